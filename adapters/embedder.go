@@ -0,0 +1,65 @@
+// Package adapters exposes hugot pipelines through the interfaces of other Go frameworks. The adapters
+// satisfy those interfaces structurally, so hugot does not depend on the frameworks.
+package adapters
+
+import (
+	"context"
+	"errors"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// Embedder embeds texts with a feature extraction pipeline. It implements the embeddings.Embedder and
+// embeddings.EmbedderClient interfaces of langchaingo, so local ONNX models can be used as drop-in
+// embedders in langchaingo vector stores and retrievers. With Firebase Genkit, EmbedDocuments can back
+// an embedder defined with genkit.DefineEmbedder.
+type Embedder struct {
+	Pipeline  *pipelines.FeatureExtractionPipeline
+	BatchSize int // number of texts embedded in a single pipeline run
+}
+
+// NewEmbedder creates an embedder backed by a feature extraction pipeline. The pipeline should produce
+// sentence embeddings, and usually be created with the pipelines.WithNormalization option.
+func NewEmbedder(pipeline *pipelines.FeatureExtractionPipeline) *Embedder {
+	return &Embedder{
+		Pipeline:  pipeline,
+		BatchSize: 32,
+	}
+}
+
+// EmbedDocuments embeds a list of documents, in batches.
+func (e *Embedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	if e.Pipeline == nil {
+		return nil, errors.New("the embedder has no pipeline")
+	}
+	batchSize := e.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(texts)
+	}
+	embeddings := make([][]float32, 0, len(texts))
+	for batchStart := 0; batchStart < len(texts); batchStart += batchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		output, err := e.Pipeline.RunPipeline(texts[batchStart:min(batchStart+batchSize, len(texts))])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, output.Embeddings...)
+	}
+	return embeddings, nil
+}
+
+// EmbedQuery embeds a single query.
+func (e *Embedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	embeddings, err := e.EmbedDocuments(ctx, []string{text})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// CreateEmbedding embeds a list of texts, like EmbedDocuments.
+func (e *Embedder) CreateEmbedding(ctx context.Context, texts []string) ([][]float32, error) {
+	return e.EmbedDocuments(ctx, texts)
+}
@@ -0,0 +1,92 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// LLM generates the replies of a chat pipeline. The llms.Model interface of langchaingo and the models of Firebase
+// Genkit take values of their own packages, e.g. llms.MessageContent and llms.CallOption, so unlike the Embedder
+// they cannot be implemented structurally: LLM takes the roles, texts and decoding options these values carry, and
+// a langchaingo model or a model defined with genkit.DefineModel is a thin wrapper around Generate.
+type LLM struct {
+	Pipeline *pipelines.ChatPipeline
+}
+
+// CallOptions are the decoding options of a call, with the names and types of the fields of the llms.CallOptions
+// of langchaingo. Zero values keep the settings of the pipeline.
+type CallOptions struct {
+	MaxTokens         int
+	Temperature       float64
+	TopK              int
+	TopP              float64
+	Seed              int
+	RepetitionPenalty float64
+}
+
+// NewLLM creates an LLM backed by a chat pipeline.
+func NewLLM(pipeline *pipelines.ChatPipeline) *LLM {
+	return &LLM{Pipeline: pipeline}
+}
+
+// Call generates the reply of the assistant to a single user prompt.
+func (l *LLM) Call(ctx context.Context, prompt string, options CallOptions) (string, error) {
+	return l.Generate(ctx, []pipelines.ChatMessage{{Role: "user", Content: prompt}}, options)
+}
+
+// Generate generates the reply of the assistant to a conversation. The roles of langchaingo (human, ai) and of
+// Genkit (model) are mapped to the ones of chat templates (user, assistant).
+func (l *LLM) Generate(ctx context.Context, messages []pipelines.ChatMessage, options CallOptions) (string, error) {
+	if l.Pipeline == nil {
+		return "", errors.New("the LLM has no pipeline")
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	conversation := make([]pipelines.ChatMessage, len(messages))
+	for i, message := range messages {
+		conversation[i] = pipelines.ChatMessage{Role: ChatRole(message.Role), Content: message.Content}
+	}
+	output, err := l.Pipeline.RunConversations([][]pipelines.ChatMessage{conversation}, options.GenerationOptions()...)
+	if err != nil {
+		return "", err
+	}
+	return output.Replies[0].Content, nil
+}
+
+// ChatRole returns the role of chat templates for the role of a message of langchaingo or Genkit.
+func ChatRole(role string) string {
+	switch role {
+	case "human":
+		return "user"
+	case "ai", "model":
+		return "assistant"
+	}
+	return role
+}
+
+// GenerationOptions returns the generation options of the pipeline for the options that are set.
+func (o CallOptions) GenerationOptions() []pipelines.GenerationOption {
+	var options []pipelines.GenerationOption
+	if o.MaxTokens > 0 {
+		options = append(options, pipelines.GenerateWithMaxTokens(o.MaxTokens))
+	}
+	if o.Temperature > 0 {
+		options = append(options, pipelines.GenerateWithTemperature(float32(o.Temperature)))
+	}
+	if o.TopK > 0 {
+		options = append(options, pipelines.GenerateWithTopK(o.TopK))
+	}
+	if o.TopP > 0 {
+		options = append(options, pipelines.GenerateWithTopP(float32(o.TopP)))
+	}
+	if o.Seed != 0 {
+		options = append(options, pipelines.GenerateWithSeed(int64(o.Seed)))
+	}
+	if o.RepetitionPenalty > 0 {
+		options = append(options, pipelines.GenerateWithRepetitionPenalty(float32(o.RepetitionPenalty)))
+	}
+	return options
+}
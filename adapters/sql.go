@@ -0,0 +1,177 @@
+package adapters
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// ScoredRow is a row of a query result along with the pipeline output for its text column.
+type ScoredRow struct {
+	Values map[string]any // column values of the row, text values are returned as strings
+	Output any            // pipeline output for the text of the row, nil if the text is NULL
+}
+
+// ScoreRows runs the pipeline on the text column of the query result rows, in batches of batchSize, and streams
+// the scored rows to callback one batch at a time, so that large tables can be enriched without loading them in memory.
+// The rows are closed when ScoreRows returns.
+func ScoreRows(ctx context.Context, rows *sql.Rows, textColumn string, pipeline pipelines.Pipeline, batchSize int, callback func([]ScoredRow) error) (err error) {
+	defer func() {
+		err = errors.Join(err, rows.Close())
+	}()
+	if batchSize <= 0 {
+		return errors.New("batch size must be greater than zero")
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	textIndex := -1
+	for i, column := range columns {
+		if column == textColumn {
+			textIndex = i
+		}
+	}
+	if textIndex < 0 {
+		return fmt.Errorf("column %s is not in the query result, columns are: %s", textColumn, strings.Join(columns, ", "))
+	}
+
+	batch := make([]ScoredRow, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var texts []string
+		var scored []int
+		for i, row := range batch {
+			if text, ok := row.Values[textColumn].(string); ok {
+				texts = append(texts, text)
+				scored = append(scored, i)
+			}
+		}
+		if len(texts) > 0 {
+			output, runErr := pipeline.Run(texts)
+			if runErr != nil {
+				return runErr
+			}
+			for i, result := range output.GetOutput() {
+				batch[scored[i]].Output = result
+			}
+		}
+		if callbackErr := callback(batch); callbackErr != nil {
+			return callbackErr
+		}
+		batch = make([]ScoredRow, 0, batchSize)
+		return nil
+	}
+
+	for rows.Next() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			return err
+		}
+		row := ScoredRow{Values: make(map[string]any, len(columns))}
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row.Values[column] = values[i]
+		}
+		batch = append(batch, row)
+		if len(batch) == batchSize {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// TableWriter writes scored rows to a table, e.g. as the callback of ScoreRows. Each batch is inserted in a
+// single transaction, with the values of KeyColumns copied from the rows and the pipeline output stored as
+// JSON in OutputColumn, or NULL for rows with a NULL text.
+type TableWriter struct {
+	DB           *sql.DB
+	Table        string
+	KeyColumns   []string
+	OutputColumn string
+	Placeholder  func(n int) string // placeholder of the n-th parameter (1-based), e.g. "?" for MySQL and SQLite or "$n" for PostgreSQL
+}
+
+// NewTableWriter creates a table writer using ? placeholders. Set Placeholder for other databases.
+func NewTableWriter(db *sql.DB, table string, keyColumns []string, outputColumn string) *TableWriter {
+	return &TableWriter{
+		DB:           db,
+		Table:        table,
+		KeyColumns:   keyColumns,
+		OutputColumn: outputColumn,
+		Placeholder:  func(int) string { return "?" },
+	}
+}
+
+// Write inserts a batch of scored rows in a single transaction.
+func (w *TableWriter) Write(ctx context.Context, rows []ScoredRow) (err error) {
+	columns := append(append([]string{}, w.KeyColumns...), w.OutputColumn)
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = w.Placeholder(i + 1)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", w.Table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+
+	tx, err := w.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); !errors.Is(rollbackErr, sql.ErrTxDone) {
+				err = errors.Join(err, rollbackErr)
+			}
+		}
+	}()
+	statement, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, statement.Close())
+	}()
+	for _, row := range rows {
+		args := make([]any, 0, len(columns))
+		for _, column := range w.KeyColumns {
+			value, ok := row.Values[column]
+			if !ok {
+				return fmt.Errorf("column %s is not in the scored row", column)
+			}
+			args = append(args, value)
+		}
+		if row.Output == nil {
+			args = append(args, nil)
+		} else {
+			output, marshalErr := json.Marshal(row.Output)
+			if marshalErr != nil {
+				return marshalErr
+			}
+			args = append(args, string(output))
+		}
+		if _, err = statement.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stdinSource is the input source of the inputs read from stdin.
+const stdinSource = "stdin"
+
+// checkpoint records, in a local file, for each input source how many input lines have been processed and written.
+// Local input files are recorded by their absolute path, so that a run resumes them however the path is written.
+// An interrupted run started again with the same checkpoint skips the lines already processed.
+// Since outputs are written before the checkpoint is saved, a line can be written twice if the
+// process is interrupted in between, but a line is never lost.
+type checkpoint struct {
+	Offsets   map[string]int `json:"offsets"`
+	path      string
+	interval  time.Duration
+	lastSaved time.Time
+	mutex     sync.Mutex
+}
+
+func loadCheckpoint(path string, interval time.Duration) (*checkpoint, error) {
+	cp := &checkpoint{
+		Offsets:   map[string]int{},
+		path:      path,
+		interval:  interval,
+		lastSaved: time.Now(),
+	}
+	if path == "" {
+		return cp, nil
+	}
+	checkpointBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(checkpointBytes, cp); err != nil {
+		return nil, err
+	}
+	// checkpoints may record the same file under several paths
+	offsets := cp.Offsets
+	cp.Offsets = map[string]int{}
+	for source, position := range offsets {
+		key := checkpointKey(source)
+		cp.Offsets[key] = max(cp.Offsets[key], position)
+	}
+	return cp, nil
+}
+
+// checkpointKey returns the key of source in the checkpoint: the cleaned absolute path of local files, and the
+// source as is for stdin and remote files.
+func checkpointKey(source string) string {
+	if source == stdinSource || strings.Contains(source, "://") {
+		return source
+	}
+	absolutePath, err := filepath.Abs(source)
+	if err != nil {
+		return filepath.Clean(source)
+	}
+	return absolutePath
+}
+
+// offset returns the number of lines of source that were already processed.
+func (c *checkpoint) offset(source string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Offsets[checkpointKey(source)]
+}
+
+// advance records that the first position lines of source have been processed,
+// and saves the checkpoint if the checkpoint interval has elapsed.
+func (c *checkpoint) advance(source string, position int) error {
+	key := checkpointKey(source)
+	c.mutex.Lock()
+	if position > c.Offsets[key] {
+		c.Offsets[key] = position
+	}
+	saveDue := time.Since(c.lastSaved) >= c.interval
+	c.mutex.Unlock()
+	if saveDue {
+		return c.save()
+	}
+	return nil
+}
+
+// save writes the checkpoint to its path. The checkpoint is first written to a temporary
+// file and then moved, so that an interruption while saving does not corrupt it.
+func (c *checkpoint) save() error {
+	if c.path == "" {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	checkpointBytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	if err = os.WriteFile(tmpPath, checkpointBytes, 0o600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, c.path); err != nil {
+		return err
+	}
+	c.lastSaved = time.Now()
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/knights-analytics/hugot"
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+var doctorJSON bool
+
+var doctorCommand = &cli.Command{
+	Name:  "doctor",
+	Usage: "Check that the environment can run hugot",
+	Description: `Doctor checks that the onnxruntime library can be loaded and is recent enough, that the tokenizers library works, which execution providers (CUDA, CoreML) are available, and that the given models can be parsed, then prints a report. It exits with an error if any check fails.
+				`,
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "model",
+			Usage:   "Path to a model folder or .onnx file to check. Can be repeated",
+			Aliases: []string{"p"},
+		},
+		&cli.StringFlag{
+			Name:        "onnxruntimeSharedLibrary",
+			Usage:       "Path to onnxruntime.so",
+			Aliases:     []string{"s"},
+			Destination: &sharedLibraryPath,
+			Required:    false,
+		},
+		&cli.StringSliceFlag{
+			Name:  "executionProvider",
+			Usage: "Execution provider to check, e.g. CUDA, CoreML, DirectML, OpenVINO or TensorRT. Defaults to CUDA and CoreML",
+		},
+		&cli.BoolFlag{
+			Name:        "json",
+			Usage:       "Print the report as json",
+			Destination: &doctorJSON,
+			Required:    false,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		libraryPath := sharedLibraryPath
+		if libraryPath == "" {
+			// same fallback as the run command
+			if homeDir, err := os.UserHomeDir(); err == nil {
+				homeLibraryPath := path.Join(homeDir, "lib", "hugot", "onnxruntime.so")
+				if exists, existsErr := util.FileSystem.Exists(ctx.Context, homeLibraryPath); existsErr == nil && exists {
+					libraryPath = homeLibraryPath
+				}
+			}
+		}
+
+		report := hugot.Doctor(hugot.DoctorOptions{
+			OnnxLibraryPath:    libraryPath,
+			ModelPaths:         ctx.StringSlice("model"),
+			ExecutionProviders: ctx.StringSlice("executionProvider"),
+		})
+		if doctorJSON {
+			reportJSON, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(reportJSON))
+		} else {
+			fmt.Print(report.String())
+		}
+		if !report.OK() {
+			return errors.New("preflight checks failed")
+		}
+		return nil
+	},
+}
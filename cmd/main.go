@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/urfave/cli/v2"
@@ -28,6 +29,12 @@ var pipelineType string
 var sharedLibraryPath string
 var batchSize int
 var modelsDir string
+var checkpointPath string
+var checkpointInterval int
+var fileWorkers int
+var showProgress bool
+var filterExpression string
+var outputFilter *util.Filter
 
 var runCommand = &cli.Command{
 	Name:  "run",
@@ -35,12 +42,16 @@ var runCommand = &cli.Command{
 	Description: `Run expects a path to a file with input in .jsonl format. Each json line in the file must be of the format {"input": "input string"} to be processed.
 				`,
 	ArgsUsage: `
-				--input: path to a .jsonl file or a folder with .jsonl files to process. If omitted, the input will be read from stdin.
+				--input: path to a .jsonl file, a folder with .jsonl files, or a glob pattern (e.g. "data/*.jsonl") to process. If omitted, the input will be read from stdin.
 				--output: path to a folder where to write the output. If omitted, the output will be sent to stdout.
 				--model: model name or path to the .onnx model to load. The hugot cli looks for models with this chain: first use the provided path. If the path does not exist, look for a model
 				with this name at $HOME/hugot/models. Finally, try to download the model from Huggingface and use it.
-				--type: pipeline type. Currently implemented types are: featureExtraction, tokenClassification, and textClassification (only single label)
+				--type: pipeline type. Currently implemented types are: featureExtraction, tokenClassification, textClassification (only single label), qualityScoring (a single quality score per input from a quality classifier, to be combined with --filter, e.g. --filter='score >= 3'), and maskedLMScoring (the pseudo-perplexity of each input under a masked language model, e.g. --filter='pseudoPerplexity < 20')
 				--onnxruntimeSharedLibrary: path to the onnxruntime.so library. If not provided, the cli will try to load it from $HOME/lib/hugot/onnxruntime.so, and from /usr/lib/onnxruntime.so in the last instance.
+				--fileWorkers: number of input files processed in parallel. All workers share the same loaded pipeline, and an error in one file does not stop the others. When several files are processed, each output has the path of its input file in "source".
+				--filter: only emit outputs that match a filter expression, e.g. 'score >= 0.8 && label != "neutral"'. Fields of the outputs (case-insensitive) are compared with strings, numbers or booleans using ==, !=, <, <=, >, >=, and combined with &&, || and !. For pipelines returning a list of results per input (e.g. entities), the list is filtered, and inputs left without results are not emitted.
+				--progress: periodically report the number of processed inputs, the throughput and, when reading from files, the estimated time remaining on stderr.
+				--checkpoint: path to a local checkpoint file. Progress is periodically recorded there, and a run interrupted midway resumes from the last checkpoint when started again with the same file.
 				`,
 	Flags: []cli.Flag{
 		&cli.StringFlag{
@@ -92,6 +103,42 @@ var runCommand = &cli.Command{
 			Required:    false,
 			Value:       "",
 		},
+		&cli.StringFlag{
+			Name:        "checkpoint",
+			Usage:       "Path to a local file where progress is recorded, so that an interrupted run can be resumed",
+			Aliases:     []string{"c"},
+			Destination: &checkpointPath,
+			Required:    false,
+			Value:       "",
+		},
+		&cli.IntFlag{
+			Name:        "fileWorkers",
+			Usage:       "Number of input files to process in parallel with the shared pipeline",
+			Aliases:     []string{"w"},
+			Destination: &fileWorkers,
+			Required:    false,
+			Value:       1,
+		},
+		&cli.StringFlag{
+			Name:        "filter",
+			Usage:       `Only emit outputs matching the expression, e.g. 'score >= 0.8 && label != "neutral"'`,
+			Destination: &filterExpression,
+			Required:    false,
+			Value:       "",
+		},
+		&cli.BoolFlag{
+			Name:        "progress",
+			Usage:       "Periodically report the number of processed inputs and the estimated time remaining on stderr",
+			Destination: &showProgress,
+			Required:    false,
+		},
+		&cli.IntFlag{
+			Name:        "checkpointInterval",
+			Usage:       "Seconds between checkpoint saves",
+			Destination: &checkpointInterval,
+			Required:    false,
+			Value:       30,
+		},
 	},
 	Action: func(ctx *cli.Context) error {
 		var opts []hugot.WithOption
@@ -120,6 +167,14 @@ var runCommand = &cli.Command{
 			return err
 		}
 
+		outputFilter = nil
+		if filterExpression != "" {
+			outputFilter, err = util.ParseFilter(filterExpression)
+			if err != nil {
+				return err
+			}
+		}
+
 		var setupErrs []error
 
 		defer func() {
@@ -174,6 +229,28 @@ var runCommand = &cli.Command{
 			}
 			pipe, err = hugot.NewPipeline(session, config)
 			setupErrs = append(setupErrs, err)
+		case "qualityScoring":
+			config := hugot.TextClassificationConfig{
+				ModelPath: modelPath,
+				Name:      "cliPipeline",
+			}
+			classifier, classifierErr := hugot.NewPipeline(session, config)
+			setupErrs = append(setupErrs, classifierErr)
+			if classifierErr == nil {
+				pipe, err = pipelines.NewQualityScoringPipeline(classifier, nil)
+				setupErrs = append(setupErrs, err)
+			}
+		case "maskedLMScoring":
+			config := hugot.FillMaskConfig{
+				ModelPath: modelPath,
+				Name:      "cliPipeline",
+			}
+			fillMask, fillMaskErr := hugot.NewPipeline(session, config)
+			setupErrs = append(setupErrs, fillMaskErr)
+			if fillMaskErr == nil {
+				pipe, err = pipelines.NewMaskedLMScoringPipeline(fillMask, 0)
+				setupErrs = append(setupErrs, err)
+			}
 		case "featureExtraction":
 			config := hugot.FeatureExtractionConfig{
 				ModelPath: modelPath,
@@ -188,17 +265,15 @@ var runCommand = &cli.Command{
 			return e
 		}
 
-		inputChannel := make(chan []input, 1000)
-		processedChannel := make(chan []byte, 1000)
+		cp, err := loadCheckpoint(checkpointPath, time.Duration(checkpointInterval)*time.Second)
+		if err != nil {
+			return err
+		}
+
+		processedChannel := make(chan processedOutput, 1000)
 		errorsChannel := make(chan error, 1000)
 		nWriteWorkers := 1
-		nProcessWorkers := 1
-		var processedWg, writeWg sync.WaitGroup
-
-		for i := 0; i < nProcessWorkers; i++ {
-			go processWithPipeline(&processedWg, inputChannel, processedChannel, errorsChannel, pipe)
-			processedWg.Add(1)
-		}
+		var writeWg sync.WaitGroup
 
 		var writers []struct {
 			Writer io.WriteCloser
@@ -226,7 +301,7 @@ var runCommand = &cli.Command{
 				Type:   "stdout",
 			})
 			writeWg.Add(1)
-			go writeOutputs(&writeWg, processedChannel, errorsChannel, writer)
+			go writeOutputs(&writeWg, processedChannel, errorsChannel, writer, cp)
 		}
 
 		defer func() {
@@ -237,50 +312,55 @@ var runCommand = &cli.Command{
 			}
 		}()
 
-		// read inputs
+		// read and process inputs
 
-		exists, err := util.FileSystem.Exists(ctx.Context, inputPath)
-		if err != nil {
-			return err
+		progress := &inputProgress{start: time.Now()}
+		if showProgress {
+			stopProgress := progress.reportEvery(10 * time.Second)
+			defer stopProgress()
 		}
-		exists = inputPath != "" && exists
-
-		if exists {
-			fileWalker := func(_ context.Context, _ string, _ string, info os.FileInfo, reader io.Reader) (toContinue bool, err error) {
-				extension := filepath.Ext(info.Name())
-				if extension == ".jsonl" {
-					err := readInputs(reader, inputChannel)
-					if err != nil {
-						return false, err
-					}
+
+		if inputPath != "" {
+			inputFiles, listErr := listInputFiles(ctx.Context, inputPath)
+			if listErr != nil {
+				return listErr
+			}
+			for _, inputFile := range inputFiles {
+				size, sizeErr := util.FileSize(inputFile)
+				if sizeErr != nil {
+					return sizeErr
 				}
-				return true, nil
+				progress.totalBytes += size
 			}
+			filesProgress := &fileProgress{total: len(inputFiles)}
+			fileChannel := make(chan string, len(inputFiles))
+			for _, inputFile := range inputFiles {
+				fileChannel <- inputFile
+			}
+			close(fileChannel)
 
-			err := util.FileSystem.Walk(ctx.Context, inputPath, fileWalker)
-			if err != nil {
-				return err
+			var processWg sync.WaitGroup
+			for i := 0; i < max(1, fileWorkers); i++ {
+				processWg.Add(1)
+				go processFiles(&processWg, fileChannel, processedChannel, errorsChannel, pipe, cp, progress, filesProgress, len(inputFiles) > 1)
 			}
-		} else {
-			if inputPath != "" {
-				return fmt.Errorf("file %s does not exist", inputPath)
+			processWg.Wait()
+			if len(inputFiles) > 1 {
+				filesProgress.report()
 			}
-
-			if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
-				// there is something to process on stdin
-				err := readInputs(os.Stdin, inputChannel)
-				if err != nil {
-					return err
-				}
+		} else if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+			// there is something to process on stdin
+			batches := &batchProcessor{processedChannel: processedChannel, errorsChannel: errorsChannel, pipeline: pipe}
+			readErr := readInputs(os.Stdin, stdinSource, cp, progress, batches.process)
+			if readErr != nil {
+				return readErr
 			}
 		}
 
-		close(inputChannel)
-		processedWg.Wait()
 		close(processedChannel)
 		close(errorsChannel)
 		writeWg.Wait()
-		return err
+		return errors.Join(err, cp.save())
 	},
 }
 
@@ -288,34 +368,42 @@ func main() {
 	app := &cli.App{
 		Name:     "hugot",
 		Usage:    "Huggingface transformers from the command line - alpha",
-		Commands: []*cli.Command{runCommand},
+		Commands: []*cli.Command{runCommand, doctorCommand},
 	}
 	if err := app.Run(os.Args); err != nil {
 		panic(err)
 	}
 }
 
-func writeOutputs(wg *sync.WaitGroup, processedChannel chan []byte, errorChannel chan error, writeTarget io.WriteCloser) {
+func writeOutputs(wg *sync.WaitGroup, processedChannel chan processedOutput, errorChannel chan error, writeTarget io.WriteCloser, cp *checkpoint) {
 	for processedChannel != nil || errorChannel != nil {
 		select {
 		case output, ok := <-processedChannel:
 			if !ok {
 				processedChannel = nil
+				continue
 			}
-			_, err := writeTarget.Write(output)
-			if err != nil {
-				panic(err)
+			if output.output != nil {
+				_, err := writeTarget.Write(output.output)
+				if err != nil {
+					panic(err)
+				}
+				_, err = writeTarget.Write([]byte("\n"))
+				if err != nil {
+					panic(err)
+				}
 			}
-			_, err = writeTarget.Write([]byte("\n"))
-			if err != nil {
-				panic(err)
+			if output.position > 0 {
+				if err := cp.advance(output.source, output.position); err != nil {
+					panic(err)
+				}
 			}
 		case err, ok := <-errorChannel:
 			if !ok {
 				errorChannel = nil
 			}
 			if err != nil {
-				_, err = os.Stderr.WriteString(err.Error())
+				_, err = os.Stderr.WriteString(err.Error() + "\n")
 				if err != nil {
 					panic(err)
 				}
@@ -325,56 +413,240 @@ func writeOutputs(wg *sync.WaitGroup, processedChannel chan []byte, errorChannel
 	wg.Done()
 }
 
-func processWithPipeline(wg *sync.WaitGroup, inputChannel chan []input, processedChannel chan []byte, errorsChannel chan error, p pipelines.Pipeline) {
-	for inputBatch := range inputChannel {
-		inputStrings := make([]string, len(inputBatch))
-		for i := 0; i < len(inputBatch); i++ {
-			inputStrings[i] = inputBatch[i].Input
+// listInputFiles returns the files to process for the --input argument, which can be a .jsonl file,
+// a folder that is searched recursively for .jsonl files, or a glob pattern matching either of these.
+func listInputFiles(ctx context.Context, inputPath string) ([]string, error) {
+	exists, err := util.FileSystem.Exists(ctx, inputPath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		matches, globErr := filepath.Glob(inputPath)
+		if globErr != nil {
+			return nil, globErr
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("file %s does not exist", inputPath)
 		}
-		output, err := p.Run(inputStrings)
+		var inputFiles []string
+		for _, match := range matches {
+			matchFiles, matchErr := listInputFiles(ctx, match)
+			if matchErr != nil {
+				return nil, matchErr
+			}
+			inputFiles = append(inputFiles, matchFiles...)
+		}
+		return inputFiles, nil
+	}
+
+	object, err := util.FileSystem.Object(ctx, inputPath)
+	if err != nil {
+		return nil, err
+	}
+	if !object.IsDir() {
+		return []string{inputPath}, nil
+	}
+
+	var inputFiles []string
+	fileWalker := func(_ context.Context, _ string, parent string, info os.FileInfo, _ io.Reader) (toContinue bool, err error) {
+		if !info.IsDir() && filepath.Ext(info.Name()) == ".jsonl" {
+			inputFiles = append(inputFiles, util.PathJoinSafe(inputPath, parent, info.Name()))
+		}
+		return true, nil
+	}
+	err = util.FileSystem.Walk(ctx, inputPath, fileWalker)
+	return inputFiles, err
+}
+
+// processFiles processes the input files received on fileChannel with the shared pipeline.
+// An error in one file is reported and does not stop the processing of the other files. With tagSource, the
+// outputs of all files are written together, and each output has the path of its input file.
+func processFiles(wg *sync.WaitGroup, fileChannel chan string, processedChannel chan processedOutput, errorsChannel chan error, p pipelines.Pipeline, cp *checkpoint, progress *inputProgress, filesProgress *fileProgress, tagSource bool) {
+	for inputFile := range fileChannel {
+		err := processFile(inputFile, processedChannel, errorsChannel, p, cp, progress, tagSource)
 		if err != nil {
-			errorsChannel <- err
+			errorsChannel <- fmt.Errorf("processing of %s failed: %w", inputFile, err)
+		}
+		filesProgress.fileDone(err)
+	}
+	wg.Done()
+}
+
+func processFile(inputFile string, processedChannel chan processedOutput, errorsChannel chan error, p pipelines.Pipeline, cp *checkpoint, progress *inputProgress, tagSource bool) (err error) {
+	reader, err := util.FileSystem.OpenURL(context.Background(), inputFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, reader.Close())
+	}()
+	batches := &batchProcessor{processedChannel: processedChannel, errorsChannel: errorsChannel, pipeline: p, tagSource: tagSource}
+	if err = readInputs(reader, inputFile, cp, progress, batches.process); err != nil {
+		return err
+	}
+	if batches.failed > 0 {
+		return fmt.Errorf("%d batches failed", batches.failed)
+	}
+	return nil
+}
+
+// batchProcessor processes the batches of an input source in order, and moves the checkpoint of the source past
+// each batch whose inputs were all processed. The checkpoint stops at the first batch with an error, so that a
+// resumed run processes that batch and the ones after it again. Each source has its own batchProcessor, so that
+// with several file workers a failing file does not hold back the checkpoints of the others.
+type batchProcessor struct {
+	processedChannel chan processedOutput
+	errorsChannel    chan error
+	pipeline         pipelines.Pipeline
+	tagSource        bool // write the source of each input with its output
+	failed           int  // number of batches with an error
+}
+
+func (b *batchProcessor) process(inputBatch []input) {
+	if b.tagSource {
+		for i := range inputBatch {
+			inputBatch[i].Source = inputBatch[i].source
+		}
+	}
+	if !processBatch(inputBatch, b.processedChannel, b.errorsChannel, b.pipeline) {
+		b.failed++
+	}
+	if b.failed == 0 {
+		// once the outputs of the batch are written, the checkpoint can move past it
+		last := inputBatch[len(inputBatch)-1]
+		b.processedChannel <- processedOutput{source: last.source, position: last.line + 1}
+	}
+}
+
+// processBatch runs the pipeline on a batch of inputs and sends their outputs to be written. It returns whether
+// every input was processed, errors being sent to errorsChannel.
+func processBatch(inputBatch []input, processedChannel chan processedOutput, errorsChannel chan error, p pipelines.Pipeline) bool {
+	inputStrings := make([]string, len(inputBatch))
+	for i := 0; i < len(inputBatch); i++ {
+		inputStrings[i] = inputBatch[i].Input
+	}
+	output, err := p.Run(inputStrings)
+	if err != nil {
+		errorsChannel <- err
+		return false
+	}
+	ok := true
+	batchOutputs := output.GetOutput()
+	for i, batchOutput := range batchOutputs {
+		out := inputBatch[i]
+		out.Output = batchOutput
+		if outputFilter != nil {
+			filteredOutput, keep, filterErr := filterOutput(outputFilter, batchOutput)
+			if filterErr != nil {
+				errorsChannel <- filterErr
+				ok = false
+				continue
+			}
+			if !keep {
+				continue
+			}
+			out.Output = filteredOutput
+		}
+		outputBytes, marshallErr := json.Marshal(out)
+		if marshallErr != nil {
+			errorsChannel <- marshallErr
+			ok = false
 		} else {
-			batchOutputs := output.GetOutput()
-			for i, batchOutput := range batchOutputs {
-				out := inputBatch[i]
-				out.Output = batchOutput
-				outputBytes, marshallErr := json.Marshal(out)
-				if marshallErr != nil {
-					errorsChannel <- marshallErr
-				} else {
-					processedChannel <- outputBytes
-				}
+			processedChannel <- processedOutput{output: outputBytes}
+		}
+	}
+	return ok
+}
+
+// filterOutput applies the filter to the output of the pipeline for an input. If the output is a list of
+// results, the results not matching the filter are removed from it. It returns false if nothing in the
+// output matches the filter.
+func filterOutput(filter *util.Filter, output any) (any, bool, error) {
+	outputBytes, err := json.Marshal(output)
+	if err != nil {
+		return nil, false, err
+	}
+	var genericOutput any
+	if err = json.Unmarshal(outputBytes, &genericOutput); err != nil {
+		return nil, false, err
+	}
+
+	switch v := genericOutput.(type) {
+	case map[string]any:
+		match, matchErr := filter.Match(v)
+		return v, match, matchErr
+	case []any:
+		filtered := make([]any, 0, len(v))
+		for _, result := range v {
+			fields, ok := result.(map[string]any)
+			if !ok {
+				return nil, false, fmt.Errorf("filter %s cannot be applied to outputs of type %T", filter, output)
+			}
+			match, matchErr := filter.Match(fields)
+			if matchErr != nil {
+				return nil, false, matchErr
+			}
+			if match {
+				filtered = append(filtered, result)
 			}
 		}
+		return filtered, len(filtered) > 0, nil
+	default:
+		return nil, false, fmt.Errorf("filter %s cannot be applied to outputs of type %T", filter, output)
 	}
-	wg.Done()
 }
 
-func readInputs(inputSource io.Reader, inputChannel chan []input) error {
-	inputBatch := make([]input, 0, 20)
+// readInputs reads the json lines of inputSource in batches of batchSize, skipping the lines
+// already processed according to the checkpoint, and calls processBatch on each batch.
+func readInputs(inputSource io.Reader, source string, cp *checkpoint, progress *inputProgress, processBatch func([]input)) error {
+	inputBatch := make([]input, 0, batchSize)
+	batchBytes := 0
+	skip := cp.offset(source)
 
 	scanner := bufio.NewScanner(inputSource)
+	lineNumber := -1
 	for scanner.Scan() {
+		lineNumber++
+		if lineNumber < skip {
+			progress.skip(len(scanner.Bytes()) + 1)
+			continue
+		}
 		var line input
 		err := json.Unmarshal(scanner.Bytes(), &line)
 		if err != nil {
 			return err
 		}
+		line.source = source
+		line.line = lineNumber
 		inputBatch = append(inputBatch, line)
+		batchBytes += len(scanner.Bytes()) + 1
 		if len(inputBatch) == batchSize {
-			inputChannel <- inputBatch
-			inputBatch = []input{}
+			processBatch(inputBatch)
+			progress.add(len(inputBatch), batchBytes)
+			inputBatch = make([]input, 0, batchSize)
+			batchBytes = 0
 		}
 	}
 	// flush
 	if len(inputBatch) > 0 {
-		inputChannel <- inputBatch
+		processBatch(inputBatch)
+		progress.add(len(inputBatch), batchBytes)
 	}
-	return nil
+	return scanner.Err()
 }
 
 type input struct {
 	Input  string `json:"input"`
 	Output any    `json:"output"`
+	Source string `json:"source,omitempty"` // set when the outputs of several input files are written together
+	source string
+	line   int
+}
+
+// processedOutput is either a marshalled output to write, or a position in an input source up to
+// which all outputs have been sent to the writer.
+type processedOutput struct {
+	output   []byte
+	source   string
+	position int
 }
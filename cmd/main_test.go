@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/urfave/cli/v2"
 
+	"github.com/knights-analytics/hugot/pipelines"
 	util "github.com/knights-analytics/hugot/utils"
 )
 
@@ -109,6 +119,381 @@ func TestFeatureExtractionCli(t *testing.T) {
 	fmt.Println(string(result))
 }
 
+func TestFilterCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{runCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testModel := path.Join("../models", "KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english")
+
+	testDataDir := path.Join(os.TempDir(), "hugoTestData")
+	err := os.MkdirAll(testDataDir, os.ModePerm)
+	check(t, err)
+	inputFile := path.Join(testDataDir, "test-filter.jsonl")
+	err = os.WriteFile(inputFile, textClassificationData, os.ModePerm)
+	check(t, err)
+	defer func() {
+		err := os.RemoveAll(testDataDir)
+		check(t, err)
+	}()
+
+	args := append(baseArgs, "run", fmt.Sprintf("--input=%s", inputFile), fmt.Sprintf("--model=%s", testModel),
+		"--type=textClassification", fmt.Sprintf("--output=%s", testDataDir), `--filter=label == "POSITIVE" && score > 0.5`)
+	if err := app.Run(args); err != nil {
+		check(t, err)
+	}
+	result, err := os.ReadFile(path.Join(testDataDir, "result-0.jsonl"))
+	check(t, err)
+	lines := strings.Split(strings.TrimSpace(string(result)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "The film was excellent") {
+		t.Fatalf("expected only the positive input to be emitted, got %s", string(result))
+	}
+}
+
+func TestMaskedLMScoringCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{runCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testModel := path.Join("../models", "Xenova_bert-base-uncased")
+
+	testDataDir := path.Join(os.TempDir(), "hugoTestData")
+	err := os.MkdirAll(testDataDir, os.ModePerm)
+	check(t, err)
+	inputFile := path.Join(testDataDir, "test-masked-lm-scoring.jsonl")
+	err = os.WriteFile(inputFile, []byte("{\"input\": \"the cat sat on the mat.\"}\n{\"input\": \"mat the on sat cat the.\"}\n"), os.ModePerm)
+	check(t, err)
+	defer func() {
+		err := os.RemoveAll(testDataDir)
+		check(t, err)
+	}()
+	readScores := func() map[string]pipelines.MaskedLMScore {
+		result, err := os.ReadFile(path.Join(testDataDir, "result-0.jsonl"))
+		check(t, err)
+		scores := map[string]pipelines.MaskedLMScore{}
+		for _, line := range strings.Split(strings.TrimSpace(string(result)), "\n") {
+			var scored struct {
+				Input  string                  `json:"input"`
+				Output pipelines.MaskedLMScore `json:"output"`
+			}
+			check(t, json.Unmarshal([]byte(line), &scored))
+			scores[scored.Input] = scored.Output
+		}
+		return scores
+	}
+
+	args := append(baseArgs, "run", fmt.Sprintf("--input=%s", inputFile), fmt.Sprintf("--model=%s", testModel),
+		"--type=maskedLMScoring", fmt.Sprintf("--output=%s", testDataDir))
+	check(t, app.Run(args))
+	scores := readScores()
+	assert.Len(t, scores, 2)
+	fluent, scrambled := scores["the cat sat on the mat."], scores["mat the on sat cat the."]
+	assert.Len(t, fluent.TokenScores, 7)
+	assert.Len(t, scrambled.TokenScores, 7)
+	assert.Less(t, fluent.PseudoPerplexity, scrambled.PseudoPerplexity)
+
+	// the scores can be filtered on
+	threshold := (fluent.PseudoPerplexity + scrambled.PseudoPerplexity) / 2
+	args = append(baseArgs, "run", fmt.Sprintf("--input=%s", inputFile), fmt.Sprintf("--model=%s", testModel),
+		"--type=maskedLMScoring", fmt.Sprintf("--output=%s", testDataDir), fmt.Sprintf("--filter=pseudoPerplexity < %f", threshold))
+	check(t, app.Run(args))
+	scores = readScores()
+	assert.Len(t, scores, 1)
+	assert.Contains(t, scores, "the cat sat on the mat.")
+}
+
+func TestParallelFilesCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{runCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testModel := path.Join("../models", "KnightsAnalytics_distilbert-NER")
+
+	testDataDir := path.Join(os.TempDir(), "hugoTestData")
+	err := os.MkdirAll(testDataDir, os.ModePerm)
+	check(t, err)
+	for i := 0; i < 3; i++ {
+		err = os.WriteFile(path.Join(testDataDir, fmt.Sprintf("test-parallel-%d.jsonl", i)), tokenClassificationData, os.ModePerm)
+		check(t, err)
+	}
+	// a malformed file should not prevent the other files from being processed
+	err = os.WriteFile(path.Join(testDataDir, "test-parallel-malformed.jsonl"), []byte("not json"), os.ModePerm)
+	check(t, err)
+	defer func() {
+		err := os.RemoveAll(testDataDir)
+		check(t, err)
+	}()
+	outputDir := path.Join(testDataDir, "output")
+
+	args := append(baseArgs, "run", fmt.Sprintf("--input=%s", path.Join(testDataDir, "test-parallel-*.jsonl")),
+		fmt.Sprintf("--model=%s", testModel), "--type=tokenClassification", fmt.Sprintf("--output=%s", outputDir), "--fileWorkers=2")
+	if err := app.Run(args); err != nil {
+		check(t, err)
+	}
+	result, err := os.ReadFile(path.Join(outputDir, "result-0.jsonl"))
+	check(t, err)
+	nLines := strings.Count(string(result), "\n")
+	expectedLines := 3*strings.Count(strings.TrimSpace(string(tokenClassificationData)), "\n") + 3
+	if nLines != expectedLines {
+		t.Fatalf("expected %d output lines, got %d", expectedLines, nLines)
+	}
+}
+
+func TestCheckpointCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{runCommand},
+	}
+	baseArgs := os.Args[0:1]
+
+	testModel := path.Join("../models", "KnightsAnalytics_distilbert-NER")
+
+	testDataDir := path.Join(os.TempDir(), "hugoTestData")
+	err := os.MkdirAll(testDataDir, os.ModePerm)
+	check(t, err)
+	inputFile := path.Join(testDataDir, "test-checkpoint.jsonl")
+	err = os.WriteFile(inputFile, tokenClassificationData, os.ModePerm)
+	check(t, err)
+	defer func() {
+		err := os.RemoveAll(testDataDir)
+		check(t, err)
+	}()
+	checkpointFile := path.Join(testDataDir, "checkpoint.json")
+	outputDir := path.Join(testDataDir, "output")
+
+	args := append(baseArgs, "run", fmt.Sprintf("--input=%s", inputFile), fmt.Sprintf("--model=%s", testModel),
+		"--type=tokenClassification", fmt.Sprintf("--output=%s", outputDir), fmt.Sprintf("--checkpoint=%s", checkpointFile))
+	if err := app.Run(args); err != nil {
+		check(t, err)
+	}
+	result, err := os.ReadFile(path.Join(outputDir, "result-0.jsonl"))
+	check(t, err)
+	cp, err := loadCheckpoint(checkpointFile, 0)
+	check(t, err)
+	if len(cp.Offsets) != 1 {
+		t.Fatalf("expected one input source in the checkpoint, got %d", len(cp.Offsets))
+	}
+
+	// running again with the same checkpoint should not process anything
+	if err := app.Run(args); err != nil {
+		check(t, err)
+	}
+	resultResumed, err := os.ReadFile(path.Join(outputDir, "result-0.jsonl"))
+	check(t, err)
+	if string(result) != string(resultResumed) {
+		t.Fatal("inputs already in the checkpoint were processed again")
+	}
+}
+
+func TestProgressAfterResume(t *testing.T) {
+	progress := &inputProgress{start: time.Now().Add(-10 * time.Second), totalBytes: 1000}
+	progress.skip(500)
+	progress.add(10, 100)
+	// 100 bytes were processed in 10s, the remaining 400 bytes take 40s
+	message := progress.String()
+	assert.Contains(t, message, "Processed 10 inputs")
+	assert.Contains(t, message, "60.0% of input read, estimated time remaining 40s")
+}
+
+// failingPipeline returns its inputs as outputs, and fails on batches with an input containing "fail".
+type failingPipeline struct{}
+
+type failingPipelineOutput struct {
+	outputs []string
+}
+
+func (o *failingPipelineOutput) GetOutput() []any {
+	out := make([]any, len(o.outputs))
+	for i, output := range o.outputs {
+		out[i] = output
+	}
+	return out
+}
+
+func (p *failingPipeline) Destroy() error     { return nil }
+func (p *failingPipeline) GetStats() []string { return nil }
+func (p *failingPipeline) Validate() error    { return nil }
+func (p *failingPipeline) GetMetadata() pipelines.PipelineMetadata {
+	return pipelines.PipelineMetadata{}
+}
+func (p *failingPipeline) Run(inputs []string) (pipelines.PipelineBatchOutput, error) {
+	for _, input := range inputs {
+		if strings.Contains(input, "fail") {
+			return nil, errors.New("failed batch")
+		}
+	}
+	return &failingPipelineOutput{outputs: inputs}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// processInputFiles processes input files with fileWorkers workers and the checkpoint, and returns the output lines
+// and the number of errors.
+func processInputFiles(t *testing.T, inputFiles []string, p pipelines.Pipeline, cp *checkpoint, fileWorkers int) ([]string, int) {
+	t.Helper()
+	processedChannel := make(chan processedOutput, 1000)
+	errorsChannel := make(chan error, 1000)
+	var output bytes.Buffer
+	var writeWg sync.WaitGroup
+	noErrors := make(chan error) // errors are counted rather than written
+	close(noErrors)
+	writeWg.Add(1)
+	go writeOutputs(&writeWg, processedChannel, noErrors, nopWriteCloser{&output}, cp)
+
+	fileChannel := make(chan string, len(inputFiles))
+	for _, inputFile := range inputFiles {
+		fileChannel <- inputFile
+	}
+	close(fileChannel)
+	progress := &inputProgress{start: time.Now()}
+	filesProgress := &fileProgress{total: len(inputFiles)}
+	var processWg sync.WaitGroup
+	for i := 0; i < fileWorkers; i++ {
+		processWg.Add(1)
+		go processFiles(&processWg, fileChannel, processedChannel, errorsChannel, p, cp, progress, filesProgress, len(inputFiles) > 1)
+	}
+	processWg.Wait()
+	close(processedChannel)
+	close(errorsChannel)
+	writeWg.Wait()
+	return strings.Fields(output.String()), len(errorsChannel)
+}
+
+func TestCheckpointAfterFailedBatch(t *testing.T) {
+	defaultBatchSize := batchSize
+	batchSize = 2
+	defer func() {
+		batchSize = defaultBatchSize
+	}()
+	inputFile := path.Join(t.TempDir(), "test-checkpoint-failure.jsonl")
+	lines := []string{"a", "b", "fail", "c", "d", "e"}
+	var data strings.Builder
+	for _, line := range lines {
+		data.WriteString(fmt.Sprintf(`{"input": "%s"}`+"\n", line))
+	}
+	check(t, os.WriteFile(inputFile, []byte(data.String()), os.ModePerm))
+
+	// the checkpoint stops before the failing batch, even though the batch after it succeeds
+	cp, err := loadCheckpoint("", 0)
+	check(t, err)
+	outputs, nErrors := processInputFiles(t, []string{inputFile}, &failingPipeline{}, cp, 1)
+	assert.Equal(t, 2, nErrors) // the error of the batch, and the failure of the file
+	assert.Len(t, outputs, 4)
+	assert.Equal(t, 2, cp.offset(inputFile))
+
+	// a resumed run processes the failing batch and the ones after it again
+	check(t, os.WriteFile(inputFile, []byte(strings.ReplaceAll(data.String(), "fail", "fixed")), os.ModePerm))
+	outputs, nErrors = processInputFiles(t, []string{inputFile}, &failingPipeline{}, cp, 1)
+	assert.Equal(t, 0, nErrors)
+	assert.Len(t, outputs, 4)
+	assert.Equal(t, len(lines), cp.offset(inputFile))
+}
+
+func TestParallelCheckpointAfterFailedBatch(t *testing.T) {
+	defaultBatchSize := batchSize
+	batchSize = 2
+	defer func() {
+		batchSize = defaultBatchSize
+	}()
+	testDataDir := t.TempDir()
+	inputFiles := []string{path.Join(testDataDir, "test-0.jsonl"), path.Join(testDataDir, "test-1.jsonl"), path.Join(testDataDir, "test-2.jsonl")}
+	check(t, os.WriteFile(inputFiles[0], []byte("{\"input\": \"a\"}\n{\"input\": \"b\"}\n{\"input\": \"c\"}\n"), os.ModePerm))
+	check(t, os.WriteFile(inputFiles[1], []byte("{\"input\": \"a\"}\n{\"input\": \"b\"}\n{\"input\": \"fail\"}\n{\"input\": \"c\"}\n{\"input\": \"d\"}\n"), os.ModePerm))
+	check(t, os.WriteFile(inputFiles[2], []byte("{\"input\": \"fail\"}\n{\"input\": \"a\"}\n"), os.ModePerm))
+
+	cp, err := loadCheckpoint("", 0)
+	check(t, err)
+	outputs, nErrors := processInputFiles(t, inputFiles, &failingPipeline{}, cp, 3)
+	assert.Equal(t, 4, nErrors) // the errors of the two failing batches, and the failures of their files
+	assert.Len(t, outputs, 6)
+	// only the file without errors is done, and the failing files stop before their failing batch
+	assert.Equal(t, 3, cp.offset(inputFiles[0]))
+	assert.Equal(t, 2, cp.offset(inputFiles[1]))
+	assert.Equal(t, 0, cp.offset(inputFiles[2]))
+}
+
+func TestParallelOutputSources(t *testing.T) {
+	testDataDir := t.TempDir()
+	inputFiles := []string{path.Join(testDataDir, "test-0.jsonl"), path.Join(testDataDir, "test-1.jsonl")}
+	check(t, os.WriteFile(inputFiles[0], []byte("{\"input\": \"a\"}\n{\"input\": \"b\"}\n"), os.ModePerm))
+	check(t, os.WriteFile(inputFiles[1], []byte("{\"input\": \"c\"}\n"), os.ModePerm))
+
+	cp, err := loadCheckpoint("", 0)
+	check(t, err)
+	outputs, nErrors := processInputFiles(t, inputFiles, &failingPipeline{}, cp, 2)
+	assert.Equal(t, 0, nErrors)
+	// the outputs of both files are written together, each with the file of its input
+	sources := map[string]string{}
+	for _, output := range outputs {
+		var line input
+		check(t, json.Unmarshal([]byte(output), &line))
+		sources[line.Input] = line.Source
+	}
+	assert.Equal(t, map[string]string{"a": inputFiles[0], "b": inputFiles[0], "c": inputFiles[1]}, sources)
+
+	// the outputs of a single file are not tagged
+	outputs, _ = processInputFiles(t, inputFiles[1:], &failingPipeline{}, &checkpoint{Offsets: map[string]int{}}, 1)
+	assert.Equal(t, []string{`{"input":"c","output":"c"}`}, outputs)
+}
+
+func TestCheckpointKeys(t *testing.T) {
+	testDataDir := t.TempDir()
+	workingDir, err := os.Getwd()
+	check(t, err)
+	check(t, os.Chdir(testDataDir))
+	defer func() {
+		check(t, os.Chdir(workingDir))
+	}()
+	inputFile, err := filepath.Abs("a.jsonl")
+	check(t, err)
+	checkpointFile := path.Join(testDataDir, "checkpoint.json")
+	// a checkpoint recording the same file under two paths
+	check(t, os.WriteFile(checkpointFile, []byte(`{"offsets": {"./a.jsonl": 2, "a.jsonl": 3, "stdin": 1}}`), os.ModePerm))
+
+	cp, err := loadCheckpoint(checkpointFile, time.Hour)
+	check(t, err)
+	assert.Equal(t, map[string]int{inputFile: 3, "stdin": 1}, cp.Offsets)
+	// the file resumes however its path is written
+	assert.Equal(t, 3, cp.offset("a.jsonl"))
+	assert.Equal(t, 3, cp.offset("./data/../a.jsonl"))
+	check(t, cp.advance("./a.jsonl", 5))
+	assert.Equal(t, 5, cp.offset(inputFile))
+	assert.Equal(t, 1, cp.offset(stdinSource))
+	assert.Equal(t, "s3://bucket/a.jsonl", checkpointKey("s3://bucket/a.jsonl"))
+}
+
+func TestDoctorCli(t *testing.T) {
+	app := &cli.App{
+		Name:     "hugot",
+		Usage:    "Huggingface transformers from the command line - alpha",
+		Commands: []*cli.Command{doctorCommand},
+	}
+	baseArgs := os.Args[0:1]
+	testModel := path.Join("../models", "KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english")
+
+	args := append(baseArgs, "doctor", fmt.Sprintf("--model=%s", testModel), "--executionProvider=CoreML")
+	check(t, app.Run(args))
+
+	args = append(baseArgs, "doctor", "--model=../models/missing")
+	if err := app.Run(args); err == nil {
+		t.Fatal("expected the checks of a missing model to fail")
+	}
+}
+
 func TestModelChain(t *testing.T) {
 	app := &cli.App{
 		Name:     "hugot",
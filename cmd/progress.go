@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// inputProgress tracks the number of processed inputs. When reading from files, the share of the
+// input bytes read so far is used to estimate the remaining time.
+type inputProgress struct {
+	processed    atomic.Int64
+	readBytes    atomic.Int64
+	skippedBytes atomic.Int64 // bytes of the inputs skipped on resume, also counted in readBytes
+	totalBytes   int64
+	start        time.Time
+}
+
+func (p *inputProgress) add(inputs int, bytes int) {
+	p.processed.Add(int64(inputs))
+	p.readBytes.Add(int64(bytes))
+}
+
+// skip records the bytes of inputs already processed according to the checkpoint.
+func (p *inputProgress) skip(bytes int) {
+	p.readBytes.Add(int64(bytes))
+	p.skippedBytes.Add(int64(bytes))
+}
+
+func (p *inputProgress) String() string {
+	processed := p.processed.Load()
+	elapsed := time.Since(p.start)
+	message := fmt.Sprintf("Processed %d inputs in %s (%.1f inputs/s)", processed, elapsed.Round(time.Second), float64(processed)/max(elapsed.Seconds(), 1e-9))
+	if p.totalBytes > 0 {
+		readBytes, skippedBytes := p.readBytes.Load(), p.skippedBytes.Load()
+		// the skipped bytes are read almost instantly, so they are left out of the rate of the estimate
+		bytesProgress := pipelines.NewProgress(int(readBytes-skippedBytes), int(p.totalBytes-skippedBytes), p.start)
+		message += fmt.Sprintf(", %.1f%% of input read, estimated time remaining %s",
+			100*float64(readBytes)/float64(p.totalBytes), bytesProgress.ETA.Round(time.Second))
+	}
+	return message
+}
+
+// reportEvery writes the progress to stderr at every interval until the returned stop function
+// is called, which also writes the final progress.
+func (p *inputProgress) reportEvery(interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = fmt.Fprintln(os.Stderr, p.String())
+			case <-done:
+				_, _ = fmt.Fprintln(os.Stderr, p.String())
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// fileProgress aggregates the progress of the file workers.
+type fileProgress struct {
+	total  int
+	done   int
+	failed int
+	mutex  sync.Mutex
+}
+
+func (f *fileProgress) fileDone(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.done++
+	if err != nil {
+		f.failed++
+	}
+	if f.total > 1 {
+		_, _ = fmt.Fprintf(os.Stderr, "Processed %d/%d files (%d failed)\n", f.done, f.total, f.failed)
+	}
+}
+
+func (f *fileProgress) report() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, _ = fmt.Fprintf(os.Stderr, "Finished processing %d files: %d succeeded, %d failed\n", f.total, f.done-f.failed, f.failed)
+}
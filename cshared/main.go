@@ -0,0 +1,159 @@
+// Package main builds hugot as a C shared library, so that programs in other languages (Python, Node, Rust, ...)
+// can run hugot pipelines in process through their FFI rather than calling a server.
+//
+// Build it with:
+//
+//	CGO_ENABLED=1 go build -buildmode=c-shared -o libhugot.so ./cshared
+//
+// which also generates the libhugot.h header. Sessions and pipelines are referred to by opaque integer handles.
+// All functions take and return JSON strings. Every returned string has an "error" field if the call failed,
+// and must be released with HugotFree.
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+	"github.com/knights-analytics/hugot/workers"
+)
+
+var (
+	handlesMutex     sync.Mutex
+	nextHandle       int64
+	sessions         = map[int64]*hugot.Session{}
+	pipelineHandles  = map[int64]pipelines.Pipeline{}
+	pipelineSessions = map[int64]int64{}
+)
+
+// HugotNewSession creates a session from a JSON session configuration and returns {"session": handle}.
+//
+//export HugotNewSession
+func HugotNewSession(configJSON *C.char) *C.char {
+	config := workers.SessionSpec{}
+	if err := unmarshalArgument(configJSON, &config); err != nil {
+		return errorResult(err)
+	}
+	session, err := workers.NewSessionFromSpec(config)
+	if err != nil {
+		return errorResult(err)
+	}
+	handlesMutex.Lock()
+	nextHandle++
+	handle := nextHandle
+	sessions[handle] = session
+	handlesMutex.Unlock()
+	return result(map[string]int64{"session": handle})
+}
+
+// HugotNewPipeline creates a pipeline in a session from a JSON pipeline configuration and returns {"pipeline": handle}.
+//
+//export HugotNewPipeline
+func HugotNewPipeline(sessionHandle C.longlong, configJSON *C.char) *C.char {
+	config := workers.PipelineSpec{}
+	if err := unmarshalArgument(configJSON, &config); err != nil {
+		return errorResult(err)
+	}
+	handlesMutex.Lock()
+	session, ok := sessions[int64(sessionHandle)]
+	handlesMutex.Unlock()
+	if !ok {
+		return errorResult(fmt.Errorf("session %d not found", sessionHandle))
+	}
+	pipeline, err := workers.NewPipelineFromSpec(session, config)
+	if err != nil {
+		return errorResult(err)
+	}
+	handlesMutex.Lock()
+	nextHandle++
+	handle := nextHandle
+	pipelineHandles[handle] = pipeline
+	pipelineSessions[handle] = int64(sessionHandle)
+	handlesMutex.Unlock()
+	return result(map[string]int64{"pipeline": handle})
+}
+
+// HugotRun runs a pipeline on a JSON array of input strings and returns {"output": [...]}, with one output per input.
+//
+//export HugotRun
+func HugotRun(pipelineHandle C.longlong, inputsJSON *C.char) *C.char {
+	var inputs []string
+	if err := unmarshalArgument(inputsJSON, &inputs); err != nil {
+		return errorResult(err)
+	}
+	handlesMutex.Lock()
+	pipeline, ok := pipelineHandles[int64(pipelineHandle)]
+	handlesMutex.Unlock()
+	if !ok {
+		return errorResult(fmt.Errorf("pipeline %d not found", pipelineHandle))
+	}
+	output, err := pipeline.Run(inputs)
+	if err != nil {
+		return errorResult(err)
+	}
+	return result(map[string][]any{"output": output.GetOutput()})
+}
+
+// HugotDestroySession destroys a session along with all its pipelines, whose handles become invalid.
+//
+//export HugotDestroySession
+func HugotDestroySession(sessionHandle C.longlong) *C.char {
+	handlesMutex.Lock()
+	session, ok := sessions[int64(sessionHandle)]
+	delete(sessions, int64(sessionHandle))
+	for pipelineHandle, pipelineSession := range pipelineSessions {
+		if pipelineSession == int64(sessionHandle) {
+			delete(pipelineHandles, pipelineHandle)
+			delete(pipelineSessions, pipelineHandle)
+		}
+	}
+	handlesMutex.Unlock()
+	if !ok {
+		return errorResult(fmt.Errorf("session %d not found", sessionHandle))
+	}
+	if err := session.Destroy(); err != nil {
+		return errorResult(err)
+	}
+	return result(map[string]any{})
+}
+
+// HugotFree releases a string returned by the library.
+//
+//export HugotFree
+func HugotFree(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+func unmarshalArgument(argument *C.char, v any) error {
+	if argument == nil {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(C.GoString(argument)), v); err != nil {
+		return fmt.Errorf("invalid JSON argument: %w", err)
+	}
+	return nil
+}
+
+func result(v any) *C.char {
+	resultBytes, err := json.Marshal(v)
+	if err != nil {
+		return errorResult(err)
+	}
+	return C.CString(string(resultBytes))
+}
+
+func errorResult(err error) *C.char {
+	errorBytes, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return C.CString(string(errorBytes))
+}
+
+// main is required to build a c-shared library.
+func main() {}
@@ -0,0 +1,262 @@
+package hugot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/daulet/tokenizers"
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/knights-analytics/hugot/pipelines"
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// minimumOnnxRuntimeVersion is the oldest onnxruntime release supporting the C API version used by hugot.
+const minimumOnnxRuntimeVersion = "1.18"
+
+// doctorTokenizer is a minimal tokenizer used to check that the tokenizers library works.
+const doctorTokenizer = `{"version":"1.0","truncation":null,"padding":null,"added_tokens":[],"normalizer":null,
+"pre_tokenizer":{"type":"Whitespace"},"post_processor":null,"decoder":null,
+"model":{"type":"WordLevel","vocab":{"[UNK]":0,"hello":1,"world":2},"unk_token":"[UNK]"}}`
+
+// DoctorStatus is the outcome of a preflight check.
+type DoctorStatus string
+
+const (
+	DoctorOK      DoctorStatus = "ok"
+	DoctorWarning DoctorStatus = "warning" // the check failed, but hugot can run without it, e.g. an optional accelerator
+	DoctorError   DoctorStatus = "error"
+)
+
+// DoctorOptions configures the preflight checks of Doctor.
+type DoctorOptions struct {
+	OnnxLibraryPath    string   // path to the onnxruntime library, see WithOnnxLibraryPath. If empty, the default one is used
+	ModelPaths         []string // model folders, or paths to .onnx files, to check
+	ExecutionProviders []string // execution providers to check, "CUDA" and "CoreML" by default
+}
+
+// DoctorCheck is the result of a preflight check.
+type DoctorCheck struct {
+	Name   string       `json:"name"`
+	Status DoctorStatus `json:"status"`
+	Detail string       `json:"detail"`
+	Hint   string       `json:"hint,omitempty"` // how to fix a failed check
+}
+
+// DoctorReport is the result of the preflight checks of Doctor.
+type DoctorReport struct {
+	Checks []DoctorCheck `json:"checks"`
+}
+
+// OK returns whether no check failed with an error. Warnings are allowed.
+func (r *DoctorReport) OK() bool {
+	for _, check := range r.Checks {
+		if check.Status == DoctorError {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the report with a line per check, followed by the hint of failed checks.
+func (r *DoctorReport) String() string {
+	var builder strings.Builder
+	for _, check := range r.Checks {
+		builder.WriteString(fmt.Sprintf("%-9s %s: %s\n", "["+string(check.Status)+"]", check.Name, check.Detail))
+		if check.Hint != "" && check.Status != DoctorOK {
+			builder.WriteString(fmt.Sprintf("%-9s hint: %s\n", "", check.Hint))
+		}
+	}
+	if r.OK() {
+		builder.WriteString("hugot is ready to run\n")
+	} else {
+		builder.WriteString("hugot cannot run until the errors above are fixed\n")
+	}
+	return builder.String()
+}
+
+func (r *DoctorReport) add(name string, status DoctorStatus, detail string, hint string) {
+	r.Checks = append(r.Checks, DoctorCheck{Name: name, Status: status, Detail: detail, Hint: hint})
+}
+
+// Doctor runs preflight checks of the environment: that the onnxruntime library can be loaded and is recent
+// enough, that the tokenizers library works, which execution providers are available, and that the model files
+// can be parsed. Most issues met when setting up hugot are environment problems that these checks pinpoint.
+// Doctor must not be called while a session is active, since onnxruntime is initialised and destroyed by the
+// checks.
+func Doctor(options DoctorOptions) *DoctorReport {
+	report := &DoctorReport{}
+	report.add("platform", DoctorOK, fmt.Sprintf("%s/%s, %s", runtime.GOOS, runtime.GOARCH, runtime.Version()), "")
+
+	ortReady := checkOnnxRuntime(report, options.OnnxLibraryPath)
+	if ortReady {
+		defer func() {
+			_ = ort.DestroyEnvironment()
+		}()
+	}
+	checkTokenizers(report)
+	if ortReady {
+		providers := options.ExecutionProviders
+		if len(providers) == 0 {
+			providers = []string{"CUDA", "CoreML"}
+		}
+		for _, provider := range providers {
+			checkExecutionProvider(report, provider)
+		}
+	}
+	for _, modelPath := range options.ModelPaths {
+		checkModel(report, modelPath, ortReady)
+	}
+	return report
+}
+
+// checkOnnxRuntime loads the onnxruntime library, and returns whether the environment was initialised.
+func checkOnnxRuntime(report *DoctorReport, libraryPath string) bool {
+	const name = "onnxruntime library"
+	if ort.IsInitialized() {
+		report.add(name, DoctorError, "onnxruntime is already initialised", "destroy the active session before running the checks")
+		return false
+	}
+	location := libraryPath
+	if libraryPath != "" {
+		exists, err := util.FileSystem.Exists(context.Background(), libraryPath)
+		if err != nil || !exists {
+			report.add(name, DoctorError, fmt.Sprintf("cannot find the library at %s", libraryPath),
+				"download onnxruntime from https://github.com/microsoft/onnxruntime/releases and pass the path of the library")
+			return false
+		}
+		ort.SetSharedLibraryPath(libraryPath)
+	} else {
+		location = "default location"
+	}
+	if err := ort.InitializeEnvironment(); err != nil {
+		report.add(name, DoctorError, fmt.Sprintf("cannot load the library from the %s: %s", location, err.Error()),
+			fmt.Sprintf("check that the library is onnxruntime %s or newer, built for %s/%s", minimumOnnxRuntimeVersion, runtime.GOOS, runtime.GOARCH))
+		return false
+	}
+	report.add(name, DoctorOK, fmt.Sprintf("version %s loaded from the %s", ort.GetVersion(), location), "")
+	return true
+}
+
+// checkTokenizers encodes a sentence with a minimal tokenizer.
+func checkTokenizers(report *DoctorReport) {
+	const name = "tokenizers library"
+	tk, err := tokenizers.FromBytes([]byte(doctorTokenizer))
+	if err != nil {
+		report.add(name, DoctorError, fmt.Sprintf("cannot create a tokenizer: %s", err.Error()),
+			"rebuild hugot linked with libtokenizers.a matching the version of github.com/daulet/tokenizers in go.mod")
+		return
+	}
+	defer func() {
+		_ = tk.Close()
+	}()
+	ids, _ := tk.Encode("hello world", false)
+	if len(ids) != 2 {
+		report.add(name, DoctorError, fmt.Sprintf("unexpected encoding %v", ids),
+			"rebuild hugot linked with libtokenizers.a matching the version of github.com/daulet/tokenizers in go.mod")
+		return
+	}
+	report.add(name, DoctorOK, "linked and working", "")
+}
+
+// checkExecutionProvider checks whether an execution provider can be added to session options.
+func checkExecutionProvider(report *DoctorReport, provider string) {
+	name := provider + " execution provider"
+	sessionOptions, err := ort.NewSessionOptions()
+	if err != nil {
+		report.add(name, DoctorError, fmt.Sprintf("cannot create session options: %s", err.Error()), "")
+		return
+	}
+	defer func() {
+		_ = sessionOptions.Destroy()
+	}()
+	switch strings.ToLower(provider) {
+	case "cuda":
+		cudaOptions, optErr := ort.NewCUDAProviderOptions()
+		if optErr == nil {
+			defer func() {
+				_ = cudaOptions.Destroy()
+			}()
+			err = sessionOptions.AppendExecutionProviderCUDA(cudaOptions)
+		} else {
+			err = optErr
+		}
+	case "coreml":
+		err = sessionOptions.AppendExecutionProviderCoreML(0)
+	case "directml":
+		err = sessionOptions.AppendExecutionProviderDirectML(0)
+	case "openvino":
+		err = sessionOptions.AppendExecutionProviderOpenVINO(map[string]string{})
+	case "tensorrt":
+		tensorRTOptions, optErr := ort.NewTensorRTProviderOptions()
+		if optErr == nil {
+			defer func() {
+				_ = tensorRTOptions.Destroy()
+			}()
+			err = sessionOptions.AppendExecutionProviderTensorRT(tensorRTOptions)
+		} else {
+			err = optErr
+		}
+	default:
+		report.add(name, DoctorError, "unknown execution provider", "use one of CUDA, CoreML, DirectML, OpenVINO or TensorRT")
+		return
+	}
+	if err != nil {
+		report.add(name, DoctorWarning, fmt.Sprintf("not available: %s", err.Error()),
+			"install an onnxruntime build with this provider and its drivers to use it, otherwise hugot runs on the CPU")
+		return
+	}
+	report.add(name, DoctorOK, "available", "")
+}
+
+// checkModel checks that the onnx file of a model can be parsed, and that its tokenizer can be loaded.
+func checkModel(report *DoctorReport, modelPath string, ortReady bool) {
+	name := "model " + modelPath
+	onnxFilename := ""
+	if strings.HasSuffix(modelPath, ".onnx") {
+		modelPath, onnxFilename = filepath.Dir(modelPath), filepath.Base(modelPath)
+	}
+	onnxPath, err := pipelines.GetOnnxModelPath(modelPath, onnxFilename)
+	if err != nil {
+		report.add(name, DoctorError, err.Error(), "pass the path of the .onnx file to check when a folder has several")
+		return
+	}
+	onnxBytes, err := util.ReadFileBytes(onnxPath)
+	if err != nil || len(onnxBytes) == 0 {
+		report.add(name, DoctorError, fmt.Sprintf("cannot read %s", onnxPath), "download the model again")
+		return
+	}
+	hash, err := util.FileSHA256(onnxPath)
+	if err != nil {
+		report.add(name, DoctorError, fmt.Sprintf("cannot hash %s: %s", onnxPath, err.Error()), "")
+		return
+	}
+	detail := fmt.Sprintf("%s, %d bytes, sha256 %s", filepath.Base(onnxPath), len(onnxBytes), hash)
+	if ortReady {
+		inputs, outputs, ioErr := ort.GetInputOutputInfoWithONNXData(onnxBytes)
+		if ioErr != nil {
+			report.add(name, DoctorError, fmt.Sprintf("%s is corrupted or not a valid onnx model: %s", onnxPath, ioErr.Error()),
+				"download the model again, and check that the download was not interrupted")
+			return
+		}
+		detail += fmt.Sprintf(", %d inputs, %d outputs", len(inputs), len(outputs))
+	}
+
+	tokenizerBytes, err := util.ReadFileBytes(util.PathJoinSafe(modelPath, "tokenizer.json"))
+	if err != nil {
+		report.add(name, DoctorError, fmt.Sprintf("%s, but tokenizer.json cannot be read: %s", detail, err.Error()),
+			"download the model with its tokenizer.json, e.g. with Session.DownloadModel")
+		return
+	}
+	tk, err := tokenizers.FromBytes(tokenizerBytes)
+	if err != nil {
+		report.add(name, DoctorError, fmt.Sprintf("%s, but tokenizer.json is invalid: %s", detail, err.Error()),
+			"download the model again")
+		return
+	}
+	_ = tk.Close()
+	report.add(name, DoctorOK, detail, "")
+}
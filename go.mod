@@ -4,6 +4,8 @@ go 1.22
 
 require (
 	github.com/daulet/tokenizers v0.9.0
+	github.com/hajimehoshi/go-mp3 v0.3.4
+	github.com/jfreymuth/oggvorbis v1.0.5
 	github.com/json-iterator/go v1.1.12
 	github.com/knights-analytics/HuggingFaceModelDownloader v1.3.5
 	github.com/mattn/go-isatty v0.0.20
@@ -11,8 +13,10 @@ require (
 	github.com/urfave/cli/v2 v2.27.4
 	github.com/viant/afs v1.25.1
 	github.com/viant/afsc v1.9.3
-	github.com/yalue/onnxruntime_go v1.11.0
+	github.com/yalue/onnxruntime_go v1.30.0
 	golang.org/x/exp v0.0.0-20240823005443-9b4947da3948
+	golang.org/x/image v0.19.0
+	google.golang.org/grpc v1.67.3
 )
 
 require (
@@ -21,6 +25,7 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fatih/color v1.17.0 // indirect
 	github.com/go-errors/errors v1.5.1 // indirect
+	github.com/jfreymuth/vorbis v1.0.2 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -31,7 +36,10 @@ require (
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240521201337-686a1a2994c1 // indirect
 	golang.org/x/crypto v0.26.0 // indirect
-	golang.org/x/oauth2 v0.22.0 // indirect
-	golang.org/x/sys v0.24.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
+	google.golang.org/protobuf v1.35.2 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	util "github.com/knights-analytics/hugot/utils"
 
@@ -14,11 +18,29 @@ import (
 
 // Session allows for the creation of new pipelines and holds the pipeline already created.
 type Session struct {
-	featureExtractionPipelines      pipelineMap[*pipelines.FeatureExtractionPipeline]
-	tokenClassificationPipelines    pipelineMap[*pipelines.TokenClassificationPipeline]
-	textClassificationPipelines     pipelineMap[*pipelines.TextClassificationPipeline]
-	zeroShotClassificationPipelines pipelineMap[*pipelines.ZeroShotClassificationPipeline]
-	ortOptions                      *ort.SessionOptions
+	featureExtractionPipelines           pipelineMap[*pipelines.FeatureExtractionPipeline]
+	tokenClassificationPipelines         pipelineMap[*pipelines.TokenClassificationPipeline]
+	textClassificationPipelines          pipelineMap[*pipelines.TextClassificationPipeline]
+	zeroShotClassificationPipelines      pipelineMap[*pipelines.ZeroShotClassificationPipeline]
+	text2TextGenerationPipelines         pipelineMap[*pipelines.Text2TextGenerationPipeline]
+	fillMaskPipelines                    pipelineMap[*pipelines.FillMaskPipeline]
+	rerankPipelines                      pipelineMap[*pipelines.RerankPipeline]
+	textGenerationPipelines              pipelineMap[*pipelines.TextGenerationPipeline]
+	speechRecognitionPipelines           pipelineMap[*pipelines.SpeechRecognitionPipeline]
+	imageClassificationPipelines         pipelineMap[*pipelines.ImageClassificationPipeline]
+	zeroShotImageClassificationPipelines pipelineMap[*pipelines.ZeroShotImageClassificationPipeline]
+	colBERTPipelines                     pipelineMap[*pipelines.ColBERTPipeline]
+	zeroShotNERPipelines                 pipelineMap[*pipelines.ZeroShotNERPipeline]
+	speakerDiarizationPipelines          pipelineMap[*pipelines.SpeakerDiarizationPipeline]
+	ortOptions                           *ort.SessionOptions
+	cpuOrtOptions                        *ort.SessionOptions
+	cpuPlacementBytes                    int64
+	engineCache                          *pipelines.EngineCache
+	seed                                 int64
+	executionProviders                   []string
+	intraOpNumThreads                    int
+	interOpNumThreads                    int
+	modelHashes                          map[string]string
 }
 
 type pipelineMap[T pipelines.Pipeline] map[string]T
@@ -31,6 +53,15 @@ func (m pipelineMap[T]) Destroy() error {
 	return err
 }
 
+func (m pipelineMap[T]) destroyPipeline(name string) (bool, error) {
+	p, ok := m[name]
+	if !ok {
+		return false, nil
+	}
+	delete(m, name)
+	return true, p.Destroy()
+}
+
 func (m pipelineMap[T]) GetStats() []string {
 	var stats []string
 	for _, p := range m {
@@ -39,6 +70,14 @@ func (m pipelineMap[T]) GetStats() []string {
 	return stats
 }
 
+func (m pipelineMap[T]) getMemoryStats(stats map[string]pipelines.MemoryStats) {
+	for name, p := range m {
+		if memoryPipeline, ok := any(p).(interface{ GetMemoryStats() pipelines.MemoryStats }); ok {
+			stats[name] = memoryPipeline.GetMemoryStats()
+		}
+	}
+}
+
 // FeatureExtractionConfig is the configuration for a feature extraction pipeline
 type FeatureExtractionConfig = pipelines.PipelineConfig[*pipelines.FeatureExtractionPipeline]
 
@@ -61,6 +100,66 @@ type TokenClassificationConfig = pipelines.PipelineConfig[*pipelines.TokenClassi
 // TokenClassificationOption is an option for a token classification pipeline
 type TokenClassificationOption = pipelines.PipelineOption[*pipelines.TokenClassificationPipeline]
 
+// Text2TextGenerationConfig is the configuration for a text2text generation pipeline
+type Text2TextGenerationConfig = pipelines.PipelineConfig[*pipelines.Text2TextGenerationPipeline]
+
+// Text2TextGenerationOption is an option for a text2text generation pipeline
+type Text2TextGenerationOption = pipelines.PipelineOption[*pipelines.Text2TextGenerationPipeline]
+
+// FillMaskConfig is the configuration for a fill-mask pipeline
+type FillMaskConfig = pipelines.PipelineConfig[*pipelines.FillMaskPipeline]
+
+// FillMaskOption is an option for a fill-mask pipeline
+type FillMaskOption = pipelines.PipelineOption[*pipelines.FillMaskPipeline]
+
+// RerankConfig is the configuration for a cross-encoder rerank pipeline
+type RerankConfig = pipelines.PipelineConfig[*pipelines.RerankPipeline]
+
+// RerankOption is an option for a cross-encoder rerank pipeline
+type RerankOption = pipelines.PipelineOption[*pipelines.RerankPipeline]
+
+// TextGenerationConfig is the configuration for a text generation pipeline
+type TextGenerationConfig = pipelines.PipelineConfig[*pipelines.TextGenerationPipeline]
+
+// TextGenerationOption is an option for a text generation pipeline
+type TextGenerationOption = pipelines.PipelineOption[*pipelines.TextGenerationPipeline]
+
+// SpeechRecognitionConfig is the configuration for a speech recognition pipeline
+type SpeechRecognitionConfig = pipelines.PipelineConfig[*pipelines.SpeechRecognitionPipeline]
+
+// SpeechRecognitionOption is an option for a speech recognition pipeline
+type SpeechRecognitionOption = pipelines.PipelineOption[*pipelines.SpeechRecognitionPipeline]
+
+// ImageClassificationConfig is the configuration for an image classification pipeline
+type ImageClassificationConfig = pipelines.PipelineConfig[*pipelines.ImageClassificationPipeline]
+
+// ImageClassificationOption is an option for an image classification pipeline
+type ImageClassificationOption = pipelines.PipelineOption[*pipelines.ImageClassificationPipeline]
+
+// ZeroShotImageClassificationConfig is the configuration for a zero shot image classification pipeline
+type ZeroShotImageClassificationConfig = pipelines.PipelineConfig[*pipelines.ZeroShotImageClassificationPipeline]
+
+// ZeroShotImageClassificationOption is an option for a zero shot image classification pipeline
+type ZeroShotImageClassificationOption = pipelines.PipelineOption[*pipelines.ZeroShotImageClassificationPipeline]
+
+// ColBERTConfig is the configuration for a ColBERT multi-vector embedding pipeline
+type ColBERTConfig = pipelines.PipelineConfig[*pipelines.ColBERTPipeline]
+
+// ColBERTOption is an option for a ColBERT multi-vector embedding pipeline
+type ColBERTOption = pipelines.PipelineOption[*pipelines.ColBERTPipeline]
+
+// ZeroShotNERConfig is the configuration for a zero-shot NER pipeline
+type ZeroShotNERConfig = pipelines.PipelineConfig[*pipelines.ZeroShotNERPipeline]
+
+// ZeroShotNEROption is an option for a zero-shot NER pipeline
+type ZeroShotNEROption = pipelines.PipelineOption[*pipelines.ZeroShotNERPipeline]
+
+// SpeakerDiarizationConfig is the configuration for a speaker diarization pipeline
+type SpeakerDiarizationConfig = pipelines.PipelineConfig[*pipelines.SpeakerDiarizationPipeline]
+
+// SpeakerDiarizationOption is an option for a speaker diarization pipeline
+type SpeakerDiarizationOption = pipelines.PipelineOption[*pipelines.SpeakerDiarizationPipeline]
+
 // NewSession is the main entrypoint to hugot and is used to create a new hugot session object.
 // ortLibraryPath should be the path to onnxruntime.so. If it's the empty string, hugot will try
 // to load the library from the default location (/usr/lib/onnxruntime.so).
@@ -74,10 +173,21 @@ func NewSession(options ...WithOption) (*Session, error) {
 	}
 
 	session := &Session{
-		featureExtractionPipelines:      map[string]*pipelines.FeatureExtractionPipeline{},
-		textClassificationPipelines:     map[string]*pipelines.TextClassificationPipeline{},
-		tokenClassificationPipelines:    map[string]*pipelines.TokenClassificationPipeline{},
-		zeroShotClassificationPipelines: map[string]*pipelines.ZeroShotClassificationPipeline{},
+		featureExtractionPipelines:           map[string]*pipelines.FeatureExtractionPipeline{},
+		textClassificationPipelines:          map[string]*pipelines.TextClassificationPipeline{},
+		tokenClassificationPipelines:         map[string]*pipelines.TokenClassificationPipeline{},
+		zeroShotClassificationPipelines:      map[string]*pipelines.ZeroShotClassificationPipeline{},
+		text2TextGenerationPipelines:         map[string]*pipelines.Text2TextGenerationPipeline{},
+		fillMaskPipelines:                    map[string]*pipelines.FillMaskPipeline{},
+		rerankPipelines:                      map[string]*pipelines.RerankPipeline{},
+		textGenerationPipelines:              map[string]*pipelines.TextGenerationPipeline{},
+		speechRecognitionPipelines:           map[string]*pipelines.SpeechRecognitionPipeline{},
+		imageClassificationPipelines:         map[string]*pipelines.ImageClassificationPipeline{},
+		zeroShotImageClassificationPipelines: map[string]*pipelines.ZeroShotImageClassificationPipeline{},
+		colBERTPipelines:                     map[string]*pipelines.ColBERTPipeline{},
+		zeroShotNERPipelines:                 map[string]*pipelines.ZeroShotNERPipeline{},
+		speakerDiarizationPipelines:          map[string]*pipelines.SpeakerDiarizationPipeline{},
+		modelHashes:                          map[string]string{},
 	}
 
 	// set session options and initialise
@@ -99,6 +209,16 @@ func (s *Session) initialiseORT(options ...WithOption) (bool, error) {
 	for _, option := range options {
 		option(o)
 	}
+	s.seed = time.Now().UnixNano()
+	if o.seedSet {
+		s.seed = o.seed
+	}
+	s.intraOpNumThreads = o.intraOpNumThreads
+	s.interOpNumThreads = o.interOpNumThreads
+	if o.redaction {
+		// redaction is process-wide, later sessions created without it must not turn it off
+		util.SetRedaction(true)
+	}
 
 	// Set pre-initialisation options
 	if o.libraryPath != "" {
@@ -128,79 +248,270 @@ func (s *Session) initialiseORT(options ...WithOption) (bool, error) {
 	}
 
 	// Create session options for use in all pipelines
-	sessionOptions, optionsError := ort.NewSessionOptions()
+	sessionOptions, optionsError := newCPUSessionOptions(o)
+	if sessionOptions != nil {
+		s.ortOptions = sessionOptions
+	}
 	if optionsError != nil {
 		return true, optionsError
 	}
-	s.ortOptions = sessionOptions
 
-	if o.intraOpNumThreads != 0 {
-		if err := sessionOptions.SetIntraOpNumThreads(o.intraOpNumThreads); err != nil {
-			return true, err
-		}
+	executionProviders, err := appendExecutionProviders(sessionOptions, o, "")
+	if err != nil {
+		return true, err
 	}
-	if o.interOpNumThreads != 0 {
-		if err := sessionOptions.SetInterOpNumThreads(o.interOpNumThreads); err != nil {
-			return true, err
+	s.executionProviders = executionProviders
+
+	// Small models stay on the CPU if a placement threshold is set
+	if o.cpuPlacementBytes > 0 && o.acceleratorSet() {
+		cpuOptions, cpuOptionsError := newCPUSessionOptions(o)
+		if cpuOptions != nil {
+			s.cpuOrtOptions = cpuOptions
 		}
-	}
-	if o.cpuMemArenaSet {
-		if err := sessionOptions.SetCpuMemArena(o.cpuMemArena); err != nil {
-			return true, err
+		if cpuOptionsError != nil {
+			return true, cpuOptionsError
 		}
+		s.cpuPlacementBytes = o.cpuPlacementBytes
 	}
-	if o.memPatternSet {
-		if err := sessionOptions.SetMemPattern(o.memPattern); err != nil {
-			return true, err
+
+	if o.engineCacheDir != "" {
+		engineCache, cacheErr := s.newEngineCache(o)
+		if cacheErr != nil {
+			return true, cacheErr
 		}
+		s.engineCache = engineCache
 	}
+
+	return true, nil
+}
+
+// appendExecutionProviders appends the execution providers configured in o to sessionOptions, and returns their
+// names. With cacheEntryDir set, the execution providers that compile engines cache them in this folder.
+func appendExecutionProviders(sessionOptions *ort.SessionOptions, o *ortOptions, cacheEntryDir string) ([]string, error) {
+	var executionProviders []string
 	if o.cudaOptionsSet {
 		cudaOptions, optErr := ort.NewCUDAProviderOptions()
 		if optErr != nil {
-			return true, optErr
+			return nil, optErr
 		}
 		if len(o.cudaOptions) > 0 {
 			optErr = cudaOptions.Update(o.cudaOptions)
 			if optErr != nil {
-				return true, optErr
+				return nil, optErr
 			}
 		}
 		if err := sessionOptions.AppendExecutionProviderCUDA(cudaOptions); err != nil {
-			return true, err
+			return nil, err
 		}
+		executionProviders = append(executionProviders, "CUDA")
 	}
 	if o.coreMLOptionsSet {
-		if err := sessionOptions.AppendExecutionProviderCoreML(o.coreMLOptions); err != nil {
-			return true, err
+		if cacheEntryDir == "" {
+			if err := sessionOptions.AppendExecutionProviderCoreML(o.coreMLOptions); err != nil {
+				return nil, err
+			}
+		} else if err := sessionOptions.AppendExecutionProviderCoreMLV2(engineCacheOptions(cacheEntryDir, "coreml", coreMLProviderOptions(o.coreMLOptions))); err != nil {
+			return nil, err
 		}
+		executionProviders = append(executionProviders, "CoreML")
 	}
 	if o.directMLOptionsSet {
 		if err := sessionOptions.AppendExecutionProviderDirectML(o.directMLOptions); err != nil {
-			return true, err
+			return nil, err
 		}
+		executionProviders = append(executionProviders, "DirectML")
 	}
 	if o.openVINOOptionsSet {
-		if err := sessionOptions.AppendExecutionProviderOpenVINO(o.openVINOOptions); err != nil {
-			return true, err
+		if err := sessionOptions.AppendExecutionProviderOpenVINO(engineCacheOptions(cacheEntryDir, "openvino", o.openVINOOptions)); err != nil {
+			return nil, err
 		}
+		executionProviders = append(executionProviders, "OpenVINO")
 	}
 	if o.tensorRTOptionsSet {
 		tensorRTOptions, optErr := ort.NewTensorRTProviderOptions()
 		if optErr != nil {
-			return true, optErr
+			return nil, optErr
 		}
-		if len(o.cudaOptions) > 0 {
-			optErr = tensorRTOptions.Update(o.tensorRTOptions)
+		providerOptions := engineCacheOptions(cacheEntryDir, "tensorrt", o.tensorRTOptions)
+		if len(providerOptions) > 0 {
+			optErr = tensorRTOptions.Update(providerOptions)
 			if optErr != nil {
-				return true, optErr
+				return nil, optErr
 			}
 		}
 		if err := sessionOptions.AppendExecutionProviderTensorRT(tensorRTOptions); err != nil {
-			return true, err
+			return nil, err
 		}
+		executionProviders = append(executionProviders, "TensorRT")
 	}
+	return executionProviders, nil
+}
 
-	return true, nil
+// coreMLProviderOptions translates the CoreML flags of WithCoreML into the provider options of the CoreML
+// execution provider, which are needed to set its model cache.
+func coreMLProviderOptions(flags uint32) map[string]string {
+	options := map[string]string{"ModelFormat": "NeuralNetwork", "MLComputeUnits": "ALL"}
+	switch {
+	case flags&0x001 != 0: // COREML_FLAG_USE_CPU_ONLY
+		options["MLComputeUnits"] = "CPUOnly"
+	case flags&0x020 != 0: // COREML_FLAG_USE_CPU_AND_GPU
+		options["MLComputeUnits"] = "CPUAndGPU"
+	case flags&0x004 != 0: // COREML_FLAG_ONLY_ENABLE_DEVICE_WITH_ANE
+		options["MLComputeUnits"] = "CPUAndNeuralEngine"
+	}
+	if flags&0x002 != 0 { // COREML_FLAG_ENABLE_ON_SUBGRAPH
+		options["EnableOnSubgraphs"] = "1"
+	}
+	if flags&0x008 != 0 { // COREML_FLAG_ONLY_ALLOW_STATIC_INPUT_SHAPES
+		options["RequireStaticInputShapes"] = "1"
+	}
+	if flags&0x010 != 0 { // COREML_FLAG_CREATE_MLPROGRAM
+		options["ModelFormat"] = "MLProgram"
+	}
+	return options
+}
+
+// newEngineCache creates the engine cache of the pipelines of the session, in the folder of the onnxruntime version
+// under the cache folder of o. The cache entries of the accelerator options of the session are keyed by their
+// execution providers, and the ones of the CPU placement options by the CPU.
+func (s *Session) newEngineCache(o *ortOptions) (*pipelines.EngineCache, error) {
+	cacheDir, err := prepareEngineCache(o.engineCacheDir)
+	if err != nil {
+		return nil, err
+	}
+	accelerator, compiles := "cpu", false
+	if len(s.executionProviders) > 0 {
+		accelerator = strings.ToLower(strings.Join(s.executionProviders, "-"))
+	}
+	for _, executionProvider := range s.executionProviders {
+		if executionProvider == "TensorRT" || executionProvider == "OpenVINO" || executionProvider == "CoreML" {
+			compiles = true
+		}
+	}
+	var profile []string
+	for _, key := range []string{"trt_profile_min_shapes", "trt_profile_opt_shapes", "trt_profile_max_shapes"} {
+		if shapes, ok := o.tensorRTOptions[key]; ok {
+			profile = append(profile, key+"="+shapes)
+		}
+	}
+	return &pipelines.EngineCache{
+		Dir:     cacheDir,
+		Profile: strings.Join(profile, ";"),
+		ExecutionProvider: func(options *ort.SessionOptions) (string, bool) {
+			if options == s.ortOptions {
+				return accelerator, compiles
+			}
+			return "cpu", false
+		},
+		NewOptions: func(options *ort.SessionOptions, entryDir string) (*ort.SessionOptions, error) {
+			entryOptions, optionsErr := newCPUSessionOptions(o)
+			if optionsErr == nil && options == s.ortOptions {
+				_, optionsErr = appendExecutionProviders(entryOptions, o, entryDir)
+			}
+			if optionsErr != nil {
+				if entryOptions != nil {
+					optionsErr = errors.Join(optionsErr, entryOptions.Destroy())
+				}
+				return nil, optionsErr
+			}
+			return entryOptions, nil
+		},
+	}, nil
+}
+
+// EngineCacheStats returns the number of graphs whose session was created from the engine cache, and of the ones
+// that were compiled or optimized and added to it. Both are zero without an engine cache.
+func (s *Session) EngineCacheStats() pipelines.EngineCacheStats {
+	if s.engineCache == nil {
+		return pipelines.EngineCacheStats{}
+	}
+	return s.engineCache.Stats()
+}
+
+// engineCacheOptions returns a copy of the options of the given execution provider, with the options that
+// persist its compiled engines in cacheEntryDir added. The options are copied unchanged if cacheEntryDir is empty.
+func engineCacheOptions(cacheEntryDir string, executionProvider string, options map[string]string) map[string]string {
+	providerOptions := make(map[string]string, len(options))
+	for k, v := range options {
+		providerOptions[k] = v
+	}
+	if cacheEntryDir == "" {
+		return providerOptions
+	}
+	switch executionProvider {
+	case "tensorrt":
+		providerOptions["trt_engine_cache_enable"] = "1"
+		providerOptions["trt_engine_cache_path"] = cacheEntryDir
+		providerOptions["trt_timing_cache_enable"] = "1"
+		providerOptions["trt_timing_cache_path"] = cacheEntryDir
+	case "openvino":
+		providerOptions["cache_dir"] = cacheEntryDir
+	case "coreml":
+		providerOptions["ModelCacheDirectory"] = cacheEntryDir
+	}
+	return providerOptions
+}
+
+// prepareEngineCache returns the folder of the engine cache for the loaded onnxruntime version, and removes the
+// folders of the other versions, whose engines and optimized graphs cannot be loaded.
+func prepareEngineCache(cacheDir string) (string, error) {
+	versionDir := "ort-" + ort.GetVersion()
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "ort-") && entry.Name() != versionDir {
+			if removeErr := os.RemoveAll(filepath.Join(cacheDir, entry.Name())); removeErr != nil {
+				return "", removeErr
+			}
+		}
+	}
+	cachePath := filepath.Join(cacheDir, versionDir)
+	if err := os.MkdirAll(cachePath, os.ModePerm); err != nil {
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// newCPUSessionOptions creates onnxruntime session options with the threading and memory settings
+// but without any execution provider.
+func newCPUSessionOptions(o *ortOptions) (*ort.SessionOptions, error) {
+	sessionOptions, optionsError := ort.NewSessionOptions()
+	if optionsError != nil {
+		return nil, optionsError
+	}
+
+	if o.intraOpNumThreads != 0 {
+		if err := sessionOptions.SetIntraOpNumThreads(o.intraOpNumThreads); err != nil {
+			return sessionOptions, err
+		}
+	}
+	if o.interOpNumThreads != 0 {
+		if err := sessionOptions.SetInterOpNumThreads(o.interOpNumThreads); err != nil {
+			return sessionOptions, err
+		}
+	}
+	if o.cpuMemArenaSet {
+		if err := sessionOptions.SetCpuMemArena(o.cpuMemArena); err != nil {
+			return sessionOptions, err
+		}
+	}
+	if o.memPatternSet {
+		if err := sessionOptions.SetMemPattern(o.memPattern); err != nil {
+			return sessionOptions, err
+		}
+	}
+	return sessionOptions, nil
+}
+
+// cpuPlacement returns the CPU placement the pipelines of the session are created with, or nil if no
+// placement threshold is set. Each pipeline places itself once it knows every graph it loads.
+func (s *Session) cpuPlacement() *pipelines.CPUPlacement {
+	if s.cpuOrtOptions == nil {
+		return nil
+	}
+	return &pipelines.CPUPlacement{Bytes: s.cpuPlacementBytes, CPUOptions: s.cpuOrtOptions}
 }
 
 type pipelineNotFoundError struct {
@@ -229,10 +540,14 @@ func NewPipeline[T pipelines.Pipeline](s *Session, pipelineConfig pipelines.Pipe
 		return pipeline, getError
 	}
 
+	ortOptions := s.ortOptions
+	pipelineConfig.CPUPlacement = s.cpuPlacement()
+	pipelineConfig.EngineCache = s.engineCache
+
 	switch any(pipeline).(type) {
 	case *pipelines.TokenClassificationPipeline:
 		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.TokenClassificationPipeline])
-		pipelineInitialised, err := pipelines.NewTokenClassificationPipeline(config, s.ortOptions)
+		pipelineInitialised, err := pipelines.NewTokenClassificationPipeline(config, ortOptions)
 		if err != nil {
 			return pipeline, err
 		}
@@ -240,7 +555,7 @@ func NewPipeline[T pipelines.Pipeline](s *Session, pipelineConfig pipelines.Pipe
 		pipeline = any(pipelineInitialised).(T)
 	case *pipelines.TextClassificationPipeline:
 		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.TextClassificationPipeline])
-		pipelineInitialised, err := pipelines.NewTextClassificationPipeline(config, s.ortOptions)
+		pipelineInitialised, err := pipelines.NewTextClassificationPipeline(config, ortOptions)
 		if err != nil {
 			return pipeline, err
 		}
@@ -248,7 +563,7 @@ func NewPipeline[T pipelines.Pipeline](s *Session, pipelineConfig pipelines.Pipe
 		pipeline = any(pipelineInitialised).(T)
 	case *pipelines.FeatureExtractionPipeline:
 		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.FeatureExtractionPipeline])
-		pipelineInitialised, err := pipelines.NewFeatureExtractionPipeline(config, s.ortOptions)
+		pipelineInitialised, err := pipelines.NewFeatureExtractionPipeline(config, ortOptions)
 		if err != nil {
 			return pipeline, err
 		}
@@ -256,12 +571,94 @@ func NewPipeline[T pipelines.Pipeline](s *Session, pipelineConfig pipelines.Pipe
 		pipeline = any(pipelineInitialised).(T)
 	case *pipelines.ZeroShotClassificationPipeline:
 		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.ZeroShotClassificationPipeline])
-		pipelineInitialised, err := pipelines.NewZeroShotClassificationPipeline(config, s.ortOptions)
+		pipelineInitialised, err := pipelines.NewZeroShotClassificationPipeline(config, ortOptions)
 		if err != nil {
 			return pipeline, err
 		}
 		s.zeroShotClassificationPipelines[config.Name] = pipelineInitialised
 		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.Text2TextGenerationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.Text2TextGenerationPipeline])
+		config.Options = append([]pipelines.PipelineOption[*pipelines.Text2TextGenerationPipeline]{pipelines.WithDecoderSamplingSeed(s.seed)}, config.Options...)
+		pipelineInitialised, err := pipelines.NewText2TextGenerationPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.text2TextGenerationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.FillMaskPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.FillMaskPipeline])
+		pipelineInitialised, err := pipelines.NewFillMaskPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.fillMaskPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.RerankPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.RerankPipeline])
+		pipelineInitialised, err := pipelines.NewRerankPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.rerankPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.TextGenerationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.TextGenerationPipeline])
+		config.Options = append([]pipelines.PipelineOption[*pipelines.TextGenerationPipeline]{pipelines.WithSamplingSeed(s.seed)}, config.Options...)
+		pipelineInitialised, err := pipelines.NewTextGenerationPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.textGenerationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.SpeechRecognitionPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.SpeechRecognitionPipeline])
+		pipelineInitialised, err := pipelines.NewSpeechRecognitionPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.speechRecognitionPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.ImageClassificationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.ImageClassificationPipeline])
+		pipelineInitialised, err := pipelines.NewImageClassificationPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.imageClassificationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.ZeroShotImageClassificationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.ZeroShotImageClassificationPipeline])
+		pipelineInitialised, err := pipelines.NewZeroShotImageClassificationPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.zeroShotImageClassificationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.ColBERTPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.ColBERTPipeline])
+		pipelineInitialised, err := pipelines.NewColBERTPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.colBERTPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.ZeroShotNERPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.ZeroShotNERPipeline])
+		pipelineInitialised, err := pipelines.NewZeroShotNERPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.zeroShotNERPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
+	case *pipelines.SpeakerDiarizationPipeline:
+		config := any(pipelineConfig).(pipelines.PipelineConfig[*pipelines.SpeakerDiarizationPipeline])
+		pipelineInitialised, err := pipelines.NewSpeakerDiarizationPipeline(config, ortOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		s.speakerDiarizationPipelines[config.Name] = pipelineInitialised
+		pipeline = any(pipelineInitialised).(T)
 	default:
 		return pipeline, fmt.Errorf("not implemented")
 	}
@@ -296,6 +693,66 @@ func GetPipeline[T pipelines.Pipeline](s *Session, name string) (T, error) {
 			return pipeline, &pipelineNotFoundError{pipelineName: name}
 		}
 		return any(p).(T), nil
+	case *pipelines.Text2TextGenerationPipeline:
+		p, ok := s.text2TextGenerationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.FillMaskPipeline:
+		p, ok := s.fillMaskPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.RerankPipeline:
+		p, ok := s.rerankPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.TextGenerationPipeline:
+		p, ok := s.textGenerationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.SpeechRecognitionPipeline:
+		p, ok := s.speechRecognitionPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.ImageClassificationPipeline:
+		p, ok := s.imageClassificationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.ZeroShotImageClassificationPipeline:
+		p, ok := s.zeroShotImageClassificationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.ColBERTPipeline:
+		p, ok := s.colBERTPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.ZeroShotNERPipeline:
+		p, ok := s.zeroShotNERPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
+	case *pipelines.SpeakerDiarizationPipeline:
+		p, ok := s.speakerDiarizationPipelines[name]
+		if !ok {
+			return pipeline, &pipelineNotFoundError{pipelineName: name}
+		}
+		return any(p).(T), nil
 	default:
 		return pipeline, errors.New("pipeline type not supported")
 	}
@@ -309,11 +766,55 @@ func (s *Session) Destroy() error {
 		s.tokenClassificationPipelines.Destroy(),
 		s.textClassificationPipelines.Destroy(),
 		s.zeroShotClassificationPipelines.Destroy(),
+		s.text2TextGenerationPipelines.Destroy(),
+		s.fillMaskPipelines.Destroy(),
+		s.rerankPipelines.Destroy(),
+		s.textGenerationPipelines.Destroy(),
+		s.speechRecognitionPipelines.Destroy(),
+		s.imageClassificationPipelines.Destroy(),
+		s.zeroShotImageClassificationPipelines.Destroy(),
+		s.colBERTPipelines.Destroy(),
+		s.zeroShotNERPipelines.Destroy(),
+		s.speakerDiarizationPipelines.Destroy(),
 		s.ortOptions.Destroy(),
+		s.destroyCPUOptions(),
 		ort.DestroyEnvironment(),
 	)
 }
 
+// DestroyPipeline destroys the pipeline with the given name and removes it from the session, e.g. to unload a
+// model that is not served any more. The pipeline must not be running.
+func (s *Session) DestroyPipeline(name string) error {
+	for _, destroyPipeline := range []func(string) (bool, error){
+		s.featureExtractionPipelines.destroyPipeline,
+		s.tokenClassificationPipelines.destroyPipeline,
+		s.textClassificationPipelines.destroyPipeline,
+		s.zeroShotClassificationPipelines.destroyPipeline,
+		s.text2TextGenerationPipelines.destroyPipeline,
+		s.fillMaskPipelines.destroyPipeline,
+		s.rerankPipelines.destroyPipeline,
+		s.textGenerationPipelines.destroyPipeline,
+		s.speechRecognitionPipelines.destroyPipeline,
+		s.imageClassificationPipelines.destroyPipeline,
+		s.zeroShotImageClassificationPipelines.destroyPipeline,
+		s.colBERTPipelines.destroyPipeline,
+		s.zeroShotNERPipelines.destroyPipeline,
+		s.speakerDiarizationPipelines.destroyPipeline,
+	} {
+		if found, err := destroyPipeline(name); found {
+			return err
+		}
+	}
+	return &pipelineNotFoundError{pipelineName: name}
+}
+
+func (s *Session) destroyCPUOptions() error {
+	if s.cpuOrtOptions == nil {
+		return nil
+	}
+	return s.cpuOrtOptions.Destroy()
+}
+
 // GetStats returns runtime statistics for all initialized pipelines for profiling purposes. We currently record for each pipeline:
 // the total runtime of the tokenization step
 // the number of batch calls to the tokenization step
@@ -323,10 +824,41 @@ func (s *Session) Destroy() error {
 // the average time per onnxruntime inference batch call
 func (s *Session) GetStats() []string {
 	// slices.Concat() is not implemented in experimental x/exp/slices package
-	return append(append(append(
+	return append(append(append(append(append(append(append(append(append(append(append(append(append(
 		s.tokenClassificationPipelines.GetStats(),
 		s.textClassificationPipelines.GetStats()...),
 		s.featureExtractionPipelines.GetStats()...),
-		s.zeroShotClassificationPipelines.GetStats()...,
+		s.zeroShotClassificationPipelines.GetStats()...),
+		s.text2TextGenerationPipelines.GetStats()...),
+		s.fillMaskPipelines.GetStats()...),
+		s.rerankPipelines.GetStats()...),
+		s.textGenerationPipelines.GetStats()...),
+		s.speechRecognitionPipelines.GetStats()...),
+		s.imageClassificationPipelines.GetStats()...),
+		s.zeroShotImageClassificationPipelines.GetStats()...),
+		s.colBERTPipelines.GetStats()...),
+		s.zeroShotNERPipelines.GetStats()...),
+		s.speakerDiarizationPipelines.GetStats()...,
 	)
 }
+
+// GetMemoryStats returns the approximate memory used by each pipeline of the session, by pipeline name, for
+// capacity planning. The sum of the peaks estimates the memory needed to run all the pipelines of the session.
+func (s *Session) GetMemoryStats() map[string]pipelines.MemoryStats {
+	stats := map[string]pipelines.MemoryStats{}
+	s.featureExtractionPipelines.getMemoryStats(stats)
+	s.tokenClassificationPipelines.getMemoryStats(stats)
+	s.textClassificationPipelines.getMemoryStats(stats)
+	s.zeroShotClassificationPipelines.getMemoryStats(stats)
+	s.text2TextGenerationPipelines.getMemoryStats(stats)
+	s.fillMaskPipelines.getMemoryStats(stats)
+	s.rerankPipelines.getMemoryStats(stats)
+	s.textGenerationPipelines.getMemoryStats(stats)
+	s.speechRecognitionPipelines.getMemoryStats(stats)
+	s.imageClassificationPipelines.getMemoryStats(stats)
+	s.zeroShotImageClassificationPipelines.getMemoryStats(stats)
+	s.colBERTPipelines.getMemoryStats(stats)
+	s.zeroShotNERPipelines.getMemoryStats(stats)
+	s.speakerDiarizationPipelines.getMemoryStats(stats)
+	return stats
+}
@@ -1,17 +1,37 @@
 package hugot
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/daulet/tokenizers"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/knights-analytics/hugot/adapters"
 	"github.com/knights-analytics/hugot/pipelines"
 	util "github.com/knights-analytics/hugot/utils"
 
@@ -40,6 +60,90 @@ func TestDownloadValidation(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+// test the options that persist the engines of execution providers
+
+func TestEngineCacheOptions(t *testing.T) {
+	// the onnxruntime version is read from the loaded library
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		destroyErr := session.Destroy()
+		check(t, destroyErr)
+	}(session)
+
+	cacheDir := t.TempDir()
+	versionDir := "ort-" + ort.GetVersion()
+	staleDir := filepath.Join(cacheDir, "ort-0.0.0")
+	check(t, os.MkdirAll(staleDir, os.ModePerm))
+
+	// engines and optimized graphs of other onnxruntime versions are removed
+	cachePath, err := prepareEngineCache(cacheDir)
+	check(t, err)
+	assert.Equal(t, filepath.Join(cacheDir, versionDir), cachePath)
+	assert.DirExists(t, cachePath)
+	assert.NoDirExists(t, staleDir)
+
+	entryDir := filepath.Join(cachePath, "tensorrt", "entry")
+	userOptions := map[string]string{"device_id": "1"}
+	assert.Equal(t, map[string]string{
+		"device_id":               "1",
+		"trt_engine_cache_enable": "1",
+		"trt_engine_cache_path":   entryDir,
+		"trt_timing_cache_enable": "1",
+		"trt_timing_cache_path":   entryDir,
+	}, engineCacheOptions(entryDir, "tensorrt", userOptions))
+	assert.Equal(t, map[string]string{"device_id": "1"}, userOptions)
+	assert.Equal(t, map[string]string{"device_type": "CPU", "cache_dir": entryDir},
+		engineCacheOptions(entryDir, "openvino", map[string]string{"device_type": "CPU"}))
+
+	// the CoreML flags are translated to provider options, which hold the model cache
+	coreMLOptions := engineCacheOptions(entryDir, "coreml", coreMLProviderOptions(0x001|0x010))
+	assert.Equal(t, map[string]string{
+		"ModelFormat":         "MLProgram",
+		"MLComputeUnits":      "CPUOnly",
+		"ModelCacheDirectory": entryDir,
+	}, coreMLOptions)
+
+	// without a cache entry the options are unchanged
+	assert.Equal(t, userOptions, engineCacheOptions("", "tensorrt", userOptions))
+}
+
+func TestEngineCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	inputs := []string{"The quick brown fox jumps over the lazy dog.", "Engines are cached across sessions."}
+	run := func() ([][]float32, pipelines.EngineCacheStats) {
+		session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary), WithEngineCache(cacheDir))
+		check(t, err)
+		defer func(session *Session) {
+			destroyErr := session.Destroy()
+			check(t, destroyErr)
+		}(session)
+		pipeline, err := NewPipeline(session, FeatureExtractionConfig{
+			ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+			Name:      "testPipeline",
+		})
+		check(t, err)
+		output, err := pipeline.RunPipeline(inputs)
+		check(t, err)
+		return output.Embeddings, session.EngineCacheStats()
+	}
+
+	// the first session optimizes the graph and saves it in the cache
+	firstEmbeddings, stats := run()
+	assert.Equal(t, pipelines.EngineCacheStats{Misses: 1}, stats)
+	optimized, err := filepath.Glob(filepath.Join(cacheDir, "ort-*", "cpu", "*", "optimized.onnx"))
+	check(t, err)
+	assert.Len(t, optimized, 1)
+
+	// the second session loads the optimized graph, with the same results
+	secondEmbeddings, stats := run()
+	assert.Equal(t, pipelines.EngineCacheStats{Hits: 1}, stats)
+	assert.Equal(t, len(firstEmbeddings), len(secondEmbeddings))
+	for i := range firstEmbeddings {
+		assert.InDeltaSlice(t, firstEmbeddings[i], secondEmbeddings[i], 1e-5)
+	}
+}
+
 // FEATURE EXTRACTION
 
 func TestFeatureExtractionPipelineValidation(t *testing.T) {
@@ -194,660 +298,3698 @@ func TestFeatureExtractionPipeline(t *testing.T) {
 	}
 }
 
-// Text classification
-
-func TestTextClassificationPipeline(t *testing.T) {
-	session, err := NewSession(
-		WithOnnxLibraryPath(onnxRuntimeSharedLibrary),
-		WithTelemetry(),
-		WithCpuMemArena(true),
-		WithMemPattern(true),
-		WithIntraOpNumThreads(1),
-		WithInterOpNumThreads(1),
-	)
+func TestFeatureExtractionPooling(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
 	check(t, err)
 	defer func(session *Session) {
-		errDestroy := session.Destroy()
-		check(t, errDestroy)
+		err := session.Destroy()
+		check(t, err)
 	}(session)
-	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
-	modelPathMulti := "./models/SamLowe_roberta-base-go_emotions-onnx"
-
-	config := TextClassificationConfig{
-		ModelPath: modelPath,
-		Name:      "testPipelineSimple",
-		Options: []TextClassificationOption{
-			pipelines.WithSoftmax(),
-		},
-	}
-	sentimentPipeline, err := NewPipeline(session, config)
-	check(t, err)
-
-	configMulti := TextClassificationConfig{
-		ModelPath:    modelPathMulti,
-		Name:         "testPipelineSimpleMulti",
-		OnnxFilename: "model.onnx",
-		Options: []TextClassificationOption{
-			pipelines.WithMultiLabel(),
-			pipelines.WithSigmoid(),
-		},
-	}
-	sentimentPipelineMulti, err := NewPipeline(session, configMulti)
-	check(t, err)
-
-	tests := []struct {
-		pipeline *pipelines.TextClassificationPipeline
-		name     string
-		strings  []string
-		expected pipelines.TextClassificationOutput
-	}{
-		{
-			pipeline: sentimentPipeline,
-			name:     "Basic tests",
-			strings:  []string{"This movie is disgustingly good!", "The director tried too much"},
-			expected: pipelines.TextClassificationOutput{
-				ClassificationOutputs: [][]pipelines.ClassificationOutput{
-					{
-						{
-							Label: "POSITIVE",
-							Score: 0.9998536109924316,
-						},
-					},
-					{
-						{
-							Label: "NEGATIVE",
-							Score: 0.9975218176841736,
-						},
-					},
-				},
-			},
-		},
-		{
-			pipeline: sentimentPipelineMulti,
-			name:     "Multiclass pipeline test",
-			strings:  []string{"ONNX is seriously fast for small batches. Impressive"},
-			expected: pipelines.TextClassificationOutput{
-				ClassificationOutputs: [][]pipelines.ClassificationOutput{
-					{
-						{
-							Label: "admiration",
-							Score: 0.9217681,
-						},
-						{
-							Label: "amusement",
-							Score: 0.001201711,
-						},
-						{
-							Label: "anger",
-							Score: 0.001109502,
-						},
-						{
-							Label: "annoyance",
-							Score: 0.0034009134,
-						},
-						{
-							Label: "approval",
-							Score: 0.05643816,
-						},
-						{
-							Label: "caring",
-							Score: 0.0011591336,
-						},
-						{
-							Label: "confusion",
-							Score: 0.0018672282,
-						},
-						{
-							Label: "curiosity",
-							Score: 0.0026787464,
-						},
-						{
-							Label: "desire",
-							Score: 0.00085846696,
-						},
-						{
-							Label: "disappointment",
-							Score: 0.0027759627,
-						},
-						{
-							Label: "disapproval",
-							Score: 0.004615115,
-						},
-						{
-							Label: "disgust",
-							Score: 0.00075303164,
-						},
-						{
-							Label: "embarrassment",
-							Score: 0.0003314704,
-						},
-						{
-							Label: "excitement",
-							Score: 0.005340109,
-						},
-						{
-							Label: "fear",
-							Score: 0.00042834174,
-						},
-						{
-							Label: "gratitude",
-							Score: 0.013405683,
-						},
-						{
-							Label: "grief",
-							Score: 0.00029952865,
-						},
-						{
-							Label: "joy",
-							Score: 0.0026875956,
-						},
-						{
-							Label: "love",
-							Score: 0.00092915917,
-						},
-						{
-							Label: "nervousness",
-							Score: 0.00012843,
-						},
-						{
-							Label: "optimism",
-							Score: 0.006792505,
-						},
-						{
-							Label: "pride",
-							Score: 0.0033409835,
-						},
-						{
-							Label: "realization",
-							Score: 0.007224476,
-						},
-						{
-							Label: "relief",
-							Score: 0.00071489986,
-						},
-						{
-							Label: "remorse",
-							Score: 0.00026071363,
-						},
-						{
-							Label: "sadness",
-							Score: 0.0009562365,
-						},
-						{
-							Label: "surprise",
-							Score: 0.0037120024,
-						},
-						{
-							Label: "neutral",
-							Score: 0.04079749,
-						},
-					},
-				},
-			},
-		},
-	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			batchResult, err := tt.pipeline.RunPipeline(tt.strings)
-			check(t, err)
-			for i, expected := range tt.expected.ClassificationOutputs {
-				checkClassificationOutput(t, expected, batchResult.ClassificationOutputs[i])
-			}
+	modelPath := "./models/sentence-transformers_all-MiniLM-L6-v2"
+	inputs := []string{"robert smith", "Onnxruntime is a great inference backend"}
+	embeddings := map[string][][]float32{}
+	for _, pooling := range []string{"MEAN", "CLS", "MAX"} {
+		pipeline, err := NewPipeline(session, FeatureExtractionConfig{
+			ModelPath: modelPath,
+			Name:      "testPipeline" + pooling,
+			Options:   []FeatureExtractionOption{pipelines.WithPooling(pooling)},
 		})
+		check(t, err)
+		output, err := pipeline.RunPipeline(inputs)
+		check(t, err)
+		embeddings[pooling] = output.Embeddings
+	}
+	for i := range inputs {
+		assert.NotEqual(t, embeddings["MEAN"][i], embeddings["CLS"][i])
+		// the maximum over the tokens is at least their mean
+		for k, value := range embeddings["MAX"][i] {
+			assert.GreaterOrEqual(t, value+1e-6, embeddings["MEAN"][i][k])
+		}
 	}
 
-	// check get stats
-	session.GetStats()
+	_, err = NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineInvalid",
+		Options:   []FeatureExtractionOption{pipelines.WithPooling("MIN")},
+	})
+	assert.Error(t, err)
 }
 
-func TestTextClassificationPipelineValidation(t *testing.T) {
+func TestFeatureExtractionFloat64(t *testing.T) {
 	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
 	check(t, err)
 	defer func(session *Session) {
 		err := session.Destroy()
 		check(t, err)
 	}(session)
-	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
 
-	config := TextClassificationConfig{
+	modelPath := "./models/sentence-transformers_all-MiniLM-L6-v2"
+	inputs := []string{"robert smith", strings.Repeat("Onnxruntime is a great inference backend. ", 8)}
+	pipeline32, err := NewPipeline(session, FeatureExtractionConfig{
 		ModelPath: modelPath,
-		Name:      "testPipelineSimple",
-		Options: []TextClassificationOption{
-			pipelines.WithSingleLabel(),
-		},
-	}
-	sentimentPipeline, err := NewPipeline(session, config)
+		Name:      "testPipeline32",
+		Options:   []FeatureExtractionOption{pipelines.WithNormalization(), pipelines.WithChunking(16, 4)},
+	})
 	check(t, err)
-
-	t.Run("id-label-map", func(t *testing.T) {
-		labelMapInitial := sentimentPipeline.IDLabelMap
-		defer func() {
-			sentimentPipeline.IDLabelMap = labelMapInitial
-		}()
-		sentimentPipeline.IDLabelMap = map[int]string{}
-		err = sentimentPipeline.Validate()
-		assert.Error(t, err)
-	})
-
-	t.Run("output-shape", func(t *testing.T) {
-		dimensionInitial := sentimentPipeline.OutputsMeta[0].Dimensions
-		defer func() {
-			sentimentPipeline.OutputsMeta[0].Dimensions = dimensionInitial
-		}()
-		sentimentPipeline.OutputsMeta[0].Dimensions = ort.NewShape(-1, -1, -1)
-		err = sentimentPipeline.Validate()
-		assert.Error(t, err)
+	pipeline64, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "testPipeline64",
+		Options:   []FeatureExtractionOption{pipelines.WithNormalization(), pipelines.WithChunking(16, 4), pipelines.WithFloat64Embeddings()},
 	})
+	check(t, err)
+	output32, err := pipeline32.RunPipeline(inputs)
+	check(t, err)
+	assert.Nil(t, output32.Embeddings64)
+	output64, err := pipeline64.RunPipeline(inputs)
+	check(t, err)
+	assert.Len(t, output64.Embeddings64, len(inputs))
+	for i := range inputs {
+		norm := 0.0
+		for k, value := range output64.Embeddings64[i] {
+			assert.InDelta(t, output32.Embeddings[i][k], value, 1e-5)
+			assert.Equal(t, float32(value), output64.Embeddings[i][k])
+			norm += value * value
+		}
+		assert.InDelta(t, 1, norm, 1e-12)
+	}
 }
 
-func TestZeroShotClassificationPipeline(t *testing.T) {
-	session, err := NewSession()
+func TestFeatureExtractionPrefixes(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
 	check(t, err)
 	defer func(session *Session) {
 		err := session.Destroy()
 		check(t, err)
 	}(session)
 
-	modelPath := "./models/protectai_deberta-v3-base-zeroshot-v1-onnx"
-
-	config := ZeroShotClassificationConfig{
+	modelPath := "./models/sentence-transformers_all-MiniLM-L6-v2"
+	pipeline, err := NewPipeline(session, FeatureExtractionConfig{
 		ModelPath: modelPath,
 		Name:      "testPipeline",
-		Options: []pipelines.PipelineOption[*pipelines.ZeroShotClassificationPipeline]{
-			pipelines.WithHypothesisTemplate("This example is {}."),
-			pipelines.WithLabels([]string{"fun", "dangerous"}),
+		Options:   []FeatureExtractionOption{pipelines.WithEmbeddingPrefixes("query: ", "passage: ")},
+	})
+	check(t, err)
+	queries, err := pipeline.EmbedQueries([]string{"robert smith"})
+	check(t, err)
+	documents, err := pipeline.EmbedDocuments([]string{"robert smith"})
+	check(t, err)
+	raw, err := pipeline.RunPipeline([]string{"query: robert smith", "passage: robert smith", "robert smith"})
+	check(t, err)
+	assert.Equal(t, raw.Embeddings[0], queries.Embeddings[0])
+	assert.Equal(t, raw.Embeddings[1], documents.Embeddings[0])
+	assert.NotEqual(t, raw.Embeddings[2], queries.Embeddings[0])
+
+	// with chunking, every chunk starts with the prefix and keeps the offsets of the document
+	chunked, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineChunked",
+		Options: []FeatureExtractionOption{
+			pipelines.WithChunking(16, 4),
+			pipelines.WithEmbeddingPrefixes("query: ", "passage: "),
 		},
+	})
+	check(t, err)
+	document := strings.Repeat("Onnxruntime is a great inference backend. ", 4)
+	prefixed, err := chunked.EmbedDocuments([]string{document})
+	check(t, err)
+	unprefixed, err := chunked.RunPipeline([]string{document})
+	check(t, err)
+	assert.NotEqual(t, unprefixed.Embeddings[0], prefixed.Embeddings[0])
+	for _, chunk := range prefixed.Chunks[0] {
+		assert.Equal(t, document[chunk.Start:chunk.End], chunk.Text)
+		// [CLS], [SEP] and the two tokens of the prefix leave 12 tokens of the document
+		assert.LessOrEqual(t, chunk.Tokens, 12)
 	}
+	assert.Equal(t, 0, prefixed.Chunks[0][0].Start)
+	assert.Equal(t, len(strings.TrimSpace(document)), prefixed.Chunks[0][len(prefixed.Chunks[0])-1].End)
 
-	classificationPipeline, err := NewPipeline(session, config)
+	chunked.DocumentPrefix = strings.Repeat("passage ", 20)
+	_, err = chunked.EmbedDocuments([]string{document})
+	assert.Error(t, err)
+}
+
+func TestFeatureExtractionTruncatedDimensions(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
 	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
 
-	tests := []struct {
-		pipeline   *pipelines.ZeroShotClassificationPipeline
-		name       string
-		sequences  []string
-		labels     []string
-		multilabel bool
-		expected   pipelines.ZeroShotOutput
-	}{
-		{
-			pipeline:   classificationPipeline,
-			name:       "single sequence, single label, no multilabel",
-			sequences:  []string{"I am going to the park"},
-			labels:     []string{"fun"},
-			multilabel: false,
-			expected: pipelines.ZeroShotOutput{
-				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
-					{
-						Sequence: "I am going to the park",
-						SortedValues: []struct {
-							Key   string
-							Value float64
-						}{
-							{
-								Key:   "fun",
-								Value: 0.0009069009101949632,
-							},
-						},
-					},
-				},
-			},
-		},
-		{
-			pipeline:   classificationPipeline,
-			name:       "multiple sequences, multiple labels, no multilabel",
-			sequences:  []string{"I am going to the park", "I will watch Interstellar tonight"},
-			labels:     []string{"fun", "movie"},
-			multilabel: false,
-			expected: pipelines.ZeroShotOutput{
-				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
-					{
-						Sequence: "I am going to the park",
-						SortedValues: []struct {
-							Key   string
-							Value float64
-						}{
-							{
-								Key:   "fun",
-								Value: 0.7746766209602356,
-							},
-							{
-								Key:   "movie",
-								Value: 0.2253233790397644,
-							},
-						},
-					},
-					{
-						Sequence: "I will watch Interstellar tonight",
-						SortedValues: []struct {
-							Key   string
-							Value float64
-						}{
-							{
-								Key:   "movie",
-								Value: 0.9984978437423706,
-							},
-							{
-								Key:   "fun",
-								Value: 0.001502170693129301,
-							},
-						},
-					},
-				},
-			},
-		},
-		{
-			pipeline:   classificationPipeline,
-			name:       "multiple sequences, multiple labels, multilabel",
-			sequences:  []string{"I am going to the park", "I will watch Interstellar tonight"},
-			labels:     []string{"fun", "movie"},
-			multilabel: true,
-			expected: pipelines.ZeroShotOutput{
-				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
-					{
-						Sequence: "I am going to the park",
-						SortedValues: []struct {
-							Key   string
-							Value float64
-						}{
-							{
-								Key:   "fun",
-								Value: 0.0009069009101949632,
-							},
-							{
-								Key:   "movie",
-								Value: 0.00009480675362283364,
-							},
-						},
-					},
-					{
-						Sequence: "I will watch Interstellar tonight",
-						SortedValues: []struct {
-							Key   string
-							Value float64
-						}{
-							{
-								Key:   "movie",
-								Value: 0.9985591769218445,
-							},
-							{
-								Key:   "fun",
-								Value: 0.0006653196760453284,
-							},
-						},
-					},
-				},
-			},
-		},
-		{
-			pipeline:   classificationPipeline,
-			name:       "multiple sequences, single label, multilabel",
-			sequences:  []string{"I am going to the park", "I will watch Interstellar tonight"},
-			labels:     []string{"fun"},
-			multilabel: true,
-			expected: pipelines.ZeroShotOutput{
-				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
-					{
-						Sequence: "I am going to the park",
-						SortedValues: []struct {
-							Key   string
-							Value float64
-						}{
-							{
-								Key:   "fun",
-								Value: 0.0009069009101949632,
-							},
-						},
-					},
-					{
-						Sequence: "I will watch Interstellar tonight",
-						SortedValues: []struct {
-							Key   string
-							Value float64
-						}{
-							{
-								Key:   "fun",
-								Value: 0.0006653196760453284,
-							},
-						},
-					},
-				},
-			},
-		},
-		{
-			pipeline:   classificationPipeline,
-			name:       "single sequence, multiple labels, multilabel=false",
-			sequences:  []string{"Please don't bother me, I'm in a rush"},
-			labels:     []string{"busy", "relaxed", "stressed"},
-			multilabel: false,
-			expected: pipelines.ZeroShotOutput{
-				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
-					{
-						Sequence: "Please don't bother me, I'm in a rush",
-						SortedValues: []struct {
-							Key   string
-							Value float64
-						}{
-							{
-								Key:   "stressed",
-								Value: 0.8865461349487305,
-							},
-							{
-								Key:   "busy",
-								Value: 0.10629364103078842,
-							},
-							{
-								Key:   "relaxed",
-								Value: 0.007160270120948553,
-							},
-						},
-					},
-				},
-			},
-		},
+	modelPath := "./models/sentence-transformers_all-MiniLM-L6-v2"
+	inputs := []string{"robert smith", "Onnxruntime is a great inference backend."}
+	full, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineFull",
+	})
+	check(t, err)
+	truncated, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineTruncated",
+		Options:   []FeatureExtractionOption{pipelines.WithTruncatedDimensions(128)},
+	})
+	check(t, err)
+	fullOutput, err := full.RunPipeline(inputs)
+	check(t, err)
+	truncatedOutput, err := truncated.RunPipeline(inputs)
+	check(t, err)
+	for i := range inputs {
+		assert.Len(t, fullOutput.Embeddings[i], 384)
+		assert.Len(t, truncatedOutput.Embeddings[i], 128)
+		expected := util.Normalize(fullOutput.Embeddings[i][:128], 2)
+		for k, value := range truncatedOutput.Embeddings[i] {
+			assert.InDelta(t, expected[k], value, 1e-6)
+		}
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			classificationPipeline.Labels = tt.labels
-			classificationPipeline.Multilabel = tt.multilabel
-			batchResult, _ := tt.pipeline.RunPipeline(tt.sequences)
-			assert.Equal(t, len(batchResult.GetOutput()), len(tt.expected.ClassificationOutputs))
-
-			for ind, expected := range tt.expected.ClassificationOutputs {
-				expectedResult := expected.SortedValues
-				testResult := batchResult.ClassificationOutputs[ind].SortedValues
-				assert.Equal(t, len(expectedResult), len(testResult))
-				assert.Equal(t, tt.expected.ClassificationOutputs[ind].Sequence, batchResult.ClassificationOutputs[ind].Sequence)
-				for i := range testResult {
-					assert.True(t, almostEqual(testResult[i].Value, expectedResult[i].Value))
-				}
-			}
+	for _, dimensions := range []int{-1, 1024} {
+		_, err = NewPipeline(session, FeatureExtractionConfig{
+			ModelPath: modelPath,
+			Name:      fmt.Sprintf("testPipeline%d", dimensions),
+			Options:   []FeatureExtractionOption{pipelines.WithTruncatedDimensions(dimensions)},
 		})
+		assert.Error(t, err)
 	}
 }
 
-func TestZeroShotClassificationPipelineValidation(t *testing.T) {
-	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+func TestFeatureExtractionChunking(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	modelPath := "./models/sentence-transformers_all-MiniLM-L6-v2"
+	pipeline, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "testPipeline",
+		Options:   []FeatureExtractionOption{pipelines.WithNormalization()},
+	})
+	check(t, err)
+	chunkPipeline, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineChunks",
+		Options:   []FeatureExtractionOption{pipelines.WithNormalization(), pipelines.WithChunking(16, 4)},
+	})
+	check(t, err)
+
+	short := "robert smith"
+	long := strings.Repeat("Onnxruntime is a great inference backend for transformer models. ", 6)
+	expected, err := pipeline.RunPipeline([]string{short})
+	check(t, err)
+	output, err := chunkPipeline.RunPipeline([]string{short, long})
+	check(t, err)
+	assert.Len(t, output.Embeddings, 2)
+	assert.Len(t, output.Chunks, 2)
+
+	// an input that fits in a chunk has the same embedding as without chunking
+	assert.Len(t, output.Chunks[0], 1)
+	for k, value := range expected.Embeddings[0] {
+		assert.InDelta(t, value, output.Embeddings[0][k], 1e-4)
+	}
+
+	assert.Greater(t, len(output.Chunks[1]), 1)
+	for _, chunk := range output.Chunks[1] {
+		assert.LessOrEqual(t, chunk.Tokens, 14)
+		assert.Equal(t, long[chunk.Start:chunk.End], chunk.Text)
+	}
+	assert.InDelta(t, 1, util.Norm(output.Embeddings[1], 2), 1e-4)
+	similarity, err := util.CosineSimilarity(output.Embeddings[1], output.Chunks[1][0].Embedding)
+	check(t, err)
+	assert.Greater(t, similarity, float32(0.8))
+}
+
+func TestColBERTPipeline(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	pipeline, err := NewPipeline(session, ColBERTConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+	output, err := pipeline.RunPipeline([]string{"robert smith", "robert smith lives in a small town", "paris"})
+	check(t, err)
+
+	// one normalized embedding per token, without [CLS], [SEP] and the padding
+	assert.Len(t, output.Embeddings[0], 2)
+	assert.Len(t, output.Embeddings[1], 7)
+	assert.Len(t, output.Embeddings[2], 1)
+	for _, embedding := range output.Embeddings[1] {
+		assert.InDelta(t, 1, util.Norm(embedding, 2), 1e-5)
+	}
+	self, err := util.MaxSim(output.Embeddings[0], output.Embeddings[0])
+	check(t, err)
+	assert.InDelta(t, 2, self, 1e-5)
+	contained, err := util.MaxSim(output.Embeddings[0], output.Embeddings[1])
+	check(t, err)
+	unrelated, err := util.MaxSim(output.Embeddings[0], output.Embeddings[2])
+	check(t, err)
+	assert.Greater(t, contained, unrelated)
+
+	_, err = util.MaxSim([][]float32{{1, 0}}, [][]float32{{1, 0, 0}})
+	assert.Error(t, err)
+	empty, err := util.MaxSim([][]float32{{1, 0}}, nil)
+	check(t, err)
+	assert.Equal(t, float32(0), empty)
+
+	_, err = NewPipeline(session, ColBERTConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testPipelineInvalid",
+		Options:   []ColBERTOption{pipelines.WithTokenOutputName("missing")},
+	})
+	assert.Error(t, err)
+}
+
+func TestZeroShotNERSpans(t *testing.T) {
+	pipeline := &pipelines.ZeroShotNERPipeline{Threshold: 0.5, MaxWidth: 3, MaxWords: 384}
+	labels := []string{"person", "city"}
+	input := "Ada Lovelace visited New-York."
+	// 5 words (Ada, Lovelace, visited, New-York and the period), 3 span widths and 2 labels
+	shape := []int64{1, 5, 3, 2}
+	logits := make([]float32, 5*3*2)
+	for i := range logits {
+		logits[i] = -5
+	}
+	set := func(word, width, label int, logit float32) {
+		logits[(word*3+width)*2+label] = logit
+	}
+	set(0, 1, 0, 4) // Ada Lovelace, person
+	set(1, 0, 0, 2) // Lovelace, person, nested in Ada Lovelace
+	set(3, 0, 1, 3) // New-York, city
+	set(1, 1, 1, 1) // Lovelace visited, city, partially overlapping Ada Lovelace with a lower score
+
+	output, err := pipeline.Postprocess([]string{input}, labels, logits, shape)
+	check(t, err)
+	assert.Len(t, output.Entities[0], 2)
+	assert.Equal(t, "Ada Lovelace", output.Entities[0][0].Word)
+	assert.Equal(t, "person", output.Entities[0][0].Entity)
+	assert.Equal(t, uint(0), output.Entities[0][0].Start)
+	assert.Equal(t, uint(12), output.Entities[0][0].End)
+	assert.Equal(t, "New-York", output.Entities[0][1].Word)
+	assert.Equal(t, "city", output.Entities[0][1].Entity)
+	assert.InDelta(t, 1/(1+math.Exp(-3)), output.Entities[0][1].Score, 1e-6)
+
+	pipeline.NestedEntities = true
+	output, err = pipeline.Postprocess([]string{input}, labels, logits, shape)
+	check(t, err)
+	assert.Len(t, output.Entities[0], 3)
+	assert.Equal(t, "Lovelace", output.Entities[0][1].Word)
+
+	_, err = pipeline.Postprocess([]string{input}, []string{"person"}, logits, shape)
+	assert.Error(t, err)
+}
+
+func TestOnnxTransforms(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	config := FeatureExtractionConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testPipelineTransforms",
+		OnnxTransforms: []pipelines.OnnxTransform{
+			pipelines.StripOnnxOutputs("sentence_embedding"),
+			pipelines.SetOnnxDynamicAxis("input_ids", 0, "batch"),
+		},
+	}
+	pipeline, err := NewPipeline(session, config)
+	check(t, err)
+	assert.Equal(t, 1, len(pipeline.OutputsMeta))
+	assert.Equal(t, "sentence_embedding", pipeline.OutputsMeta[0].Name)
+	_, err = pipeline.RunPipeline([]string{"Onnxruntime is a great inference backend"})
+	check(t, err)
+
+	config.Name = "testPipelineTransformsError"
+	config.OnnxTransforms = []pipelines.OnnxTransform{pipelines.StripOnnxOutputs("missing_output")}
+	_, err = NewPipeline(session, config)
+	assert.Error(t, err)
+}
+
+func TestWordPieceTokenizer(t *testing.T) {
+	tokenizerPath := "./models/sentence-transformers_all-MiniLM-L6-v2/tokenizer.json"
+	tokenizerBytes, err := os.ReadFile(tokenizerPath)
+	check(t, err)
+	wordPiece, err := util.NewWordPieceTokenizer(tokenizerBytes)
+	check(t, err)
+	reference, err := tokenizers.FromFile(tokenizerPath)
+	check(t, err)
+	defer func(reference *tokenizers.Tokenizer) {
+		check(t, reference.Close())
+	}(reference)
+
+	// the pure Go tokenizer should match the tokenizer used by the pipelines
+	for _, text := range []string{
+		"Onnxruntime is a great inference backend",
+		"Héllo, WORLD! Unaffable café: 42 € in 中文 text.",
+	} {
+		expectedIDs, _ := reference.Encode(text, true)
+		tokens := wordPiece.Encode(text)
+		ids := make([]uint32, len(tokens))
+		for i, token := range tokens {
+			ids[i] = token.ID
+		}
+		assert.Equal(t, expectedIDs, ids, text)
+		assert.Equal(t, len(expectedIDs), wordPiece.Count(text))
+	}
+
+	chunks, err := wordPiece.Chunk("one two three four five six seven", 5, 1)
+	check(t, err)
+	assert.Equal(t, []string{"one two three", "three four five", "five six seven"}, chunks)
+}
+
+func TestLoadVocabulary(t *testing.T) {
+	tokenizerPath := "./models/sentence-transformers_all-MiniLM-L6-v2/tokenizer.json"
+	tokenizerBytes, err := os.ReadFile(tokenizerPath)
+	check(t, err)
+	vocabulary, err := util.LoadVocabulary(tokenizerBytes)
+	check(t, err)
+	reference, err := tokenizers.FromFile(tokenizerPath)
+	check(t, err)
+	defer func(reference *tokenizers.Tokenizer) {
+		check(t, reference.Close())
+	}(reference)
+	assert.Len(t, vocabulary, int(reference.VocabSize()))
+	assert.Equal(t, "[MASK]", vocabulary[103])
+	ids, tokens := reference.Encode("Onnxruntime is great", false)
+	for i, id := range ids {
+		assert.Equal(t, tokens[i], vocabulary[id])
+	}
+
+	unigram := `{"model": {"type": "Unigram", "vocab": [["<pad>", 0], ["▁hello", -3.5]]}, "added_tokens": [{"id": 2, "content": "<mask>"}]}`
+	vocabulary, err = util.LoadVocabulary([]byte(unigram))
+	check(t, err)
+	assert.Equal(t, []string{"<pad>", "▁hello", "<mask>"}, vocabulary)
+	_, err = util.LoadVocabulary([]byte(`{"model": {"type": "BPE"}}`))
+	assert.Error(t, err)
+}
+
+func TestEmbedderAdapter(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	pipeline, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testPipelineAdapter",
+		Options:   []FeatureExtractionOption{pipelines.WithNormalization()},
+	})
+	check(t, err)
+	embedder := adapters.NewEmbedder(pipeline)
+	embedder.BatchSize = 2
+
+	documents := []string{"The cat sat on the mat", "A dog was sleeping on the rug", "Stock markets fell sharply today"}
+	embeddings, err := embedder.EmbedDocuments(context.Background(), documents)
+	check(t, err)
+	assert.Equal(t, len(documents), len(embeddings))
+	query, err := embedder.EmbedQuery(context.Background(), documents[2])
+	check(t, err)
+	check(t, floatsEqual(embeddings[2], query))
+}
+
+func TestLLMAdapter(t *testing.T) {
+	// without a generation test model, the conversion of the roles and options is tested on its own
+	assert.Equal(t, "user", adapters.ChatRole("human"))
+	assert.Equal(t, "assistant", adapters.ChatRole("ai"))
+	assert.Equal(t, "assistant", adapters.ChatRole("model"))
+	assert.Equal(t, "system", adapters.ChatRole("system"))
+
+	assert.Empty(t, adapters.CallOptions{}.GenerationOptions())
+	assert.Len(t, adapters.CallOptions{MaxTokens: 16, Temperature: 0.7, TopP: 0.9, Seed: 1}.GenerationOptions(), 4)
+
+	_, err := adapters.NewLLM(nil).Call(context.Background(), "Hello", adapters.CallOptions{})
+	assert.Error(t, err)
+}
+
+func TestEmbeddingDrift(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/sentence-transformers_all-MiniLM-L6-v2"
+
+	reference, err := NewPipeline(session, FeatureExtractionConfig{ModelPath: modelPath, Name: "testPipelineReference"})
+	check(t, err)
+	candidate, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineCandidate",
+		Options:   []FeatureExtractionOption{pipelines.WithNormalization()},
+	})
+	check(t, err)
+
+	corpus := []string{
+		"The cat sat on the mat",
+		"A dog was sleeping on the rug",
+		"Stock markets fell sharply today",
+		"Investors sold shares after the announcement",
+		"Onnxruntime is a great inference backend",
+	}
+	// normalization does not change the direction of the embeddings, so there should be no drift
+	report, err := pipelines.CompareEmbeddingModels(reference, candidate, corpus, 2, 2)
+	check(t, err)
+	assert.Equal(t, len(corpus), report.Documents)
+	assert.True(t, report.SameDimension)
+	assert.InDelta(t, 1, report.MeanCosine, 1e-4)
+	assert.InDelta(t, 1, report.NeighborOverlap, 1e-6)
+}
+
+// Text classification
+
+func TestEmbeddingArithmetic(t *testing.T) {
+	vectors := [][]float32{{1, 0, 2}, {3, 2, 0}}
+	centroid, err := util.Centroid(vectors)
+	check(t, err)
+	assert.Equal(t, []float32{2, 1, 1}, centroid)
+	average, err := util.WeightedAverage(vectors, []float32{3, 1})
+	check(t, err)
+	assert.Equal(t, []float32{1.5, 0.5, 1.5}, average)
+	_, err = util.WeightedAverage(vectors, []float32{0, 0})
+	assert.Error(t, err)
+	_, err = util.Centroid([][]float32{{1, 2}, {1}})
+	assert.Error(t, err)
+
+	direction, err := util.Subtract(vectors[1], vectors[0])
+	check(t, err)
+	assert.Equal(t, []float32{2, 2, -2}, direction)
+	orthogonal, err := util.RemoveProjection([]float32{1, 2, 3}, []float32{0, 2, 0})
+	check(t, err)
+	assert.Equal(t, []float32{1, 0, 3}, orthogonal)
+	assert.Equal(t, float32(0), util.Dot(orthogonal, []float32{0, 2, 0}))
+	_, err = util.RemoveProjection([]float32{1, 2}, []float32{0, 0})
+	assert.Error(t, err)
+}
+
+func TestStreamingClusterer(t *testing.T) {
+	clusterer := util.NewStreamingClusterer(0.9)
+	var ids []int
+	for _, embedding := range [][]float32{{1, 0, 0}, {0.95, 0.1, 0}, {0, 1, 0}, {0, 0.9, 0.1}, {0.6, 0.8, 0}} {
+		id, err := clusterer.Assign(embedding)
+		check(t, err)
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []int{0, 0, 1, 1, 2}, ids)
+	_, err := clusterer.Assign([]float32{1, 0})
+	assert.Error(t, err)
+	clusters := clusterer.Clusters()
+	assert.Len(t, clusters, 3)
+	assert.Equal(t, 2, clusters[0].Size)
+	assert.InDelta(t, 1, util.Norm(clusters[0].Centroid, 2), 1e-6)
+
+	clusterer.MergeAbove = 0.75
+	merged := clusterer.Recenter()
+	assert.Len(t, merged, 1)
+	assert.Len(t, clusterer.Clusters(), 2)
+
+	bounded := util.NewStreamingClusterer(0.99)
+	bounded.MaxClusters = 2
+	for _, embedding := range [][]float32{{1, 0}, {0, 1}, {1, 0.2}} {
+		_, err = bounded.Assign(embedding)
+		check(t, err)
+	}
+	assert.Len(t, bounded.Clusters(), 2)
+}
+
+func TestNoveltyDetection(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	embedder, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	reference := []string{
+		"The invoice is due at the end of the month.",
+		"Please pay the attached invoice within 30 days.",
+		"Your payment for invoice 1234 has been received.",
+		"We have not yet received payment for the last invoice.",
+		"The invoice total includes VAT.",
+		"Send the invoice to the accounts payable department.",
+	}
+	referenceEmbeddings, err := embedder.RunPipeline(reference)
+	check(t, err)
+	index := util.NewVectorIndex()
+	for i, embedding := range referenceEmbeddings.Embeddings {
+		check(t, index.Add(reference[i], embedding))
+	}
+	knn, err := util.NewKNNNoveltyDetector(index, 2)
+	check(t, err)
+	check(t, knn.FitThreshold(1))
+	gaussian, err := util.FitGaussianNoveltyDetector(referenceEmbeddings.Embeddings, 0.5, 1)
+	check(t, err)
+
+	for _, detector := range []util.NoveltyDetector{knn, gaussian} {
+		novelty, err := pipelines.NewNoveltyPipeline(embedder, detector)
+		check(t, err)
+		output, err := novelty.RunPipeline([]string{
+			"The invoice is due at the end of the month.",
+			"The striker scored twice in the second half of the match.",
+		})
+		check(t, err)
+		assert.False(t, output.Results[0].Novel)
+		assert.True(t, output.Results[1].Novel)
+		assert.Greater(t, output.Results[1].Score, output.Results[0].Score)
+	}
+
+	_, err = util.NewKNNNoveltyDetector(util.NewVectorIndex(), 2)
+	assert.Error(t, err)
+	_, err = pipelines.NewNoveltyPipeline(embedder, nil)
+	assert.Error(t, err)
+}
+
+func TestSentenceSimilarityPipeline(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	embedder, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	similarity, err := pipelines.NewSentenceSimilarityPipeline(embedder)
+	check(t, err)
+	output, err := similarity.Compare("How do I pay my invoice?", []string{
+		"How do I pay my invoice?",
+		"What are the payment options for invoices?",
+		"The striker scored twice in the second half of the match.",
+	})
+	check(t, err)
+	assert.Len(t, output.Similarities, 3)
+	assert.InDelta(t, 1, output.Similarities[0], 1e-4)
+	assert.Greater(t, output.Similarities[1], output.Similarities[2])
+
+	// the first input of Run is the source sentence
+	runOutput, err := similarity.RunPipeline([]string{"How do I pay my invoice?", "What are the payment options for invoices?"})
+	check(t, err)
+	assert.InDelta(t, output.Similarities[1], runOutput.Similarities[0], 1e-5)
+
+	_, err = similarity.RunPipeline(nil)
+	assert.Error(t, err)
+	_, err = pipelines.NewSentenceSimilarityPipeline(nil)
+	assert.Error(t, err)
+}
+
+func TestTextClassificationPipeline(t *testing.T) {
+	session, err := NewSession(
+		WithOnnxLibraryPath(onnxRuntimeSharedLibrary),
+		WithTelemetry(),
+		WithCpuMemArena(true),
+		WithMemPattern(true),
+		WithIntraOpNumThreads(1),
+		WithInterOpNumThreads(1),
+	)
+	check(t, err)
+	defer func(session *Session) {
+		errDestroy := session.Destroy()
+		check(t, errDestroy)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+	modelPathMulti := "./models/SamLowe_roberta-base-go_emotions-onnx"
+
+	config := TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineSimple",
+		Options: []TextClassificationOption{
+			pipelines.WithSoftmax(),
+		},
+	}
+	sentimentPipeline, err := NewPipeline(session, config)
+	check(t, err)
+
+	configMulti := TextClassificationConfig{
+		ModelPath:    modelPathMulti,
+		Name:         "testPipelineSimpleMulti",
+		OnnxFilename: "model.onnx",
+		Options: []TextClassificationOption{
+			pipelines.WithMultiLabel(),
+			pipelines.WithSigmoid(),
+		},
+	}
+	sentimentPipelineMulti, err := NewPipeline(session, configMulti)
+	check(t, err)
+
+	tests := []struct {
+		pipeline *pipelines.TextClassificationPipeline
+		name     string
+		strings  []string
+		expected pipelines.TextClassificationOutput
+	}{
+		{
+			pipeline: sentimentPipeline,
+			name:     "Basic tests",
+			strings:  []string{"This movie is disgustingly good!", "The director tried too much"},
+			expected: pipelines.TextClassificationOutput{
+				ClassificationOutputs: [][]pipelines.ClassificationOutput{
+					{
+						{
+							Label: "POSITIVE",
+							Score: 0.9998536109924316,
+						},
+					},
+					{
+						{
+							Label: "NEGATIVE",
+							Score: 0.9975218176841736,
+						},
+					},
+				},
+			},
+		},
+		{
+			pipeline: sentimentPipelineMulti,
+			name:     "Multiclass pipeline test",
+			strings:  []string{"ONNX is seriously fast for small batches. Impressive"},
+			expected: pipelines.TextClassificationOutput{
+				ClassificationOutputs: [][]pipelines.ClassificationOutput{
+					{
+						{
+							Label: "admiration",
+							Score: 0.9217681,
+						},
+						{
+							Label: "amusement",
+							Score: 0.001201711,
+						},
+						{
+							Label: "anger",
+							Score: 0.001109502,
+						},
+						{
+							Label: "annoyance",
+							Score: 0.0034009134,
+						},
+						{
+							Label: "approval",
+							Score: 0.05643816,
+						},
+						{
+							Label: "caring",
+							Score: 0.0011591336,
+						},
+						{
+							Label: "confusion",
+							Score: 0.0018672282,
+						},
+						{
+							Label: "curiosity",
+							Score: 0.0026787464,
+						},
+						{
+							Label: "desire",
+							Score: 0.00085846696,
+						},
+						{
+							Label: "disappointment",
+							Score: 0.0027759627,
+						},
+						{
+							Label: "disapproval",
+							Score: 0.004615115,
+						},
+						{
+							Label: "disgust",
+							Score: 0.00075303164,
+						},
+						{
+							Label: "embarrassment",
+							Score: 0.0003314704,
+						},
+						{
+							Label: "excitement",
+							Score: 0.005340109,
+						},
+						{
+							Label: "fear",
+							Score: 0.00042834174,
+						},
+						{
+							Label: "gratitude",
+							Score: 0.013405683,
+						},
+						{
+							Label: "grief",
+							Score: 0.00029952865,
+						},
+						{
+							Label: "joy",
+							Score: 0.0026875956,
+						},
+						{
+							Label: "love",
+							Score: 0.00092915917,
+						},
+						{
+							Label: "nervousness",
+							Score: 0.00012843,
+						},
+						{
+							Label: "optimism",
+							Score: 0.006792505,
+						},
+						{
+							Label: "pride",
+							Score: 0.0033409835,
+						},
+						{
+							Label: "realization",
+							Score: 0.007224476,
+						},
+						{
+							Label: "relief",
+							Score: 0.00071489986,
+						},
+						{
+							Label: "remorse",
+							Score: 0.00026071363,
+						},
+						{
+							Label: "sadness",
+							Score: 0.0009562365,
+						},
+						{
+							Label: "surprise",
+							Score: 0.0037120024,
+						},
+						{
+							Label: "neutral",
+							Score: 0.04079749,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batchResult, err := tt.pipeline.RunPipeline(tt.strings)
+			check(t, err)
+			for i, expected := range tt.expected.ClassificationOutputs {
+				checkClassificationOutput(t, expected, batchResult.ClassificationOutputs[i])
+			}
+		})
+	}
+
+	// check get stats
+	session.GetStats()
+}
+
+func TestTextClassificationDefaultAggregation(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+
+	// single label pipelines default to softmax, so that the scores of the labels sum to one
+	singleLabel, err := NewPipeline(session, TextClassificationConfig{ModelPath: modelPath, Name: "testPipelineSingle"})
+	check(t, err)
+	assert.Equal(t, "SOFTMAX", singleLabel.AggregationFunctionName)
+	output, err := singleLabel.RunPipeline([]string{"This movie is disgustingly good!"})
+	check(t, err)
+	checkClassificationOutput(t, output.ClassificationOutputs[0], []pipelines.ClassificationOutput{{Label: "POSITIVE", Score: 0.9998536109924316}})
+
+	// multi label pipelines default to sigmoid, which scores each label independently
+	multiLabel, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineMulti",
+		Options:   []TextClassificationOption{pipelines.WithMultiLabel()},
+	})
+	check(t, err)
+	assert.Equal(t, "SIGMOID", multiLabel.AggregationFunctionName)
+}
+
+func TestTextClassificationFloat64(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+	inputs := []string{"This movie is disgustingly good!", "The director tried too much"}
+
+	pipeline32, err := NewPipeline(session, TextClassificationConfig{ModelPath: modelPath, Name: "testPipeline32"})
+	check(t, err)
+	pipeline64, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipeline64",
+		Options:   []TextClassificationOption{pipelines.WithFloat64Scores()},
+	})
+	check(t, err)
+	output32, err := pipeline32.RunPipeline(inputs)
+	check(t, err)
+	assert.Nil(t, output32.Scores64)
+	output64, err := pipeline64.RunPipeline(inputs)
+	check(t, err)
+	assert.Len(t, output64.Scores64, len(inputs))
+	for i := range inputs {
+		assert.Equal(t, output32.ClassificationOutputs[i][0].Label, output64.ClassificationOutputs[i][0].Label)
+		assert.InDelta(t, output32.ClassificationOutputs[i][0].Score, output64.Scores64[i][0], 1e-6)
+		assert.Equal(t, float32(output64.Scores64[i][0]), output64.ClassificationOutputs[i][0].Score)
+	}
+}
+
+func TestTextPairClassification(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	// the zero shot test model is an NLI model with entailment and not_entailment labels
+	pipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/protectai_deberta-v3-base-zeroshot-v1-onnx",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	premise := "The cat is sleeping on the sofa."
+	output, err := pipeline.RunPairs([]string{premise, premise}, []string{"An animal is resting.", "The cat is running in the garden."})
+	check(t, err)
+	assert.Len(t, output.ClassificationOutputs, 2)
+	assert.Equal(t, "entailment", output.ClassificationOutputs[0][0].Label)
+	assert.Equal(t, "not_entailment", output.ClassificationOutputs[1][0].Label)
+
+	_, err = pipeline.RunPairs([]string{premise}, nil)
+	assert.Error(t, err)
+}
+
+func TestTextClassificationSlidingWindow(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+	pipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipeline",
+	})
+	check(t, err)
+	windowPipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineWindow",
+		Options:   []pipelines.PipelineOption[*pipelines.TextClassificationPipeline]{pipelines.WithSlidingWindow(16, 4)},
+	})
+	check(t, err)
+	voteConfig := TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineVote",
+		Options: []pipelines.PipelineOption[*pipelines.TextClassificationPipeline]{
+			pipelines.WithSlidingWindow(16, 4),
+			pipelines.WithWindowAggregation("VOTE"),
+		},
+	}
+	votePipeline, err := NewPipeline(session, voteConfig)
+	check(t, err)
+
+	// inputs that fit in a window are classified as without windows
+	short := "I love this movie."
+	expected, err := pipeline.RunPipeline([]string{short})
+	check(t, err)
+	output, err := windowPipeline.RunPipeline([]string{short})
+	check(t, err)
+	assert.Equal(t, expected.ClassificationOutputs[0][0].Label, output.ClassificationOutputs[0][0].Label)
+	assert.InDelta(t, expected.ClassificationOutputs[0][0].Score, output.ClassificationOutputs[0][0].Score, 1e-4)
+
+	// most windows of the long input are positive, and the last ones negative
+	long := strings.Repeat("This movie is wonderful and I loved every minute of it. ", 3) + "The ending was terrible and boring, a complete waste of time."
+	output, err = votePipeline.RunPipeline([]string{long, short})
+	check(t, err)
+	assert.Len(t, output.ClassificationOutputs, 2)
+	assert.Equal(t, "POSITIVE", output.ClassificationOutputs[0][0].Label)
+	assert.Less(t, output.ClassificationOutputs[0][0].Score, float32(1))
+	assert.Equal(t, float32(1), output.ClassificationOutputs[1][0].Score)
+
+	batch := pipelines.NewBatch()
+	check(t, windowPipeline.Preprocess(batch, []string{long}))
+	assert.Greater(t, len(batch.Input), 1)
+	for _, window := range batch.Input {
+		assert.LessOrEqual(t, len(window.TokenIDs), 16)
+	}
+	check(t, batch.Destroy())
+
+	voteConfig.Name = "testPipelineInvalid"
+	voteConfig.Options = []pipelines.PipelineOption[*pipelines.TextClassificationPipeline]{pipelines.WithSlidingWindow(16, 14)}
+	_, err = NewPipeline(session, voteConfig)
+	assert.Error(t, err)
+}
+
+func TestRemoteBackend(t *testing.T) {
+	// a KServe v2 server that classifies every input as POSITIVE
+	var requestedBatchSize atomic.Int64
+	var serverDown atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if serverDown.Load() {
+			http.Error(w, `{"error": "server unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/models/sst2/ready":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/models/sst2/infer":
+			var request struct {
+				Inputs []struct {
+					Name  string  `json:"name"`
+					Shape []int64 `json:"shape"`
+				} `json:"inputs"`
+				Outputs []struct {
+					Name string `json:"name"`
+				} `json:"outputs"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			assert.Equal(t, "input_ids", request.Inputs[0].Name)
+			batchSize := request.Inputs[0].Shape[0]
+			requestedBatchSize.Store(batchSize)
+			data := make([]float32, 0, 2*batchSize)
+			for range batchSize {
+				data = append(data, -1, 1)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"outputs": []map[string]any{
+				{"name": request.Outputs[0].Name, "shape": []int64{batchSize, 2}, "datatype": "FP32", "data": data},
+			}})
+		default:
+			http.Error(w, `{"error": "unknown model"}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	backend := pipelines.NewRemoteBackend(server.URL, "sst2")
+	check(t, backend.Ready(context.Background()))
+	pipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+		Remote:    backend,
+	})
+	check(t, err)
+	assert.Nil(t, pipeline.OrtSession)
+	output, err := pipeline.RunPipeline([]string{"This movie is terrible.", "I hated it."})
+	check(t, err)
+	assert.Equal(t, int64(2), requestedBatchSize.Load())
+	for _, classification := range output.ClassificationOutputs {
+		assert.Equal(t, "POSITIVE", classification[0].Label)
+	}
+
+	pipeline.Remote = pipelines.NewRemoteBackend(server.URL, "missing")
+	assert.Error(t, pipeline.Remote.Ready(context.Background()))
+	_, err = pipeline.RunPipeline([]string{"This movie is terrible."})
+	assert.ErrorContains(t, err, "unknown model")
+
+	// hybrid execution: single inputs run locally, larger batches remotely, and failed remote batches locally
+	hybridBackend := pipelines.NewRemoteBackend(server.URL, "sst2")
+	hybridBackend.LocalBatchSize = 1
+	hybridBackend.Failover = true
+	hybridPipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipelineHybrid",
+		Remote:    hybridBackend,
+	})
+	check(t, err)
+	assert.NotNil(t, hybridPipeline.OrtSession)
+	output, err = hybridPipeline.RunPipeline([]string{"This movie is terrible."})
+	check(t, err)
+	assert.Equal(t, "NEGATIVE", output.ClassificationOutputs[0][0].Label)
+	output, err = hybridPipeline.RunPipeline([]string{"This movie is terrible.", "I hated it."})
+	check(t, err)
+	assert.Equal(t, "POSITIVE", output.ClassificationOutputs[0][0].Label)
+	serverDown.Store(true)
+	output, err = hybridPipeline.RunPipeline([]string{"This movie is terrible.", "I hated it."})
+	check(t, err)
+	assert.Equal(t, "NEGATIVE", output.ClassificationOutputs[0][0].Label)
+	assert.Equal(t, pipelines.RemoteBackendStats{LocalBatches: 2, RemoteBatches: 1, Failovers: 1}, hybridBackend.Stats())
+	// the server is not tried again during the cooldown
+	serverDown.Store(false)
+	output, err = hybridPipeline.RunPipeline([]string{"This movie is terrible.", "I hated it."})
+	check(t, err)
+	assert.Equal(t, "NEGATIVE", output.ClassificationOutputs[0][0].Label)
+	assert.Equal(t, uint64(1), hybridBackend.Stats().Failovers)
+}
+
+func TestClassificationStream(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	pipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+	stream, err := pipelines.NewClassificationStream(pipeline)
+	check(t, err)
+	stream.Window = 24
+	stream.Debounce = 50 * time.Millisecond
+	receive := func() pipelines.ClassificationVerdict {
+		select {
+		case verdict := <-stream.Verdicts():
+			check(t, verdict.Err)
+			return verdict
+		case <-time.After(10 * time.Second):
+			t.Fatal("no verdict received")
+			return pipelines.ClassificationVerdict{}
+		}
+	}
+
+	// appends within the debounce are classified together
+	check(t, stream.Append("This movie "))
+	check(t, stream.Append("is wonderful"))
+	verdict := receive()
+	assert.Equal(t, "This movie is wonderful", verdict.Text)
+	assert.Equal(t, 0, verdict.Start)
+	assert.Equal(t, 23, verdict.End)
+	assert.Equal(t, "POSITIVE", verdict.Labels[0].Label)
+
+	// flushing does not wait for the debounce, and the window is moved forward to the start of a word
+	check(t, stream.Append(", the ending was awful and boring"))
+	stream.Flush()
+	verdict = receive()
+	assert.Equal(t, "was awful and boring", verdict.Text)
+	assert.Equal(t, 36, verdict.Start)
+	assert.Equal(t, 56, verdict.End)
+	assert.Equal(t, "NEGATIVE", verdict.Labels[0].Label)
+
+	// closing classifies the pending text and closes the channel
+	check(t, stream.Append("!"))
+	stream.Close()
+	verdict = receive()
+	assert.Equal(t, "was awful and boring!", verdict.Text)
+	_, open := <-stream.Verdicts()
+	assert.False(t, open)
+	assert.Error(t, stream.Append("more"))
+}
+
+func TestRunWithProgress(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+
+	config := TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineProgress",
+	}
+	sentimentPipeline, err := NewPipeline(session, config)
+	check(t, err)
+
+	inputs := []string{"This movie is disgustingly good!", "The director tried too much", "The film was excellent"}
+	var reported []pipelines.Progress
+	outputs, err := pipelines.RunWithProgress(sentimentPipeline, inputs, 2, func(progress pipelines.Progress) {
+		reported = append(reported, progress)
+	})
+	check(t, err)
+	assert.Equal(t, len(inputs), len(outputs))
+	assert.Equal(t, 2, len(reported))
+	assert.Equal(t, 2, reported[0].Processed)
+	assert.Equal(t, len(inputs), reported[1].Processed)
+	assert.Equal(t, len(inputs), reported[1].Total)
+}
+
+func TestDegradingPipeline(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	sentimentPipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	memoryUsage := uint64(500)
+	var warnings []string
+	degrading, err := pipelines.NewDegradingPipeline(sentimentPipeline, pipelines.MemoryPressurePolicy{
+		HighWatermark:  1000,
+		MaxBatchSize:   4,
+		MaxInputLength: 1024,
+		MinInputLength: 16,
+		MemoryUsage:    func() (uint64, error) { return memoryUsage, nil },
+		Warn:           func(message string) { warnings = append(warnings, message) },
+	})
+	check(t, err)
+
+	inputs := []string{"This movie is disgustingly good!", "The director tried too much", "The film was excellent"}
+	output, err := degrading.RunPipeline(inputs)
+	check(t, err)
+	assert.Len(t, output.Outputs, 3)
+	assert.False(t, degrading.Stats().Degraded)
+	assert.Empty(t, warnings)
+
+	memoryUsage = 2000
+	output, err = degrading.RunPipeline(inputs)
+	check(t, err)
+	assert.Len(t, output.Outputs, 3)
+	stats := degrading.Stats()
+	assert.True(t, stats.Degraded)
+	assert.Equal(t, 1, stats.BatchSize)
+	assert.Equal(t, 256, stats.InputLength)
+	assert.Equal(t, 2, stats.Degradations)
+	assert.NotEmpty(t, warnings)
+
+	memoryUsage = 100
+	_, err = degrading.RunPipeline(inputs)
+	check(t, err)
+	stats = degrading.Stats()
+	assert.False(t, stats.Degraded)
+	assert.Equal(t, 4, stats.BatchSize)
+	assert.Equal(t, 1024, stats.InputLength)
+	assert.Equal(t, 0, stats.TruncatedInputs)
+
+	_, err = pipelines.NewDegradingPipeline(sentimentPipeline, pipelines.MemoryPressurePolicy{MaxBatchSize: 4})
+	assert.Error(t, err)
+}
+
+func TestMemoryStats(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	sentimentPipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	stats := sentimentPipeline.GetMemoryStats()
+	assert.Greater(t, stats.ModelBytes, uint64(0))
+	assert.Equal(t, uint64(0), stats.PeakBatchBytes)
+
+	_, err = sentimentPipeline.RunPipeline([]string{"This movie is disgustingly good!", "The director tried too much"})
+	check(t, err)
+	stats = sentimentPipeline.GetMemoryStats()
+	assert.Greater(t, stats.PeakBatchBytes, uint64(0))
+	assert.GreaterOrEqual(t, stats.PeakBytes(), stats.ModelBytes+stats.PeakBatchBytes)
+
+	_, err = sentimentPipeline.RunPipeline([]string{"Short"})
+	check(t, err)
+	assert.Equal(t, stats.PeakBatchBytes, sentimentPipeline.GetMemoryStats().PeakBatchBytes)
+
+	sessionStats := session.GetMemoryStats()
+	assert.Contains(t, sessionStats, "testPipeline")
+	assert.Equal(t, stats.ModelBytes, sessionStats["testPipeline"].ModelBytes)
+	assert.Contains(t, session.GetStats(), sessionStats["testPipeline"].String())
+}
+
+func TestDoctor(t *testing.T) {
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+	report := Doctor(DoctorOptions{
+		OnnxLibraryPath:    onnxRuntimeSharedLibrary,
+		ModelPaths:         []string{modelPath, "./models/missing"},
+		ExecutionProviders: []string{"CoreML"},
+	})
+	statuses := map[string]DoctorStatus{}
+	for _, check := range report.Checks {
+		statuses[check.Name] = check.Status
+	}
+	assert.Equal(t, DoctorOK, statuses["onnxruntime library"])
+	assert.Equal(t, DoctorOK, statuses["tokenizers library"])
+	assert.Contains(t, statuses, "CoreML execution provider")
+	assert.Equal(t, DoctorOK, statuses["model "+modelPath])
+	assert.Equal(t, DoctorError, statuses["model ./models/missing"])
+	assert.False(t, report.OK())
+	assert.Contains(t, report.String(), "hint:")
+
+	// the environment is destroyed after the checks, so that a session can be created
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	check(t, session.Destroy())
+
+	report = Doctor(DoctorOptions{OnnxLibraryPath: "./missing/onnxruntime.so"})
+	assert.False(t, report.OK())
+}
+
+func TestQualityScoringPipeline(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+
+	config := TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineQuality",
+	}
+	classifier, err := NewPipeline(session, config)
+	check(t, err)
+	// use the sentiment model as a stand-in quality classifier: the score is the probability of POSITIVE
+	qualityPipeline, err := pipelines.NewQualityScoringPipeline(classifier, map[string]float32{"NEGATIVE": 0, "POSITIVE": 1})
+	check(t, err)
+
+	output, err := qualityPipeline.RunPipeline([]string{"The film was excellent", "The director tried too much"})
+	check(t, err)
+	assert.Equal(t, 2, len(output.Scores))
+	assert.Greater(t, output.Scores[0].Score, float32(0.9))
+	assert.Less(t, output.Scores[1].Score, float32(0.1))
+
+	// the preset runs a copy of the classifier, which keeps its configuration
+	assert.Equal(t, "singleLabel", classifier.ProblemType)
+	assert.Equal(t, "SOFTMAX", classifier.AggregationFunctionName)
+	classifierOutput, err := classifier.RunPipeline([]string{"The film was excellent"})
+	check(t, err)
+	assert.Len(t, classifierOutput.ClassificationOutputs[0], 1)
+
+	_, err = pipelines.NewQualityScoringPipeline(classifier, map[string]float32{"UNKNOWN": 1})
+	assert.Error(t, err)
+}
+
+func TestMaskedLMScoringPipeline(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	config := FillMaskConfig{
+		ModelPath:    "./models/Xenova_bert-base-uncased",
+		Name:         "testPipelineMaskedLMScoring",
+		OnnxFilename: "model_quantized.onnx",
+	}
+	fillMask, err := NewPipeline(session, config)
+	check(t, err)
+
+	inputs := []string{"the cat sat on the mat.", "", "mat the on sat cat the.", "paris is the capital of france."}
+	scoring, err := pipelines.NewMaskedLMScoringPipeline(fillMask, 0)
+	check(t, err)
+	output, err := scoring.RunPipeline(inputs)
+	check(t, err)
+	assert.Len(t, output.Scores, 4)
+
+	// every token but the special ones is masked once, and the scores follow the tokens of their input
+	tokens := [][]string{{"the", "cat", "sat", "on", "the", "mat", "."}, nil, {"mat", "the", "on", "sat", "cat", "the", "."},
+		{"paris", "is", "the", "capital", "of", "france", "."}}
+	for i, score := range output.Scores {
+		assert.Len(t, score.TokenScores, len(tokens[i]))
+		sum := float32(0)
+		for j, tokenScore := range score.TokenScores {
+			assert.Equal(t, tokens[i][j], tokenScore.Token)
+			assert.Equal(t, tokens[i][j], inputs[i][tokenScore.Start:tokenScore.End])
+			assert.Less(t, tokenScore.LogProbability, float32(0))
+			sum += tokenScore.LogProbability
+		}
+		assert.InDelta(t, sum, score.PseudoLogLikelihood, 1e-4)
+		if len(tokens[i]) > 0 {
+			assert.InDelta(t, math.Exp(-float64(sum)/float64(len(tokens[i]))), score.PseudoPerplexity, 1e-2)
+		}
+	}
+	assert.Zero(t, output.Scores[1].PseudoLogLikelihood)
+	assert.Zero(t, output.Scores[1].PseudoPerplexity)
+	assert.Less(t, output.Scores[0].PseudoPerplexity, output.Scores[2].PseudoPerplexity)
+
+	// the masked copies are split in chunks that cross inputs, which gives the same scores
+	for _, batchSize := range []int{1, 3, 8} {
+		chunked, err := pipelines.NewMaskedLMScoringPipeline(fillMask, batchSize)
+		check(t, err)
+		chunkedOutput, err := chunked.RunPipeline(inputs)
+		check(t, err)
+		for i, score := range chunkedOutput.Scores {
+			assert.Len(t, score.TokenScores, len(tokens[i]))
+			for j, tokenScore := range score.TokenScores {
+				assert.InDelta(t, output.Scores[i].TokenScores[j].LogProbability, tokenScore.LogProbability, 1e-3, "batch size %d", batchSize)
+			}
+		}
+	}
+
+	_, err = pipelines.NewMaskedLMScoringPipeline(fillMask, -1)
+	assert.Error(t, err)
+	_, err = pipelines.NewMaskedLMScoringPipeline(nil, 0)
+	assert.Error(t, err)
+}
+
+func TestQuantizationReport(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+
+	original, err := NewPipeline(session, TextClassificationConfig{ModelPath: modelPath, Name: "testPipelineOriginal"})
+	check(t, err)
+	// a model compared with itself agrees on every sample
+	quantized, err := NewPipeline(session, TextClassificationConfig{ModelPath: modelPath, Name: "testPipelineQuantized"})
+	check(t, err)
+
+	samples := []pipelines.LabeledInput{
+		{Text: "The film was excellent", Label: "POSITIVE"},
+		{Text: "The director tried too much", Label: "NEGATIVE"},
+		{Text: "This movie is disgustingly good!", Label: "POSITIVE"},
+	}
+	report, err := pipelines.NewQuantizationReport(original, quantized, samples, 2)
+	check(t, err)
+	assert.Equal(t, len(samples), report.Samples)
+	assert.Equal(t, float32(1), report.Agreement)
+	assert.Equal(t, float32(0), report.AccuracyDrop)
+	assert.False(t, report.AccuracyDropCI.Significant())
+	assert.Equal(t, float32(1), report.SizeRatio)
+	assert.Greater(t, report.Original.SizeBytes, int64(0))
+	fmt.Print(report.String())
+}
+
+func TestCheckTokenizer(t *testing.T) {
+	texts := []string{"The film was excellent", "Un café à Paris", "Great movie 😀"}
+	report, err := pipelines.CheckTokenizer("./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english", texts)
+	check(t, err)
+	assert.Equal(t, len(texts), report.Texts)
+	assert.Equal(t, len(texts), report.ExactRoundTrips+report.NormalizedRoundTrips+report.LossyTexts)
+	// the uncased model lowercases texts, strips accents and has no token for emojis
+	assert.True(t, report.HasIssues())
+	assert.Equal(t, 0, report.OffsetErrors)
+	assert.Equal(t, 1, report.UnknownTokens)
+	assert.Contains(t, report.Characters, pipelines.ProblemCharacter{Character: 'é', Kind: pipelines.LossyDecoding, Count: 1})
+	assert.Contains(t, report.Characters, pipelines.ProblemCharacter{Character: '😀', Kind: pipelines.UnknownCharacters, Count: 1})
+	fmt.Print(report.String())
+
+	_, err = pipelines.CheckTokenizer("./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english", nil)
+	assert.Error(t, err)
+}
+
+func TestBootstrapDelta(t *testing.T) {
+	expected := make([]string, 200)
+	better := make([]string, 200)
+	worse := make([]string, 200)
+	for i := range expected {
+		expected[i] = []string{"A", "B"}[i%2]
+		better[i] = expected[i]
+		worse[i] = expected[i]
+		if i%4 == 0 {
+			worse[i] = "B"
+		}
+	}
+	interval, err := util.BootstrapDelta(len(expected), util.AccuracyMetric(worse, expected), util.AccuracyMetric(better, expected), 500, 0.95, 42)
+	check(t, err)
+	assert.InDelta(t, 0.25, interval.Delta, 1e-9)
+	assert.True(t, interval.Significant())
+	assert.Less(t, interval.Lower, interval.Delta)
+	assert.Greater(t, interval.Upper, interval.Delta)
+
+	// the same model is never significantly better than itself
+	interval, err = util.BootstrapDelta(len(expected), util.MacroF1Metric(worse, expected), util.MacroF1Metric(worse, expected), 500, 0.95, 42)
+	check(t, err)
+	assert.False(t, interval.Significant())
+
+	ndcg, err := util.NDCG([]float64{3, 2, 0}, 3)
+	check(t, err)
+	assert.InDelta(t, 1, ndcg, 1e-9)
+	ndcg, err = util.NDCG([]float64{0, 2, 3}, 3)
+	check(t, err)
+	assert.Less(t, ndcg, 1.0)
+	for _, k := range []int{0, -1} {
+		_, err = util.NDCG([]float64{3, 2, 0}, k)
+		assert.Error(t, err)
+	}
+}
+
+func TestSampleEvalSet(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	classifier, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	inputs := []string{
+		"The film was excellent",
+		"This movie is disgustingly good!",
+		"A wonderful cast and a great story",
+		"I loved every minute of it",
+		"The director tried too much",
+		"What a waste of time",
+	}
+	samples, err := pipelines.SampleEvalSet(inputs, pipelines.StratifyByPredictedLabel(classifier, 4), 2, 1)
+	check(t, err)
+	assert.Len(t, samples, 2)
+	assert.Equal(t, "NEGATIVE", samples[0].Stratum)
+	assert.Equal(t, "POSITIVE", samples[1].Stratum)
+
+	samples, err = pipelines.SampleEvalSet(inputs, pipelines.StratifyByLength(5), 3, 1)
+	check(t, err)
+	strata := map[string]int{}
+	for _, sample := range samples {
+		strata[sample.Stratum]++
+	}
+	assert.Equal(t, map[string]int{"0-5": 2, ">5": 1}, strata)
+	again, err := pipelines.SampleEvalSet(inputs, pipelines.StratifyByLength(5), 3, 1)
+	check(t, err)
+	assert.Equal(t, samples, again)
+
+	var buffer strings.Builder
+	samples[0].Label = "POSITIVE"
+	check(t, pipelines.WriteEvalSet(&buffer, samples))
+	labeled, err := pipelines.ReadEvalSet(strings.NewReader(buffer.String()))
+	check(t, err)
+	assert.Len(t, labeled, 3)
+	assert.Equal(t, pipelines.LabeledInput{Text: samples[0].Text, Label: "POSITIVE"}, labeled[0])
+}
+
+func TestActiveLearningSampler(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	classifier, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testClassifier",
+	})
+	check(t, err)
+	embedder, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testEmbedder",
+	})
+	check(t, err)
+
+	inputs := []string{
+		"The movie was fine I guess",
+		"The movie was fine I guess",
+		"This movie is disgustingly good!",
+		"What a waste of time",
+	}
+	sampler, err := pipelines.NewActiveLearningSampler(classifier, nil)
+	check(t, err)
+	candidates, err := sampler.Select(inputs, 3)
+	check(t, err)
+	assert.Len(t, candidates, 3)
+	for i, candidate := range candidates {
+		assert.GreaterOrEqual(t, candidate.Entropy, float32(0))
+		assert.LessOrEqual(t, candidate.Entropy, float32(1))
+		if i > 0 {
+			assert.LessOrEqual(t, candidate.Entropy, candidates[i-1].Entropy)
+		}
+	}
+
+	// with diversity only, the duplicate of the first candidate is selected last
+	sampler, err = pipelines.NewActiveLearningSampler(classifier, embedder)
+	check(t, err)
+	sampler.DiversityWeight = 1
+	candidates, err = sampler.Select(inputs, 4)
+	check(t, err)
+	assert.Equal(t, 0, candidates[0].Index)
+	assert.Equal(t, 1, candidates[3].Index)
+	assert.InDelta(t, 0, candidates[3].Diversity, 1e-4)
+
+	var buffer strings.Builder
+	check(t, pipelines.WriteLabelingCandidates(&buffer, candidates))
+	labeled, err := pipelines.ReadEvalSet(strings.NewReader(buffer.String()))
+	check(t, err)
+	assert.Len(t, labeled, 4)
+}
+
+func TestWeakLabeler(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	classifier, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	positive, err := pipelines.KeywordLabelingFunction("positiveKeywords", "pos", "excellent", "great")
+	check(t, err)
+	negative, err := pipelines.KeywordLabelingFunction("negativeKeywords", "neg", "waste", "boring")
+	check(t, err)
+	model := pipelines.ClassifierLabelingFunction("sentimentModel", classifier, 0.9, map[string]string{"POSITIVE": "pos", "NEGATIVE": "neg"})
+	labeler, err := pipelines.NewWeakLabeler(positive, negative, model)
+	check(t, err)
+	labeler.BatchSize = 2
+
+	labels, err := labeler.Label([]string{"The film was excellent", "What a waste of time", "Boring, and a waste of money", "A GREAT cast"})
+	check(t, err)
+	assert.Equal(t, "pos", labels[0].Label)
+	assert.Equal(t, map[string]string{"positiveKeywords": "pos", "sentimentModel": "pos"}, labels[0].Votes)
+	assert.Equal(t, float32(1), labels[0].Confidence)
+	assert.Equal(t, "neg", labels[1].Label)
+	assert.Equal(t, "neg", labels[2].Label)
+	assert.Equal(t, "pos", labels[3].Label)
+	for _, weight := range labeler.Weights {
+		assert.Greater(t, weight, float32(0.5))
+	}
+
+	keywordsOnly, err := pipelines.NewWeakLabeler(positive, negative)
+	check(t, err)
+	labels, err = keywordsOnly.Label([]string{"Nothing to see here"})
+	check(t, err)
+	assert.Equal(t, pipelines.Abstain, labels[0].Label)
+
+	_, err = pipelines.NewWeakLabeler(positive, positive)
+	assert.Error(t, err)
+}
+
+func TestTextStatisticsPipeline(t *testing.T) {
+	stats := util.ComputeTextStatistics("The cat sat on the mat. It was happy!")
+	assert.Equal(t, 9, stats.Words)
+	assert.Equal(t, 2, stats.Sentences)
+	assert.Equal(t, 10, stats.Syllables)
+	assert.InDelta(t, 206.835-1.015*4.5-84.6*10.0/9, stats.FleschReadingEase, 1e-9)
+	assert.Equal(t, 1, util.ComputeTextStatistics("Pi is 3.14").Sentences)
+	assert.Equal(t, 0, util.ComputeTextStatistics(" ... ").Sentences)
+	assert.Equal(t, 1, util.CountSyllables("make"))
+	assert.Equal(t, 2, util.CountSyllables("table"))
+
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	classifier, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+	_, err = pipelines.NewTextStatisticsPipeline(nil, nil)
+	assert.Error(t, err)
+	annotated, err := pipelines.NewTextStatisticsPipeline(classifier, classifier.Tokenizer)
+	check(t, err)
+	annotated.Skip = func(stats util.TextStatistics) bool { return stats.Words < 3 }
+
+	output, err := annotated.RunPipeline([]string{"This movie is disgustingly good !", "Meh"})
+	check(t, err)
+	assert.Equal(t, 5, output.Outputs[0].Statistics.Words)
+	assert.GreaterOrEqual(t, output.Outputs[0].Statistics.Tokens, 6)
+	assert.Equal(t, "POSITIVE", output.Outputs[0].Output.([]pipelines.ClassificationOutput)[0].Label)
+	assert.True(t, output.Outputs[1].Skipped)
+	assert.Nil(t, output.Outputs[1].Output)
+}
+
+func TestKeywordPrefilterPipeline(t *testing.T) {
+	matcher := util.NewKeywordMatcher([]string{"he", "she", "hers", "Straße"}, true, false)
+	assert.Equal(t, []util.KeywordMatch{
+		{Keyword: "she", Start: 1, End: 4},
+		{Keyword: "he", Start: 2, End: 4},
+		{Keyword: "hers", Start: 2, End: 6},
+		{Keyword: "Straße", Start: 11, End: 18},
+	}, matcher.FindAll("ushers and STRAßE"))
+	assert.False(t, util.NewKeywordMatcher([]string{"he"}, false, true).Match("ushers"))
+
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	classifier, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	prefilter, err := pipelines.NewKeywordPrefilterPipeline(classifier, []string{"waste", "awful"}, "MATCHED")
+	check(t, err)
+	output, err := prefilter.RunPipeline([]string{"What a waste of time", "The film was excellent", "Wasteful, AWFUL acting"})
+	check(t, err)
+	assert.True(t, output.Outputs[0].Skipped)
+	assert.Nil(t, output.Outputs[0].Output)
+	assert.Equal(t, []util.KeywordMatch{{Keyword: "waste", Start: 7, End: 12}}, output.Outputs[0].Matches)
+	assert.False(t, output.Outputs[1].Skipped)
+	assert.Equal(t, "POSITIVE", output.Outputs[1].Output.([]pipelines.ClassificationOutput)[0].Label)
+	assert.Equal(t, []util.KeywordMatch{{Keyword: "awful", Start: 10, End: 15}}, output.Outputs[2].Matches)
+
+	prefilter, err = pipelines.NewKeywordPrefilterPipeline(classifier, nil, "SOMETIMES")
+	assert.Error(t, err)
+	assert.Nil(t, prefilter)
+}
+
+func TestTextClassificationTaxonomy(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+	taxonomy := &pipelines.LabelTaxonomy{Parents: map[string]string{"POSITIVE": "sentiment", "NEGATIVE": "sentiment"}}
+	inputs := []string{"This movie is disgustingly good !", "The director tried too much"}
+	pipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipeline",
+		Options:   []TextClassificationOption{pipelines.WithTaxonomy(taxonomy)},
+	})
+	check(t, err)
+	output, err := pipeline.RunPipeline(inputs)
+	check(t, err)
+	assert.Equal(t, "POSITIVE", output.ClassificationOutputs[0][0].Label)
+	assert.Equal(t, []string{"sentiment", "POSITIVE"}, output.ClassificationOutputs[0][0].Path)
+	assert.Equal(t, "NEGATIVE", output.ClassificationOutputs[1][0].Label)
+
+	multiLabel, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineMultiLabel",
+		Options:   []TextClassificationOption{pipelines.WithMultiLabel(), pipelines.WithTaxonomy(taxonomy)},
+	})
+	check(t, err)
+	output, err = multiLabel.RunPipeline(inputs)
+	check(t, err)
+	classes := output.ClassificationOutputs[0]
+	assert.Len(t, classes, 3)
+	assert.Equal(t, "sentiment", classes[2].Label)
+	assert.Equal(t, []string{"sentiment"}, classes[2].Path)
+	assert.Equal(t, max(classes[0].Score, classes[1].Score), classes[2].Score)
+
+	// the taxonomy is read from the model directory
+	taxonomyPath := linkModel(t, modelPath)
+	check(t, os.WriteFile(filepath.Join(taxonomyPath, pipelines.TaxonomyFile), []byte(`{"parents": {"POSITIVE": "sentiment", "NEGATIVE": "sentiment"}}`), 0o600))
+	fromFile, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: taxonomyPath,
+		Name:      "testPipelineFromFile",
+	})
+	check(t, err)
+	assert.Equal(t, taxonomy, fromFile.Taxonomy)
+
+	_, err = NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineInvalid",
+		Options: []TextClassificationOption{pipelines.WithTaxonomy(&pipelines.LabelTaxonomy{
+			Parents: map[string]string{"POSITIVE": "NEGATIVE", "NEGATIVE": "POSITIVE"},
+		})},
+	})
+	assert.Error(t, err)
+}
+
+func TestTextClassificationThresholds(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+	inputs := []string{"This movie is disgustingly good !", "The director tried too much"}
+	pipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipeline",
+		Options: []TextClassificationOption{
+			pipelines.WithMultiLabel(),
+			pipelines.WithThresholds(map[string]float32{"POSITIVE": 0.5}, 1),
+		},
+	})
+	check(t, err)
+	output, err := pipeline.RunPipeline(inputs)
+	check(t, err)
+	assert.Len(t, output.ClassificationOutputs[0], 1)
+	assert.Equal(t, "POSITIVE", output.ClassificationOutputs[0][0].Label)
+	assert.Empty(t, output.ClassificationOutputs[1])
+
+	// the thresholds are read from the model directory
+	thresholdsPath := linkModel(t, modelPath)
+	check(t, os.WriteFile(filepath.Join(thresholdsPath, pipelines.ThresholdsFile), []byte(`{"threshold": 0.4, "thresholds": {"NEGATIVE": 0.9}}`), 0o600))
+	fromFile, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: thresholdsPath,
+		Name:      "testPipelineFromFile",
+		Options:   []TextClassificationOption{pipelines.WithMultiLabel()},
+	})
+	check(t, err)
+	assert.Equal(t, map[string]float32{"NEGATIVE": 0.9}, fromFile.Thresholds)
+	assert.Equal(t, float32(0.4), fromFile.Threshold)
+	output, err = fromFile.RunPipeline(inputs)
+	check(t, err)
+	assert.Equal(t, "POSITIVE", output.ClassificationOutputs[0][0].Label)
+	for _, classes := range output.ClassificationOutputs {
+		for _, class := range classes {
+			threshold, ok := fromFile.Thresholds[class.Label]
+			if !ok {
+				threshold = fromFile.Threshold
+			}
+			assert.GreaterOrEqual(t, class.Score, threshold)
+		}
+	}
+
+	// the moderation preset takes over the thresholds of the model
+	moderation, err := pipelines.NewModerationPipeline(fromFile, nil)
+	check(t, err)
+	assert.Equal(t, map[string]float32{"NEGATIVE": 0.9}, moderation.Thresholds)
+	assert.Equal(t, float32(0.4), moderation.DefaultThreshold)
+	assert.Equal(t, map[string]float32{"NEGATIVE": 0.9}, fromFile.Thresholds)
+	// the classifier still applies its thresholds, while the preset sees the scores of all the labels
+	afterPreset, err := fromFile.RunPipeline(inputs)
+	check(t, err)
+	assert.Equal(t, output.ClassificationOutputs, afterPreset.ClassificationOutputs)
+	verdicts, err := moderation.RunPipeline(inputs)
+	check(t, err)
+	assert.Len(t, verdicts.Verdicts[0].Scores, 2)
+
+	for _, thresholds := range []map[string]float32{{"NEUTRAL": 0.5}, {"POSITIVE": 2}} {
+		_, err = NewPipeline(session, TextClassificationConfig{
+			ModelPath: modelPath,
+			Name:      "testPipelineInvalid",
+			Options:   []TextClassificationOption{pipelines.WithMultiLabel(), pipelines.WithThresholds(thresholds, 0.5)},
+		})
+		assert.Error(t, err)
+	}
+}
+
+func TestCalibrationPersistence(t *testing.T) {
+	calibration, err := pipelines.LoadCalibration(t.TempDir())
+	check(t, err)
+	assert.Nil(t, calibration)
+
+	// the calibration is saved in a copy of the model directory
+	modelPath := linkModel(t, "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english")
+	check(t, pipelines.SaveCalibration(modelPath, &pipelines.Calibration{
+		Temperature: 0.5,
+		Platt:       map[string]pipelines.PlattScaling{"NEGATIVE": {A: 2, B: -1}},
+	}))
+
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	classifier, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	formality, err := pipelines.NewFormalityPipeline(classifier, nil, nil)
+	check(t, err)
+	assert.Equal(t, float32(0.5), formality.Temperature)
+	moderation, err := pipelines.NewModerationPipeline(classifier, nil)
+	check(t, err)
+	assert.Equal(t, map[string]pipelines.PlattScaling{"NEGATIVE": {A: 2, B: -1}}, moderation.Platt)
+
+	inputs := []string{"This movie is disgustingly good !", "The director tried too much", "What a waste of time", "A masterpiece"}
+	err = moderation.Calibrate([]pipelines.LabeledInput{
+		{Text: inputs[0], Label: "POSITIVE"},
+		{Text: inputs[1], Label: "NEGATIVE"},
+		{Text: inputs[2], Label: "NEGATIVE"},
+		{Text: inputs[3]},
+	}, 2)
+	check(t, err)
+	assert.Len(t, moderation.Platt, 2)
+	output, err := moderation.RunPipeline(inputs[1:2])
+	check(t, err)
+	assert.Equal(t, "NEGATIVE", output.Verdicts[0].Categories[0])
+	err = moderation.Calibrate([]pipelines.LabeledInput{{Text: inputs[0], Label: "TOXIC"}}, 1)
+	assert.Error(t, err)
+
+	// saving the calibration of a preset keeps the one of the other
+	check(t, moderation.SaveCalibration())
+	calibration, err = pipelines.LoadCalibration(modelPath)
+	check(t, err)
+	assert.Equal(t, float32(0.5), calibration.Temperature)
+	assert.Equal(t, moderation.Platt, calibration.Platt)
+	formality.Temperature = 2
+	check(t, formality.SaveCalibration())
+	reloaded, err := pipelines.NewModerationPipeline(classifier, nil)
+	check(t, err)
+	assert.Equal(t, moderation.Platt, reloaded.Platt)
+	formality, err = pipelines.NewFormalityPipeline(classifier, nil, nil)
+	check(t, err)
+	assert.Equal(t, float32(2), formality.Temperature)
+}
+
+func TestTextClassificationPipelineValidation(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+
+	config := TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineSimple",
+		Options: []TextClassificationOption{
+			pipelines.WithSingleLabel(),
+		},
+	}
+	sentimentPipeline, err := NewPipeline(session, config)
+	check(t, err)
+
+	t.Run("id-label-map", func(t *testing.T) {
+		labelMapInitial := sentimentPipeline.IDLabelMap
+		defer func() {
+			sentimentPipeline.IDLabelMap = labelMapInitial
+		}()
+		sentimentPipeline.IDLabelMap = map[int]string{}
+		err = sentimentPipeline.Validate()
+		assert.Error(t, err)
+	})
+
+	t.Run("output-shape", func(t *testing.T) {
+		dimensionInitial := sentimentPipeline.OutputsMeta[0].Dimensions
+		defer func() {
+			sentimentPipeline.OutputsMeta[0].Dimensions = dimensionInitial
+		}()
+		sentimentPipeline.OutputsMeta[0].Dimensions = ort.NewShape(-1, -1, -1)
+		err = sentimentPipeline.Validate()
+		assert.Error(t, err)
+	})
+}
+
+func TestZeroShotClassificationPipeline(t *testing.T) {
+	session, err := NewSession()
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	modelPath := "./models/protectai_deberta-v3-base-zeroshot-v1-onnx"
+
+	config := ZeroShotClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipeline",
+		Options: []pipelines.PipelineOption[*pipelines.ZeroShotClassificationPipeline]{
+			pipelines.WithHypothesisTemplate("This example is {}."),
+			pipelines.WithLabels([]string{"fun", "dangerous"}),
+		},
+	}
+
+	classificationPipeline, err := NewPipeline(session, config)
+	check(t, err)
+
+	tests := []struct {
+		pipeline   *pipelines.ZeroShotClassificationPipeline
+		name       string
+		sequences  []string
+		labels     []string
+		multilabel bool
+		expected   pipelines.ZeroShotOutput
+	}{
+		{
+			pipeline:   classificationPipeline,
+			name:       "single sequence, single label, no multilabel",
+			sequences:  []string{"I am going to the park"},
+			labels:     []string{"fun"},
+			multilabel: false,
+			expected: pipelines.ZeroShotOutput{
+				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
+					{
+						Sequence: "I am going to the park",
+						SortedValues: []struct {
+							Key   string
+							Value float64
+						}{
+							{
+								Key:   "fun",
+								Value: 0.0009069009101949632,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			pipeline:   classificationPipeline,
+			name:       "multiple sequences, multiple labels, no multilabel",
+			sequences:  []string{"I am going to the park", "I will watch Interstellar tonight"},
+			labels:     []string{"fun", "movie"},
+			multilabel: false,
+			expected: pipelines.ZeroShotOutput{
+				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
+					{
+						Sequence: "I am going to the park",
+						SortedValues: []struct {
+							Key   string
+							Value float64
+						}{
+							{
+								Key:   "fun",
+								Value: 0.7746766209602356,
+							},
+							{
+								Key:   "movie",
+								Value: 0.2253233790397644,
+							},
+						},
+					},
+					{
+						Sequence: "I will watch Interstellar tonight",
+						SortedValues: []struct {
+							Key   string
+							Value float64
+						}{
+							{
+								Key:   "movie",
+								Value: 0.9984978437423706,
+							},
+							{
+								Key:   "fun",
+								Value: 0.001502170693129301,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			pipeline:   classificationPipeline,
+			name:       "multiple sequences, multiple labels, multilabel",
+			sequences:  []string{"I am going to the park", "I will watch Interstellar tonight"},
+			labels:     []string{"fun", "movie"},
+			multilabel: true,
+			expected: pipelines.ZeroShotOutput{
+				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
+					{
+						Sequence: "I am going to the park",
+						SortedValues: []struct {
+							Key   string
+							Value float64
+						}{
+							{
+								Key:   "fun",
+								Value: 0.0009069009101949632,
+							},
+							{
+								Key:   "movie",
+								Value: 0.00009480675362283364,
+							},
+						},
+					},
+					{
+						Sequence: "I will watch Interstellar tonight",
+						SortedValues: []struct {
+							Key   string
+							Value float64
+						}{
+							{
+								Key:   "movie",
+								Value: 0.9985591769218445,
+							},
+							{
+								Key:   "fun",
+								Value: 0.0006653196760453284,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			pipeline:   classificationPipeline,
+			name:       "multiple sequences, single label, multilabel",
+			sequences:  []string{"I am going to the park", "I will watch Interstellar tonight"},
+			labels:     []string{"fun"},
+			multilabel: true,
+			expected: pipelines.ZeroShotOutput{
+				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
+					{
+						Sequence: "I am going to the park",
+						SortedValues: []struct {
+							Key   string
+							Value float64
+						}{
+							{
+								Key:   "fun",
+								Value: 0.0009069009101949632,
+							},
+						},
+					},
+					{
+						Sequence: "I will watch Interstellar tonight",
+						SortedValues: []struct {
+							Key   string
+							Value float64
+						}{
+							{
+								Key:   "fun",
+								Value: 0.0006653196760453284,
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			pipeline:   classificationPipeline,
+			name:       "single sequence, multiple labels, multilabel=false",
+			sequences:  []string{"Please don't bother me, I'm in a rush"},
+			labels:     []string{"busy", "relaxed", "stressed"},
+			multilabel: false,
+			expected: pipelines.ZeroShotOutput{
+				ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{
+					{
+						Sequence: "Please don't bother me, I'm in a rush",
+						SortedValues: []struct {
+							Key   string
+							Value float64
+						}{
+							{
+								Key:   "stressed",
+								Value: 0.8865461349487305,
+							},
+							{
+								Key:   "busy",
+								Value: 0.10629364103078842,
+							},
+							{
+								Key:   "relaxed",
+								Value: 0.007160270120948553,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classificationPipeline.Labels = tt.labels
+			classificationPipeline.Multilabel = tt.multilabel
+			batchResult, _ := tt.pipeline.RunPipeline(tt.sequences)
+			assert.Equal(t, len(batchResult.GetOutput()), len(tt.expected.ClassificationOutputs))
+
+			for ind, expected := range tt.expected.ClassificationOutputs {
+				expectedResult := expected.SortedValues
+				testResult := batchResult.ClassificationOutputs[ind].SortedValues
+				assert.Equal(t, len(expectedResult), len(testResult))
+				assert.Equal(t, tt.expected.ClassificationOutputs[ind].Sequence, batchResult.ClassificationOutputs[ind].Sequence)
+				for i := range testResult {
+					assert.True(t, almostEqual(testResult[i].Value, expectedResult[i].Value))
+				}
+			}
+		})
+	}
+}
+
+func TestZeroShotClassificationPipelineValidation(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/protectai_deberta-v3-base-zeroshot-v1-onnx"
+
+	config := TextClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineSimple",
+	}
+	sentimentPipeline, err := NewPipeline(session, config)
+	check(t, err)
+
+	t.Run("id-label-map", func(t *testing.T) {
+		labelMapInitial := sentimentPipeline.IDLabelMap
+		defer func() {
+			sentimentPipeline.IDLabelMap = labelMapInitial
+		}()
+		sentimentPipeline.IDLabelMap = map[int]string{}
+		err = sentimentPipeline.Validate()
+		assert.Error(t, err)
+	})
+
+	t.Run("output-shape", func(t *testing.T) {
+		dimensionInitial := sentimentPipeline.OutputsMeta[0].Dimensions
+		defer func() {
+			sentimentPipeline.OutputsMeta[0].Dimensions = dimensionInitial
+		}()
+		sentimentPipeline.OutputsMeta[0].Dimensions = ort.NewShape(-1, -1, -1)
+		err = sentimentPipeline.Validate()
+		assert.Error(t, err)
+	})
+}
+
+// Token classification
+
+func TestFaithfulnessChecker(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	nli, err := NewPipeline(session, ZeroShotClassificationConfig{
+		ModelPath: "./models/protectai_deberta-v3-base-zeroshot-v1-onnx",
+		Name:      "testPipeline",
+		Options: []pipelines.PipelineOption[*pipelines.ZeroShotClassificationPipeline]{
+			pipelines.WithLabels([]string{"unused"}),
+		},
+	})
+	check(t, err)
+
+	checker := pipelines.NewFaithfulnessChecker(nli)
+	source := "The Eiffel Tower was completed in 1889 for the World's Fair in Paris. It is made of wrought iron and was the tallest structure in the world until 1930."
+	report, err := checker.Check(source, "The Eiffel Tower is made of iron. It was built in 1950 by a team of Brazilian engineers.")
+	check(t, err)
+	assert.Len(t, report.Sentences, 2)
+	assert.Equal(t, "The Eiffel Tower is made of iron.", report.Sentences[0].Sentence)
+	assert.False(t, report.Sentences[0].Hallucination)
+	assert.True(t, report.Sentences[1].Hallucination)
+	assert.Greater(t, report.Sentences[0].Entailment, report.Sentences[1].Entailment)
+
+	checker.ChunkWords = 0
+	_, err = checker.Check(source, "The Eiffel Tower is made of iron.")
+	assert.Error(t, err)
+}
+
+func TestTokenClassificationPipeline(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	modelPath := "./models/KnightsAnalytics_distilbert-NER"
+	configSimple := TokenClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineSimple",
+		Options: []TokenClassificationOption{
+			pipelines.WithSimpleAggregation(),
+			pipelines.WithIgnoreLabels([]string{"O"}),
+		},
+	}
+	pipelineSimple, err2 := NewPipeline(session, configSimple)
+	check(t, err2)
+
+	configNone := TokenClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineNone",
+		Options: []TokenClassificationOption{
+			pipelines.WithoutAggregation(),
+		},
+	}
+	pipelineNone, err3 := NewPipeline(session, configNone)
+	check(t, err3)
+
+	configMapping := TokenClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineMapping",
+		Options: []TokenClassificationOption{
+			pipelines.WithSimpleAggregation(),
+			pipelines.WithLabelMapping(map[string]string{
+				"LABEL_0": "O",
+				"LABEL_1": "PERSON",
+				"LABEL_5": "LOCATION",
+			}),
+		},
+	}
+	pipelineMapping, err5 := NewPipeline(session, configMapping)
+	check(t, err5)
+
+	configRules := TokenClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineRules",
+		Options: []TokenClassificationOption{
+			pipelines.WithSimpleAggregation(),
+			pipelines.WithEntityRules([]pipelines.EntityRule{
+				{Label: "CITY", Terms: []string{"berlin"}, CaseInsensitive: true, Override: true},
+				{Label: "GREETING", Pattern: `[Hh]ello`},
+			}),
+		},
+	}
+	pipelineRules, err6 := NewPipeline(session, configRules)
+	check(t, err6)
+
+	var expectedResults map[int]pipelines.TokenClassificationOutput
+	err4 := json.Unmarshal(tokenExpectedByte, &expectedResults)
+	check(t, err4)
+
+	tests := []struct {
+		pipeline *pipelines.TokenClassificationPipeline
+		name     string
+		strings  []string
+		expected pipelines.TokenClassificationOutput
+	}{
+		{
+			pipeline: pipelineSimple,
+			name:     "Simple aggregation",
+			strings:  []string{"My name is Wolfgang and I live in Berlin."},
+			expected: expectedResults[0],
+		},
+		{
+			pipeline: pipelineNone,
+			name:     "No aggregation",
+			strings:  []string{"My name is Wolfgang and I live in Berlin."},
+			expected: expectedResults[1],
+		},
+		{
+			pipeline: pipelineSimple,
+			name:     "Parsing of batch with different token length",
+			strings:  []string{"Microsoft incorporated.", "Yesterday I went to Berlin and met with Jack Brown."},
+			expected: expectedResults[2],
+		},
+		{
+			pipeline: pipelineMapping,
+			name:     "Label mapping",
+			strings:  []string{"My name is Wolfgang and I live in Berlin."},
+			expected: pipelines.TokenClassificationOutput{
+				Entities: [][]pipelines.Entity{
+					{
+						{Entity: "PERSON", Word: "Wolfgang"},
+						{Entity: "LOCATION", Word: "Berlin"},
+					},
+				},
+			},
+		},
+		{
+			pipeline: pipelineRules,
+			name:     "Entity rules",
+			strings:  []string{"My name is Wolfgang and I live in Berlin."},
+			expected: pipelines.TokenClassificationOutput{
+				Entities: [][]pipelines.Entity{
+					{
+						{Entity: "LABEL_0", Word: "My name is"},
+						{Entity: "LABEL_1", Word: "Wolfgang"},
+						{Entity: "LABEL_0", Word: "and I live in"},
+						{Entity: "CITY", Word: "Berlin"},
+						{Entity: "LABEL_0", Word: "."},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batchResult, err := tt.pipeline.RunPipeline(tt.strings)
+			check(t, err)
+			printTokenEntities(batchResult)
+			for i, predictedEntities := range batchResult.Entities {
+				assert.Equal(t, len(tt.expected.Entities[i]), len(predictedEntities))
+				for j, entity := range predictedEntities {
+					expectedEntity := tt.expected.Entities[i][j]
+					assert.Equal(t, expectedEntity.Entity, entity.Entity)
+					assert.Equal(t, expectedEntity.Word, entity.Word)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenClassificationPipelineValidation(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	modelPath := "./models/KnightsAnalytics_distilbert-NER"
+	configSimple := TokenClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineSimple",
+		Options: []TokenClassificationOption{
+			pipelines.WithSimpleAggregation(),
+			pipelines.WithIgnoreLabels([]string{"O"}),
+		},
+	}
+	pipelineSimple, err2 := NewPipeline(session, configSimple)
+	check(t, err2)
+
+	t.Run("id-label-map", func(t *testing.T) {
+		labelMapInitial := pipelineSimple.IDLabelMap
+		defer func() {
+			pipelineSimple.IDLabelMap = labelMapInitial
+		}()
+		pipelineSimple.IDLabelMap = map[int]string{}
+		err = pipelineSimple.Validate()
+		assert.Error(t, err)
+	})
+
+	t.Run("output-shape", func(t *testing.T) {
+		dimensionInitial := pipelineSimple.OutputsMeta[0].Dimensions
+		defer func() {
+			pipelineSimple.OutputsMeta[0].Dimensions = dimensionInitial
+		}()
+		pipelineSimple.OutputsMeta[0].Dimensions = ort.NewShape(-1, -1, -1)
+		err = pipelineSimple.Validate()
+		assert.Error(t, err)
+	})
+}
+
+// Entity linking
+
+func TestKeyphraseExtraction(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	// the NER test model tags entities with B-/I- labels like keyphrase models
+	tokenPipeline, err := NewPipeline(session, TokenClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-NER",
+		Name:      "testPipelineKeyphrases",
+	})
+	check(t, err)
+	extractor, err := pipelines.NewKeyphraseExtractionPipeline(tokenPipeline)
+	check(t, err)
+
+	input := "Angela Merkel visited Paris in May. In Paris, Angela Merkel met the mayor."
+	output, err := extractor.RunPipeline([]string{input, ""})
+	check(t, err)
+	assert.Len(t, output.Keyphrases, 2)
+	assert.Empty(t, output.Keyphrases[1])
+	keyphrases := map[string]pipelines.Keyphrase{}
+	for _, keyphrase := range output.Keyphrases[0] {
+		keyphrases[keyphrase.Text] = keyphrase
+		for _, span := range keyphrase.Spans {
+			assert.Equal(t, keyphrase.Text, input[span.Start:span.End])
+		}
+	}
+	assert.Len(t, keyphrases["Angela Merkel"].Spans, 2)
+	assert.Len(t, keyphrases["Paris"].Spans, 2)
+	assert.GreaterOrEqual(t, output.Keyphrases[0][0].Score, output.Keyphrases[0][1].Score)
+
+	extractor.MinScore = 1.1
+	output, err = extractor.RunPipeline([]string{input})
+	check(t, err)
+	assert.Empty(t, output.Keyphrases[0])
+
+	_, err = pipelines.NewKeyphraseExtractionPipeline(nil)
+	assert.Error(t, err)
+}
+
+func TestEntityLinking(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	tokenPipeline, err := NewPipeline(session, TokenClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-NER",
+		Name:      "testPipelineNER",
+		Options: []TokenClassificationOption{
+			pipelines.WithSimpleAggregation(),
+			pipelines.WithIgnoreLabels([]string{"O"}),
+		},
+	})
+	check(t, err)
+	embedder, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testPipelineEmbedder",
+		Options:   []FeatureExtractionOption{pipelines.WithNormalization()},
+	})
+	check(t, err)
+
+	linker, err := pipelines.NewEntityLinker(embedder, []pipelines.KnowledgeBaseEntry{
+		{ID: "Q64", Text: "Berlin, capital and largest city of Germany"},
+		{ID: "Q90", Text: "Paris, capital and largest city of France"},
+		{ID: "Q254", Text: "Wolfgang Amadeus Mozart, Austrian composer"},
+	}, 2)
+	check(t, err)
+
+	text := "My name is Wolfgang and I live in Berlin."
+	entities, err := tokenPipeline.RunPipeline([]string{text})
+	check(t, err)
+	linked, err := linker.Link(text, entities.Entities[0])
+	check(t, err)
+	assert.Equal(t, len(entities.Entities[0]), len(linked))
+	for _, l := range linked {
+		if l.Entity.Word == "Berlin" {
+			assert.Equal(t, "Q64", l.Candidates[0].ID)
+		}
+	}
+}
+
+func TestMentionClustering(t *testing.T) {
+	text := "Wolfgang Mozart lived in Vienna. Mozart was born in Salzburg, not in Vienna."
+	entities := []pipelines.Entity{
+		{Entity: "PER", Word: "Wolfgang Mozart", Start: 0, End: 15},
+		{Entity: "LOC", Word: "Vienna", Start: 25, End: 31},
+		{Entity: "PER", Word: "Mozart", Start: 33, End: 39},
+		{Entity: "LOC", Word: "Salzburg", Start: 52, End: 60},
+		{Entity: "LOC", Word: "Vienna", Start: 69, End: 75},
+	}
+	clusterer := pipelines.NewMentionClusterer(nil)
+	clusters, err := clusterer.Cluster(text, entities)
+	check(t, err)
+	assert.Equal(t, 3, len(clusters))
+	assert.Equal(t, []pipelines.Entity{entities[0], entities[2]}, clusters[0].Mentions)
+	assert.Equal(t, []pipelines.Entity{entities[1], entities[4]}, clusters[1].Mentions)
+	assert.Equal(t, "LOC", clusters[2].Entity)
+}
+
+func TestPseudonymization(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	tokenPipeline, err := NewPipeline(session, TokenClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-NER",
+		Name:      "testPipelineNER",
+		Options: []TokenClassificationOption{
+			pipelines.WithSimpleAggregation(),
+			pipelines.WithIgnoreLabels([]string{"O"}),
+		},
+	})
+	check(t, err)
+
+	texts := []string{"My name is Wolfgang and I live in Berlin.", "Wolfgang likes Berlin."}
+	output, err := tokenPipeline.RunPipeline(texts)
+	check(t, err)
+	table := pipelines.NewPseudonymTable()
+	pseudonymized := make([]string, len(texts))
+	for i, text := range texts {
+		pseudonymized[i], err = table.Pseudonymize(text, output.Entities[i])
+		check(t, err)
+	}
+	assert.Equal(t, "My name is [PER_1] and I live in [LOC_1].", pseudonymized[0])
+	assert.Equal(t, "[PER_1] likes [LOC_1].", pseudonymized[1])
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	encrypted, err := table.Encrypt(key)
+	check(t, err)
+	assert.NotContains(t, string(encrypted), "Wolfgang")
+	decrypted, err := pipelines.DecryptPseudonymTable(encrypted, key)
+	check(t, err)
+	for i, text := range texts {
+		assert.Equal(t, text, decrypted.Reidentify(pseudonymized[i]))
+	}
+	_, err = pipelines.DecryptPseudonymTable(encrypted, []byte("another key of thirty-two bytes!"))
+	assert.Error(t, err)
+}
+
+func TestHTMLHighlighter(t *testing.T) {
+	text := "Zoë <b>Martin</b> & 😀 in Paris"
+	highlighter := pipelines.NewHTMLHighlighter()
+	highlighted, err := highlighter.HighlightEntities(text, []pipelines.Entity{
+		{Entity: "B-PER", Score: 0.9, Start: 0, End: 4},
+		{Entity: "LOC", Score: 0.8, Start: 29, End: 34},
+	})
+	check(t, err)
+	assert.Equal(t, `<mark class="highlight-PER" title="PER">Zoë</mark> &lt;b&gt;Martin&lt;/b&gt; &amp; 😀 in <mark class="highlight-LOC" title="LOC">Paris</mark>`, highlighted)
+
+	// offsets of Python libraries count code points, and overlapping spans of lower score are left out
+	highlighter.Offsets = pipelines.RuneOffsets
+	highlighter.ShowScores = true
+	highlighted, err = highlighter.Highlight(text, []pipelines.HighlightSpan{
+		{Start: 7, End: 13, Label: "answer", Score: 0.7},
+		{Start: 4, End: 13, Label: "answer", Score: 0.2},
+		{Start: 20, End: 21, Label: `a "label"`, Score: 0.5},
+	})
+	check(t, err)
+	assert.Equal(t, `Zoë &lt;b&gt;<mark class="highlight-answer" title="answer 0.70">Martin</mark>&lt;/b&gt; &amp; <mark class="highlight-a--label-" title="a &#34;label&#34; 0.50">😀</mark> in Paris`, highlighted)
+
+	// offsets of JavaScript strings count the emoji twice, and offsets inside a character are rejected
+	highlighter.Offsets = pipelines.UTF16Offsets
+	highlighted, err = highlighter.Highlight(text, []pipelines.HighlightSpan{{Start: 26, End: 31, Label: "LOC"}})
+	check(t, err)
+	assert.Equal(t, `Zoë &lt;b&gt;Martin&lt;/b&gt; &amp; 😀 in <mark class="highlight-LOC" title="LOC 0.00">Paris</mark>`, highlighted)
+	_, err = highlighter.Highlight(text, []pipelines.HighlightSpan{{Start: 21, End: 22}})
+	assert.Error(t, err)
+	highlighter.Offsets = pipelines.ByteOffsets
+	_, err = highlighter.Highlight(text, []pipelines.HighlightSpan{{Start: 3, End: 4}})
+	assert.Error(t, err)
+}
+
+func TestEntityStream(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	ner, err := NewPipeline(session, TokenClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-NER",
+		Name:      "testNer",
+		Options: []TokenClassificationOption{
+			pipelines.WithSimpleAggregation(),
+			pipelines.WithIgnoreLabels([]string{"LABEL_0"}),
+		},
+	})
+	check(t, err)
+	stream, err := pipelines.NewEntityStream(ner)
+	check(t, err)
+
+	events, err := stream.Append("My name is Wolfgang and I live in")
+	check(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, pipelines.EntityAdded, events[0].Type)
+	assert.Equal(t, "Wolfgang", events[0].Entity.Word)
+	wolfgangID := events[0].ID
+
+	// the earlier entity is re-run but unchanged, so only the new one is reported, with offsets in the whole text
+	events, err = stream.Append(" Berlin.")
+	check(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, pipelines.EntityAdded, events[0].Type)
+	assert.NotEqual(t, wolfgangID, events[0].ID)
+	assert.Equal(t, "Berlin", stream.Text()[events[0].Entity.Start:events[0].Entity.End])
+
+	// without context, the entities before the appended text are final
+	stream.Context = 0
+	events, err = stream.Append(" Hello")
+	check(t, err)
+	for _, event := range events {
+		assert.NotEqual(t, wolfgangID, event.ID)
+	}
+	assert.Equal(t, "Wolfgang", stream.Entities()[0].Word)
+
+	stream.Reset()
+	assert.Empty(t, stream.Entities())
+	assert.Empty(t, stream.Text())
+	_, err = pipelines.NewEntityStream(nil)
+	assert.Error(t, err)
+}
+
+func TestTemporalNormalization(t *testing.T) {
+	reference := time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC) // a Wednesday
+	for expression, expected := range map[string]string{
+		"next Tuesday":   "2024-05-21",
+		"last Wednesday": "2024-05-08",
+		"tomorrow":       "2024-05-16",
+		"in 3 days":      "2024-05-18",
+		"two weeks ago":  "2024-W18",
+		"next month":     "2024-06",
+		"last year":      "2023",
+		"May 1st":        "2024-05-01",
+		"3rd of July":    "2024-07-03",
+		"1 June 2023":    "2023-06-01",
+	} {
+		normalized, ok := util.NormalizeTemporalExpression(expression, reference)
+		assert.True(t, ok, expression)
+		assert.Equal(t, expected, normalized, expression)
+	}
+	_, ok := util.NormalizeTemporalExpression("February 30", reference)
+	assert.False(t, ok)
+}
+
+func TestOutputProto(t *testing.T) {
+	// expected encodings of the messages of proto/outputs.proto
+	classification := &pipelines.TextClassificationOutput{ClassificationOutputs: [][]pipelines.ClassificationOutput{{{Label: "POSITIVE", Score: 0.5}}}}
+	assert.Equal(t, "0a110a0f0a08504f534954495645150000003f", hex.EncodeToString(classification.MarshalProto()))
+	features := &pipelines.FeatureExtractionOutput{Embeddings: [][]float32{{1, 0}, {}}}
+	assert.Equal(t, "0a0a0a080000803f000000000a00", hex.EncodeToString(features.MarshalProto()))
+	entities := &pipelines.TokenClassificationOutput{Entities: [][]pipelines.Entity{{{Entity: "PER", Score: 0.5, Start: 1, End: 3, IsSubword: true}}, {}}}
+	assert.Equal(t, "0a120a100a03504552150000003f3801400348010a00", hex.EncodeToString(entities.MarshalProto()))
+}
+
+func TestOutputProtoRoundTrip(t *testing.T) {
+	features := &pipelines.FeatureExtractionOutput{Embeddings: [][]float32{{1, -0.5, 0}, {}}}
+	decodedFeatures := &pipelines.FeatureExtractionOutput{}
+	check(t, decodedFeatures.UnmarshalProto(features.MarshalProto()))
+	assert.Equal(t, features, decodedFeatures)
+
+	classification := &pipelines.TextClassificationOutput{ClassificationOutputs: [][]pipelines.ClassificationOutput{
+		{{Label: "POSITIVE", Score: 0.75}, {Label: "NEGATIVE", Score: 0.25}},
+		{{Label: "cat", Score: 0.5, Path: []string{"animal", "mammal", "cat"}}},
+		{},
+	}}
+	decodedClassification := &pipelines.TextClassificationOutput{}
+	check(t, decodedClassification.UnmarshalProto(classification.MarshalProto()))
+	assert.Equal(t, classification, decodedClassification)
+
+	entities := &pipelines.TokenClassificationOutput{Entities: [][]pipelines.Entity{
+		{
+			{Entity: "PER", Score: 0.5, Scores: []float32{0.5, 0.25}, Index: 2, Word: "Anna", TokenID: 4090, Start: 1, End: 5, IsSubword: true},
+			{Entity: "LOC", Score: 0.9, Index: 7, Word: "Zürich", TokenID: 8, Start: 10, End: 17},
+		},
+		{},
+	}}
+	decodedEntities := &pipelines.TokenClassificationOutput{}
+	check(t, decodedEntities.UnmarshalProto(entities.MarshalProto()))
+	assert.Equal(t, entities, decodedEntities)
+
+	zeroShot := &pipelines.ZeroShotOutput{ClassificationOutputs: []pipelines.ZeroShotClassificationOutput{{Sequence: "I love cooking"}}}
+	zeroShot.ClassificationOutputs[0].SortedValues = append(zeroShot.ClassificationOutputs[0].SortedValues,
+		struct {
+			Key   string
+			Value float64
+		}{Key: "food", Value: 0.875},
+		struct {
+			Key   string
+			Value float64
+		}{Key: "sport", Value: 0})
+	decodedZeroShot := &pipelines.ZeroShotOutput{}
+	check(t, decodedZeroShot.UnmarshalProto(zeroShot.MarshalProto()))
+	assert.Equal(t, zeroShot, decodedZeroShot)
+
+	quality := &pipelines.QualityScoringOutput{Scores: []pipelines.QualityScore{{Score: 0.125}, {Score: 0}}}
+	decodedQuality := &pipelines.QualityScoringOutput{}
+	check(t, decodedQuality.UnmarshalProto(quality.MarshalProto()))
+	assert.Equal(t, quality, decodedQuality)
+
+	// decoding replaces the previous content of the output
+	check(t, decodedQuality.UnmarshalProto(quality.MarshalProto()))
+	assert.Equal(t, quality, decodedQuality)
+
+	// unpacked repeated floats, as older encoders write them, are decoded too
+	unpacked, err := hex.DecodeString("0a0a0d0000803f0d000000bf")
+	check(t, err)
+	check(t, decodedFeatures.UnmarshalProto(unpacked))
+	assert.Equal(t, [][]float32{{1, -0.5}}, decodedFeatures.Embeddings)
+
+	assert.Error(t, decodedFeatures.UnmarshalProto([]byte{0x0a, 0x05}))
+	assert.Error(t, decodedFeatures.UnmarshalProto([]byte{0x0a, 0x03, 0x0a, 0x01, 0x00}))
+}
+
+func TestBatchProto(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+	pipeline, err := NewPipeline(session, TextClassificationConfig{ModelPath: modelPath, Name: "testPipeline"})
+	check(t, err)
+	inputs := []string{"This movie is disgustingly good !", "The director tried too much"}
+	expected, err := pipeline.RunPipeline(inputs)
+	check(t, err)
+
+	// tokenize without the model, and run the decoded batch through the pipeline
+	tokenizer, err := pipelines.NewBatchTokenizer(modelPath)
+	check(t, err)
+	defer func() {
+		check(t, tokenizer.Destroy())
+	}()
+	tokenized := tokenizer.Tokenize(inputs)
+	message := tokenized.MarshalProto()
+	batch := pipelines.NewBatch()
+	defer func() {
+		check(t, batch.Destroy())
+	}()
+	check(t, batch.UnmarshalProto(message))
+	assert.Equal(t, tokenized.Input, batch.Input)
+	assert.Equal(t, tokenized.MaxSequenceLength, batch.MaxSequenceLength)
+	check(t, pipeline.CreateInputTensors(batch))
+	check(t, pipeline.Forward(batch))
+	output, err := pipeline.Postprocess(batch)
+	check(t, err)
+	assert.Equal(t, expected, output)
+
+	assert.Error(t, pipeline.CreateInputTensors(batch))
+	assert.Error(t, pipelines.NewBatch().UnmarshalProto([]byte{0x0a, 0x05}))
+}
+
+func TestReproducibilityManifest(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary), WithSeed(42))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	assert.Equal(t, int64(42), session.Seed())
+	sentimentPipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+
+	manifest, err := session.Manifest()
+	check(t, err)
+	assert.Equal(t, int64(42), manifest.Seed)
+	assert.NotEmpty(t, manifest.OnnxRuntimeVersion)
+	assert.Empty(t, manifest.ExecutionProviders)
+	assert.Len(t, manifest.Models, 1)
+	assert.Equal(t, "testPipeline", manifest.Models[0].Pipeline)
+	assert.Equal(t, "textClassification", manifest.Models[0].PipelineType)
+	assert.Len(t, manifest.Models[0].SHA256, 64)
+
+	output, err := sentimentPipeline.RunPipeline([]string{"This movie is disgustingly good !"})
+	check(t, err)
+	result := manifest.Attach(output)
+	assert.Len(t, result.Outputs, 1)
+	_, err = json.Marshal(result)
+	check(t, err)
+}
+
+func TestAuditedPipeline(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	sentimentPipeline, err := NewPipeline(session, TextClassificationConfig{
+		ModelPath: "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+		Name:      "testPipeline",
+	})
+	check(t, err)
+	manifest, err := session.Manifest()
+	check(t, err)
+
+	log := new(strings.Builder)
+	auditLog := pipelines.NewAuditLog(log, []byte("key"))
+	_, err = pipelines.NewAuditedPipeline(sentimentPipeline, "", manifest.Models[0].SHA256, auditLog)
+	assert.Error(t, err)
+	audited, err := pipelines.NewAuditedPipeline(sentimentPipeline, "sentiment", manifest.Models[0].SHA256, auditLog)
+	check(t, err)
+	inputs := []string{"This movie is disgustingly good !", "The director tried too much"}
+	output, err := audited.RunAs("alice", inputs)
+	check(t, err)
+	assert.Len(t, output.GetOutput(), 2)
+	_, err = audited.Run(inputs[:1])
+	check(t, err)
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	assert.Len(t, lines, 2)
+	record := pipelines.AuditRecord{}
+	check(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "alice", record.Actor)
+	assert.Equal(t, "sentiment", record.Pipeline)
+	assert.Equal(t, manifest.Models[0].SHA256, record.ModelVersion)
+	assert.Equal(t, 2, record.NumInputs)
+	assert.Equal(t, auditLog.Hash(inputs[0]), record.InputHashes[0])
+	assert.NotEqual(t, pipelines.NewAuditLog(nil, nil).Hash(inputs[0]), record.InputHashes[0])
+	assert.NotContains(t, log.String(), "movie")
+}
+
+func TestRedaction(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary), WithRedaction())
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+		util.SetRedaction(false)
+	}(session)
+	manifest, err := session.Manifest()
+	check(t, err)
+	assert.True(t, manifest.Redaction)
+
+	redacted := util.Redact("Jane Doe, born 1970-01-01")
+	assert.NotContains(t, redacted, "Jane")
+	assert.Contains(t, redacted, "len=25")
+	assert.Equal(t, redacted, util.Redact("Jane Doe, born 1970-01-01"))
+	_, err = pipelines.HighlightAnswer("Jane Doe was admitted on Monday.", "Tuesday", "<hl>")
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "Tuesday")
+}
+
+func TestRedactionSticky(t *testing.T) {
+	defer util.SetRedaction(false)
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary), WithRedaction())
+	check(t, err)
+	check(t, session.Destroy())
+
+	// a later session created without redaction keeps it on
+	session, err = NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+	assert.True(t, util.RedactionEnabled())
+	manifest, err := session.Manifest()
+	check(t, err)
+	assert.True(t, manifest.Redaction)
+	_, err = pipelines.HighlightAnswer("Jane Doe was admitted on Monday.", "Tuesday", "<hl>")
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "Tuesday")
+}
+
+func TestNoSameNamePipeline(t *testing.T) {
+	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	check(t, err)
+	defer func(session *Session) {
+		err := session.Destroy()
+		check(t, err)
+	}(session)
+
+	modelPath := "./models/KnightsAnalytics_distilbert-NER"
+	configSimple := TokenClassificationConfig{
+		ModelPath: modelPath,
+		Name:      "testPipelineSimple",
+		Options: []TokenClassificationOption{
+			pipelines.WithSimpleAggregation(),
+			pipelines.WithIgnoreLabels([]string{"O"}),
+		},
+	}
+	_, err2 := NewPipeline(session, configSimple)
+	if err2 != nil {
+		t.FailNow()
+	}
+	_, err3 := NewPipeline(session, configSimple)
+	assert.Error(t, err3)
+}
+
+// Text2text generation
+
+func TestHighlightAnswer(t *testing.T) {
+	passage := "Python is a programming language created by Guido van Rossum in 1991."
+	highlighted, err := pipelines.HighlightAnswer(passage, "Guido van Rossum", "<hl>")
+	check(t, err)
+	assert.Equal(t, "Python is a programming language created by <hl> Guido van Rossum <hl> in 1991.", highlighted)
+	_, err = pipelines.HighlightAnswer(passage, "Monty Python", "<hl>")
+	assert.Error(t, err)
+	_, err = pipelines.HighlightAnswer(passage, "", "<hl>")
+	assert.Error(t, err)
+}
+
+// Text generation
+
+func TestChatTemplate(t *testing.T) {
+	messages := []map[string]any{
+		{"role": "system", "content": "You are helpful."},
+		{"role": "user", "content": "Hi "},
+		{"role": "assistant", "content": "Hello!"},
+		{"role": "user", "content": "What's 2+2?"},
+	}
+	variables := map[string]any{"messages": messages, "bos_token": "<s>", "eos_token": "</s>", "add_generation_prompt": true}
+
+	// the template of Llama 3 Instruct
+	llama, err := util.ParseChatTemplate("{% set loop_messages = messages %}{% for message in loop_messages %}{% set content = '<|start_header_id|>' + message['role'] + '<|end_header_id|>\n\n'+ message['content'] | trim + '<|eot_id|>' %}{% if loop.index0 == 0 %}{% set content = bos_token + content %}{% endif %}{{ content }}{% endfor %}{% if add_generation_prompt %}{{ '<|start_header_id|>assistant<|end_header_id|>\n\n' }}{% endif %}")
+	check(t, err)
+	prompt, err := llama.Render(variables)
+	check(t, err)
+	assert.Equal(t, "<s><|start_header_id|>system<|end_header_id|>\n\nYou are helpful.<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\nHello!<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nWhat's 2+2?<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n", prompt)
+
+	// the template of Mistral Instruct, with whitespace control and an exception for roles that do not alternate
+	mistral, err := util.ParseChatTemplate("{%- if messages[0]['role'] == 'system' %}\n    {%- set system_message = messages[0]['content'] %}\n    {%- set loop_messages = messages[1:] %}\n{%- else %}\n    {%- set loop_messages = messages %}\n{%- endif %}\n\n{{- bos_token }}\n{%- for message in loop_messages %}\n    {%- if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}\n        {{- raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}\n    {%- endif %}\n    {%- if message['role'] == 'user' %}\n        {%- if loop.first and system_message is defined %}\n            {{- ' [INST] ' + system_message + '\\n\\n' + message['content'] + ' [/INST]' }}\n        {%- else %}\n            {{- ' [INST] ' + message['content'] + ' [/INST]' }}\n        {%- endif %}\n    {%- else %}\n        {{- ' ' + message['content'] + eos_token}}\n    {%- endif %}\n{%- endfor %}\n")
+	check(t, err)
+	prompt, err = mistral.Render(variables)
+	check(t, err)
+	assert.Equal(t, "<s> [INST] You are helpful.\n\nHi  [/INST] Hello!</s> [INST] What's 2+2? [/INST]", prompt)
+	variables["messages"] = messages[2:]
+	_, err = mistral.Render(variables)
+	assert.ErrorContains(t, err, "Conversation roles must alternate")
+
+	// trim_blocks and lstrip_blocks, namespaces, loop filters, filters, tests and methods
+	features, err := util.ParseChatTemplate("{% for m in messages %}\n  {% if m.role == 'user' %}\nU: {{ m.content|trim }}\n  {% else %}\nA: {{ m.content[:5] ~ '|' ~ (m.content | length) }}\n  {% endif %}\n{% endfor %}\n{%- set ns = namespace(n=0) -%}\n{% for m in messages if m.role == 'user' %}{% set ns.n = ns.n + 1 %}{% endfor %}{# a comment #}{{ ns.n }} {{ 'x' if ns.n > 1 else 'y' }} {{ {'b': [1, 2.5, none, true], 'a': 'é'} | tojson }} {{ 'a,b'.split(',') }} {{ messages[-1].content.startswith('What') }} {{ range(3) | list }} {{ missing is defined }} {{ missing | default('d') }} {{ 7 // 2 }} {{ 'ab'[::-1] }}")
+	check(t, err)
+	prompt, err = features.Render(map[string]any{"messages": messages[2:]})
+	check(t, err)
+	assert.Equal(t, "A: Hello|6\nU: What's 2+2?\n1 y {\"a\": \"é\", \"b\": [1, 2.5, null, true]} ['a', 'b'] True [0, 1, 2] False d 3 ba", prompt)
+
+	_, err = util.ParseChatTemplate("{% if true %}unclosed")
+	assert.Error(t, err)
+	_, err = util.ParseChatTemplate("{% macro greet(name) %}Hi {{ name }}{% endmacro %}")
+	assert.Error(t, err)
+}
+
+func TestSamplingLogitProcessors(t *testing.T) {
+	negativeInfinity := float32(math.Inf(-1))
+	// the tokens of the prompt and of the generated text are penalized once
+	logits := []float32{2, -2, 1}
+	check(t, pipelines.RepetitionPenaltyProcessor(2).ProcessLogits([]int64{0}, []int64{1, 1}, logits))
+	assert.Equal(t, []float32{1, -4, 1}, logits)
+
+	logits = []float32{2, -2, 1}
+	check(t, pipelines.TemperatureProcessor(0.5).ProcessLogits(nil, nil, logits))
+	assert.Equal(t, []float32{4, -4, 2}, logits)
+	assert.Error(t, pipelines.TemperatureProcessor(0).ProcessLogits(nil, nil, logits))
+
+	// tokens as likely as the k-th one are kept
+	logits = []float32{1, 3, 2, 2}
+	check(t, pipelines.TopKProcessor(2).ProcessLogits(nil, nil, logits))
+	assert.Equal(t, []float32{negativeInfinity, 3, 2, 2}, logits)
+
+	// probabilities of 0.6, 0.3 and 0.1
+	probabilities := []float64{0.6, 0.3, 0.1}
+	logits = make([]float32, len(probabilities))
+	for i, probability := range probabilities {
+		logits[i] = float32(math.Log(probability))
+	}
+	nucleus := append([]float32(nil), logits...)
+	check(t, pipelines.TopPProcessor(0.5).ProcessLogits(nil, nil, nucleus))
+	assert.Equal(t, []float32{logits[0], negativeInfinity, negativeInfinity}, nucleus)
+	nucleus = append([]float32(nil), logits...)
+	check(t, pipelines.TopPProcessor(0.8).ProcessLogits(nil, nil, nucleus))
+	assert.Equal(t, []float32{logits[0], logits[1], negativeInfinity}, nucleus)
+	assert.Error(t, pipelines.TopPProcessor(1.5).ProcessLogits(nil, nil, nucleus))
+}
+
+func TestConstrainedGeneration(t *testing.T) {
+	schema := `{"type": "object", "properties": {"name": {"type": "string", "maxLength": 5}, "age": {"type": "integer"}, "tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2}, "born": {"type": "string", "format": "date"}}, "required": ["age"]}`
+	pattern, err := util.JSONSchemaPattern([]byte(schema))
+	check(t, err)
+	matcher := regexp.MustCompile("^(?:" + pattern + ")$")
+	for _, valid := range []string{`{"age":3}`, `{"name": "Bob", "age": 30}`, `{"age":3,"tags":["a", "b"]}`, `{ "age": -1, "born": "2024-02-29" }`} {
+		assert.True(t, matcher.MatchString(valid), valid)
+	}
+	for _, invalid := range []string{`{}`, `{"name":"Bob"}`, `{"age":3,}`, `{"age":3,"tags":["a","b","a"]}`, `{"name":"Robert","age":1}`, `{"age":01}`, `{"age":1,"name":"Bob"}`} {
+		assert.False(t, matcher.MatchString(invalid), invalid)
+	}
+	pattern, err = util.JSONSchemaPattern([]byte(`{"properties": {"a": {"type": "null"}, "b": {"type": "boolean"}}}`))
+	check(t, err)
+	matcher = regexp.MustCompile("^(?:" + pattern + ")$")
+	for _, valid := range []string{`{}`, `{"a":null}`, `{"b":true}`, `{"a":null,"b":false}`} {
+		assert.True(t, matcher.MatchString(valid), valid)
+	}
+	assert.False(t, matcher.MatchString(`{,"b":true}`))
+	_, err = util.JSONSchemaPattern([]byte(`{"$ref": "#/definitions/node"}`))
+	assert.Error(t, err)
+
+	// tokens may end in the middle of a character, and special tokens have no bytes
+	tokens := [][]byte{[]byte("{"), []byte(`"`), []byte("age"), []byte(`":`), []byte("1"), []byte("12"), []byte("}"), []byte("x"), nil, []byte("\xc3"), []byte("\xa9"), []byte("é")}
+	constraint, err := util.NewTokenConstraint(`\{"age":[0-9]+\}|caf(?:é|e)`, tokens)
+	check(t, err)
+	allowedIDs := func(generated string) []int {
+		allowed, _, allowedErr := constraint.Allowed([]byte(generated))
+		check(t, allowedErr)
+		var ids []int
+		for id := range tokens {
+			if util.TokenAllowed(allowed, id) {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	assert.Equal(t, []int{0}, allowedIDs(""))
+	assert.Equal(t, []int{4, 5, 6}, allowedIDs(`{"age":1`))
+	assert.Equal(t, []int{9, 11}, allowedIDs("caf"))
+	assert.Equal(t, []int{10}, allowedIDs("caf\xc3"))
+	_, complete, err := constraint.Allowed([]byte(`{"age":12}`))
+	check(t, err)
+	assert.True(t, complete)
+	_, _, err = constraint.Allowed([]byte("x"))
+	assert.Error(t, err)
+
+	byteLevel := `{"model": {"type": "BPE", "vocab": {"Ġhello": 0, "Ã©": 1, "Ċ": 2}}, "added_tokens": [{"id": 3, "content": "<|endoftext|>", "special": true}], "decoder": {"type": "ByteLevel"}}`
+	tokens, err = util.TokenBytes([]byte(byteLevel))
+	check(t, err)
+	assert.Equal(t, [][]byte{[]byte(" hello"), []byte("é"), []byte("\n"), nil}, tokens)
+	sentencePiece := `{"model": {"type": "Unigram", "vocab": [["<unk>", 0], ["▁hello", -1], ["<0x0A>", -2]]}, "added_tokens": [{"id": 0, "content": "<unk>", "special": true}], "decoder": {"type": "Sequence", "decoders": [{"type": "Replace"}, {"type": "ByteFallback"}]}}`
+	tokens, err = util.TokenBytes([]byte(sentencePiece))
+	check(t, err)
+	assert.Equal(t, [][]byte{nil, []byte(" hello"), []byte("\n")}, tokens)
+
+	// the processor masks the logits of the tokens of a WordPiece vocabulary
+	modelPath := "./models/sentence-transformers_all-MiniLM-L6-v2"
+	tokenizerBytes, err := os.ReadFile(modelPath + "/tokenizer.json")
+	check(t, err)
+	vocabulary, err := util.LoadVocabulary(tokenizerBytes)
+	check(t, err)
+	yes, no := slices.Index(vocabulary, "yes"), slices.Index(vocabulary, "no")
+	eos := int64(slices.Index(vocabulary, "[SEP]"))
+	processor, err := pipelines.NewRegexProcessor(modelPath, "yes|no", map[int64]bool{eos: true})
+	check(t, err)
+	logits := make([]float32, len(vocabulary))
+	check(t, processor.ProcessLogits(nil, nil, logits))
+	assert.False(t, math.IsInf(float64(logits[yes]), -1))
+	assert.False(t, math.IsInf(float64(logits[no]), -1))
+	assert.True(t, math.IsInf(float64(logits[slices.Index(vocabulary, "maybe")]), -1))
+	assert.True(t, math.IsInf(float64(logits[eos]), -1))
+	logits = make([]float32, len(vocabulary))
+	check(t, processor.ProcessLogits(nil, []int64{int64(yes)}, logits))
+	index, _, err := util.ArgMax(logits)
+	check(t, err)
+	assert.Equal(t, int(eos), index)
+	_, err = pipelines.NewJSONSchemaProcessor(modelPath, `{"type": "tuple"}`, map[int64]bool{eos: true})
+	assert.Error(t, err)
+}
+
+// Speech recognition
+
+func TestAudioFeatures(t *testing.T) {
+	// a stereo 16 bit WAV file with two frames
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt ")
+	wav = binary.LittleEndian.AppendUint32(wav, 16)
+	wav = binary.LittleEndian.AppendUint16(wav, 1)     // PCM
+	wav = binary.LittleEndian.AppendUint16(wav, 2)     // channels
+	wav = binary.LittleEndian.AppendUint32(wav, 8000)  // sample rate
+	wav = binary.LittleEndian.AppendUint32(wav, 32000) // byte rate
+	wav = binary.LittleEndian.AppendUint16(wav, 4)     // block align
+	wav = binary.LittleEndian.AppendUint16(wav, 16)    // bits per sample
+	wav = append(wav, []byte("data")...)
+	wav = binary.LittleEndian.AppendUint32(wav, 8)
+	for _, sample := range []int16{16384, 0, -32768, -32768} {
+		wav = binary.LittleEndian.AppendUint16(wav, uint16(sample))
+	}
+	samples, sampleRate, err := util.DecodeWAV(wav)
+	check(t, err)
+	assert.Equal(t, 8000, sampleRate)
+	assert.Equal(t, []float32{0.25, -1}, samples)
+	assert.Len(t, util.ResampleAudio(samples, 8000, 16000), 4)
+	_, _, err = util.DecodeWAV([]byte("not a wav file"))
+	assert.Error(t, err)
+
+	// the first filter of the Whisper filter bank, and the features of one second of a 440Hz tone
+	spectrogram := util.NewMelSpectrogram(16000, 400, 160, 80)
+	tone := make([]float32, 16000)
+	for i := range tone {
+		tone[i] = float32(0.5 * math.Sin(2*math.Pi*440*float64(i)/16000))
+	}
+	features := spectrogram.LogMel(tone, 3000)
+	assert.Len(t, features, 80*3000)
+	for _, feature := range features {
+		assert.LessOrEqual(t, feature, float32(1.6))
+		assert.GreaterOrEqual(t, feature, float32(-1.5))
+	}
+	// the tone is louder than the silence after it
+	assert.Greater(t, features[10*3000+50], features[10*3000+2000])
+}
+
+func TestVoiceActivityDetection(t *testing.T) {
+	// two seconds of quiet noise at 16kHz, with a tone from 0.5 to 1 second and from 1.2 to 1.5 seconds
+	samples := make([]float32, 32000)
+	for i := range samples {
+		samples[i] = 0.001 * float32(math.Sin(float64(i)*1.3))
+		seconds := float64(i) / 16000
+		if (seconds >= 0.5 && seconds < 1) || (seconds >= 1.2 && seconds < 1.5) {
+			samples[i] = float32(0.5 * math.Sin(2*math.Pi*440*seconds))
+		}
+	}
+	segments, err := pipelines.NewEnergyVAD().DetectSpeech(samples, 16000)
+	check(t, err)
+	assert.Len(t, segments, 2)
+	// frames of 30ms, padded by 30ms
+	assert.InDelta(t, 0.45, segments[0].Start, 1e-6)
+	assert.InDelta(t, 1.05, segments[0].End, 1e-6)
+	assert.InDelta(t, 1.17, segments[1].Start, 1e-6)
+	assert.InDelta(t, 1.53, segments[1].End, 1e-6)
+	assert.Equal(t, []util.AudioSegment{{Start: segments[0].Start, End: segments[1].End}}, util.MergeSegments(segments, 30))
+	assert.Equal(t, segments, util.MergeSegments(segments, 0.8))
+
+	// short silences are bridged and short segments dropped
+	speech := []bool{true, true, true, false, true, true, false, false, false, false, true}
+	options := util.VADOptions{MinSpeech: 0.25, MinSilence: 0.15}
+	bridged := util.SpeechSegments(speech, 0.1, 1.1, options)
+	assert.Len(t, bridged, 1)
+	assert.InDelta(t, 0.6, bridged[0].End, 1e-6)
+	silence, err := pipelines.NewEnergyVAD().DetectSpeech(make([]float32, 16000), 16000)
+	check(t, err)
+	assert.Empty(t, silence)
+}
+
+func TestSpeakerClustering(t *testing.T) {
+	embeddings := [][]float32{{1, 0}, {0, 1}, {0.9, 0.1}, {0.1, 0.9}, {-1, 0}}
+	labels, err := util.AgglomerativeClustering(embeddings, 0, 0.5)
+	check(t, err)
+	assert.Equal(t, []int{0, 1, 0, 1, 2}, labels)
+	labels, err = util.AgglomerativeClustering(embeddings, 2, 0.5)
+	check(t, err)
+	assert.Equal(t, []int{0, 0, 0, 0, 1}, labels)
+	_, err = util.AgglomerativeClustering([][]float32{{1, 0}, {1}}, 0, 0.5)
+	assert.Error(t, err)
+
+	// 25ms frames every 10ms, and a 1kHz tone peaks in the filter around 1000 mels
+	fbank := util.NewFbank(16000, 80)
+	tone := make([]float32, 16000)
+	for i := range tone {
+		tone[i] = float32(16384 * math.Sin(2*math.Pi*1000*float64(i)/16000))
+	}
+	features := fbank.Features(tone)
+	assert.Equal(t, 98, fbank.NumFrames(len(tone)))
+	assert.Len(t, features, 98*80)
+	peak, _, err := util.ArgMax(features[50*80 : 51*80])
+	check(t, err)
+	assert.Equal(t, 27, peak)
+
+	transcription := &pipelines.Transcription{
+		Chunks: []pipelines.TranscriptionChunk{{Text: "hello", Start: 0, End: 2}, {Text: "hi", Start: 2, End: 3}, {Text: "bye", Start: 5, End: 6}},
+	}
+	pipelines.AssignSpeakers(transcription, pipelines.Diarization{
+		Segments: []pipelines.SpeakerSegment{
+			{Speaker: "SPEAKER_00", Start: 0, End: 1.8},
+			{Speaker: "SPEAKER_01", Start: 1.8, End: 3.5},
+		},
+		NumSpeakers: 2,
+	})
+	assert.Equal(t, "SPEAKER_00", transcription.Chunks[0].Speaker)
+	assert.Equal(t, "SPEAKER_01", transcription.Chunks[1].Speaker)
+	assert.Equal(t, "", transcription.Chunks[2].Speaker)
+}
+
+func TestDecodeAudio(t *testing.T) {
+	// a FLAC stream written bit by bit: 16 bit stereo at 8000Hz with two frames of 4 samples
+	var bits []bool
+	write := func(value int64, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, value>>i&1 == 1)
+		}
+	}
+	align := func() {
+		for len(bits)%8 != 0 {
+			bits = append(bits, false)
+		}
+	}
+	write(0x664C6143, 32) // fLaC
+	write(1, 1)           // last metadata block
+	write(0, 7)           // stream info
+	write(34, 24)         // length
+	write(4, 16)          // min block size
+	write(4, 16)          // max block size
+	write(0, 48)          // frame sizes
+	write(8000, 20)       // sample rate
+	write(1, 3)           // channels - 1
+	write(15, 5)          // bits per sample - 1
+	write(8, 36)          // total samples
+	write(0, 64)          // MD5
+	write(0, 64)
+	frameHeader := func(channels int64, number int64) {
+		write(0x3FFE, 14) // sync
+		write(0, 2)       // reserved, fixed block size
+		write(6, 4)       // 8 bit block size
+		write(0, 4)       // sample rate of the stream info
+		write(channels, 4)
+		write(4, 3) // 16 bits
+		write(0, 1)
+		write(number, 8)
+		write(3, 8) // block size - 1
+		write(0, 8) // CRC-8
+	}
+	// mid/side: mid with a fixed predictor of order 2, side constant
+	frameHeader(10, 0)
+	write(0, 1)
+	write(10, 6) // fixed order 2
+	write(0, 1)
+	write(50, 16)
+	write(52, 16)
+	write(0, 2) // rice
+	write(0, 4) // partition order
+	write(0, 4) // parameter
+	write(1, 1)
+	write(1, 1) // two residuals of 0
+	write(0, 1)
+	write(0, 6) // constant
+	write(0, 1)
+	write(100, 17)
+	align()
+	write(0, 16) // CRC-16
+	// independent: verbatim with a wasted bit, and a linear predictor of order 1
+	frameHeader(1, 1)
+	write(0, 1)
+	write(1, 6) // verbatim
+	write(1, 1) // wasted bits
+	write(1, 1) // 1 wasted bit
+	for _, sample := range []int64{-1, 3, -5, 7} {
+		write(sample, 15)
+	}
+	write(0, 1)
+	write(32, 6) // order 1
+	write(0, 1)
+	write(10, 16) // warm-up
+	write(3, 4)   // precision 4
+	write(1, 5)   // shift 1
+	write(2, 4)   // coefficient
+	write(0, 2)   // rice
+	write(0, 4)   // partition order
+	write(1, 4)   // parameter 1
+	write(0b010, 3)
+	write(0b11, 2)
+	write(0b0010, 4) // residuals 1, -1, 2
+	align()
+	write(0, 16)
+	write(0x544147, 24) // an ID3v1 tag after the frames
+	data := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			data[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+
+	samples, sampleRate, err := util.DecodeAudio(data)
+	check(t, err)
+	assert.Equal(t, 8000, sampleRate)
+	expected := []float32{50, 52, 54, 56, 4, 8.5, 0, 13}
+	for i := range expected {
+		expected[i] /= 32768
+	}
+	assert.Equal(t, expected, samples)
+	_, _, err = util.DecodeAudio(data[:len(data)-10])
+	assert.Error(t, err)
+
+	// raw PCM
+	pcm, err := util.DecodePCM([]byte{0x00, 0x40, 0x00, 0xC0}, util.PCMFormat{Channels: 1, BitsPerSample: 16})
 	check(t, err)
-	defer func(session *Session) {
-		err := session.Destroy()
-		check(t, err)
-	}(session)
-	modelPath := "./models/protectai_deberta-v3-base-zeroshot-v1-onnx"
+	assert.Equal(t, []float32{0.5, -0.5}, pcm)
 
-	config := TextClassificationConfig{
-		ModelPath: modelPath,
-		Name:      "testPipelineSimple",
-	}
-	sentimentPipeline, err := NewPipeline(session, config)
+	// MP3, with and without an ID3 tag, resampled to the 16000Hz of speech models
+	mp3Data, err := os.ReadFile("./testData/audio/speech.mp3")
+	check(t, err)
+	samples, sampleRate, err = util.DecodeAudio(mp3Data)
+	check(t, err)
+	assert.Equal(t, 22050, sampleRate)
+	assert.Len(t, samples, 60*576) // 60 MPEG-2 layer III frames of 576 samples
+	tagged, _, err := util.DecodeAudio(append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), mp3Data...))
+	check(t, err)
+	assert.Equal(t, samples, tagged)
+	assert.Len(t, util.ResampleAudio(samples, sampleRate, 16000), 25077)
+	_, _, err = util.DecodeAudio([]byte("ID3\x04\x00\x00\x00\x00\x00\x00\xFF\xFB"))
+	assert.ErrorContains(t, err, "MP3")
+
+	// Ogg Vorbis, one second of mono audio
+	oggData, err := os.ReadFile("./testData/audio/test.ogg")
 	check(t, err)
+	samples, sampleRate, err = util.DecodeAudio(oggData)
+	check(t, err)
+	assert.Equal(t, 44100, sampleRate)
+	assert.Len(t, samples, 44100)
+	assert.Len(t, util.ResampleAudio(samples, sampleRate, 16000), 16000)
+	_, _, err = util.DecodeAudio([]byte("OggS\x00"))
+	assert.ErrorContains(t, err, "Ogg Vorbis")
+}
+
+// Image classification
+
+func TestImageClassificationPipelineValidation(t *testing.T) {
+	pipeline := &pipelines.ImageClassificationPipeline{
+		IDLabelMap:  map[int]string{0: "cat", 1: "dog"},
+		ProblemType: "single_label_classification",
+	}
+	pipeline.ResizeHeight, pipeline.ResizeWidth = 224, 224
+	pipeline.ImageStd = [3]float32{0.5, 0.5, 0.5}
+	pipeline.InputsMeta = []ort.InputOutputInfo{{Name: "pixel_values", Dimensions: ort.NewShape(-1, 3, 224, 224)}}
+	pipeline.OutputsMeta = []ort.InputOutputInfo{{Name: "logits", Dimensions: ort.NewShape(-1, 2)}}
+	check(t, pipeline.Validate())
 
 	t.Run("id-label-map", func(t *testing.T) {
-		labelMapInitial := sentimentPipeline.IDLabelMap
-		defer func() {
-			sentimentPipeline.IDLabelMap = labelMapInitial
-		}()
-		sentimentPipeline.IDLabelMap = map[int]string{}
-		err = sentimentPipeline.Validate()
-		assert.Error(t, err)
+		invalid := *pipeline
+		invalid.IDLabelMap = map[int]string{0: "cat"}
+		assert.ErrorContains(t, invalid.Validate(), "does not match number of logits")
 	})
-
-	t.Run("output-shape", func(t *testing.T) {
-		dimensionInitial := sentimentPipeline.OutputsMeta[0].Dimensions
-		defer func() {
-			sentimentPipeline.OutputsMeta[0].Dimensions = dimensionInitial
-		}()
-		sentimentPipeline.OutputsMeta[0].Dimensions = ort.NewShape(-1, -1, -1)
-		err = sentimentPipeline.Validate()
-		assert.Error(t, err)
+	t.Run("problem-type", func(t *testing.T) {
+		invalid := *pipeline
+		invalid.ProblemType = "regression"
+		assert.ErrorContains(t, invalid.Validate(), "problem type regression is not supported")
+	})
+	t.Run("image-size", func(t *testing.T) {
+		invalid := *pipeline
+		invalid.ResizeHeight, invalid.ResizeWidth = 384, 384
+		assert.ErrorContains(t, invalid.Validate(), "the model expects 224x224 images but they are processed to 384x384")
+	})
+	t.Run("pixel-values", func(t *testing.T) {
+		invalid := *pipeline
+		invalid.InputsMeta = []ort.InputOutputInfo{{Name: "input_ids", Dimensions: ort.NewShape(-1, -1)}}
+		assert.ErrorContains(t, invalid.Validate(), "single pixel_values input")
 	})
 }
 
-// Token classification
+func TestImageClassificationPostprocess(t *testing.T) {
+	pipeline := &pipelines.ImageClassificationPipeline{
+		IDLabelMap:  map[int]string{0: "cat", 1: "dog", 2: "bird"},
+		ProblemType: "single_label_classification",
+		TopK:        2,
+	}
+	// two images and three labels
+	logits := []float32{1, 3, 0, 2, 0, 0}
+	output, err := pipeline.Postprocess(logits, 3)
+	check(t, err)
+	assert.Len(t, output.ClassificationOutputs, 2)
+	sum := math.Exp(1) + math.Exp(3) + math.Exp(0)
+	assert.Equal(t, []string{"dog", "cat"}, []string{output.ClassificationOutputs[0][0].Label, output.ClassificationOutputs[0][1].Label})
+	assert.InDelta(t, math.Exp(3)/sum, output.ClassificationOutputs[0][0].Score, 1e-6)
+	assert.InDelta(t, math.Exp(1)/sum, output.ClassificationOutputs[0][1].Score, 1e-6)
+	// labels with equal scores keep the order of the id2label map
+	assert.Equal(t, "cat", output.ClassificationOutputs[1][0].Label)
+	assert.Equal(t, "dog", output.ClassificationOutputs[1][1].Label)
 
-func TestTokenClassificationPipeline(t *testing.T) {
-	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+	// multi-label scores are independent sigmoids, and TopK 0 returns all the labels
+	pipeline.ProblemType = "multi_label_classification"
+	pipeline.TopK = 0
+	output, err = pipeline.Postprocess(logits, 3)
 	check(t, err)
-	defer func(session *Session) {
-		err := session.Destroy()
-		check(t, err)
-	}(session)
+	assert.Len(t, output.ClassificationOutputs[0], 3)
+	assert.InDelta(t, 1/(1+math.Exp(-3)), output.ClassificationOutputs[0][0].Score, 1e-6)
+	assert.InDelta(t, 0.5, output.ClassificationOutputs[0][2].Score, 1e-6)
 
-	modelPath := "./models/KnightsAnalytics_distilbert-NER"
-	configSimple := TokenClassificationConfig{
-		ModelPath: modelPath,
-		Name:      "testPipelineSimple",
-		Options: []TokenClassificationOption{
-			pipelines.WithSimpleAggregation(),
-			pipelines.WithIgnoreLabels([]string{"O"}),
-		},
+	_, err = pipeline.Postprocess([]float32{1, 2, 3, 4}, 4)
+	assert.Error(t, err)
+}
+
+func TestImageFeatures(t *testing.T) {
+	// a 4x2 image with a horizontal red gradient, and an origin which is not zero
+	img := image.NewRGBA(image.Rect(10, 10, 14, 12))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			img.Set(10+x, 10+y, color.RGBA{R: uint8(x * 60), G: 100, B: 200, A: 255})
+		}
 	}
-	pipelineSimple, err2 := NewPipeline(session, configSimple)
-	check(t, err2)
+	// downscaling averages the pixels covered by the filter, as PIL does
+	resized := util.ResizeImage(img, 2, 1, util.Bilinear)
+	assert.Equal(t, []uint8{43, 100, 200, 255, 137, 100, 200, 255}, resized.Pix)
+	upscaled := util.ResizeImage(img, 8, 4, util.Bicubic)
+	assert.Equal(t, image.Rect(0, 0, 8, 4), upscaled.Rect)
+	assert.Equal(t, []uint8{0, 10, 43, 75}, []uint8{upscaled.Pix[0], upscaled.Pix[4], upscaled.Pix[8], upscaled.Pix[12]})
+	// the other filters of PIL, selected by the resample of preprocessor_config.json
+	assert.Equal(t, []uint8{30, 100, 200, 255, 150, 100, 200, 255}, util.ResizeImage(img, 2, 1, util.PILImageFilter(4)).Pix)
+	assert.Equal(t, []uint8{60, 100, 200, 255, 180, 100, 200, 255}, util.ResizeImage(img, 2, 1, util.PILImageFilter(0)).Pix)
+	assert.Equal(t, []uint8{32, 100, 200, 255, 148, 100, 200, 255}, util.ResizeImage(img, 2, 1, util.PILImageFilter(1)).Pix)
+	hamming := util.ResizeImage(img, 3, 2, util.PILImageFilter(5))
+	assert.Equal(t, []uint8{9, 90, 171}, []uint8{hamming.Pix[0], hamming.Pix[4], hamming.Pix[8]})
+	width, height := util.ResizeShortestEdge(img, 224)
+	assert.Equal(t, []int{448, 224}, []int{width, height})
 
-	configNone := TokenClassificationConfig{
-		ModelPath: modelPath,
-		Name:      "testPipelineNone",
-		Options: []TokenClassificationOption{
-			pipelines.WithoutAggregation(),
-		},
+	// cropping to a larger size pads with black
+	cropped := util.CenterCropImage(img, 6, 1)
+	assert.Equal(t, []uint8{0, 0, 0, 255, 0, 100, 200, 255}, cropped.Pix[:8])
+	pixels := util.ImagePixels(util.CenterCropImage(img, 2, 1), 1.0/255, [3]float32{0.5, 0.5, 0.5}, [3]float32{0.5, 0.5, 0.5})
+	expected := []float32{60.0/255*2 - 1, 120.0/255*2 - 1, 100.0/255*2 - 1, 100.0/255*2 - 1, 200.0/255*2 - 1, 200.0/255*2 - 1}
+	assert.InDeltaSlice(t, expected, pixels, 1e-6)
+}
+
+func TestVideoFrames(t *testing.T) {
+	frameJPEG := func(fill color.RGBA, thumbnail bool) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = fill.R, fill.G, fill.B, 255
+		}
+		var buffer bytes.Buffer
+		check(t, jpeg.Encode(&buffer, img, nil))
+		data := buffer.Bytes()
+		if !thumbnail {
+			return data
+		}
+		// an APP1 segment whose content contains the markers of an embedded image
+		segment := []byte{0xFF, 0xE1, 0x00, 0x0C, 'E', 'x', 'i', 'f', 0, 0, 0xFF, 0xD8, 0xFF, 0xD9}
+		return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
 	}
-	pipelineNone, err3 := NewPipeline(session, configNone)
-	check(t, err3)
+	red, blue := color.RGBA{R: 200, A: 255}, color.RGBA{B: 200, A: 255}
+	var stream bytes.Buffer
+	stream.WriteString("--boundary\r\nContent-Type: image/jpeg\r\n\r\n")
+	stream.Write(frameJPEG(red, true))
+	stream.WriteString("\r\n--boundary\r\n")
+	stream.Write(frameJPEG(red, false))
+	stream.Write(frameJPEG(blue, false))
+	stream.Write(frameJPEG(blue, false))
 
-	var expectedResults map[int]pipelines.TokenClassificationOutput
-	err4 := json.Unmarshal(tokenExpectedByte, &expectedResults)
-	check(t, err4)
+	reader := util.NewMJPEGReader(bytes.NewReader(stream.Bytes()), 25)
+	var frames []*util.VideoFrame
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		check(t, err)
+		frames = append(frames, frame)
+	}
+	assert.Len(t, frames, 4)
+	assert.Equal(t, 3, frames[3].Index)
+	assert.Equal(t, 120*time.Millisecond, frames[3].Time)
+	assert.Equal(t, image.Rect(0, 0, 32, 24), frames[0].Image.Bounds())
 
-	tests := []struct {
-		pipeline *pipelines.TokenClassificationPipeline
-		name     string
-		strings  []string
-		expected pipelines.TokenClassificationOutput
-	}{
-		{
-			pipeline: pipelineSimple,
-			name:     "Simple aggregation",
-			strings:  []string{"My name is Wolfgang and I live in Berlin."},
-			expected: expectedResults[0],
-		},
-		{
-			pipeline: pipelineNone,
-			name:     "No aggregation",
-			strings:  []string{"My name is Wolfgang and I live in Berlin."},
-			expected: expectedResults[1],
-		},
-		{
-			pipeline: pipelineSimple,
-			name:     "Parsing of batch with different token length",
-			strings:  []string{"Microsoft incorporated.", "Yesterday I went to Berlin and met with Jack Brown."},
-			expected: expectedResults[2],
-		},
+	selected := func(selector util.FrameSelector) []int {
+		var indices []int
+		for _, frame := range frames {
+			if selector.SelectFrame(frame) {
+				indices = append(indices, frame.Index)
+			}
+		}
+		return indices
 	}
+	assert.Equal(t, []int{0, 2}, selected(util.EveryNthFrame(2)))
+	assert.Equal(t, []int{0, 2}, selected(util.EveryInterval(80*time.Millisecond)))
+	assert.Equal(t, []int{0, 2}, selected(util.SceneChanges(0.3)))
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			batchResult, err := tt.pipeline.RunPipeline(tt.strings)
-			check(t, err)
-			printTokenEntities(batchResult)
-			for i, predictedEntities := range batchResult.Entities {
-				assert.Equal(t, len(tt.expected.Entities[i]), len(predictedEntities))
-				for j, entity := range predictedEntities {
-					expectedEntity := tt.expected.Entities[i][j]
-					assert.Equal(t, expectedEntity.Entity, entity.Entity)
-					assert.Equal(t, expectedEntity.Word, entity.Word)
+	// a truncated image is an error
+	_, err := util.NewMJPEGReader(bytes.NewReader(frameJPEG(red, false)[:100]), 25).ReadFrame()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestVideoTagger(t *testing.T) {
+	// a fake classifier, which labels red frames as "fire" and the others as "sea"
+	var batchSizes []int
+	tagger := &pipelines.VideoTagger{
+		Classify: func(images []image.Image) ([][]pipelines.ClassificationOutput, error) {
+			batchSizes = append(batchSizes, len(images))
+			labels := make([][]pipelines.ClassificationOutput, len(images))
+			for i, img := range images {
+				if r, _, _, _ := img.At(0, 0).RGBA(); r > 0x8000 {
+					labels[i] = []pipelines.ClassificationOutput{{Label: "fire", Score: 0.9}, {Label: "sea", Score: 0.1}}
+				} else {
+					labels[i] = []pipelines.ClassificationOutput{{Label: "sea", Score: 0.6}, {Label: "fire", Score: 0.4}}
 				}
 			}
-		})
+			return labels, nil
+		},
+		BatchSize: 2,
+	}
+	directory := t.TempDir()
+	var paths []string
+	for i, fill := range []color.Color{color.White, color.Black, color.Black, color.White, color.Black} {
+		img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		draw.Draw(img, img.Bounds(), image.NewUniform(fill), image.Point{}, draw.Src)
+		path := filepath.Join(directory, fmt.Sprintf("%06d.png", i))
+		file, err := os.Create(path)
+		check(t, err)
+		check(t, png.Encode(file, img))
+		check(t, file.Close())
+		paths = append(paths, path)
 	}
+	output, err := tagger.TagVideo(util.NewImageSequenceReader(paths, 1), util.EveryNthFrame(1))
+	check(t, err)
+	assert.Equal(t, []int{2, 2, 1}, batchSizes)
+	assert.Len(t, output.Frames, 5)
+	assert.Equal(t, 3*time.Second, output.Frames[3].Time)
+	assert.Len(t, output.Tags, 2)
+	assert.Equal(t, "fire", output.Tags[0].Label)
+	assert.InDelta(t, (0.9*2+0.4*3)/5, output.Tags[0].MeanScore, 1e-6)
+	assert.InDelta(t, 0.9, output.Tags[0].MaxScore, 1e-6)
+	assert.Equal(t, time.Duration(0), output.Tags[0].MaxTime)
+	assert.Equal(t, 2, output.Tags[0].TopFrames)
+	assert.Equal(t, "sea", output.Tags[1].Label)
+	assert.Equal(t, time.Second, output.Tags[1].MaxTime)
+	assert.Equal(t, 3, output.Tags[1].TopFrames)
+
+	_, err = pipelines.NewVideoTagger(nil)
+	assert.Error(t, err)
 }
 
-func TestTokenClassificationPipelineValidation(t *testing.T) {
-	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
+func TestDecodeImage(t *testing.T) {
+	// a 2x1 PNG image, red then blue, with an eXIf chunk after the header setting orientation 6
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	img.Set(1, 0, color.NRGBA{B: 255, A: 128})
+	var buffer bytes.Buffer
+	check(t, png.Encode(&buffer, img))
+	encoded := buffer.Bytes()
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(exif)))
+	chunk = append(append(chunk, "eXIf"...), exif...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	withExif := append(append(append([]byte{}, encoded[:33]...), chunk...), encoded[33:]...)
+	assert.Equal(t, 1, util.ImageOrientation(encoded))
+	assert.Equal(t, 6, util.ImageOrientation(withExif))
+
+	// rotated clockwise to a 1x2 image, and opaque
+	decoded, err := util.DecodeImage(withExif)
 	check(t, err)
-	defer func(session *Session) {
-		err := session.Destroy()
-		check(t, err)
-	}(session)
+	assert.Equal(t, image.Rect(0, 0, 1, 2), decoded.Rect)
+	assert.Equal(t, []uint8{255, 0, 0, 255, 0, 0, 255, 255}, decoded.Pix)
+	decoded, err = util.DecodeImage(encoded)
+	check(t, err)
+	assert.Equal(t, []uint8{255, 0, 0, 255, 0, 0, 255, 255}, decoded.Pix)
 
-	modelPath := "./models/KnightsAnalytics_distilbert-NER"
-	configSimple := TokenClassificationConfig{
-		ModelPath: modelPath,
-		Name:      "testPipelineSimple",
-		Options: []TokenClassificationOption{
-			pipelines.WithSimpleAggregation(),
-			pipelines.WithIgnoreLabels([]string{"O"}),
-		},
+	// the orientation of a JPEG is in its APP1 segment, here in little endian
+	jpegHeader := []byte("\xff\xd8\xff\xe1\x00\x22Exif\x00\x00II\x2a\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\xff\xda")
+	assert.Equal(t, 8, util.ImageOrientation(jpegHeader))
+	square := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i := range square.Pix {
+		square.Pix[i] = uint8(i / 4) // index of the pixel
 	}
-	pipelineSimple, err2 := NewPipeline(session, configSimple)
-	check(t, err2)
+	redChannel := func(img *image.NRGBA) []uint8 {
+		return []uint8{img.Pix[0], img.Pix[4], img.Pix[8], img.Pix[12]}
+	}
+	assert.Equal(t, []uint8{1, 3, 0, 2}, redChannel(util.OrientImage(square, 8)))
+	assert.Equal(t, []uint8{3, 2, 1, 0}, redChannel(util.OrientImage(square, 3)))
+	assert.Equal(t, []uint8{0, 2, 1, 3}, redChannel(util.OrientImage(square, 5)))
 
-	t.Run("id-label-map", func(t *testing.T) {
-		labelMapInitial := pipelineSimple.IDLabelMap
-		defer func() {
-			pipelineSimple.IDLabelMap = labelMapInitial
-		}()
-		pipelineSimple.IDLabelMap = map[int]string{}
-		err = pipelineSimple.Validate()
-		assert.Error(t, err)
-	})
+	// grayscale images are converted to RGB
+	gray := image.NewGray(image.Rect(0, 0, 1, 1))
+	gray.Pix[0] = 77
+	assert.Equal(t, []uint8{77, 77, 77, 255}, util.ImageToRGB(gray).Pix)
 
-	t.Run("output-shape", func(t *testing.T) {
-		dimensionInitial := pipelineSimple.OutputsMeta[0].Dimensions
-		defer func() {
-			pipelineSimple.OutputsMeta[0].Dimensions = dimensionInitial
-		}()
-		pipelineSimple.OutputsMeta[0].Dimensions = ort.NewShape(-1, -1, -1)
-		err = pipelineSimple.Validate()
-		assert.Error(t, err)
+	_, err = util.DecodeImage([]byte("not an image"))
+	assert.ErrorContains(t, err, "unsupported image format")
+}
+
+// Zero shot image classification
+
+func TestZeroShotImageClassificationPipelineValidation(t *testing.T) {
+	pipeline := &pipelines.ZeroShotImageClassificationPipeline{
+		Labels:             []string{"cat", "dog"},
+		HypothesisTemplate: "a photo of a {}",
+		LogitScale:         100,
+		TextOutputsMeta:    []ort.InputOutputInfo{{Name: "text_embeds", Dimensions: ort.NewShape(-1, 512)}},
+	}
+	pipeline.CropHeight, pipeline.CropWidth = 224, 224
+	pipeline.ImageStd = [3]float32{0.26862954, 0.26130258, 0.27577711}
+	pipeline.InputsMeta = []ort.InputOutputInfo{{Name: "pixel_values", Dimensions: ort.NewShape(-1, 3, 224, 224)}}
+	pipeline.OutputsMeta = []ort.InputOutputInfo{{Name: "image_embeds", Dimensions: ort.NewShape(-1, 512)}}
+	check(t, pipeline.Validate())
+
+	t.Run("labels", func(t *testing.T) {
+		invalid := *pipeline
+		invalid.Labels = nil
+		assert.ErrorContains(t, invalid.Validate(), "no labels")
+	})
+	t.Run("hypothesis-template", func(t *testing.T) {
+		invalid := *pipeline
+		invalid.HypothesisTemplate = "a photo"
+		assert.ErrorContains(t, invalid.Validate(), "has no {} to replace with the labels")
 	})
+	t.Run("embedding-size", func(t *testing.T) {
+		invalid := *pipeline
+		invalid.TextOutputsMeta = []ort.InputOutputInfo{{Name: "text_embeds", Dimensions: ort.NewShape(-1, 768)}}
+		assert.ErrorContains(t, invalid.Validate(), "the image embeddings have 512 dimensions but the text embeddings have 768")
+	})
+	t.Run("text-model", func(t *testing.T) {
+		invalid := *pipeline
+		invalid.TextOutputsMeta = []ort.InputOutputInfo{{Name: "last_hidden_state", Dimensions: ort.NewShape(-1, -1, 512)}}
+		assert.ErrorContains(t, invalid.Validate(), "text_embeds output")
+	})
+
+	_, err := pipelines.NewImageSearch(nil)
+	assert.Error(t, err)
+	// the ids must match the images
+	search := &pipelines.ImageSearch{Index: util.NewVectorIndex()}
+	assert.Error(t, search.IndexImages([]string{"cat.jpg"}, nil))
+	assert.Equal(t, 0, search.Len())
 }
 
-func TestNoSameNamePipeline(t *testing.T) {
+func TestZeroShotImageClassificationScores(t *testing.T) {
+	pipeline := &pipelines.ZeroShotImageClassificationPipeline{LogitScale: 100}
+	// normalized embeddings, the image is closer to the second label
+	labelEmbeddings := [][]float32{{1, 0}, {0.6, 0.8}}
+	output, err := pipeline.Postprocess([][]float32{{0, 1}}, []string{"cat", "dog"}, labelEmbeddings)
+	check(t, err)
+	assert.Len(t, output.ClassificationOutputs, 1)
+	assert.Equal(t, "dog", output.ClassificationOutputs[0][0].Label)
+	assert.InDelta(t, 1/(1+math.Exp(-80)), output.ClassificationOutputs[0][0].Score, 1e-6)
+	assert.Equal(t, "cat", output.ClassificationOutputs[0][1].Label)
+	_, err = pipeline.Postprocess([][]float32{{0, 1, 0}}, []string{"cat", "dog"}, labelEmbeddings)
+	assert.Error(t, err)
+}
+
+// Rerank
+
+func TestRetrieverCitations(t *testing.T) {
 	session, err := NewSession(WithOnnxLibraryPath(onnxRuntimeSharedLibrary))
 	check(t, err)
 	defer func(session *Session) {
 		err := session.Destroy()
 		check(t, err)
 	}(session)
+	embedder, err := NewPipeline(session, FeatureExtractionConfig{
+		ModelPath: "./models/sentence-transformers_all-MiniLM-L6-v2",
+		Name:      "testPipelineEmbedder",
+		Options:   []FeatureExtractionOption{pipelines.WithNormalization(), pipelines.WithChunking(16, 0)},
+	})
+	check(t, err)
 
-	modelPath := "./models/KnightsAnalytics_distilbert-NER"
-	configSimple := TokenClassificationConfig{
-		ModelPath: modelPath,
-		Name:      "testPipelineSimple",
-		Options: []TokenClassificationOption{
-			pipelines.WithSimpleAggregation(),
-			pipelines.WithIgnoreLabels([]string{"O"}),
-		},
+	documents := []pipelines.SourceDocument{
+		{ID: "cooking", Text: "Boil the pasta in salted water for ten minutes. Drain it and add the tomato sauce with fresh basil."},
+		{ID: "astronomy", Text: "Jupiter is the largest planet of the solar system. It is a gas giant with dozens of moons."},
 	}
-	_, err2 := NewPipeline(session, configSimple)
-	if err2 != nil {
-		t.FailNow()
+	_, err = pipelines.NewRetriever(nil, nil)
+	assert.Error(t, err)
+	retriever, err := pipelines.NewRetriever(embedder, nil)
+	check(t, err)
+	check(t, retriever.AddDocuments(documents))
+	assert.Greater(t, retriever.Len(), len(documents))
+
+	texts := map[string]string{}
+	for _, document := range documents {
+		texts[document.ID] = document.Text
 	}
-	_, err3 := NewPipeline(session, configSimple)
-	assert.Error(t, err3)
+	chunks, err := retriever.Retrieve("Which planet is the biggest?", 2)
+	check(t, err)
+	assert.Len(t, chunks, 2)
+	assert.Equal(t, "astronomy", chunks[0].DocumentID)
+	assert.GreaterOrEqual(t, chunks[0].Score, chunks[1].Score)
+	for _, chunk := range chunks {
+		assert.Equal(t, texts[chunk.DocumentID][chunk.Start:chunk.End], chunk.Text)
+	}
+	assert.Equal(t, fmt.Sprintf("astronomy:%d-%d", chunks[0].Start, chunks[0].End), chunks[0].Citation())
+}
+
+func TestPromptAssembler(t *testing.T) {
+	text := "Jupiter is the largest planet of the solar system. It is a gas giant with dozens of moons, the largest of which is Ganymede."
+	chunks := []pipelines.RetrievedChunk{
+		{DocumentChunk: pipelines.DocumentChunk{DocumentID: "astronomy", Start: 51, End: len(text), Text: text[51:]}},
+		{DocumentChunk: pipelines.DocumentChunk{DocumentID: "cooking", Start: 0, End: 15, Text: "Boil the pasta."}},
+		{DocumentChunk: pipelines.DocumentChunk{DocumentID: "astronomy", Start: 0, End: 50, Text: text[:50]}},
+	}
+	modelPath := "./models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english"
+	_, err := pipelines.NewPromptAssembler(modelPath, 0)
+	assert.Error(t, err)
+	assembler, err := pipelines.NewPromptAssembler(modelPath, 1000)
+	check(t, err)
+	defer func() {
+		check(t, assembler.Destroy())
+	}()
+	assembler.Template = "{context}\nQ: {question}"
+	question := "Which planet is the largest?"
+
+	// everything fits, grouped by document in the order of the documents
+	assembler.Order = pipelines.ContextBySource
+	packed, err := assembler.Pack(question, chunks)
+	check(t, err)
+	assert.Equal(t, "[1] "+text[:50]+"\n\n[2] "+text[51:]+"\n\n[3] Boil the pasta.\nQ: "+question, packed.Prompt)
+	assert.Equal(t, 0, packed.Dropped)
+	assert.False(t, packed.Truncated)
+	assert.LessOrEqual(t, packed.Tokens, 1000)
+
+	// the most relevant chunks at the edges of the context
+	assembler.Order = pipelines.ContextAtEdges
+	packed, err = assembler.Pack(question, chunks)
+	check(t, err)
+	assert.Equal(t, []int{51, 0, 0}, []int{packed.Chunks[0].Start, packed.Chunks[1].Start, packed.Chunks[2].Start})
+	assert.Equal(t, "cooking", packed.Chunks[2].DocumentID)
+
+	// with 10 tokens left after the question, the most relevant chunk is truncated, or skipped for a shorter one
+	assembler.Order = pipelines.ContextByRelevance
+	assembler.MinChunkTokens = 4
+	assembler.MaxTokens = 20
+	packed, err = assembler.Pack(question, chunks)
+	check(t, err)
+	assert.LessOrEqual(t, packed.Tokens, 20)
+	assert.True(t, packed.Truncated)
+	assert.Len(t, packed.Chunks, 1)
+	assert.Less(t, packed.Chunks[0].End, len(text))
+	assert.Equal(t, text[51:packed.Chunks[0].End], packed.Chunks[0].Text)
+
+	assembler.Truncation = pipelines.SkipOverflow
+	packed, err = assembler.Pack(question, chunks)
+	check(t, err)
+	assert.LessOrEqual(t, packed.Tokens, 20)
+	assert.False(t, packed.Truncated)
+	assert.Len(t, packed.Chunks, 1)
+	assert.Equal(t, "cooking", packed.Chunks[0].DocumentID)
+	assert.Equal(t, 2, packed.Dropped)
+
+	// the question alone does not fit
+	assembler.MaxTokens = 3
+	_, err = assembler.Pack(question, chunks)
+	assert.Error(t, err)
 }
 
 // README: test the readme examples
@@ -940,6 +4082,63 @@ func TestCuda(t *testing.T) {
 	fmt.Println(res.GetOutput())
 }
 
+func TestCPUPlacement(t *testing.T) {
+	if os.Getenv("CI") != "" {
+		t.SkipNow()
+	}
+	opts := []WithOption{
+		WithOnnxLibraryPath("/usr/lib64/onnxruntime-gpu/libonnxruntime.so"),
+		WithCuda(map[string]string{
+			"device_id": "0",
+		}),
+		WithCPUPlacementThreshold(1024 * 1024 * 1024),
+	}
+
+	session, err := NewSession(opts...)
+	check(t, err)
+	defer func(session *Session) {
+		errDestroy := session.Destroy()
+		check(t, errDestroy)
+	}(session)
+
+	modelPath := "./models/KnightsAnalytics_all-MiniLM-L6-v2"
+	config := FeatureExtractionConfig{
+		ModelPath: modelPath,
+		Name:      "cpuPlacedEmbedding",
+	}
+	pipelineEmbedder, err := NewPipeline(session, config)
+	check(t, err)
+	assert.Equal(t, session.cpuOrtOptions, pipelineEmbedder.OrtOptions)
+	_, err = pipelineEmbedder.Run([]string{"Small models run on the cpu"})
+	check(t, err)
+
+	// an encoder/decoder model is placed by the total size of both of its default graphs
+	t5Path := "./models/Xenova_t5-small"
+	generator, err := NewPipeline(session, Text2TextGenerationConfig{
+		ModelPath: t5Path,
+		Name:      "cpuPlacedText2Text",
+	})
+	check(t, err)
+	assert.Equal(t, session.cpuOrtOptions, generator.OrtOptions)
+
+	encoderPath, err := pipelines.GetOnnxModelPath(t5Path, "encoder_model.onnx")
+	check(t, err)
+	encoderSize, err := util.FileSize(encoderPath)
+	check(t, err)
+	largeModelSession, err := NewSession(append(opts, WithCPUPlacementThreshold(encoderSize+1))...)
+	check(t, err)
+	defer func(session *Session) {
+		errDestroy := session.Destroy()
+		check(t, errDestroy)
+	}(largeModelSession)
+	generator, err = NewPipeline(largeModelSession, Text2TextGenerationConfig{
+		ModelPath: t5Path,
+		Name:      "acceleratorPlacedText2Text",
+	})
+	check(t, err)
+	assert.Equal(t, largeModelSession.ortOptions, generator.OrtOptions)
+}
+
 // Benchmarks
 
 func runBenchmarkEmbedding(strings *[]string, cuda bool) {
@@ -1059,3 +4258,17 @@ func printTokenEntities(o *pipelines.TokenClassificationOutput) {
 		}
 	}
 }
+
+// linkModel links the files of a model in a directory of its own, to add files to the model directory.
+func linkModel(t *testing.T, modelPath string) string {
+	t.Helper()
+	linkPath := t.TempDir()
+	files, err := os.ReadDir(modelPath)
+	check(t, err)
+	for _, file := range files {
+		source, absErr := filepath.Abs(filepath.Join(modelPath, file.Name()))
+		check(t, absErr)
+		check(t, os.Symlink(source, filepath.Join(linkPath, file.Name())))
+	}
+	return linkPath
+}
@@ -0,0 +1,153 @@
+package hugot
+
+import (
+	"runtime"
+	"sort"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	"github.com/knights-analytics/hugot/pipelines"
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// ReproducibilityManifest records the sources of nondeterminism of a session, so that results can be traced back
+// to the exact models and runtime configuration that produced them, and runs can be reproduced.
+type ReproducibilityManifest struct {
+	CreatedAt          time.Time       `json:"createdAt"`
+	Seed               int64           `json:"seed"`
+	OnnxRuntimeVersion string          `json:"onnxRuntimeVersion"`
+	GoVersion          string          `json:"goVersion"`
+	Platform           string          `json:"platform"`
+	ExecutionProviders []string        `json:"executionProviders"` // accelerators in order of preference, the CPU is always the fallback
+	CPUPlacementBytes  int64           `json:"cpuPlacementBytes,omitempty"`
+	IntraOpNumThreads  int             `json:"intraOpNumThreads,omitempty"`
+	InterOpNumThreads  int             `json:"interOpNumThreads,omitempty"`
+	Redaction          bool            `json:"redaction"` // whether input texts are redacted from errors
+	Models             []ModelManifest `json:"models"`
+}
+
+// ModelManifest identifies the model file of a pipeline by its hash.
+type ModelManifest struct {
+	Pipeline     string `json:"pipeline"`
+	PipelineType string `json:"pipelineType"`
+	ModelPath    string `json:"modelPath"`
+	OnnxFile     string `json:"onnxFile"`
+	SHA256       string `json:"sha256"`
+}
+
+// ReproducibleOutput is the output of a pipeline along with the manifest of the session that produced it.
+type ReproducibleOutput struct {
+	Manifest *ReproducibilityManifest `json:"manifest"`
+	Outputs  []any                    `json:"outputs"`
+}
+
+// Seed returns the seed of the session, set with WithSeed or drawn from the clock when the session was created.
+// Pass it to the sampling functions of hugot to make their results reproducible.
+func (s *Session) Seed() int64 {
+	return s.seed
+}
+
+// Manifest returns the reproducibility manifest of the session, with the hashes of the model files of all the
+// pipelines of the session. Model files are hashed once per session.
+func (s *Session) Manifest() (*ReproducibilityManifest, error) {
+	manifest := &ReproducibilityManifest{
+		CreatedAt:          time.Now().UTC(),
+		Seed:               s.seed,
+		OnnxRuntimeVersion: ort.GetVersion(),
+		GoVersion:          runtime.Version(),
+		Platform:           runtime.GOOS + "/" + runtime.GOARCH,
+		ExecutionProviders: append([]string{}, s.executionProviders...),
+		CPUPlacementBytes:  s.cpuPlacementBytes,
+		IntraOpNumThreads:  s.intraOpNumThreads,
+		InterOpNumThreads:  s.interOpNumThreads,
+		Redaction:          util.RedactionEnabled(),
+	}
+
+	type model struct {
+		pipeline, pipelineType, modelPath, onnxFilename string
+	}
+	var models []model
+	for name, p := range s.featureExtractionPipelines {
+		models = append(models, model{name, "featureExtraction", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.textClassificationPipelines {
+		models = append(models, model{name, "textClassification", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.tokenClassificationPipelines {
+		models = append(models, model{name, "tokenClassification", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.zeroShotClassificationPipelines {
+		models = append(models, model{name, "zeroShotClassification", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.fillMaskPipelines {
+		models = append(models, model{name, "fillMask", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.rerankPipelines {
+		models = append(models, model{name, "rerank", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.textGenerationPipelines {
+		models = append(models, model{name, "textGeneration", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.imageClassificationPipelines {
+		models = append(models, model{name, "imageClassification", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.colBERTPipelines {
+		models = append(models, model{name, "colBERT", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.zeroShotNERPipelines {
+		models = append(models, model{name, "zeroShotNER", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.speakerDiarizationPipelines {
+		models = append(models, model{name, "speakerDiarization", p.ModelPath, p.OnnxFilename})
+	}
+	for name, p := range s.zeroShotImageClassificationPipelines {
+		models = append(models,
+			model{name, "zeroShotImageClassification", p.ModelPath, p.OnnxFilename},
+			model{name, "zeroShotImageClassification", p.ModelPath, p.TextOnnxFilename})
+	}
+	for name, p := range s.speechRecognitionPipelines {
+		models = append(models,
+			model{name, "speechRecognition", p.ModelPath, p.OnnxFilename},
+			model{name, "speechRecognition", p.ModelPath, p.DecoderFilename})
+	}
+	for name, p := range s.text2TextGenerationPipelines {
+		models = append(models,
+			model{name, "text2TextGeneration", p.ModelPath, p.OnnxFilename},
+			model{name, "text2TextGeneration", p.ModelPath, p.DecoderFilename})
+	}
+
+	for _, m := range models {
+		onnxPath, err := pipelines.GetOnnxModelPath(m.modelPath, m.onnxFilename)
+		if err != nil {
+			return nil, err
+		}
+		hash, ok := s.modelHashes[onnxPath]
+		if !ok {
+			hash, err = util.FileSHA256(onnxPath)
+			if err != nil {
+				return nil, err
+			}
+			s.modelHashes[onnxPath] = hash
+		}
+		manifest.Models = append(manifest.Models, ModelManifest{
+			Pipeline:     m.pipeline,
+			PipelineType: m.pipelineType,
+			ModelPath:    m.modelPath,
+			OnnxFile:     onnxPath,
+			SHA256:       hash,
+		})
+	}
+	sort.Slice(manifest.Models, func(i, j int) bool {
+		if manifest.Models[i].Pipeline != manifest.Models[j].Pipeline {
+			return manifest.Models[i].Pipeline < manifest.Models[j].Pipeline
+		}
+		return manifest.Models[i].OnnxFile < manifest.Models[j].OnnxFile
+	})
+	return manifest, nil
+}
+
+// Attach returns the outputs of a pipeline along with the manifest, e.g. to store them together.
+func (m *ReproducibilityManifest) Attach(output pipelines.PipelineBatchOutput) *ReproducibleOutput {
+	return &ReproducibleOutput{Manifest: m, Outputs: output.GetOutput()}
+}
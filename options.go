@@ -19,6 +19,16 @@ type ortOptions struct {
 	openVINOOptionsSet bool
 	tensorRTOptions    map[string]string
 	tensorRTOptionsSet bool
+	cpuPlacementBytes  int64
+	engineCacheDir     string
+	seed               int64
+	seedSet            bool
+	redaction          bool
+}
+
+// acceleratorSet returns true if any non-CPU execution provider has been configured.
+func (o *ortOptions) acceleratorSet() bool {
+	return o.cudaOptionsSet || o.coreMLOptionsSet || o.directMLOptionsSet || o.openVINOOptionsSet || o.tensorRTOptionsSet
 }
 
 // WithOption is the interface for all option functions
@@ -133,3 +143,49 @@ func WithTensorRT(options map[string]string) WithOption {
 		o.tensorRTOptionsSet = true
 	}
 }
+
+// WithCPUPlacementThreshold Use this function to run models whose .onnx files are smaller than thresholdBytes
+// on the CPU, even when an accelerator execution provider (e.g. CUDA) has been configured. The files of a model
+// with several graphs (e.g. the encoder and decoder of a text2text model) are counted together. Larger models are
+// placed on the accelerator, so that accelerator memory is kept for the models that benefit the most from it.
+// By default, all models are placed on the configured execution provider.
+// Example usage: WithCPUPlacementThreshold(100 * 1024 * 1024) keeps models below 100MB on the CPU.
+func WithCPUPlacementThreshold(thresholdBytes int64) WithOption {
+	return func(o *ortOptions) {
+		o.cpuPlacementBytes = thresholdBytes
+	}
+}
+
+// WithEngineCache Use this function to persist in cacheDir the engines that execution providers compile for each
+// model, so that restarted processes can reuse them instead of paying the engine build time again. Each graph has its
+// own cache entry, keyed by the hash of the graph, the execution provider and the TensorRT shape profile, and the
+// entries are invalidated when the onnxruntime version changes. TensorRT and OpenVINO cache their engines in the entry,
+// and CoreML its compiled models, which requires the CREATE_MLPROGRAM flag of WithCoreML. For the other execution
+// providers, the graph optimized by onnxruntime is saved in the entry and loaded instead of the model.
+func WithEngineCache(cacheDir string) WithOption {
+	return func(o *ortOptions) {
+		o.engineCacheDir = cacheDir
+	}
+}
+
+// WithSeed Use this function to fix the seed of the session, returned by session.Seed() to seed the sampling
+// functions of hugot (e.g. pipelines.SampleEvalSet or util.BootstrapDelta), so that runs can be reproduced. It is
+// also the default sampling seed of the text generation and text2text generation pipelines created with NewPipeline,
+// which WithSamplingSeed and WithDecoderSamplingSeed override. By default, the seed is drawn from the clock when the
+// session is created, and recorded in the session manifest.
+func WithSeed(seed int64) WithOption {
+	return func(o *ortOptions) {
+		o.seed = seed
+		o.seedSet = true
+	}
+}
+
+// WithRedaction Use this function to guarantee that no input text is written in the errors returned by hugot, e.g.
+// when the errors are logged in a deployment handling health data. Input texts are replaced by their length and a
+// hash, see util.Redact. Redaction is off by default, and is recorded in the session manifest. Once a session is
+// created with redaction, it stays on for the whole process, including for the sessions created after it.
+func WithRedaction() WithOption {
+	return func(o *ortOptions) {
+		o.redaction = true
+	}
+}
@@ -0,0 +1,142 @@
+package pipelines
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// LabelingCandidate is an unlabeled input selected for human labeling.
+type LabelingCandidate struct {
+	Index     int     `json:"index"`     // index of the input
+	Text      string  `json:"text"`      // text of the input
+	Entropy   float32 `json:"entropy"`   // entropy of the classifier's predicted distribution, normalized to [0, 1]
+	Diversity float32 `json:"diversity"` // one minus the highest cosine similarity to the candidates selected before it
+	Score     float32 `json:"score"`     // weighted combination of entropy and diversity the candidate was selected with
+}
+
+// ActiveLearningSampler ranks unlabeled inputs by how useful labeling them would be to improve a classifier:
+// inputs the classifier is uncertain about have a high entropy, and inputs far from the candidates already
+// selected in embedding space have a high diversity, which avoids spending labeling effort on near duplicates.
+type ActiveLearningSampler struct {
+	Classifier      *TextClassificationPipeline
+	Embedder        *FeatureExtractionPipeline // optional, candidates are ranked by entropy only without it
+	DiversityWeight float32                    // weight of the diversity in the score, between 0 and 1
+	BatchSize       int
+}
+
+// NewActiveLearningSampler creates a sampler weighing entropy and diversity equally. A copy of the classifier is
+// configured to return the raw scores of all its labels. embedder can be nil to rank candidates by entropy only.
+func NewActiveLearningSampler(classifier *TextClassificationPipeline, embedder *FeatureExtractionPipeline) (*ActiveLearningSampler, error) {
+	if classifier == nil {
+		return nil, errors.New("a text classification pipeline is required for active learning")
+	}
+	preset, err := presetClassifier(classifier, "NONE")
+	if err != nil {
+		return nil, err
+	}
+	return &ActiveLearningSampler{
+		Classifier:      preset,
+		Embedder:        embedder,
+		DiversityWeight: 0.5,
+		BatchSize:       32,
+	}, nil
+}
+
+// Select returns the k best candidates for labeling among the inputs, in order of selection. Candidates are
+// selected greedily, so the diversity of each candidate is relative to the candidates selected before it.
+func (s *ActiveLearningSampler) Select(inputs []string, k int) ([]LabelingCandidate, error) {
+	if s.BatchSize <= 0 {
+		return nil, errors.New("batch size must be greater than zero")
+	}
+	if k <= 0 {
+		return nil, errors.New("the number of candidates must be greater than zero")
+	}
+	entropies := make([]float32, 0, len(inputs))
+	for batchStart := 0; batchStart < len(inputs); batchStart += s.BatchSize {
+		output, err := s.Classifier.RunPipeline(inputs[batchStart:min(batchStart+s.BatchSize, len(inputs))])
+		if err != nil {
+			return nil, err
+		}
+		for _, classes := range output.ClassificationOutputs {
+			entropies = append(entropies, normalizedEntropy(classes))
+		}
+	}
+	var embeddings [][]float32
+	diversityWeight := float32(0)
+	if s.Embedder != nil {
+		var err error
+		if embeddings, err = embedCorpus(s.Embedder, inputs, s.BatchSize); err != nil {
+			return nil, err
+		}
+		diversityWeight = s.DiversityWeight
+	}
+
+	// maxSimilarities[i] is the highest similarity of input i to the selected candidates
+	maxSimilarities := make([]float32, len(inputs))
+	selected := make([]bool, len(inputs))
+	candidates := make([]LabelingCandidate, 0, min(k, len(inputs)))
+	for len(candidates) < cap(candidates) {
+		best := LabelingCandidate{Index: -1}
+		for i := range inputs {
+			if selected[i] {
+				continue
+			}
+			diversity := 1 - max(maxSimilarities[i], 0)
+			score := (1-diversityWeight)*entropies[i] + diversityWeight*diversity
+			if best.Index < 0 || score > best.Score {
+				best = LabelingCandidate{Index: i, Text: inputs[i], Entropy: entropies[i], Diversity: diversity, Score: score}
+			}
+		}
+		selected[best.Index] = true
+		candidates = append(candidates, best)
+		if embeddings != nil {
+			for i := range inputs {
+				similarity, err := util.CosineSimilarity(embeddings[i], embeddings[best.Index])
+				if err != nil {
+					return nil, err
+				}
+				maxSimilarities[i] = max(maxSimilarities[i], similarity)
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// normalizedEntropy returns the entropy of the softmax distribution over the classes' raw scores, divided by
+// the maximum entropy for the number of classes. A single raw score is the logit of a binary classifier.
+func normalizedEntropy(classes []ClassificationOutput) float32 {
+	var probabilities []float32
+	if len(classes) == 1 {
+		p := util.Sigmoid([]float32{classes[0].Score})[0]
+		probabilities = []float32{p, 1 - p}
+	} else {
+		logits := make([]float32, len(classes))
+		for i, class := range classes {
+			logits[i] = class.Score
+		}
+		probabilities = util.SoftMax(logits)
+	}
+	entropy := 0.0
+	for _, p := range probabilities {
+		if p > 0 {
+			entropy -= float64(p) * math.Log(float64(p))
+		}
+	}
+	return float32(entropy / math.Log(float64(len(probabilities))))
+}
+
+// WriteLabelingCandidates writes the candidates as JSON lines. Once a "label" field is added to each line,
+// the file can be read with ReadEvalSet.
+func WriteLabelingCandidates(w io.Writer, candidates []LabelingCandidate) error {
+	encoder := json.NewEncoder(w)
+	for _, candidate := range candidates {
+		if err := encoder.Encode(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
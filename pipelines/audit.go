@@ -0,0 +1,138 @@
+package pipelines
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// AuditLog is an append-only log of the inference requests run by audited pipelines, written as JSON lines, for
+// compliance-sensitive deployments. Inputs are never written: each input is recorded by its SHA-256 hash, or by
+// its HMAC-SHA256 if a key is set, so that short or guessable inputs cannot be recovered by hashing candidates.
+// An AuditLog is safe for concurrent use.
+type AuditLog struct {
+	writer io.Writer
+	key    []byte
+	mutex  sync.Mutex
+}
+
+// AuditRecord is a line of an audit log.
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	Actor        string    `json:"actor,omitempty"` // who ran the pipeline, e.g. the user or service authenticated by the server
+	Pipeline     string    `json:"pipeline"`
+	ModelVersion string    `json:"modelVersion,omitempty"` // e.g. the SHA-256 of the model file, see Session.Manifest
+	NumInputs    int       `json:"numInputs"`
+	InputHashes  []string  `json:"inputHashes"`
+	InputBytes   int       `json:"inputBytes"`
+	DurationMS   float64   `json:"durationMs"`
+	Error        bool      `json:"error,omitempty"` // whether the run failed. The error itself is not logged, since it may quote inputs
+}
+
+// NewAuditLog creates an audit log writing to writer, e.g. a file opened with os.O_APPEND. If key is not empty,
+// inputs are hashed with HMAC-SHA256 and the key.
+func NewAuditLog(writer io.Writer, key []byte) *AuditLog {
+	return &AuditLog{writer: writer, key: key}
+}
+
+// Hash returns the hash of an input as recorded in the log.
+func (l *AuditLog) Hash(input string) string {
+	if len(l.key) == 0 {
+		sum := sha256.Sum256([]byte(input))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(input))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record appends a record to the log as a single line.
+func (l *AuditLog) Record(record AuditRecord) error {
+	line, err := jsoniter.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.writer.Write(append(line, '\n'))
+	return err
+}
+
+// AuditedPipeline records each run of a pipeline in an audit log.
+type AuditedPipeline struct {
+	Pipeline
+	Name         string
+	ModelVersion string
+	Log          *AuditLog
+}
+
+// NewAuditedPipeline wraps a pipeline so that each run is recorded in the audit log under the pipeline name and
+// model version.
+func NewAuditedPipeline(pipeline Pipeline, name string, modelVersion string, log *AuditLog) (*AuditedPipeline, error) {
+	audited := &AuditedPipeline{
+		Pipeline:     pipeline,
+		Name:         name,
+		ModelVersion: modelVersion,
+		Log:          log,
+	}
+	if err := audited.Validate(); err != nil {
+		return nil, err
+	}
+	return audited, nil
+}
+
+// Run the pipeline on a batch of strings without an actor.
+func (p *AuditedPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunAs("", inputs)
+}
+
+// RunAs runs the pipeline on behalf of an actor and records the run. The output is only returned if the run
+// could be recorded.
+func (p *AuditedPipeline) RunAs(actor string, inputs []string) (PipelineBatchOutput, error) {
+	start := time.Now()
+	output, runErr := p.Pipeline.Run(inputs)
+	record := AuditRecord{
+		Time:         start.UTC(),
+		Actor:        actor,
+		Pipeline:     p.Name,
+		ModelVersion: p.ModelVersion,
+		NumInputs:    len(inputs),
+		InputHashes:  make([]string, len(inputs)),
+		DurationMS:   float64(time.Since(start).Microseconds()) / 1000,
+		Error:        runErr != nil,
+	}
+	for i, input := range inputs {
+		record.InputHashes[i] = p.Log.Hash(input)
+		record.InputBytes += len(input)
+	}
+	if err := p.Log.Record(record); err != nil {
+		return nil, errors.Join(runErr, err)
+	}
+	return output, runErr
+}
+
+// Validate checks that the pipeline has a wrapped pipeline and an audit log, and validates the wrapped pipeline.
+func (p *AuditedPipeline) Validate() error {
+	var validationErrors []error
+	if p.Pipeline == nil {
+		return errors.New("pipeline configuration invalid: a pipeline is required")
+	}
+	if p.Log == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: an audit log is required"))
+	}
+	if p.Name == "" {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a pipeline name is required"))
+	}
+	return errors.Join(append(validationErrors, p.Pipeline.Validate())...)
+}
+
+// Destroy does nothing, since the wrapped pipeline is destroyed with its session.
+func (p *AuditedPipeline) Destroy() error {
+	return nil
+}
@@ -0,0 +1,199 @@
+package pipelines
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/daulet/tokenizers"
+)
+
+// BatchTokenizer tokenizes inputs without loading a model, e.g. on CPU nodes that send the tokenized batches to
+// GPU nodes for inference. The batches have all the attributes returned by the tokenizer, so that they can be
+// run by any pipeline of the model.
+type BatchTokenizer struct {
+	Tokenizer *tokenizers.Tokenizer
+}
+
+// NewBatchTokenizer loads the tokenizer.json of a model.
+func NewBatchTokenizer(modelPath string) (*BatchTokenizer, error) {
+	tk, err := loadTokenizer(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	return &BatchTokenizer{Tokenizer: tk}, nil
+}
+
+// Tokenize tokenizes the inputs into a new batch, without input tensors.
+func (t *BatchTokenizer) Tokenize(inputs []string) *PipelineBatch {
+	batch := NewBatch()
+	tokenizeInputs(batch, t.Tokenizer, inputs, []tokenizers.EncodeOption{tokenizers.WithReturnAllAttributes()})
+	return batch
+}
+
+// Destroy frees the tokenizer.
+func (t *BatchTokenizer) Destroy() error {
+	return t.Tokenizer.Close()
+}
+
+// CreateInputTensors creates the input tensors of the pipeline for a batch tokenized elsewhere, e.g. decoded
+// with UnmarshalProto. The batch can then be run with the Forward and Postprocess methods of the pipeline.
+func (p *basePipeline) CreateInputTensors(batch *PipelineBatch) error {
+	if len(batch.InputTensors) > 0 {
+		return errors.New("the batch already has input tensors")
+	}
+	for i, input := range batch.Input {
+		for _, inputMeta := range p.InputsMeta {
+			if inputMeta.Name == "token_type_ids" && len(input.TypeIDs) < len(input.TokenIDs) {
+				return fmt.Errorf("input %d of the batch has no token type ids, which the model requires", i)
+			}
+			if inputMeta.Name == "attention_mask" && len(input.AttentionMask) < len(input.TokenIDs) {
+				return fmt.Errorf("input %d of the batch has no attention mask, which the model requires", i)
+			}
+		}
+	}
+	return createInputTensors(batch, p.InputsMeta)
+}
+
+// MarshalProto encodes the tokenized inputs of the batch as a hugot.v1.TokenizedBatch message of
+// proto/batch.proto. The tensors of the batch are not encoded.
+func (b *PipelineBatch) MarshalProto() []byte {
+	var message []byte
+	for _, input := range b.Input {
+		message = appendProtoBytes(message, 1, input.marshalProto())
+	}
+	return appendProtoUint(message, 2, uint64(b.MaxSequenceLength))
+}
+
+func (t tokenizedInput) marshalProto() []byte {
+	message := appendProtoString(nil, 1, t.Raw)
+	for _, token := range t.Tokens {
+		message = appendProtoBytes(message, 2, []byte(token))
+	}
+	message = appendProtoPackedUints(message, 3, t.TokenIDs)
+	message = appendProtoPackedUints(message, 4, t.TypeIDs)
+	message = appendProtoPackedUints(message, 5, t.AttentionMask)
+	message = appendProtoPackedUints(message, 6, t.SpecialTokensMask)
+	message = appendProtoUint(message, 7, uint64(t.MaxAttentionIndex))
+	if len(t.Offsets) > 0 {
+		var packed []byte
+		for _, offset := range t.Offsets {
+			packed = binary.AppendUvarint(binary.AppendUvarint(packed, uint64(offset[0])), uint64(offset[1]))
+		}
+		message = appendProtoBytes(message, 8, packed)
+	}
+	return message
+}
+
+// UnmarshalProto decodes a hugot.v1.TokenizedBatch message into the tokenized inputs of the batch.
+func (b *PipelineBatch) UnmarshalProto(message []byte) error {
+	if len(b.InputTensors) > 0 {
+		return errors.New("cannot decode into a batch with input tensors")
+	}
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	b.Input = nil
+	b.MaxSequenceLength = 0
+	for _, field := range fields {
+		switch {
+		case field.number == 1 && field.wireType == protoWireLengthDelimited:
+			input, inputErr := unmarshalTokenizedInput(field.value)
+			if inputErr != nil {
+				return fmt.Errorf("cannot decode input %d of the batch: %w", len(b.Input), inputErr)
+			}
+			b.Input = append(b.Input, input)
+		case field.number == 2 && field.wireType == protoWireVarint:
+			length, _ := binary.Uvarint(field.value)
+			b.MaxSequenceLength = int(length)
+		}
+	}
+	for _, input := range b.Input {
+		if len(input.TokenIDs) > b.MaxSequenceLength {
+			return fmt.Errorf("an input of the batch has %d tokens, more than the maximum sequence length %d", len(input.TokenIDs), b.MaxSequenceLength)
+		}
+	}
+	return nil
+}
+
+func unmarshalTokenizedInput(message []byte) (tokenizedInput, error) {
+	var input tokenizedInput
+	fields, err := parseProto(message)
+	if err != nil {
+		return input, err
+	}
+	for _, field := range fields {
+		var values []uint64
+		if field.number >= 3 && field.number <= 8 {
+			if values, err = protoUints(field); err != nil {
+				return input, err
+			}
+		}
+		switch field.number {
+		case 1:
+			input.Raw = string(field.value)
+		case 2:
+			input.Tokens = append(input.Tokens, string(field.value))
+		case 3:
+			input.TokenIDs = appendUint32s(input.TokenIDs, values)
+		case 4:
+			input.TypeIDs = appendUint32s(input.TypeIDs, values)
+		case 5:
+			input.AttentionMask = appendUint32s(input.AttentionMask, values)
+		case 6:
+			input.SpecialTokensMask = appendUint32s(input.SpecialTokensMask, values)
+		case 7:
+			if len(values) > 0 {
+				input.MaxAttentionIndex = int(values[0])
+			}
+		case 8:
+			if len(values)%2 != 0 {
+				return input, errors.New("offsets must have a start and an end")
+			}
+			for i := 0; i < len(values); i += 2 {
+				input.Offsets = append(input.Offsets, tokenizers.Offset{uint(values[i]), uint(values[i+1])})
+			}
+		}
+	}
+	return input, nil
+}
+
+func appendProtoPackedUints(message []byte, number int, values []uint32) []byte {
+	if len(values) == 0 {
+		return message
+	}
+	packed := make([]byte, 0, len(values))
+	for _, value := range values {
+		packed = binary.AppendUvarint(packed, uint64(value))
+	}
+	return appendProtoBytes(message, number, packed)
+}
+
+// protoUints decodes the varints of a packed or of a single repeated field.
+func protoUints(field protoField) ([]uint64, error) {
+	if field.wireType == protoWireVarint {
+		value, _ := binary.Uvarint(field.value)
+		return []uint64{value}, nil
+	}
+	if field.wireType != protoWireLengthDelimited {
+		return nil, fmt.Errorf("unexpected wire type %d for field %d", field.wireType, field.number)
+	}
+	var values []uint64
+	for position := 0; position < len(field.value); {
+		value, n := binary.Uvarint(field.value[position:])
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf varint")
+		}
+		values = append(values, value)
+		position += n
+	}
+	return values, nil
+}
+
+func appendUint32s(slice []uint32, values []uint64) []uint32 {
+	for _, value := range values {
+		slice = append(slice, uint32(value))
+	}
+	return slice
+}
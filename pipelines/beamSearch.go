@@ -0,0 +1,206 @@
+package pipelines
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// beam is a sequence being extended by beam search, or a finished hypothesis.
+type beam struct {
+	tokens  []uint32 // generated token ids, without the end of sequence token
+	logProb float64  // sum of the log probabilities of the tokens, minus infinity for an unused beam
+	parent  int      // index of the beam it extends at the previous step
+	score   float64  // log probability normalized by the length penalty, for finished hypotheses
+}
+
+func (b beam) active() bool {
+	return !math.IsInf(b.logProb, -1)
+}
+
+type beamCandidate struct {
+	beam    int
+	token   int
+	logProb float64
+}
+
+// beamSearch keeps the numBeams most likely sequences of an input at each decoding step, as in transformers: the
+// 2*numBeams most likely extensions of the beams are considered, those ending with an end of sequence token become
+// finished hypotheses, and the most likely others become the beams of the next step. Hypotheses are ranked by
+// their log probability divided by their length to the power of the length penalty, so that a penalty above 0
+// favours longer sequences and a penalty below 0 shorter ones.
+type beamSearch struct {
+	numBeams      int
+	lengthPenalty float64
+	earlyStopping bool
+	beams         []beam // always numBeams beams, most likely first, unused ones last
+	hypotheses    []beam // the best finished hypotheses, best first, at most numBeams
+	done          bool
+}
+
+// newBeamSearch starts the beam search of an input from a single beam with no generated tokens.
+func newBeamSearch(settings *generationSettings) *beamSearch {
+	s := &beamSearch{
+		numBeams:      settings.numBeams,
+		lengthPenalty: float64(settings.lengthPenalty),
+		earlyStopping: settings.earlyStopping,
+		beams:         make([]beam, settings.numBeams),
+	}
+	for i := range s.beams {
+		s.beams[i].parent = i
+		if i > 0 {
+			s.beams[i].logProb = math.Inf(-1)
+		}
+	}
+	return s
+}
+
+// advance extends the beams with the processed logits of their next token, nil for unused beams. The parent of
+// each new beam is the index of the beam it extends, and unused beams have their own index as parent. Once the
+// search is done, all the beams are unused.
+func (s *beamSearch) advance(logits [][]float32, eosTokenIDs map[int64]bool) error {
+	if s.done {
+		return nil
+	}
+	width := 2 * s.numBeams
+	candidates := make([]beamCandidate, 0, width+1) // most likely first
+	for i, b := range s.beams {
+		if !b.active() {
+			continue
+		}
+		if len(logits[i]) == 0 {
+			return errors.New("no logits for an active beam")
+		}
+		maxLogit := math.Inf(-1)
+		for _, logit := range logits[i] {
+			maxLogit = max(maxLogit, float64(logit))
+		}
+		if math.IsInf(maxLogit, -1) {
+			continue
+		}
+		sumExp := 0.0
+		for _, logit := range logits[i] {
+			sumExp += math.Exp(float64(logit) - maxLogit)
+		}
+		logSumExp := maxLogit + math.Log(sumExp)
+		for token, logit := range logits[i] {
+			logProb := b.logProb + float64(logit) - logSumExp
+			if math.IsInf(logProb, -1) || (len(candidates) == width && logProb <= candidates[width-1].logProb) {
+				continue
+			}
+			position := sort.Search(len(candidates), func(j int) bool { return candidates[j].logProb < logProb })
+			candidates = append(candidates, beamCandidate{})
+			copy(candidates[position+1:], candidates[position:])
+			candidates[position] = beamCandidate{beam: i, token: token, logProb: logProb}
+			if len(candidates) > width {
+				candidates = candidates[:width]
+			}
+		}
+	}
+
+	next := make([]beam, 0, s.numBeams)
+	for rank, candidate := range candidates {
+		parent := s.beams[candidate.beam]
+		if eosTokenIDs[int64(candidate.token)] {
+			// as in transformers, end of sequence tokens outside of the numBeams best extensions are dropped
+			if rank < s.numBeams {
+				s.addHypothesis(parent.tokens, candidate.logProb)
+			}
+			continue
+		}
+		tokens := make([]uint32, len(parent.tokens), len(parent.tokens)+1)
+		copy(tokens, parent.tokens)
+		next = append(next, beam{tokens: append(tokens, uint32(candidate.token)), logProb: candidate.logProb, parent: candidate.beam})
+		if len(next) == s.numBeams {
+			break
+		}
+	}
+	s.done = s.isDone(next)
+	if s.done {
+		next = next[:0]
+	}
+	for len(next) < s.numBeams {
+		next = append(next, beam{logProb: math.Inf(-1), parent: len(next)})
+	}
+	s.beams = next
+	return nil
+}
+
+// isDone returns whether the beams cannot lead to better hypotheses. Without early stopping, as in transformers by
+// default, the search stops when the score of the best beam at its current length is not better than the worst
+// hypothesis, and with early stopping as soon as there are numBeams hypotheses.
+func (s *beamSearch) isDone(beams []beam) bool {
+	if len(beams) == 0 {
+		return true
+	}
+	if len(s.hypotheses) < s.numBeams {
+		return false
+	}
+	if s.earlyStopping {
+		return true
+	}
+	return s.hypotheses[len(s.hypotheses)-1].score >= s.score(beams[0].logProb, len(beams[0].tokens))
+}
+
+func (s *beamSearch) score(logProb float64, length int) float64 {
+	return logProb / math.Pow(float64(max(length, 1)), s.lengthPenalty)
+}
+
+// addHypothesis adds a finished sequence to the hypotheses if it is among the numBeams best.
+func (s *beamSearch) addHypothesis(tokens []uint32, logProb float64) {
+	score := s.score(logProb, len(tokens))
+	if len(s.hypotheses) == s.numBeams && score <= s.hypotheses[len(s.hypotheses)-1].score {
+		return
+	}
+	position := sort.Search(len(s.hypotheses), func(i int) bool { return s.hypotheses[i].score < score })
+	s.hypotheses = append(s.hypotheses, beam{})
+	copy(s.hypotheses[position+1:], s.hypotheses[position:])
+	s.hypotheses[position] = beam{tokens: tokens, logProb: logProb, score: score}
+	if len(s.hypotheses) > s.numBeams {
+		s.hypotheses = s.hypotheses[:s.numBeams]
+	}
+}
+
+// best returns the tokens of the best hypothesis. If the search is not done, e.g. when the maximum number of tokens
+// is reached, the beams are finished first.
+func (s *beamSearch) best() []uint32 {
+	if !s.done {
+		for _, b := range s.beams {
+			if b.active() {
+				s.addHypothesis(b.tokens, b.logProb)
+			}
+		}
+		s.done = true
+	}
+	if len(s.hypotheses) == 0 {
+		return nil
+	}
+	return s.hypotheses[0].tokens
+}
+
+// gatherRows returns a new float32 tensor made of the given rows, i.e. slices along the first dimension, of a
+// tensor, in order. It is used to reorder the past key values of the beams, and to repeat the encoder outputs of
+// each input for its beams.
+func gatherRows(value ort.Value, rows []int) (*ort.Tensor[float32], error) {
+	tensor, ok := value.(*ort.Tensor[float32])
+	if !ok {
+		return nil, errors.New("the tensor to reorder is not a float32 tensor")
+	}
+	shape := tensor.GetShape()
+	data := tensor.GetData()
+	rowSize := 0
+	if shape[0] > 0 {
+		rowSize = len(data) / int(shape[0])
+	}
+	gathered := make([]float32, 0, rowSize*len(rows))
+	for _, row := range rows {
+		if row < 0 || row >= int(shape[0]) {
+			return nil, errors.New("row out of range of the tensor to reorder")
+		}
+		gathered = append(gathered, data[row*rowSize:(row+1)*rowSize]...)
+	}
+	shape[0] = int64(len(rows))
+	return ort.NewTensor(shape, gathered)
+}
@@ -0,0 +1,157 @@
+package pipelines
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// CalibrationFile is the file of a model directory with the fitted calibration parameters of the presets that
+// calibrate their scores, which load it when they are created, so that calibrated scores survive redeployments.
+const CalibrationFile = "calibration.json"
+
+// PlattScaling are the coefficients of Platt scaling, which maps the logit x of a label to the probability
+// sigmoid(A*x + B), where A=1 and B=0 is the plain sigmoid.
+type PlattScaling struct {
+	A float32 `json:"a"`
+	B float32 `json:"b"`
+}
+
+// Probability returns the calibrated probability of a logit.
+func (s PlattScaling) Probability(logit float32) float32 {
+	return float32(1 / (1 + math.Exp(-float64(s.A*logit+s.B))))
+}
+
+// Calibration are the fitted calibration parameters of a model.
+type Calibration struct {
+	Temperature float32                 `json:"temperature,omitempty"` // temperature of the softmax, see FormalityPipeline
+	Platt       map[string]PlattScaling `json:"platt,omitempty"`       // Platt scaling of each label, see ModerationPipeline
+}
+
+// LoadCalibration reads the calibration parameters of the model at modelPath, which may be on S3. It returns nil
+// if the model directory has no CalibrationFile.
+func LoadCalibration(modelPath string) (*Calibration, error) {
+	path := util.PathJoinSafe(modelPath, CalibrationFile)
+	exists, err := util.FileExists(path)
+	if err != nil || !exists {
+		return nil, err
+	}
+	calibrationBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	calibration := &Calibration{}
+	if err = json.Unmarshal(calibrationBytes, calibration); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	if calibration.Temperature < 0 {
+		return nil, fmt.Errorf("temperature %f of %s must be greater than zero", calibration.Temperature, path)
+	}
+	return calibration, nil
+}
+
+// SaveCalibration writes calibration parameters to the CalibrationFile of the model at modelPath, replacing the
+// parameters saved before.
+func SaveCalibration(modelPath string, calibration *Calibration) error {
+	calibrationBytes, err := json.MarshalIndent(calibration, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileBytes(util.PathJoinSafe(modelPath, CalibrationFile), calibrationBytes)
+}
+
+// updateCalibration changes some of the calibration parameters saved with the model at modelPath, keeping the
+// others, e.g. those of another preset using the same model.
+func updateCalibration(modelPath string, update func(*Calibration)) error {
+	calibration, err := LoadCalibration(modelPath)
+	if err != nil {
+		return err
+	}
+	if calibration == nil {
+		calibration = &Calibration{}
+	}
+	update(calibration)
+	return SaveCalibration(modelPath, calibration)
+}
+
+// classifyInBatches runs a text classification pipeline on texts, batchSize texts at a time, e.g. on the labeled
+// sample that a preset is calibrated on.
+func classifyInBatches(classifier *TextClassificationPipeline, texts []string, batchSize int) ([][]ClassificationOutput, error) {
+	if batchSize <= 0 {
+		return nil, errors.New("batch size must be greater than zero")
+	}
+	var outputs [][]ClassificationOutput
+	for start := 0; start < len(texts); start += batchSize {
+		output, err := classifier.RunPipeline(texts[start:min(start+batchSize, len(texts))])
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output.ClassificationOutputs...)
+	}
+	return outputs, nil
+}
+
+// fitPlatt fits Platt scaling to the logits of a label and whether the label is correct, with Newton's method and
+// backtracking on the log-likelihood, and the smoothed targets of Platt, which keep the coefficients finite on
+// separable samples.
+func fitPlatt(logits []float32, positives []bool) PlattScaling {
+	numPositives := 0
+	for _, positive := range positives {
+		if positive {
+			numPositives++
+		}
+	}
+	targets := make([]float64, len(positives))
+	for i, positive := range positives {
+		targets[i] = 1 / (float64(len(positives)-numPositives) + 2)
+		if positive {
+			targets[i] = (float64(numPositives) + 1) / (float64(numPositives) + 2)
+		}
+	}
+	loss := func(a float64, b float64) float64 {
+		total := 0.0
+		for i, logit := range logits {
+			z := a*float64(logit) + b
+			// log(1 + exp(z)) - target*z, computed without overflow
+			total += math.Max(z, 0) + math.Log1p(math.Exp(-math.Abs(z))) - targets[i]*z
+		}
+		return total
+	}
+
+	a, b := 1.0, 0.0
+	current := loss(a, b)
+	for iteration := 0; iteration < 100; iteration++ {
+		var gradientA, gradientB, hessianAA, hessianAB, hessianBB float64
+		for i, logit := range logits {
+			x := float64(logit)
+			probability := 1 / (1 + math.Exp(-(a*x + b)))
+			weight := probability * (1 - probability)
+			gradientA += (probability - targets[i]) * x
+			gradientB += probability - targets[i]
+			hessianAA += weight * x * x
+			hessianAB += weight * x
+			hessianBB += weight
+		}
+		// a small ridge keeps the Hessian invertible, e.g. when all the logits are equal
+		hessianAA += 1e-9
+		hessianBB += 1e-9
+		determinant := hessianAA*hessianBB - hessianAB*hessianAB
+		stepA := (hessianBB*gradientA - hessianAB*gradientB) / determinant
+		stepB := (hessianAA*gradientB - hessianAB*gradientA) / determinant
+		improved := false
+		for scale := 1.0; scale >= 1e-10; scale /= 2 {
+			next := loss(a-scale*stepA, b-scale*stepB)
+			if next < current {
+				a, b, current, improved = a-scale*stepA, b-scale*stepB, next, true
+				break
+			}
+		}
+		if !improved || (math.Abs(stepA) < 1e-8 && math.Abs(stepB) < 1e-8) {
+			break
+		}
+	}
+	return PlattScaling{A: float32(a), B: float32(b)}
+}
@@ -0,0 +1,205 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+
+	jsoniter "github.com/json-iterator/go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// ChatPipeline is a preset for chat models, such as Llama 3 Instruct, Qwen or Mistral Instruct. It renders a
+// conversation into a prompt with the chat template of the model, the Jinja template of the chat_template of its
+// tokenizer_config.json or of its chat_template.jinja, and generates the reply of the assistant with a text
+// generation pipeline. Since the template adds the special tokens of the model, such as the bos token, the prompt
+// is tokenized without adding special tokens again.
+type ChatPipeline struct {
+	*TextGenerationPipeline
+	Template  *util.ChatTemplate
+	Variables map[string]any // extra variables of the template, e.g. enable_thinking for Qwen3 models
+	bosToken  string
+	eosToken  string
+}
+
+// ChatMessage is a message of a conversation, with a role such as system, user or assistant.
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+type ChatOutput struct {
+	Replies []ChatMessage
+}
+
+func (t *ChatOutput) GetOutput() []any {
+	out := make([]any, len(t.Replies))
+	for i, reply := range t.Replies {
+		out[i] = any(reply)
+	}
+	return out
+}
+
+// NewChatPipeline creates a chat preset from a text generation pipeline. The chat template is read from the model
+// unless chatTemplate is set.
+func NewChatPipeline(generator *TextGenerationPipeline, chatTemplate string) (*ChatPipeline, error) {
+	if generator == nil {
+		return nil, errors.New("a text generation pipeline is required for chat")
+	}
+	tokenizerConfig, err := readChatTokenizerConfig(generator.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	if chatTemplate == "" {
+		chatTemplate = tokenizerConfig.template
+	}
+	if chatTemplate == "" {
+		return nil, fmt.Errorf("the model at %s has no chat template", generator.ModelPath)
+	}
+	template, err := util.ParseChatTemplate(chatTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &ChatPipeline{
+		TextGenerationPipeline: generator,
+		Template:               template,
+		Variables:              map[string]any{},
+		bosToken:               tokenizerConfig.bosToken,
+		eosToken:               tokenizerConfig.eosToken,
+	}, nil
+}
+
+type chatTokenizerConfig struct {
+	template string
+	bosToken string
+	eosToken string
+}
+
+// readChatTokenizerConfig reads the chat template and the special tokens of a model from its tokenizer_config.json.
+// The template is either a string or a list of named templates, of which the default one is used, and recent
+// versions of transformers save it to chat_template.jinja instead.
+func readChatTokenizerConfig(modelPath string) (chatTokenizerConfig, error) {
+	var raw struct {
+		ChatTemplate jsoniter.RawMessage `json:"chat_template"`
+		BOSToken     jsoniter.RawMessage `json:"bos_token"`
+		EOSToken     jsoniter.RawMessage `json:"eos_token"`
+	}
+	config := chatTokenizerConfig{}
+	configBytes, err := util.ReadFileBytes(util.PathJoinSafe(modelPath, "tokenizer_config.json"))
+	if err == nil {
+		if err = jsoniter.Unmarshal(configBytes, &raw); err != nil {
+			return config, fmt.Errorf("cannot unmarshal tokenizer_config.json at %s: %w", modelPath, err)
+		}
+	}
+	config.bosToken = specialTokenContent(raw.BOSToken)
+	config.eosToken = specialTokenContent(raw.EOSToken)
+	if len(raw.ChatTemplate) > 0 && jsoniter.Unmarshal(raw.ChatTemplate, &config.template) != nil {
+		var namedTemplates []struct {
+			Name     string `json:"name"`
+			Template string `json:"template"`
+		}
+		if err = jsoniter.Unmarshal(raw.ChatTemplate, &namedTemplates); err != nil {
+			return config, fmt.Errorf("cannot read chat_template from tokenizer_config.json at %s: %w", modelPath, err)
+		}
+		for _, named := range namedTemplates {
+			if named.Name == "default" {
+				config.template = named.Template
+			}
+		}
+	}
+	if config.template == "" {
+		if templateBytes, readErr := util.ReadFileBytes(util.PathJoinSafe(modelPath, "chat_template.jinja")); readErr == nil {
+			config.template = string(templateBytes)
+		}
+	}
+	return config, nil
+}
+
+// specialTokenContent returns the content of a special token of tokenizer_config.json, which is either a string or
+// an object with a content field.
+func specialTokenContent(raw jsoniter.RawMessage) string {
+	var content string
+	if jsoniter.Unmarshal(raw, &content) == nil {
+		return content
+	}
+	var token struct {
+		Content string `json:"content"`
+	}
+	if jsoniter.Unmarshal(raw, &token) == nil {
+		return token.Content
+	}
+	return ""
+}
+
+// RenderPrompt renders a conversation into the prompt of the model, followed by the start of the reply of the
+// assistant.
+func (p *ChatPipeline) RenderPrompt(messages []ChatMessage) (string, error) {
+	if len(messages) == 0 {
+		return "", errors.New("the conversation has no messages")
+	}
+	templateMessages := make([]any, len(messages))
+	for i, message := range messages {
+		templateMessages[i] = map[string]any{"role": message.Role, "content": message.Content}
+	}
+	variables := map[string]any{}
+	for name, value := range p.Variables {
+		variables[name] = value
+	}
+	variables["messages"] = templateMessages
+	variables["add_generation_prompt"] = true
+	variables["bos_token"] = p.bosToken
+	variables["eos_token"] = p.eosToken
+	return p.Template.Render(variables)
+}
+
+// Run the pipeline on a batch of strings, each the message of a user in a new conversation.
+func (p *ChatPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete chat output type rather than the interface.
+func (p *ChatPipeline) RunPipeline(inputs []string) (*ChatOutput, error) {
+	return p.RunWithOptions(inputs)
+}
+
+// RunWithOptions is like RunPipeline, with decoding options for this call only.
+func (p *ChatPipeline) RunWithOptions(inputs []string, options ...GenerationOption) (*ChatOutput, error) {
+	conversations := make([][]ChatMessage, len(inputs))
+	for i, input := range inputs {
+		conversations[i] = []ChatMessage{{Role: "user", Content: input}}
+	}
+	return p.RunConversations(conversations, options...)
+}
+
+// RunConversations generates the reply of the assistant to each conversation, with the decoding options of the
+// call if any.
+func (p *ChatPipeline) RunConversations(conversations [][]ChatMessage, options ...GenerationOption) (*ChatOutput, error) {
+	settings, err := p.settings(options)
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, len(conversations))
+	for i, conversation := range conversations {
+		prompt, err := p.RenderPrompt(conversation)
+		if err != nil {
+			return nil, fmt.Errorf("conversation %d: %w", i, err)
+		}
+		tokenIDs, err := p.encodePrompt(prompt, false)
+		if err != nil {
+			return nil, fmt.Errorf("conversation %d: %w", i, err)
+		}
+		texts[i], err = p.generate(tokenIDs, settings)
+		if err != nil {
+			return nil, err
+		}
+	}
+	generated, err := p.Postprocess(texts)
+	if err != nil {
+		return nil, err
+	}
+	output := &ChatOutput{Replies: make([]ChatMessage, len(generated.GeneratedTexts))}
+	for i, text := range generated.GeneratedTexts {
+		output.Replies[i] = ChatMessage{Role: "assistant", Content: text}
+	}
+	return output, nil
+}
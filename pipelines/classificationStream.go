@@ -0,0 +1,153 @@
+package pipelines
+
+import (
+	"errors"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ClassificationVerdict is the classification of the recent text of a ClassificationStream.
+type ClassificationVerdict struct {
+	Start  int    // byte offset of the classified window in the whole text of the stream
+	End    int    // byte offset of the end of the window, i.e. the length of the text when it was classified
+	Text   string // the classified window
+	Labels []ClassificationOutput
+	Err    error // set if the classification failed
+}
+
+// ClassificationStream classifies a rolling window of the text appended to it, such as the messages of a chat for
+// real-time moderation. Appends are debounced: the window is classified once no text was appended for Debounce,
+// or once text has waited for MaxDelay during continuous appends. The verdicts are sent in order on the channel
+// returned by Verdicts, which must be read until it is closed by Close. The Window, Debounce and MaxDelay fields
+// must be set before the first append. It is safe for concurrent use.
+type ClassificationStream struct {
+	Pipeline   *TextClassificationPipeline
+	Window     int           // bytes of recent text classified, moved forward to the start of a word, 512 by default
+	Debounce   time.Duration // quiet time after an append before the window is classified, 300ms by default
+	MaxDelay   time.Duration // longest time appended text waits to be classified, 2s by default
+	text       string        // the end of the text, from the start of the last window
+	offset     int           // length of the text dropped before the last window
+	classified int           // length of the text when it was last classified
+	pending    time.Time     // time of the first append since the text was last classified
+	timer      *time.Timer
+	verdicts   chan ClassificationVerdict
+	closed     bool
+	mutex      sync.Mutex
+	running    sync.Mutex // classifications run one at a time so that verdicts are in order
+}
+
+// NewClassificationStream creates a classification stream on a text classification pipeline.
+func NewClassificationStream(pipeline *TextClassificationPipeline) (*ClassificationStream, error) {
+	if pipeline == nil {
+		return nil, errors.New("a text classification pipeline is required for a classification stream")
+	}
+	return &ClassificationStream{
+		Pipeline: pipeline,
+		Window:   512,
+		Debounce: 300 * time.Millisecond,
+		MaxDelay: 2 * time.Second,
+		verdicts: make(chan ClassificationVerdict, 16),
+	}, nil
+}
+
+// Verdicts returns the channel of the verdicts of the stream. It is closed by Close.
+func (s *ClassificationStream) Verdicts() <-chan ClassificationVerdict {
+	return s.verdicts
+}
+
+// Append appends text to the stream and schedules the classification of its window.
+func (s *ClassificationStream) Append(text string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return errors.New("cannot append to a closed classification stream")
+	}
+	if text == "" {
+		return nil
+	}
+	s.text += text
+	now := time.Now()
+	if s.pending.IsZero() {
+		s.pending = now
+	}
+	delay := min(s.Debounce, max(s.MaxDelay-now.Sub(s.pending), 0))
+	if s.timer == nil {
+		s.timer = time.AfterFunc(delay, s.classify)
+	} else {
+		s.timer.Reset(delay)
+	}
+	return nil
+}
+
+// Flush classifies the text appended since the last verdict without waiting for the debounce, e.g. at the end of
+// a message. It returns once the verdict is sent.
+func (s *ClassificationStream) Flush() {
+	s.mutex.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mutex.Unlock()
+	s.classify()
+}
+
+// Close classifies the pending text, then closes the verdicts channel. Appending to a closed stream fails.
+func (s *ClassificationStream) Close() {
+	s.Flush()
+	s.mutex.Lock()
+	alreadyClosed := s.closed
+	s.closed = true
+	s.mutex.Unlock()
+	if alreadyClosed {
+		return
+	}
+	s.running.Lock()
+	defer s.running.Unlock()
+	close(s.verdicts)
+}
+
+// classify runs the pipeline on the window of the text, if text was appended since it was last classified.
+func (s *ClassificationStream) classify() {
+	s.running.Lock()
+	defer s.running.Unlock()
+	s.mutex.Lock()
+	if s.closed || len(s.text) == s.classified {
+		s.mutex.Unlock()
+		return
+	}
+	start := s.windowStart()
+	verdict := ClassificationVerdict{Start: s.offset + start, End: s.offset + len(s.text), Text: s.text[start:]}
+	// the text before the window is not needed any more
+	s.text = s.text[start:]
+	s.offset += start
+	s.classified = len(s.text)
+	s.pending = time.Time{}
+	s.mutex.Unlock()
+
+	output, err := s.Pipeline.RunPipeline([]string{verdict.Text})
+	if err != nil {
+		verdict.Err = err
+	} else {
+		verdict.Labels = output.ClassificationOutputs[0]
+	}
+	s.verdicts <- verdict
+}
+
+// windowStart returns the offset of the window: Window bytes before the end of the text, moved forward to the
+// start of a word, or to the start of a rune if the window is inside a single word.
+func (s *ClassificationStream) windowStart() int {
+	start := max(len(s.text)-s.Window, 0)
+	if start == 0 || unicode.IsSpace(rune(s.text[start-1])) {
+		return start
+	}
+	for i := start; i < len(s.text); i++ {
+		if unicode.IsSpace(rune(s.text[i])) && i+1 < len(s.text) {
+			return i + 1
+		}
+	}
+	for start < len(s.text) && !utf8.RuneStart(s.text[start]) {
+		start++
+	}
+	return start
+}
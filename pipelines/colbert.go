@@ -0,0 +1,253 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/daulet/tokenizers"
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// ColBERTPipeline returns multi-vector embeddings for late-interaction retrieval as in ColBERT: one normalized
+// embedding per token of the input, without the padding and special tokens. Queries and documents are scored
+// with util.MaxSim on their token embeddings.
+type ColBERTPipeline struct {
+	basePipeline
+	OutputName string
+	Output     ort.InputOutputInfo
+}
+
+type ColBERTOutput struct {
+	Embeddings [][][]float32 // token embeddings of each input
+}
+
+func (t *ColBERTOutput) GetOutput() []any {
+	out := make([]any, len(t.Embeddings))
+	for i, embeddings := range t.Embeddings {
+		out[i] = any(embeddings)
+	}
+	return out
+}
+
+// PIPELINE OPTIONS
+
+// WithTokenOutputName sets the output of the model with the token embeddings, e.g. when the ColBERT projection
+// is exported as a separate output. If not passed, the first output of the model is used.
+func WithTokenOutputName(outputName string) PipelineOption[*ColBERTPipeline] {
+	return func(pipeline *ColBERTPipeline) {
+		pipeline.OutputName = outputName
+	}
+}
+
+// NewColBERTPipeline init a ColBERT multi-vector embedding pipeline.
+func NewColBERTPipeline(config PipelineConfig[*ColBERTPipeline], ortOptions *ort.SessionOptions) (*ColBERTPipeline, error) {
+	pipeline := &ColBERTPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.Remote = config.Remote
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	// onnx model init
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+
+	// init of inputs and outputs
+	inputs, outputs, err := loadInputOutputMeta(model)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = outputs
+
+	// filter outputs
+	if pipeline.OutputName != "" {
+		for _, output := range outputs {
+			if output.Name == pipeline.OutputName {
+				pipeline.Output = output
+				break
+			}
+		}
+		if pipeline.Output.Name == "" {
+			return nil, fmt.Errorf("output %s is not available, outputs are: %s", pipeline.OutputName, strings.Join(getNames(outputs), ", "))
+		}
+	} else {
+		pipeline.Output = outputs[0]
+	}
+
+	// tokenizer init
+	pipeline.TokenizerOptions, err = getTokenizerOptions(inputs)
+	if err != nil {
+		return nil, err
+	}
+	// the special tokens mask is needed to drop the special tokens in postprocessing
+	pipeline.TokenizerOptions = append(pipeline.TokenizerOptions, tokenizers.WithReturnSpecialTokensMask())
+
+	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	if tkErr != nil {
+		return nil, tkErr
+	}
+	pipeline.Tokenizer = tk
+
+	// creation of the session. Only one output, the token embeddings.
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := pipeline.createSession(config.EngineCache, model, inputs, []ort.InputOutputInfo{pipeline.Output}, ortOptions)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.OrtSession = session
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
+	pipeline.TokenizerTimings = &timings{}
+
+	// validate pipeline
+	err = pipeline.Validate()
+	if err != nil {
+		errDestroy := pipeline.Destroy()
+		return nil, errors.Join(err, errDestroy)
+	}
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the token embeddings output.
+func (p *ColBERTPipeline) GetMetadata() PipelineMetadata {
+	return PipelineMetadata{
+		OutputsInfo: []OutputInfo{
+			{
+				Name:       p.Output.Name,
+				Dimensions: p.Output.Dimensions,
+			},
+		},
+	}
+}
+
+// Destroy frees the ColBERT pipeline resources.
+func (p *ColBERTPipeline) Destroy() error {
+	return destroySession(p.Tokenizer, p.OrtSession)
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *ColBERTPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Tokenizer: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.TokenizerTimings.TotalNS),
+			p.TokenizerTimings.NumCalls,
+			time.Duration(float64(p.TokenizerTimings.TotalNS)/math.Max(1, float64(p.TokenizerTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *ColBERTPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.Output.Dimensions) != 3 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: ColBERT pipeline requires an output of token embeddings with 3 dimensions, output %s has %d", p.Output.Name, len(p.Output.Dimensions)))
+	}
+	for _, input := range p.InputsMeta {
+		dims := []int64(input.Dimensions)
+		if len(dims) > 3 {
+			validationErrors = append(validationErrors, fmt.Errorf("inputs and outputs currently can have at most 3 dimensions"))
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess tokenizes the input strings.
+func (p *ColBERTPipeline) Preprocess(batch *PipelineBatch, inputs []string) error {
+	start := time.Now()
+	tokenizeInputs(batch, p.Tokenizer, inputs, p.TokenizerOptions)
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return createInputTensors(batch, p.InputsMeta)
+}
+
+// Forward performs the forward inference of the ColBERT pipeline.
+func (p *ColBERTPipeline) Forward(batch *PipelineBatch) error {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	err := p.runOnBatch(batch, []ort.InputOutputInfo{p.Output})
+	if err != nil {
+		return err
+	}
+	p.PipelineMemory.recordForward(usageBefore, batch)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return nil
+}
+
+// Postprocess gathers the L2 normalized embeddings of the tokens of each input, skipping the padding and the
+// special tokens such as [CLS] and [SEP].
+func (p *ColBERTPipeline) Postprocess(batch *PipelineBatch) (*ColBERTOutput, error) {
+	data := batch.OutputTensors[0].GetData()
+	shape := batch.OutputTensors[0].GetShape()
+	sequenceLength, dimension := int(shape[1]), int(shape[2])
+
+	output := &ColBERTOutput{Embeddings: make([][][]float32, len(batch.Input))}
+	for i, input := range batch.Input {
+		var embeddings [][]float32
+		for j := 0; j < min(len(input.AttentionMask), sequenceLength); j++ {
+			if input.AttentionMask[j] == 0 || (j < len(input.SpecialTokensMask) && input.SpecialTokensMask[j] != 0) {
+				continue
+			}
+			offset := (i*sequenceLength + j) * dimension
+			embedding := make([]float32, dimension)
+			copy(embedding, data[offset:offset+dimension])
+			embeddings = append(embeddings, util.Normalize(embedding, 2))
+		}
+		output.Embeddings[i] = embeddings
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *ColBERTPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete ColBERT output type rather than the interface.
+func (p *ColBERTPipeline) RunPipeline(inputs []string) (*ColBERTOutput, error) {
+	var runErrors []error
+	batch := NewBatch()
+	defer func(*PipelineBatch) {
+		runErrors = append(runErrors, batch.Destroy())
+	}(batch)
+
+	runErrors = append(runErrors, p.Preprocess(batch, inputs))
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	runErrors = append(runErrors, p.Forward(batch))
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	result, postErr := p.Postprocess(batch)
+	runErrors = append(runErrors, postErr)
+	return result, errors.Join(runErrors...)
+}
@@ -0,0 +1,151 @@
+package pipelines
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// MentionClusterer groups the entity mentions of a document that refer to the same entity. It is a
+// lightweight alternative to coreference resolution: two mentions of the same entity type are
+// clustered if one mention's words are contained in the other's (e.g. "Mozart" and "Wolfgang Amadeus Mozart"),
+// or, when an embedder is set, if the embeddings of the mentions with their surrounding text are similar enough.
+type MentionClusterer struct {
+	Embedder      *FeatureExtractionPipeline // optional, if nil mentions are only clustered by string match
+	ContextWindow int                        // number of bytes of text on each side of a mention that are embedded with it
+	Threshold     float32                    // minimum cosine similarity for two mentions to be clustered by embedding
+}
+
+// MentionCluster is a group of mentions that refer to the same entity, in order of appearance.
+type MentionCluster struct {
+	Entity   string // entity type of the mentions
+	Mentions []Entity
+}
+
+// NewMentionClusterer creates a mention clusterer. The embedder can be nil to only cluster mentions by string match.
+func NewMentionClusterer(embedder *FeatureExtractionPipeline) *MentionClusterer {
+	return &MentionClusterer{
+		Embedder:      embedder,
+		ContextWindow: 50,
+		Threshold:     0.8,
+	}
+}
+
+// Cluster groups the entities found in text into clusters of mentions of the same entity. Clusters are
+// ordered by their first mention, and every entity belongs to exactly one cluster.
+func (c *MentionClusterer) Cluster(text string, entities []Entity) ([]MentionCluster, error) {
+	if len(entities) == 0 {
+		return nil, nil
+	}
+	sorted := make([]Entity, len(entities))
+	copy(sorted, entities)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	var embeddings [][]float32
+	if c.Embedder != nil {
+		mentions := make([]string, len(sorted))
+		for i, entity := range sorted {
+			mention, err := mentionContext(text, entity, c.ContextWindow)
+			if err != nil {
+				return nil, err
+			}
+			mentions[i] = mention
+		}
+		output, err := c.Embedder.RunPipeline(mentions)
+		if err != nil {
+			return nil, err
+		}
+		embeddings = output.Embeddings
+	}
+
+	// union-find over the mentions
+	parents := make([]int, len(sorted))
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+
+	words := make([][]string, len(sorted))
+	for i, entity := range sorted {
+		words[i] = mentionWords(entity.Word)
+	}
+	for i := range sorted {
+		for j := i + 1; j < len(sorted); j++ {
+			if entityType(sorted[i].Entity) != entityType(sorted[j].Entity) || find(i) == find(j) {
+				continue
+			}
+			match := containsWords(words[i], words[j]) || containsWords(words[j], words[i])
+			if !match && embeddings != nil {
+				similarity, err := util.CosineSimilarity(embeddings[i], embeddings[j])
+				if err != nil {
+					return nil, err
+				}
+				match = similarity >= c.Threshold
+			}
+			if match {
+				// the root is always the earliest mention so that clusters are ordered by first mention
+				rootI, rootJ := find(i), find(j)
+				parents[max(rootI, rootJ)] = min(rootI, rootJ)
+			}
+		}
+	}
+
+	var clusters []MentionCluster
+	clusterIndex := map[int]int{}
+	for i, entity := range sorted {
+		root := find(i)
+		index, ok := clusterIndex[root]
+		if !ok {
+			index = len(clusters)
+			clusterIndex[root] = index
+			clusters = append(clusters, MentionCluster{Entity: entityType(entity.Entity)})
+		}
+		clusters[index].Mentions = append(clusters[index].Mentions, entity)
+	}
+	return clusters, nil
+}
+
+// entityType strips the B-/I- prefix of a label.
+func entityType(label string) string {
+	if strings.HasPrefix(label, "B-") || strings.HasPrefix(label, "I-") {
+		return label[2:]
+	}
+	return label
+}
+
+// mentionWords splits a mention into lower case words, ignoring punctuation.
+func mentionWords(mention string) []string {
+	return strings.FieldsFunc(strings.ToLower(mention), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsWords returns true if all the words of b are in a.
+func containsWords(a []string, b []string) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, word := range b {
+		found := false
+		for _, candidate := range a {
+			if candidate == word {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
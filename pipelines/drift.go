@@ -0,0 +1,132 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// EmbeddingDriftReport describes how much the embeddings of a corpus change between two embedding models,
+// e.g. two versions of a model or a quantized model and its full precision original.
+type EmbeddingDriftReport struct {
+	Documents       int     // number of documents compared
+	SameDimension   bool    // whether the two models produce embeddings of the same dimension
+	MeanCosine      float32 // mean cosine similarity of each embedding to its counterpart, only set if SameDimension
+	MinCosine       float32 // lowest cosine similarity of an embedding to its counterpart, only set if SameDimension
+	K               int     // number of nearest neighbours compared for the overlap
+	NeighborOverlap float32 // mean fraction of the k nearest neighbours of a document that are the same with both models
+}
+
+// CompareEmbeddingModels embeds the corpus with both pipelines, in batches of batchSize, and reports the
+// drift between the two embeddings of the corpus.
+func CompareEmbeddingModels(reference *FeatureExtractionPipeline, candidate *FeatureExtractionPipeline, corpus []string, k int, batchSize int) (*EmbeddingDriftReport, error) {
+	if reference == nil || candidate == nil {
+		return nil, errors.New("two feature extraction pipelines are required to compare embeddings")
+	}
+	referenceEmbeddings, err := embedCorpus(reference, corpus, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	candidateEmbeddings, err := embedCorpus(candidate, corpus, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	return CompareEmbeddings(referenceEmbeddings, candidateEmbeddings, k)
+}
+
+// CompareEmbeddings reports the drift between two embeddings of the same documents, given in the same order.
+func CompareEmbeddings(reference [][]float32, candidate [][]float32, k int) (*EmbeddingDriftReport, error) {
+	if len(reference) != len(candidate) {
+		return nil, fmt.Errorf("cannot compare %d embeddings with %d embeddings", len(reference), len(candidate))
+	}
+	if len(reference) == 0 {
+		return nil, errors.New("no embeddings to compare")
+	}
+	if k <= 0 {
+		return nil, errors.New("the number of nearest neighbours must be greater than zero")
+	}
+	report := &EmbeddingDriftReport{
+		Documents:     len(reference),
+		SameDimension: len(reference[0]) == len(candidate[0]),
+		K:             min(k, len(reference)-1),
+	}
+
+	if report.SameDimension {
+		sum := 0.0
+		minCosine := float32(math.MaxFloat32)
+		for i := range reference {
+			cosine, err := util.CosineSimilarity(reference[i], candidate[i])
+			if err != nil {
+				return nil, err
+			}
+			sum += float64(cosine)
+			minCosine = min(minCosine, cosine)
+		}
+		report.MeanCosine = float32(sum / float64(len(reference)))
+		report.MinCosine = minCosine
+	}
+
+	if report.K > 0 {
+		referenceNeighbors, err := nearestNeighbors(reference, report.K)
+		if err != nil {
+			return nil, err
+		}
+		candidateNeighbors, err := nearestNeighbors(candidate, report.K)
+		if err != nil {
+			return nil, err
+		}
+		overlap := 0
+		for i := range referenceNeighbors {
+			for id := range referenceNeighbors[i] {
+				if candidateNeighbors[i][id] {
+					overlap++
+				}
+			}
+		}
+		report.NeighborOverlap = float32(overlap) / float32(report.K*len(reference))
+	}
+	return report, nil
+}
+
+func embedCorpus(pipeline *FeatureExtractionPipeline, corpus []string, batchSize int) ([][]float32, error) {
+	if batchSize <= 0 {
+		batchSize = 32
+	}
+	embeddings := make([][]float32, 0, len(corpus))
+	for batchStart := 0; batchStart < len(corpus); batchStart += batchSize {
+		output, err := pipeline.RunPipeline(corpus[batchStart:min(batchStart+batchSize, len(corpus))])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, output.Embeddings...)
+	}
+	return embeddings, nil
+}
+
+// nearestNeighbors returns, for each embedding, the set of ids of its k nearest other embeddings.
+func nearestNeighbors(embeddings [][]float32, k int) ([]map[string]bool, error) {
+	index := util.NewVectorIndex()
+	for i, embedding := range embeddings {
+		if err := index.Add(strconv.Itoa(i), embedding); err != nil {
+			return nil, err
+		}
+	}
+	neighbors := make([]map[string]bool, len(embeddings))
+	for i, embedding := range embeddings {
+		results, err := index.Search(embedding, k+1)
+		if err != nil {
+			return nil, err
+		}
+		neighbors[i] = map[string]bool{}
+		self := strconv.Itoa(i)
+		for _, result := range results {
+			if result.ID != self && len(neighbors[i]) < k {
+				neighbors[i][result.ID] = true
+			}
+		}
+	}
+	return neighbors, nil
+}
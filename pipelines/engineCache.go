@@ -0,0 +1,114 @@
+package pipelines
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// EngineCache reuses across sessions the engines that execution providers compile for the graphs of the pipelines,
+// and the graphs that onnxruntime optimizes for the other execution providers. Each graph has its own cache entry,
+// keyed by the hash of the graph, the execution provider and the shape profile. It is set by the session when an
+// engine cache is configured.
+type EngineCache struct {
+	Dir     string // folder of the cache entries, specific to the onnxruntime version
+	Profile string // shape profile of the compiled engines, e.g. the min, opt and max shapes of TensorRT
+	// ExecutionProvider returns the name of the execution provider of options, e.g. tensorrt or cpu, and whether it
+	// compiles engines, in which case the optimized graph cannot be saved by onnxruntime.
+	ExecutionProvider func(options *ort.SessionOptions) (name string, compiles bool)
+	// NewOptions returns new session options equivalent to options, whose engines are cached in entryDir.
+	NewOptions func(options *ort.SessionOptions, entryDir string) (*ort.SessionOptions, error)
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+// EngineCacheStats counts the graphs whose session was created from the cache, or had to be compiled or optimized.
+type EngineCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// optimizedGraphFile is the name of the graph optimized by onnxruntime in a cache entry.
+const optimizedGraphFile = "optimized.onnx"
+
+// Stats returns the number of cache hits and misses.
+func (c *EngineCache) Stats() EngineCacheStats {
+	return EngineCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// engineCacheKey is the name of the cache entry of a graph: the graph, the execution provider, the shape profile
+// and the architecture, since the compiled engines and optimized graphs are specific to all of them.
+func engineCacheKey(onnxBytes []byte, executionProvider string, profile string) string {
+	hash := sha256.New()
+	for _, part := range [][]byte{onnxBytes, []byte(executionProvider), []byte(profile), []byte(runtime.GOARCH)} {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+// createSession creates the session of a graph with its cache entry. The engines that the execution provider
+// compiled for the graph are reused, or, for the execution providers that do not compile engines, the graph
+// optimized by a previous session is loaded rather than the graph. Without a cache, the session is created as is.
+func (c *EngineCache) createSession(onnxBytes []byte, inputs, outputs []ort.InputOutputInfo, options *ort.SessionOptions) (session *ort.DynamicAdvancedSession, err error) {
+	if c == nil {
+		return createSession(onnxBytes, inputs, outputs, options)
+	}
+	executionProvider, compiles := c.ExecutionProvider(options)
+	entryDir := filepath.Join(c.Dir, executionProvider, engineCacheKey(onnxBytes, executionProvider, c.Profile))
+	entries, err := os.ReadDir(entryDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err = os.MkdirAll(entryDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	entryOptions, err := c.NewOptions(options, entryDir)
+	if err != nil {
+		return nil, err
+	}
+	// onnxruntime copies the options into the session
+	defer func(entryOptions *ort.SessionOptions) {
+		err = errors.Join(err, entryOptions.Destroy())
+	}(entryOptions)
+
+	if compiles {
+		if len(entries) > 0 {
+			c.hits.Add(1)
+		} else {
+			c.misses.Add(1)
+		}
+		return createSession(onnxBytes, inputs, outputs, entryOptions)
+	}
+
+	optimizedPath := filepath.Join(entryDir, optimizedGraphFile)
+	if optimized, readErr := os.ReadFile(optimizedPath); readErr == nil {
+		if err = entryOptions.SetGraphOptimizationLevel(ort.GraphOptimizationLevelDisableAll); err != nil {
+			return nil, err
+		}
+		c.hits.Add(1)
+		return createSession(optimized, inputs, outputs, entryOptions)
+	} else if !errors.Is(readErr, os.ErrNotExist) {
+		return nil, readErr
+	}
+	// the optimized graph is written next to its final path, so that an interrupted write is never loaded
+	pendingPath := optimizedPath + ".pending"
+	if err = entryOptions.SetOptimizedModelFilePath(pendingPath); err != nil {
+		return nil, err
+	}
+	c.misses.Add(1)
+	session, err = createSession(onnxBytes, inputs, outputs, entryOptions)
+	if err != nil {
+		return nil, errors.Join(err, os.Remove(pendingPath))
+	}
+	if renameErr := os.Rename(pendingPath, optimizedPath); renameErr != nil {
+		return nil, errors.Join(renameErr, session.Destroy())
+	}
+	return session, nil
+}
@@ -0,0 +1,132 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// KnowledgeBaseEntry is an entry of the knowledge base that entity mentions are linked to.
+type KnowledgeBaseEntry struct {
+	ID   string
+	Text string // name and description of the entry, which are embedded to build the index
+}
+
+// EntityLinker links the entities found by a token classification pipeline to the entries of a
+// knowledge base. Each mention is embedded together with the text around it and resolved against
+// an index of the embedded knowledge base entries.
+type EntityLinker struct {
+	Embedder      *FeatureExtractionPipeline
+	Index         *util.VectorIndex
+	ContextWindow int     // number of bytes of text on each side of a mention that are embedded with it
+	TopK          int     // maximum number of candidates returned for each mention
+	MinScore      float32 // candidates with a lower similarity than this are discarded
+}
+
+// EntityCandidate is a knowledge base entry that an entity mention may refer to.
+type EntityCandidate struct {
+	ID    string
+	Score float32
+}
+
+// LinkedEntity is an entity mention along with its knowledge base candidates, best first.
+type LinkedEntity struct {
+	Entity     Entity
+	Candidates []EntityCandidate
+}
+
+// NewEntityLinker embeds the knowledge base entries with the embedder and indexes them.
+// The embedder should produce sentence embeddings, e.g. a sentence-transformers model. With WithEmbeddingPrefixes,
+// the entries are embedded as documents and the mentions as queries.
+func NewEntityLinker(embedder *FeatureExtractionPipeline, entries []KnowledgeBaseEntry, batchSize int) (*EntityLinker, error) {
+	if embedder == nil {
+		return nil, errors.New("an embedder is required for entity linking")
+	}
+	if batchSize <= 0 {
+		batchSize = 32
+	}
+	index := util.NewVectorIndex()
+	for batchStart := 0; batchStart < len(entries); batchStart += batchSize {
+		batch := entries[batchStart:min(batchStart+batchSize, len(entries))]
+		texts := make([]string, len(batch))
+		for i, entry := range batch {
+			texts[i] = entry.Text
+		}
+		output, err := embedder.EmbedDocuments(texts)
+		if err != nil {
+			return nil, err
+		}
+		for i, entry := range batch {
+			if err = index.Add(entry.ID, output.Embeddings[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &EntityLinker{
+		Embedder:      embedder,
+		Index:         index,
+		ContextWindow: 100,
+		TopK:          3,
+	}, nil
+}
+
+// Link resolves the entities found in text against the knowledge base. The entities must have been
+// found in text, since their offsets are used to extract the context of each mention.
+func (l *EntityLinker) Link(text string, entities []Entity) ([]LinkedEntity, error) {
+	if len(entities) == 0 {
+		return nil, nil
+	}
+	mentions := make([]string, len(entities))
+	for i, entity := range entities {
+		mention, err := mentionContext(text, entity, l.ContextWindow)
+		if err != nil {
+			return nil, err
+		}
+		mentions[i] = mention
+	}
+	output, err := l.Embedder.EmbedQueries(mentions)
+	if err != nil {
+		return nil, err
+	}
+
+	linked := make([]LinkedEntity, len(entities))
+	for i, entity := range entities {
+		results, searchErr := l.Index.Search(output.Embeddings[i], l.TopK)
+		if searchErr != nil {
+			return nil, searchErr
+		}
+		linked[i].Entity = entity
+		for _, result := range results {
+			if result.Score >= l.MinScore {
+				linked[i].Candidates = append(linked[i].Candidates, EntityCandidate{ID: result.ID, Score: result.Score})
+			}
+		}
+	}
+	return linked, nil
+}
+
+// mentionContext returns the text of the entity mention with up to window bytes of text on each side.
+func mentionContext(text string, entity Entity, window int) (string, error) {
+	start, end := int(entity.Start), int(entity.End)
+	if start > end || end > len(text) {
+		return "", fmt.Errorf("entity %s at offsets %d-%d is outside of the text", util.Redact(entity.Word), start, end)
+	}
+	contextStart, contextEnd := contextBounds(text, start, end, window)
+	return text[contextStart:contextEnd], nil
+}
+
+// contextBounds returns the byte offsets of the span of text from start to end with up to window bytes of text on
+// each side, widened to character boundaries.
+func contextBounds(text string, start int, end int, window int) (int, int) {
+	contextStart := max(0, start-window)
+	for contextStart > 0 && !utf8.RuneStart(text[contextStart]) {
+		contextStart--
+	}
+	contextEnd := min(len(text), end+window)
+	for contextEnd < len(text) && !utf8.RuneStart(text[contextEnd]) {
+		contextEnd++
+	}
+	return contextStart, contextEnd
+}
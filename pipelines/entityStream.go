@@ -0,0 +1,158 @@
+package pipelines
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"unicode"
+)
+
+// EntityEventType is the kind of change of an entity of an EntityStream.
+type EntityEventType string
+
+const (
+	EntityAdded     EntityEventType = "ADD"
+	EntityUpdated   EntityEventType = "UPDATE"  // the span or the label of the entity changed
+	EntityRetracted EntityEventType = "RETRACT" // the entity is not found any more
+)
+
+// EntityEvent is a change of the entities of an EntityStream. The offsets of the entity are byte offsets in the
+// whole text of the stream.
+type EntityEvent struct {
+	Type   EntityEventType
+	ID     int    // identifies the entity across its events
+	Entity Entity // for retractions, the entity as last reported
+}
+
+type streamEntity struct {
+	id     int
+	entity Entity
+}
+
+// EntityStream runs a token classification pipeline incrementally on text appended over time, such as a live
+// transcript. Each append only re-runs the end of the text: the appended text along with the Context bytes
+// before it, extended to the start of a word and of any entity they cut. Entities before that window are final.
+// Entities in the window are compared with the ones previously found there, and the changes are reported as
+// events: entities can be added, updated when more text changes their span or label, e.g. "New" becoming
+// "New York", or retracted. It is safe for concurrent use.
+type EntityStream struct {
+	Pipeline *TokenClassificationPipeline
+	Context  int // bytes of text before the appended text that are re-run with it, 256 by default
+	text     string
+	entities []streamEntity // by start offset
+	nextID   int
+	mutex    sync.Mutex
+}
+
+// NewEntityStream creates an entity stream on a token classification pipeline.
+func NewEntityStream(pipeline *TokenClassificationPipeline) (*EntityStream, error) {
+	if pipeline == nil {
+		return nil, errors.New("a token classification pipeline is required for an entity stream")
+	}
+	return &EntityStream{Pipeline: pipeline, Context: 256}, nil
+}
+
+// Append appends text to the stream and returns the changes to its entities: retractions first, then additions
+// and updates in order of appearance.
+func (s *EntityStream) Append(text string) ([]EntityEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if text == "" {
+		return nil, nil
+	}
+	windowStart := s.windowStart()
+	fullText := s.text + text
+	output, err := s.Pipeline.RunPipeline([]string{fullText[windowStart:]})
+	if err != nil {
+		return nil, err
+	}
+	s.text = fullText
+
+	// entities starting before the window are final
+	final := 0
+	for final < len(s.entities) && int(s.entities[final].entity.Start) < windowStart {
+		final++
+	}
+	previous := s.entities[final:]
+	matched := make([]bool, len(previous))
+	var retractions, changes []EntityEvent
+	entities := append([]streamEntity{}, s.entities[:final]...)
+	found := output.Entities[0]
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Start < found[j].Start
+	})
+	for _, entity := range found {
+		entity.Start += uint(windowStart)
+		entity.End += uint(windowStart)
+		tracked := streamEntity{id: -1, entity: entity}
+		for i, old := range previous {
+			if !matched[i] && old.entity.Start < entity.End && entity.Start < old.entity.End {
+				matched[i] = true
+				tracked.id = old.id
+				if old.entity.Start != entity.Start || old.entity.End != entity.End || old.entity.Entity != entity.Entity {
+					changes = append(changes, EntityEvent{Type: EntityUpdated, ID: old.id, Entity: entity})
+				}
+				break
+			}
+		}
+		if tracked.id < 0 {
+			tracked.id = s.nextID
+			s.nextID++
+			changes = append(changes, EntityEvent{Type: EntityAdded, ID: tracked.id, Entity: entity})
+		}
+		entities = append(entities, tracked)
+	}
+	for i, old := range previous {
+		if !matched[i] {
+			retractions = append(retractions, EntityEvent{Type: EntityRetracted, ID: old.id, Entity: old.entity})
+		}
+	}
+	s.entities = entities
+	return append(retractions, changes...), nil
+}
+
+// windowStart returns the offset from which the text is re-run: Context bytes before its end, moved back to the
+// start of a word and of any entity overlapping it.
+func (s *EntityStream) windowStart() int {
+	start := max(len(s.text)-s.Context, 0)
+	for moved := true; moved; {
+		moved = false
+		for start > 0 && !unicode.IsSpace(rune(s.text[start-1])) {
+			start--
+		}
+		for _, tracked := range s.entities {
+			if int(tracked.entity.Start) < start && int(tracked.entity.End) > start {
+				start = int(tracked.entity.Start)
+				moved = true
+			}
+		}
+	}
+	return start
+}
+
+// Text returns the text appended so far.
+func (s *EntityStream) Text() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.text
+}
+
+// Entities returns the current entities of the stream, in order of appearance.
+func (s *EntityStream) Entities() []Entity {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entities := make([]Entity, len(s.entities))
+	for i, tracked := range s.entities {
+		entities[i] = tracked.entity
+	}
+	return entities
+}
+
+// Reset clears the text and the entities of the stream, e.g. at the start of a new transcript.
+func (s *EntityStream) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.text = ""
+	s.entities = nil
+	s.nextID = 0
+}
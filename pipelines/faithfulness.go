@@ -0,0 +1,124 @@
+package pipelines
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// FaithfulnessChecker scores whether the sentences of a generated summary are supported by the source text,
+// with the NLI model of a zero-shot classification pipeline: each sentence is used as the hypothesis and
+// the source as the premise. Long sources are split into chunks of ChunkWords words, and a sentence is
+// supported if any chunk entails it. Sentences with an entailment probability below Threshold are flagged
+// as likely hallucinations.
+type FaithfulnessChecker struct {
+	NLI        *ZeroShotClassificationPipeline
+	Threshold  float32
+	ChunkWords int
+}
+
+// SentenceFaithfulness is the faithfulness of a summary sentence.
+type SentenceFaithfulness struct {
+	Sentence      string
+	Entailment    float32 // highest probability that a chunk of the source entails the sentence, against contradiction
+	Hallucination bool    // whether the entailment is below the threshold
+}
+
+// FaithfulnessReport is the faithfulness of a summary to its source.
+type FaithfulnessReport struct {
+	Score     float32 // mean entailment of the sentences
+	Sentences []SentenceFaithfulness
+}
+
+// NewFaithfulnessChecker creates a checker with a threshold of 0.5 and chunks of 200 words.
+func NewFaithfulnessChecker(nli *ZeroShotClassificationPipeline) *FaithfulnessChecker {
+	return &FaithfulnessChecker{
+		NLI:        nli,
+		Threshold:  0.5,
+		ChunkWords: 200,
+	}
+}
+
+// Check scores the sentences of the summary against the source.
+func (c *FaithfulnessChecker) Check(source string, summary string) (*FaithfulnessReport, error) {
+	if c.NLI == nil {
+		return nil, errors.New("a zero-shot classification pipeline is required to check faithfulness")
+	}
+	if c.ChunkWords <= 0 {
+		return nil, errors.New("chunk size must be greater than zero")
+	}
+	sentences := splitSentences(summary)
+	if len(sentences) == 0 {
+		return nil, errors.New("the summary has no sentences")
+	}
+	words := strings.Fields(source)
+	var chunks []string
+	for chunkStart := 0; chunkStart < len(words); chunkStart += c.ChunkWords {
+		chunks = append(chunks, strings.Join(words[chunkStart:min(chunkStart+c.ChunkWords, len(words))], " "))
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("the source is empty")
+	}
+
+	report := &FaithfulnessReport{Sentences: make([]SentenceFaithfulness, len(sentences))}
+	for i, sentence := range sentences {
+		report.Sentences[i].Sentence = sentence
+	}
+	for _, chunk := range chunks {
+		entailments, err := c.NLI.entailmentProbabilities(chunk, sentences)
+		if err != nil {
+			return nil, err
+		}
+		for i, entailment := range entailments {
+			report.Sentences[i].Entailment = max(report.Sentences[i].Entailment, entailment)
+		}
+	}
+	var sum float32
+	for i := range report.Sentences {
+		report.Sentences[i].Hallucination = report.Sentences[i].Entailment < c.Threshold
+		sum += report.Sentences[i].Entailment
+	}
+	report.Score = sum / float32(len(sentences))
+	return report, nil
+}
+
+// entailmentProbabilities returns, for each hypothesis, the probability that the premise entails it against
+// the probability that the premise contradicts it, as in multi-label zero-shot classification.
+func (p *ZeroShotClassificationPipeline) entailmentProbabilities(premise string, hypotheses []string) ([]float32, error) {
+	probabilities := make([]float32, 0, len(hypotheses))
+	for _, hypothesis := range hypotheses {
+		logits, err := p.runPair(premise + p.separatorToken + hypothesis)
+		if err != nil {
+			return nil, err
+		}
+		entailmentID, contradictionID := p.entailmentID, 0
+		if entailmentID == -1 {
+			entailmentID = len(logits) - 1
+		} else if entailmentID == 0 {
+			contradictionID = len(logits) - 1
+		}
+		entailment := math.Exp(float64(logits[entailmentID]))
+		contradiction := math.Exp(float64(logits[contradictionID]))
+		probabilities = append(probabilities, float32(entailment/(entailment+contradiction)))
+	}
+	return probabilities, nil
+}
+
+var sentenceEndRegexp = regexp.MustCompile(`[.!?]+["')\]]*\s+`)
+
+// splitSentences splits a text into sentences at sentence-ending punctuation followed by whitespace.
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	for _, end := range sentenceEndRegexp.FindAllStringIndex(text, -1) {
+		if sentence := strings.TrimSpace(text[start:end[1]]); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = end[1]
+	}
+	if sentence := strings.TrimSpace(text[start:]); sentence != "" {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
@@ -8,6 +8,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/daulet/tokenizers"
 	ort "github.com/yalue/onnxruntime_go"
 
 	util "github.com/knights-analytics/hugot/utils"
@@ -17,13 +18,30 @@ import (
 // https://github.com/huggingface/transformers/blob/main/src/transformers/pipelines/feature_extraction.py
 type FeatureExtractionPipeline struct {
 	basePipeline
-	Normalization bool
-	OutputName    string
-	Output        ort.InputOutputInfo
+	Normalization  bool
+	OutputName     string
+	Output         ort.InputOutputInfo
+	Pooling        string // pooling of token embeddings: MEAN over the attention mask (default), CLS for the first token, or MAX
+	Float64        bool   // whether embeddings are pooled and normalized in float64, see WithFloat64Embeddings
+	QueryPrefix    string // prepended to the inputs of EmbedQueries, see WithEmbeddingPrefixes
+	DocumentPrefix string // prepended to the inputs of EmbedDocuments, see WithEmbeddingPrefixes
+	Dimensions     int    // dimensions the embeddings are truncated to, 0 to keep all, see WithTruncatedDimensions
+	window         *slidingWindow
 }
 
 type FeatureExtractionOutput struct {
-	Embeddings [][]float32
+	Embeddings   [][]float32
+	Embeddings64 [][]float64        // with WithFloat64Embeddings, the float64 embedding of each input
+	Chunks       [][]EmbeddingChunk // chunks of each input, with WithChunking
+}
+
+// EmbeddingChunk is the embedding of a chunk of an input split with WithChunking.
+type EmbeddingChunk struct {
+	Text      string
+	Start     int // byte offset of the chunk in the input
+	End       int
+	Tokens    int // tokens of the input in the chunk, the weight of the chunk in the embedding of the input
+	Embedding []float32
 }
 
 func (t *FeatureExtractionOutput) GetOutput() []any {
@@ -51,6 +69,58 @@ func WithOutputName(outputName string) PipelineOption[*FeatureExtractionPipeline
 	}
 }
 
+// WithPooling sets how token embeddings are pooled into a sentence embedding: MEAN averages the token embeddings
+// over the attention mask (the default, like sentence-transformers), CLS takes the embedding of the first token
+// (e.g. for BGE models), and MAX takes the element-wise maximum over the attention mask. Pooling has no effect for
+// models that already output sentence embeddings.
+func WithPooling(pooling string) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.Pooling = pooling
+	}
+}
+
+// WithChunking splits inputs longer than chunkLength tokens, special tokens included, into overlapping chunks rather
+// than truncating them, with stride tokens shared by consecutive chunks. Each chunk is embedded, and the embedding of
+// an input is the mean of the embeddings of its chunks weighted by their number of tokens. The chunks and their
+// embeddings are returned in the Chunks field of the output. A chunkLength of zero uses the maximum length of the
+// model, read from its tokenizer config.
+func WithChunking(chunkLength int, stride int) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.window = &slidingWindow{length: chunkLength, stride: stride}
+	}
+}
+
+// WithFloat64Embeddings pools the token embeddings, the embeddings of the chunks of WithChunking, and normalizes
+// the embeddings in float64 rather than float32, and returns the float64 embeddings in Embeddings64 along with
+// the float32 embeddings, e.g. for long inputs whose mean pooling accumulates float32 rounding errors.
+func WithFloat64Embeddings() PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.Float64 = true
+	}
+}
+
+// WithEmbeddingPrefixes sets the prefixes that EmbedQueries and EmbedDocuments prepend to their inputs, which many
+// retrieval models require for correct results: "query: " and "passage: " for E5 models, a query instruction such
+// as "Represent this sentence for searching relevant passages: " and no document prefix for BGE models, or task
+// instructions such as "Represent the Wikipedia question for retrieving supporting documents: " for Instructor
+// models. Run and RunPipeline embed their inputs as they are.
+func WithEmbeddingPrefixes(queryPrefix string, documentPrefix string) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.QueryPrefix = queryPrefix
+		pipeline.DocumentPrefix = documentPrefix
+	}
+}
+
+// WithTruncatedDimensions truncates the embeddings to their first dimensions and normalizes them again, e.g. to 256
+// of 1024 dimensions, for models trained with Matryoshka representation learning, such as nomic-embed-text-v1.5 or
+// mxbai-embed-large-v1, whose first dimensions are an embedding of their own. Truncated embeddings are always
+// normalized, since the norm of their first dimensions is not the norm of the embedding.
+func WithTruncatedDimensions(dimensions int) PipelineOption[*FeatureExtractionPipeline] {
+	return func(pipeline *FeatureExtractionPipeline) {
+		pipeline.Dimensions = dimensions
+	}
+}
+
 // NewFeatureExtractionPipeline init a feature extraction pipeline.
 func NewFeatureExtractionPipeline(config PipelineConfig[*FeatureExtractionPipeline], ortOptions *ort.SessionOptions) (*FeatureExtractionPipeline, error) {
 	pipeline := &FeatureExtractionPipeline{}
@@ -58,13 +128,19 @@ func NewFeatureExtractionPipeline(config PipelineConfig[*FeatureExtractionPipeli
 	pipeline.PipelineName = config.Name
 	pipeline.OrtOptions = ortOptions
 	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.Remote = config.Remote
 
 	for _, o := range config.Options {
 		o(pipeline)
 	}
 
+	if pipeline.Pooling == "" {
+		pipeline.Pooling = "MEAN"
+	}
+
 	// onnx model init
-	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename)
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
 	if err != nil {
 		return nil, err
 	}
@@ -98,14 +174,16 @@ func NewFeatureExtractionPipeline(config PipelineConfig[*FeatureExtractionPipeli
 		return nil, err
 	}
 
-	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	tk, tkErr := loadWindowTokenizer(pipeline.ModelPath, pipeline.window)
 	if tkErr != nil {
 		return nil, tkErr
 	}
 	pipeline.Tokenizer = tk
 
 	// creation of the session. Only one output (either token or sentence embedding).
-	session, err := createSession(model, inputs, []ort.InputOutputInfo{pipeline.Output}, ortOptions)
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := pipeline.createSession(config.EngineCache, model, inputs, []ort.InputOutputInfo{pipeline.Output}, ortOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -114,6 +192,7 @@ func NewFeatureExtractionPipeline(config PipelineConfig[*FeatureExtractionPipeli
 	// initialize timings
 
 	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
 	pipeline.TokenizerTimings = &timings{}
 
 	// validate pipeline
@@ -157,6 +236,7 @@ func (p *FeatureExtractionPipeline) GetStats() []string {
 			time.Duration(p.PipelineTimings.TotalNS),
 			p.PipelineTimings.NumCalls,
 			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
 	}
 }
 
@@ -164,6 +244,12 @@ func (p *FeatureExtractionPipeline) GetStats() []string {
 func (p *FeatureExtractionPipeline) Validate() error {
 	var validationErrors []error
 
+	switch p.Pooling {
+	case "MEAN", "CLS", "MAX":
+	default:
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: pooling %s is not supported", p.Pooling))
+	}
+
 	for _, input := range p.InputsMeta {
 		dims := []int64(input.Dimensions)
 		if len(dims) > 3 {
@@ -181,13 +267,44 @@ func (p *FeatureExtractionPipeline) Validate() error {
 				input.Name, input.Dimensions.String()))
 		}
 	}
+	if p.window != nil {
+		validationErrors = append(validationErrors, p.window.validate())
+	}
+	if outputDimensions := p.Output.Dimensions; p.Dimensions < 0 ||
+		(len(outputDimensions) > 0 && outputDimensions[len(outputDimensions)-1] > 0 && int64(p.Dimensions) > outputDimensions[len(outputDimensions)-1]) {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: cannot truncate embeddings of dimension %s to %d dimensions",
+			p.Output.Dimensions.String(), p.Dimensions))
+	}
 	return errors.Join(validationErrors...)
 }
 
-// Preprocess tokenizes the input strings.
+// Preprocess tokenizes the input strings, split into chunks with WithChunking.
 func (p *FeatureExtractionPipeline) Preprocess(batch *PipelineBatch, inputs []string) error {
+	return p.preprocess(batch, inputs, "")
+}
+
+// preprocess tokenizes the input strings with a prefix, which starts every chunk with WithChunking.
+func (p *FeatureExtractionPipeline) preprocess(batch *PipelineBatch, inputs []string, prefix string) error {
 	start := time.Now()
-	tokenizeInputs(batch, p.Tokenizer, inputs, p.TokenizerOptions)
+	if p.window != nil {
+		var prefixEncoding tokenizers.Encoding
+		if prefix != "" {
+			prefixEncoding = p.Tokenizer.EncodeWithOptions(prefix, false, tokenizers.WithReturnTokens())
+			if err := p.window.validatePrefix(prefixEncoding); err != nil {
+				return err
+			}
+		}
+		p.window.tokenize(batch, p.Tokenizer, inputs, prefixEncoding)
+	} else {
+		if prefix != "" {
+			prefixed := make([]string, len(inputs))
+			for i, input := range inputs {
+				prefixed[i] = prefix + input
+			}
+			inputs = prefixed
+		}
+		tokenizeInputs(batch, p.Tokenizer, inputs, p.TokenizerOptions)
+	}
 	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
 	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
 	err := createInputTensors(batch, p.InputsMeta)
@@ -197,10 +314,12 @@ func (p *FeatureExtractionPipeline) Preprocess(batch *PipelineBatch, inputs []st
 // Forward performs the forward inference of the feature extraction pipeline.
 func (p *FeatureExtractionPipeline) Forward(batch *PipelineBatch) error {
 	start := time.Now()
-	err := runSessionOnBatch(batch, p.OrtSession, []ort.InputOutputInfo{p.Output})
+	usageBefore := memoryUsageBefore()
+	err := p.runOnBatch(batch, []ort.InputOutputInfo{p.Output})
 	if err != nil {
 		return err
 	}
+	p.PipelineMemory.recordForward(usageBefore, batch)
 	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
 	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
 	return nil
@@ -215,6 +334,10 @@ func (p *FeatureExtractionPipeline) Postprocess(batch *PipelineBatch) (*FeatureE
 	// about how to do this in a lightweight manner.
 
 	batchEmbeddings := make([][]float32, len(batch.Input))
+	var embeddings64 [][]float64
+	if p.Float64 {
+		embeddings64 = make([][]float64, len(batch.Input))
+	}
 	outputDimensions := []int64(p.Output.Dimensions)
 	embeddingDimension := outputDimensions[len(outputDimensions)-1]
 	maxSequenceLength := batch.MaxSequenceLength
@@ -241,7 +364,18 @@ func (p *FeatureExtractionPipeline) Postprocess(batch *PipelineBatch) (*FeatureE
 				outputEmbedding = make([]float32, embeddingDimension)
 				if tokenEmbeddingsCounter == maxSequenceLength-1 {
 					// computed all embeddings for the tokens, calculate sentence embedding, add to batch outputs, and reset token embeddings and counter
-					batchEmbeddings[batchInputCounter] = meanPooling(tokenEmbeddings, batch.Input[batchInputCounter], maxSequenceLength, int(embeddingDimension))
+					switch p.Pooling {
+					case "CLS":
+						batchEmbeddings[batchInputCounter] = tokenEmbeddings[0]
+					case "MAX":
+						batchEmbeddings[batchInputCounter] = maxPooling(tokenEmbeddings, batch.Input[batchInputCounter], maxSequenceLength, int(embeddingDimension))
+					default:
+						if p.Float64 {
+							embeddings64[batchInputCounter] = meanPooling64(tokenEmbeddings, batch.Input[batchInputCounter], maxSequenceLength, int(embeddingDimension))
+						} else {
+							batchEmbeddings[batchInputCounter] = meanPooling(tokenEmbeddings, batch.Input[batchInputCounter], maxSequenceLength, int(embeddingDimension))
+						}
+					}
 					tokenEmbeddings = make([][]float32, maxSequenceLength)
 					tokenEmbeddingsCounter = 0
 					batchInputCounter++
@@ -257,14 +391,114 @@ func (p *FeatureExtractionPipeline) Postprocess(batch *PipelineBatch) (*FeatureE
 		}
 	}
 
-	// Normalize embeddings (if asked), like in https://huggingface.co/sentence-transformers/all-mpnet-base-v2
-	if p.Normalization {
+	normalize := p.Normalization
+	if p.Dimensions > 0 && p.Dimensions < int(embeddingDimension) {
+		for i := range batchEmbeddings {
+			if batchEmbeddings[i] != nil {
+				batchEmbeddings[i] = batchEmbeddings[i][:p.Dimensions]
+			}
+			if embeddings64 != nil && embeddings64[i] != nil {
+				embeddings64[i] = embeddings64[i][:p.Dimensions]
+			}
+		}
+		normalize = true
+	}
+
+	if p.Float64 {
+		for i, embedding := range embeddings64 {
+			if embedding == nil {
+				// embeddings that are not mean pooled are the float32 outputs of the model
+				embedding = util.ToFloat64(batchEmbeddings[i])
+			}
+			if normalize {
+				embedding = util.Normalize64(embedding)
+			}
+			embeddings64[i] = embedding
+			batchEmbeddings[i] = util.ToFloat32(embedding)
+		}
+	} else if normalize {
+		// Normalize embeddings (if asked), like in https://huggingface.co/sentence-transformers/all-mpnet-base-v2
 		for i, output := range batchEmbeddings {
 			batchEmbeddings[i] = util.Normalize(output, 2)
 		}
 	}
 
-	return &FeatureExtractionOutput{Embeddings: batchEmbeddings}, nil
+	if batch.windows != nil {
+		return poolChunkEmbeddings(batchEmbeddings, embeddings64, batch, normalize), nil
+	}
+	return &FeatureExtractionOutput{Embeddings: batchEmbeddings, Embeddings64: embeddings64}, nil
+}
+
+// poolChunkEmbeddings gathers the embeddings of the chunks of each input, and pools them into the embedding of the
+// input, weighted by their number of tokens. The float64 embeddings of the chunks, if not nil, are pooled in
+// float64.
+func poolChunkEmbeddings(embeddings [][]float32, embeddings64 [][]float64, batch *PipelineBatch, normalize bool) *FeatureExtractionOutput {
+	output := &FeatureExtractionOutput{}
+	if len(batch.windows) == 0 {
+		return output
+	}
+	numInputs := batch.windows[len(batch.windows)-1] + 1
+	output.Embeddings = make([][]float32, numInputs)
+	output.Chunks = make([][]EmbeddingChunk, numInputs)
+	for i, embedding := range embeddings {
+		window := batch.Input[i]
+		chunk := EmbeddingChunk{Text: window.Raw, Embedding: embedding}
+		for j, special := range window.SpecialTokensMask {
+			if special != 0 {
+				continue
+			}
+			if chunk.Tokens == 0 {
+				chunk.Start = int(window.Offsets[j][0])
+			}
+			chunk.End = int(window.Offsets[j][1])
+			chunk.Tokens++
+		}
+		output.Chunks[batch.windows[i]] = append(output.Chunks[batch.windows[i]], chunk)
+	}
+	if embeddings64 != nil {
+		output.Embeddings64 = make([][]float64, numInputs)
+		chunkIndex := 0
+		for i, chunks := range output.Chunks {
+			vector := make([]float64, len(chunks[0].Embedding))
+			totalWeight := 0.0
+			for _, chunk := range chunks {
+				weight := float64(max(chunk.Tokens, 1))
+				for k, value := range embeddings64[chunkIndex] {
+					vector[k] += weight * value
+				}
+				totalWeight += weight
+				chunkIndex++
+			}
+			for k := range vector {
+				vector[k] /= totalWeight
+			}
+			if normalize {
+				vector = util.Normalize64(vector)
+			}
+			output.Embeddings64[i] = vector
+			output.Embeddings[i] = util.ToFloat32(vector)
+		}
+		return output
+	}
+	for i, chunks := range output.Chunks {
+		vector := make([]float32, len(chunks[0].Embedding))
+		totalWeight := float32(0)
+		for _, chunk := range chunks {
+			weight := float32(max(chunk.Tokens, 1))
+			for k, value := range chunk.Embedding {
+				vector[k] += weight * value
+			}
+			totalWeight += weight
+		}
+		for k := range vector {
+			vector[k] /= totalWeight
+		}
+		if normalize {
+			vector = util.Normalize(vector, 2)
+		}
+		output.Embeddings[i] = vector
+	}
+	return output
 }
 
 func meanPooling(tokens [][]float32, input tokenizedInput, maxSequence int, dimensions int) []float32 {
@@ -286,6 +520,40 @@ func meanPooling(tokens [][]float32, input tokenizedInput, maxSequence int, dime
 	return vector
 }
 
+// meanPooling64 is like meanPooling, summing and averaging in float64.
+func meanPooling64(tokens [][]float32, input tokenizedInput, maxSequence int, dimensions int) []float64 {
+	length := len(input.AttentionMask)
+	vector := make([]float64, dimensions)
+	for j := 0; j < maxSequence; j++ {
+		if j+1 <= length && input.AttentionMask[j] != 0 {
+			for k, vectorValue := range tokens[j] {
+				vector[k] += float64(vectorValue)
+			}
+		}
+	}
+	numAttentionTokens := float64(input.MaxAttentionIndex + 1)
+	for v := range vector {
+		vector[v] /= numAttentionTokens
+	}
+	return vector
+}
+
+func maxPooling(tokens [][]float32, input tokenizedInput, maxSequence int, dimensions int) []float32 {
+	length := len(input.AttentionMask)
+	vector := make([]float32, dimensions)
+	for k := range vector {
+		vector[k] = float32(math.Inf(-1))
+	}
+	for j := 0; j < maxSequence; j++ {
+		if j+1 <= length && input.AttentionMask[j] != 0 {
+			for k, vectorValue := range tokens[j] {
+				vector[k] = max(vector[k], vectorValue)
+			}
+		}
+	}
+	return vector
+}
+
 // Run the pipeline on a batch of strings.
 func (p *FeatureExtractionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
 	return p.RunPipeline(inputs)
@@ -293,13 +561,29 @@ func (p *FeatureExtractionPipeline) Run(inputs []string) (PipelineBatchOutput, e
 
 // RunPipeline is like Run, but returns the concrete feature extraction output type rather than the interface.
 func (p *FeatureExtractionPipeline) RunPipeline(inputs []string) (*FeatureExtractionOutput, error) {
+	return p.runWithPrefix(inputs, "")
+}
+
+// EmbedQueries embeds search queries, prefixed with the QueryPrefix of the pipeline.
+func (p *FeatureExtractionPipeline) EmbedQueries(queries []string) (*FeatureExtractionOutput, error) {
+	return p.runWithPrefix(queries, p.QueryPrefix)
+}
+
+// EmbedDocuments embeds the documents searched by queries, prefixed with the DocumentPrefix of the pipeline. With
+// WithChunking, every chunk of a document starts with the prefix, and the offsets of the chunks are those of the
+// document without it.
+func (p *FeatureExtractionPipeline) EmbedDocuments(documents []string) (*FeatureExtractionOutput, error) {
+	return p.runWithPrefix(documents, p.DocumentPrefix)
+}
+
+func (p *FeatureExtractionPipeline) runWithPrefix(inputs []string, prefix string) (*FeatureExtractionOutput, error) {
 	var runErrors []error
 	batch := NewBatch()
 	defer func(*PipelineBatch) {
 		runErrors = append(runErrors, batch.Destroy())
 	}(batch)
 
-	runErrors = append(runErrors, p.Preprocess(batch, inputs))
+	runErrors = append(runErrors, p.preprocess(batch, inputs, prefix))
 	if e := errors.Join(runErrors...); e != nil {
 		return nil, e
 	}
@@ -0,0 +1,302 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// FillMaskPipeline predicts the token hidden behind the mask token of masked language models, such as
+// bert-base-uncased ([MASK]) or roberta-base (<mask>). Each input must contain exactly one mask token.
+type FillMaskPipeline struct {
+	basePipeline
+	MaskToken   string
+	MaskTokenID uint32
+	TopK        int
+	Vocabulary  []string // token of each token id, see util.LoadVocabulary
+}
+
+// FillMaskPrediction is a candidate token for the mask of an input.
+type FillMaskPrediction struct {
+	TokenID  uint32
+	Token    string  // token as stored in the vocabulary, e.g. ##ly
+	TokenStr string  // decoded token, e.g. ly
+	Score    float32 // probability of the token, softmax over the vocabulary
+	Sequence string  // input with the mask replaced by the decoded token
+}
+
+type FillMaskOutput struct {
+	Predictions [][]FillMaskPrediction // top-k predictions of each input, sorted by decreasing score
+}
+
+func (t *FillMaskOutput) GetOutput() []any {
+	out := make([]any, len(t.Predictions))
+	for i, predictions := range t.Predictions {
+		out[i] = any(predictions)
+	}
+	return out
+}
+
+// options
+
+// WithTopK sets the number of candidate tokens returned for each input, 5 by default.
+func WithTopK(topK int) PipelineOption[*FillMaskPipeline] {
+	return func(pipeline *FillMaskPipeline) {
+		pipeline.TopK = topK
+	}
+}
+
+// NewFillMaskPipeline initializes a new fill-mask pipeline. The mask token is read from the special_tokens_map.json
+// of the model, and the vocabulary from its tokenizer.json.
+func NewFillMaskPipeline(config PipelineConfig[*FillMaskPipeline], ortOptions *ort.SessionOptions) (*FillMaskPipeline, error) {
+	pipeline := &FillMaskPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.Remote = config.Remote
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	if pipeline.TopK == 0 {
+		pipeline.TopK = 5
+	}
+
+	// read the mask token and the vocabulary
+	maskToken, err := readSpecialToken(pipeline.ModelPath, "mask_token")
+	if err != nil {
+		return nil, err
+	}
+	pipeline.MaskToken = maskToken
+	tokenizerBytes, err := util.ReadFileBytes(util.PathJoinSafe(pipeline.ModelPath, "tokenizer.json"))
+	if err != nil {
+		return nil, err
+	}
+	pipeline.Vocabulary, err = util.LoadVocabulary(tokenizerBytes)
+	if err != nil {
+		return nil, err
+	}
+	maskTokenFound := false
+	for id, token := range pipeline.Vocabulary {
+		if token == maskToken {
+			pipeline.MaskTokenID = uint32(id)
+			maskTokenFound = true
+		}
+	}
+	if !maskTokenFound {
+		return nil, fmt.Errorf("mask token %s is not in the vocabulary", maskToken)
+	}
+
+	// onnx model init
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+
+	// init of inputs and outputs
+	inputs, outputs, err := loadInputOutputMeta(model)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = outputs
+
+	// tokenizer init
+	pipeline.TokenizerOptions, err = getTokenizerOptions(inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	if tkErr != nil {
+		return nil, tkErr
+	}
+	pipeline.Tokenizer = tk
+
+	// creation of the session
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := pipeline.createSession(config.EngineCache, model, inputs, pipeline.OutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	pipeline.OrtSession = session
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
+	pipeline.TokenizerTimings = &timings{}
+
+	// validate
+	err = pipeline.Validate()
+	if err != nil {
+		errDestroy := pipeline.Destroy()
+		return nil, errors.Join(err, errDestroy)
+	}
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the logits output.
+func (p *FillMaskPipeline) GetMetadata() PipelineMetadata {
+	return PipelineMetadata{
+		OutputsInfo: []OutputInfo{
+			{
+				Name:       p.OutputsMeta[0].Name,
+				Dimensions: p.OutputsMeta[0].Dimensions,
+			},
+		},
+	}
+}
+
+// Destroy frees the fill-mask pipeline resources.
+func (p *FillMaskPipeline) Destroy() error {
+	return destroySession(p.Tokenizer, p.OrtSession)
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *FillMaskPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Tokenizer: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.TokenizerTimings.TotalNS),
+			p.TokenizerTimings.NumCalls,
+			time.Duration(float64(p.TokenizerTimings.TotalNS)/math.Max(1, float64(p.TokenizerTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *FillMaskPipeline) Validate() error {
+	var validationErrors []error
+
+	outDims := p.OutputsMeta[0].Dimensions
+	if len(outDims) != 3 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: fill-mask must have 3 dimensional output"))
+	} else if outDims[2] == -1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: fill-mask output vocabulary dimension cannot be dynamic"))
+	}
+	if p.TopK <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: top k must be greater than zero"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess tokenizes the input strings.
+func (p *FillMaskPipeline) Preprocess(batch *PipelineBatch, inputs []string) error {
+	start := time.Now()
+	tokenizeInputs(batch, p.Tokenizer, inputs, p.TokenizerOptions)
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	err := createInputTensors(batch, p.InputsMeta)
+	return err
+}
+
+// Forward performs the forward inference of the fill-mask pipeline.
+func (p *FillMaskPipeline) Forward(batch *PipelineBatch) error {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	err := p.runOnBatch(batch, p.OutputsMeta)
+	if err != nil {
+		return err
+	}
+	p.PipelineMemory.recordForward(usageBefore, batch)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return nil
+}
+
+// Postprocess applies a softmax over the vocabulary to the logits at the mask position of each input and returns
+// the top-k tokens.
+func (p *FillMaskPipeline) Postprocess(batch *PipelineBatch) (*FillMaskOutput, error) {
+	logits := batch.OutputTensors[0].GetData()
+	vocabularySize := int(p.OutputsMeta[0].Dimensions[2])
+	output := &FillMaskOutput{Predictions: make([][]FillMaskPrediction, len(batch.Input))}
+
+	for i, input := range batch.Input {
+		maskPosition := -1
+		for j, id := range input.TokenIDs {
+			if id != p.MaskTokenID || j >= batch.MaxSequenceLength {
+				continue
+			}
+			if maskPosition >= 0 {
+				return nil, fmt.Errorf("input %d has more than one mask token %s", i, p.MaskToken)
+			}
+			maskPosition = j
+		}
+		if maskPosition < 0 {
+			return nil, fmt.Errorf("input %d has no mask token %s", i, p.MaskToken)
+		}
+
+		start := (i*batch.MaxSequenceLength + maskPosition) * vocabularySize
+		scores := util.SoftMax(logits[start : start+vocabularySize])
+		ids := make([]int, len(scores))
+		for id := range ids {
+			ids[id] = id
+		}
+		sort.SliceStable(ids, func(a, b int) bool {
+			return scores[ids[a]] > scores[ids[b]]
+		})
+
+		predictions := make([]FillMaskPrediction, 0, p.TopK)
+		for _, id := range ids[:min(p.TopK, len(ids))] {
+			prediction := FillMaskPrediction{
+				TokenID:  uint32(id),
+				TokenStr: strings.TrimSpace(p.Tokenizer.Decode([]uint32{uint32(id)}, false)),
+				Score:    scores[id],
+			}
+			if id < len(p.Vocabulary) {
+				prediction.Token = p.Vocabulary[id]
+			}
+			prediction.Sequence = strings.Replace(input.Raw, p.MaskToken, prediction.TokenStr, 1)
+			predictions = append(predictions, prediction)
+		}
+		output.Predictions[i] = predictions
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *FillMaskPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete fill-mask output type rather than the interface.
+func (p *FillMaskPipeline) RunPipeline(inputs []string) (*FillMaskOutput, error) {
+	var runErrors []error
+	batch := NewBatch()
+	defer func(*PipelineBatch) {
+		runErrors = append(runErrors, batch.Destroy())
+	}(batch)
+
+	runErrors = append(runErrors, p.Preprocess(batch, inputs))
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	runErrors = append(runErrors, p.Forward(batch))
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	result, postErr := p.Postprocess(batch)
+	runErrors = append(runErrors, postErr)
+	return result, errors.Join(runErrors...)
+}
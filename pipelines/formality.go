@@ -0,0 +1,199 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// UndeterminedStyle is the style of inputs whose most likely style is below its threshold.
+const UndeterminedStyle = "undetermined"
+
+// FormalityPipeline is a preset for formality and style classifiers, such as s-nlp/roberta-base-formality-ranker.
+// It remaps the labels of the model to stable style names with LabelMapping, so that models with different
+// label conventions (e.g. LABEL_0 and LABEL_1) can be swapped without changing the downstream code, and several
+// labels can be merged into one style. The probabilities are calibrated with temperature scaling, see Calibrate,
+// and an input gets the most likely style only if its probability reaches the threshold of the style. The fitted
+// temperature can be saved with the model, see SaveCalibration.
+type FormalityPipeline struct {
+	*TextClassificationPipeline
+	LabelMapping map[string]string  // style of each label of the model
+	Thresholds   map[string]float32 // minimum probability of each style, 0 if not set
+	Temperature  float32            // temperature applied to the logits before the softmax
+}
+
+// FormalityResult is the style of an input.
+type FormalityResult struct {
+	Style  string             // most likely style, or UndeterminedStyle
+	Score  float32            // calibrated probability of the most likely style
+	Scores map[string]float32 // calibrated probability of each style
+}
+
+type FormalityOutput struct {
+	Results []FormalityResult
+}
+
+func (t *FormalityOutput) GetOutput() []any {
+	out := make([]any, len(t.Results))
+	for i, result := range t.Results {
+		out[i] = any(result)
+	}
+	return out
+}
+
+// NewFormalityPipeline creates a formality preset from a text classification pipeline with at least two labels.
+// labelMapping maps the labels of the model to styles, labels that are not mapped keep their name. A copy of the
+// classifier is configured to return the raw scores of all its labels, which the preset then calibrates with the
+// temperature saved with the model, if any.
+func NewFormalityPipeline(classifier *TextClassificationPipeline, labelMapping map[string]string, thresholds map[string]float32) (*FormalityPipeline, error) {
+	if classifier == nil {
+		return nil, errors.New("a text classification pipeline is required for formality classification")
+	}
+	if len(classifier.IDLabelMap) < 2 {
+		return nil, errors.New("formality classification requires a model with at least two labels")
+	}
+	mapping := map[string]string{}
+	for _, label := range classifier.IDLabelMap {
+		mapping[label] = label
+	}
+	for label, style := range labelMapping {
+		if _, ok := mapping[label]; !ok {
+			return nil, fmt.Errorf("label %s of the label mapping is not a label of the model", label)
+		}
+		mapping[label] = style
+	}
+	for style := range thresholds {
+		found := false
+		for _, mapped := range mapping {
+			found = found || mapped == style
+		}
+		if !found {
+			return nil, fmt.Errorf("style %s of the thresholds is not a style of the label mapping", style)
+		}
+	}
+	if thresholds == nil {
+		thresholds = map[string]float32{}
+	}
+	temperature := float32(1)
+	calibration, err := LoadCalibration(classifier.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	if calibration != nil && calibration.Temperature > 0 {
+		temperature = calibration.Temperature
+	}
+	preset, err := presetClassifier(classifier, "NONE")
+	if err != nil {
+		return nil, err
+	}
+	return &FormalityPipeline{
+		TextClassificationPipeline: preset,
+		LabelMapping:               mapping,
+		Thresholds:                 thresholds,
+		Temperature:                temperature,
+	}, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *FormalityPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete formality output type rather than the interface.
+func (p *FormalityPipeline) RunPipeline(inputs []string) (*FormalityOutput, error) {
+	if p.Temperature <= 0 {
+		return nil, errors.New("temperature must be greater than zero")
+	}
+	output, err := p.TextClassificationPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.results(output.ClassificationOutputs), nil
+}
+
+// results returns the most probable style of each input given the logits of the classifier.
+func (p *FormalityPipeline) results(outputs [][]ClassificationOutput) *FormalityOutput {
+	result := &FormalityOutput{Results: make([]FormalityResult, len(outputs))}
+	for i, classes := range outputs {
+		scores := p.styleProbabilities(classes, p.Temperature)
+		best := FormalityResult{Style: UndeterminedStyle, Scores: scores}
+		for style, score := range scores {
+			if score > best.Score || (score == best.Score && style < best.Style) {
+				best.Style, best.Score = style, score
+			}
+		}
+		if best.Score < p.Thresholds[best.Style] {
+			best.Style = UndeterminedStyle
+		}
+		result.Results[i] = best
+	}
+	return result
+}
+
+// Calibrate fits the temperature to a labeled sample, whose labels are styles, by minimizing the negative
+// log-likelihood of the labels, so that the scores can be compared to the thresholds as probabilities.
+func (p *FormalityPipeline) Calibrate(samples []LabeledInput, batchSize int) error {
+	if len(samples) == 0 {
+		return errors.New("no samples to calibrate on")
+	}
+	texts := make([]string, len(samples))
+	for i, sample := range samples {
+		texts[i] = sample.Text
+	}
+	outputs, err := classifyInBatches(p.TextClassificationPipeline, texts, batchSize)
+	if err != nil {
+		return err
+	}
+	temperature, err := p.fitTemperature(samples, outputs)
+	if err != nil {
+		return err
+	}
+	p.Temperature = temperature
+	return nil
+}
+
+// fitTemperature returns the temperature that minimizes the negative log-likelihood of the labels of the samples
+// given the logits of the classifier for their texts.
+func (p *FormalityPipeline) fitTemperature(samples []LabeledInput, outputs [][]ClassificationOutput) (float32, error) {
+	bestTemperature, bestLoss := float32(1), math.Inf(1)
+	// log-spaced grid between 0.05 and 20
+	for step := 0; step <= 60; step++ {
+		temperature := float32(0.05 * math.Pow(400, float64(step)/60))
+		loss := 0.0
+		for i, classes := range outputs {
+			probability, ok := p.styleProbabilities(classes, temperature)[samples[i].Label]
+			if !ok {
+				return 0, fmt.Errorf("label %s of sample %d is not a style of the label mapping", samples[i].Label, i)
+			}
+			loss -= math.Log(math.Max(float64(probability), 1e-12))
+		}
+		if loss < bestLoss {
+			bestTemperature, bestLoss = temperature, loss
+		}
+	}
+	return bestTemperature, nil
+}
+
+// SaveCalibration saves the temperature with the model, in its CalibrationFile, so that it is loaded by the
+// formality presets created from the model.
+func (p *FormalityPipeline) SaveCalibration() error {
+	return updateCalibration(p.ModelPath, func(calibration *Calibration) {
+		calibration.Temperature = p.Temperature
+	})
+}
+
+// styleProbabilities applies the temperature softmax to the logits of the labels and sums the probabilities
+// of the labels mapped to the same style.
+func (p *FormalityPipeline) styleProbabilities(classes []ClassificationOutput, temperature float32) map[string]float32 {
+	logits := make([]float32, len(classes))
+	for j, class := range classes {
+		logits[j] = class.Score / temperature
+	}
+	scores := map[string]float32{}
+	for j, probability := range util.SoftMax(logits) {
+		scores[p.LabelMapping[classes[j].Label]] += probability
+	}
+	return scores
+}
@@ -0,0 +1,187 @@
+package pipelines
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// GenerationOption changes the decoding of a single call of a generation pipeline, e.g. of RunWithOptions,
+// instead of the settings of the pipeline.
+type GenerationOption func(settings *generationSettings)
+
+// generationSettings are the decoding settings of a call of a generation pipeline.
+type generationSettings struct {
+	maxNewTokens      int
+	temperature       float32 // 0 for greedy decoding
+	topK              int
+	topP              float32
+	repetitionPenalty float32 // 0 or 1 for no penalty
+	seed              *int64
+	logitProcessors   []LogitProcessor
+	numBeams          int     // 0 or 1 for no beam search
+	lengthPenalty     float32 // exponent of the length normalizing the scores of beam search hypotheses
+	earlyStopping     bool
+	random            *rand.Rand
+	randomMutex       *sync.Mutex
+}
+
+// GenerateWithMaxTokens sets the maximum number of tokens generated for each input.
+func GenerateWithMaxTokens(maxNewTokens int) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.maxNewTokens = maxNewTokens
+	}
+}
+
+// GenerateWithTemperature samples the generated tokens from the distribution of the model scaled by the
+// temperature, or decodes greedily with a temperature of 0.
+func GenerateWithTemperature(temperature float32) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.temperature = temperature
+	}
+}
+
+// GenerateWithTopK samples among the k most likely tokens only, 0 for no limit.
+func GenerateWithTopK(topK int) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.topK = topK
+	}
+}
+
+// GenerateWithTopP samples among the most likely tokens whose cumulative probability reaches p, 0 for no limit.
+func GenerateWithTopP(topP float32) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.topP = topP
+	}
+}
+
+// GenerateWithRepetitionPenalty penalizes the tokens of the prompt and of the generated text (see
+// RepetitionPenaltyProcessor), with greedy decoding as well as sampling.
+func GenerateWithRepetitionPenalty(penalty float32) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.repetitionPenalty = penalty
+	}
+}
+
+// GenerateWithSeed seeds the sampling of the call, so that the same call with the same seed generates the same
+// texts.
+func GenerateWithSeed(seed int64) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.seed = &seed
+	}
+}
+
+// GenerateWithLogitProcessors adds logit processors to the call, applied after the logit processors of the
+// pipeline and before the temperature, top k and top p.
+func GenerateWithLogitProcessors(processors ...LogitProcessor) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.logitProcessors = append(settings.logitProcessors, processors...)
+	}
+}
+
+// GenerateWithBeamSearch decodes with beam search, keeping the numBeams most likely sequences at each step instead
+// of only the most likely one, which usually improves summaries and translations at the cost of running the
+// decoder on numBeams sequences. The length penalty and early stopping are set with GenerateWithLengthPenalty and
+// GenerateWithEarlyStopping. Beam search is deterministic and cannot be combined with sampling.
+func GenerateWithBeamSearch(numBeams int) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.numBeams = numBeams
+	}
+}
+
+// GenerateWithLengthPenalty sets the exponent of the length by which the log probabilities of the hypotheses of
+// beam search are divided, 1 by default. Above 0 longer sequences are favoured, and below 0 shorter ones.
+func GenerateWithLengthPenalty(lengthPenalty float32) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.lengthPenalty = lengthPenalty
+	}
+}
+
+// GenerateWithEarlyStopping stops beam search as soon as numBeams hypotheses are finished, rather than when the
+// remaining beams are unlikely to lead to better ones.
+func GenerateWithEarlyStopping(earlyStopping bool) GenerationOption {
+	return func(settings *generationSettings) {
+		settings.earlyStopping = earlyStopping
+	}
+}
+
+// apply applies the options of a call and checks the resulting settings. Calls with a seed get their own random
+// source, and the others share the source of the pipeline.
+func (s *generationSettings) apply(options []GenerationOption) error {
+	for _, option := range options {
+		option(s)
+	}
+	if s.maxNewTokens <= 0 {
+		return errors.New("the maximum number of new tokens must be greater than zero")
+	}
+	if s.temperature < 0 || s.topK < 0 || s.topP < 0 || s.topP > 1 || s.repetitionPenalty < 0 {
+		return errors.New("temperature, top k and repetition penalty must not be negative, and top p must be between 0 and 1")
+	}
+	if s.numBeams < 0 {
+		return errors.New("the number of beams must not be negative")
+	}
+	if s.numBeams > 1 && s.temperature > 0 {
+		return errors.New("beam search cannot be combined with sampling, set the temperature to 0")
+	}
+	if s.seed != nil {
+		s.random = rand.New(rand.NewSource(*s.seed))
+		s.randomMutex = &sync.Mutex{}
+	}
+	if s.random == nil {
+		s.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+		s.randomMutex = &sync.Mutex{}
+	}
+	return nil
+}
+
+// processors returns the logit processors of a call, in the order of transformers: the repetition penalty, the
+// processors of the pipeline and of the call, and then the temperature, top k and top p of sampling.
+func (s *generationSettings) processors(pipelineProcessors []LogitProcessor) []LogitProcessor {
+	var processors []LogitProcessor
+	if s.repetitionPenalty != 0 && s.repetitionPenalty != 1 {
+		processors = append(processors, RepetitionPenaltyProcessor(s.repetitionPenalty))
+	}
+	processors = append(processors, pipelineProcessors...)
+	processors = append(processors, s.logitProcessors...)
+	if s.temperature > 0 {
+		if s.temperature != 1 {
+			processors = append(processors, TemperatureProcessor(s.temperature))
+		}
+		if s.topK > 0 {
+			processors = append(processors, TopKProcessor(s.topK))
+		}
+		if s.topP > 0 && s.topP < 1 {
+			processors = append(processors, TopPProcessor(s.topP))
+		}
+	}
+	return processors
+}
+
+// pickToken picks the next token from the processed logits, the most likely one with greedy decoding, or one
+// sampled from their softmax.
+func (s *generationSettings) pickToken(logits []float32) (int, error) {
+	if s.temperature == 0 {
+		index, _, err := util.ArgMax(logits)
+		return index, err
+	}
+	probabilities := util.SoftMax(logits)
+	draw := s.draw()
+	last := -1
+	for id, probability := range probabilities {
+		if probability == 0 {
+			continue
+		}
+		draw -= probability
+		last = id
+		if draw <= 0 {
+			return id, nil
+		}
+	}
+	if last < 0 {
+		return 0, errors.New("all the tokens have been masked")
+	}
+	return last, nil
+}
@@ -0,0 +1,155 @@
+package pipelines
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// OffsetUnit is the unit of the offsets of highlighted spans.
+type OffsetUnit string
+
+const (
+	ByteOffsets  OffsetUnit = "BYTES" // bytes of the UTF-8 text, as in the outputs of hugot pipelines
+	RuneOffsets  OffsetUnit = "RUNES" // Unicode code points, as in the outputs of Python libraries
+	UTF16Offsets OffsetUnit = "UTF16" // UTF-16 code units, as in JavaScript strings
+)
+
+// HighlightSpan is a span of a text to highlight, e.g. the answer of an extractive question answering model or an
+// entity found by a token classification pipeline.
+type HighlightSpan struct {
+	Start int // offset of the span in the text, in the unit of the highlighter
+	End   int // offset of the end of the span in the text, in the unit of the highlighter
+	Label string
+	Score float32
+}
+
+// HTMLHighlighter renders a text as HTML with spans of it highlighted, e.g. to show the answers of a question
+// answering model or the entities of a named entity recognition model in their context. The text and the labels
+// are escaped, so that the output is safe to embed in a page whatever the text, and the offsets of the spans are
+// those of the original text, before escaping.
+type HTMLHighlighter struct {
+	Tag         string // element wrapping each span, "mark" by default
+	ClassPrefix string // class of each span, followed by its label, "highlight-" by default
+	ShowScores  bool   // whether the title of each span, shown on hover, includes its score
+	Offsets     OffsetUnit
+}
+
+// NewHTMLHighlighter creates a highlighter wrapping spans with byte offsets in mark elements.
+func NewHTMLHighlighter() *HTMLHighlighter {
+	return &HTMLHighlighter{Tag: "mark", ClassPrefix: "highlight-", Offsets: ByteOffsets}
+}
+
+// Highlight returns the escaped text with each span wrapped in an element with the class of its label, and with
+// its label, and score if ShowScores is set, as title. Spans overlapping a span of higher score are left out,
+// since overlapping elements cannot be nested, and spans of equal scores are kept in the order of the text.
+func (h *HTMLHighlighter) Highlight(text string, spans []HighlightSpan) (string, error) {
+	byteSpans := make([]HighlightSpan, len(spans))
+	for i, span := range spans {
+		start, startErr := h.byteOffset(text, span.Start)
+		end, endErr := h.byteOffset(text, span.End)
+		if startErr != nil || endErr != nil || start > end {
+			return "", fmt.Errorf("span %d-%d is outside of the text or not on character boundaries", span.Start, span.End)
+		}
+		span.Start, span.End = start, end
+		byteSpans[i] = span
+	}
+
+	// the spans of highest score are kept first
+	sort.SliceStable(byteSpans, func(i, j int) bool {
+		if byteSpans[i].Score != byteSpans[j].Score {
+			return byteSpans[i].Score > byteSpans[j].Score
+		}
+		return byteSpans[i].Start < byteSpans[j].Start
+	})
+	var kept []HighlightSpan
+	for _, span := range byteSpans {
+		overlaps := false
+		for _, other := range kept {
+			if span.Start < other.End && other.Start < span.End {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps && span.Start < span.End {
+			kept = append(kept, span)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Start < kept[j].Start })
+
+	tag := h.Tag
+	if tag == "" {
+		tag = "mark"
+	}
+	var sb strings.Builder
+	position := 0
+	for _, span := range kept {
+		sb.WriteString(html.EscapeString(text[position:span.Start]))
+		title := span.Label
+		if h.ShowScores {
+			title = strings.TrimSpace(fmt.Sprintf("%s %.2f", span.Label, span.Score))
+		}
+		fmt.Fprintf(&sb, `<%s class="%s" title="%s">%s</%s>`,
+			tag, html.EscapeString(h.ClassPrefix+className(span.Label)), html.EscapeString(title),
+			html.EscapeString(text[span.Start:span.End]), tag)
+		position = span.End
+	}
+	sb.WriteString(html.EscapeString(text[position:]))
+	return sb.String(), nil
+}
+
+// HighlightEntities highlights the entities found in a text by a token classification pipeline, labelled with
+// their entity type. Entities have byte offsets, whatever the Offsets of the highlighter.
+func (h *HTMLHighlighter) HighlightEntities(text string, entities []Entity) (string, error) {
+	spans := make([]HighlightSpan, len(entities))
+	for i, entity := range entities {
+		spans[i] = HighlightSpan{Start: int(entity.Start), End: int(entity.End), Label: entityType(entity.Entity), Score: entity.Score}
+	}
+	byteHighlighter := *h
+	byteHighlighter.Offsets = ByteOffsets
+	return byteHighlighter.Highlight(text, spans)
+}
+
+// byteOffset converts an offset in the unit of the highlighter to a byte offset in the text.
+func (h *HTMLHighlighter) byteOffset(text string, offset int) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	switch h.Offsets {
+	case RuneOffsets, UTF16Offsets:
+		units := 0
+		for position, r := range text {
+			if units == offset {
+				return position, nil
+			}
+			if units > offset {
+				break
+			}
+			units++
+			if h.Offsets == UTF16Offsets && r > 0xFFFF {
+				units++ // encoded as a surrogate pair
+			}
+		}
+		if units == offset {
+			return len(text), nil
+		}
+		return 0, fmt.Errorf("offset %d is not on a character boundary or outside of the text", offset)
+	default:
+		if offset > len(text) || (offset < len(text) && !utf8.RuneStart(text[offset])) {
+			return 0, fmt.Errorf("offset %d is not on a character boundary or outside of the text", offset)
+		}
+		return offset, nil
+	}
+}
+
+// className replaces the characters of a label that cannot be part of a class name with dashes.
+func className(label string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '-'
+	}, label)
+}
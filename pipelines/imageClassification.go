@@ -0,0 +1,285 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// types
+
+// ImageClassificationPipeline classifies images with vision models such as ViT, exported to ONNX with a
+// pixel_values input and a logits output. Images are preprocessed in Go as set in preprocessor_config.json.
+type ImageClassificationPipeline struct {
+	basePipeline
+	imageProcessor
+	IDLabelMap  map[int]string
+	ProblemType string // "single_label_classification" for softmax scores, "multi_label_classification" for sigmoid scores
+	TopK        int    // number of labels returned per image, all of them if it is 0
+}
+
+// ImageClassificationPipelineConfig holds the fields of config.json used by the pipeline.
+type ImageClassificationPipelineConfig struct {
+	IDLabelMap  map[int]string `json:"id2label"`
+	ProblemType string         `json:"problem_type"`
+}
+
+type ImageClassificationOutput struct {
+	ClassificationOutputs [][]ClassificationOutput // labels of each image, by decreasing score
+}
+
+func (t *ImageClassificationOutput) GetOutput() []any {
+	out := make([]any, len(t.ClassificationOutputs))
+	for i, classificationOutput := range t.ClassificationOutputs {
+		out[i] = any(classificationOutput)
+	}
+	return out
+}
+
+// options
+
+// WithTopLabels sets the number of labels returned per image, 5 by default. 0 returns all the labels.
+func WithTopLabels(topK int) PipelineOption[*ImageClassificationPipeline] {
+	return func(pipeline *ImageClassificationPipeline) {
+		pipeline.TopK = topK
+	}
+}
+
+// NewImageClassificationPipeline initializes a new image classification pipeline.
+func NewImageClassificationPipeline(config PipelineConfig[*ImageClassificationPipeline], ortOptions *ort.SessionOptions) (*ImageClassificationPipeline, error) {
+	pipeline := &ImageClassificationPipeline{TopK: 5}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	// read id to label map and image preprocessing configuration
+	configPath := util.PathJoinSafe(pipeline.ModelPath, "config.json")
+	pipelineInputConfig := ImageClassificationPipelineConfig{}
+	mapBytes, err := util.ReadFileBytes(configPath)
+	if err != nil {
+		return nil, err
+	}
+	err = jsoniter.Unmarshal(mapBytes, &pipelineInputConfig)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.IDLabelMap = pipelineInputConfig.IDLabelMap
+	pipeline.ProblemType = pipelineInputConfig.ProblemType
+	if pipeline.ProblemType == "" {
+		pipeline.ProblemType = "single_label_classification"
+	}
+	if err = pipeline.loadImageProcessor(pipeline.ModelPath); err != nil {
+		return nil, err
+	}
+
+	// onnx model init
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+	inputs, outputs, err := loadInputOutputMeta(model)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = outputs
+
+	// creation of the session, there is no tokenizer
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := config.EngineCache.createSession(model, inputs, outputs, ortOptions)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.OrtSession = session
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
+
+	// validate
+	err = pipeline.Validate()
+	if err != nil {
+		errDestroy := pipeline.Destroy()
+		return nil, errors.Join(err, errDestroy)
+	}
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the logits output.
+func (p *ImageClassificationPipeline) GetMetadata() PipelineMetadata {
+	return PipelineMetadata{
+		OutputsInfo: []OutputInfo{
+			{
+				Name:       p.OutputsMeta[0].Name,
+				Dimensions: p.OutputsMeta[0].Dimensions,
+			},
+		},
+	}
+}
+
+// Destroy frees the image classification pipeline resources.
+func (p *ImageClassificationPipeline) Destroy() error {
+	return p.OrtSession.Destroy()
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *ImageClassificationPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Image preprocessing: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.ImageTimings.TotalNS),
+			p.ImageTimings.NumCalls,
+			time.Duration(float64(p.ImageTimings.TotalNS)/math.Max(1, float64(p.ImageTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *ImageClassificationPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.IDLabelMap) <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: length of id2label map for image classification pipeline must be greater than zero"))
+	}
+	if len(p.OutputsMeta) == 0 || len(p.OutputsMeta[0].Dimensions) != 2 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: image classification must have 2 dimensional output"))
+	} else if nLogits := p.OutputsMeta[0].Dimensions[1]; nLogits > 0 && len(p.IDLabelMap) != int(nLogits) {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: length of id2label map does not match number of logits in output (%d)", nLogits))
+	}
+	if p.ProblemType != "single_label_classification" && p.ProblemType != "multi_label_classification" {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: problem type %s is not supported", p.ProblemType))
+	}
+	if p.TopK < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the number of top labels cannot be negative"))
+	}
+	return errors.Join(append(validationErrors, p.validateImageProcessor(p.InputsMeta))...)
+}
+
+// Preprocess creates the pixel_values tensor of the images.
+func (p *ImageClassificationPipeline) Preprocess(images []image.Image) (*ort.Tensor[float32], error) {
+	return p.pixelValues(images)
+}
+
+// Forward runs the model on the pixel values and returns the logits of each image.
+func (p *ImageClassificationPipeline) Forward(pixelValues *ort.Tensor[float32]) ([]float32, int, error) {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	outputs := []ort.Value{nil}
+	if err := p.OrtSession.Run([]ort.Value{pixelValues}, outputs); err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = outputs[0].Destroy()
+	}()
+	logitsTensor, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, 0, errors.New("the logits are not a float32 tensor")
+	}
+	shape := logitsTensor.GetShape()
+	logits := append([]float32(nil), logitsTensor.GetData()...)
+	p.PipelineMemory.recordForward(usageBefore, nil)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return logits, int(shape[1]), nil
+}
+
+// Postprocess converts the logits to scores and returns the TopK labels of each image.
+func (p *ImageClassificationPipeline) Postprocess(logits []float32, numLabels int) (*ImageClassificationOutput, error) {
+	aggregationFunction := util.SoftMax
+	if p.ProblemType == "multi_label_classification" {
+		aggregationFunction = util.Sigmoid
+	}
+	numImages := len(logits) / numLabels
+	output := &ImageClassificationOutput{ClassificationOutputs: make([][]ClassificationOutput, numImages)}
+	for i := range output.ClassificationOutputs {
+		scores := aggregationFunction(logits[i*numLabels : (i+1)*numLabels])
+		labels := make([]ClassificationOutput, len(scores))
+		for j, score := range scores {
+			label, ok := p.IDLabelMap[j]
+			if !ok {
+				return nil, fmt.Errorf("class with index number %d not found in id label map", j)
+			}
+			labels[j] = ClassificationOutput{Label: label, Score: score}
+		}
+		sort.SliceStable(labels, func(a, b int) bool {
+			return labels[a].Score > labels[b].Score
+		})
+		if p.TopK > 0 && p.TopK < len(labels) {
+			labels = labels[:p.TopK]
+		}
+		output.ClassificationOutputs[i] = labels
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of paths to images, in the formats supported by util.DecodeImage.
+func (p *ImageClassificationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete image classification output type rather than the interface.
+func (p *ImageClassificationPipeline) RunPipeline(inputs []string) (*ImageClassificationOutput, error) {
+	images, err := readImages(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunImages(images)
+}
+
+// RunImageBytes classifies a batch of image files, e.g. uploads, in the formats supported by util.DecodeImage:
+// JPEG, PNG, GIF and WebP, rotated as set by their EXIF orientation.
+func (p *ImageClassificationPipeline) RunImageBytes(inputs [][]byte) (*ImageClassificationOutput, error) {
+	images, err := decodeImages(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunImages(images)
+}
+
+// RunImages classifies a batch of decoded images.
+func (p *ImageClassificationPipeline) RunImages(images []image.Image) (*ImageClassificationOutput, error) {
+	if len(images) == 0 {
+		return &ImageClassificationOutput{}, nil
+	}
+	var runErrors []error
+	pixelValues, err := p.Preprocess(images)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		runErrors = append(runErrors, pixelValues.Destroy())
+	}()
+
+	logits, numLabels, err := p.Forward(pixelValues)
+	runErrors = append(runErrors, err)
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	result, postErr := p.Postprocess(logits, numLabels)
+	runErrors = append(runErrors, postErr)
+	return result, errors.Join(runErrors...)
+}
@@ -0,0 +1,230 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// ImagePreprocessorConfig holds the fields of preprocessor_config.json used by image pipelines. Sizes are either
+// an object with height and width or shortest_edge, or a number.
+type ImagePreprocessorConfig struct {
+	DoResize      *bool               `json:"do_resize"`
+	Size          jsoniter.RawMessage `json:"size"`
+	Resample      *int                `json:"resample"` // PIL filter, see util.PILImageFilter, bilinear by default
+	DoCenterCrop  *bool               `json:"do_center_crop"`
+	CropSize      jsoniter.RawMessage `json:"crop_size"`
+	DoRescale     *bool               `json:"do_rescale"`
+	RescaleFactor *float32            `json:"rescale_factor"`
+	DoNormalize   *bool               `json:"do_normalize"`
+	ImageMean     []float32           `json:"image_mean"`
+	ImageStd      []float32           `json:"image_std"`
+}
+
+type imageSize struct {
+	Height       int `json:"height"`
+	Width        int `json:"width"`
+	ShortestEdge int `json:"shortest_edge"`
+}
+
+// imageProcessor converts images to the pixel_values input of vision models as the transformers image
+// processors do: the image is resized, center cropped, rescaled and normalized, as set in
+// preprocessor_config.json.
+type imageProcessor struct {
+	ResizeHeight       int
+	ResizeWidth        int
+	ResizeShortestEdge int // images are resized to ResizeHeight x ResizeWidth if it is 0
+	ResizeFilter       util.ImageFilter
+	CropHeight         int // images are not cropped if it is 0
+	CropWidth          int
+	RescaleFactor      float32
+	ImageMean          [3]float32
+	ImageStd           [3]float32
+	ImageTimings       *timings
+}
+
+// loadImageProcessor reads preprocessor_config.json, using the defaults of ViT models for missing fields.
+func (ip *imageProcessor) loadImageProcessor(modelPath string) error {
+	configPath := util.PathJoinSafe(modelPath, "preprocessor_config.json")
+	config := ImagePreprocessorConfig{}
+	configBytes, err := util.ReadFileBytes(configPath)
+	if err != nil {
+		return err
+	}
+	if err = jsoniter.Unmarshal(configBytes, &config); err != nil {
+		return fmt.Errorf("cannot read %s: %w", configPath, err)
+	}
+	enabled := func(flag *bool) bool { return flag == nil || *flag }
+
+	ip.ImageTimings = &timings{}
+	ip.ResizeFilter = util.Bilinear
+	if config.Resample != nil {
+		ip.ResizeFilter = util.PILImageFilter(*config.Resample)
+	}
+	crop := config.DoCenterCrop != nil && *config.DoCenterCrop
+	if crop {
+		cropSize, cropErr := parseImageSize(config.CropSize, true)
+		if cropErr != nil {
+			return fmt.Errorf("cannot read crop_size from %s: %w", configPath, cropErr)
+		}
+		ip.CropHeight, ip.CropWidth = cropSize.Height, cropSize.Width
+	}
+	if enabled(config.DoResize) {
+		// as in transformers, a single number is the shortest edge for processors that crop, and a square otherwise
+		size, sizeErr := parseImageSize(config.Size, !crop)
+		if sizeErr != nil {
+			return fmt.Errorf("cannot read size from %s: %w", configPath, sizeErr)
+		}
+		ip.ResizeHeight, ip.ResizeWidth, ip.ResizeShortestEdge = size.Height, size.Width, size.ShortestEdge
+		if len(config.Size) == 0 {
+			ip.ResizeHeight, ip.ResizeWidth = 224, 224
+		}
+	}
+
+	ip.RescaleFactor = 1
+	if enabled(config.DoRescale) {
+		ip.RescaleFactor = 1.0 / 255
+		if config.RescaleFactor != nil {
+			ip.RescaleFactor = *config.RescaleFactor
+		}
+	}
+	ip.ImageMean, ip.ImageStd = [3]float32{0, 0, 0}, [3]float32{1, 1, 1}
+	if enabled(config.DoNormalize) {
+		ip.ImageMean, ip.ImageStd = [3]float32{0.5, 0.5, 0.5}, [3]float32{0.5, 0.5, 0.5}
+		if len(config.ImageMean) == 3 {
+			copy(ip.ImageMean[:], config.ImageMean)
+		}
+		if len(config.ImageStd) == 3 {
+			copy(ip.ImageStd[:], config.ImageStd)
+		}
+	}
+	return nil
+}
+
+func parseImageSize(raw jsoniter.RawMessage, square bool) (imageSize, error) {
+	size := imageSize{}
+	if len(raw) == 0 {
+		return size, nil
+	}
+	var length int
+	if err := jsoniter.Unmarshal(raw, &length); err == nil {
+		if square {
+			return imageSize{Height: length, Width: length}, nil
+		}
+		return imageSize{ShortestEdge: length}, nil
+	}
+	err := jsoniter.Unmarshal(raw, &size)
+	return size, err
+}
+
+// imageSize returns the height and width of the processed images, which must be fixed so that images can be
+// batched.
+func (ip *imageProcessor) imageSize() (int, int) {
+	if ip.CropHeight > 0 {
+		return ip.CropHeight, ip.CropWidth
+	}
+	if ip.ResizeShortestEdge > 0 {
+		return 0, 0
+	}
+	return ip.ResizeHeight, ip.ResizeWidth
+}
+
+// validateImageProcessor checks that the model has a pixel_values input matching the processed images.
+func (ip *imageProcessor) validateImageProcessor(inputs []ort.InputOutputInfo) error {
+	var validationErrors []error
+	height, width := ip.imageSize()
+	if height <= 0 || width <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: images must be resized to a fixed height and width, or center cropped"))
+	}
+	if ip.ImageStd[0] == 0 || ip.ImageStd[1] == 0 || ip.ImageStd[2] == 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: image_std cannot be zero"))
+	}
+	if len(inputs) != 1 || inputs[0].Name != "pixel_values" {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model must have a single pixel_values input"))
+	} else if dimensions := inputs[0].Dimensions; len(dimensions) != 4 || (dimensions[1] > 0 && dimensions[1] != 3) {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: pixel_values must have 4 dimensions and 3 channels"))
+	} else if (dimensions[2] > 0 && int(dimensions[2]) != height) || (dimensions[3] > 0 && int(dimensions[3]) != width) {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model expects %dx%d images but they are processed to %dx%d", dimensions[3], dimensions[2], width, height))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// PreprocessImage resizes, crops, rescales and normalizes an image, and returns its pixel values in channel first
+// order.
+func (ip *imageProcessor) PreprocessImage(img image.Image) []float32 {
+	if ip.ResizeShortestEdge > 0 {
+		width, height := util.ResizeShortestEdge(img, ip.ResizeShortestEdge)
+		img = util.ResizeImage(img, width, height, ip.ResizeFilter)
+	} else if ip.ResizeHeight > 0 {
+		img = util.ResizeImage(img, ip.ResizeWidth, ip.ResizeHeight, ip.ResizeFilter)
+	}
+	if ip.CropHeight > 0 {
+		img = util.CenterCropImage(img, ip.CropWidth, ip.CropHeight)
+	}
+	return util.ImagePixels(img, ip.RescaleFactor, ip.ImageMean, ip.ImageStd)
+}
+
+// pixelValues creates the pixel_values tensor of a batch of images, which are processed in parallel.
+func (ip *imageProcessor) pixelValues(images []image.Image) (*ort.Tensor[float32], error) {
+	start := time.Now()
+	height, width := ip.imageSize()
+	imageLength := 3 * height * width
+	pixels := make([]float32, len(images)*imageLength)
+	// the images are processed in parallel, at most one per CPU
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i, img := range images {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, img image.Image) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			copy(pixels[i*imageLength:(i+1)*imageLength], ip.PreprocessImage(img))
+		}(i, img)
+	}
+	wg.Wait()
+	atomic.AddUint64(&ip.ImageTimings.NumCalls, 1)
+	atomic.AddUint64(&ip.ImageTimings.TotalNS, uint64(time.Since(start)))
+	return ort.NewTensor(ort.NewShape(int64(len(images)), 3, int64(height), int64(width)), pixels)
+}
+
+// readImages decodes the images at the given paths, in the formats supported by util.DecodeImage.
+func readImages(paths []string) ([]image.Image, error) {
+	images := make([]image.Image, len(paths))
+	for i, path := range paths {
+		imageBytes, err := util.ReadFileBytes(path)
+		if err != nil {
+			return nil, err
+		}
+		img, err := util.DecodeImage(imageBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode image %s: %w", path, err)
+		}
+		images[i] = img
+	}
+	return images, nil
+}
+
+// decodeImages decodes a batch of image files, in the formats supported by util.DecodeImage.
+func decodeImages(inputs [][]byte) ([]image.Image, error) {
+	images := make([]image.Image, len(inputs))
+	for i, input := range inputs {
+		img, err := util.DecodeImage(input)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode input %d: %w", i, err)
+		}
+		images[i] = img
+	}
+	return images, nil
+}
@@ -0,0 +1,123 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// ImageSearch is a visual search engine over a collection of images. The images are embedded by the vision model
+// of a CLIP-style zero shot image classification pipeline and indexed in a vector index, and since CLIP embeds
+// images and texts in the same space, they can be searched both by similar images and by text descriptions.
+// Images can be indexed while searches run.
+type ImageSearch struct {
+	Embedder  *ZeroShotImageClassificationPipeline
+	Index     *util.VectorIndex
+	BatchSize int // number of images embedded at once when indexing, 32 by default
+	mutex     sync.RWMutex
+}
+
+// NewImageSearch creates an empty visual search engine, which embeds images and texts with the embedder.
+func NewImageSearch(embedder *ZeroShotImageClassificationPipeline) (*ImageSearch, error) {
+	if embedder == nil {
+		return nil, errors.New("a zero shot image classification pipeline is required to embed the images")
+	}
+	return &ImageSearch{Embedder: embedder, Index: util.NewVectorIndex(), BatchSize: 32}, nil
+}
+
+// IndexImages embeds decoded images in batches and adds them to the index, with the given ids.
+func (s *ImageSearch) IndexImages(ids []string, images []image.Image) error {
+	if len(ids) != len(images) {
+		return fmt.Errorf("got %d ids for %d images", len(ids), len(images))
+	}
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = 32
+	}
+	for batchStart := 0; batchStart < len(images); batchStart += batchSize {
+		batchEnd := min(batchStart+batchSize, len(images))
+		embeddings, err := s.Embedder.EmbedImages(images[batchStart:batchEnd])
+		if err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		for i, embedding := range embeddings {
+			if err = s.Index.Add(ids[batchStart+i], embedding); err != nil {
+				break
+			}
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IndexImageFiles reads image files, in the formats supported by util.DecodeImage, and indexes them with their
+// paths as ids.
+func (s *ImageSearch) IndexImageFiles(paths []string) error {
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = 32
+	}
+	// files are read one batch at a time, to keep a single batch of decoded images in memory
+	for batchStart := 0; batchStart < len(paths); batchStart += batchSize {
+		batch := paths[batchStart:min(batchStart+batchSize, len(paths))]
+		images, err := readImages(batch)
+		if err != nil {
+			return err
+		}
+		if err = s.IndexImages(batch, images); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of indexed images.
+func (s *ImageSearch) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Index.Len()
+}
+
+// SearchByImage returns the k indexed images most similar to a decoded image, most similar first, with the cosine
+// similarity of their embeddings as score.
+func (s *ImageSearch) SearchByImage(query image.Image, k int) ([]util.SearchResult, error) {
+	embeddings, err := s.Embedder.EmbedImages([]image.Image{query})
+	if err != nil {
+		return nil, err
+	}
+	return s.search(embeddings[0], k)
+}
+
+// SearchByImageBytes is like SearchByImage for an image file, e.g. an upload, in the formats supported by
+// util.DecodeImage.
+func (s *ImageSearch) SearchByImageBytes(query []byte, k int) ([]util.SearchResult, error) {
+	images, err := decodeImages([][]byte{query})
+	if err != nil {
+		return nil, err
+	}
+	return s.SearchByImage(images[0], k)
+}
+
+// SearchByText returns the k indexed images that best match a text description, such as "a dog on a beach", most
+// similar first. The similarities between a text and images are lower than between similar images, and are
+// meaningful relative to each other.
+func (s *ImageSearch) SearchByText(query string, k int) ([]util.SearchResult, error) {
+	embeddings, err := s.Embedder.EmbedTexts([]string{query})
+	if err != nil {
+		return nil, err
+	}
+	return s.search(embeddings[0], k)
+}
+
+func (s *ImageSearch) search(embedding []float32, k int) ([]util.SearchResult, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.Index.Search(embedding, k)
+}
@@ -0,0 +1,133 @@
+package pipelines
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// KeyphraseExtractionPipeline is a preset for extracting keyphrases with token classification models that tag the
+// tokens of keyphrases with B and I labels, such as ml6team/keyphrase-extraction-kbir-inspec. It wraps a token
+// classification pipeline, groups the tagged tokens into keyphrases with their offsets, and de-duplicates the
+// keyphrases of each input case-insensitively. Keyphrases scoring less than MinScore are dropped.
+type KeyphraseExtractionPipeline struct {
+	*TokenClassificationPipeline
+	MinScore float32
+}
+
+// KeyphraseSpan is an occurrence of a keyphrase in an input, as byte offsets.
+type KeyphraseSpan struct {
+	Start uint
+	End   uint
+}
+
+// Keyphrase is a keyphrase of an input with all its occurrences.
+type Keyphrase struct {
+	Text  string          // text of the first occurrence of the keyphrase
+	Score float32         // highest score of the occurrences, the mean score of their tokens
+	Spans []KeyphraseSpan // occurrences of the keyphrase in the input, in order
+}
+
+type KeyphraseExtractionOutput struct {
+	Keyphrases [][]Keyphrase // keyphrases of each input, sorted by decreasing score
+}
+
+func (t *KeyphraseExtractionOutput) GetOutput() []any {
+	out := make([]any, len(t.Keyphrases))
+	for i, keyphrases := range t.Keyphrases {
+		out[i] = any(keyphrases)
+	}
+	return out
+}
+
+// NewKeyphraseExtractionPipeline creates a keyphrase extraction preset from a token classification pipeline. The
+// token labels are grouped by the preset, so the aggregation of the pipeline is turned off.
+func NewKeyphraseExtractionPipeline(extractor *TokenClassificationPipeline) (*KeyphraseExtractionPipeline, error) {
+	if extractor == nil {
+		return nil, errors.New("a token classification pipeline is required for keyphrase extraction")
+	}
+	extractor.AggregationStrategy = "NONE"
+	return &KeyphraseExtractionPipeline{TokenClassificationPipeline: extractor}, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *KeyphraseExtractionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete keyphrase extraction output type rather than the interface.
+func (p *KeyphraseExtractionPipeline) RunPipeline(inputs []string) (*KeyphraseExtractionOutput, error) {
+	output, err := p.TokenClassificationPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	result := &KeyphraseExtractionOutput{Keyphrases: make([][]Keyphrase, len(inputs))}
+	for i, tokens := range output.Entities {
+		result.Keyphrases[i] = p.keyphrases(inputs[i], tokens)
+	}
+	return result, nil
+}
+
+// keyphrase is an occurrence of a keyphrase being grouped from its tokens.
+type keyphrase struct {
+	start, end uint
+	scores     float32
+	tokens     int
+	lastIndex  int
+}
+
+// keyphrases groups the labelled tokens of an input into keyphrases. A B token starts a keyphrase, unless it
+// continues the word of the previous token, and an I token continues the keyphrase of the previous token, or
+// starts one if the previous token is outside of keyphrases.
+func (p *KeyphraseExtractionPipeline) keyphrases(input string, tokens []Entity) []Keyphrase {
+	var occurrences []keyphrase
+	var current *keyphrase
+	for _, token := range tokens {
+		label := strings.ToUpper(token.Entity)
+		inside := strings.HasPrefix(label, "I")
+		begin := strings.HasPrefix(label, "B")
+		follows := current != nil && token.Index == current.lastIndex+1
+		switch {
+		case !inside && !begin:
+			current = nil
+			continue
+		case follows && (inside || token.Start == current.end):
+			current.end = token.End
+		default:
+			occurrences = append(occurrences, keyphrase{start: token.Start, end: token.End})
+			current = &occurrences[len(occurrences)-1]
+		}
+		current.scores += token.Score
+		current.tokens++
+		current.lastIndex = token.Index
+	}
+
+	var keyphrases []Keyphrase
+	byText := map[string]int{}
+	for _, occurrence := range occurrences {
+		text := input[occurrence.start:occurrence.end]
+		score := occurrence.scores / float32(occurrence.tokens)
+		if score < p.MinScore {
+			continue
+		}
+		span := KeyphraseSpan{Start: occurrence.start, End: occurrence.end}
+		key := strings.Join(strings.Fields(strings.ToLower(text)), " ")
+		if k, ok := byText[key]; ok {
+			keyphrases[k].Spans = append(keyphrases[k].Spans, span)
+			keyphrases[k].Score = max(keyphrases[k].Score, score)
+			continue
+		}
+		byText[key] = len(keyphrases)
+		keyphrases = append(keyphrases, Keyphrase{Text: text, Score: score, Spans: []KeyphraseSpan{span}})
+	}
+	slices.SortStableFunc(keyphrases, func(a, b Keyphrase) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return 0
+	})
+	return keyphrases
+}
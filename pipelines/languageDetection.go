@@ -0,0 +1,137 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// UnknownLanguage is the language of inputs whose most likely language is below the threshold.
+const UnknownLanguage = "unknown"
+
+// LanguageDetectionPipeline is a preset for language identification models, such as
+// papluca/xlm-roberta-base-language-detection. It returns the ISO 639 code of the most likely language of each
+// input with its confidence, along with the other candidate languages. Labels are normalized to lowercase codes
+// without script or region, e.g. __label__en and en_Latn become en, and LabelMapping maps the labels of models
+// that use other conventions, e.g. English to en. Inputs whose most likely language has a confidence below
+// Threshold get UnknownLanguage.
+type LanguageDetectionPipeline struct {
+	*TextClassificationPipeline
+	LabelMapping map[string]string // ISO code of the labels of the model that are not codes
+	Threshold    float32           // minimum confidence of the language of an input, 0 to always return it
+}
+
+// LanguageCandidate is a language of an input with its confidence.
+type LanguageCandidate struct {
+	Language   string  // ISO 639 code
+	Confidence float32 // probability of the language
+}
+
+// DetectedLanguage is the language detected for an input.
+type DetectedLanguage struct {
+	Language   string              // ISO 639 code of the most likely language, or UnknownLanguage
+	Confidence float32             // probability of the most likely language, also when it is unknown
+	Candidates []LanguageCandidate // all the languages, by decreasing confidence
+}
+
+// LanguageOrUnknown returns the most likely language if its confidence reaches threshold, or else UnknownLanguage,
+// e.g. to apply a stricter threshold than the one of the pipeline.
+func (d DetectedLanguage) LanguageOrUnknown(threshold float32) string {
+	if len(d.Candidates) == 0 || d.Candidates[0].Confidence < threshold {
+		return UnknownLanguage
+	}
+	return d.Candidates[0].Language
+}
+
+type LanguageDetectionOutput struct {
+	Languages []DetectedLanguage
+}
+
+func (t *LanguageDetectionOutput) GetOutput() []any {
+	out := make([]any, len(t.Languages))
+	for i, language := range t.Languages {
+		out[i] = any(language)
+	}
+	return out
+}
+
+// NewLanguageDetectionPipeline creates a language detection preset from a text classification pipeline. labelMapping
+// maps labels of the model to ISO codes, and may be nil for models whose labels are codes. A copy of the classifier
+// is configured to return the probability of all its labels.
+func NewLanguageDetectionPipeline(classifier *TextClassificationPipeline, labelMapping map[string]string, threshold float32) (*LanguageDetectionPipeline, error) {
+	if classifier == nil {
+		return nil, errors.New("a text classification pipeline is required for language detection")
+	}
+	if threshold < 0 || threshold > 1 {
+		return nil, fmt.Errorf("language detection threshold %f must be between 0 and 1", threshold)
+	}
+	for label := range labelMapping {
+		found := false
+		for _, modelLabel := range classifier.IDLabelMap {
+			found = found || modelLabel == label
+		}
+		if !found {
+			return nil, fmt.Errorf("label %s of the label mapping is not a label of the model", label)
+		}
+	}
+	preset, err := presetClassifier(classifier, "SOFTMAX")
+	if err != nil {
+		return nil, err
+	}
+	return &LanguageDetectionPipeline{TextClassificationPipeline: preset, LabelMapping: labelMapping, Threshold: threshold}, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *LanguageDetectionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete language detection output type rather than the interface.
+func (p *LanguageDetectionPipeline) RunPipeline(inputs []string) (*LanguageDetectionOutput, error) {
+	output, err := p.TextClassificationPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.detections(output.ClassificationOutputs), nil
+}
+
+// detections returns the language of each input given the probabilities of the labels of the classifier.
+func (p *LanguageDetectionPipeline) detections(outputs [][]ClassificationOutput) *LanguageDetectionOutput {
+	result := &LanguageDetectionOutput{Languages: make([]DetectedLanguage, len(outputs))}
+	for i, classes := range outputs {
+		// labels that normalize to the same code, e.g. zh_Hans and zh_Hant, are summed
+		confidences := map[string]float32{}
+		for _, class := range classes {
+			confidences[p.languageCode(class.Label)] += class.Score
+		}
+		detected := DetectedLanguage{Candidates: make([]LanguageCandidate, 0, len(confidences))}
+		for language, confidence := range confidences {
+			detected.Candidates = append(detected.Candidates, LanguageCandidate{Language: language, Confidence: confidence})
+		}
+		sort.Slice(detected.Candidates, func(a, b int) bool {
+			if detected.Candidates[a].Confidence != detected.Candidates[b].Confidence {
+				return detected.Candidates[a].Confidence > detected.Candidates[b].Confidence
+			}
+			return detected.Candidates[a].Language < detected.Candidates[b].Language
+		})
+		if len(detected.Candidates) > 0 {
+			detected.Confidence = detected.Candidates[0].Confidence
+		}
+		detected.Language = detected.LanguageOrUnknown(p.Threshold)
+		result.Languages[i] = detected
+	}
+	return result
+}
+
+// languageCode returns the ISO code of a label of the model.
+func (p *LanguageDetectionPipeline) languageCode(label string) string {
+	if code, ok := p.LabelMapping[label]; ok {
+		return code
+	}
+	code := strings.TrimPrefix(label, "__label__")
+	if i := strings.IndexAny(code, "_-"); i > 0 {
+		code = code[:i]
+	}
+	return strings.ToLower(code)
+}
@@ -0,0 +1,165 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// FallbackRoute is the route of the inputs served by the fallback pipeline of a LanguageRouterPipeline.
+const FallbackRoute = "fallback"
+
+// LanguageRouterPipeline runs language identification on its inputs, e.g. with papluca/xlm-roberta-base-language-detection,
+// and dispatches each input to the pipeline configured for its language, or to a multilingual fallback pipeline.
+// The routed pipelines are run once per language on the inputs of that language, and the outputs are returned
+// in the order of the inputs along with the route that served each input.
+type LanguageRouterPipeline struct {
+	LanguageIdentifier *TextClassificationPipeline
+	Routes             map[string]Pipeline // pipeline of each language label of the language identifier
+	Fallback           Pipeline            // optional, serves the languages without a route and the uncertain identifications
+	MinConfidence      float32             // identifications with a lower score are served by the fallback
+}
+
+// RoutedOutput is the output of an input of a LanguageRouterPipeline.
+type RoutedOutput struct {
+	Language   string  // language identified for the input
+	Confidence float32 // score of the language identification
+	Route      string  // language of the route that served the input, FallbackRoute, or empty if no pipeline could serve it
+	Output     any     // output of the routed pipeline for the input, nil if no pipeline could serve it
+}
+
+type LanguageRouterOutput struct {
+	Outputs []RoutedOutput
+}
+
+func (t *LanguageRouterOutput) GetOutput() []any {
+	out := make([]any, len(t.Outputs))
+	for i, output := range t.Outputs {
+		out[i] = any(output)
+	}
+	return out
+}
+
+// NewLanguageRouterPipeline creates a router from a language identification pipeline, the pipelines of each
+// language, and an optional fallback pipeline. The router does not own the pipelines, which are destroyed
+// with their session.
+func NewLanguageRouterPipeline(languageIdentifier *TextClassificationPipeline, routes map[string]Pipeline, fallback Pipeline) (*LanguageRouterPipeline, error) {
+	router := &LanguageRouterPipeline{
+		LanguageIdentifier: languageIdentifier,
+		Routes:             routes,
+		Fallback:           fallback,
+	}
+	if err := router.Validate(); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *LanguageRouterPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete language router output type rather than the interface.
+func (p *LanguageRouterPipeline) RunPipeline(inputs []string) (*LanguageRouterOutput, error) {
+	languages, err := p.LanguageIdentifier.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.route(inputs, languages.ClassificationOutputs)
+}
+
+// route runs each input through the pipeline of the language identified for it, given the outputs of the
+// language identifier.
+func (p *LanguageRouterPipeline) route(inputs []string, languages [][]ClassificationOutput) (*LanguageRouterOutput, error) {
+	result := &LanguageRouterOutput{Outputs: make([]RoutedOutput, len(inputs))}
+	routeInputs := map[string][]int{}
+	for i, classes := range languages {
+		var top ClassificationOutput
+		for j, class := range classes {
+			if j == 0 || class.Score > top.Score {
+				top = class
+			}
+		}
+		result.Outputs[i].Language = top.Label
+		result.Outputs[i].Confidence = top.Score
+		route := top.Label
+		if _, ok := p.Routes[route]; !ok || top.Score < p.MinConfidence {
+			route = FallbackRoute
+			if p.Fallback == nil {
+				continue
+			}
+		}
+		routeInputs[route] = append(routeInputs[route], i)
+	}
+
+	routes := make([]string, 0, len(routeInputs))
+	for route := range routeInputs {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		pipeline := p.Fallback
+		if route != FallbackRoute {
+			pipeline = p.Routes[route]
+		}
+		indices := routeInputs[route]
+		batch := make([]string, len(indices))
+		for i, index := range indices {
+			batch[i] = inputs[index]
+		}
+		output, runErr := pipeline.Run(batch)
+		if runErr != nil {
+			return nil, fmt.Errorf("pipeline of route %s failed: %w", route, runErr)
+		}
+		for i, routedOutput := range output.GetOutput() {
+			result.Outputs[indices[i]].Route = route
+			result.Outputs[indices[i]].Output = routedOutput
+		}
+	}
+	return result, nil
+}
+
+// GetStats returns the runtime statistics of the language identifier and the routed pipelines.
+func (p *LanguageRouterPipeline) GetStats() []string {
+	stats := p.LanguageIdentifier.GetStats()
+	languages := make([]string, 0, len(p.Routes))
+	for language := range p.Routes {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	for _, language := range languages {
+		stats = append(stats, p.Routes[language].GetStats()...)
+	}
+	if p.Fallback != nil {
+		stats = append(stats, p.Fallback.GetStats()...)
+	}
+	return stats
+}
+
+// GetMetadata returns the metadata of the language identifier, since the outputs of the routed pipelines can differ.
+func (p *LanguageRouterPipeline) GetMetadata() PipelineMetadata {
+	return p.LanguageIdentifier.GetMetadata()
+}
+
+// Validate checks that the router has a language identifier and at least one pipeline to route to.
+func (p *LanguageRouterPipeline) Validate() error {
+	var validationErrors []error
+	if p.LanguageIdentifier == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a language identification pipeline is required"))
+	}
+	if len(p.Routes) == 0 && p.Fallback == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: at least one route or a fallback pipeline is required"))
+	}
+	for language, pipeline := range p.Routes {
+		if pipeline == nil {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the pipeline of language %s is nil", language))
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy does nothing, since the language identifier and the routed pipelines are destroyed with their session.
+func (p *LanguageRouterPipeline) Destroy() error {
+	return nil
+}
@@ -0,0 +1,215 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// LogitProcessor changes the logits of the next token of a generated sequence before the token is picked, e.g. to
+// mask the tokens that are not allowed. The logit processors of a generation pipeline are applied in order at each
+// decoding step, and must be safe for concurrent use, since the sequences of a batch may be generated in parallel.
+type LogitProcessor interface {
+	// ProcessLogits changes the logits of the next token in place, given the token ids of the prompt, or nil for
+	// encoder-decoder models, and the token ids generated so far.
+	ProcessLogits(prompt []int64, generated []int64, logits []float32) error
+}
+
+// RepetitionPenaltyProcessor is a LogitProcessor that discourages the tokens of the prompt and of the generated
+// text from being repeated, as in transformers: their positive logits are divided by the penalty and their
+// negative logits multiplied by it. A penalty of 1 has no effect, and 1.1 to 1.3 is common.
+type RepetitionPenaltyProcessor float32
+
+// ProcessLogits penalizes the logits of the tokens seen so far.
+func (r RepetitionPenaltyProcessor) ProcessLogits(prompt []int64, generated []int64, logits []float32) error {
+	penalty := float32(r)
+	if penalty <= 0 {
+		return fmt.Errorf("the repetition penalty must be positive, got %f", penalty)
+	}
+	seen := map[int64]bool{}
+	for _, tokenIDs := range [][]int64{prompt, generated} {
+		for _, id := range tokenIDs {
+			if seen[id] || id < 0 || int(id) >= len(logits) {
+				continue
+			}
+			seen[id] = true
+			if logits[id] > 0 {
+				logits[id] /= penalty
+			} else {
+				logits[id] *= penalty
+			}
+		}
+	}
+	return nil
+}
+
+// TemperatureProcessor is a LogitProcessor that divides the logits by a temperature before sampling: below 1 the
+// most likely tokens are picked more often, and above 1 less often.
+type TemperatureProcessor float32
+
+// ProcessLogits divides the logits by the temperature.
+func (t TemperatureProcessor) ProcessLogits(_ []int64, _ []int64, logits []float32) error {
+	temperature := float32(t)
+	if temperature <= 0 {
+		return fmt.Errorf("the temperature must be positive, got %f", temperature)
+	}
+	for i := range logits {
+		logits[i] /= temperature
+	}
+	return nil
+}
+
+// TopKProcessor is a LogitProcessor that masks all the tokens but the k most likely ones. Tokens as likely as the
+// k-th one are kept.
+type TopKProcessor int
+
+// ProcessLogits sets the logits below the k-th highest one to minus infinity.
+func (k TopKProcessor) ProcessLogits(_ []int64, _ []int64, logits []float32) error {
+	if k <= 0 {
+		return fmt.Errorf("top k must be positive, got %d", int(k))
+	}
+	if int(k) >= len(logits) {
+		return nil
+	}
+	sorted := append([]float32(nil), logits...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	threshold := sorted[k-1]
+	for i, logit := range logits {
+		if logit < threshold {
+			logits[i] = float32(math.Inf(-1))
+		}
+	}
+	return nil
+}
+
+// TopPProcessor is a LogitProcessor for nucleus sampling: it keeps the most likely tokens whose cumulative
+// probability reaches p, and masks the others. The most likely token is always kept.
+type TopPProcessor float32
+
+// ProcessLogits sets the logits of the tokens outside of the nucleus to minus infinity.
+func (p TopPProcessor) ProcessLogits(_ []int64, _ []int64, logits []float32) error {
+	if p <= 0 || p > 1 {
+		return fmt.Errorf("top p must be between 0 and 1, got %f", float32(p))
+	}
+	probabilities := util.SoftMax(logits)
+	ids := make([]int, len(logits))
+	for i := range ids {
+		ids[i] = i
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return probabilities[ids[a]] > probabilities[ids[b]]
+	})
+	total := float32(0)
+	for i, id := range ids {
+		if total >= float32(p) {
+			for _, masked := range ids[i:] {
+				logits[masked] = float32(math.Inf(-1))
+			}
+			break
+		}
+		total += probabilities[id]
+	}
+	return nil
+}
+
+// ConstraintProcessor is a LogitProcessor that masks the tokens which would make the generated text stop matching
+// a regular expression, so that the generated text matches it, unless the maximum number of tokens is reached
+// first. End of sequence tokens are allowed once the text matches, and are the only tokens allowed once nothing
+// can follow it. A leading space is allowed, since SentencePiece tokenizers mark the start of words with a space
+// that is stripped when decoding, and the generated texts are trimmed.
+type ConstraintProcessor struct {
+	Constraint  *util.TokenConstraint
+	tokens      [][]byte
+	eosTokenIDs map[int64]bool
+}
+
+// NewRegexProcessor constrains the text generated by a model to the matches of a regular expression, in the RE2
+// syntax of the regexp package. The vocabulary is read from the tokenizer.json file of the model.
+func NewRegexProcessor(modelPath string, pattern string, eosTokenIDs map[int64]bool) (*ConstraintProcessor, error) {
+	tokenizerBytes, err := util.ReadFileBytes(util.PathJoinSafe(modelPath, "tokenizer.json"))
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := util.TokenBytes(tokenizerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the vocabulary of the tokenizer at %s: %w", modelPath, err)
+	}
+	constraint, err := util.NewTokenConstraint(`(?: )?(?:`+pattern+`)`, tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &ConstraintProcessor{Constraint: constraint, tokens: tokens, eosTokenIDs: eosTokenIDs}, nil
+}
+
+// NewJSONSchemaProcessor constrains the text generated by a model to JSON texts that are valid for a JSON schema,
+// as converted to a regular expression by util.JSONSchemaPattern.
+func NewJSONSchemaProcessor(modelPath string, schema string, eosTokenIDs map[int64]bool) (*ConstraintProcessor, error) {
+	pattern, err := util.JSONSchemaPattern([]byte(schema))
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert the JSON schema: %w", err)
+	}
+	return NewRegexProcessor(modelPath, pattern, eosTokenIDs)
+}
+
+// ProcessLogits sets the logits of the tokens that are not allowed to minus infinity.
+func (c *ConstraintProcessor) ProcessLogits(_ []int64, generated []int64, logits []float32) error {
+	var text []byte
+	for _, id := range generated {
+		if id >= 0 && int(id) < len(c.tokens) {
+			text = append(text, c.tokens[id]...)
+		}
+	}
+	allowed, complete, err := c.Constraint.Allowed(text)
+	if err != nil {
+		return fmt.Errorf("%w: %q", err, text)
+	}
+	anyAllowed := false
+	for id := range logits {
+		switch {
+		case c.eosTokenIDs[int64(id)] && complete:
+			anyAllowed = true
+		case util.TokenAllowed(allowed, id):
+			anyAllowed = true
+		default:
+			logits[id] = float32(math.Inf(-1))
+		}
+	}
+	if !anyAllowed {
+		return fmt.Errorf("no token of the vocabulary can continue the generated text %q under the constraint", text)
+	}
+	return nil
+}
+
+// generationConstraint returns the logit processor of the regular expression or the JSON schema that a generation
+// pipeline is constrained to, or nil if there is none.
+func generationConstraint(modelPath string, regex string, jsonSchema string, eosTokenIDs map[int64]bool) (LogitProcessor, error) {
+	switch {
+	case regex != "" && jsonSchema != "":
+		return nil, errors.New("pipeline configuration invalid: generation can be constrained by a regex or a JSON schema, not both")
+	case regex != "":
+		return NewRegexProcessor(modelPath, regex, eosTokenIDs)
+	case jsonSchema != "":
+		return NewJSONSchemaProcessor(modelPath, jsonSchema, eosTokenIDs)
+	}
+	return nil, nil
+}
+
+// processLogits applies logit processors in order.
+func processLogits(processors []LogitProcessor, prompt []int64, generated []uint32, logits []float32) error {
+	if len(processors) == 0 {
+		return nil
+	}
+	generatedIDs := make([]int64, len(generated))
+	for i, id := range generated {
+		generatedIDs[i] = int64(id)
+	}
+	for _, processor := range processors {
+		if err := processor.ProcessLogits(prompt, generatedIDs, logits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
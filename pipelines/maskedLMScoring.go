@@ -0,0 +1,177 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/daulet/tokenizers"
+)
+
+// MaskedLMScoringPipeline is a preset that scores the fluency of sentences with a masked language model, e.g. to rank
+// candidate sentences or to filter noisy text out of a corpus. It wraps a fill-mask pipeline and computes the
+// pseudo-log-likelihood of each input: every token is masked in turn, and the log probability that the model gives to
+// the original token at the mask is summed over the tokens. An input of n tokens therefore runs n masked copies of
+// the input through the model, in batches of BatchSize copies.
+type MaskedLMScoringPipeline struct {
+	*FillMaskPipeline
+	BatchSize int
+}
+
+// MaskedTokenScore is the log probability of a token of an input when it is masked.
+type MaskedTokenScore struct {
+	Token          string
+	Start          uint // byte offset of the token in the input
+	End            uint
+	LogProbability float32
+}
+
+// MaskedLMScore is the pseudo-log-likelihood of an input. Both scores are zero for inputs without tokens.
+type MaskedLMScore struct {
+	PseudoLogLikelihood float32 // sum of the log probabilities of the tokens, higher is more fluent
+	PseudoPerplexity    float32 // exp of the mean negative log probability of the tokens, lower is more fluent
+	TokenScores         []MaskedTokenScore
+}
+
+type MaskedLMScoringOutput struct {
+	Scores []MaskedLMScore
+}
+
+func (t *MaskedLMScoringOutput) GetOutput() []any {
+	out := make([]any, len(t.Scores))
+	for i, score := range t.Scores {
+		out[i] = any(score)
+	}
+	return out
+}
+
+// NewMaskedLMScoringPipeline creates a masked language model scoring preset from a fill-mask pipeline. batchSize is
+// the number of masked copies run by the model at once, 32 if zero.
+func NewMaskedLMScoringPipeline(fillMask *FillMaskPipeline, batchSize int) (*MaskedLMScoringPipeline, error) {
+	if fillMask == nil {
+		return nil, errors.New("a fill-mask pipeline is required for masked language model scoring")
+	}
+	if batchSize < 0 {
+		return nil, errors.New("the batch size of masked language model scoring must be positive")
+	}
+	if batchSize == 0 {
+		batchSize = 32
+	}
+	return &MaskedLMScoringPipeline{FillMaskPipeline: fillMask, BatchSize: batchSize}, nil
+}
+
+// maskedCopy is an input with one of its tokens masked.
+type maskedCopy struct {
+	input    int // index of the input
+	position int // position of the masked token
+	tokenID  uint32
+}
+
+// Run the pipeline on a batch of strings.
+func (p *MaskedLMScoringPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete masked language model scoring output type rather than the interface.
+func (p *MaskedLMScoringPipeline) RunPipeline(inputs []string) (*MaskedLMScoringOutput, error) {
+	batch := NewBatch()
+	start := time.Now()
+	options := append([]tokenizers.EncodeOption{tokenizers.WithReturnSpecialTokensMask(), tokenizers.WithReturnOffsets(), tokenizers.WithReturnTokens()}, p.TokenizerOptions...)
+	tokenizeInputs(batch, p.Tokenizer, inputs, options)
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+
+	output := &MaskedLMScoringOutput{Scores: make([]MaskedLMScore, len(inputs))}
+	var copies []maskedCopy
+	for i, input := range batch.Input {
+		for j, id := range input.TokenIDs {
+			if j > input.MaxAttentionIndex || (j < len(input.SpecialTokensMask) && input.SpecialTokensMask[j] == 1) {
+				continue
+			}
+			copies = append(copies, maskedCopy{input: i, position: j, tokenID: id})
+			tokenScore := MaskedTokenScore{}
+			if j < len(input.Tokens) {
+				tokenScore.Token = input.Tokens[j]
+			}
+			if j < len(input.Offsets) {
+				tokenScore.Start, tokenScore.End = input.Offsets[j][0], input.Offsets[j][1]
+			}
+			output.Scores[i].TokenScores = append(output.Scores[i].TokenScores, tokenScore)
+		}
+	}
+
+	tokenIndex := make([]int, len(inputs)) // next token score of each input
+	for chunkStart := 0; chunkStart < len(copies); chunkStart += p.BatchSize {
+		chunk := copies[chunkStart:min(chunkStart+p.BatchSize, len(copies))]
+		logProbabilities, err := p.scoreMaskedCopies(batch, chunk)
+		if err != nil {
+			return nil, err
+		}
+		for k, masked := range chunk {
+			output.Scores[masked.input].TokenScores[tokenIndex[masked.input]].LogProbability = logProbabilities[k]
+			tokenIndex[masked.input]++
+		}
+	}
+
+	for i := range output.Scores {
+		score := &output.Scores[i]
+		if len(score.TokenScores) == 0 {
+			continue
+		}
+		for _, tokenScore := range score.TokenScores {
+			score.PseudoLogLikelihood += tokenScore.LogProbability
+		}
+		score.PseudoPerplexity = float32(math.Exp(-float64(score.PseudoLogLikelihood) / float64(len(score.TokenScores))))
+	}
+	return output, nil
+}
+
+// scoreMaskedCopies runs the masked copies of inputs of the tokenized batch and returns the log probability of the
+// original token at the mask of each copy.
+func (p *MaskedLMScoringPipeline) scoreMaskedCopies(tokenized *PipelineBatch, chunk []maskedCopy) (logProbabilities []float32, err error) {
+	batch := NewBatch()
+	defer func() {
+		err = errors.Join(err, batch.Destroy())
+	}()
+	batch.Input = make([]tokenizedInput, len(chunk))
+	for k, masked := range chunk {
+		input := tokenized.Input[masked.input]
+		input.TokenIDs = append([]uint32(nil), input.TokenIDs...)
+		input.TokenIDs[masked.position] = p.MaskTokenID
+		batch.Input[k] = input
+		batch.MaxSequenceLength = max(batch.MaxSequenceLength, input.MaxAttentionIndex+1)
+	}
+	if err = createInputTensors(batch, p.InputsMeta); err != nil {
+		return nil, err
+	}
+	if err = p.Forward(batch); err != nil {
+		return nil, err
+	}
+
+	logits := batch.OutputTensors[0].GetData()
+	vocabularySize := int(p.OutputsMeta[0].Dimensions[2])
+	logProbabilities = make([]float32, len(chunk))
+	for k, masked := range chunk {
+		if int(masked.tokenID) >= vocabularySize {
+			return nil, fmt.Errorf("token id %d is outside of the vocabulary of the model", masked.tokenID)
+		}
+		offset := (k*batch.MaxSequenceLength + masked.position) * vocabularySize
+		logProbabilities[k] = logSoftMax(logits[offset:offset+vocabularySize], int(masked.tokenID))
+	}
+	return logProbabilities, nil
+}
+
+// logSoftMax returns the log of the softmax probability of the logit at index.
+func logSoftMax(logits []float32, index int) float32 {
+	maxLogit := logits[0]
+	for _, logit := range logits {
+		maxLogit = max(maxLogit, logit)
+	}
+	sumExp := 0.0
+	for _, logit := range logits {
+		sumExp += math.Exp(float64(logit - maxLogit))
+	}
+	return float32(float64(logits[index]-maxLogit) - math.Log(sumExp))
+}
@@ -0,0 +1,266 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// MemoryPressurePolicy configures how a DegradingPipeline reduces its batch size and input length when memory
+// usage is high.
+type MemoryPressurePolicy struct {
+	HighWatermark  uint64                 // memory usage in bytes above which the settings are halved
+	LowWatermark   uint64                 // memory usage in bytes below which the settings are doubled back, 80% of HighWatermark by default
+	MaxBatchSize   int                    // batch size without memory pressure
+	MaxInputLength int                    // input length in bytes without memory pressure, a proxy for the sequence length. 0 for no limit
+	MinBatchSize   int                    // 1 by default
+	MinInputLength int                    // 256 by default
+	MemoryUsage    func() (uint64, error) // util.ProcessMemoryUsage by default
+	Warn           func(message string)   // called when the settings are reduced or restored, e.g. log.Println
+}
+
+// DegradationStats are the metrics of a DegradingPipeline.
+type DegradationStats struct {
+	Degraded        bool   // whether the current settings are below the maximum ones
+	BatchSize       int    // current batch size
+	InputLength     int    // current maximum input length, 0 for no limit
+	MemoryUsage     uint64 // last memory usage measured
+	Degradations    int    // number of times the settings were reduced
+	Recoveries      int    // number of times the settings were increased
+	TruncatedInputs int    // number of inputs truncated
+}
+
+// DegradingPipeline runs a pipeline in batches, and degrades gracefully under memory pressure rather than
+// failing: when the memory usage is above the high watermark, or the pipeline fails to allocate memory, the batch
+// size and the maximum input length are halved, down to their minimum. Longer inputs are truncated. The settings
+// are doubled back up to their maximum once the memory usage is below the low watermark.
+type DegradingPipeline struct {
+	Pipeline
+	Policy MemoryPressurePolicy
+	mutex  sync.Mutex
+	stats  DegradationStats
+}
+
+// DegradedOutput is the output of a DegradingPipeline.
+type DegradedOutput struct {
+	Outputs   []any  // outputs of the wrapped pipeline, as returned by GetOutput
+	Truncated []bool // whether each input was truncated
+}
+
+func (t *DegradedOutput) GetOutput() []any {
+	return t.Outputs
+}
+
+// NewDegradingPipeline wraps a pipeline with a memory pressure policy.
+func NewDegradingPipeline(pipeline Pipeline, policy MemoryPressurePolicy) (*DegradingPipeline, error) {
+	if policy.LowWatermark == 0 {
+		policy.LowWatermark = policy.HighWatermark / 5 * 4
+	}
+	if policy.MinBatchSize == 0 {
+		policy.MinBatchSize = 1
+	}
+	if policy.MinInputLength == 0 {
+		policy.MinInputLength = 256
+	}
+	if policy.MemoryUsage == nil {
+		policy.MemoryUsage = util.ProcessMemoryUsage
+	}
+	degrading := &DegradingPipeline{
+		Pipeline: pipeline,
+		Policy:   policy,
+		stats: DegradationStats{
+			BatchSize:   policy.MaxBatchSize,
+			InputLength: policy.MaxInputLength,
+		},
+	}
+	if err := degrading.Validate(); err != nil {
+		return nil, err
+	}
+	return degrading, nil
+}
+
+// Stats returns the current settings and the degradation metrics of the pipeline.
+func (p *DegradingPipeline) Stats() DegradationStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stats
+}
+
+// Run the pipeline on a batch of strings.
+func (p *DegradingPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete output type rather than the interface.
+func (p *DegradingPipeline) RunPipeline(inputs []string) (*DegradedOutput, error) {
+	output := &DegradedOutput{
+		Outputs:   make([]any, 0, len(inputs)),
+		Truncated: make([]bool, 0, len(inputs)),
+	}
+	for batchStart := 0; batchStart < len(inputs); {
+		if err := p.adjust(); err != nil {
+			return nil, err
+		}
+		settings := p.Stats()
+		batchEnd := min(batchStart+settings.BatchSize, len(inputs))
+		batch := make([]string, 0, batchEnd-batchStart)
+		truncated := make([]bool, 0, batchEnd-batchStart)
+		for _, input := range inputs[batchStart:batchEnd] {
+			truncatedInput := truncateInput(input, settings.InputLength)
+			batch = append(batch, truncatedInput)
+			truncated = append(truncated, len(truncatedInput) < len(input))
+		}
+
+		batchOutput, err := p.Pipeline.Run(batch)
+		if err != nil {
+			if isAllocationError(err) && p.degrade(fmt.Sprintf("allocation failure: %s", err.Error())) {
+				continue // retry the batch with the reduced settings
+			}
+			return nil, err
+		}
+		output.Outputs = append(output.Outputs, batchOutput.GetOutput()...)
+		output.Truncated = append(output.Truncated, truncated...)
+		numTruncated := 0
+		for _, isTruncated := range truncated {
+			if isTruncated {
+				numTruncated++
+			}
+		}
+		p.mutex.Lock()
+		p.stats.TruncatedInputs += numTruncated
+		p.mutex.Unlock()
+		batchStart = batchEnd
+	}
+	return output, nil
+}
+
+// adjust measures the memory usage and reduces or restores the settings accordingly.
+func (p *DegradingPipeline) adjust() error {
+	usage, err := p.Policy.MemoryUsage()
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.stats.MemoryUsage = usage
+	degraded := p.stats.Degraded
+	p.mutex.Unlock()
+	switch {
+	case usage > p.Policy.HighWatermark:
+		p.degrade(fmt.Sprintf("memory usage of %d bytes is above the high watermark of %d bytes", usage, p.Policy.HighWatermark))
+	case usage < p.Policy.LowWatermark && degraded:
+		p.recover(usage)
+	}
+	return nil
+}
+
+// degrade halves the settings, and returns false if they are already at their minimum.
+func (p *DegradingPipeline) degrade(reason string) bool {
+	p.mutex.Lock()
+	batchSize := max(p.stats.BatchSize/2, p.Policy.MinBatchSize)
+	inputLength := p.stats.InputLength
+	if inputLength == 0 || inputLength > p.Policy.MinInputLength {
+		if inputLength == 0 {
+			// without a maximum input length, start from the minimum one
+			inputLength = p.Policy.MinInputLength * 2
+		}
+		inputLength = max(inputLength/2, p.Policy.MinInputLength)
+	}
+	changed := batchSize != p.stats.BatchSize || inputLength != p.stats.InputLength
+	if changed {
+		p.stats.BatchSize, p.stats.InputLength = batchSize, inputLength
+		p.stats.Degraded = true
+		p.stats.Degradations++
+	}
+	p.mutex.Unlock()
+	if changed {
+		p.warn(fmt.Sprintf("%s, reducing the batch size to %d and the input length to %d", reason, batchSize, inputLength))
+	}
+	return changed
+}
+
+// recover doubles the settings, up to their maximum.
+func (p *DegradingPipeline) recover(usage uint64) {
+	p.mutex.Lock()
+	p.stats.BatchSize = min(p.stats.BatchSize*2, p.Policy.MaxBatchSize)
+	if p.Policy.MaxInputLength == 0 {
+		if p.stats.InputLength >= 4*p.Policy.MinInputLength {
+			p.stats.InputLength = 0
+		} else {
+			p.stats.InputLength *= 2
+		}
+	} else {
+		p.stats.InputLength = min(p.stats.InputLength*2, p.Policy.MaxInputLength)
+	}
+	p.stats.Degraded = p.stats.BatchSize < p.Policy.MaxBatchSize || p.stats.InputLength != p.Policy.MaxInputLength
+	p.stats.Recoveries++
+	batchSize, inputLength, degraded := p.stats.BatchSize, p.stats.InputLength, p.stats.Degraded
+	p.mutex.Unlock()
+	if degraded {
+		p.warn(fmt.Sprintf("memory usage of %d bytes is below the low watermark, increasing the batch size to %d and the input length to %d", usage, batchSize, inputLength))
+	} else {
+		p.warn(fmt.Sprintf("memory usage of %d bytes is below the low watermark, settings restored", usage))
+	}
+}
+
+func (p *DegradingPipeline) warn(message string) {
+	if p.Policy.Warn != nil {
+		p.Policy.Warn(message)
+	}
+}
+
+// isAllocationError returns whether an error of onnxruntime is a failure to allocate memory.
+func isAllocationError(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, pattern := range []string{"failed to allocate", "bad_alloc", "out of memory"} {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateInput truncates an input to at most length bytes, on a rune boundary. A length of 0 means no limit.
+func truncateInput(input string, length int) string {
+	if length <= 0 || len(input) <= length {
+		return input
+	}
+	for length > 0 && !utf8.RuneStart(input[length]) {
+		length--
+	}
+	return input[:length]
+}
+
+// GetStats returns the runtime statistics of the wrapped pipeline, and the degradation metrics.
+func (p *DegradingPipeline) GetStats() []string {
+	stats := p.Stats()
+	return append(p.Pipeline.GetStats(),
+		fmt.Sprintf("Memory pressure: Degraded=%t, Batch size=%d, Input length=%d, Memory usage=%d, Degradations=%d, Recoveries=%d, Truncated inputs=%d",
+			stats.Degraded, stats.BatchSize, stats.InputLength, stats.MemoryUsage, stats.Degradations, stats.Recoveries, stats.TruncatedInputs))
+}
+
+// Validate checks that the policy is valid, and validates the wrapped pipeline.
+func (p *DegradingPipeline) Validate() error {
+	if p.Pipeline == nil {
+		return errors.New("pipeline configuration invalid: a pipeline is required")
+	}
+	var validationErrors []error
+	if p.Policy.HighWatermark == 0 || p.Policy.LowWatermark > p.Policy.HighWatermark {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the high watermark must be set and above the low watermark"))
+	}
+	if p.Policy.MaxBatchSize < p.Policy.MinBatchSize || p.Policy.MinBatchSize <= 0 {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the maximum batch size must be at least the minimum batch size, which must be greater than zero"))
+	}
+	if p.Policy.MaxInputLength != 0 && p.Policy.MaxInputLength < p.Policy.MinInputLength {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: the maximum input length must be at least the minimum input length"))
+	}
+	return errors.Join(append(validationErrors, p.Pipeline.Validate())...)
+}
+
+// Destroy does nothing, since the wrapped pipeline is destroyed with its session.
+func (p *DegradingPipeline) Destroy() error {
+	return nil
+}
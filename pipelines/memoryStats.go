@@ -0,0 +1,89 @@
+package pipelines
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// MemoryStats are the approximate memory figures of a pipeline, for capacity planning on nodes running several
+// models. onnxruntime does not report its allocations, so the memory it retains, mostly its arena, is estimated
+// as the growth of the resident memory of the process during the forward passes of the pipeline. When pipelines
+// run concurrently, the growth may be attributed to the wrong one.
+type MemoryStats struct {
+	ModelBytes     uint64 // size of the onnx models loaded in the session, roughly the memory held by the weights
+	ArenaBytes     uint64 // growth of the process memory during forward passes, beyond the output tensors
+	PeakBatchBytes uint64 // largest size of the input and output tensors of a batch, allocated on the Go side
+}
+
+// PeakBytes returns the approximate peak memory used by the pipeline.
+func (m MemoryStats) PeakBytes() uint64 {
+	return m.ModelBytes + m.ArenaBytes + m.PeakBatchBytes
+}
+
+func (m MemoryStats) String() string {
+	return fmt.Sprintf("Memory: Model=%d bytes, Arena=%d bytes, Peak batch=%d bytes, Peak=%d bytes",
+		m.ModelBytes, m.ArenaBytes, m.PeakBatchBytes, m.PeakBytes())
+}
+
+// GetMemoryStats returns the approximate memory used by the pipeline.
+func (p *basePipeline) GetMemoryStats() MemoryStats {
+	if p.PipelineMemory == nil {
+		return MemoryStats{}
+	}
+	return MemoryStats{
+		ModelBytes:     atomic.LoadUint64(&p.PipelineMemory.ModelBytes),
+		ArenaBytes:     atomic.LoadUint64(&p.PipelineMemory.ArenaBytes),
+		PeakBatchBytes: atomic.LoadUint64(&p.PipelineMemory.PeakBatchBytes),
+	}
+}
+
+// memoryUsageBefore returns the resident memory of the process before a forward pass, or 0 if it is unknown.
+func memoryUsageBefore() uint64 {
+	usage, err := util.ProcessMemoryUsage()
+	if err != nil {
+		return 0
+	}
+	return usage
+}
+
+// recordForward records the memory used by a forward pass on batch, started when the process used usageBefore
+// bytes. The batch is nil for pipelines that do not allocate their tensors on the Go side.
+func (m *MemoryStats) recordForward(usageBefore uint64, batch *PipelineBatch) {
+	if m == nil {
+		return
+	}
+	var inputBytes, outputBytes uint64
+	if batch != nil {
+		inputBytes, outputBytes = batch.tensorBytes()
+	}
+	if usageBefore > 0 {
+		if usageAfter, err := util.ProcessMemoryUsage(); err == nil && usageAfter > usageBefore+outputBytes {
+			atomic.AddUint64(&m.ArenaBytes, usageAfter-usageBefore-outputBytes)
+		}
+	}
+	batchBytes := inputBytes + outputBytes
+	for {
+		peak := atomic.LoadUint64(&m.PeakBatchBytes)
+		if batchBytes <= peak || atomic.CompareAndSwapUint64(&m.PeakBatchBytes, peak, batchBytes) {
+			return
+		}
+	}
+}
+
+// tensorBytes returns the size of the input and output tensors of the batch.
+func (b *PipelineBatch) tensorBytes() (uint64, uint64) {
+	var inputBytes, outputBytes uint64
+	for _, tensor := range b.InputTensors {
+		if tensor != nil {
+			inputBytes += uint64(len(tensor.GetData())) * 8
+		}
+	}
+	for _, tensor := range b.OutputTensors {
+		if tensor != nil {
+			outputBytes += uint64(len(tensor.GetData())) * 4
+		}
+	}
+	return inputBytes, outputBytes
+}
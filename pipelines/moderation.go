@@ -0,0 +1,207 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ModerationPipeline is a preset for toxicity and content moderation classifiers, such as unitary/toxic-bert, whose
+// labels are categories of harmful content (e.g. toxic, insult, threat) scored independently of each other. Each
+// category has its own threshold, since categories differ in severity and in how well the model is calibrated on
+// them, and an input is flagged if the score of any category reaches its threshold, to gate user content. The scores
+// can be calibrated with Platt scaling, see Calibrate.
+type ModerationPipeline struct {
+	*TextClassificationPipeline
+	Thresholds       map[string]float32      // threshold of each category
+	DefaultThreshold float32                 // threshold of the categories without one, that of the classifier or 0.5 by default
+	Platt            map[string]PlattScaling // Platt scaling of each category, the plain sigmoid for the categories without one
+}
+
+// ModerationVerdict is the moderation verdict of an input.
+type ModerationVerdict struct {
+	Flagged    bool
+	Categories []string           // categories whose score reaches their threshold, by decreasing score
+	Scores     map[string]float32 // probability of each category
+}
+
+type ModerationOutput struct {
+	Verdicts []ModerationVerdict
+}
+
+func (t *ModerationOutput) GetOutput() []any {
+	out := make([]any, len(t.Verdicts))
+	for i, verdict := range t.Verdicts {
+		out[i] = any(verdict)
+	}
+	return out
+}
+
+// NewModerationPipeline creates a moderation preset from a multi-label text classification pipeline, whose labels
+// are the categories, with thresholds by category, between 0 and 1, which override the thresholds of the classifier,
+// e.g. read from the ThresholdsFile of the model. A copy of the classifier is configured to return the logit of each
+// category, and the Platt scaling saved with the model, if any, is loaded.
+func NewModerationPipeline(classifier *TextClassificationPipeline, thresholds map[string]float32) (*ModerationPipeline, error) {
+	if classifier == nil {
+		return nil, errors.New("a text classification pipeline is required for moderation")
+	}
+	merged := make(map[string]float32, len(classifier.Thresholds)+len(thresholds))
+	for category, threshold := range classifier.Thresholds {
+		merged[category] = threshold
+	}
+	for category, threshold := range thresholds {
+		merged[category] = threshold
+	}
+	thresholds = merged
+	defaultThreshold := float32(0.5)
+	if classifier.Threshold > 0 {
+		defaultThreshold = classifier.Threshold
+	}
+	for category, threshold := range thresholds {
+		if !isLabel(classifier, category) {
+			return nil, fmt.Errorf("category %s of the thresholds is not a label of the model", category)
+		}
+		if threshold < 0 || threshold > 1 {
+			return nil, fmt.Errorf("threshold %f of category %s is not between 0 and 1", threshold, category)
+		}
+	}
+	platt := map[string]PlattScaling{}
+	calibration, err := LoadCalibration(classifier.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	if calibration != nil {
+		for category, scaling := range calibration.Platt {
+			if !isLabel(classifier, category) {
+				return nil, fmt.Errorf("category %s of the calibration is not a label of the model", category)
+			}
+			platt[category] = scaling
+		}
+	}
+	preset, err := presetClassifier(classifier, "NONE")
+	if err != nil {
+		return nil, err
+	}
+	return &ModerationPipeline{
+		TextClassificationPipeline: preset,
+		Thresholds:                 thresholds,
+		DefaultThreshold:           defaultThreshold,
+		Platt:                      platt,
+	}, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *ModerationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete moderation output type rather than the interface.
+func (p *ModerationPipeline) RunPipeline(inputs []string) (*ModerationOutput, error) {
+	output, err := p.TextClassificationPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.verdicts(output.ClassificationOutputs), nil
+}
+
+// verdicts compares the calibrated probabilities of the categories to their thresholds given the logits of the
+// classifier for each input.
+func (p *ModerationPipeline) verdicts(outputs [][]ClassificationOutput) *ModerationOutput {
+	result := &ModerationOutput{Verdicts: make([]ModerationVerdict, len(outputs))}
+	for i, classes := range outputs {
+		verdict := ModerationVerdict{Scores: make(map[string]float32, len(classes))}
+		for _, class := range classes {
+			class.Score = p.probability(class.Label, class.Score)
+			verdict.Scores[class.Label] = class.Score
+			threshold, ok := p.Thresholds[class.Label]
+			if !ok {
+				threshold = p.DefaultThreshold
+			}
+			if class.Score >= threshold {
+				verdict.Categories = append(verdict.Categories, class.Label)
+			}
+		}
+		sort.SliceStable(verdict.Categories, func(a, b int) bool {
+			return verdict.Scores[verdict.Categories[a]] > verdict.Scores[verdict.Categories[b]]
+		})
+		verdict.Flagged = len(verdict.Categories) > 0
+		result.Verdicts[i] = verdict
+	}
+	return result
+}
+
+// Calibrate fits the Platt scaling of each category to a labeled sample, whose labels are categories, by maximizing
+// the likelihood of the labels, so that the scores can be compared to the thresholds as probabilities. An input
+// with several categories is given once for each of them, and an input with none, e.g. with an empty label, is
+// a negative example of every category. Categories without both positive and negative examples keep their
+// scaling.
+func (p *ModerationPipeline) Calibrate(samples []LabeledInput, batchSize int) error {
+	if len(samples) == 0 {
+		return errors.New("no samples to calibrate on")
+	}
+	var texts []string
+	categories := map[string]map[string]bool{} // categories of each text
+	for i, sample := range samples {
+		if sample.Label != "" && !isLabel(p.TextClassificationPipeline, sample.Label) {
+			return fmt.Errorf("label %s of sample %d is not a category of the model", sample.Label, i)
+		}
+		if _, ok := categories[sample.Text]; !ok {
+			categories[sample.Text] = map[string]bool{}
+			texts = append(texts, sample.Text)
+		}
+		if sample.Label != "" {
+			categories[sample.Text][sample.Label] = true
+		}
+	}
+	outputs, err := classifyInBatches(p.TextClassificationPipeline, texts, batchSize)
+	if err != nil {
+		return err
+	}
+
+	logits := map[string][]float32{}
+	positives := map[string][]bool{}
+	for i, classes := range outputs {
+		for _, class := range classes {
+			logits[class.Label] = append(logits[class.Label], class.Score)
+			positives[class.Label] = append(positives[class.Label], categories[texts[i]][class.Label])
+		}
+	}
+	for category, categoryPositives := range positives {
+		numPositives := 0
+		for _, positive := range categoryPositives {
+			if positive {
+				numPositives++
+			}
+		}
+		if numPositives > 0 && numPositives < len(categoryPositives) {
+			p.Platt[category] = fitPlatt(logits[category], categoryPositives)
+		}
+	}
+	return nil
+}
+
+// SaveCalibration saves the Platt scaling of the categories with the model, in its CalibrationFile, so that it is
+// loaded by the moderation presets created from the model.
+func (p *ModerationPipeline) SaveCalibration() error {
+	return updateCalibration(p.ModelPath, func(calibration *Calibration) {
+		calibration.Platt = p.Platt
+	})
+}
+
+// probability returns the calibrated probability of a category given its logit.
+func (p *ModerationPipeline) probability(category string, logit float32) float32 {
+	scaling, ok := p.Platt[category]
+	if !ok {
+		scaling = PlattScaling{A: 1}
+	}
+	return scaling.Probability(logit)
+}
+
+func isLabel(classifier *TextClassificationPipeline, label string) bool {
+	for _, modelLabel := range classifier.IDLabelMap {
+		if modelLabel == label {
+			return true
+		}
+	}
+	return false
+}
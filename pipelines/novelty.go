@@ -0,0 +1,94 @@
+package pipelines
+
+import (
+	"errors"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// NoveltyPipeline embeds its inputs and flags the ones unlike the reference data of a novelty detector, e.g. as
+// a data quality gate that routes unexpected documents to review before they are ingested.
+type NoveltyPipeline struct {
+	Embedder *FeatureExtractionPipeline
+	Detector util.NoveltyDetector
+}
+
+// NoveltyResult is the novelty of an input.
+type NoveltyResult struct {
+	Novel bool    // whether the score is above the threshold of the detector
+	Score float32 // novelty score, the higher the more unlike the reference data
+}
+
+type NoveltyOutput struct {
+	Results []NoveltyResult
+}
+
+func (t *NoveltyOutput) GetOutput() []any {
+	out := make([]any, len(t.Results))
+	for i, result := range t.Results {
+		out[i] = any(result)
+	}
+	return out
+}
+
+// NewNoveltyPipeline creates a novelty pipeline from an embedder and a detector fitted on embeddings of the reference
+// data computed by the same embedder, e.g. a util.KNNNoveltyDetector or a util.GaussianNoveltyDetector.
+func NewNoveltyPipeline(embedder *FeatureExtractionPipeline, detector util.NoveltyDetector) (*NoveltyPipeline, error) {
+	pipeline := &NoveltyPipeline{
+		Embedder: embedder,
+		Detector: detector,
+	}
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *NoveltyPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete novelty output type rather than the interface.
+func (p *NoveltyPipeline) RunPipeline(inputs []string) (*NoveltyOutput, error) {
+	embeddings, err := p.Embedder.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	result := &NoveltyOutput{Results: make([]NoveltyResult, len(inputs))}
+	for i, embedding := range embeddings.Embeddings {
+		novel, score, scoreErr := p.Detector.IsNovel(embedding)
+		if scoreErr != nil {
+			return nil, scoreErr
+		}
+		result.Results[i] = NoveltyResult{Novel: novel, Score: score}
+	}
+	return result, nil
+}
+
+// GetStats returns the runtime statistics of the embedder.
+func (p *NoveltyPipeline) GetStats() []string {
+	return p.Embedder.GetStats()
+}
+
+// GetMetadata returns the metadata of the embedder.
+func (p *NoveltyPipeline) GetMetadata() PipelineMetadata {
+	return p.Embedder.GetMetadata()
+}
+
+// Validate checks that the pipeline has an embedder and a detector.
+func (p *NoveltyPipeline) Validate() error {
+	var validationErrors []error
+	if p.Embedder == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a feature extraction pipeline is required"))
+	}
+	if p.Detector == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a novelty detector is required"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy does nothing, since the embedder is destroyed with its session.
+func (p *NoveltyPipeline) Destroy() error {
+	return nil
+}
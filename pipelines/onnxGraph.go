@@ -0,0 +1,349 @@
+package pipelines
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// OnnxTransform modifies the bytes of an ONNX model before the onnxruntime session is created. Transforms
+// are set on a pipeline with the OnnxTransforms field of its config, and fix small problems of community
+// exports without having to re-export the model with the Python onnx tooling.
+type OnnxTransform func(model []byte) ([]byte, error)
+
+// Field numbers of the ONNX protobuf messages, see https://github.com/onnx/onnx/blob/main/onnx/onnx.proto.
+const (
+	onnxModelGraph           = 7
+	onnxGraphNode            = 1
+	onnxGraphInitializer     = 5
+	onnxGraphInput           = 11
+	onnxGraphOutput          = 12
+	onnxGraphValueInfo       = 13
+	onnxNodeInput            = 1
+	onnxNodeAttribute        = 5
+	onnxAttributeGraph       = 6
+	onnxAttributeGraphs      = 11
+	onnxTensorName           = 8
+	onnxValueInfoName        = 1
+	onnxValueInfoType        = 2
+	onnxTypeTensor           = 1
+	onnxTensorTypeShape      = 2
+	onnxShapeDimension       = 1
+	onnxDimensionValue       = 1
+	onnxDimensionParam       = 2
+	protoWireVarint          = 0
+	protoWireFixed64         = 1
+	protoWireLengthDelimited = 2
+	protoWireFixed32         = 5
+)
+
+// StripOnnxOutputs removes all the outputs of the model graph except the given ones. The nodes that only
+// compute removed outputs are pruned by onnxruntime when the session is created.
+func StripOnnxOutputs(keep ...string) OnnxTransform {
+	return func(model []byte) ([]byte, error) {
+		return editOnnxGraph(model, func(graph []protoField) ([]protoField, error) {
+			keepSet := map[string]bool{}
+			for _, name := range keep {
+				keepSet[name] = false
+			}
+			var edited []protoField
+			for _, field := range graph {
+				if field.number == onnxGraphOutput {
+					name, err := protoString(field.value, onnxValueInfoName)
+					if err != nil {
+						return nil, err
+					}
+					if _, ok := keepSet[name]; !ok {
+						continue
+					}
+					keepSet[name] = true
+				}
+				edited = append(edited, field)
+			}
+			for name, found := range keepSet {
+				if !found {
+					return nil, fmt.Errorf("output %s not found in the model", name)
+				}
+			}
+			return edited, nil
+		})
+	}
+}
+
+// RenameOnnxInput renames an input of the model graph, along with all the references to it in the graph's nodes.
+func RenameOnnxInput(oldName string, newName string) OnnxTransform {
+	return func(model []byte) ([]byte, error) {
+		return editOnnxGraph(model, func(graph []protoField) ([]protoField, error) {
+			found := false
+			for i, field := range graph {
+				if field.number != onnxGraphInput {
+					continue
+				}
+				name, err := protoString(field.value, onnxValueInfoName)
+				if err != nil {
+					return nil, err
+				}
+				if name == oldName {
+					found = true
+					if graph[i].value, err = replaceProtoString(field.value, onnxValueInfoName, oldName, newName); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("input %s not found in the model", oldName)
+			}
+			return renameGraphReferences(graph, oldName, newName)
+		})
+	}
+}
+
+// SetOnnxDynamicAxis makes an axis of an input or output of the model graph dynamic, with the given symbolic name
+// (e.g. "batch_size" or "sequence_length").
+func SetOnnxDynamicAxis(valueName string, axis int, paramName string) OnnxTransform {
+	dimension := appendProtoBytes(nil, onnxDimensionParam, []byte(paramName))
+	return setOnnxDimension(valueName, axis, dimension)
+}
+
+// SetOnnxFixedAxis fixes the size of an axis of an input or output of the model graph.
+func SetOnnxFixedAxis(valueName string, axis int, size int64) OnnxTransform {
+	dimension := appendProtoVarint(nil, onnxDimensionValue, uint64(size))
+	return setOnnxDimension(valueName, axis, dimension)
+}
+
+func setOnnxDimension(valueName string, axis int, dimension []byte) OnnxTransform {
+	return func(model []byte) ([]byte, error) {
+		return editOnnxGraph(model, func(graph []protoField) ([]protoField, error) {
+			found := false
+			for i, field := range graph {
+				if field.number != onnxGraphInput && field.number != onnxGraphOutput {
+					continue
+				}
+				name, err := protoString(field.value, onnxValueInfoName)
+				if err != nil {
+					return nil, err
+				}
+				if name != valueName {
+					continue
+				}
+				found = true
+				graph[i].value, err = editProtoPath(field.value, []int{onnxValueInfoType, onnxTypeTensor, onnxTensorTypeShape}, func(shape []protoField) ([]protoField, error) {
+					dimensionIndex := 0
+					for j, shapeField := range shape {
+						if shapeField.number != onnxShapeDimension {
+							continue
+						}
+						if dimensionIndex == axis {
+							shape[j].value = dimension
+							return shape, nil
+						}
+						dimensionIndex++
+					}
+					return nil, fmt.Errorf("axis %d is out of range for %s, which has %d dimensions", axis, valueName, dimensionIndex)
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("input or output %s not found in the model", valueName)
+			}
+			return graph, nil
+		})
+	}
+}
+
+// applyOnnxTransforms applies the transforms to the model bytes in order.
+func applyOnnxTransforms(model []byte, transforms []OnnxTransform) ([]byte, error) {
+	for _, transform := range transforms {
+		var err error
+		if model, err = transform(model); err != nil {
+			return nil, fmt.Errorf("cannot transform onnx model: %w", err)
+		}
+	}
+	return model, nil
+}
+
+// editOnnxGraph applies edit to the graph of an ONNX model.
+func editOnnxGraph(model []byte, edit func(graph []protoField) ([]protoField, error)) ([]byte, error) {
+	return editProtoPath(model, []int{onnxModelGraph}, edit)
+}
+
+// renameGraphReferences renames the node inputs, initializers and value infos of a graph named oldName,
+// including in the subgraphs of control flow nodes, which can reference names of the outer graph.
+func renameGraphReferences(graph []protoField, oldName string, newName string) ([]protoField, error) {
+	for i, field := range graph {
+		var err error
+		switch field.number {
+		case onnxGraphNode:
+			graph[i].value, err = renameNodeReferences(field.value, oldName, newName)
+		case onnxGraphInitializer:
+			graph[i].value, err = replaceProtoString(field.value, onnxTensorName, oldName, newName)
+		case onnxGraphOutput, onnxGraphValueInfo:
+			graph[i].value, err = replaceProtoString(field.value, onnxValueInfoName, oldName, newName)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return graph, nil
+}
+
+func renameNodeReferences(node []byte, oldName string, newName string) ([]byte, error) {
+	fields, err := parseProto(node)
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range fields {
+		switch field.number {
+		case onnxNodeInput:
+			if string(field.value) == oldName {
+				fields[i].value = []byte(newName)
+			}
+		case onnxNodeAttribute:
+			attribute, attributeErr := parseProto(field.value)
+			if attributeErr != nil {
+				return nil, attributeErr
+			}
+			for j, attributeField := range attribute {
+				if attributeField.number != onnxAttributeGraph && attributeField.number != onnxAttributeGraphs {
+					continue
+				}
+				subgraph, subgraphErr := parseProto(attributeField.value)
+				if subgraphErr != nil {
+					return nil, subgraphErr
+				}
+				if subgraph, subgraphErr = renameGraphReferences(subgraph, oldName, newName); subgraphErr != nil {
+					return nil, subgraphErr
+				}
+				attribute[j].value = encodeProto(subgraph)
+			}
+			fields[i].value = encodeProto(attribute)
+		}
+	}
+	return encodeProto(fields), nil
+}
+
+// protobuf wire format
+
+// protoField is a field of a protobuf message. The value of varint and fixed fields is their encoded bytes,
+// and the value of length-delimited fields is their content.
+type protoField struct {
+	number   int
+	wireType int
+	value    []byte
+}
+
+func parseProto(message []byte) ([]protoField, error) {
+	var fields []protoField
+	for position := 0; position < len(message); {
+		key, n := binary.Uvarint(message[position:])
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf field key")
+		}
+		position += n
+		field := protoField{number: int(key >> 3), wireType: int(key & 7)}
+		var size int
+		switch field.wireType {
+		case protoWireVarint:
+			if _, size = binary.Uvarint(message[position:]); size <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+		case protoWireFixed64:
+			size = 8
+		case protoWireFixed32:
+			size = 4
+		case protoWireLengthDelimited:
+			length, n := binary.Uvarint(message[position:])
+			if n <= 0 {
+				return nil, errors.New("invalid protobuf length")
+			}
+			position += n
+			size = int(length)
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", field.wireType)
+		}
+		if size < 0 || position+size > len(message) {
+			return nil, errors.New("truncated protobuf message")
+		}
+		field.value = message[position : position+size]
+		position += size
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func encodeProto(fields []protoField) []byte {
+	size := 0
+	for _, field := range fields {
+		size += len(field.value) + 2*binary.MaxVarintLen64
+	}
+	message := make([]byte, 0, size)
+	for _, field := range fields {
+		message = binary.AppendUvarint(message, uint64(field.number)<<3|uint64(field.wireType))
+		if field.wireType == protoWireLengthDelimited {
+			message = binary.AppendUvarint(message, uint64(len(field.value)))
+		}
+		message = append(message, field.value...)
+	}
+	return message
+}
+
+func appendProtoBytes(message []byte, number int, value []byte) []byte {
+	return append(message, encodeProto([]protoField{{number: number, wireType: protoWireLengthDelimited, value: value}})...)
+}
+
+func appendProtoVarint(message []byte, number int, value uint64) []byte {
+	return append(message, encodeProto([]protoField{{number: number, wireType: protoWireVarint, value: binary.AppendUvarint(nil, value)}})...)
+}
+
+// protoString returns the first string field with the given number of a message.
+func protoString(message []byte, number int) (string, error) {
+	fields, err := parseProto(message)
+	if err != nil {
+		return "", err
+	}
+	for _, field := range fields {
+		if field.number == number && field.wireType == protoWireLengthDelimited {
+			return string(field.value), nil
+		}
+	}
+	return "", nil
+}
+
+// replaceProtoString replaces the string fields with the given number of a message that are equal to oldValue.
+func replaceProtoString(message []byte, number int, oldValue string, newValue string) ([]byte, error) {
+	fields, err := parseProto(message)
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range fields {
+		if field.number == number && field.wireType == protoWireLengthDelimited && string(field.value) == oldValue {
+			fields[i].value = []byte(newValue)
+		}
+	}
+	return encodeProto(fields), nil
+}
+
+// editProtoPath applies edit to the fields of the nested message found by following the field numbers of path.
+func editProtoPath(message []byte, path []int, edit func([]protoField) ([]protoField, error)) ([]byte, error) {
+	fields, err := parseProto(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		if fields, err = edit(fields); err != nil {
+			return nil, err
+		}
+		return encodeProto(fields), nil
+	}
+	for i, field := range fields {
+		if field.number == path[0] && field.wireType == protoWireLengthDelimited {
+			if fields[i].value, err = editProtoPath(field.value, path[1:], edit); err != nil {
+				return nil, err
+			}
+			return encodeProto(fields), nil
+		}
+	}
+	return nil, fmt.Errorf("field %d not found in onnx model", path[0])
+}
@@ -0,0 +1,355 @@
+package pipelines
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MarshalProto encodes the output as a hugot.v1.FeatureExtractionOutput message of proto/outputs.proto.
+func (t *FeatureExtractionOutput) MarshalProto() []byte {
+	var message []byte
+	for _, embedding := range t.Embeddings {
+		message = appendProtoBytes(message, 1, appendProtoPackedFloats(nil, 1, embedding))
+	}
+	return message
+}
+
+// MarshalProto encodes the output as a hugot.v1.TextClassificationOutput message of proto/outputs.proto.
+func (t *TextClassificationOutput) MarshalProto() []byte {
+	var message []byte
+	for _, classes := range t.ClassificationOutputs {
+		var classesMessage []byte
+		for _, class := range classes {
+			classesMessage = appendProtoBytes(classesMessage, 1, class.marshalProto())
+		}
+		message = appendProtoBytes(message, 1, classesMessage)
+	}
+	return message
+}
+
+func (c ClassificationOutput) marshalProto() []byte {
+	message := appendProtoString(nil, 1, c.Label)
+	message = appendProtoFloat(message, 2, c.Score)
+	for _, label := range c.Path {
+		message = appendProtoString(message, 3, label)
+	}
+	return message
+}
+
+// MarshalProto encodes the output as a hugot.v1.TokenClassificationOutput message of proto/outputs.proto.
+func (t *TokenClassificationOutput) MarshalProto() []byte {
+	var message []byte
+	for _, entities := range t.Entities {
+		var entitiesMessage []byte
+		for _, entity := range entities {
+			entitiesMessage = appendProtoBytes(entitiesMessage, 1, entity.marshalProto())
+		}
+		message = appendProtoBytes(message, 1, entitiesMessage)
+	}
+	return message
+}
+
+func (e Entity) marshalProto() []byte {
+	message := appendProtoString(nil, 1, e.Entity)
+	message = appendProtoFloat(message, 2, e.Score)
+	message = appendProtoPackedFloats(message, 3, e.Scores)
+	message = appendProtoUint(message, 4, uint64(e.Index))
+	message = appendProtoString(message, 5, e.Word)
+	message = appendProtoUint(message, 6, uint64(e.TokenID))
+	message = appendProtoUint(message, 7, uint64(e.Start))
+	message = appendProtoUint(message, 8, uint64(e.End))
+	if e.IsSubword {
+		message = appendProtoVarint(message, 9, 1)
+	}
+	return message
+}
+
+// MarshalProto encodes the output as a hugot.v1.ZeroShotOutput message of proto/outputs.proto.
+func (t *ZeroShotOutput) MarshalProto() []byte {
+	var message []byte
+	for _, output := range t.ClassificationOutputs {
+		outputMessage := appendProtoString(nil, 1, output.Sequence)
+		for _, value := range output.SortedValues {
+			valueMessage := appendProtoString(nil, 1, value.Key)
+			if value.Value != 0 {
+				valueMessage = append(valueMessage, encodeProto([]protoField{{number: 2, wireType: protoWireFixed64, value: binary.LittleEndian.AppendUint64(nil, math.Float64bits(value.Value))}})...)
+			}
+			outputMessage = appendProtoBytes(outputMessage, 2, valueMessage)
+		}
+		message = appendProtoBytes(message, 1, outputMessage)
+	}
+	return message
+}
+
+// MarshalProto encodes the output as a hugot.v1.QualityScoringOutput message of proto/outputs.proto.
+func (t *QualityScoringOutput) MarshalProto() []byte {
+	var message []byte
+	for _, score := range t.Scores {
+		message = appendProtoBytes(message, 1, appendProtoFloat(nil, 1, score.Score))
+	}
+	return message
+}
+
+// The following helpers omit fields with default values, as proto3 encoders do.
+
+func appendProtoString(message []byte, number int, value string) []byte {
+	if value == "" {
+		return message
+	}
+	return appendProtoBytes(message, number, []byte(value))
+}
+
+func appendProtoUint(message []byte, number int, value uint64) []byte {
+	if value == 0 {
+		return message
+	}
+	return appendProtoVarint(message, number, value)
+}
+
+func appendProtoFloat(message []byte, number int, value float32) []byte {
+	if value == 0 {
+		return message
+	}
+	return append(message, encodeProto([]protoField{{number: number, wireType: protoWireFixed32, value: binary.LittleEndian.AppendUint32(nil, math.Float32bits(value))}})...)
+}
+
+func appendProtoPackedFloats(message []byte, number int, values []float32) []byte {
+	if len(values) == 0 {
+		return message
+	}
+	packed := make([]byte, 0, 4*len(values))
+	for _, value := range values {
+		packed = binary.LittleEndian.AppendUint32(packed, math.Float32bits(value))
+	}
+	return appendProtoBytes(message, number, packed)
+}
+
+// UnmarshalProto decodes a hugot.v1.FeatureExtractionOutput message into the output.
+func (t *FeatureExtractionOutput) UnmarshalProto(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	t.Embeddings = nil
+	for _, field := range protoMessages(fields, 1) {
+		embedding := []float32{}
+		embeddingFields, embeddingErr := parseProto(field.value)
+		if embeddingErr != nil {
+			return fmt.Errorf("cannot decode embedding %d: %w", len(t.Embeddings), embeddingErr)
+		}
+		for _, embeddingField := range embeddingFields {
+			if embeddingField.number == 1 {
+				if embedding, err = appendProtoFloats(embedding, embeddingField); err != nil {
+					return err
+				}
+			}
+		}
+		t.Embeddings = append(t.Embeddings, embedding)
+	}
+	return nil
+}
+
+// UnmarshalProto decodes a hugot.v1.TextClassificationOutput message into the output.
+func (t *TextClassificationOutput) UnmarshalProto(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	t.ClassificationOutputs = nil
+	for _, field := range protoMessages(fields, 1) {
+		classesFields, classesErr := parseProto(field.value)
+		if classesErr != nil {
+			return fmt.Errorf("cannot decode the classes of input %d: %w", len(t.ClassificationOutputs), classesErr)
+		}
+		classes := []ClassificationOutput{}
+		for _, classField := range protoMessages(classesFields, 1) {
+			var class ClassificationOutput
+			if err = class.unmarshalProto(classField.value); err != nil {
+				return fmt.Errorf("cannot decode the classes of input %d: %w", len(t.ClassificationOutputs), err)
+			}
+			classes = append(classes, class)
+		}
+		t.ClassificationOutputs = append(t.ClassificationOutputs, classes)
+	}
+	return nil
+}
+
+func (c *ClassificationOutput) unmarshalProto(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		switch {
+		case field.number == 1 && field.wireType == protoWireLengthDelimited:
+			c.Label = string(field.value)
+		case field.number == 2 && field.wireType == protoWireFixed32:
+			c.Score = protoFloat(field)
+		case field.number == 3 && field.wireType == protoWireLengthDelimited:
+			c.Path = append(c.Path, string(field.value))
+		}
+	}
+	return nil
+}
+
+// UnmarshalProto decodes a hugot.v1.TokenClassificationOutput message into the output.
+func (t *TokenClassificationOutput) UnmarshalProto(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	t.Entities = nil
+	for _, field := range protoMessages(fields, 1) {
+		entitiesFields, entitiesErr := parseProto(field.value)
+		if entitiesErr != nil {
+			return fmt.Errorf("cannot decode the entities of input %d: %w", len(t.Entities), entitiesErr)
+		}
+		entities := []Entity{}
+		for _, entityField := range protoMessages(entitiesFields, 1) {
+			var entity Entity
+			if err = entity.unmarshalProto(entityField.value); err != nil {
+				return fmt.Errorf("cannot decode the entities of input %d: %w", len(t.Entities), err)
+			}
+			entities = append(entities, entity)
+		}
+		t.Entities = append(t.Entities, entities)
+	}
+	return nil
+}
+
+func (e *Entity) unmarshalProto(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if field.number == 3 {
+			if e.Scores, err = appendProtoFloats(e.Scores, field); err != nil {
+				return err
+			}
+			continue
+		}
+		var value uint64
+		if field.wireType == protoWireVarint {
+			value, _ = binary.Uvarint(field.value)
+		}
+		switch {
+		case field.number == 1 && field.wireType == protoWireLengthDelimited:
+			e.Entity = string(field.value)
+		case field.number == 2 && field.wireType == protoWireFixed32:
+			e.Score = protoFloat(field)
+		case field.number == 4 && field.wireType == protoWireVarint:
+			e.Index = int(int64(value))
+		case field.number == 5 && field.wireType == protoWireLengthDelimited:
+			e.Word = string(field.value)
+		case field.number == 6 && field.wireType == protoWireVarint:
+			e.TokenID = uint32(value)
+		case field.number == 7 && field.wireType == protoWireVarint:
+			e.Start = uint(value)
+		case field.number == 8 && field.wireType == protoWireVarint:
+			e.End = uint(value)
+		case field.number == 9 && field.wireType == protoWireVarint:
+			e.IsSubword = value != 0
+		}
+	}
+	return nil
+}
+
+// UnmarshalProto decodes a hugot.v1.ZeroShotOutput message into the output.
+func (t *ZeroShotOutput) UnmarshalProto(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	t.ClassificationOutputs = nil
+	for _, field := range protoMessages(fields, 1) {
+		outputFields, outputErr := parseProto(field.value)
+		if outputErr != nil {
+			return fmt.Errorf("cannot decode the output of input %d: %w", len(t.ClassificationOutputs), outputErr)
+		}
+		var output ZeroShotClassificationOutput
+		for _, outputField := range outputFields {
+			switch {
+			case outputField.number == 1 && outputField.wireType == protoWireLengthDelimited:
+				output.Sequence = string(outputField.value)
+			case outputField.number == 2 && outputField.wireType == protoWireLengthDelimited:
+				valueFields, valueErr := parseProto(outputField.value)
+				if valueErr != nil {
+					return fmt.Errorf("cannot decode the output of input %d: %w", len(t.ClassificationOutputs), valueErr)
+				}
+				var value struct {
+					Key   string
+					Value float64
+				}
+				for _, valueField := range valueFields {
+					switch {
+					case valueField.number == 1 && valueField.wireType == protoWireLengthDelimited:
+						value.Key = string(valueField.value)
+					case valueField.number == 2 && valueField.wireType == protoWireFixed64:
+						value.Value = math.Float64frombits(binary.LittleEndian.Uint64(valueField.value))
+					}
+				}
+				output.SortedValues = append(output.SortedValues, value)
+			}
+		}
+		t.ClassificationOutputs = append(t.ClassificationOutputs, output)
+	}
+	return nil
+}
+
+// UnmarshalProto decodes a hugot.v1.QualityScoringOutput message into the output.
+func (t *QualityScoringOutput) UnmarshalProto(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	t.Scores = nil
+	for _, field := range protoMessages(fields, 1) {
+		scoreFields, scoreErr := parseProto(field.value)
+		if scoreErr != nil {
+			return fmt.Errorf("cannot decode score %d: %w", len(t.Scores), scoreErr)
+		}
+		var score QualityScore
+		for _, scoreField := range scoreFields {
+			if scoreField.number == 1 && scoreField.wireType == protoWireFixed32 {
+				score.Score = protoFloat(scoreField)
+			}
+		}
+		t.Scores = append(t.Scores, score)
+	}
+	return nil
+}
+
+// protoMessages returns the embedded messages of the fields with the given number.
+func protoMessages(fields []protoField, number int) []protoField {
+	var messages []protoField
+	for _, field := range fields {
+		if field.number == number && field.wireType == protoWireLengthDelimited {
+			messages = append(messages, field)
+		}
+	}
+	return messages
+}
+
+func protoFloat(field protoField) float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(field.value))
+}
+
+// appendProtoFloats decodes the floats of a packed or of a single repeated field.
+func appendProtoFloats(values []float32, field protoField) ([]float32, error) {
+	switch field.wireType {
+	case protoWireFixed32:
+		return append(values, protoFloat(field)), nil
+	case protoWireLengthDelimited:
+		if len(field.value)%4 != 0 {
+			return nil, errors.New("packed floats must have a length that is a multiple of 4")
+		}
+		for position := 0; position < len(field.value); position += 4 {
+			values = append(values, math.Float32frombits(binary.LittleEndian.Uint32(field.value[position:])))
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected wire type %d for field %d", field.wireType, field.number)
+}
@@ -12,12 +12,15 @@ import (
 	ort "github.com/yalue/onnxruntime_go"
 
 	util "github.com/knights-analytics/hugot/utils"
+
+	jsoniter "github.com/json-iterator/go"
 )
 
 // BasePipeline can be embedded by a pipeline.
 type basePipeline struct {
 	ModelPath        string
 	OnnxFilename     string
+	OnnxTransforms   []OnnxTransform
 	PipelineName     string
 	OrtSession       *ort.DynamicAdvancedSession
 	OrtOptions       *ort.SessionOptions
@@ -27,6 +30,8 @@ type basePipeline struct {
 	OutputsMeta      []ort.InputOutputInfo
 	TokenizerTimings *timings
 	PipelineTimings  *timings
+	PipelineMemory   *MemoryStats
+	Remote           *RemoteBackend
 }
 
 type OutputInfo struct {
@@ -57,10 +62,37 @@ type PipelineOption[T Pipeline] func(eo T)
 // PipelineConfig is a configuration for a pipeline type that can be used
 // to create that pipeline.
 type PipelineConfig[T Pipeline] struct {
-	ModelPath    string
-	Name         string
-	OnnxFilename string
-	Options      []PipelineOption[T]
+	ModelPath      string
+	Name           string
+	OnnxFilename   string
+	OnnxTransforms []OnnxTransform // applied in order to the onnx model before the session is created
+	Remote         *RemoteBackend  // runs the model on an inference server rather than with onnxruntime
+	CPUPlacement   *CPUPlacement   // set by the session when a CPU placement threshold is configured
+	EngineCache    *EngineCache    // set by the session when an engine cache is configured
+	Options        []PipelineOption[T]
+}
+
+// CPUPlacement keeps the pipelines whose graphs are smaller than Bytes in total on the CPU, with the session
+// options CPUOptions instead of the options of the configured execution provider.
+type CPUPlacement struct {
+	Bytes      int64
+	CPUOptions *ort.SessionOptions
+}
+
+// sessionOptions returns the options to create the sessions of a pipeline with, given every graph the pipeline
+// loads. The CPU options are returned if the graphs are smaller than the threshold in total, options otherwise.
+func (c *CPUPlacement) sessionOptions(options *ort.SessionOptions, graphs ...[]byte) *ort.SessionOptions {
+	if c == nil || c.CPUOptions == nil {
+		return options
+	}
+	var size int64
+	for _, graph := range graphs {
+		size += int64(len(graph))
+	}
+	if size < c.Bytes {
+		return c.CPUOptions
+	}
+	return options
 }
 
 type timings struct {
@@ -86,6 +118,7 @@ type PipelineBatch struct {
 	InputTensors      []*ort.Tensor[int64]
 	MaxSequenceLength int
 	OutputTensors     []*ort.Tensor[float32]
+	windows           []int // input of each window, for pipelines that split long inputs into windows
 }
 
 func (b *PipelineBatch) Destroy() error {
@@ -119,38 +152,48 @@ func loadTokenizer(modelPath string) (*tokenizers.Tokenizer, error) {
 	return tk, nil
 }
 
-func loadOnnxModelBytes(modelPath string, modelFilename string) ([]byte, error) {
+// GetOnnxModelPath returns the path to the .onnx file that a pipeline created from modelPath and
+// onnxFilename would load.
+func GetOnnxModelPath(modelPath string, onnxFilename string) (string, error) {
 	var modelOnnxFile string
 	onnxFiles, err := getOnnxFiles(modelPath)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if len(onnxFiles) == 0 {
-		return nil, fmt.Errorf("no .onnx file detected at %s. There should be exactly .onnx file", modelPath)
+		return "", fmt.Errorf("no .onnx file detected at %s. There should be exactly .onnx file", modelPath)
 	}
 	if len(onnxFiles) > 1 {
-		if modelFilename == "" {
-			return nil, fmt.Errorf("multiple .onnx file detected at %s and no OnnxFilename specified", modelPath)
+		if onnxFilename == "" {
+			return "", fmt.Errorf("multiple .onnx file detected at %s and no OnnxFilename specified", modelPath)
 		}
 		modelNameFound := false
 		for i := range onnxFiles {
-			if onnxFiles[i][1] == modelFilename {
+			if onnxFiles[i][1] == onnxFilename {
 				modelNameFound = true
 				modelOnnxFile = util.PathJoinSafe(onnxFiles[i]...)
 			}
 		}
 		if !modelNameFound {
-			return nil, fmt.Errorf("file %s not found at %s", modelFilename, modelPath)
+			return "", fmt.Errorf("file %s not found at %s", onnxFilename, modelPath)
 		}
 	} else {
 		modelOnnxFile = util.PathJoinSafe(onnxFiles[0]...)
 	}
+	return modelOnnxFile, nil
+}
+
+func loadOnnxModelBytes(modelPath string, modelFilename string, transforms []OnnxTransform) ([]byte, error) {
+	modelOnnxFile, err := GetOnnxModelPath(modelPath, modelFilename)
+	if err != nil {
+		return nil, err
+	}
 
 	onnxBytes, err := util.ReadFileBytes(modelOnnxFile)
 	if err != nil {
 		return nil, err
 	}
-	return onnxBytes, err
+	return applyOnnxTransforms(onnxBytes, transforms)
 }
 
 func loadInputOutputMeta(onnxBytes []byte) ([]ort.InputOutputInfo, []ort.InputOutputInfo, error) {
@@ -179,6 +222,14 @@ func createSession(onnxBytes []byte, inputs, outputs []ort.InputOutputInfo, opti
 	return session, err
 }
 
+// createSession creates the onnxruntime session of the pipeline, unless its model only runs on a remote backend.
+func (p *basePipeline) createSession(cache *EngineCache, onnxBytes []byte, inputs, outputs []ort.InputOutputInfo, options *ort.SessionOptions) (*ort.DynamicAdvancedSession, error) {
+	if p.Remote != nil && !p.Remote.hybrid() {
+		return nil, nil
+	}
+	return cache.createSession(onnxBytes, inputs, outputs, options)
+}
+
 func getOnnxFiles(path string) ([][]string, error) {
 	var onnxFiles [][]string
 	walker := func(_ context.Context, _ string, parent string, info os.FileInfo, _ io.Reader) (toContinue bool, err error) {
@@ -191,6 +242,38 @@ func getOnnxFiles(path string) ([][]string, error) {
 	return onnxFiles, err
 }
 
+// readSpecialToken reads a special token, such as sep_token or mask_token, from the special_tokens_map.json of a model.
+func readSpecialToken(modelPath string, name string) (string, error) {
+	specialTokensBytes, err := util.ReadFileBytes(util.PathJoinSafe(modelPath, "special_tokens_map.json"))
+	if err != nil {
+		return "", fmt.Errorf("cannot read special_tokens_map.json at %s", modelPath)
+	}
+	var specialTokens map[string]any
+	if err = jsoniter.Unmarshal(specialTokensBytes, &specialTokens); err != nil {
+		return "", fmt.Errorf("cannot unmarshal special_tokens_map.json at %s", modelPath)
+	}
+	token, ok := specialTokens[name]
+	if !ok {
+		return "", fmt.Errorf("no %s detected in special_tokens_map.json at %s", name, modelPath)
+	}
+	switch v := token.(type) {
+	case map[string]any:
+		content, ok := v["content"]
+		if !ok {
+			return "", fmt.Errorf("%s is map but no content field is available", name)
+		}
+		contentString, ok := content.(string)
+		if !ok {
+			return "", fmt.Errorf("%s cannot be converted to string: %v", name, content)
+		}
+		return contentString, nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("%s has unexpected type: %v", name, v)
+	}
+}
+
 func tokenizeInputs(batch *PipelineBatch, tk *tokenizers.Tokenizer, inputs []string, options []tokenizers.EncodeOption) {
 	outputs := make([]tokenizedInput, len(inputs))
 	maxSequence := 0
@@ -345,12 +428,30 @@ func runSessionOnBatch(batch *PipelineBatch, session *ort.DynamicAdvancedSession
 	return nil
 }
 
+// runOnBatch runs the model on the batch with the onnxruntime session of the pipeline, on its remote backend, or on
+// either with a hybrid execution policy.
+func (p *basePipeline) runOnBatch(batch *PipelineBatch, outputs []ort.InputOutputInfo) error {
+	switch {
+	case p.Remote == nil:
+		return runSessionOnBatch(batch, p.OrtSession, outputs)
+	case p.OrtSession == nil:
+		return p.Remote.run(batch, p.InputsMeta, outputs)
+	default:
+		return p.Remote.runHybrid(batch, p.InputsMeta, outputs, func() error {
+			return runSessionOnBatch(batch, p.OrtSession, outputs)
+		})
+	}
+}
+
 func destroySession(tk *tokenizers.Tokenizer, session *ort.DynamicAdvancedSession) error {
 	var finalErr error
 	errTokenizer := tk.Close()
 	if errTokenizer != nil {
 		finalErr = errTokenizer
 	}
+	if session == nil {
+		return finalErr
+	}
 	ortError := session.Destroy()
 	if ortError != nil {
 		finalErr = ortError
@@ -0,0 +1,117 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// KeywordPrefilterPipeline matches its inputs against a keyword list before running a pipeline on them, e.g. a
+// profanity list in front of a toxicity classifier. Every output is annotated with the keyword matches of its
+// input, and with a SkipStrategy the inputs that are obviously in or out of scope for the model are not run
+// through it, which reduces the inference load of moderation workloads.
+type KeywordPrefilterPipeline struct {
+	Pipeline     Pipeline
+	Matcher      *util.KeywordMatcher
+	SkipStrategy string // NONE runs all inputs, MATCHED skips inputs with a match, UNMATCHED skips inputs without a match
+}
+
+// PrefilteredOutput is the output of an input of a KeywordPrefilterPipeline.
+type PrefilteredOutput struct {
+	Matches []util.KeywordMatch // keyword matches in the input
+	Skipped bool                // whether the input was not run through the pipeline
+	Output  any                 // output of the pipeline for the input, nil if it was skipped
+}
+
+type KeywordPrefilterOutput struct {
+	Outputs []PrefilteredOutput
+}
+
+func (t *KeywordPrefilterOutput) GetOutput() []any {
+	out := make([]any, len(t.Outputs))
+	for i, output := range t.Outputs {
+		out[i] = any(output)
+	}
+	return out
+}
+
+// NewKeywordPrefilterPipeline creates a prefilter matching the keywords case-insensitively as whole words in front
+// of the pipeline. The skip strategy is NONE, MATCHED or UNMATCHED.
+func NewKeywordPrefilterPipeline(pipeline Pipeline, keywords []string, skipStrategy string) (*KeywordPrefilterPipeline, error) {
+	prefilter := &KeywordPrefilterPipeline{
+		Pipeline:     pipeline,
+		Matcher:      util.NewKeywordMatcher(keywords, true, true),
+		SkipStrategy: skipStrategy,
+	}
+	if err := prefilter.Validate(); err != nil {
+		return nil, err
+	}
+	return prefilter, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *KeywordPrefilterPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete keyword prefilter output type rather than the interface.
+func (p *KeywordPrefilterPipeline) RunPipeline(inputs []string) (*KeywordPrefilterOutput, error) {
+	result := &KeywordPrefilterOutput{Outputs: make([]PrefilteredOutput, len(inputs))}
+	var modelInputs []string
+	var modelIndices []int
+	for i, input := range inputs {
+		matches := p.Matcher.FindAll(input)
+		result.Outputs[i].Matches = matches
+		switch {
+		case p.SkipStrategy == "MATCHED" && len(matches) > 0, p.SkipStrategy == "UNMATCHED" && len(matches) == 0:
+			result.Outputs[i].Skipped = true
+		default:
+			modelInputs = append(modelInputs, input)
+			modelIndices = append(modelIndices, i)
+		}
+	}
+	if len(modelInputs) == 0 {
+		return result, nil
+	}
+	output, err := p.Pipeline.Run(modelInputs)
+	if err != nil {
+		return nil, err
+	}
+	for i, modelOutput := range output.GetOutput() {
+		result.Outputs[modelIndices[i]].Output = modelOutput
+	}
+	return result, nil
+}
+
+// GetStats returns the runtime statistics of the wrapped pipeline.
+func (p *KeywordPrefilterPipeline) GetStats() []string {
+	return p.Pipeline.GetStats()
+}
+
+// GetMetadata returns the metadata of the wrapped pipeline.
+func (p *KeywordPrefilterPipeline) GetMetadata() PipelineMetadata {
+	return p.Pipeline.GetMetadata()
+}
+
+// Validate checks the wrapped pipeline, the matcher and the skip strategy.
+func (p *KeywordPrefilterPipeline) Validate() error {
+	var validationErrors []error
+	if p.Pipeline == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a pipeline to prefilter is required"))
+	}
+	if p.Matcher == nil {
+		validationErrors = append(validationErrors, errors.New("pipeline configuration invalid: a keyword matcher is required"))
+	}
+	switch p.SkipStrategy {
+	case "NONE", "MATCHED", "UNMATCHED":
+	default:
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: skip strategy %s is not supported", p.SkipStrategy))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Destroy does nothing, since the wrapped pipeline is destroyed with its session.
+func (p *KeywordPrefilterPipeline) Destroy() error {
+	return nil
+}
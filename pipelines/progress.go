@@ -0,0 +1,54 @@
+package pipelines
+
+import (
+	"errors"
+	"time"
+)
+
+// Progress describes how far a long-running run has got.
+type Progress struct {
+	Processed int           // number of inputs processed so far
+	Total     int           // total number of inputs to process
+	Elapsed   time.Duration // time elapsed since the start of the run
+	ETA       time.Duration // estimated time until the run completes
+}
+
+// ProgressCallback is called with the current progress of a long-running run.
+type ProgressCallback func(Progress)
+
+// NewProgress computes the progress of a run started at start, extrapolating the ETA
+// from the throughput so far.
+func NewProgress(processed int, total int, start time.Time) Progress {
+	progress := Progress{
+		Processed: processed,
+		Total:     total,
+		Elapsed:   time.Since(start),
+	}
+	if processed > 0 && total > processed {
+		progress.ETA = time.Duration(float64(progress.Elapsed) * float64(total-processed) / float64(processed))
+	}
+	return progress
+}
+
+// RunWithProgress runs the pipeline on inputs in batches of batchSize, calling callback after each
+// batch so that callers can report the progress of large runs. It returns the concatenated outputs
+// of all batches, as returned by GetOutput.
+func RunWithProgress(p Pipeline, inputs []string, batchSize int, callback ProgressCallback) ([]any, error) {
+	if batchSize <= 0 {
+		return nil, errors.New("batch size must be greater than zero")
+	}
+	start := time.Now()
+	outputs := make([]any, 0, len(inputs))
+	for batchStart := 0; batchStart < len(inputs); batchStart += batchSize {
+		batchEnd := min(batchStart+batchSize, len(inputs))
+		batchOutput, err := p.Run(inputs[batchStart:batchEnd])
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, batchOutput.GetOutput()...)
+		if callback != nil {
+			callback(NewProgress(batchEnd, len(inputs), start))
+		}
+	}
+	return outputs, nil
+}
@@ -0,0 +1,215 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/daulet/tokenizers"
+)
+
+// ContextOrder is the order of the chunks packed into a prompt by a PromptAssembler.
+type ContextOrder string
+
+const (
+	ContextByRelevance ContextOrder = "RELEVANCE" // most relevant first, in the order of the retrieved chunks
+	ContextBySource    ContextOrder = "SOURCE"    // grouped by document, in the order of their text in the document
+	ContextAtEdges     ContextOrder = "EDGES"     // most relevant at the start and at the end, least relevant in the middle
+)
+
+// ContextTruncation is what a PromptAssembler does with the first chunk that does not fit in the token budget.
+type ContextTruncation string
+
+const (
+	SkipOverflow     ContextTruncation = "SKIP"     // skip the chunk, and pack the next ones that fit
+	StopAtOverflow   ContextTruncation = "STOP"     // stop packing
+	TruncateOverflow ContextTruncation = "TRUNCATE" // cut the chunk to the tokens left, and stop packing
+)
+
+// PromptAssembler packs retrieved chunks into the prompt of a generation model, within a budget of tokens counted
+// with the tokenizer of the model, most relevant chunks first. The budget is usually the context length of the
+// model minus the tokens to generate, and for chat pipelines minus the tokens of the chat template. Each chunk is
+// numbered in the prompt, so that the model can cite it, and the chunks of the packed prompt keep their source
+// spans to resolve the citations.
+type PromptAssembler struct {
+	Template       string // the prompt, with {context} and {question} placeholders
+	ChunkTemplate  string // each chunk of the context, with {n}, {document} and {text} placeholders
+	Separator      string // between the chunks of the context
+	MaxTokens      int    // tokens of the prompt, special tokens included
+	MinChunkTokens int    // truncated chunks with fewer tokens than this are left out, 16 by default
+	Order          ContextOrder
+	Truncation     ContextTruncation
+	tokenizer      *tokenizers.Tokenizer
+}
+
+// PackedPrompt is a prompt assembled from retrieved chunks.
+type PackedPrompt struct {
+	Prompt    string
+	Chunks    []RetrievedChunk // the chunks of the context in their order, numbered from 1
+	Tokens    int              // tokens of the prompt, special tokens included
+	Dropped   int              // number of chunks left out of the prompt
+	Truncated bool             // whether a chunk was cut to fit, its offsets being those of the text kept
+}
+
+// NewPromptAssembler creates a prompt assembler for the generation model at modelPath, whose tokenizer.json counts
+// the tokens, with a budget of maxTokens tokens. The chunks are ordered by relevance and the chunk that overflows
+// is truncated by default.
+func NewPromptAssembler(modelPath string, maxTokens int) (*PromptAssembler, error) {
+	if maxTokens <= 0 {
+		return nil, errors.New("the token budget of the prompt must be greater than zero")
+	}
+	// the token counts of long texts must not be truncated to the maximum length of the tokenizer
+	tk, err := loadTokenizerWithoutTruncation(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	return &PromptAssembler{
+		Template:       "Answer the question using the sources below, and cite the sources you use as [n].\n\n{context}\n\nQuestion: {question}\nAnswer:",
+		ChunkTemplate:  "[{n}] {text}",
+		Separator:      "\n\n",
+		MaxTokens:      maxTokens,
+		MinChunkTokens: 16,
+		Order:          ContextByRelevance,
+		Truncation:     TruncateOverflow,
+		tokenizer:      tk,
+	}, nil
+}
+
+// Destroy closes the tokenizer of the assembler.
+func (a *PromptAssembler) Destroy() error {
+	return a.tokenizer.Close()
+}
+
+// Pack assembles the prompt of a question from chunks sorted by decreasing relevance, e.g. the results of
+// Retriever.Retrieve. The chunks are picked by relevance until the budget is spent, as set by Truncation, and
+// then ordered as set by Order.
+func (a *PromptAssembler) Pack(question string, chunks []RetrievedChunk) (*PackedPrompt, error) {
+	fixedTokens := a.countTokens(a.render(question, nil), true)
+	if fixedTokens > a.MaxTokens {
+		return nil, fmt.Errorf("the prompt takes %d tokens without context, over the budget of %d tokens", fixedTokens, a.MaxTokens)
+	}
+	separatorTokens := a.countTokens(a.Separator, false)
+	remaining := a.MaxTokens - fixedTokens
+	var selected []RetrievedChunk
+	truncated := false
+	for _, chunk := range chunks {
+		// chunks are counted with the largest number they may get
+		cost := a.countTokens(a.formatChunk(len(chunks), chunk), false)
+		if len(selected) > 0 {
+			cost += separatorTokens
+		}
+		if cost <= remaining {
+			selected = append(selected, chunk)
+			remaining -= cost
+			continue
+		}
+		if a.Truncation == SkipOverflow {
+			continue
+		}
+		if a.Truncation == TruncateOverflow {
+			overhead := cost - a.countTokens(chunk.Text, false)
+			if cut, ok := a.truncate(chunk, remaining-overhead); ok {
+				selected = append(selected, cut)
+				truncated = true
+			}
+		}
+		break
+	}
+	packed := len(selected)
+
+	// the counts of the parts may differ slightly from the count of the whole prompt, so the least relevant
+	// chunks are left out until it fits
+	for {
+		ordered := a.order(selected)
+		prompt := a.render(question, ordered)
+		tokens := a.countTokens(prompt, true)
+		if tokens <= a.MaxTokens || len(selected) == 0 {
+			if tokens > a.MaxTokens {
+				return nil, fmt.Errorf("the prompt takes %d tokens, over the budget of %d tokens", tokens, a.MaxTokens)
+			}
+			return &PackedPrompt{
+				Prompt:    prompt,
+				Chunks:    ordered,
+				Tokens:    tokens,
+				Dropped:   len(chunks) - len(selected),
+				Truncated: truncated && len(selected) == packed, // the truncated chunk is the last one packed
+			}, nil
+		}
+		selected = selected[:len(selected)-1]
+	}
+}
+
+// truncate cuts the text of a chunk to its first tokens, if there are at least MinChunkTokens of them.
+func (a *PromptAssembler) truncate(chunk RetrievedChunk, maxTokens int) (RetrievedChunk, bool) {
+	if maxTokens <= 0 || maxTokens < a.MinChunkTokens {
+		return chunk, false
+	}
+	encoding := a.tokenizer.EncodeWithOptions(chunk.Text, false, tokenizers.WithReturnOffsets())
+	if maxTokens >= len(encoding.Offsets) {
+		return chunk, true
+	}
+	end := int(encoding.Offsets[maxTokens-1][1])
+	if end <= 0 || end > len(chunk.Text) {
+		return chunk, false
+	}
+	chunk.Text = chunk.Text[:end]
+	chunk.End = chunk.Start + end
+	return chunk, true
+}
+
+// order returns the chunks, sorted by decreasing relevance, in the order of the context.
+func (a *PromptAssembler) order(chunks []RetrievedChunk) []RetrievedChunk {
+	ordered := make([]RetrievedChunk, 0, len(chunks))
+	switch a.Order {
+	case ContextBySource:
+		ordered = append(ordered, chunks...)
+		documentRanks := map[string]int{}
+		for i, chunk := range chunks {
+			if _, ok := documentRanks[chunk.DocumentID]; !ok {
+				documentRanks[chunk.DocumentID] = i
+			}
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			if ordered[i].DocumentID != ordered[j].DocumentID {
+				return documentRanks[ordered[i].DocumentID] < documentRanks[ordered[j].DocumentID]
+			}
+			return ordered[i].Start < ordered[j].Start
+		})
+	case ContextAtEdges:
+		// models attend most to the start and the end of long contexts, so the most relevant chunks alternate
+		// between them
+		var end []RetrievedChunk
+		for i, chunk := range chunks {
+			if i%2 == 0 {
+				ordered = append(ordered, chunk)
+			} else {
+				end = append(end, chunk)
+			}
+		}
+		for i := len(end) - 1; i >= 0; i-- {
+			ordered = append(ordered, end[i])
+		}
+	default:
+		ordered = append(ordered, chunks...)
+	}
+	return ordered
+}
+
+// render fills the template with the question and the numbered chunks.
+func (a *PromptAssembler) render(question string, chunks []RetrievedChunk) string {
+	formatted := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		formatted[i] = a.formatChunk(i+1, chunk)
+	}
+	return strings.NewReplacer("{context}", strings.Join(formatted, a.Separator), "{question}", question).Replace(a.Template)
+}
+
+func (a *PromptAssembler) formatChunk(n int, chunk RetrievedChunk) string {
+	return strings.NewReplacer("{n}", strconv.Itoa(n), "{document}", chunk.DocumentID, "{text}", chunk.Text).Replace(a.ChunkTemplate)
+}
+
+func (a *PromptAssembler) countTokens(text string, addSpecialTokens bool) int {
+	return len(a.tokenizer.EncodeWithOptions(text, addSpecialTokens).IDs)
+}
@@ -0,0 +1,122 @@
+package pipelines
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// promptCache keeps the past key values of the last generated sequences of a text generation pipeline, keyed by
+// their tokens, so that a new prompt starting with the same tokens, e.g. the same system prompt or the previous
+// turns of a chat, only runs the model on the tokens that follow them. Sequences are evicted least recently used
+// first.
+type promptCache struct {
+	maxEntries   int
+	entries      []*promptCacheEntry // least recently used first
+	hits         uint64
+	misses       uint64
+	reusedTokens uint64
+	mutex        sync.Mutex
+}
+
+type promptCacheEntry struct {
+	tokens []int64 // the tokens whose past key values are in the cache
+	cache  *kvCache
+}
+
+// startCache returns the cache to generate the text of a prompt from: a copy of the past key values of the longest
+// prefix of the prompt in the prompt cache, or an empty cache. The last token of the prompt is always run, to get
+// the logits of the first generated token.
+func (p *TextGenerationPipeline) startCache(prompt []int64) (*kvCache, error) {
+	c := p.promptCache
+	if c == nil {
+		return &kvCache{past: map[int]ort.Value{}}, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	best, bestLength := -1, 0
+	for i, entry := range c.entries {
+		length := commonPrefixLength(entry.tokens, prompt[:max(len(prompt)-1, 0)])
+		if length > bestLength {
+			best, bestLength = i, length
+		}
+	}
+	if best < 0 {
+		atomic.AddUint64(&c.misses, 1)
+		return &kvCache{past: map[int]ort.Value{}}, nil
+	}
+	entry := c.entries[best]
+	cache, err := p.copyCachePrefix(entry.cache, bestLength)
+	if err != nil {
+		return nil, err
+	}
+	c.touch(best)
+	atomic.AddUint64(&c.hits, 1)
+	atomic.AddUint64(&c.reusedTokens, uint64(bestLength))
+	return cache, nil
+}
+
+// endCache adds the cache of a generated sequence, whose tokens start with the ones in the cache, to the prompt
+// cache, or destroys it if the pipeline has no prompt cache or already caches these tokens.
+func (p *TextGenerationPipeline) endCache(cache *kvCache, sequence []int64) error {
+	c := p.promptCache
+	if c == nil || cache.tokens == 0 {
+		return cache.destroy()
+	}
+	tokens := append([]int64{}, sequence[:cache.tokens]...)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, entry := range c.entries {
+		if commonPrefixLength(entry.tokens, tokens) == len(tokens) {
+			c.touch(i)
+			return cache.destroy()
+		}
+	}
+	var err error
+	// the entries whose tokens are a prefix of the new ones are redundant
+	kept := c.entries[:0]
+	for _, entry := range c.entries {
+		if commonPrefixLength(entry.tokens, tokens) == len(entry.tokens) {
+			err = errors.Join(err, entry.cache.destroy())
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	c.entries = append(kept, &promptCacheEntry{tokens: tokens, cache: cache})
+	for len(c.entries) > c.maxEntries {
+		err = errors.Join(err, c.entries[0].cache.destroy())
+		c.entries = c.entries[1:]
+	}
+	return err
+}
+
+// touch marks an entry as the most recently used.
+func (c *promptCache) touch(index int) {
+	entry := c.entries[index]
+	c.entries = append(append(c.entries[:index], c.entries[index+1:]...), entry)
+}
+
+// destroy frees the past key values of all the entries.
+func (c *promptCache) destroy() error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var err error
+	for _, entry := range c.entries {
+		err = errors.Join(err, entry.cache.destroy())
+	}
+	c.entries = nil
+	return err
+}
+
+func commonPrefixLength(a []int64, b []int64) int {
+	length := 0
+	for length < len(a) && length < len(b) && a[length] == b[length] {
+		length++
+	}
+	return length
+}
@@ -0,0 +1,114 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// PromptInjectionPipeline is a preset for detecting prompt injection and jailbreak attempts in user inputs before
+// they are sent to an LLM. It combines a prompt injection classifier, such as protectai/deberta-v3-base-prompt-injection-v2,
+// with regular expressions matching well-known injection phrasings, which catch attempts that the classifier may
+// miss and explain why an input was flagged. The risk of an input is the noisy-or of the classifier's score and of
+// HeuristicWeight for each matched pattern.
+type PromptInjectionPipeline struct {
+	*TextClassificationPipeline
+	InjectionLabel  string                    // label of the classifier for injection attempts
+	Patterns        map[string]*regexp.Regexp // heuristic patterns by name
+	HeuristicWeight float32                   // probability that an input is an injection attempt given a matched pattern
+}
+
+// DefaultPromptInjectionPatterns are the heuristic patterns used by NewPromptInjectionPipeline.
+var DefaultPromptInjectionPatterns = map[string]string{
+	"ignoreInstructions": `(?i)\b(ignore|disregard|forget|override)\b.{0,30}\b(previous|prior|above|earlier|all|your)\b.{0,20}\b(instructions?|prompts?|rules|directions|guidelines)\b`,
+	"revealPrompt":       `(?i)\b(reveal|show|print|repeat|output|leak)\b.{0,30}\b(system|initial|hidden|original)\s+(prompt|instructions?|message)\b`,
+	"roleOverride":       `(?i)\b(you are now|from now on,? you|pretend (to be|you are)|act as (an?|the) (unrestricted|unfiltered|different))\b`,
+	"jailbreakPersona":   `(?i)\b(DAN|do anything now|developer mode|jailbreak(ed)?|no (restrictions|limitations|filters))\b`,
+	"fakeDelimiter":      `(?i)(\[/?(system|inst)\]|<\|?(system|im_start|im_end)\|?>|###\s*(system|instruction))`,
+}
+
+// PromptInjectionResult is the prompt injection risk of an input.
+type PromptInjectionResult struct {
+	Risk            float32  // combined risk, between 0 and 1
+	ModelScore      float32  // probability of the injection label according to the classifier
+	MatchedPatterns []string // names of the heuristic patterns matched by the input, sorted
+}
+
+type PromptInjectionOutput struct {
+	Results []PromptInjectionResult
+}
+
+func (t *PromptInjectionOutput) GetOutput() []any {
+	out := make([]any, len(t.Results))
+	for i, result := range t.Results {
+		out[i] = any(result)
+	}
+	return out
+}
+
+// NewPromptInjectionPipeline creates a prompt injection preset from a text classification pipeline, the label of the
+// classifier for injection attempts, and the DefaultPromptInjectionPatterns. A copy of the classifier is configured
+// to return the scores of all its labels.
+func NewPromptInjectionPipeline(classifier *TextClassificationPipeline, injectionLabel string) (*PromptInjectionPipeline, error) {
+	if classifier == nil {
+		return nil, errors.New("a text classification pipeline is required for prompt injection detection")
+	}
+	found := false
+	for _, label := range classifier.IDLabelMap {
+		found = found || label == injectionLabel
+	}
+	if !found {
+		return nil, fmt.Errorf("label %s is not a label of the model", injectionLabel)
+	}
+	patterns := map[string]*regexp.Regexp{}
+	for name, pattern := range DefaultPromptInjectionPatterns {
+		patterns[name] = regexp.MustCompile(pattern)
+	}
+	preset, err := presetClassifier(classifier, "SOFTMAX")
+	if err != nil {
+		return nil, err
+	}
+	return &PromptInjectionPipeline{
+		TextClassificationPipeline: preset,
+		InjectionLabel:             injectionLabel,
+		Patterns:                   patterns,
+		HeuristicWeight:            0.5,
+	}, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *PromptInjectionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete prompt injection output type rather than the interface.
+func (p *PromptInjectionPipeline) RunPipeline(inputs []string) (*PromptInjectionOutput, error) {
+	output, err := p.TextClassificationPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.results(inputs, output.ClassificationOutputs), nil
+}
+
+// results combines the scores of the classifier for the inputs with the heuristic patterns they match.
+func (p *PromptInjectionPipeline) results(inputs []string, outputs [][]ClassificationOutput) *PromptInjectionOutput {
+	result := &PromptInjectionOutput{Results: make([]PromptInjectionResult, len(inputs))}
+	for i, classes := range outputs {
+		for _, class := range classes {
+			if class.Label == p.InjectionLabel {
+				result.Results[i].ModelScore = class.Score
+			}
+		}
+		safe := 1 - result.Results[i].ModelScore
+		for name, pattern := range p.Patterns {
+			if pattern.MatchString(inputs[i]) {
+				result.Results[i].MatchedPatterns = append(result.Results[i].MatchedPatterns, name)
+				safe *= 1 - p.HeuristicWeight
+			}
+		}
+		slices.Sort(result.Results[i].MatchedPatterns)
+		result.Results[i].Risk = 1 - safe
+	}
+	return result
+}
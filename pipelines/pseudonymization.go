@@ -0,0 +1,132 @@
+package pipelines
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// PseudonymTable replaces the entities found by a token classification pipeline, e.g. a PII detection model,
+// with placeholders such as [PER_1], and records the mapping so that authorized systems can re-identify the
+// text. The same entity text of the same type always gets the same placeholder, across all the texts
+// pseudonymized with the table, so that pseudonymized texts can still be joined and analysed. The table can
+// be stored encrypted with Encrypt, separately from the pseudonymized texts.
+type PseudonymTable struct {
+	Placeholders map[string]string `json:"placeholders"` // original text of each placeholder
+	Counts       map[string]int    `json:"counts"`       // number of placeholders of each entity type
+
+	placeholderOf map[string]string
+}
+
+// NewPseudonymTable creates an empty pseudonym table.
+func NewPseudonymTable() *PseudonymTable {
+	return &PseudonymTable{
+		Placeholders:  map[string]string{},
+		Counts:        map[string]int{},
+		placeholderOf: map[string]string{},
+	}
+}
+
+// Pseudonymize replaces the entities in text with their placeholders. Entities overlapping a previous entity
+// are ignored.
+func (t *PseudonymTable) Pseudonymize(text string, entities []Entity) (string, error) {
+	sorted := append([]Entity{}, entities...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	var sb strings.Builder
+	position := 0
+	for _, entity := range sorted {
+		start, end := int(entity.Start), int(entity.End)
+		if start > end || end > len(text) {
+			return "", fmt.Errorf("entity %s at offsets %d-%d is outside of the text", util.Redact(entity.Word), start, end)
+		}
+		if start < position {
+			continue
+		}
+		sb.WriteString(text[position:start])
+		sb.WriteString(t.placeholder(entityType(entity.Entity), text[start:end]))
+		position = end
+	}
+	sb.WriteString(text[position:])
+	return sb.String(), nil
+}
+
+func (t *PseudonymTable) placeholder(label string, original string) string {
+	key := label + "\x00" + original
+	if placeholder, ok := t.placeholderOf[key]; ok {
+		return placeholder
+	}
+	t.Counts[label]++
+	placeholder := fmt.Sprintf("[%s_%d]", label, t.Counts[label])
+	t.Placeholders[placeholder] = original
+	t.placeholderOf[key] = placeholder
+	return placeholder
+}
+
+// Reidentify replaces the placeholders of the table in text with their original text.
+func (t *PseudonymTable) Reidentify(text string) string {
+	replacements := make([]string, 0, 2*len(t.Placeholders))
+	for placeholder, original := range t.Placeholders {
+		replacements = append(replacements, placeholder, original)
+	}
+	return strings.NewReplacer(replacements...).Replace(text)
+}
+
+// Encrypt serializes the table and encrypts it with AES-GCM. The key must be 16, 24 or 32 bytes long.
+func (t *PseudonymTable) Encrypt(key []byte) ([]byte, error) {
+	plaintext, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newPseudonymCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// DecryptPseudonymTable decrypts a table encrypted with Encrypt, to re-identify texts or to keep pseudonymizing
+// texts consistently.
+func DecryptPseudonymTable(encrypted []byte, key []byte) (*PseudonymTable, error) {
+	aead, err := newPseudonymCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < aead.NonceSize() {
+		return nil, errors.New("encrypted pseudonym table is too short")
+	}
+	plaintext, err := aead.Open(nil, encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt pseudonym table: %w", err)
+	}
+	table := NewPseudonymTable()
+	if err = json.Unmarshal(plaintext, table); err != nil {
+		return nil, err
+	}
+	for placeholder, original := range table.Placeholders {
+		separator := strings.LastIndex(placeholder, "_")
+		if !strings.HasPrefix(placeholder, "[") || separator < 0 {
+			return nil, fmt.Errorf("placeholder %s of the pseudonym table is not of the form [TYPE_n]", placeholder)
+		}
+		table.placeholderOf[placeholder[1:separator]+"\x00"+original] = placeholder
+	}
+	return table, nil
+}
+
+func newPseudonymCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,91 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// QualityScoringPipeline is a preset for scoring the quality of text for data curation, e.g. with an
+// educational value or fluency classifier. It wraps a text classification pipeline and reduces its output
+// to a single score per input, so that large corpora can be filtered with a score threshold:
+//   - for regression models with a single output, such as the fineweb-edu classifier, the score is the raw model output;
+//   - for models with several quality classes, the score is the expected value of the class weights under
+//     the softmax distribution over the classes. By default the weight of a class is its index in the model's id2label map.
+type QualityScoringPipeline struct {
+	*TextClassificationPipeline
+	LabelWeights map[string]float32
+}
+
+// QualityScore is the quality score of an input.
+type QualityScore struct {
+	Score float32
+}
+
+type QualityScoringOutput struct {
+	Scores []QualityScore
+}
+
+func (t *QualityScoringOutput) GetOutput() []any {
+	out := make([]any, len(t.Scores))
+	for i, score := range t.Scores {
+		out[i] = any(score)
+	}
+	return out
+}
+
+// NewQualityScoringPipeline creates a quality scoring preset from a text classification pipeline. A copy of the
+// classifier is configured to return the raw scores of all its labels, which the preset then reduces to a single
+// score. labelWeights optionally overrides the weight of each label.
+func NewQualityScoringPipeline(classifier *TextClassificationPipeline, labelWeights map[string]float32) (*QualityScoringPipeline, error) {
+	if classifier == nil {
+		return nil, errors.New("a text classification pipeline is required for quality scoring")
+	}
+	weights := map[string]float32{}
+	for id, label := range classifier.IDLabelMap {
+		weights[label] = float32(id)
+	}
+	for label, weight := range labelWeights {
+		if _, ok := weights[label]; !ok {
+			return nil, fmt.Errorf("label %s of the label weights is not a label of the model", label)
+		}
+		weights[label] = weight
+	}
+	preset, err := presetClassifier(classifier, "NONE")
+	if err != nil {
+		return nil, err
+	}
+	return &QualityScoringPipeline{
+		TextClassificationPipeline: preset,
+		LabelWeights:               weights,
+	}, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *QualityScoringPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete quality scoring output type rather than the interface.
+func (p *QualityScoringPipeline) RunPipeline(inputs []string) (*QualityScoringOutput, error) {
+	output, err := p.TextClassificationPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	result := &QualityScoringOutput{Scores: make([]QualityScore, len(output.ClassificationOutputs))}
+	for i, classes := range output.ClassificationOutputs {
+		if len(classes) == 1 {
+			result.Scores[i].Score = classes[0].Score
+			continue
+		}
+		logits := make([]float32, len(classes))
+		for j, class := range classes {
+			logits[j] = class.Score
+		}
+		for j, probability := range util.SoftMax(logits) {
+			result.Scores[i].Score += probability * p.LabelWeights[classes[j].Label]
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,162 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// LabeledInput is an input text along with its expected label.
+type LabeledInput struct {
+	Text  string
+	Label string
+}
+
+// ModelEvaluation is the accuracy, latency and size of a classification model on a labeled sample.
+type ModelEvaluation struct {
+	OnnxFile  string
+	SizeBytes int64
+	Accuracy  float32
+	Latency   time.Duration // mean time to classify one input, including tokenization
+}
+
+// QuantizationReport compares a quantized classification model with its original on a labeled sample,
+// to decide whether the quantized model is accurate enough for the task.
+type QuantizationReport struct {
+	Samples        int
+	Original       ModelEvaluation
+	Quantized      ModelEvaluation
+	Agreement      float32                 // fraction of the inputs for which both models predict the same label
+	AccuracyDrop   float32                 // accuracy of the original model minus accuracy of the quantized model
+	AccuracyDropCI util.ConfidenceInterval // 95% bootstrap confidence interval of AccuracyDrop
+	SizeRatio      float32                 // size of the quantized model relative to the original
+	Speedup        float32                 // latency of the original model relative to the quantized model
+}
+
+// NewQuantizationReport runs the labeled samples, in batches of batchSize, through the original and the quantized
+// text classification pipelines, e.g. two pipelines loading model.onnx and model_quantized.onnx from the same
+// model folder with OnnxFilename, and reports their accuracy, latency and size.
+func NewQuantizationReport(original *TextClassificationPipeline, quantized *TextClassificationPipeline, samples []LabeledInput, batchSize int) (*QuantizationReport, error) {
+	if original == nil || quantized == nil {
+		return nil, errors.New("an original and a quantized pipeline are required for a quantization report")
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("no labeled samples to evaluate")
+	}
+	if batchSize <= 0 {
+		batchSize = 32
+	}
+
+	originalEvaluation, originalLabels, err := evaluateClassifier(original, samples, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	quantizedEvaluation, quantizedLabels, err := evaluateClassifier(quantized, samples, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	return compareEvaluations(samples, originalEvaluation, originalLabels, quantizedEvaluation, quantizedLabels)
+}
+
+// compareEvaluations reports the differences between the evaluations of the original and the quantized models,
+// given the labels they predict for the samples.
+func compareEvaluations(samples []LabeledInput, originalEvaluation ModelEvaluation, originalLabels []string, quantizedEvaluation ModelEvaluation, quantizedLabels []string) (*QuantizationReport, error) {
+	agreements := 0
+	expectedLabels := make([]string, len(samples))
+	for i := range originalLabels {
+		if originalLabels[i] == quantizedLabels[i] {
+			agreements++
+		}
+		expectedLabels[i] = samples[i].Label
+	}
+	accuracyDropCI, err := util.BootstrapDelta(len(samples), util.AccuracyMetric(quantizedLabels, expectedLabels),
+		util.AccuracyMetric(originalLabels, expectedLabels), 1000, 0.95, 0)
+	if err != nil {
+		return nil, err
+	}
+	report := &QuantizationReport{
+		Samples:        len(samples),
+		Original:       originalEvaluation,
+		Quantized:      quantizedEvaluation,
+		Agreement:      float32(agreements) / float32(len(samples)),
+		AccuracyDrop:   originalEvaluation.Accuracy - quantizedEvaluation.Accuracy,
+		AccuracyDropCI: accuracyDropCI,
+	}
+	if originalEvaluation.SizeBytes > 0 {
+		report.SizeRatio = float32(quantizedEvaluation.SizeBytes) / float32(originalEvaluation.SizeBytes)
+	}
+	if quantizedEvaluation.Latency > 0 {
+		report.Speedup = float32(originalEvaluation.Latency) / float32(quantizedEvaluation.Latency)
+	}
+	return report, nil
+}
+
+func (r *QuantizationReport) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Quantization report on %d samples\n", r.Samples))
+	for _, evaluation := range []struct {
+		name string
+		ModelEvaluation
+	}{{"Original", r.Original}, {"Quantized", r.Quantized}} {
+		sb.WriteString(fmt.Sprintf("%s: file=%s, size=%.1fMB, accuracy=%.4f, latency=%s\n",
+			evaluation.name, evaluation.OnnxFile, float64(evaluation.SizeBytes)/(1<<20), evaluation.Accuracy, evaluation.Latency))
+	}
+	sb.WriteString(fmt.Sprintf("Agreement=%.4f, accuracy drop=%s, size ratio=%.2f, speedup=%.2fx\n",
+		r.Agreement, r.AccuracyDropCI, r.SizeRatio, r.Speedup))
+	return sb.String()
+}
+
+// evaluateClassifier returns the evaluation of the pipeline on the samples and the label predicted for each sample.
+func evaluateClassifier(pipeline *TextClassificationPipeline, samples []LabeledInput, batchSize int) (ModelEvaluation, []string, error) {
+	evaluation := ModelEvaluation{}
+	onnxFile, err := GetOnnxModelPath(pipeline.ModelPath, pipeline.OnnxFilename)
+	if err != nil {
+		return evaluation, nil, err
+	}
+	evaluation.OnnxFile = onnxFile
+	if evaluation.SizeBytes, err = util.FileSize(onnxFile); err != nil {
+		return evaluation, nil, err
+	}
+
+	labels := make([]string, 0, len(samples))
+	correct := 0
+	var elapsed time.Duration
+	for batchStart := 0; batchStart < len(samples); batchStart += batchSize {
+		batch := samples[batchStart:min(batchStart+batchSize, len(samples))]
+		texts := make([]string, len(batch))
+		for i, sample := range batch {
+			texts[i] = sample.Text
+		}
+		start := time.Now()
+		output, runErr := pipeline.RunPipeline(texts)
+		elapsed += time.Since(start)
+		if runErr != nil {
+			return evaluation, nil, runErr
+		}
+		for i, classes := range output.ClassificationOutputs {
+			label := topLabel(classes)
+			if label == batch[i].Label {
+				correct++
+			}
+			labels = append(labels, label)
+		}
+	}
+	evaluation.Accuracy = float32(correct) / float32(len(samples))
+	evaluation.Latency = elapsed / time.Duration(len(samples))
+	return evaluation, labels, nil
+}
+
+// topLabel returns the label with the highest score.
+func topLabel(classes []ClassificationOutput) string {
+	label := ""
+	var score float32
+	for i, class := range classes {
+		if i == 0 || class.Score > score {
+			label, score = class.Label, class.Score
+		}
+	}
+	return label
+}
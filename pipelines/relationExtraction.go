@@ -0,0 +1,235 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// EntityMarkers are the strings inserted around the head and tail entities of a pair before the pair is classified,
+// as the relation classifier was trained with, e.g. [E1] and [/E1]. The {type} placeholder in a marker is replaced
+// by the type of the entity it marks, for typed entity markers such as <S:PER> and </S:PER>. Markers are inserted
+// as they are, so they should include the spaces the model expects around them, and are best added to the
+// vocabulary of the model as special tokens, so that each of them is a single token.
+type EntityMarkers struct {
+	HeadStart string
+	HeadEnd   string
+	TailStart string
+	TailEnd   string
+}
+
+// Insert returns the text with the head and tail entities wrapped in their markers. The entities must have been
+// found in text and must not overlap.
+func (m EntityMarkers) Insert(text string, head Entity, tail Entity) (string, error) {
+	for _, entity := range []Entity{head, tail} {
+		if entity.Start > entity.End || int(entity.End) > len(text) ||
+			!isCharacterBoundary(text, int(entity.Start)) || !isCharacterBoundary(text, int(entity.End)) {
+			return "", fmt.Errorf("entity %s at offsets %d-%d is outside of the text or not on character boundaries",
+				util.Redact(entity.Word), entity.Start, entity.End)
+		}
+	}
+	if head.Start < tail.End && tail.Start < head.End {
+		return "", fmt.Errorf("entities %s and %s overlap", util.Redact(head.Word), util.Redact(tail.Word))
+	}
+	headType, tailType := entityType(head.Entity), entityType(tail.Entity)
+	type insertion struct {
+		offset int
+		marker string
+	}
+	insertions := []insertion{
+		{int(head.Start), strings.ReplaceAll(m.HeadStart, "{type}", headType)},
+		{int(head.End), strings.ReplaceAll(m.HeadEnd, "{type}", headType)},
+		{int(tail.Start), strings.ReplaceAll(m.TailStart, "{type}", tailType)},
+		{int(tail.End), strings.ReplaceAll(m.TailEnd, "{type}", tailType)},
+	}
+	if tail.Start < head.Start {
+		insertions[0], insertions[1], insertions[2], insertions[3] = insertions[2], insertions[3], insertions[0], insertions[1]
+	}
+	var sb strings.Builder
+	position := 0
+	for _, i := range insertions {
+		sb.WriteString(text[position:i.offset])
+		sb.WriteString(i.marker)
+		position = i.offset
+	}
+	sb.WriteString(text[position:])
+	return sb.String(), nil
+}
+
+// RelationExtractionPipeline extracts relations between the entities of a text, such as (Marie Curie, born_in,
+// Warsaw), by combining entity spans, found by a token classification pipeline or provided by the caller, with a
+// relation classifier, i.e. a text classification model trained on texts whose head and tail entities are marked,
+// e.g. on TACRED or SemEval. Each ordered pair of entities is marked in its text with Markers and classified, and
+// the pairs classified as a relation other than the NoRelationLabels, with a score reaching the threshold, are
+// returned as triples.
+type RelationExtractionPipeline struct {
+	*TextClassificationPipeline
+	NER              *TokenClassificationPipeline // optional, finds the entities of the inputs of Run
+	Markers          EntityMarkers
+	NoRelationLabels []string // labels of the classifier for pairs of entities with no relation
+	Threshold        float32  // relations with a lower score are discarded
+	MaxDistance      int      // maximum number of bytes between the entities of a pair, 0 for no maximum
+	ContextWindow    int      // number of bytes of text kept on each side of a pair, 0 to keep the whole text
+	BatchSize        int      // number of pairs classified at once, 32 by default
+}
+
+// Relation is a relation between a head and a tail entity of a text.
+type Relation struct {
+	Head     Entity
+	Relation string
+	Tail     Entity
+	Score    float32
+}
+
+type RelationExtractionOutput struct {
+	Relations [][]Relation // relations of each input, by decreasing score
+}
+
+func (t *RelationExtractionOutput) GetOutput() []any {
+	out := make([]any, len(t.Relations))
+	for i, relations := range t.Relations {
+		out[i] = any(relations)
+	}
+	return out
+}
+
+// NewRelationExtractionPipeline creates a relation extraction pipeline from a relation classifier and an optional
+// token classification pipeline, which must aggregate entities. Without it, the entities must be provided with
+// RunWithEntities. The markers default to [E1], [/E1], [E2] and [/E2], and the labels with no relation to
+// no_relation, NA and Other, the conventions of TACRED, DocRED and SemEval.
+func NewRelationExtractionPipeline(classifier *TextClassificationPipeline, ner *TokenClassificationPipeline) (*RelationExtractionPipeline, error) {
+	if classifier == nil {
+		return nil, errors.New("a text classification pipeline is required for relation extraction")
+	}
+	if ner != nil && ner.AggregationStrategy == "NONE" {
+		return nil, errors.New("relation extraction requires a token classification pipeline that aggregates entities")
+	}
+	return &RelationExtractionPipeline{
+		TextClassificationPipeline: classifier,
+		NER:                        ner,
+		Markers:                    EntityMarkers{HeadStart: "[E1]", HeadEnd: "[/E1]", TailStart: "[E2]", TailEnd: "[/E2]"},
+		NoRelationLabels:           []string{"no_relation", "NA", "Other"},
+		BatchSize:                  32,
+	}, nil
+}
+
+// Run the pipeline on a batch of strings, whose entities are found by the token classification pipeline.
+func (p *RelationExtractionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete relation extraction output type rather than the interface.
+func (p *RelationExtractionPipeline) RunPipeline(inputs []string) (*RelationExtractionOutput, error) {
+	if p.NER == nil {
+		return nil, errors.New("relation extraction without a token classification pipeline requires the entities of the inputs")
+	}
+	entities, err := p.NER.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunWithEntities(inputs, entities.Entities)
+}
+
+// RunWithEntities extracts the relations between the entities of each input, e.g. spans from a gazetteer or from
+// annotations. The entities must have byte offsets in their input.
+func (p *RelationExtractionPipeline) RunWithEntities(inputs []string, entities [][]Entity) (*RelationExtractionOutput, error) {
+	pairs, texts, err := p.entityPairs(inputs, entities)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = 32
+	}
+	var outputs [][]ClassificationOutput
+	for batchStart := 0; batchStart < len(texts); batchStart += batchSize {
+		output, err := p.TextClassificationPipeline.RunPipeline(texts[batchStart:min(batchStart+batchSize, len(texts))])
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output.ClassificationOutputs...)
+	}
+	return p.relations(len(inputs), pairs, outputs), nil
+}
+
+// entityPair is a pair of entities of an input to classify.
+type entityPair struct {
+	input      int
+	head, tail Entity
+}
+
+// entityPairs returns the pairs of entities of the inputs that are classified, and their texts.
+func (p *RelationExtractionPipeline) entityPairs(inputs []string, entities [][]Entity) ([]entityPair, []string, error) {
+	if len(inputs) != len(entities) {
+		return nil, nil, fmt.Errorf("got entities for %d inputs, but %d inputs", len(entities), len(inputs))
+	}
+	var pairs []entityPair
+	var texts []string
+	for i, input := range inputs {
+		for _, head := range entities[i] {
+			for _, tail := range entities[i] {
+				if head.Start < tail.End && tail.Start < head.End {
+					continue // the same entity, or overlapping entities
+				}
+				if p.MaxDistance > 0 && int(max(head.Start, tail.Start))-int(min(head.End, tail.End)) > p.MaxDistance {
+					continue
+				}
+				text, err := p.pairText(input, head, tail)
+				if err != nil {
+					return nil, nil, err
+				}
+				pairs = append(pairs, entityPair{input: i, head: head, tail: tail})
+				texts = append(texts, text)
+			}
+		}
+	}
+	return pairs, texts, nil
+}
+
+// relations returns the relations of the pairs of entities given the outputs of the classifier for their texts.
+func (p *RelationExtractionPipeline) relations(numInputs int, pairs []entityPair, outputs [][]ClassificationOutput) *RelationExtractionOutput {
+	result := &RelationExtractionOutput{Relations: make([][]Relation, numInputs)}
+	for i, classes := range outputs {
+		pair := pairs[i]
+		for _, class := range classes {
+			if class.Score < p.Threshold || p.isNoRelation(class.Label) {
+				continue
+			}
+			result.Relations[pair.input] = append(result.Relations[pair.input],
+				Relation{Head: pair.head, Relation: class.Label, Tail: pair.tail, Score: class.Score})
+		}
+	}
+	for _, relations := range result.Relations {
+		sort.SliceStable(relations, func(a, b int) bool { return relations[a].Score > relations[b].Score })
+	}
+	return result
+}
+
+// pairText returns the text of a pair of entities to classify: the input, or the part of it around the pair if
+// ContextWindow is set, with the entities marked.
+func (p *RelationExtractionPipeline) pairText(input string, head Entity, tail Entity) (string, error) {
+	if p.ContextWindow <= 0 {
+		return p.Markers.Insert(input, head, tail)
+	}
+	start, end := int(min(head.Start, tail.Start)), int(max(head.End, tail.End))
+	if end > len(input) {
+		return "", fmt.Errorf("entities %s and %s at offsets %d-%d are outside of the text",
+			util.Redact(head.Word), util.Redact(tail.Word), start, end)
+	}
+	contextStart, contextEnd := contextBounds(input, start, end, p.ContextWindow)
+	head.Start, head.End = head.Start-uint(contextStart), head.End-uint(contextStart)
+	tail.Start, tail.End = tail.Start-uint(contextStart), tail.End-uint(contextStart)
+	return p.Markers.Insert(input[contextStart:contextEnd], head, tail)
+}
+
+func (p *RelationExtractionPipeline) isNoRelation(label string) bool {
+	for _, noRelation := range p.NoRelationLabels {
+		if label == noRelation {
+			return true
+		}
+	}
+	return false
+}
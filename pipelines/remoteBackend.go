@@ -0,0 +1,314 @@
+package pipelines
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+	"google.golang.org/grpc"
+)
+
+// RemoteBackend runs the model of a pipeline on an inference server, such as Triton Inference Server, with the
+// KServe v2 inference protocol, while the tokenization and postprocessing stay local. Set it on the
+// Remote field of the config of a text classification, token classification, feature extraction, zero-shot
+// classification, rerank, fill-mask or ColBERT pipeline. The model directory is still needed locally for the
+// tokenizer and for the inputs and outputs of the model.
+//
+// By default every batch runs on the server and no onnxruntime session is created. With LocalBatchSize or Failover,
+// the pipeline also creates its local session for a hybrid execution: small batches run locally, where they have a
+// lower latency, while large batches are shipped to the server, and with Failover a batch that fails on one side is
+// run on the other. After the server fails, batches run locally for FailoverCooldown before the server is tried again.
+//
+// The HTTP/JSON binding of the protocol is used by default. With GRPC set, e.g. by NewGRPCRemoteBackend, the gRPC
+// binding is used instead, with less encoding overhead for large batches. Close the backend to close its gRPC
+// connection once no pipeline uses it.
+type RemoteBackend struct {
+	URL              string            // base URL of the server, e.g. http://triton:8000, or its address with GRPC
+	Model            string            // name of the model in the server's model repository
+	Version          string            // version of the model, the server's default if empty
+	Headers          map[string]string // headers added to each request, e.g. for authorization
+	Client           *http.Client      // http.DefaultClient if nil
+	Timeout          time.Duration     // timeout of each inference request, 60s by default and if zero
+	LocalBatchSize   int               // batches of up to LocalBatchSize inputs run locally, 0 to run them all remotely
+	Failover         bool              // run the batches that fail on one backend on the other
+	FailoverCooldown time.Duration     // time after a remote failure during which batches run locally, 30s by default
+	GRPC             bool              // use the gRPC binding of the protocol rather than HTTP/JSON
+	DialOptions      []grpc.DialOption // options of the gRPC connection, without transport security if empty
+	grpcConn         *grpc.ClientConn
+	grpcConnMutex    sync.Mutex
+	remoteFailedAt   atomic.Int64 // unix nanoseconds of the last remote failure
+	localBatches     atomic.Uint64
+	remoteBatches    atomic.Uint64
+	failovers        atomic.Uint64
+}
+
+// RemoteBackendStats counts the batches run by each backend of a hybrid execution.
+type RemoteBackendStats struct {
+	LocalBatches  uint64
+	RemoteBatches uint64
+	Failovers     uint64 // batches run on a backend after they failed on the other
+}
+
+// defaultRemoteTimeout is the timeout of the inference requests of a RemoteBackend without one.
+const defaultRemoteTimeout = 60 * time.Second
+
+// NewRemoteBackend creates a backend for a model served at baseURL.
+func NewRemoteBackend(baseURL string, model string) *RemoteBackend {
+	return &RemoteBackend{URL: baseURL, Model: model, FailoverCooldown: 30 * time.Second, Timeout: defaultRemoteTimeout}
+}
+
+// NewGRPCRemoteBackend creates a backend for a model served with the gRPC binding at address, e.g. triton:8001.
+func NewGRPCRemoteBackend(address string, model string) *RemoteBackend {
+	backend := NewRemoteBackend(address, model)
+	backend.GRPC = true
+	return backend
+}
+
+// Stats returns the number of batches run by each backend.
+func (b *RemoteBackend) Stats() RemoteBackendStats {
+	return RemoteBackendStats{
+		LocalBatches:  b.localBatches.Load(),
+		RemoteBatches: b.remoteBatches.Load(),
+		Failovers:     b.failovers.Load(),
+	}
+}
+
+// hybrid reports whether batches can also run on the local onnxruntime session.
+func (b *RemoteBackend) hybrid() bool {
+	return b.LocalBatchSize > 0 || b.Failover
+}
+
+// runHybrid runs the batch on the server or with the local session, as set by the execution policy of the backend.
+func (b *RemoteBackend) runHybrid(batch *PipelineBatch, inputs []ort.InputOutputInfo, outputs []ort.InputOutputInfo, runLocal func() error) error {
+	runRemote := func() error {
+		err := b.run(batch, inputs, outputs)
+		if err != nil {
+			b.remoteFailedAt.Store(time.Now().UnixNano())
+		}
+		return err
+	}
+	remote := len(batch.Input) > b.LocalBatchSize
+	if remote && b.Failover && time.Since(time.Unix(0, b.remoteFailedAt.Load())) < b.FailoverCooldown {
+		remote = false
+	}
+	run, fallback := runLocal, runRemote
+	batches, fallbackBatches := &b.localBatches, &b.remoteBatches
+	if remote {
+		run, fallback = runRemote, runLocal
+		batches, fallbackBatches = &b.remoteBatches, &b.localBatches
+	}
+
+	err := run()
+	if err == nil {
+		batches.Add(1)
+		return nil
+	}
+	if !b.Failover {
+		return err
+	}
+	// the outputs of the failed run, if any, are replaced by the ones of the fallback
+	for _, tensor := range batch.OutputTensors {
+		err = errors.Join(err, tensor.Destroy())
+	}
+	batch.OutputTensors = nil
+	if fallbackErr := fallback(); fallbackErr != nil {
+		return errors.Join(err, fallbackErr)
+	}
+	fallbackBatches.Add(1)
+	b.failovers.Add(1)
+	return nil
+}
+
+// remoteTensor is a tensor of the KServe v2 inference protocol.
+type remoteTensor struct {
+	Name     string  `json:"name"`
+	Shape    []int64 `json:"shape,omitempty"`
+	Datatype string  `json:"datatype,omitempty"`
+	Data     any     `json:"data,omitempty"`
+}
+
+type remoteInferenceRequest struct {
+	Inputs  []remoteTensor `json:"inputs"`
+	Outputs []remoteTensor `json:"outputs"`
+}
+
+type remoteInferenceResponse struct {
+	Outputs []remoteOutput `json:"outputs"`
+	Error   string         `json:"error"`
+}
+
+// remoteOutput is an output tensor returned by the server, with either binding of the protocol.
+type remoteOutput struct {
+	Name     string    `json:"name"`
+	Shape    []int64   `json:"shape"`
+	Datatype string    `json:"datatype"`
+	Data     []float32 `json:"data"`
+}
+
+// modelPath is the path of the model on the server, e.g. /v2/models/my-model/versions/1.
+func (b *RemoteBackend) modelPath() string {
+	path := "/v2/models/" + url.PathEscape(b.Model)
+	if b.Version != "" {
+		path += "/versions/" + url.PathEscape(b.Version)
+	}
+	return path
+}
+
+func (b *RemoteBackend) do(request *http.Request) (*http.Response, error) {
+	for name, value := range b.Headers {
+		request.Header.Set(name, value)
+	}
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(request)
+}
+
+// Ready checks that the model is loaded and ready for inference on the server.
+func (b *RemoteBackend) Ready(ctx context.Context) (err error) {
+	if b.GRPC {
+		return b.readyGRPC(ctx)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(b.URL, "/")+b.modelPath()+"/ready", nil)
+	if err != nil {
+		return err
+	}
+	response, err := b.do(request)
+	if err != nil {
+		return err
+	}
+	defer func(response *http.Response) {
+		err = errors.Join(err, response.Body.Close())
+	}(response)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("model %s is not ready on %s: status %s", b.Model, b.URL, response.Status)
+	}
+	return nil
+}
+
+// run sends the input tensors of the batch to the server, and sets the output tensors of the batch from its response.
+func (b *RemoteBackend) run(batch *PipelineBatch, inputs []ort.InputOutputInfo, outputs []ort.InputOutputInfo) error {
+	timeout := b.Timeout
+	if timeout <= 0 {
+		timeout = defaultRemoteTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	infer := b.inferHTTP
+	if b.GRPC {
+		infer = b.inferGRPC
+	}
+	remoteOutputs, err := infer(ctx, batch, inputs, outputs)
+	if err != nil {
+		return err
+	}
+
+	batchSize := int64(len(batch.Input))
+	if len(batch.InputTensors) > 0 {
+		batchSize = batch.InputTensors[0].GetShape()[0]
+	}
+	for _, output := range outputs {
+		found := false
+		for _, remoteOutput := range remoteOutputs {
+			if remoteOutput.Name != output.Name {
+				continue
+			}
+			if remoteOutput.Datatype != "FP32" {
+				return fmt.Errorf("output %s of the remote model has type %s, only FP32 is supported", output.Name, remoteOutput.Datatype)
+			}
+			if err = checkRemoteShape(output, remoteOutput.Shape, batchSize); err != nil {
+				return err
+			}
+			size := int64(1)
+			for _, dim := range remoteOutput.Shape {
+				size *= dim
+			}
+			if size != int64(len(remoteOutput.Data)) {
+				return fmt.Errorf("output %s of the remote model has %d values for shape %v", output.Name, len(remoteOutput.Data), remoteOutput.Shape)
+			}
+			tensor, tensorErr := ort.NewTensor(ort.NewShape(remoteOutput.Shape...), remoteOutput.Data)
+			if tensorErr != nil {
+				return tensorErr
+			}
+			batch.OutputTensors = append(batch.OutputTensors, tensor)
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("the response of %s has no output %s", b.URL, output.Name)
+		}
+	}
+	return nil
+}
+
+// inferHTTP runs the batch with the HTTP/JSON binding of the protocol.
+func (b *RemoteBackend) inferHTTP(ctx context.Context, batch *PipelineBatch, inputs []ort.InputOutputInfo, outputs []ort.InputOutputInfo) (_ []remoteOutput, err error) {
+	inferenceRequest := remoteInferenceRequest{}
+	for i, tensor := range batch.InputTensors {
+		inferenceRequest.Inputs = append(inferenceRequest.Inputs, remoteTensor{
+			Name:     inputs[i].Name,
+			Shape:    tensor.GetShape(),
+			Datatype: "INT64",
+			Data:     tensor.GetData(),
+		})
+	}
+	for _, output := range outputs {
+		inferenceRequest.Outputs = append(inferenceRequest.Outputs, remoteTensor{Name: output.Name})
+	}
+	body, err := jsoniter.Marshal(inferenceRequest)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(b.URL, "/")+b.modelPath()+"/infer", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := b.do(request)
+	if err != nil {
+		return nil, fmt.Errorf("remote inference on %s failed: %w", b.URL, err)
+	}
+	defer func(response *http.Response) {
+		err = errors.Join(err, response.Body.Close())
+	}(response)
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the response of %s: %w", b.URL, err)
+	}
+	inferenceResponse := remoteInferenceResponse{}
+	if err = jsoniter.Unmarshal(responseBody, &inferenceResponse); err != nil && response.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("cannot unmarshal the response of %s: %w", b.URL, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote inference on %s failed with status %s: %s", b.URL, response.Status, inferenceResponse.Error)
+	}
+	return inferenceResponse.Outputs, nil
+}
+
+// checkRemoteShape checks that the shape of an output returned by the server is one the model can return for the
+// batch: the rank and the static dimensions of the output, and the batch size as first dimension.
+func checkRemoteShape(output ort.InputOutputInfo, shape []int64, batchSize int64) error {
+	if len(shape) != len(output.Dimensions) {
+		return fmt.Errorf("output %s of the remote model has shape %v, expected %d dimensions", output.Name, shape, len(output.Dimensions))
+	}
+	if len(shape) > 0 && shape[0] != batchSize {
+		return fmt.Errorf("output %s of the remote model has shape %v for a batch of %d inputs", output.Name, shape, batchSize)
+	}
+	for i, dim := range output.Dimensions {
+		if i > 0 && dim >= 0 && shape[i] != dim {
+			return fmt.Errorf("output %s of the remote model has shape %v, expected %v", output.Name, shape, output.Dimensions)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package pipelines
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	ort "github.com/yalue/onnxruntime_go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// The methods of the GRPCInferenceService of the KServe v2 protocol, as served by Triton Inference Server.
+const (
+	grpcModelInferMethod = "/inference.GRPCInferenceService/ModelInfer"
+	grpcModelReadyMethod = "/inference.GRPCInferenceService/ModelReady"
+)
+
+// grpcCodec encodes the few messages of the protocol used by the backend, which encode themselves with the
+// protobuf helpers of hugot rather than with the code generated from the .proto file of the protocol.
+type grpcCodec struct{}
+
+type grpcMessage interface {
+	marshal() []byte
+	unmarshal(message []byte) error
+}
+
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	message, ok := v.(grpcMessage)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return message.marshal(), nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	message, ok := v.(grpcMessage)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T", v)
+	}
+	return message.unmarshal(data)
+}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+// grpcInferRequest is an inference.ModelInferRequest, with INT64 inputs.
+type grpcInferRequest struct {
+	model   string
+	version string
+	inputs  []grpcInputTensor
+	outputs []string
+}
+
+type grpcInputTensor struct {
+	name  string
+	shape []int64
+	data  []int64
+}
+
+func (r *grpcInferRequest) marshal() []byte {
+	message := appendProtoString(nil, 1, r.model)
+	message = appendProtoString(message, 2, r.version)
+	for _, input := range r.inputs {
+		tensor := appendProtoString(nil, 1, input.name)
+		tensor = appendProtoString(tensor, 2, "INT64")
+		tensor = appendProtoPackedInts(tensor, 3, input.shape)
+		tensor = appendProtoBytes(tensor, 5, appendProtoPackedInts(nil, 3, input.data)) // int64_contents
+		message = appendProtoBytes(message, 5, tensor)
+	}
+	for _, output := range r.outputs {
+		message = appendProtoBytes(message, 6, appendProtoString(nil, 1, output))
+	}
+	return message
+}
+
+func (r *grpcInferRequest) unmarshal([]byte) error {
+	return errors.New("inference requests are only sent")
+}
+
+// grpcInferResponse is an inference.ModelInferResponse. The values of the outputs are either in their contents or,
+// as Triton returns them, in raw little-endian bytes, in the same order as the outputs.
+type grpcInferResponse struct {
+	outputs []remoteOutput
+}
+
+func (r *grpcInferResponse) marshal() []byte {
+	return nil
+}
+
+func (r *grpcInferResponse) unmarshal(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	for _, field := range protoMessages(fields, 5) {
+		output, outputErr := unmarshalGRPCOutput(field.value)
+		if outputErr != nil {
+			return fmt.Errorf("cannot decode output %d of the response: %w", len(r.outputs), outputErr)
+		}
+		r.outputs = append(r.outputs, output)
+	}
+	rawContents := protoMessages(fields, 6)
+	if len(rawContents) == 0 {
+		return nil
+	}
+	if len(rawContents) != len(r.outputs) {
+		return fmt.Errorf("the response has %d raw output contents for %d outputs", len(rawContents), len(r.outputs))
+	}
+	for i, raw := range rawContents {
+		if r.outputs[i].Datatype != "FP32" {
+			continue // rejected with the type of the output
+		}
+		if r.outputs[i].Data, err = appendProtoFloats(nil, raw); err != nil {
+			return fmt.Errorf("cannot decode the raw contents of output %s: %w", r.outputs[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// unmarshalGRPCOutput decodes an inference.InferOutputTensor, with the fp32_contents of its contents.
+func unmarshalGRPCOutput(message []byte) (remoteOutput, error) {
+	output := remoteOutput{}
+	fields, err := parseProto(message)
+	if err != nil {
+		return output, err
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			output.Name = string(field.value)
+		case 2:
+			output.Datatype = string(field.value)
+		case 3:
+			dims, dimsErr := protoUints(field)
+			if dimsErr != nil {
+				return output, dimsErr
+			}
+			for _, dim := range dims {
+				output.Shape = append(output.Shape, int64(dim))
+			}
+		case 5:
+			contents, contentsErr := parseProto(field.value)
+			if contentsErr != nil {
+				return output, contentsErr
+			}
+			for _, values := range contents {
+				if values.number != 6 { // fp32_contents
+					continue
+				}
+				if output.Data, err = appendProtoFloats(output.Data, values); err != nil {
+					return output, err
+				}
+			}
+		}
+	}
+	return output, nil
+}
+
+// grpcReadyRequest is an inference.ModelReadyRequest, and grpcReadyResponse an inference.ModelReadyResponse.
+type grpcReadyRequest struct {
+	model   string
+	version string
+}
+
+func (r *grpcReadyRequest) marshal() []byte {
+	return appendProtoString(appendProtoString(nil, 1, r.model), 2, r.version)
+}
+
+func (r *grpcReadyRequest) unmarshal([]byte) error {
+	return errors.New("ready requests are only sent")
+}
+
+type grpcReadyResponse struct {
+	ready bool
+}
+
+func (r *grpcReadyResponse) marshal() []byte {
+	return nil
+}
+
+func (r *grpcReadyResponse) unmarshal(message []byte) error {
+	fields, err := parseProto(message)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if field.number == 1 && field.wireType == protoWireVarint {
+			ready, _ := binary.Uvarint(field.value)
+			r.ready = ready != 0
+		}
+	}
+	return nil
+}
+
+// appendProtoPackedInts appends a packed repeated int64 field.
+func appendProtoPackedInts(message []byte, number int, values []int64) []byte {
+	if len(values) == 0 {
+		return message
+	}
+	packed := make([]byte, 0, len(values))
+	for _, value := range values {
+		packed = binary.AppendUvarint(packed, uint64(value))
+	}
+	return appendProtoBytes(message, number, packed)
+}
+
+// grpcConnection returns the gRPC connection of the backend, created on first use.
+func (b *RemoteBackend) grpcConnection() (*grpc.ClientConn, error) {
+	b.grpcConnMutex.Lock()
+	defer b.grpcConnMutex.Unlock()
+	if b.grpcConn != nil {
+		return b.grpcConn, nil
+	}
+	options := b.DialOptions
+	if len(options) == 0 {
+		options = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	conn, err := grpc.NewClient(b.URL, options...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", b.URL, err)
+	}
+	b.grpcConn = conn
+	return conn, nil
+}
+
+// invokeGRPC calls a method of the inference service, with the headers of the backend as metadata.
+func (b *RemoteBackend) invokeGRPC(ctx context.Context, method string, request grpcMessage, response grpcMessage) error {
+	conn, err := b.grpcConnection()
+	if err != nil {
+		return err
+	}
+	for name, value := range b.Headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, name, value)
+	}
+	return conn.Invoke(ctx, method, request, response, grpc.ForceCodec(grpcCodec{}))
+}
+
+// inferGRPC runs the batch with the gRPC binding of the protocol.
+func (b *RemoteBackend) inferGRPC(ctx context.Context, batch *PipelineBatch, inputs []ort.InputOutputInfo, outputs []ort.InputOutputInfo) ([]remoteOutput, error) {
+	request := &grpcInferRequest{model: b.Model, version: b.Version}
+	for i, tensor := range batch.InputTensors {
+		request.inputs = append(request.inputs, grpcInputTensor{name: inputs[i].Name, shape: tensor.GetShape(), data: tensor.GetData()})
+	}
+	for _, output := range outputs {
+		request.outputs = append(request.outputs, output.Name)
+	}
+	response := &grpcInferResponse{}
+	if err := b.invokeGRPC(ctx, grpcModelInferMethod, request, response); err != nil {
+		return nil, fmt.Errorf("remote inference on %s failed: %w", b.URL, err)
+	}
+	return response.outputs, nil
+}
+
+// readyGRPC checks that the model is ready with the gRPC binding of the protocol.
+func (b *RemoteBackend) readyGRPC(ctx context.Context) error {
+	response := &grpcReadyResponse{}
+	if err := b.invokeGRPC(ctx, grpcModelReadyMethod, &grpcReadyRequest{model: b.Model, version: b.Version}, response); err != nil {
+		return fmt.Errorf("cannot check that model %s is ready on %s: %w", b.Model, b.URL, err)
+	}
+	if !response.ready {
+		return fmt.Errorf("model %s is not ready on %s", b.Model, b.URL)
+	}
+	return nil
+}
+
+// Close closes the gRPC connection of the backend, if it has one. A closed backend reconnects on its next request.
+func (b *RemoteBackend) Close() error {
+	b.grpcConnMutex.Lock()
+	defer b.grpcConnMutex.Unlock()
+	if b.grpcConn == nil {
+		return nil
+	}
+	err := b.grpcConn.Close()
+	b.grpcConn = nil
+	return err
+}
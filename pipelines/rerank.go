@@ -0,0 +1,260 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// RerankPipeline scores the relevance of documents to a query with a cross-encoder, such as
+// cross-encoder/ms-marco-MiniLM-L-6-v2, e.g. to rerank the documents retrieved by a vector search in RAG.
+// The query and each document are encoded together as a pair, and all the pairs run in a single batch.
+type RerankPipeline struct {
+	basePipeline
+	LogitScores bool // return the logits of the model rather than probabilities
+	pairs       *pairEncoder
+}
+
+// RerankResult is the relevance score of a document.
+type RerankResult struct {
+	Index    int // index of the document in the input
+	Document string
+	Score    float32
+}
+
+type RerankOutput struct {
+	Results []RerankResult // sorted by decreasing score
+}
+
+func (t *RerankOutput) GetOutput() []any {
+	out := make([]any, len(t.Results))
+	for i, result := range t.Results {
+		out[i] = any(result)
+	}
+	return out
+}
+
+// options
+
+// WithLogitScores returns the logits of the model as scores, rather than the sigmoid of the logit for models with
+// a single output, or the softmax probability of the last label for models with two.
+func WithLogitScores() PipelineOption[*RerankPipeline] {
+	return func(pipeline *RerankPipeline) {
+		pipeline.LogitScores = true
+	}
+}
+
+// NewRerankPipeline initializes a new rerank pipeline. The pairs are encoded as in the tokenizer.json of the model.
+func NewRerankPipeline(config PipelineConfig[*RerankPipeline], ortOptions *ort.SessionOptions) (*RerankPipeline, error) {
+	pipeline := &RerankPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.Remote = config.Remote
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	// onnx model init
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+
+	// init of inputs and outputs
+	inputs, outputs, err := loadInputOutputMeta(model)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = outputs
+
+	// tokenizer init
+	pipeline.TokenizerOptions, err = getTokenizerOptions(inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	if tkErr != nil {
+		return nil, tkErr
+	}
+	pipeline.Tokenizer = tk
+
+	pipeline.pairs, err = loadPairEncoder(pipeline.ModelPath, tk)
+	if err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+
+	// creation of the session
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := pipeline.createSession(config.EngineCache, model, inputs, pipeline.OutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	pipeline.OrtSession = session
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
+	pipeline.TokenizerTimings = &timings{}
+
+	// validate
+	err = pipeline.Validate()
+	if err != nil {
+		errDestroy := pipeline.Destroy()
+		return nil, errors.Join(err, errDestroy)
+	}
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the logits output.
+func (p *RerankPipeline) GetMetadata() PipelineMetadata {
+	return PipelineMetadata{
+		OutputsInfo: []OutputInfo{
+			{
+				Name:       p.OutputsMeta[0].Name,
+				Dimensions: p.OutputsMeta[0].Dimensions,
+			},
+		},
+	}
+}
+
+// Destroy frees the rerank pipeline resources.
+func (p *RerankPipeline) Destroy() error {
+	return destroySession(p.Tokenizer, p.OrtSession)
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *RerankPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Tokenizer: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.TokenizerTimings.TotalNS),
+			p.TokenizerTimings.NumCalls,
+			time.Duration(float64(p.TokenizerTimings.TotalNS)/math.Max(1, float64(p.TokenizerTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *RerankPipeline) Validate() error {
+	var validationErrors []error
+
+	outDims := p.OutputsMeta[0].Dimensions
+	if len(outDims) != 2 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: rerank must have 2 dimensional output"))
+	} else if outDims[1] != 1 && outDims[1] != 2 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: rerank must have one or two output labels, got %d", outDims[1]))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess tokenizes the query/document pairs, with the token type ids of the document set as the python
+// tokenizers do for the second sequence of a pair.
+func (p *RerankPipeline) Preprocess(batch *PipelineBatch, query string, documents []string) error {
+	start := time.Now()
+	queries := make([]string, len(documents))
+	for i := range documents {
+		queries[i] = query
+	}
+	if err := p.pairs.tokenizePairs(batch, p.Tokenizer, queries, documents, p.TokenizerOptions); err != nil {
+		return err
+	}
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	err := createInputTensors(batch, p.InputsMeta)
+	return err
+}
+
+// Forward performs the forward inference of the rerank pipeline.
+func (p *RerankPipeline) Forward(batch *PipelineBatch) error {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	err := p.runOnBatch(batch, p.OutputsMeta)
+	if err != nil {
+		return err
+	}
+	p.PipelineMemory.recordForward(usageBefore, batch)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return nil
+}
+
+// Postprocess scores the documents and sorts them by decreasing score.
+func (p *RerankPipeline) Postprocess(batch *PipelineBatch, documents []string) (*RerankOutput, error) {
+	logits := batch.OutputTensors[0].GetData()
+	numLabels := int(p.OutputsMeta[0].Dimensions[1])
+	output := &RerankOutput{Results: make([]RerankResult, len(documents))}
+
+	for i, document := range documents {
+		documentLogits := logits[i*numLabels : (i+1)*numLabels]
+		score := documentLogits[numLabels-1]
+		if !p.LogitScores {
+			if numLabels == 1 {
+				score = util.Sigmoid(documentLogits)[0]
+			} else {
+				score = util.SoftMax(documentLogits)[numLabels-1]
+			}
+		}
+		output.Results[i] = RerankResult{Index: i, Document: document, Score: score}
+	}
+	sort.SliceStable(output.Results, func(a, b int) bool {
+		return output.Results[a].Score > output.Results[b].Score
+	})
+	return output, nil
+}
+
+// Run the pipeline on a query and its documents: the first input is the query, and the others are the documents.
+func (p *RerankPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("rerank requires a query")
+	}
+	return p.RunPipeline(inputs[0], inputs[1:])
+}
+
+// RunPipeline scores the documents against the query and returns them sorted by decreasing relevance, along with
+// their index in documents.
+func (p *RerankPipeline) RunPipeline(query string, documents []string) (*RerankOutput, error) {
+	if len(documents) == 0 {
+		return &RerankOutput{}, nil
+	}
+
+	var runErrors []error
+	batch := NewBatch()
+	defer func(*PipelineBatch) {
+		runErrors = append(runErrors, batch.Destroy())
+	}(batch)
+
+	runErrors = append(runErrors, p.Preprocess(batch, query, documents))
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	runErrors = append(runErrors, p.Forward(batch))
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	result, postErr := p.Postprocess(batch, documents)
+	runErrors = append(runErrors, postErr)
+	return result, errors.Join(runErrors...)
+}
@@ -0,0 +1,171 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// SourceDocument is a document indexed by a Retriever.
+type SourceDocument struct {
+	ID   string
+	Text string
+}
+
+// DocumentChunk is a chunk of a source document, with the byte offsets of its text in the document, so that an
+// answer generated from the chunk can cite the exact span of the source it comes from.
+type DocumentChunk struct {
+	DocumentID string
+	Start      int    // byte offset of the chunk in the text of the document
+	End        int    // byte offset of the end of the chunk in the text of the document
+	Text       string // the text of the document between Start and End
+}
+
+// Citation returns a reference to the source span of the chunk, as "documentID:start-end".
+func (c DocumentChunk) Citation() string {
+	return fmt.Sprintf("%s:%d-%d", c.DocumentID, c.Start, c.End)
+}
+
+// RetrievedChunk is a chunk retrieved for a query, along with its source.
+type RetrievedChunk struct {
+	DocumentChunk
+	Score       float32 // cosine similarity between the query and the chunk
+	RerankScore float32 // relevance of the chunk to the query according to the reranker, 0 without reranker
+}
+
+// Retriever is the retrieve-and-rerank component of RAG. Documents are split into chunks and embedded by a feature
+// extraction pipeline, created with WithChunking to index chunks rather than whole documents, and the chunks of a
+// query are retrieved by vector search and then reranked by a cross-encoder if there is one. Each chunk keeps the
+// id of its document and its offsets in the document, so that generated answers can cite their sources.
+// Documents can be added while queries run.
+type Retriever struct {
+	Embedder   *FeatureExtractionPipeline
+	Reranker   *RerankPipeline // reranks the retrieved chunks if not nil
+	Index      *util.VectorIndex
+	Candidates int // number of chunks retrieved by vector search before reranking, at least k, 20 by default
+	BatchSize  int // number of documents embedded at once, 32 by default
+	chunks     []DocumentChunk
+	mutex      sync.RWMutex
+}
+
+// NewRetriever creates an empty retriever, which embeds documents and queries with the embedder, with its document
+// and query prefixes, and reranks the retrieved chunks with the reranker, which may be nil.
+func NewRetriever(embedder *FeatureExtractionPipeline, reranker *RerankPipeline) (*Retriever, error) {
+	if embedder == nil {
+		return nil, errors.New("a feature extraction pipeline is required to embed the documents")
+	}
+	return &Retriever{Embedder: embedder, Reranker: reranker, Index: util.NewVectorIndex(), Candidates: 20, BatchSize: 32}, nil
+}
+
+// AddDocuments embeds documents in batches and indexes their chunks. Documents that the embedder does not split
+// are indexed as a single chunk.
+func (r *Retriever) AddDocuments(documents []SourceDocument) error {
+	batchSize := r.BatchSize
+	if batchSize <= 0 {
+		batchSize = 32
+	}
+	for batchStart := 0; batchStart < len(documents); batchStart += batchSize {
+		batch := documents[batchStart:min(batchStart+batchSize, len(documents))]
+		texts := make([]string, len(batch))
+		for i, document := range batch {
+			texts[i] = document.Text
+		}
+		output, err := r.Embedder.EmbedDocuments(texts)
+		if err != nil {
+			return err
+		}
+		r.mutex.Lock()
+		for i, document := range batch {
+			if i < len(output.Chunks) && len(output.Chunks[i]) > 0 {
+				for _, chunk := range output.Chunks[i] {
+					if err = r.add(document, chunk.Start, chunk.End, chunk.Embedding); err != nil {
+						break
+					}
+				}
+			} else {
+				err = r.add(document, 0, len(document.Text), output.Embeddings[i])
+			}
+			if err != nil {
+				break
+			}
+		}
+		r.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add indexes a chunk of a document, with its position in the chunks as id.
+func (r *Retriever) add(document SourceDocument, start int, end int, embedding []float32) error {
+	if start < 0 || end > len(document.Text) || start > end {
+		return fmt.Errorf("chunk %d-%d out of the bounds of document %s", start, end, document.ID)
+	}
+	if err := r.Index.Add(strconv.Itoa(len(r.chunks)), embedding); err != nil {
+		return err
+	}
+	r.chunks = append(r.chunks, DocumentChunk{DocumentID: document.ID, Start: start, End: end, Text: document.Text[start:end]})
+	return nil
+}
+
+// Len returns the number of indexed chunks.
+func (r *Retriever) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.chunks)
+}
+
+// Retrieve returns the k chunks most relevant to a query, most relevant first: the Candidates chunks most similar
+// to the query, reranked by the reranker if there is one, or the k most similar chunks otherwise.
+func (r *Retriever) Retrieve(query string, k int) ([]RetrievedChunk, error) {
+	if k <= 0 {
+		return nil, nil
+	}
+	output, err := r.Embedder.EmbedQueries([]string{query})
+	if err != nil {
+		return nil, err
+	}
+	candidates := k
+	if r.Reranker != nil {
+		candidates = max(k, r.Candidates)
+	}
+	r.mutex.RLock()
+	results, err := r.Index.Search(output.Embeddings[0], candidates)
+	retrieved := make([]RetrievedChunk, len(results))
+	for i, result := range results {
+		position, _ := strconv.Atoi(result.ID) // the ids of the index are the positions of the chunks
+		retrieved[i] = RetrievedChunk{DocumentChunk: r.chunks[position], Score: result.Score}
+	}
+	r.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if r.Reranker == nil || len(retrieved) == 0 {
+		return retrieved[:min(k, len(retrieved))], nil
+	}
+
+	texts := make([]string, len(retrieved))
+	for i, chunk := range retrieved {
+		texts[i] = chunk.Text
+	}
+	reranked, err := r.Reranker.RunPipeline(query, texts)
+	if err != nil {
+		return nil, err
+	}
+	return rerankedChunks(retrieved, reranked, k), nil
+}
+
+// rerankedChunks returns the k retrieved chunks with the highest scores of the reranker, with their sources.
+func rerankedChunks(retrieved []RetrievedChunk, reranked *RerankOutput, k int) []RetrievedChunk {
+	chunks := make([]RetrievedChunk, 0, min(k, len(reranked.Results)))
+	for _, result := range reranked.Results[:min(k, len(reranked.Results))] {
+		chunk := retrieved[result.Index]
+		chunk.RerankScore = result.Score
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
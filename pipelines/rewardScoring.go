@@ -0,0 +1,96 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// RewardScoringPipeline is a preset for reward models, which score the quality of the response of an LLM to a
+// prompt, such as OpenAssistant/reward-model-deberta-v3-large-v2, e.g. to rank candidate responses, filter
+// synthetic data or monitor the outputs of an LLM. It wraps a text classification pipeline of a model with a
+// regression head, whose output has shape [batch, 1] rather than one logit per label, and returns the raw output
+// as the reward. Models with two labels are also supported, with the log-odds of the last label as the reward.
+// Prompts and responses are encoded as pairs with RunPairs, while Run scores texts that already contain both,
+// e.g. formatted with the chat template of the model.
+type RewardScoringPipeline struct {
+	*TextClassificationPipeline
+}
+
+// RewardScore is the reward of an input.
+type RewardScore struct {
+	Reward      float32 // raw output of the model, higher is better
+	Probability float32 // sigmoid of the reward
+}
+
+type RewardScoringOutput struct {
+	Scores []RewardScore
+}
+
+func (t *RewardScoringOutput) GetOutput() []any {
+	out := make([]any, len(t.Scores))
+	for i, score := range t.Scores {
+		out[i] = any(score)
+	}
+	return out
+}
+
+// NewRewardScoringPipeline creates a reward scoring preset from a text classification pipeline of a model with one
+// or two outputs. A copy of the classifier is configured to return its raw outputs.
+func NewRewardScoringPipeline(classifier *TextClassificationPipeline) (*RewardScoringPipeline, error) {
+	if classifier == nil {
+		return nil, errors.New("a text classification pipeline is required for reward scoring")
+	}
+	outDims := classifier.OutputsMeta[0].Dimensions
+	if nLogits := outDims[len(outDims)-1]; nLogits != 1 && nLogits != 2 {
+		return nil, fmt.Errorf("reward scoring requires a model with one or two outputs, got %d", nLogits)
+	}
+	preset, err := presetClassifier(classifier, "NONE")
+	if err != nil {
+		return nil, err
+	}
+	return &RewardScoringPipeline{TextClassificationPipeline: preset}, nil
+}
+
+// PreferenceProbability is the probability that a response with the chosen reward is preferred over a response with
+// the rejected reward, under the Bradley-Terry model that reward models are trained with.
+func PreferenceProbability(chosen RewardScore, rejected RewardScore) float32 {
+	return util.Sigmoid([]float32{chosen.Reward - rejected.Reward})[0]
+}
+
+// Run the pipeline on a batch of strings.
+func (p *RewardScoringPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete reward scoring output type rather than the interface.
+func (p *RewardScoringPipeline) RunPipeline(inputs []string) (*RewardScoringOutput, error) {
+	output, err := p.TextClassificationPipeline.RunPipeline(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return rewardScores(output), nil
+}
+
+// RunPairs scores the responses to the prompts, each response along with the prompt at the same index.
+func (p *RewardScoringPipeline) RunPairs(prompts []string, responses []string) (*RewardScoringOutput, error) {
+	output, err := p.TextClassificationPipeline.RunPairs(prompts, responses)
+	if err != nil {
+		return nil, err
+	}
+	return rewardScores(output), nil
+}
+
+// rewardScores reduces the raw outputs of the classifier to a reward per input.
+func rewardScores(output *TextClassificationOutput) *RewardScoringOutput {
+	result := &RewardScoringOutput{Scores: make([]RewardScore, len(output.ClassificationOutputs))}
+	for i, classes := range output.ClassificationOutputs {
+		reward := classes[len(classes)-1].Score
+		if len(classes) == 2 {
+			reward -= classes[0].Score
+		}
+		result.Scores[i] = RewardScore{Reward: reward, Probability: util.Sigmoid([]float32{reward})[0]}
+	}
+	return result
+}
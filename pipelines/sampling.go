@@ -0,0 +1,178 @@
+package pipelines
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Stratifier assigns each input to a stratum, e.g. its predicted label or its length bucket.
+type Stratifier func(inputs []string) ([]string, error)
+
+// EvalSample is an input sampled for an evaluation set, along with its stratum. Label is empty until the
+// sample is labeled.
+type EvalSample struct {
+	Text    string `json:"text"`
+	Label   string `json:"label,omitempty"`
+	Stratum string `json:"stratum"`
+}
+
+// StratifyByPredictedLabel assigns each input to the top label predicted by the classifier, run in batches of
+// batchSize. With a language identification model, such as papluca/xlm-roberta-base-language-detection,
+// this stratifies the inputs by language.
+func StratifyByPredictedLabel(classifier *TextClassificationPipeline, batchSize int) Stratifier {
+	return func(inputs []string) ([]string, error) {
+		if batchSize <= 0 {
+			batchSize = 32
+		}
+		strata := make([]string, 0, len(inputs))
+		for batchStart := 0; batchStart < len(inputs); batchStart += batchSize {
+			output, err := classifier.RunPipeline(inputs[batchStart:min(batchStart+batchSize, len(inputs))])
+			if err != nil {
+				return nil, err
+			}
+			for _, classes := range output.ClassificationOutputs {
+				strata = append(strata, topLabel(classes))
+			}
+		}
+		return strata, nil
+	}
+}
+
+// StratifyByLength assigns each input to a bucket of its number of words. The buckets are delimited by the
+// given strictly increasing upper bounds, at least one, e.g. 16 and 64 give the buckets "0-16", "17-64" and ">64".
+func StratifyByLength(upperBounds ...int) Stratifier {
+	return func(inputs []string) ([]string, error) {
+		if len(upperBounds) == 0 {
+			return nil, errors.New("at least one upper bound of the length buckets is needed")
+		}
+		for i := 1; i < len(upperBounds); i++ {
+			if upperBounds[i] <= upperBounds[i-1] {
+				return nil, errors.New("the upper bounds of the length buckets must be strictly increasing")
+			}
+		}
+		strata := make([]string, len(inputs))
+		for i, input := range inputs {
+			words := len(strings.Fields(input))
+			bucket := sort.SearchInts(upperBounds, words)
+			switch {
+			case bucket == len(upperBounds):
+				strata[i] = fmt.Sprintf(">%d", upperBounds[len(upperBounds)-1])
+			case bucket == 0:
+				strata[i] = fmt.Sprintf("0-%d", upperBounds[0])
+			default:
+				strata[i] = fmt.Sprintf("%d-%d", upperBounds[bucket-1]+1, upperBounds[bucket])
+			}
+		}
+		return strata, nil
+	}
+}
+
+// SampleEvalSet samples size inputs, stratified with the stratifier: each stratum gets a share of the sample
+// proportional to its share of the inputs, and at least one sample. The samples are drawn from a generator
+// seeded with seed, so that the same inputs, size and seed always give the same evaluation set.
+func SampleEvalSet(inputs []string, stratifier Stratifier, size int, seed int64) ([]EvalSample, error) {
+	if size <= 0 {
+		return nil, errors.New("the sample size must be greater than zero")
+	}
+	strata, err := stratifier(inputs)
+	if err != nil {
+		return nil, err
+	}
+	if len(strata) != len(inputs) {
+		return nil, fmt.Errorf("the stratifier returned %d strata for %d inputs", len(strata), len(inputs))
+	}
+	members := map[string][]int{}
+	for i, stratum := range strata {
+		members[stratum] = append(members[stratum], i)
+	}
+	names := make([]string, 0, len(members))
+	for stratum := range members {
+		names = append(names, stratum)
+	}
+	sort.Strings(names)
+
+	allocation := allocateSample(names, members, min(size, len(inputs)), len(inputs))
+	random := rand.New(rand.NewSource(seed))
+	var samples []EvalSample
+	for _, stratum := range names {
+		indices := append([]int{}, members[stratum]...)
+		random.Shuffle(len(indices), func(i, j int) { indices[i], indices[j] = indices[j], indices[i] })
+		selected := indices[:allocation[stratum]]
+		sort.Ints(selected)
+		for _, i := range selected {
+			samples = append(samples, EvalSample{Text: inputs[i], Stratum: stratum})
+		}
+	}
+	return samples, nil
+}
+
+// allocateSample splits the sample size between the strata proportionally to their sizes, with the largest
+// remainder method, giving at least one sample to each stratum while the sample size allows.
+func allocateSample(names []string, members map[string][]int, size int, total int) map[string]int {
+	allocation := map[string]int{}
+	remainders := make([]float64, len(names))
+	allocated := 0
+	for i, stratum := range names {
+		share := float64(size) * float64(len(members[stratum])) / float64(total)
+		allocation[stratum] = int(share)
+		remainders[i] = share - float64(allocation[stratum])
+		allocated += allocation[stratum]
+	}
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	// empty strata first, then largest remainders
+	sort.SliceStable(order, func(a, b int) bool {
+		emptyA, emptyB := allocation[names[order[a]]] == 0, allocation[names[order[b]]] == 0
+		if emptyA != emptyB {
+			return emptyA
+		}
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for _, i := range order {
+		if allocated == size {
+			break
+		}
+		if allocation[names[i]] < len(members[names[i]]) {
+			allocation[names[i]]++
+			allocated++
+		}
+	}
+	return allocation
+}
+
+// WriteEvalSet writes the samples as JSON lines, to be labeled and then read back with ReadEvalSet.
+func WriteEvalSet(w io.Writer, samples []EvalSample) error {
+	encoder := json.NewEncoder(w)
+	for _, sample := range samples {
+		if err := encoder.Encode(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadEvalSet reads a labeled evaluation set written by WriteEvalSet, e.g. for NewQuantizationReport.
+func ReadEvalSet(r io.Reader) ([]LabeledInput, error) {
+	var inputs []LabeledInput
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		sample := EvalSample{}
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			return nil, fmt.Errorf("invalid evaluation sample on line %d: %w", line, err)
+		}
+		inputs = append(inputs, LabeledInput{Text: sample.Text, Label: sample.Label})
+	}
+	return inputs, scanner.Err()
+}
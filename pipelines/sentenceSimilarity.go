@@ -0,0 +1,92 @@
+package pipelines
+
+import (
+	"errors"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// SentenceSimilarityPipeline scores how similar candidate sentences are to a source sentence, as the cosine
+// similarity of their embeddings, e.g. to find the FAQ entry closest to a question or to compare paraphrases.
+type SentenceSimilarityPipeline struct {
+	Embedder *FeatureExtractionPipeline
+}
+
+type SentenceSimilarityOutput struct {
+	Similarities []float32 // cosine similarity of each candidate to the source sentence, between -1 and 1
+}
+
+func (t *SentenceSimilarityOutput) GetOutput() []any {
+	out := make([]any, len(t.Similarities))
+	for i, similarity := range t.Similarities {
+		out[i] = any(similarity)
+	}
+	return out
+}
+
+// NewSentenceSimilarityPipeline creates a sentence similarity pipeline from an embedder, whose pooling and
+// normalization are used as configured.
+func NewSentenceSimilarityPipeline(embedder *FeatureExtractionPipeline) (*SentenceSimilarityPipeline, error) {
+	pipeline := &SentenceSimilarityPipeline{Embedder: embedder}
+	if err := pipeline.Validate(); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// Run the pipeline on a batch of strings, the source sentence followed by the candidates.
+func (p *SentenceSimilarityPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete sentence similarity output type rather than the interface.
+func (p *SentenceSimilarityPipeline) RunPipeline(inputs []string) (*SentenceSimilarityOutput, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("sentence similarity requires a source sentence")
+	}
+	return p.Compare(inputs[0], inputs[1:])
+}
+
+// Compare returns the similarity of each candidate to the source sentence. The source and the candidates are
+// embedded in a single batch.
+func (p *SentenceSimilarityPipeline) Compare(source string, candidates []string) (*SentenceSimilarityOutput, error) {
+	result := &SentenceSimilarityOutput{Similarities: make([]float32, len(candidates))}
+	if len(candidates) == 0 {
+		return result, nil
+	}
+	embeddings, err := p.Embedder.RunPipeline(append([]string{source}, candidates...))
+	if err != nil {
+		return nil, err
+	}
+	for i, embedding := range embeddings.Embeddings[1:] {
+		similarity, similarityErr := util.CosineSimilarity(embeddings.Embeddings[0], embedding)
+		if similarityErr != nil {
+			return nil, similarityErr
+		}
+		result.Similarities[i] = similarity
+	}
+	return result, nil
+}
+
+// GetStats returns the runtime statistics of the embedder.
+func (p *SentenceSimilarityPipeline) GetStats() []string {
+	return p.Embedder.GetStats()
+}
+
+// GetMetadata returns the metadata of the embedder.
+func (p *SentenceSimilarityPipeline) GetMetadata() PipelineMetadata {
+	return p.Embedder.GetMetadata()
+}
+
+// Validate checks that the pipeline has an embedder.
+func (p *SentenceSimilarityPipeline) Validate() error {
+	if p.Embedder == nil {
+		return errors.New("pipeline configuration invalid: a feature extraction pipeline is required")
+	}
+	return nil
+}
+
+// Destroy does nothing, since the embedder is destroyed with its session.
+func (p *SentenceSimilarityPipeline) Destroy() error {
+	return nil
+}
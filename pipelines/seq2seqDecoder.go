@@ -0,0 +1,236 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// seq2seqDecoder is the decoder of an encoder-decoder model exported to ONNX by optimum, shared by the text2text
+// generation and speech recognition pipelines. DecoderFilename defaults to the merged decoder
+// decoder_model_merged.onnx if the model has one, and to decoder_model.onnx otherwise. With a merged decoder, the
+// past keys and values are cached between decoding steps, so that each step only runs the decoder on the last
+// token.
+type seq2seqDecoder struct {
+	DecoderFilename       string
+	DecoderSession        *ort.DynamicAdvancedSession
+	DecoderInputsMeta     []ort.InputOutputInfo
+	DecoderOutputsMeta    []ort.InputOutputInfo
+	decoderPresentIndex   map[int]int // index of the present output of each past key values input of the decoder
+	decoderHasCacheBranch bool
+}
+
+// loadDecoder reads the decoder model and its inputs and outputs, and returns the model bytes.
+func (d *seq2seqDecoder) loadDecoder(modelPath string) ([]byte, error) {
+	if d.DecoderFilename == "" {
+		d.DecoderFilename = "decoder_model.onnx"
+		if path, err := GetOnnxModelPath(modelPath, "decoder_model_merged.onnx"); err == nil && strings.HasSuffix(path, "decoder_model_merged.onnx") {
+			d.DecoderFilename = "decoder_model_merged.onnx"
+		}
+	}
+	decoder, err := loadOnnxModelBytes(modelPath, d.DecoderFilename, nil)
+	if err != nil {
+		return nil, err
+	}
+	decoderInputs, decoderOutputs, err := loadInputOutputMeta(decoder)
+	if err != nil {
+		return nil, err
+	}
+	d.DecoderInputsMeta = decoderInputs
+	d.DecoderOutputsMeta = decoderOutputs
+	d.decoderPresentIndex, d.decoderHasCacheBranch = presentOutputs(decoderInputs, decoderOutputs)
+	if len(d.decoderPresentIndex) == 0 {
+		// without past key values, only the logits are needed since the present key values are recomputed at each step
+		for _, output := range decoderOutputs {
+			if output.Name == "logits" {
+				d.DecoderOutputsMeta = []ort.InputOutputInfo{output}
+			}
+		}
+	}
+	return decoder, nil
+}
+
+// decoderMetadata returns the names and dimensions of the logits output of the decoder.
+func (d *seq2seqDecoder) decoderMetadata() PipelineMetadata {
+	for _, output := range d.DecoderOutputsMeta {
+		if output.Name == "logits" {
+			return PipelineMetadata{OutputsInfo: []OutputInfo{{Name: output.Name, Dimensions: output.Dimensions}}}
+		}
+	}
+	return PipelineMetadata{}
+}
+
+func (d *seq2seqDecoder) destroyDecoder() error {
+	if d.DecoderSession != nil {
+		return d.DecoderSession.Destroy()
+	}
+	return nil
+}
+
+func (d *seq2seqDecoder) validateDecoder() error {
+	var validationErrors []error
+	hasLogits := false
+	for _, output := range d.DecoderOutputsMeta {
+		if output.Name == "logits" {
+			hasLogits = len(output.Dimensions) == 3
+		}
+	}
+	if !hasLogits {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the decoder must have a logits output with 3 dimensions"))
+	}
+	hasInputIDs, hasHiddenStates := false, false
+	for i, input := range d.DecoderInputsMeta {
+		switch {
+		case input.Name == "input_ids":
+			hasInputIDs = true
+		case input.Name == "encoder_hidden_states":
+			hasHiddenStates = true
+		case input.Name == "encoder_attention_mask", input.Name == "use_cache_branch":
+		case strings.HasPrefix(input.Name, "past_key_values"):
+			if !d.decoderHasCacheBranch {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: decoder input %s is not supported, decoders with past key values must be merged decoders such as decoder_model_merged.onnx", input.Name))
+			} else if _, ok := d.decoderPresentIndex[i]; !ok {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: no present output for decoder input %s", input.Name))
+			}
+			if input.DataType != ort.TensorElementDataTypeFloat {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: decoder input %s must be float32", input.Name))
+			}
+		default:
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: decoder input %s is not supported", input.Name))
+		}
+	}
+	if !hasInputIDs || !hasHiddenStates {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the decoder must have input_ids and encoder_hidden_states inputs"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// decoderStep runs the decoder on the sequences generated so far and returns the logits of the last position
+// of each sequence, concatenated, along with the vocabulary size. With a merged decoder, only the last token of
+// each sequence is run after the first step, and the past key values are replaced with the present ones. The
+// encoder mask is only used by decoders with an encoder_attention_mask input.
+func (d *seq2seqDecoder) decoderStep(sequences [][]int64, past map[int]ort.Value, encoderMask []int64, encoderLength int, hiddenStates *ort.Tensor[float32]) ([]float32, int, error) {
+	batchSize := int64(len(sequences))
+	length := int64(len(sequences[0]))
+	firstStep := len(past) == 0
+	useCache := len(d.decoderPresentIndex) > 0 && !firstStep
+	inputIDs := make([]int64, 0, batchSize*length)
+	for _, sequence := range sequences {
+		if useCache {
+			inputIDs = append(inputIDs, sequence[len(sequence)-1])
+		} else {
+			inputIDs = append(inputIDs, sequence...)
+		}
+	}
+	if useCache {
+		length = 1
+	}
+
+	var tensors []ort.Value
+	defer func() {
+		for _, tensor := range tensors {
+			_ = tensor.Destroy()
+		}
+	}()
+	if firstStep {
+		// the merged decoder ignores the past key values on the first step, but onnxruntime tensors cannot be empty
+		for inputIndex := range d.decoderPresentIndex {
+			dimensions := d.DecoderInputsMeta[inputIndex].Dimensions
+			shape := make([]int64, len(dimensions))
+			for i, dimension := range dimensions {
+				shape[i] = max(dimension, 1)
+			}
+			shape[0] = batchSize
+			tensor, err := ort.NewEmptyTensor[float32](ort.NewShape(shape...))
+			if err != nil {
+				return nil, 0, err
+			}
+			past[inputIndex] = tensor
+		}
+	}
+	inputTensors := make([]ort.Value, len(d.DecoderInputsMeta))
+	for i, meta := range d.DecoderInputsMeta {
+		var tensor ort.Value
+		var err error
+		switch meta.Name {
+		case "input_ids":
+			tensor, err = ort.NewTensor(ort.NewShape(batchSize, length), inputIDs)
+		case "encoder_attention_mask":
+			tensor, err = ort.NewTensor(ort.NewShape(batchSize, int64(encoderLength)), encoderMask)
+		case "use_cache_branch":
+			useCacheBranch := []byte{0}
+			if useCache {
+				useCacheBranch[0] = 1
+			}
+			tensor, err = ort.NewCustomDataTensor(ort.NewShape(1), useCacheBranch, ort.TensorElementDataTypeBool)
+		case "encoder_hidden_states":
+			inputTensors[i] = hiddenStates
+			continue
+		default:
+			inputTensors[i] = past[i]
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		tensors = append(tensors, tensor)
+		inputTensors[i] = tensor
+	}
+	outputTensors := make([]ort.Value, len(d.DecoderOutputsMeta))
+	if err := d.DecoderSession.Run(inputTensors, outputTensors); err != nil {
+		return nil, 0, err
+	}
+
+	// the present key values become the past key values of the next step
+	isPresent := map[int]bool{}
+	for inputIndex, outputIndex := range d.decoderPresentIndex {
+		tensors = append(tensors, past[inputIndex])
+		past[inputIndex] = outputTensors[outputIndex]
+		isPresent[outputIndex] = true
+	}
+	var logitsTensor *ort.Tensor[float32]
+	for i, output := range outputTensors {
+		if isPresent[i] {
+			continue
+		}
+		tensors = append(tensors, output)
+		if d.DecoderOutputsMeta[i].Name == "logits" {
+			logitsTensor, _ = output.(*ort.Tensor[float32])
+		}
+	}
+	if logitsTensor == nil {
+		return nil, 0, errors.New("the decoder logits are not a float32 tensor")
+	}
+	shape := logitsTensor.GetShape()
+	vocabularySize := int(shape[2])
+	data := logitsTensor.GetData()
+	logits := make([]float32, 0, int(batchSize)*vocabularySize)
+	for i := 0; i < int(batchSize); i++ {
+		last := (i*int(length) + int(length) - 1) * vocabularySize
+		logits = append(logits, data[last:last+vocabularySize]...)
+	}
+	return logits, vocabularySize, nil
+}
+
+// destroyPast destroys the past key values cached by decoderStep.
+func destroyPast(past map[int]ort.Value) {
+	for _, tensor := range past {
+		_ = tensor.Destroy()
+	}
+}
+
+// reorderPast replaces the past key values cached by decoderStep with the given rows of the batch, in order, to
+// follow the beams of beam search.
+func reorderPast(past map[int]ort.Value, rows []int) error {
+	for inputIndex, value := range past {
+		reordered, err := gatherRows(value, rows)
+		if err != nil {
+			return err
+		}
+		_ = value.Destroy()
+		past[inputIndex] = reordered
+	}
+	return nil
+}
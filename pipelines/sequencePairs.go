@@ -0,0 +1,144 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/daulet/tokenizers"
+	jsoniter "github.com/json-iterator/go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// pairEncoder encodes pairs of sequences, such as a premise and a hypothesis, as a single input. The tokenizer
+// library only encodes single sequences, so the two sequences are joined with the special tokens that the pair
+// template of the model puts between them, e.g. [SEP] for BERT or </s></s> for RoBERTa, and the token type ids of
+// the second sequence are set after tokenization.
+type pairEncoder struct {
+	separator       string   // special tokens between the two sequences
+	separatorIDs    []uint32 // token ids of the separator
+	secondSequence  uint32   // token type id of the second sequence
+	setSecondTypeID bool     // false if the second sequence has the token type id of the first one
+}
+
+// tokenizerPostProcessor holds the fields of the post processor of tokenizer.json that describe pairs.
+type tokenizerPostProcessor struct {
+	Type string `json:"type"`
+	Sep  []any  `json:"sep"` // BertProcessing and RobertaProcessing: [token, id]
+	Pair []struct {
+		SpecialToken *struct {
+			ID     string `json:"id"`
+			TypeID uint32 `json:"type_id"`
+		} `json:"SpecialToken"`
+		Sequence *struct {
+			ID     string `json:"id"`
+			TypeID uint32 `json:"type_id"`
+		} `json:"Sequence"`
+	} `json:"pair"`
+	Processors []*tokenizerPostProcessor `json:"processors"` // Sequence
+}
+
+// loadPairEncoder reads how the model encodes pairs from the post processor of its tokenizer.json. Models without
+// a post processor describing pairs use the sep_token of their special_tokens_map.json.
+func loadPairEncoder(modelPath string, tk *tokenizers.Tokenizer) (*pairEncoder, error) {
+	var tokenizerConfig struct {
+		PostProcessor *tokenizerPostProcessor `json:"post_processor"`
+	}
+	tokenizerBytes, err := util.ReadFileBytes(util.PathJoinSafe(modelPath, "tokenizer.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err = jsoniter.Unmarshal(tokenizerBytes, &tokenizerConfig); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal tokenizer.json at %s: %w", modelPath, err)
+	}
+
+	encoder := &pairEncoder{}
+	postProcessor := tokenizerConfig.PostProcessor
+	if postProcessor != nil && postProcessor.Type == "Sequence" {
+		// the pairs are described by one of the processors of the sequence
+		for _, processor := range postProcessor.Processors {
+			if processor != nil && (len(processor.Pair) > 0 || len(processor.Sep) > 0) {
+				postProcessor = processor
+			}
+		}
+	}
+	switch {
+	case postProcessor != nil && postProcessor.Type == "TemplateProcessing" && len(postProcessor.Pair) > 0:
+		var separator []string
+		inSeparator := false
+		for _, piece := range postProcessor.Pair {
+			switch {
+			case piece.Sequence != nil && piece.Sequence.ID == "A":
+				inSeparator = true
+			case piece.Sequence != nil && piece.Sequence.ID == "B":
+				inSeparator = false
+				encoder.secondSequence = piece.Sequence.TypeID
+				encoder.setSecondTypeID = true
+			case piece.SpecialToken != nil && inSeparator:
+				separator = append(separator, piece.SpecialToken.ID)
+			}
+		}
+		encoder.separator = strings.Join(separator, "")
+	case postProcessor != nil && (postProcessor.Type == "BertProcessing" || postProcessor.Type == "RobertaProcessing") && len(postProcessor.Sep) > 0:
+		sep, ok := postProcessor.Sep[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("the separator token of tokenizer.json at %s is not a string", modelPath)
+		}
+		if postProcessor.Type == "RobertaProcessing" {
+			encoder.separator = sep + sep
+		} else {
+			encoder.separator = sep
+			encoder.secondSequence = 1
+			encoder.setSecondTypeID = true
+		}
+	default:
+		sep, sepErr := readSpecialToken(modelPath, "sep_token")
+		if sepErr != nil {
+			return nil, sepErr
+		}
+		encoder.separator = sep
+		encoder.secondSequence = 1
+		encoder.setSecondTypeID = true
+	}
+	if encoder.separator == "" {
+		return nil, errors.New("the pair template of the tokenizer has no separator between the sequences")
+	}
+	encoder.separatorIDs, _ = tk.Encode(encoder.separator, false)
+	if len(encoder.separatorIDs) == 0 {
+		return nil, fmt.Errorf("separator %s is not encoded by the tokenizer", encoder.separator)
+	}
+	return encoder, nil
+}
+
+// tokenizePairs tokenizes pairs of sequences into the batch, with the token type ids of the second sequence of
+// each pair set as in the pair template of the model.
+func (e *pairEncoder) tokenizePairs(batch *PipelineBatch, tk *tokenizers.Tokenizer, first []string, second []string, options []tokenizers.EncodeOption) error {
+	if len(first) != len(second) {
+		return fmt.Errorf("got %d texts but %d text pairs", len(first), len(second))
+	}
+	pairs := make([]string, len(first))
+	for i := range first {
+		pairs[i] = first[i] + e.separator + second[i]
+	}
+	tokenizeInputs(batch, tk, pairs, options)
+	if !e.setSecondTypeID {
+		return nil
+	}
+	for _, input := range batch.Input {
+		// the second sequence starts after the first occurrence of the separator
+		for j := 0; j+len(e.separatorIDs) <= len(input.TokenIDs); j++ {
+			if !slices.Equal(input.TokenIDs[j:j+len(e.separatorIDs)], e.separatorIDs) {
+				continue
+			}
+			for k := j + len(e.separatorIDs); k < len(input.TypeIDs); k++ {
+				if k >= len(input.AttentionMask) || input.AttentionMask[k] != 0 {
+					input.TypeIDs[k] = e.secondSequence
+				}
+			}
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/daulet/tokenizers"
+	jsoniter "github.com/json-iterator/go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// slidingWindow splits inputs longer than the maximum length of a model into overlapping windows of tokens, each
+// with the special tokens that the model adds around a single sequence, e.g. [CLS] and [SEP] for BERT.
+type slidingWindow struct {
+	length   int                 // tokens of a window, special tokens included, 0 for the maximum length of the model
+	stride   int                 // tokens shared by consecutive windows
+	template tokenizers.Encoding // encoding of a short text with the special tokens around it
+	first    int                 // position of the first token of the text in the template
+	last     int                 // position of the last token of the text in the template
+}
+
+// init resolves the length of the windows and reads the special tokens around a sequence.
+func (w *slidingWindow) init(modelPath string, tk *tokenizers.Tokenizer) error {
+	if w.length == 0 {
+		length, err := readModelMaxLength(modelPath)
+		if err != nil {
+			return err
+		}
+		w.length = length
+	}
+	w.template = tk.EncodeWithOptions("a", true, tokenizers.WithReturnAllAttributes())
+	w.first, w.last = -1, -1
+	for i, special := range w.template.SpecialTokensMask {
+		if special == 0 {
+			if w.first < 0 {
+				w.first = i
+			}
+			w.last = i
+		}
+	}
+	if w.first < 0 {
+		return errors.New("cannot find the position of the sequence among the special tokens of the tokenizer")
+	}
+	return nil
+}
+
+// contentLength is the number of tokens of the input in a window.
+func (w *slidingWindow) contentLength() int {
+	return w.length - w.specialTokens()
+}
+
+// specialTokens is the number of special tokens of a window.
+func (w *slidingWindow) specialTokens() int {
+	return len(w.template.IDs) - (w.last - w.first + 1)
+}
+
+func (w *slidingWindow) validate() error {
+	var validationErrors []error
+	if w.contentLength() <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: window length %d leaves no room for tokens besides the special tokens", w.length))
+	}
+	if w.stride < 0 || w.stride >= w.contentLength() {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: window stride must be positive and smaller than the %d tokens of a window", w.contentLength()))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// tokenize tokenizes the inputs into the windows of the batch, and records the input of each window. The tokens of
+// the prefix, if any, start every window, after the leading special tokens, and are marked as special tokens so that
+// they are not part of the chunks of the input.
+func (w *slidingWindow) tokenize(batch *PipelineBatch, tk *tokenizers.Tokenizer, inputs []string, prefix tokenizers.Encoding) {
+	batch.Input = nil
+	batch.windows = nil
+	batch.MaxSequenceLength = 0
+	contentLength := w.contentLength() - len(prefix.IDs)
+	step := contentLength - w.stride
+	for i, input := range inputs {
+		encoding := tk.EncodeWithOptions(input, false, tokenizers.WithReturnTokens(), tokenizers.WithReturnOffsets())
+		for start := 0; ; start += step {
+			end := min(start+contentLength, len(encoding.IDs))
+			window := w.window(input, encoding, start, end, prefix)
+			batch.Input = append(batch.Input, window)
+			batch.windows = append(batch.windows, i)
+			batch.MaxSequenceLength = max(batch.MaxSequenceLength, len(window.TokenIDs))
+			if end == len(encoding.IDs) {
+				break
+			}
+		}
+	}
+}
+
+// validatePrefix returns an error if the tokens of a prefix leave no room for the tokens of the input in a window.
+func (w *slidingWindow) validatePrefix(prefix tokenizers.Encoding) error {
+	if len(prefix.IDs) > 0 && w.contentLength()-len(prefix.IDs) <= w.stride {
+		return fmt.Errorf("prefix of %d tokens leaves no room for the input in windows of %d tokens with a stride of %d tokens",
+			len(prefix.IDs), w.contentLength(), w.stride)
+	}
+	return nil
+}
+
+// window wraps the tokens of the prefix and the tokens from start to end of the encoding of an input with the
+// special tokens of the model.
+func (w *slidingWindow) window(input string, encoding tokenizers.Encoding, start int, end int, prefix tokenizers.Encoding) tokenizedInput {
+	length := w.specialTokens() + len(prefix.IDs) + end - start
+	window := tokenizedInput{
+		TokenIDs:          make([]uint32, 0, length),
+		TypeIDs:           make([]uint32, 0, length),
+		AttentionMask:     make([]uint32, 0, length),
+		SpecialTokensMask: make([]uint32, 0, length),
+		Tokens:            make([]string, 0, length),
+		Offsets:           make([]tokenizers.Offset, 0, length),
+		MaxAttentionIndex: length - 1,
+	}
+	for i := range w.template.IDs {
+		if i < w.first || i > w.last {
+			window.TokenIDs = append(window.TokenIDs, w.template.IDs[i])
+			window.TypeIDs = append(window.TypeIDs, w.template.TypeIDs[i])
+			window.SpecialTokensMask = append(window.SpecialTokensMask, 1)
+			window.Tokens = append(window.Tokens, w.template.Tokens[i])
+			window.Offsets = append(window.Offsets, tokenizers.Offset{})
+			continue
+		}
+		if i != w.first {
+			continue
+		}
+		window.TokenIDs = append(window.TokenIDs, prefix.IDs...)
+		window.Tokens = append(window.Tokens, prefix.Tokens...)
+		for range prefix.IDs {
+			window.TypeIDs = append(window.TypeIDs, w.template.TypeIDs[i])
+			window.SpecialTokensMask = append(window.SpecialTokensMask, 1)
+			window.Offsets = append(window.Offsets, tokenizers.Offset{})
+		}
+		window.TokenIDs = append(window.TokenIDs, encoding.IDs[start:end]...)
+		window.Tokens = append(window.Tokens, encoding.Tokens[start:end]...)
+		window.Offsets = append(window.Offsets, encoding.Offsets[start:end]...)
+		for range end - start {
+			window.TypeIDs = append(window.TypeIDs, w.template.TypeIDs[i])
+			window.SpecialTokensMask = append(window.SpecialTokensMask, 0)
+		}
+	}
+	for range length {
+		window.AttentionMask = append(window.AttentionMask, 1)
+	}
+	if end > start {
+		window.Raw = input[encoding.Offsets[start][0]:encoding.Offsets[end-1][1]]
+	}
+	return window
+}
+
+// mergeWindowScores merges the scores of the windows of each input:
+//   - MEAN: the mean of the scores of the windows;
+//   - MAX: the maximum score of each label over the windows;
+//   - VOTE: each window votes for its top label, and the score of a label is its share of the votes.
+func mergeWindowScores[T float32 | float64](scores [][]T, windows []int, aggregation string) ([][]T, error) {
+	if len(windows) == 0 {
+		return nil, nil
+	}
+	merged := make([][]T, windows[len(windows)-1]+1)
+	counts := make([]int, len(merged))
+	for i, scoresWindow := range scores {
+		input := windows[i]
+		if merged[input] == nil {
+			merged[input] = make([]T, len(scoresWindow))
+			if aggregation == "MAX" {
+				copy(merged[input], scoresWindow)
+			}
+		}
+		counts[input]++
+		switch aggregation {
+		case "MEAN":
+			for j, score := range scoresWindow {
+				merged[input][j] += score
+			}
+		case "MAX":
+			for j, score := range scoresWindow {
+				merged[input][j] = max(merged[input][j], score)
+			}
+		case "VOTE":
+			index, _, err := util.ArgMax(scoresWindow)
+			if err != nil {
+				return nil, err
+			}
+			merged[input][index]++
+		default:
+			return nil, fmt.Errorf("window aggregation %s is not supported", aggregation)
+		}
+	}
+	if aggregation != "MAX" {
+		for input := range merged {
+			for j := range merged[input] {
+				merged[input][j] /= T(counts[input])
+			}
+		}
+	}
+	return merged, nil
+}
+
+// readModelMaxLength reads the maximum number of tokens of the model from the model_max_length of its
+// tokenizer_config.json, or else from the truncation of its tokenizer.json.
+func readModelMaxLength(modelPath string) (int, error) {
+	var tokenizerConfig struct {
+		ModelMaxLength float64 `json:"model_max_length"`
+	}
+	configBytes, err := util.ReadFileBytes(util.PathJoinSafe(modelPath, "tokenizer_config.json"))
+	if err == nil && jsoniter.Unmarshal(configBytes, &tokenizerConfig) == nil {
+		// transformers saves a very large integer if the model has no maximum length
+		if tokenizerConfig.ModelMaxLength > 0 && tokenizerConfig.ModelMaxLength < 1e6 {
+			return int(tokenizerConfig.ModelMaxLength), nil
+		}
+	}
+	var tokenizerJSON struct {
+		Truncation *struct {
+			MaxLength int `json:"max_length"`
+		} `json:"truncation"`
+	}
+	tokenizerBytes, err := util.ReadFileBytes(util.PathJoinSafe(modelPath, "tokenizer.json"))
+	if err != nil {
+		return 0, err
+	}
+	if err = jsoniter.Unmarshal(tokenizerBytes, &tokenizerJSON); err != nil {
+		return 0, fmt.Errorf("cannot unmarshal tokenizer.json at %s: %w", modelPath, err)
+	}
+	if tokenizerJSON.Truncation == nil || tokenizerJSON.Truncation.MaxLength <= 0 {
+		return 0, fmt.Errorf("cannot find the maximum length of the model at %s, set the window length", modelPath)
+	}
+	return tokenizerJSON.Truncation.MaxLength, nil
+}
+
+// loadWindowTokenizer loads the tokenizer of a model, without truncation if its inputs are split into windows,
+// and initializes the windows with it.
+func loadWindowTokenizer(modelPath string, window *slidingWindow) (*tokenizers.Tokenizer, error) {
+	if window == nil {
+		return loadTokenizer(modelPath)
+	}
+	tk, err := loadTokenizerWithoutTruncation(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = window.init(modelPath, tk); err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	return tk, nil
+}
+
+// loadTokenizerWithoutTruncation loads the tokenizer of a model with the truncation and the padding of its
+// tokenizer.json removed, so that long inputs can be split into windows rather than truncated.
+func loadTokenizerWithoutTruncation(modelPath string) (*tokenizers.Tokenizer, error) {
+	tokenizerBytes, err := util.ReadFileBytes(util.PathJoinSafe(modelPath, "tokenizer.json"))
+	if err != nil {
+		return nil, err
+	}
+	// numbers are kept as they are written in tokenizer.json
+	json := jsoniter.Config{UseNumber: true}.Froze()
+	var tokenizerJSON map[string]any
+	if err = json.Unmarshal(tokenizerBytes, &tokenizerJSON); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal tokenizer.json at %s: %w", modelPath, err)
+	}
+	if tokenizerJSON["truncation"] != nil || tokenizerJSON["padding"] != nil {
+		tokenizerJSON["truncation"] = nil
+		tokenizerJSON["padding"] = nil
+		if tokenizerBytes, err = json.Marshal(tokenizerJSON); err != nil {
+			return nil, err
+		}
+	}
+	return tokenizers.FromBytes(tokenizerBytes)
+}
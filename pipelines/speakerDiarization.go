@@ -0,0 +1,482 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// types
+
+// SpeakerDiarizationPipeline finds who spoke when in audio recordings, with speaker embedding models exported to
+// ONNX such as the WeSpeaker ones (e.g. pyannote/wespeaker-voxceleb-resnet34-LM), which take Kaldi fbank features
+// of shape [batch, frames, mels], or models taking the waveform of shape [batch, samples] or [batch, 1, samples].
+// The speech found by the voice activity detector is split into windows of WindowLength seconds every WindowStep
+// seconds, each window is embedded, and the embeddings are clustered with average linkage agglomerative
+// clustering, into NumSpeakers speakers if it is set or else until no two clusters are more similar than
+// Threshold. Audio is resampled to 16 kHz.
+type SpeakerDiarizationPipeline struct {
+	basePipeline
+	VAD             VoiceActivityDetector
+	NumSpeakers     int     // number of speakers of each input, estimated with Threshold if 0
+	Threshold       float32 // minimum mean cosine similarity of the windows of a speaker
+	WindowLength    float64 // seconds
+	WindowStep      float64 // seconds
+	BatchSize       int     // windows embedded per model run
+	SampleRate      int
+	FeaturesTimings *timings
+	fbank           *util.Fbank // nil for models taking the waveform
+}
+
+// SpeakerSegment is a segment of audio during which a speaker speaks, in seconds from the start of the audio.
+type SpeakerSegment struct {
+	Speaker string // SPEAKER_00, SPEAKER_01, ... by order of first appearance
+	Start   float64
+	End     float64
+}
+
+// Diarization is the diarization of an audio input.
+type Diarization struct {
+	Segments    []SpeakerSegment // segments of speech by start time, without overlaps
+	NumSpeakers int
+}
+
+type SpeakerDiarizationOutput struct {
+	Diarizations []Diarization
+}
+
+func (t *SpeakerDiarizationOutput) GetOutput() []any {
+	out := make([]any, len(t.Diarizations))
+	for i, diarization := range t.Diarizations {
+		out[i] = any(diarization)
+	}
+	return out
+}
+
+// speakerWindow is a window of speech of an input, embedded by the model. The segment attributed to the window
+// goes from start to end, and is part of the audio embedded.
+type speakerWindow struct {
+	input      int
+	start, end float64 // seconds
+	samples    []float32
+}
+
+// options
+
+// WithSpeakerVAD sets the voice activity detector that finds the speech to diarize, NewEnergyVAD() by default.
+func WithSpeakerVAD(detector VoiceActivityDetector) PipelineOption[*SpeakerDiarizationPipeline] {
+	return func(pipeline *SpeakerDiarizationPipeline) {
+		pipeline.VAD = detector
+	}
+}
+
+// WithNumSpeakers sets the number of speakers of each input when it is known, rather than estimating it.
+func WithNumSpeakers(numSpeakers int) PipelineOption[*SpeakerDiarizationPipeline] {
+	return func(pipeline *SpeakerDiarizationPipeline) {
+		pipeline.NumSpeakers = numSpeakers
+	}
+}
+
+// WithSpeakerThreshold sets the minimum mean cosine similarity of the windows of a speaker, 0.5 by default. Lower
+// thresholds find fewer speakers.
+func WithSpeakerThreshold(threshold float32) PipelineOption[*SpeakerDiarizationPipeline] {
+	return func(pipeline *SpeakerDiarizationPipeline) {
+		pipeline.Threshold = threshold
+	}
+}
+
+// WithSpeakerWindow sets the length of the windows embedded and the step between them in seconds, 1.5 and 0.75 by
+// default.
+func WithSpeakerWindow(length float64, step float64) PipelineOption[*SpeakerDiarizationPipeline] {
+	return func(pipeline *SpeakerDiarizationPipeline) {
+		pipeline.WindowLength = length
+		pipeline.WindowStep = step
+	}
+}
+
+// NewSpeakerDiarizationPipeline initializes a new speaker diarization pipeline.
+func NewSpeakerDiarizationPipeline(config PipelineConfig[*SpeakerDiarizationPipeline], ortOptions *ort.SessionOptions) (*SpeakerDiarizationPipeline, error) {
+	pipeline := &SpeakerDiarizationPipeline{
+		Threshold:    0.5,
+		WindowLength: 1.5,
+		WindowStep:   0.75,
+		BatchSize:    32,
+		SampleRate:   16000,
+	}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+	if pipeline.VAD == nil {
+		pipeline.VAD = NewEnergyVAD()
+	}
+
+	// onnx model init
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+	inputs, outputs, err := loadInputOutputMeta(model)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = outputs
+
+	// models with a fixed number of mels take fbank features
+	if len(inputs) == 1 && len(inputs[0].Dimensions) == 3 && inputs[0].Dimensions[1] != 1 && inputs[0].Dimensions[2] > 1 {
+		pipeline.fbank = util.NewFbank(pipeline.SampleRate, int(inputs[0].Dimensions[2]))
+	}
+
+	// creation of the session, there is no tokenizer
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := config.EngineCache.createSession(model, inputs, outputs[:min(1, len(outputs))], ortOptions)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.OrtSession = session
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
+	pipeline.FeaturesTimings = &timings{}
+
+	// validate
+	err = pipeline.Validate()
+	if err != nil {
+		errDestroy := pipeline.Destroy()
+		return nil, errors.Join(err, errDestroy)
+	}
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the speaker embeddings.
+func (p *SpeakerDiarizationPipeline) GetMetadata() PipelineMetadata {
+	return PipelineMetadata{
+		OutputsInfo: []OutputInfo{
+			{
+				Name:       p.OutputsMeta[0].Name,
+				Dimensions: p.OutputsMeta[0].Dimensions,
+			},
+		},
+	}
+}
+
+// Destroy frees the speaker diarization pipeline resources.
+func (p *SpeakerDiarizationPipeline) Destroy() error {
+	return p.OrtSession.Destroy()
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *SpeakerDiarizationPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Features: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.FeaturesTimings.TotalNS),
+			p.FeaturesTimings.NumCalls,
+			time.Duration(float64(p.FeaturesTimings.TotalNS)/math.Max(1, float64(p.FeaturesTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *SpeakerDiarizationPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.InputsMeta) != 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: speaker embedding models must have a single input"))
+	} else if dimensions := p.InputsMeta[0].Dimensions; p.fbank == nil && len(dimensions) != 2 && (len(dimensions) != 3 || dimensions[1] != 1) {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the input must be fbank features [batch, frames, mels] or a waveform [batch, samples] or [batch, 1, samples]"))
+	}
+	if len(p.OutputsMeta) == 0 || len(p.OutputsMeta[0].Dimensions) != 2 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: speaker embedding models must output embeddings with 2 dimensions"))
+	}
+	if p.NumSpeakers < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the number of speakers cannot be negative"))
+	}
+	if p.WindowLength <= 0 || p.WindowStep <= 0 || p.WindowStep > p.WindowLength {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the window step must be greater than zero and at most the window length"))
+	}
+	if p.BatchSize <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the batch size must be greater than zero"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// windows splits the speech segments of an input into windows of WindowLength seconds every WindowStep seconds,
+// the last one ending with the segment. Each window is attributed the audio closer to its center than to the
+// centers of the windows around it.
+func (p *SpeakerDiarizationPipeline) windows(input int, samples []float32, segments []util.AudioSegment) []speakerWindow {
+	var windows []speakerWindow
+	rate := float64(p.SampleRate)
+	for _, segment := range segments {
+		var starts []float64
+		for start := segment.Start; ; start += p.WindowStep {
+			if start+p.WindowLength >= segment.End {
+				starts = append(starts, max(segment.Start, segment.End-p.WindowLength))
+				break
+			}
+			starts = append(starts, start)
+		}
+		for i, start := range starts {
+			// full windows have the same number of samples, so that they are embedded together
+			from := min(int(math.Round(start*rate)), len(samples))
+			to := min(from+int(math.Round((min(start+p.WindowLength, segment.End)-start)*rate)), len(samples))
+			window := speakerWindow{
+				input:   input,
+				start:   segment.Start,
+				end:     segment.End,
+				samples: samples[from:to],
+			}
+			if i > 0 {
+				window.start = (start + starts[i-1] + p.WindowLength) / 2
+			}
+			if i < len(starts)-1 {
+				window.end = (start + starts[i+1] + p.WindowLength) / 2
+			}
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
+
+// Preprocess creates the input tensor of windows of the same number of samples, with their fbank features if the
+// model takes them.
+func (p *SpeakerDiarizationPipeline) Preprocess(windows []speakerWindow) (*ort.Tensor[float32], error) {
+	start := time.Now()
+	numSamples := len(windows[0].samples)
+	shape := ort.NewShape(int64(len(windows)), int64(numSamples))
+	if len(p.InputsMeta[0].Dimensions) == 3 {
+		shape = ort.NewShape(int64(len(windows)), 1, int64(numSamples))
+	}
+	var values []float32
+	for _, window := range windows {
+		if p.fbank == nil {
+			values = append(values, window.samples...)
+			continue
+		}
+		// features of 16 bit samples, with their mean over the window subtracted
+		scaled := make([]float32, len(window.samples))
+		for i, sample := range window.samples {
+			scaled[i] = sample * 32768
+		}
+		features := p.fbank.Features(scaled)
+		numFrames := len(features) / p.fbank.NumMels
+		for mel := range p.fbank.NumMels {
+			var mean float32
+			for frame := range numFrames {
+				mean += features[frame*p.fbank.NumMels+mel]
+			}
+			mean /= float32(numFrames)
+			for frame := range numFrames {
+				features[frame*p.fbank.NumMels+mel] -= mean
+			}
+		}
+		values = append(values, features...)
+		shape = ort.NewShape(int64(len(windows)), int64(numFrames), int64(p.fbank.NumMels))
+	}
+	atomic.AddUint64(&p.FeaturesTimings.NumCalls, 1)
+	atomic.AddUint64(&p.FeaturesTimings.TotalNS, uint64(time.Since(start)))
+	return ort.NewTensor(shape, values)
+}
+
+// Forward runs the model on the input and returns the embedding of each window.
+func (p *SpeakerDiarizationPipeline) Forward(input *ort.Tensor[float32]) ([][]float32, error) {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	outputs := []ort.Value{nil}
+	if err := p.OrtSession.Run([]ort.Value{input}, outputs); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = outputs[0].Destroy()
+	}()
+	embeddingsTensor, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, errors.New("the speaker embeddings are not a float32 tensor")
+	}
+	shape := embeddingsTensor.GetShape()
+	data := embeddingsTensor.GetData()
+	embeddings := make([][]float32, shape[0])
+	for i := range embeddings {
+		embeddings[i] = append([]float32(nil), data[i*int(shape[1]):(i+1)*int(shape[1])]...)
+	}
+	p.PipelineMemory.recordForward(usageBefore, nil)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return embeddings, nil
+}
+
+// Postprocess clusters the embeddings of the windows of each input into speakers, and merges the consecutive
+// windows of a speaker into segments.
+func (p *SpeakerDiarizationPipeline) Postprocess(windows []speakerWindow, embeddings [][]float32, numInputs int) (*SpeakerDiarizationOutput, error) {
+	output := &SpeakerDiarizationOutput{Diarizations: make([]Diarization, numInputs)}
+	for input := range numInputs {
+		var inputWindows []speakerWindow
+		var inputEmbeddings [][]float32
+		for i, window := range windows {
+			if window.input == input {
+				inputWindows = append(inputWindows, window)
+				inputEmbeddings = append(inputEmbeddings, embeddings[i])
+			}
+		}
+		if len(inputWindows) == 0 {
+			continue
+		}
+		speakers, err := util.AgglomerativeClustering(inputEmbeddings, min(p.NumSpeakers, len(inputEmbeddings)), p.Threshold)
+		if err != nil {
+			return nil, err
+		}
+		diarization := &output.Diarizations[input]
+		for i, window := range inputWindows {
+			speaker := fmt.Sprintf("SPEAKER_%02d", speakers[i])
+			diarization.NumSpeakers = max(diarization.NumSpeakers, speakers[i]+1)
+			if n := len(diarization.Segments); n > 0 && diarization.Segments[n-1].Speaker == speaker && diarization.Segments[n-1].End >= window.start {
+				diarization.Segments[n-1].End = window.end
+				continue
+			}
+			diarization.Segments = append(diarization.Segments, SpeakerSegment{Speaker: speaker, Start: window.start, End: window.end})
+		}
+	}
+	return output, nil
+}
+
+// AssignSpeakers sets the Speaker of the chunks and segments of a transcription to the speaker of the diarization
+// who speaks the most during each of them, composing a speech recognition pipeline with a speaker diarization one
+// to get speaker attributed transcripts. Chunks without speech of the diarization keep no speaker.
+func AssignSpeakers(transcription *Transcription, diarization Diarization) {
+	assign := func(chunks []TranscriptionChunk) {
+		for i, chunk := range chunks {
+			overlaps := map[string]float64{}
+			for _, segment := range diarization.Segments {
+				if overlap := min(chunk.End, segment.End) - max(chunk.Start, segment.Start); overlap > 0 {
+					overlaps[segment.Speaker] += overlap
+				}
+			}
+			speakers := make([]string, 0, len(overlaps))
+			for speaker := range overlaps {
+				speakers = append(speakers, speaker)
+			}
+			sort.Strings(speakers)
+			best := ""
+			for _, speaker := range speakers {
+				if best == "" || overlaps[speaker] > overlaps[best] {
+					best = speaker
+				}
+			}
+			chunks[i].Speaker = best
+		}
+	}
+	assign(transcription.Chunks)
+	assign(transcription.Segments)
+}
+
+// Run the pipeline on a batch of paths to audio files, in the formats supported by util.DecodeAudio.
+func (p *SpeakerDiarizationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete speaker diarization output type rather than the interface.
+func (p *SpeakerDiarizationPipeline) RunPipeline(inputs []string) (*SpeakerDiarizationOutput, error) {
+	files := make([][]byte, len(inputs))
+	for i, input := range inputs {
+		file, err := util.ReadFileBytes(input)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = file
+	}
+	return p.RunAudio(files)
+}
+
+// RunAudio diarizes a batch of audio files, in the formats supported by util.DecodeAudio.
+func (p *SpeakerDiarizationPipeline) RunAudio(inputs [][]byte) (*SpeakerDiarizationOutput, error) {
+	audio := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		samples, sampleRate, err := util.DecodeAudio(input)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode input %d: %w", i, err)
+		}
+		audio[i] = util.ResampleAudio(samples, sampleRate, p.SampleRate)
+	}
+	return p.RunPCM(audio, p.SampleRate)
+}
+
+// RunPCM diarizes a batch of mono PCM audio inputs, with samples between -1 and 1 at the given sample rate.
+func (p *SpeakerDiarizationPipeline) RunPCM(inputs [][]float32, sampleRate int) (*SpeakerDiarizationOutput, error) {
+	var windows []speakerWindow
+	for i, input := range inputs {
+		samples := util.ResampleAudio(input, sampleRate, p.SampleRate)
+		segments, err := p.VAD.DetectSpeech(samples, p.SampleRate)
+		if err != nil {
+			return nil, fmt.Errorf("cannot detect the speech of input %d: %w", i, err)
+		}
+		windows = append(windows, p.windows(i, samples, segments)...)
+	}
+
+	// windows of the same length are embedded together, in batches of BatchSize
+	byLength := map[int][]int{}
+	var lengths []int
+	for i, window := range windows {
+		if p.fbank != nil && p.fbank.NumFrames(len(window.samples)) == 0 {
+			// too short for a frame of features, padded with silence
+			padded := make([]float32, p.fbank.FrameLength)
+			copy(padded, window.samples)
+			window.samples = padded
+			windows[i] = window
+		}
+		if _, ok := byLength[len(window.samples)]; !ok {
+			lengths = append(lengths, len(window.samples))
+		}
+		byLength[len(window.samples)] = append(byLength[len(window.samples)], i)
+	}
+	embeddings := make([][]float32, len(windows))
+	for _, length := range lengths {
+		indices := byLength[length]
+		for start := 0; start < len(indices); start += p.BatchSize {
+			batchIndices := indices[start:min(start+p.BatchSize, len(indices))]
+			batch := make([]speakerWindow, len(batchIndices))
+			for i, index := range batchIndices {
+				batch[i] = windows[index]
+			}
+			batchEmbeddings, err := p.embed(batch)
+			if err != nil {
+				return nil, err
+			}
+			for i, index := range batchIndices {
+				embeddings[index] = batchEmbeddings[i]
+			}
+		}
+	}
+	return p.Postprocess(windows, embeddings, len(inputs))
+}
+
+// embed returns the embeddings of windows of the same number of samples.
+func (p *SpeakerDiarizationPipeline) embed(windows []speakerWindow) ([][]float32, error) {
+	input, err := p.Preprocess(windows)
+	if err != nil {
+		return nil, err
+	}
+	embeddings, err := p.Forward(input)
+	return embeddings, errors.Join(err, input.Destroy())
+}
@@ -0,0 +1,287 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync/atomic"
+
+	util "github.com/knights-analytics/hugot/utils"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// generateSpeculative generates the text that follows a prompt with speculative decoding: at each step, the draft
+// model proposes DraftTokens tokens, one at a time, and the model runs once on all of them to verify them. With
+// greedy decoding, the proposed tokens are accepted as long as they are the ones the model would pick, and with
+// sampling, as in speculative sampling, a token proposed with probability q and of probability p for the model is
+// accepted with probability min(1, p/q). The token of the model at the first rejected position, or after the last
+// proposed token if they are all accepted, is then added, so that the generated text follows the distribution of
+// the model, while most tokens only cost a run of the draft model. The caches are truncated to drop the rejected
+// tokens.
+func (p *TextGenerationPipeline) generateSpeculative(prompt []int64, settings *generationSettings) (text string, err error) {
+	cache, err := p.startCache(prompt)
+	if err != nil {
+		return "", err
+	}
+	draftCache, err := p.Draft.startCache(prompt)
+	if err != nil {
+		return "", errors.Join(err, cache.destroy())
+	}
+	sequence := append([]int64{}, prompt...) // the prompt and the generated tokens
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, cache.destroy(), draftCache.destroy())
+			return
+		}
+		err = errors.Join(p.endCache(cache, sequence), p.Draft.endCache(draftCache, sequence))
+	}()
+
+	processors := settings.processors(p.LogitProcessors)
+	var generated []uint32
+	stopped, stoppedBySequence := false, false
+	for len(generated) < settings.maxNewTokens && !stopped {
+		// the draft model proposes tokens, without exceeding the maximum number of tokens with the token of the model
+		numDraftTokens := min(p.DraftTokens, settings.maxNewTokens-len(generated)-1)
+		var proposals []int64
+		var draftProbabilities [][]float32
+		draftInput := sequence[draftCache.tokens:]
+		for len(proposals) < numDraftTokens {
+			logits, stepErr := p.Draft.step(draftCache, draftInput)
+			if stepErr != nil {
+				return "", stepErr
+			}
+			if processErr := processLogits(processors, prompt, append(generated, toUint32(proposals)...), logits); processErr != nil {
+				return "", processErr
+			}
+			next, tokenErr := settings.pickToken(logits)
+			if tokenErr != nil {
+				return "", tokenErr
+			}
+			if settings.temperature > 0 {
+				draftProbabilities = append(draftProbabilities, util.SoftMax(logits))
+			}
+			proposals = append(proposals, int64(next))
+			if p.EOSTokenIDs[int64(next)] {
+				break
+			}
+			draftInput = []int64{int64(next)}
+		}
+
+		// the model runs on the tokens it has not seen and on the proposed tokens
+		allLogits, stepErr := p.stepPositions(cache, append(sequence[cache.tokens:], proposals...), len(proposals)+1)
+		if stepErr != nil {
+			return "", stepErr
+		}
+		var accepted []int64
+		for i, logits := range allLogits {
+			if processErr := processLogits(processors, prompt, append(generated, toUint32(accepted)...), logits); processErr != nil {
+				return "", processErr
+			}
+			if i < len(proposals) {
+				if ok, acceptErr := settings.acceptDraftToken(logits, proposals[i], draftProbabilities, i); acceptErr != nil {
+					return "", acceptErr
+				} else if ok {
+					accepted = append(accepted, proposals[i])
+					if p.EOSTokenIDs[proposals[i]] {
+						break
+					}
+					continue
+				}
+			}
+			next, tokenErr := settings.correctionToken(logits, draftProbabilities, i)
+			if tokenErr != nil {
+				return "", tokenErr
+			}
+			accepted = append(accepted, int64(next))
+			break
+		}
+		atomic.AddUint64(&p.draftProposed, uint64(len(proposals)))
+		atomic.AddUint64(&p.draftAccepted, uint64(min(len(accepted), len(proposals))))
+
+		for _, id := range accepted {
+			if p.EOSTokenIDs[id] {
+				stopped = true
+				break
+			}
+			sequence = append(sequence, id)
+			generated = append(generated, uint32(id))
+			if len(p.StopSequences) > 0 {
+				if text, stoppedBySequence = p.stopText(p.Tokenizer.Decode(generated, true)); stoppedBySequence {
+					stopped = true
+					break
+				}
+			}
+		}
+
+		// the caches keep the tokens of the sequence they have seen, and the model sees the last token at the next step
+		if err = p.truncateCache(cache, min(cache.tokens, len(sequence)-1)); err != nil {
+			return "", err
+		}
+		if err = p.Draft.truncateCache(draftCache, min(draftCache.tokens, len(sequence)-1)); err != nil {
+			return "", err
+		}
+	}
+	if !stoppedBySequence {
+		text = p.Tokenizer.Decode(generated, true)
+	}
+	return text, nil
+}
+
+// draftTokenizerProbe is encoded by the tokenizers of a model and of its draft model, which must give the same ids.
+const draftTokenizerProbe = "The draft model proposes 42 tokens: déjà vu, naïve café, 東京, Привет! <b>ok</b>"
+
+// validateDraft checks that the draft model has the tokenizer of the model, since the tokens it proposes are
+// verified by their ids: the same vocabulary size, and the same ids for a probe text. The logits of the two models
+// may still be padded differently.
+func (p *TextGenerationPipeline) validateDraft() error {
+	if p.Tokenizer == nil || p.Draft.Tokenizer == nil {
+		return errors.New("pipeline configuration invalid: speculative decoding needs the tokenizers of the model and of the draft model")
+	}
+	if size, draftSize := p.Tokenizer.VocabSize(), p.Draft.Tokenizer.VocabSize(); size != draftSize {
+		return fmt.Errorf("pipeline configuration invalid: the vocabulary of the draft model has %d tokens, the one of the model %d", draftSize, size)
+	}
+	ids, _ := p.Tokenizer.Encode(draftTokenizerProbe, true)
+	draftIDs, _ := p.Draft.Tokenizer.Encode(draftTokenizerProbe, true)
+	if !slices.Equal(ids, draftIDs) {
+		return errors.New("pipeline configuration invalid: the draft model does not have the tokenizer of the model")
+	}
+	return nil
+}
+
+// acceptDraftToken returns whether the model accepts the token proposed by the draft model at a position, given
+// the processed logits of the model at that position.
+func (s *generationSettings) acceptDraftToken(logits []float32, proposal int64, draftProbabilities [][]float32, position int) (bool, error) {
+	if s.temperature == 0 {
+		index, _, err := util.ArgMax(logits)
+		return int64(index) == proposal, err
+	}
+	probabilities := util.SoftMax(logits)
+	p, q := probabilityOf(probabilities, proposal), probabilityOf(draftProbabilities[position], proposal)
+	if q <= 0 {
+		return false, nil
+	}
+	return s.draw() < p/q, nil
+}
+
+// correctionToken picks the token of the model at a position where the proposed token is rejected, or after the
+// last proposed token. With sampling, the token of a rejected position is sampled from the distribution of the
+// model minus the one of the draft model, clipped at 0 and normalized.
+func (s *generationSettings) correctionToken(logits []float32, draftProbabilities [][]float32, position int) (int, error) {
+	if s.temperature == 0 || position >= len(draftProbabilities) {
+		return s.pickToken(logits)
+	}
+	probabilities := util.SoftMax(logits)
+	total := float32(0)
+	for id := range probabilities {
+		probabilities[id] = max(0, probabilities[id]-probabilityOf(draftProbabilities[position], int64(id)))
+		total += probabilities[id]
+	}
+	if total <= 0 {
+		return s.pickToken(logits)
+	}
+	draw := s.draw() * total
+	last := -1
+	for id, probability := range probabilities {
+		if probability == 0 {
+			continue
+		}
+		draw -= probability
+		last = id
+		if draw <= 0 {
+			return id, nil
+		}
+	}
+	return last, nil
+}
+
+// draw returns a random number in [0, 1) from the random source of the call.
+func (s *generationSettings) draw() float32 {
+	s.randomMutex.Lock()
+	defer s.randomMutex.Unlock()
+	return s.random.Float32()
+}
+
+// probabilityOf returns the probability of a token, 0 if it is out of the vocabulary, since the vocabulary of a
+// draft model may be padded differently.
+func probabilityOf(probabilities []float32, id int64) float32 {
+	if id < 0 || int(id) >= len(probabilities) {
+		return 0
+	}
+	return probabilities[id]
+}
+
+func toUint32(ids []int64) []uint32 {
+	converted := make([]uint32, len(ids))
+	for i, id := range ids {
+		converted[i] = uint32(id)
+	}
+	return converted
+}
+
+// truncateCache drops the past key values of the tokens of a cache after the first tokens, e.g. of the tokens
+// proposed by a draft model and rejected.
+func (p *TextGenerationPipeline) truncateCache(cache *kvCache, tokens int) error {
+	if tokens >= cache.tokens {
+		return nil
+	}
+	prefix, err := p.copyCachePrefix(cache, tokens)
+	if err != nil {
+		return err
+	}
+	err = cache.destroy()
+	*cache = *prefix
+	return err
+}
+
+// copyCachePrefix returns a copy of the past key values of the first tokens of a cache. The sequence axis of each
+// past key values input is its last dynamic dimension.
+func (p *TextGenerationPipeline) copyCachePrefix(cache *kvCache, tokens int) (*kvCache, error) {
+	if tokens <= 0 || tokens > cache.tokens {
+		return nil, fmt.Errorf("cannot copy the first %d tokens of a cache of %d tokens", tokens, cache.tokens)
+	}
+	length := cache.length - (cache.tokens - tokens)
+	prefix := &kvCache{past: make(map[int]ort.Value, len(cache.past)), length: length, dummy: cache.dummy, tokens: tokens}
+	for inputIndex, value := range cache.past {
+		tensor, ok := value.(*ort.Tensor[float32])
+		if !ok {
+			return nil, errors.Join(errors.New("the past key values are not float32 tensors"), prefix.destroy())
+		}
+		axis := -1
+		for i, dimension := range p.InputsMeta[inputIndex].Dimensions {
+			if i > 0 && dimension < 0 {
+				axis = i
+			}
+		}
+		shape := tensor.GetShape()
+		if axis < 0 || int(shape[axis]) != cache.length {
+			return nil, errors.Join(fmt.Errorf("cannot find the sequence axis of input %s", p.InputsMeta[inputIndex].Name), prefix.destroy())
+		}
+		outer, inner := 1, 1
+		for _, dimension := range shape[:axis] {
+			outer *= int(dimension)
+		}
+		for _, dimension := range shape[axis+1:] {
+			inner *= int(dimension)
+		}
+		data := tensor.GetData()
+		copied := make([]float32, 0, outer*length*inner)
+		for o := 0; o < outer; o++ {
+			start := o * cache.length * inner
+			copied = append(copied, data[start:start+length*inner]...)
+		}
+		shape[axis] = int64(length)
+		copiedTensor, err := ort.NewTensor(shape, copied)
+		if err != nil {
+			return nil, errors.Join(err, prefix.destroy())
+		}
+		prefix.past[inputIndex] = copiedTensor
+	}
+	return prefix, nil
+}
+
+// draftAcceptanceRate returns the share of the tokens proposed by the draft model that were accepted.
+func (p *TextGenerationPipeline) draftAcceptanceRate() float64 {
+	return float64(atomic.LoadUint64(&p.draftAccepted)) / math.Max(1, float64(atomic.LoadUint64(&p.draftProposed)))
+}
@@ -0,0 +1,678 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// types
+
+// SpeechRecognitionPipeline transcribes speech with Whisper models exported to ONNX by optimum as a separate
+// encoder and decoder (encoder_model.onnx and decoder_model.onnx, or decoder_model_merged.onnx). Audio is
+// resampled to the sample rate of the model, split in chunks of 30 seconds, and converted to log-mel spectrogram
+// features in Go. The transcription is generated with greedy decoding, and can include timestamps. The language is
+// detected by the model unless it is set with WithLanguage.
+type SpeechRecognitionPipeline struct {
+	basePipeline
+	seq2seqDecoder
+	Language            string // language code such as "en". Detected by multilingual models if empty
+	Task                string // "transcribe", or "translate" to English with multilingual models
+	Timestamps          bool
+	MaxNewTokens        int
+	SampleRate          int
+	ChunkLength         int // seconds of audio per chunk
+	NumFrames           int // spectrogram frames per chunk
+	FeaturesTimings     *timings
+	VAD                 VoiceActivityDetector // only the segments of speech are transcribed if set
+	melSpectrogram      *util.MelSpectrogram
+	startTokenID        int64
+	noTimestampsTokenID int64
+	timestampBeginID    int64 // id of the <|0.00|> token, timestamps are the following ids with a step of 20ms
+	eosTokenIDs         map[int64]bool
+	textTokenLimit      int64 // token ids from this one are special tokens
+	languageTokenIDs    map[string]int64
+	taskTokenIDs        map[string]int64
+	suppressTokens      []int64
+	beginSuppressTokens []int64
+}
+
+// SpeechRecognitionGenerationConfig holds the fields of generation_config.json used by the pipeline.
+type SpeechRecognitionGenerationConfig struct {
+	DecoderStartTokenID int64               `json:"decoder_start_token_id"`
+	EOSTokenID          jsoniter.RawMessage `json:"eos_token_id"`
+	NoTimestampsTokenID int64               `json:"no_timestamps_token_id"`
+	LangToID            map[string]int64    `json:"lang_to_id"`
+	TaskToID            map[string]int64    `json:"task_to_id"`
+	SuppressTokens      []int64             `json:"suppress_tokens"`
+	BeginSuppressTokens []int64             `json:"begin_suppress_tokens"`
+}
+
+// SpeechRecognitionPreprocessorConfig holds the fields of preprocessor_config.json used by the pipeline.
+type SpeechRecognitionPreprocessorConfig struct {
+	FeatureSize  int `json:"feature_size"`
+	SamplingRate int `json:"sampling_rate"`
+	HopLength    int `json:"hop_length"`
+	NFFT         int `json:"n_fft"`
+	ChunkLength  int `json:"chunk_length"`
+}
+
+// TranscriptionChunk is a segment of a transcription between two timestamps, in seconds from the start of the
+// audio.
+type TranscriptionChunk struct {
+	Text    string
+	Start   float64
+	End     float64
+	Speaker string // only with AssignSpeakers
+}
+
+// Transcription is the transcription of an audio input.
+type Transcription struct {
+	Text     string
+	Language string               // language of the first chunk, as set or detected
+	Chunks   []TranscriptionChunk // only with timestamps
+	Segments []TranscriptionChunk // segments of speech transcribed separately, only with voice activity detection
+}
+
+type SpeechRecognitionOutput struct {
+	Transcriptions []Transcription
+}
+
+func (t *SpeechRecognitionOutput) GetOutput() []any {
+	out := make([]any, len(t.Transcriptions))
+	for i, transcription := range t.Transcriptions {
+		out[i] = any(transcription)
+	}
+	return out
+}
+
+// audioChunk is a chunk of at most ChunkLength seconds of an input.
+type audioChunk struct {
+	input   int
+	segment int     // index of the segment of speech of the input, -1 without voice activity detection
+	offset  float64 // seconds
+	samples []float32
+}
+
+// options
+
+// WithLanguage sets the language of the audio, such as "en" or "fr", rather than detecting it.
+func WithLanguage(language string) PipelineOption[*SpeechRecognitionPipeline] {
+	return func(pipeline *SpeechRecognitionPipeline) {
+		pipeline.Language = language
+	}
+}
+
+// WithTranslation translates the speech to English rather than transcribing it, with multilingual models.
+func WithTranslation() PipelineOption[*SpeechRecognitionPipeline] {
+	return func(pipeline *SpeechRecognitionPipeline) {
+		pipeline.Task = "translate"
+	}
+}
+
+// WithTimestamps splits the transcriptions into chunks with their start and end time.
+func WithTimestamps() PipelineOption[*SpeechRecognitionPipeline] {
+	return func(pipeline *SpeechRecognitionPipeline) {
+		pipeline.Timestamps = true
+	}
+}
+
+// WithVoiceActivityDetection transcribes only the segments of speech found by the detector, e.g. NewEnergyVAD() or a
+// SileroVAD. Consecutive segments are merged up to the chunk length of the model, so that recordings with little
+// speech need fewer chunks, and the transcription of each merged segment is in the Segments of the output.
+func WithVoiceActivityDetection(detector VoiceActivityDetector) PipelineOption[*SpeechRecognitionPipeline] {
+	return func(pipeline *SpeechRecognitionPipeline) {
+		pipeline.VAD = detector
+	}
+}
+
+// WithTranscriptionTokens sets the maximum number of tokens generated for each 30 seconds chunk, 224 by default.
+func WithTranscriptionTokens(maxNewTokens int) PipelineOption[*SpeechRecognitionPipeline] {
+	return func(pipeline *SpeechRecognitionPipeline) {
+		pipeline.MaxNewTokens = maxNewTokens
+	}
+}
+
+// NewSpeechRecognitionPipeline initializes a new speech recognition pipeline.
+func NewSpeechRecognitionPipeline(config PipelineConfig[*SpeechRecognitionPipeline], ortOptions *ort.SessionOptions) (*SpeechRecognitionPipeline, error) {
+	pipeline := &SpeechRecognitionPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	if pipeline.OnnxFilename == "" {
+		pipeline.OnnxFilename = "encoder_model.onnx"
+	}
+	if pipeline.Task == "" {
+		pipeline.Task = "transcribe"
+	}
+	if pipeline.MaxNewTokens == 0 {
+		pipeline.MaxNewTokens = 224
+	}
+
+	// read the audio features and special tokens configurations
+	preprocessorConfig := SpeechRecognitionPreprocessorConfig{FeatureSize: 80, SamplingRate: 16000, HopLength: 160, NFFT: 400, ChunkLength: 30}
+	preprocessorBytes, err := util.ReadFileBytes(util.PathJoinSafe(pipeline.ModelPath, "preprocessor_config.json"))
+	if err == nil {
+		if err = jsoniter.Unmarshal(preprocessorBytes, &preprocessorConfig); err != nil {
+			return nil, err
+		}
+	}
+	pipeline.SampleRate = preprocessorConfig.SamplingRate
+	pipeline.ChunkLength = preprocessorConfig.ChunkLength
+	pipeline.NumFrames = preprocessorConfig.ChunkLength * preprocessorConfig.SamplingRate / preprocessorConfig.HopLength
+	pipeline.melSpectrogram = util.NewMelSpectrogram(preprocessorConfig.SamplingRate, preprocessorConfig.NFFT, preprocessorConfig.HopLength, preprocessorConfig.FeatureSize)
+
+	generationConfigPath := util.PathJoinSafe(pipeline.ModelPath, "generation_config.json")
+	generationConfig := SpeechRecognitionGenerationConfig{}
+	generationBytes, err := util.ReadFileBytes(generationConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = jsoniter.Unmarshal(generationBytes, &generationConfig); err != nil {
+		return nil, err
+	}
+	pipeline.startTokenID = generationConfig.DecoderStartTokenID
+	pipeline.noTimestampsTokenID = generationConfig.NoTimestampsTokenID
+	pipeline.timestampBeginID = generationConfig.NoTimestampsTokenID + 1
+	pipeline.eosTokenIDs, err = parseTokenIDs(generationConfig.EOSTokenID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read eos_token_id from %s: %w", generationConfigPath, err)
+	}
+	pipeline.textTokenLimit = math.MaxInt64
+	for id := range pipeline.eosTokenIDs {
+		pipeline.textTokenLimit = min(pipeline.textTokenLimit, id)
+	}
+	pipeline.languageTokenIDs = map[string]int64{}
+	for token, id := range generationConfig.LangToID {
+		pipeline.languageTokenIDs[strings.Trim(token, "<|>")] = id
+	}
+	pipeline.taskTokenIDs = generationConfig.TaskToID
+	pipeline.suppressTokens = generationConfig.SuppressTokens
+	pipeline.beginSuppressTokens = generationConfig.BeginSuppressTokens
+
+	// onnx models init
+	encoder, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+	inputs, outputs, err := loadInputOutputMeta(encoder)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = outputs
+
+	decoder, err := pipeline.loadDecoder(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// tokenizer init, only used to decode the generated tokens
+	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	if tkErr != nil {
+		return nil, tkErr
+	}
+	pipeline.Tokenizer = tk
+
+	// creation of the sessions, placed together by the total size of both graphs
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, encoder, decoder)
+	pipeline.OrtOptions = ortOptions
+	session, err := config.EngineCache.createSession(encoder, inputs, pipeline.OutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	pipeline.OrtSession = session
+	if err = pipeline.validateDecoder(); err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	decoderSession, err := config.EngineCache.createSession(decoder, pipeline.DecoderInputsMeta, pipeline.DecoderOutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	pipeline.DecoderSession = decoderSession
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(encoder) + len(decoder))}
+	pipeline.FeaturesTimings = &timings{}
+
+	// validate
+	err = pipeline.Validate()
+	if err != nil {
+		errDestroy := pipeline.Destroy()
+		return nil, errors.Join(err, errDestroy)
+	}
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the logits output of the decoder.
+func (p *SpeechRecognitionPipeline) GetMetadata() PipelineMetadata {
+	return p.decoderMetadata()
+}
+
+// Destroy frees the speech recognition pipeline resources.
+func (p *SpeechRecognitionPipeline) Destroy() error {
+	return errors.Join(destroySession(p.Tokenizer, p.OrtSession), p.destroyDecoder())
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *SpeechRecognitionPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Features: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.FeaturesTimings.TotalNS),
+			p.FeaturesTimings.NumCalls,
+			time.Duration(float64(p.FeaturesTimings.TotalNS)/math.Max(1, float64(p.FeaturesTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *SpeechRecognitionPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.InputsMeta) != 1 || p.InputsMeta[0].Name != "input_features" {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the encoder must have a single input_features input"))
+	} else if dimensions := p.InputsMeta[0].Dimensions; len(dimensions) != 3 || (dimensions[1] > 0 && int(dimensions[1]) != p.melSpectrogram.NumMels) {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the encoder input_features must have 3 dimensions and %d mels", p.melSpectrogram.NumMels))
+	}
+	if len(p.OutputsMeta) == 0 || len(p.OutputsMeta[0].Dimensions) != 3 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the encoder must output hidden states with 3 dimensions"))
+	}
+	if p.MaxNewTokens <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the maximum number of new tokens must be greater than zero"))
+	}
+	if len(p.eosTokenIDs) == 0 || p.noTimestampsTokenID == 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: eos_token_id and no_timestamps_token_id must be set in generation_config.json"))
+	}
+	if p.Language != "" {
+		if _, ok := p.languageTokenIDs[p.Language]; !ok {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: language %s is not supported by the model", p.Language))
+		}
+	}
+	if _, ok := p.taskTokenIDs[p.Task]; !ok && (len(p.languageTokenIDs) > 0 || p.Task != "transcribe") {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: task %s is not supported by the model", p.Task))
+	}
+	return errors.Join(append(validationErrors, p.validateDecoder())...)
+}
+
+// prompt returns the tokens forced at the start of the decoding: the start of transcript token, the language
+// and task tokens of multilingual models, and the no timestamps token. The language token is -1 when it must be
+// detected.
+func (p *SpeechRecognitionPipeline) prompt() []int64 {
+	prompt := []int64{p.startTokenID}
+	if len(p.languageTokenIDs) > 0 {
+		languageID := int64(-1)
+		if p.Language != "" {
+			languageID = p.languageTokenIDs[p.Language]
+		}
+		prompt = append(prompt, languageID, p.taskTokenIDs[p.Task])
+	}
+	if !p.Timestamps {
+		prompt = append(prompt, p.noTimestampsTokenID)
+	}
+	return prompt
+}
+
+// Preprocess computes the log-mel spectrogram of the audio chunks and creates the encoder input tensor.
+func (p *SpeechRecognitionPipeline) Preprocess(chunks []audioChunk) (*ort.Tensor[float32], error) {
+	start := time.Now()
+	features := make([]float32, 0, len(chunks)*p.melSpectrogram.NumMels*p.NumFrames)
+	for _, chunk := range chunks {
+		features = append(features, p.melSpectrogram.LogMel(chunk.samples, p.NumFrames)...)
+	}
+	atomic.AddUint64(&p.FeaturesTimings.NumCalls, 1)
+	atomic.AddUint64(&p.FeaturesTimings.TotalNS, uint64(time.Since(start)))
+	return ort.NewTensor(ort.NewShape(int64(len(chunks)), int64(p.melSpectrogram.NumMels), int64(p.NumFrames)), features)
+}
+
+// Forward runs the encoder on the features, and then the decoder once per generated token until all the chunks
+// have generated an eos token or MaxNewTokens tokens. It returns the generated token ids of each chunk, including
+// the prompt.
+func (p *SpeechRecognitionPipeline) Forward(features *ort.Tensor[float32]) ([][]int64, error) {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	encoderOutputs := []ort.Value{nil}
+	if err := p.OrtSession.Run([]ort.Value{features}, encoderOutputs); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = encoderOutputs[0].Destroy()
+	}()
+	hiddenStates, ok := encoderOutputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, errors.New("the encoder hidden states are not a float32 tensor")
+	}
+
+	prompt := p.prompt()
+	batchSize := int(features.GetShape()[0])
+	sequences := make([][]int64, batchSize)
+	for i := range sequences {
+		sequences[i] = []int64{p.startTokenID}
+	}
+	finished := make([]bool, batchSize)
+	past := map[int]ort.Value{}
+	defer destroyPast(past)
+	for step := 1; step < len(prompt)+p.MaxNewTokens; step++ {
+		logits, vocabularySize, err := p.decoderStep(sequences, past, nil, 0, hiddenStates)
+		if err != nil {
+			return nil, err
+		}
+		allFinished := true
+		for i := range sequences {
+			row := logits[i*vocabularySize : (i+1)*vocabularySize]
+			var next int64
+			switch {
+			case finished[i]:
+				next = p.startTokenID // padding, ignored
+			case step < len(prompt) && prompt[step] >= 0:
+				next = prompt[step]
+			case step < len(prompt):
+				next = p.detectLanguage(row)
+			default:
+				next = p.nextToken(row, sequences[i][len(prompt):])
+			}
+			sequences[i] = append(sequences[i], next)
+			if !finished[i] && p.eosTokenIDs[next] {
+				finished[i] = true
+			}
+			allFinished = allFinished && finished[i]
+		}
+		if allFinished {
+			break
+		}
+	}
+	p.PipelineMemory.recordForward(usageBefore, nil)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return sequences, nil
+}
+
+// detectLanguage returns the language token with the highest logit.
+func (p *SpeechRecognitionPipeline) detectLanguage(logits []float32) int64 {
+	best := int64(-1)
+	for _, id := range p.languageTokenIDs {
+		if int(id) < len(logits) && (best < 0 || logits[id] > logits[best]) {
+			best = id
+		}
+	}
+	return best
+}
+
+// nextToken picks the next token greedily, after suppressing the tokens that Whisper must not generate and, with
+// timestamps, enforcing that timestamps come in increasing pairs around the text, as the reference
+// implementation does.
+func (p *SpeechRecognitionPipeline) nextToken(logits []float32, generated []int64) int64 {
+	scores := make([]float64, len(logits))
+	for i, logit := range logits {
+		scores[i] = float64(logit)
+	}
+	suppress := func(from, to int64) {
+		for id := max(from, 0); id < min(to, int64(len(scores))); id++ {
+			scores[id] = math.Inf(-1)
+		}
+	}
+	for _, id := range p.suppressTokens {
+		suppress(id, id+1)
+	}
+	if len(generated) == 0 {
+		for _, id := range p.beginSuppressTokens {
+			suppress(id, id+1)
+		}
+	}
+	suppress(p.noTimestampsTokenID, p.noTimestampsTokenID+1)
+	if !p.Timestamps {
+		suppress(p.timestampBeginID, int64(len(scores)))
+	} else {
+		eos := p.textTokenLimit
+		lastWasTimestamp := len(generated) >= 1 && generated[len(generated)-1] >= p.timestampBeginID
+		penultimateWasTimestamp := len(generated) < 2 || generated[len(generated)-2] >= p.timestampBeginID
+		if lastWasTimestamp {
+			if penultimateWasTimestamp {
+				suppress(p.timestampBeginID, int64(len(scores))) // a segment was closed, text must follow
+			} else {
+				suppress(0, eos) // a segment must be closed by a timestamp, or the end of the transcription
+			}
+		}
+		// timestamps do not decrease
+		for j := len(generated) - 1; j >= 0; j-- {
+			if generated[j] >= p.timestampBeginID {
+				last := generated[j]
+				if !lastWasTimestamp || penultimateWasTimestamp {
+					last++
+				}
+				suppress(p.timestampBeginID, last)
+				break
+			}
+		}
+		if len(generated) == 0 {
+			// the transcription starts with a timestamp, of at most one second
+			suppress(0, p.timestampBeginID)
+			suppress(p.timestampBeginID+51, int64(len(scores)))
+		}
+		// pick a timestamp if their total probability is higher than the one of any text token, comparing the
+		// logits since the softmax normalization is the same for both
+		timestampScore, maxTextScore := math.Inf(-1), math.Inf(-1)
+		for id, score := range scores {
+			if int64(id) >= p.timestampBeginID {
+				timestampScore = logAddExp(timestampScore, score)
+			} else {
+				maxTextScore = max(maxTextScore, score)
+			}
+		}
+		if timestampScore > maxTextScore {
+			suppress(0, p.timestampBeginID)
+		}
+	}
+	best := 0
+	for id, score := range scores {
+		if score > scores[best] {
+			best = id
+		}
+	}
+	return int64(best)
+}
+
+func logAddExp(a, b float64) float64 {
+	if math.IsInf(a, -1) {
+		return b
+	}
+	if math.IsInf(b, -1) {
+		return a
+	}
+	return max(a, b) + math.Log1p(math.Exp(-math.Abs(a-b)))
+}
+
+// Postprocess decodes the generated tokens of each chunk, and joins the chunks of each input.
+func (p *SpeechRecognitionPipeline) Postprocess(chunks []audioChunk, sequences [][]int64, numInputs int) (*SpeechRecognitionOutput, error) {
+	output := &SpeechRecognitionOutput{Transcriptions: make([]Transcription, numInputs)}
+	texts := make([][]string, numInputs)
+	promptLength := len(p.prompt())
+	for i, chunk := range chunks {
+		transcription := &output.Transcriptions[chunk.input]
+		if transcription.Language == "" && len(p.languageTokenIDs) > 0 {
+			for language, id := range p.languageTokenIDs {
+				if id == sequences[i][1] {
+					transcription.Language = language
+				}
+			}
+		}
+		chunkEnd := chunk.offset + float64(len(chunk.samples))/float64(p.SampleRate)
+		var text, segment []uint32
+		segmentStart := -1.0
+		for _, id := range sequences[i][promptLength:] {
+			switch {
+			case p.eosTokenIDs[id]:
+			case id >= p.timestampBeginID:
+				timestamp := chunk.offset + float64(id-p.timestampBeginID)*0.02
+				if segmentStart < 0 {
+					segmentStart = timestamp
+					continue
+				}
+				transcription.Chunks = append(transcription.Chunks, TranscriptionChunk{
+					Text:  strings.TrimSpace(p.Tokenizer.Decode(segment, true)),
+					Start: segmentStart,
+					End:   min(timestamp, chunkEnd),
+				})
+				segment, segmentStart = nil, -1
+			case id < p.textTokenLimit:
+				text = append(text, uint32(id))
+				segment = append(segment, uint32(id))
+			}
+			if p.eosTokenIDs[id] {
+				break
+			}
+		}
+		if p.Timestamps && len(segment) > 0 {
+			// a segment interrupted by the end of the chunk ends with it
+			transcription.Chunks = append(transcription.Chunks, TranscriptionChunk{
+				Text:  strings.TrimSpace(p.Tokenizer.Decode(segment, true)),
+				Start: max(segmentStart, chunk.offset),
+				End:   chunkEnd,
+			})
+		}
+		chunkText := strings.TrimSpace(p.Tokenizer.Decode(text, true))
+		if chunkText != "" {
+			texts[chunk.input] = append(texts[chunk.input], chunkText)
+		}
+		if chunk.segment >= 0 {
+			// the chunks of a segment follow each other
+			for len(transcription.Segments) <= chunk.segment {
+				transcription.Segments = append(transcription.Segments, TranscriptionChunk{Start: chunk.offset})
+			}
+			segment := &transcription.Segments[chunk.segment]
+			segment.Text = strings.TrimSpace(segment.Text + " " + chunkText)
+			segment.End = chunkEnd
+		}
+	}
+	for i := range output.Transcriptions {
+		output.Transcriptions[i].Text = strings.Join(texts[i], " ")
+		sort.SliceStable(output.Transcriptions[i].Chunks, func(a, b int) bool {
+			return output.Transcriptions[i].Chunks[a].Start < output.Transcriptions[i].Chunks[b].Start
+		})
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of paths to audio files, in the formats supported by util.DecodeAudio.
+func (p *SpeechRecognitionPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete speech recognition output type rather than the interface.
+func (p *SpeechRecognitionPipeline) RunPipeline(inputs []string) (*SpeechRecognitionOutput, error) {
+	files := make([][]byte, len(inputs))
+	for i, input := range inputs {
+		file, err := util.ReadFileBytes(input)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = file
+	}
+	return p.RunAudio(files)
+}
+
+// RunAudio transcribes a batch of audio files, in the formats supported by util.DecodeAudio.
+func (p *SpeechRecognitionPipeline) RunAudio(inputs [][]byte) (*SpeechRecognitionOutput, error) {
+	audio := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		samples, sampleRate, err := util.DecodeAudio(input)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode input %d: %w", i, err)
+		}
+		audio[i] = util.ResampleAudio(samples, sampleRate, p.SampleRate)
+	}
+	return p.RunPCM(audio, p.SampleRate)
+}
+
+// RunWAV transcribes a batch of WAV files.
+func (p *SpeechRecognitionPipeline) RunWAV(inputs [][]byte) (*SpeechRecognitionOutput, error) {
+	audio := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		samples, sampleRate, err := util.DecodeWAV(input)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode input %d: %w", i, err)
+		}
+		audio[i] = util.ResampleAudio(samples, sampleRate, p.SampleRate)
+	}
+	return p.RunPCM(audio, p.SampleRate)
+}
+
+// RunPCM transcribes a batch of mono PCM audio inputs, with samples between -1 and 1 at the given sample rate.
+func (p *SpeechRecognitionPipeline) RunPCM(inputs [][]float32, sampleRate int) (*SpeechRecognitionOutput, error) {
+	chunkSize := p.ChunkLength * p.SampleRate
+	var chunks []audioChunk
+	for i, input := range inputs {
+		samples := util.ResampleAudio(input, sampleRate, p.SampleRate)
+		segments := []util.AudioSegment{{Start: 0, End: float64(len(samples)) / float64(p.SampleRate)}}
+		segmentIndex := -1
+		if p.VAD != nil {
+			detected, err := p.VAD.DetectSpeech(samples, p.SampleRate)
+			if err != nil {
+				return nil, fmt.Errorf("cannot detect the speech of input %d: %w", i, err)
+			}
+			segments = util.MergeSegments(detected, float64(p.ChunkLength))
+			segmentIndex = 0
+		}
+		for _, segment := range segments {
+			from := int(segment.Start * float64(p.SampleRate))
+			to := min(int(math.Ceil(segment.End*float64(p.SampleRate))), len(samples))
+			for start := from; start < to; start += chunkSize {
+				chunks = append(chunks, audioChunk{
+					input:   i,
+					segment: segmentIndex,
+					offset:  float64(start) / float64(p.SampleRate),
+					samples: samples[start:min(start+chunkSize, to)],
+				})
+			}
+			if segmentIndex >= 0 {
+				segmentIndex++
+			}
+		}
+	}
+	if len(chunks) == 0 {
+		return &SpeechRecognitionOutput{Transcriptions: make([]Transcription, len(inputs))}, nil
+	}
+
+	var runErrors []error
+	features, err := p.Preprocess(chunks)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		runErrors = append(runErrors, features.Destroy())
+	}()
+
+	sequences, err := p.Forward(features)
+	runErrors = append(runErrors, err)
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	result, postErr := p.Postprocess(chunks, sequences, len(inputs))
+	runErrors = append(runErrors, postErr)
+	return result, errors.Join(runErrors...)
+}
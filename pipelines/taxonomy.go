@@ -0,0 +1,214 @@
+package pipelines
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// TaxonomyFile is the file of a model directory with the label taxonomy of a text classification model, which text
+// classification pipelines load when they are created.
+const TaxonomyFile = "taxonomy.json"
+
+// LabelTaxonomy is a hierarchy of labels, e.g. sports > football > transfers, given by the parent of each label that
+// has one, as in {"parents": {"football": "sports", "transfers": "football"}}. The labels of the model can be
+// anywhere in the hierarchy, while the labels that are not labels of the model only group their children.
+type LabelTaxonomy struct {
+	Parents map[string]string `json:"parents"`
+}
+
+// LoadTaxonomy reads the label taxonomy of the model at modelPath, which may be on S3. It returns nil if the model
+// directory has no TaxonomyFile.
+func LoadTaxonomy(modelPath string) (*LabelTaxonomy, error) {
+	path := util.PathJoinSafe(modelPath, TaxonomyFile)
+	exists, err := util.FileExists(path)
+	if err != nil || !exists {
+		return nil, err
+	}
+	taxonomyBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	taxonomy := &LabelTaxonomy{}
+	if err = json.Unmarshal(taxonomyBytes, taxonomy); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return taxonomy, nil
+}
+
+// Path returns the labels from the root of the taxonomy to label, label included.
+func (t *LabelTaxonomy) Path(label string) []string {
+	path := []string{label}
+	seen := map[string]bool{label: true}
+	for parent, ok := t.Parents[label]; ok && !seen[parent]; parent, ok = t.Parents[parent] {
+		seen[parent] = true
+		path = append(path, parent)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// validate checks that the taxonomy has no cycles and that its labels are labels of the model or parents.
+func (t *LabelTaxonomy) validate(idLabelMap map[int]string) error {
+	isModelLabel := map[string]bool{}
+	for _, label := range idLabelMap {
+		isModelLabel[label] = true
+	}
+	isParent := map[string]bool{}
+	for _, parent := range t.Parents {
+		isParent[parent] = true
+	}
+	var validationErrors []error
+	for label := range t.Parents {
+		if !isModelLabel[label] && !isParent[label] {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: label %s of the taxonomy is not a label of the model", label))
+		}
+		steps := 0
+		for parent, ok := t.Parents[label]; ok && steps <= len(t.Parents); parent, ok = t.Parents[parent] {
+			if parent == label {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: label %s of the taxonomy is its own ancestor", label))
+				break
+			}
+			steps++
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// labels returns the labels of the model in the order of their ids, followed by the labels of the taxonomy that
+// are not labels of the model, in alphabetical order.
+func (t *LabelTaxonomy) labels(idLabelMap map[int]string) []string {
+	labels := make([]string, 0, len(idLabelMap))
+	isModelLabel := map[string]bool{}
+	for i := 0; i < len(idLabelMap); i++ {
+		labels = append(labels, idLabelMap[i])
+		isModelLabel[idLabelMap[i]] = true
+	}
+	var groups []string
+	for _, parent := range t.Parents {
+		if !isModelLabel[parent] {
+			isModelLabel[parent] = true
+			groups = append(groups, parent)
+		}
+	}
+	sort.Strings(groups)
+	return append(labels, groups...)
+}
+
+// rollUp returns the score of each label of the taxonomy and of the model, where the score of a parent combines its
+// own score, if it is a label of the model, with the scores of its children: their sum for exclusive labels, whose
+// probabilities add up, or their maximum for independent labels, so that a parent is at least as likely as each
+// of its children.
+func (t *LabelTaxonomy) rollUp(scores map[string]float64, exclusive bool) map[string]float64 {
+	rolled := make(map[string]float64, len(scores)+len(t.Parents))
+	depths := map[string]int{}
+	for label, score := range scores {
+		rolled[label] = score
+		depths[label] = len(t.Path(label))
+	}
+	for label, parent := range t.Parents {
+		depths[label] = len(t.Path(label))
+		depths[parent] = len(t.Path(parent))
+	}
+	labels := make([]string, 0, len(depths))
+	for label := range depths {
+		labels = append(labels, label)
+	}
+	// the deepest labels first, so that children are rolled up before their parents
+	sort.Slice(labels, func(i, j int) bool {
+		if depths[labels[i]] != depths[labels[j]] {
+			return depths[labels[i]] > depths[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	for _, label := range labels {
+		parent, ok := t.Parents[label]
+		if !ok {
+			continue
+		}
+		if exclusive {
+			rolled[parent] += rolled[label]
+		} else {
+			rolled[parent] = max(rolled[parent], rolled[label])
+		}
+	}
+	return rolled
+}
+
+// decode picks the label of an input of a single label model from the root of the taxonomy down: the most likely
+// root, then its most likely child, until a leaf or a label of the model more likely than each of its children.
+// It returns the label and its score, its own score if it has children.
+func (t *LabelTaxonomy) decode(scores map[string]float64, exclusive bool) (string, float64) {
+	rolled := t.rollUp(scores, exclusive)
+	children := map[string][]string{}
+	var roots []string
+	for label := range rolled {
+		if parent, ok := t.Parents[label]; ok {
+			children[parent] = append(children[parent], label)
+		} else {
+			roots = append(roots, label)
+		}
+	}
+	best := func(candidates []string) string {
+		sort.Strings(candidates)
+		bestLabel := candidates[0]
+		for _, candidate := range candidates[1:] {
+			if rolled[candidate] > rolled[bestLabel] {
+				bestLabel = candidate
+			}
+		}
+		return bestLabel
+	}
+	label := best(roots)
+	for len(children[label]) > 0 {
+		child := best(children[label])
+		if own, ok := scores[label]; ok && own >= rolled[child] {
+			return label, own
+		}
+		label = child
+	}
+	return label, rolled[label]
+}
+
+// hierarchical returns whether the outputs of the pipeline follow its taxonomy. Taxonomies only apply to
+// probabilities, and raw scores keep the labels of the model.
+func (p *TextClassificationPipeline) hierarchical() bool {
+	return p.Taxonomy != nil && (p.AggregationFunctionName == "SOFTMAX" || p.AggregationFunctionName == "SIGMOID")
+}
+
+// taxonomyOutputs returns the classification outputs of an input given the scores of the labels of the model, and
+// their scores: the label picked from the root of the taxonomy down for single label models, or the rolled up
+// scores of all the labels of the model and the taxonomy for multi-label models.
+func (p *TextClassificationPipeline) taxonomyOutputs(scores []float64) ([]ClassificationOutput, []float64, error) {
+	scoresByLabel := make(map[string]float64, len(scores))
+	for j, score := range scores {
+		label, ok := p.IDLabelMap[j]
+		if !ok {
+			return nil, nil, fmt.Errorf("class with index number %d not found in id label map", j)
+		}
+		scoresByLabel[label] = score
+	}
+	exclusive := p.AggregationFunctionName == "SOFTMAX"
+	switch p.ProblemType {
+	case "singleLabel":
+		label, score := p.Taxonomy.decode(scoresByLabel, exclusive)
+		return []ClassificationOutput{{Label: label, Score: float32(score), Path: p.Taxonomy.Path(label)}}, []float64{score}, nil
+	case "multiLabel":
+		rolled := p.Taxonomy.rollUp(scoresByLabel, exclusive)
+		labels := p.Taxonomy.labels(p.IDLabelMap)
+		classes := make([]ClassificationOutput, len(labels))
+		classScores := make([]float64, len(labels))
+		for j, label := range labels {
+			classes[j] = ClassificationOutput{Label: label, Score: float32(rolled[label]), Path: p.Taxonomy.Path(label)}
+			classScores[j] = rolled[label]
+		}
+		return classes, classScores, nil
+	default:
+		return nil, nil, fmt.Errorf("problem type %s not recognized", p.ProblemType)
+	}
+}
@@ -0,0 +1,71 @@
+package pipelines
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// TemporalEntity is an event or temporal expression found in a text.
+type TemporalEntity struct {
+	Entity
+	Normalized string // ISO 8601 value of a temporal expression, empty if it could not be normalized
+}
+
+// TemporalExtractor is a preset that combines token classification pipelines for events and temporal
+// expressions, e.g. a model trained on TimeBank, and normalizes the temporal expressions they find to
+// ISO 8601 values relative to a reference time.
+type TemporalExtractor struct {
+	Pipelines      []*TokenClassificationPipeline
+	TemporalLabels []string // entity types that are temporal expressions and are normalized, matched case-insensitively
+}
+
+// NewTemporalExtractor creates a temporal extractor that merges the entities found by the given pipelines.
+func NewTemporalExtractor(pipelines ...*TokenClassificationPipeline) (*TemporalExtractor, error) {
+	if len(pipelines) == 0 {
+		return nil, errors.New("at least one token classification pipeline is required for temporal extraction")
+	}
+	return &TemporalExtractor{
+		Pipelines:      pipelines,
+		TemporalLabels: []string{"DATE", "TIME", "TIMEX", "TIMEX3", "TEMPORAL"},
+	}, nil
+}
+
+// Extract finds the events and temporal expressions of each input, in order of appearance. Relative
+// expressions such as "next Tuesday" are resolved against the reference time.
+func (e *TemporalExtractor) Extract(inputs []string, reference time.Time) ([][]TemporalEntity, error) {
+	results := make([][]TemporalEntity, len(inputs))
+	for _, pipeline := range e.Pipelines {
+		output, err := pipeline.RunPipeline(inputs)
+		if err != nil {
+			return nil, err
+		}
+		for i, entities := range output.Entities {
+			for _, entity := range entities {
+				temporalEntity := TemporalEntity{Entity: entity}
+				if e.isTemporal(entity.Entity) {
+					temporalEntity.Normalized, _ = util.NormalizeTemporalExpression(entity.Word, reference)
+				}
+				results[i] = append(results[i], temporalEntity)
+			}
+		}
+	}
+	for i := range results {
+		sort.SliceStable(results[i], func(a, b int) bool {
+			return results[i][a].Start < results[i][b].Start
+		})
+	}
+	return results, nil
+}
+
+func (e *TemporalExtractor) isTemporal(label string) bool {
+	for _, temporalLabel := range e.TemporalLabels {
+		if strings.EqualFold(entityType(label), temporalLabel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,591 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// types
+
+// Text2TextGenerationPipeline runs encoder-decoder models, such as T5, BART or Marian, exported to ONNX by optimum
+// as a separate encoder and decoder (encoder_model.onnx and decoder_model.onnx), e.g. summarization, translation
+// or question generation models. The encoder is loaded from OnnxFilename, which defaults to encoder_model.onnx,
+// and the decoder from DecoderFilename, which defaults to the merged decoder decoder_model_merged.onnx if the model
+// has one, and to decoder_model.onnx otherwise. With a merged decoder, the past keys and values are cached between
+// decoding steps, so that each step only runs the decoder on the last token. The output is generated with greedy
+// decoding by default, with beam search with WithDecoderBeamSearch, or sampled with the options of RunWithOptions,
+// after the logit processors of the pipeline, if any, have changed the logits of each step.
+type Text2TextGenerationPipeline struct {
+	basePipeline
+	seq2seqDecoder
+	Prefix              string // prepended to each input, e.g. the task prefix of T5 models
+	MaxNewTokens        int
+	DecoderStartTokenID int64
+	ForcedBOSTokenID    int64 // forced as the first generated token if not negative, as for BART models
+	EOSTokenIDs         map[int64]bool
+	LogitProcessors     []LogitProcessor // applied to the logits of each step before the next token is picked
+	NumBeams            int              // beam search with NumBeams beams if greater than 1
+	LengthPenalty       float32          // exponent of the length normalizing the scores of beam search hypotheses, 1 by default
+	EarlyStopping       bool             // stop beam search as soon as NumBeams hypotheses are finished
+	regex               string
+	jsonSchema          string
+	random              *rand.Rand
+	randomMutex         sync.Mutex
+}
+
+type Text2TextGenerationPipelineConfig struct {
+	DecoderStartTokenID *int64              `json:"decoder_start_token_id"`
+	ForcedBOSTokenID    *int64              `json:"forced_bos_token_id"`
+	EOSTokenID          jsoniter.RawMessage `json:"eos_token_id"` // a token id or a list of token ids
+	PadTokenID          int64               `json:"pad_token_id"`
+}
+
+type Text2TextGenerationOutput struct {
+	GeneratedTexts []string
+}
+
+func (t *Text2TextGenerationOutput) GetOutput() []any {
+	out := make([]any, len(t.GeneratedTexts))
+	for i, text := range t.GeneratedTexts {
+		out[i] = any(text)
+	}
+	return out
+}
+
+// options
+
+// WithDecoderFilename sets the file name of the decoder model, decoder_model_merged.onnx or decoder_model.onnx by
+// default.
+func WithDecoderFilename(filename string) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.DecoderFilename = filename
+	}
+}
+
+// WithPrefix prepends a prefix to each input, such as the "generate question: " task prefix of T5 question
+// generation models.
+func WithPrefix(prefix string) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.Prefix = prefix
+	}
+}
+
+// WithMaxNewTokens sets the maximum number of tokens generated for each input, 64 by default.
+func WithMaxNewTokens(maxNewTokens int) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.MaxNewTokens = maxNewTokens
+	}
+}
+
+// WithDecoderLogitProcessors adds logit processors, applied in order to the logits of each decoding step before
+// the next token is picked. The processors are given a nil prompt.
+func WithDecoderLogitProcessors(processors ...LogitProcessor) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.LogitProcessors = append(pipeline.LogitProcessors, processors...)
+	}
+}
+
+// WithDecoderBeamSearch decodes with beam search (see GenerateWithBeamSearch) with numBeams beams, a length
+// penalty, usually 1, and early stopping or not, like WithBeamSearch for text generation pipelines. Summarization
+// models often use 4 beams, a length penalty of 2 and early stopping, as in their generation_config.json.
+func WithDecoderBeamSearch(numBeams int, lengthPenalty float32, earlyStopping bool) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.NumBeams = numBeams
+		pipeline.LengthPenalty = lengthPenalty
+		pipeline.EarlyStopping = earlyStopping
+	}
+}
+
+// WithDecoderSamplingSeed seeds the random source of the calls sampled with the options of RunWithOptions, like
+// WithSamplingSeed for text generation pipelines.
+func WithDecoderSamplingSeed(seed int64) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.random = rand.New(rand.NewSource(seed))
+	}
+}
+
+// WithDecoderRegex constrains the generated texts to the matches of a regular expression, like WithRegex for text
+// generation pipelines.
+func WithDecoderRegex(pattern string) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.regex = pattern
+	}
+}
+
+// WithDecoderJSONSchema constrains the generated texts to JSON texts that are valid for a JSON schema, like
+// WithJSONSchema for text generation pipelines.
+func WithDecoderJSONSchema(schema string) PipelineOption[*Text2TextGenerationPipeline] {
+	return func(pipeline *Text2TextGenerationPipeline) {
+		pipeline.jsonSchema = schema
+	}
+}
+
+// HighlightAnswer surrounds the first occurrence of answer in passage with the highlight token, which is the input
+// format of answer-aware question generation models, e.g. "<hl>" for the valhalla/t5-*-qg-hl models.
+func HighlightAnswer(passage string, answer string, highlightToken string) (string, error) {
+	start := strings.Index(passage, answer)
+	if answer == "" || start < 0 {
+		return "", fmt.Errorf("answer %q not found in the passage", util.Redact(answer))
+	}
+	end := start + len(answer)
+	return passage[:start] + highlightToken + " " + answer + " " + highlightToken + passage[end:], nil
+}
+
+// parseTokenIDs parses a token id field of a model config, such as eos_token_id, which is either a token id or a
+// list of token ids.
+func parseTokenIDs(raw jsoniter.RawMessage) (map[int64]bool, error) {
+	var ids []int64
+	if err := jsoniter.Unmarshal(raw, &ids); err != nil {
+		var id int64
+		if err = jsoniter.Unmarshal(raw, &id); err != nil {
+			return nil, err
+		}
+		ids = []int64{id}
+	}
+	tokenIDs := map[int64]bool{}
+	for _, id := range ids {
+		tokenIDs[id] = true
+	}
+	return tokenIDs, nil
+}
+
+// NewText2TextGenerationPipeline initializes a new text2text generation pipeline.
+func NewText2TextGenerationPipeline(config PipelineConfig[*Text2TextGenerationPipeline], ortOptions *ort.SessionOptions) (*Text2TextGenerationPipeline, error) {
+	pipeline := &Text2TextGenerationPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.LengthPenalty = 1
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	if pipeline.OnnxFilename == "" {
+		pipeline.OnnxFilename = "encoder_model.onnx"
+	}
+	if pipeline.MaxNewTokens == 0 {
+		pipeline.MaxNewTokens = 64
+	}
+	if pipeline.random == nil {
+		pipeline.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	// read the special tokens used for generation
+	configPath := util.PathJoinSafe(pipeline.ModelPath, "config.json")
+	pipelineInputConfig := Text2TextGenerationPipelineConfig{}
+	configBytes, err := util.ReadFileBytes(configPath)
+	if err != nil {
+		return nil, err
+	}
+	err = jsoniter.Unmarshal(configBytes, &pipelineInputConfig)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.DecoderStartTokenID = pipelineInputConfig.PadTokenID
+	if pipelineInputConfig.DecoderStartTokenID != nil {
+		pipeline.DecoderStartTokenID = *pipelineInputConfig.DecoderStartTokenID
+	}
+	pipeline.ForcedBOSTokenID = -1
+	if pipelineInputConfig.ForcedBOSTokenID != nil {
+		pipeline.ForcedBOSTokenID = *pipelineInputConfig.ForcedBOSTokenID
+	}
+	pipeline.EOSTokenIDs, err = parseTokenIDs(pipelineInputConfig.EOSTokenID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read eos_token_id from %s: %w", configPath, err)
+	}
+	constraint, err := generationConstraint(pipeline.ModelPath, pipeline.regex, pipeline.jsonSchema, pipeline.EOSTokenIDs)
+	if err != nil {
+		return nil, err
+	}
+	if constraint != nil {
+		pipeline.LogitProcessors = append(pipeline.LogitProcessors, constraint)
+	}
+
+	// onnx models init
+	encoder, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+	inputs, outputs, err := loadInputOutputMeta(encoder)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = outputs
+
+	decoder, err := pipeline.loadDecoder(pipeline.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// tokenizer init
+	pipeline.TokenizerOptions, err = getTokenizerOptions(inputs)
+	if err != nil {
+		return nil, err
+	}
+	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	if tkErr != nil {
+		return nil, tkErr
+	}
+	pipeline.Tokenizer = tk
+
+	// creation of the sessions, placed together by the total size of both graphs
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, encoder, decoder)
+	pipeline.OrtOptions = ortOptions
+	session, err := config.EngineCache.createSession(encoder, inputs, pipeline.OutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	pipeline.OrtSession = session
+	if err = pipeline.validateDecoder(); err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	decoderSession, err := config.EngineCache.createSession(decoder, pipeline.DecoderInputsMeta, pipeline.DecoderOutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	pipeline.DecoderSession = decoderSession
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(encoder) + len(decoder))}
+	pipeline.TokenizerTimings = &timings{}
+
+	// validate
+	err = pipeline.Validate()
+	if err != nil {
+		errDestroy := pipeline.Destroy()
+		return nil, errors.Join(err, errDestroy)
+	}
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the logits output of the decoder.
+func (p *Text2TextGenerationPipeline) GetMetadata() PipelineMetadata {
+	return p.decoderMetadata()
+}
+
+// Destroy frees the text2text generation pipeline resources.
+func (p *Text2TextGenerationPipeline) Destroy() error {
+	return errors.Join(destroySession(p.Tokenizer, p.OrtSession), p.destroyDecoder())
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *Text2TextGenerationPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Tokenizer: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.TokenizerTimings.TotalNS),
+			p.TokenizerTimings.NumCalls,
+			time.Duration(float64(p.TokenizerTimings.TotalNS)/math.Max(1, float64(p.TokenizerTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *Text2TextGenerationPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.OutputsMeta) == 0 || len(p.OutputsMeta[0].Dimensions) != 3 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the encoder must output hidden states with 3 dimensions"))
+	}
+	if p.MaxNewTokens <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the maximum number of new tokens must be greater than zero"))
+	}
+	if p.NumBeams < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the number of beams must not be negative"))
+	}
+	if len(p.EOSTokenIDs) == 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: no eos_token_id in the model config"))
+	}
+	return errors.Join(append(validationErrors, p.validateDecoder())...)
+}
+
+// Preprocess tokenizes the inputs and creates the encoder input tensors.
+func (p *Text2TextGenerationPipeline) Preprocess(batch *PipelineBatch, inputs []string) error {
+	start := time.Now()
+	prefixed := make([]string, len(inputs))
+	for i, input := range inputs {
+		prefixed[i] = p.Prefix + input
+	}
+	tokenizeInputs(batch, p.Tokenizer, prefixed, p.TokenizerOptions)
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	err := createInputTensors(batch, p.InputsMeta)
+	return err
+}
+
+// Forward runs the encoder, and then the decoder once per generated token until all the sequences of the batch
+// have generated an eos token or MaxNewTokens tokens. It returns the generated token ids of each input.
+func (p *Text2TextGenerationPipeline) Forward(batch *PipelineBatch) ([][]uint32, error) {
+	settings, err := p.settings(nil)
+	if err != nil {
+		return nil, err
+	}
+	return p.generate(batch, settings)
+}
+
+// settings returns the decoding settings of a call: greedy decoding or beam search of up to MaxNewTokens tokens,
+// changed by the options of the call.
+func (p *Text2TextGenerationPipeline) settings(options []GenerationOption) (*generationSettings, error) {
+	settings := &generationSettings{
+		maxNewTokens:  p.MaxNewTokens,
+		numBeams:      p.NumBeams,
+		lengthPenalty: p.LengthPenalty,
+		earlyStopping: p.EarlyStopping,
+		random:        p.random,
+		randomMutex:   &p.randomMutex,
+	}
+	return settings, settings.apply(options)
+}
+
+// generate runs the encoder and the decoder with the decoding settings of a call.
+func (p *Text2TextGenerationPipeline) generate(batch *PipelineBatch, settings *generationSettings) ([][]uint32, error) {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	if err := runSessionOnBatch(batch, p.OrtSession, p.OutputsMeta[:1]); err != nil {
+		return nil, err
+	}
+	hiddenStates := batch.OutputTensors[0]
+
+	batchSize := len(batch.Input)
+	encoderMask := make([]int64, batchSize*batch.MaxSequenceLength)
+	for i, input := range batch.Input {
+		for j, mask := range input.AttentionMask {
+			if j < batch.MaxSequenceLength {
+				encoderMask[i*batch.MaxSequenceLength+j] = int64(mask)
+			}
+		}
+	}
+
+	var generated [][]uint32
+	var err error
+	if settings.numBeams > 1 {
+		generated, err = p.generateBeams(batch, hiddenStates, encoderMask, settings)
+	} else {
+		generated, err = p.generateTokens(batch, hiddenStates, encoderMask, settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.PipelineMemory.recordForward(usageBefore, batch)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return generated, nil
+}
+
+// generateTokens decodes the inputs of a batch one token at a time, greedily or by sampling.
+func (p *Text2TextGenerationPipeline) generateTokens(batch *PipelineBatch, hiddenStates *ort.Tensor[float32], encoderMask []int64, settings *generationSettings) ([][]uint32, error) {
+	batchSize := len(batch.Input)
+	sequences := make([][]int64, batchSize)
+	for i := range sequences {
+		sequences[i] = []int64{p.DecoderStartTokenID}
+	}
+	finished := make([]bool, batchSize)
+	generated := make([][]uint32, batchSize)
+	past := map[int]ort.Value{}
+	defer destroyPast(past)
+	processors := settings.processors(p.LogitProcessors)
+	for step := 0; step < settings.maxNewTokens; step++ {
+		logits, vocabularySize, err := p.decoderStep(sequences, past, encoderMask, batch.MaxSequenceLength, hiddenStates)
+		if err != nil {
+			return nil, err
+		}
+		allFinished := true
+		for i := range sequences {
+			var next int64
+			switch {
+			case finished[i]:
+				next = p.DecoderStartTokenID // padding, ignored
+			case step == 0 && p.ForcedBOSTokenID >= 0:
+				next = p.ForcedBOSTokenID
+			default:
+				sequenceLogits := logits[i*vocabularySize : (i+1)*vocabularySize]
+				if err = processLogits(processors, nil, generated[i], sequenceLogits); err != nil {
+					return nil, err
+				}
+				index, pickErr := settings.pickToken(sequenceLogits)
+				if pickErr != nil {
+					return nil, pickErr
+				}
+				next = int64(index)
+			}
+			sequences[i] = append(sequences[i], next)
+			if finished[i] {
+				continue
+			}
+			if p.EOSTokenIDs[next] {
+				finished[i] = true
+			} else {
+				generated[i] = append(generated[i], uint32(next))
+				allFinished = false
+			}
+		}
+		if allFinished {
+			break
+		}
+	}
+	return generated, nil
+}
+
+// generateBeams decodes the inputs of a batch with beam search. The decoder is run on the beams of all the inputs
+// at once, with the encoder outputs and mask of each input repeated for each of its beams, and the past key values
+// are reordered after each step to follow the beams.
+func (p *Text2TextGenerationPipeline) generateBeams(batch *PipelineBatch, hiddenStates *ort.Tensor[float32], encoderMask []int64, settings *generationSettings) ([][]uint32, error) {
+	batchSize := len(batch.Input)
+	numBeams := settings.numBeams
+	encoderLength := batch.MaxSequenceLength
+	inputRows := make([]int, 0, batchSize*numBeams)
+	for i := 0; i < batchSize; i++ {
+		for j := 0; j < numBeams; j++ {
+			inputRows = append(inputRows, i)
+		}
+	}
+	beamHiddenStates, err := gatherRows(hiddenStates, inputRows)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = beamHiddenStates.Destroy()
+	}()
+	beamMask := make([]int64, 0, len(inputRows)*encoderLength)
+	for _, row := range inputRows {
+		beamMask = append(beamMask, encoderMask[row*encoderLength:(row+1)*encoderLength]...)
+	}
+
+	searches := make([]*beamSearch, batchSize)
+	for i := range searches {
+		searches[i] = newBeamSearch(settings)
+	}
+	sequences := make([][]int64, len(inputRows))
+	for i := range sequences {
+		sequences[i] = []int64{p.DecoderStartTokenID}
+	}
+	past := map[int]ort.Value{}
+	defer destroyPast(past)
+	processors := settings.processors(p.LogitProcessors)
+	for step := 0; step < settings.maxNewTokens; step++ {
+		logits, vocabularySize, stepErr := p.decoderStep(sequences, past, beamMask, encoderLength, beamHiddenStates)
+		if stepErr != nil {
+			return nil, stepErr
+		}
+		allDone := true
+		parentRows := make([]int, len(sequences))
+		for i, search := range searches {
+			beamLogits := make([][]float32, numBeams)
+			for j, b := range search.beams {
+				if !b.active() {
+					continue
+				}
+				row := i*numBeams + j
+				beamLogits[j] = logits[row*vocabularySize : (row+1)*vocabularySize]
+				if step == 0 && p.ForcedBOSTokenID >= 0 {
+					for id := range beamLogits[j] {
+						if int64(id) != p.ForcedBOSTokenID {
+							beamLogits[j][id] = float32(math.Inf(-1))
+						}
+					}
+				} else if err = processLogits(processors, nil, b.tokens, beamLogits[j]); err != nil {
+					return nil, err
+				}
+			}
+			if err = search.advance(beamLogits, p.EOSTokenIDs); err != nil {
+				return nil, err
+			}
+			for j, b := range search.beams {
+				parentRows[i*numBeams+j] = i*numBeams + b.parent
+			}
+			allDone = allDone && search.done
+		}
+		if allDone {
+			break
+		}
+		next := make([][]int64, len(sequences))
+		for row, parentRow := range parentRows {
+			b := searches[row/numBeams].beams[row%numBeams]
+			token := p.DecoderStartTokenID // padding of unused beams, ignored
+			if b.active() {
+				token = int64(b.tokens[len(b.tokens)-1])
+			}
+			next[row] = append(append(make([]int64, 0, len(sequences[parentRow])+1), sequences[parentRow]...), token)
+		}
+		sequences = next
+		if err = reorderPast(past, parentRows); err != nil {
+			return nil, err
+		}
+	}
+	generated := make([][]uint32, batchSize)
+	for i, search := range searches {
+		generated[i] = search.best()
+	}
+	return generated, nil
+}
+
+// Postprocess decodes the generated token ids into texts.
+func (p *Text2TextGenerationPipeline) Postprocess(generated [][]uint32) (*Text2TextGenerationOutput, error) {
+	output := &Text2TextGenerationOutput{GeneratedTexts: make([]string, len(generated))}
+	for i, tokenIDs := range generated {
+		output.GeneratedTexts[i] = strings.TrimSpace(p.Tokenizer.Decode(tokenIDs, true))
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *Text2TextGenerationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete text2text generation output type rather than the interface.
+func (p *Text2TextGenerationPipeline) RunPipeline(inputs []string) (*Text2TextGenerationOutput, error) {
+	return p.RunWithOptions(inputs)
+}
+
+// RunWithOptions is like RunPipeline, with decoding options for this call only, e.g. GenerateWithTemperature(0.7)
+// to sample the output instead of decoding it greedily.
+func (p *Text2TextGenerationPipeline) RunWithOptions(inputs []string, options ...GenerationOption) (*Text2TextGenerationOutput, error) {
+	settings, err := p.settings(options)
+	if err != nil {
+		return nil, err
+	}
+	var runErrors []error
+	batch := NewBatch()
+	defer func(*PipelineBatch) {
+		runErrors = append(runErrors, batch.Destroy())
+	}(batch)
+
+	runErrors = append(runErrors, p.Preprocess(batch, inputs))
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	generated, err := p.generate(batch, settings)
+	runErrors = append(runErrors, err)
+	if e := errors.Join(runErrors...); e != nil {
+		return nil, e
+	}
+
+	result, postErr := p.Postprocess(generated)
+	runErrors = append(runErrors, postErr)
+	return result, errors.Join(runErrors...)
+}
@@ -9,6 +9,7 @@ import (
 
 	util "github.com/knights-analytics/hugot/utils"
 
+	"github.com/daulet/tokenizers"
 	jsoniter "github.com/json-iterator/go"
 	ort "github.com/yalue/onnxruntime_go"
 )
@@ -20,6 +21,15 @@ type TextClassificationPipeline struct {
 	IDLabelMap              map[int]string
 	AggregationFunctionName string
 	ProblemType             string
+	WindowAggregation       string             // how the scores of the windows of long inputs are merged, see WithSlidingWindow
+	Float64                 bool               // whether scores are computed in float64, see WithFloat64Scores
+	Taxonomy                *LabelTaxonomy     // hierarchy of the labels, read from the TaxonomyFile of the model or set with WithTaxonomy
+	Thresholds              map[string]float32 // with multi-label models, decision threshold of each label, see WithThresholds
+	Threshold               float32            // with multi-label models, decision threshold of the labels without one in Thresholds
+	window                  *slidingWindow
+	pairs                   *pairEncoder
+	pairsError              error // why the model cannot encode pairs, if it cannot
+	allLabels               bool  // whether the scores of all the labels are returned whatever the thresholds, for presets
 }
 
 type TextClassificationPipelineConfig struct {
@@ -29,10 +39,12 @@ type TextClassificationPipelineConfig struct {
 type ClassificationOutput struct {
 	Label string
 	Score float32
+	Path  []string `json:",omitempty"` // with a label taxonomy, the labels from the root of the taxonomy to Label
 }
 
 type TextClassificationOutput struct {
 	ClassificationOutputs [][]ClassificationOutput
+	Scores64              [][]float64 // with WithFloat64Scores, the float64 score of each classification output
 }
 
 func (t *TextClassificationOutput) GetOutput() []any {
@@ -59,6 +71,66 @@ func WithSigmoid() PipelineOption[*TextClassificationPipeline] {
 	}
 }
 
+// WithRawScores returns the logits of the model as scores without applying an aggregation function,
+// e.g. for regression models that output a single score.
+func WithRawScores() PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.AggregationFunctionName = "NONE"
+	}
+}
+
+// WithSlidingWindow splits inputs longer than windowLength tokens, special tokens included, into overlapping windows
+// rather than truncating them, with stride tokens shared by consecutive windows. Each window is classified, and the
+// scores of the windows of an input are merged as set by WithWindowAggregation. A windowLength of zero uses the
+// maximum length of the model, read from its tokenizer config. Text pairs are not split into windows.
+func WithSlidingWindow(windowLength int, stride int) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.window = &slidingWindow{length: windowLength, stride: stride}
+	}
+}
+
+// WithWindowAggregation sets how the scores of the windows of an input are merged with WithSlidingWindow:
+// MEAN (the default) averages the scores, MAX takes the maximum score of each label, and VOTE gives each label
+// the share of the windows for which it is the top label.
+func WithWindowAggregation(aggregation string) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.WindowAggregation = aggregation
+	}
+}
+
+// WithFloat64Scores computes the scores from the logits, merges the scores of windows and picks the label in
+// float64 rather than float32, and returns the float64 scores in Scores64 along with the float32 scores. For models
+// whose logits are near saturation, the float32 scores of the labels may round to the same value, so that the
+// label picked and the order of the scores depend on rounding.
+func WithFloat64Scores() PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.Float64 = true
+	}
+}
+
+// WithTaxonomy sets the hierarchy of the labels of the model, rather than reading it from the TaxonomyFile of the
+// model. With a taxonomy, the probabilities of the labels are rolled up to their parents: summed with the softmax,
+// or their maximum with the sigmoid, so that parents are at least as likely as their children. Single label models
+// then pick their label from the root of the taxonomy down, and multi-label models return the scores of all the
+// labels of the taxonomy. Every classification output has the path of its label in the taxonomy.
+func WithTaxonomy(taxonomy *LabelTaxonomy) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.Taxonomy = taxonomy
+	}
+}
+
+// WithThresholds sets the decision thresholds of the labels of a multi-label model, rather than reading them from the
+// ThresholdsFile of the model: only the labels whose score reaches their threshold are returned, with
+// defaultThreshold for the labels without one. Optimal thresholds often differ widely across labels, e.g. rare labels
+// usually need a lower threshold than frequent ones. With a taxonomy, the labels of the taxonomy can have thresholds
+// too. Thresholds are probabilities, unless the pipeline returns raw scores.
+func WithThresholds(thresholds map[string]float32, defaultThreshold float32) PipelineOption[*TextClassificationPipeline] {
+	return func(pipeline *TextClassificationPipeline) {
+		pipeline.Thresholds = thresholds
+		pipeline.Threshold = defaultThreshold
+	}
+}
+
 func WithSingleLabel() PipelineOption[*TextClassificationPipeline] {
 	return func(pipeline *TextClassificationPipeline) {
 		pipeline.ProblemType = "singleLabel"
@@ -78,6 +150,8 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 	pipeline.PipelineName = config.Name
 	pipeline.OrtOptions = ortOptions
 	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.Remote = config.Remote
 
 	for _, o := range config.Options {
 		o(pipeline)
@@ -87,12 +161,15 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 		pipeline.ProblemType = "singleLabel"
 	}
 	if pipeline.AggregationFunctionName == "" {
-		if pipeline.PipelineName == "singleLabel" {
+		if pipeline.ProblemType == "singleLabel" {
 			pipeline.AggregationFunctionName = "SOFTMAX"
 		} else {
 			pipeline.AggregationFunctionName = "SIGMOID"
 		}
 	}
+	if pipeline.WindowAggregation == "" {
+		pipeline.WindowAggregation = "MEAN"
+	}
 
 	// read id to label map
 	configPath := util.PathJoinSafe(pipeline.ModelPath, "config.json")
@@ -108,8 +185,23 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 
 	pipeline.IDLabelMap = pipelineInputConfig.IDLabelMap
 
+	if pipeline.Taxonomy == nil {
+		if pipeline.Taxonomy, err = LoadTaxonomy(pipeline.ModelPath); err != nil {
+			return nil, err
+		}
+	}
+	if pipeline.Thresholds == nil && pipeline.Threshold == 0 {
+		thresholds, thresholdsErr := LoadThresholds(pipeline.ModelPath)
+		if thresholdsErr != nil {
+			return nil, thresholdsErr
+		}
+		if thresholds != nil {
+			pipeline.Thresholds, pipeline.Threshold = thresholds.Thresholds, thresholds.Threshold
+		}
+	}
+
 	// onnx model init
-	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename)
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
 	if err != nil {
 		return nil, err
 	}
@@ -128,14 +220,17 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 		return nil, err
 	}
 
-	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	tk, tkErr := loadWindowTokenizer(pipeline.ModelPath, pipeline.window)
 	if tkErr != nil {
 		return nil, tkErr
 	}
 	pipeline.Tokenizer = tk
+	pipeline.pairs, pipeline.pairsError = loadPairEncoder(pipeline.ModelPath, tk)
 
 	// creation of the session
-	session, err := createSession(model, inputs, pipeline.OutputsMeta, ortOptions)
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := pipeline.createSession(config.EngineCache, model, inputs, pipeline.OutputsMeta, ortOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -143,6 +238,7 @@ func NewTextClassificationPipeline(config PipelineConfig[*TextClassificationPipe
 
 	// initialize timings
 	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
 	pipeline.TokenizerTimings = &timings{}
 
 	// validate
@@ -186,6 +282,7 @@ func (p *TextClassificationPipeline) GetStats() []string {
 			time.Duration(p.PipelineTimings.TotalNS),
 			p.PipelineTimings.NumCalls,
 			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
 	}
 }
 
@@ -215,25 +312,58 @@ func (p *TextClassificationPipeline) Validate() error {
 	if len(p.IDLabelMap) != nLogits {
 		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: length of id2label map does not match number of logits in output (%d)", nLogits))
 	}
+	if p.window != nil {
+		validationErrors = append(validationErrors, p.window.validate())
+		switch p.WindowAggregation {
+		case "MEAN", "MAX", "VOTE":
+		default:
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: window aggregation %s is not supported", p.WindowAggregation))
+		}
+	}
+	if p.Taxonomy != nil {
+		validationErrors = append(validationErrors, p.Taxonomy.validate(p.IDLabelMap))
+	}
+	validationErrors = append(validationErrors, p.validateThresholds())
 	return errors.Join(validationErrors...)
 }
 
-// Preprocess tokenizes the input strings.
+// Preprocess tokenizes the input strings, split into windows with WithSlidingWindow.
 func (p *TextClassificationPipeline) Preprocess(batch *PipelineBatch, inputs []string) error {
 	start := time.Now()
-	tokenizeInputs(batch, p.Tokenizer, inputs, p.TokenizerOptions)
+	if p.window != nil {
+		p.window.tokenize(batch, p.Tokenizer, inputs, tokenizers.Encoding{})
+	} else {
+		tokenizeInputs(batch, p.Tokenizer, inputs, p.TokenizerOptions)
+	}
 	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
 	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
 	err := createInputTensors(batch, p.InputsMeta)
 	return err
 }
 
+// PreprocessPairs tokenizes pairs of texts, such as a premise and a hypothesis for NLI models or two sentences for
+// semantic textual similarity, with the token type ids of the second text set as in the pair template of the model.
+func (p *TextClassificationPipeline) PreprocessPairs(batch *PipelineBatch, texts []string, textPairs []string) error {
+	if p.pairs == nil {
+		return fmt.Errorf("the model cannot encode text pairs: %w", p.pairsError)
+	}
+	start := time.Now()
+	if err := p.pairs.tokenizePairs(batch, p.Tokenizer, texts, textPairs, p.TokenizerOptions); err != nil {
+		return err
+	}
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	return createInputTensors(batch, p.InputsMeta)
+}
+
 func (p *TextClassificationPipeline) Forward(batch *PipelineBatch) error {
 	start := time.Now()
-	err := runSessionOnBatch(batch, p.OrtSession, p.OutputsMeta)
+	usageBefore := memoryUsageBefore()
+	err := p.runOnBatch(batch, p.OutputsMeta)
 	if err != nil {
 		return err
 	}
+	p.PipelineMemory.recordForward(usageBefore, batch)
 	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
 	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
 	return nil
@@ -243,24 +373,14 @@ func (p *TextClassificationPipeline) Postprocess(batch *PipelineBatch) (*TextCla
 	outputTensor := batch.OutputTensors[0]
 	outputDims := p.OutputsMeta[0].Dimensions
 	nLogit := outputDims[len(outputDims)-1]
-	output := make([][]float32, len(batch.Input))
+	logits := make([][]float32, len(batch.Input))
 	inputCounter := 0
 	vectorCounter := 0
 	inputVector := make([]float32, nLogit)
-	var aggregationFunction func([]float32) []float32
-	switch p.AggregationFunctionName {
-	case "SIGMOID":
-		aggregationFunction = util.Sigmoid
-	case "SOFTMAX":
-		aggregationFunction = util.SoftMax
-	default:
-		return nil, fmt.Errorf("aggregation function %s is not supported", p.AggregationFunctionName)
-	}
-
 	for _, result := range outputTensor.GetData() {
 		inputVector[vectorCounter] = result
 		if vectorCounter == int(nLogit)-1 {
-			output[inputCounter] = aggregationFunction(inputVector)
+			logits[inputCounter] = inputVector
 			vectorCounter = 0
 			inputVector = make([]float32, nLogit)
 			inputCounter++
@@ -269,63 +389,159 @@ func (p *TextClassificationPipeline) Postprocess(batch *PipelineBatch) (*TextCla
 		}
 	}
 
-	batchClassificationOutputs := TextClassificationOutput{
-		ClassificationOutputs: make([][]ClassificationOutput, len(batch.Input)),
+	var output [][]float64
+	var err error
+	if p.Float64 {
+		output, err = p.scores64(logits, batch.windows)
+	} else {
+		var output32 [][]float32
+		output32, err = p.scores32(logits, batch.windows)
+		output = make([][]float64, len(output32))
+		for i, scores := range output32 {
+			output[i] = util.ToFloat64(scores)
+		}
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
+	batchClassificationOutputs := TextClassificationOutput{
+		ClassificationOutputs: make([][]ClassificationOutput, len(output)),
+	}
+	if p.Float64 {
+		batchClassificationOutputs.Scores64 = make([][]float64, len(output))
+	}
 
-	for i := 0; i < len(batch.Input); i++ {
-		switch p.ProblemType {
-		case "singleLabel":
-			inputClassificationOutputs := make([]ClassificationOutput, 1)
-			index, value, errArgMax := util.ArgMax(output[i])
-			if errArgMax != nil {
-				err = errArgMax
+	for i := 0; i < len(output); i++ {
+		var classes []ClassificationOutput
+		var scores64 []float64
+		if p.hierarchical() {
+			var taxonomyErr error
+			classes, scores64, taxonomyErr = p.taxonomyOutputs(output[i])
+			if taxonomyErr != nil {
+				err = taxonomyErr
 				continue
 			}
-			class, ok := p.IDLabelMap[index]
-			if !ok {
-				err = fmt.Errorf("class with index number %d not found in id label map", index)
-			}
-			inputClassificationOutputs[0] = ClassificationOutput{
-				Label: class,
-				Score: value,
-			}
-			batchClassificationOutputs.ClassificationOutputs[i] = inputClassificationOutputs
-		case "multiLabel":
-			inputClassificationOutputs := make([]ClassificationOutput, len(p.IDLabelMap))
-			for j := range output[i] {
-				class, ok := p.IDLabelMap[j]
+		} else {
+			switch p.ProblemType {
+			case "singleLabel":
+				index, value, errArgMax := util.ArgMax(output[i])
+				if errArgMax != nil {
+					err = errArgMax
+					continue
+				}
+				class, ok := p.IDLabelMap[index]
 				if !ok {
-					err = fmt.Errorf("class with index number %d not found in id label map", j)
+					err = fmt.Errorf("class with index number %d not found in id label map", index)
 				}
-				inputClassificationOutputs[j] = ClassificationOutput{
+				classes = []ClassificationOutput{{
 					Label: class,
-					Score: output[i][j],
+					Score: float32(value),
+				}}
+				scores64 = []float64{value}
+			case "multiLabel":
+				classes = make([]ClassificationOutput, len(p.IDLabelMap))
+				for j := range output[i] {
+					class, ok := p.IDLabelMap[j]
+					if !ok {
+						err = fmt.Errorf("class with index number %d not found in id label map", j)
+					}
+					classes[j] = ClassificationOutput{
+						Label: class,
+						Score: float32(output[i][j]),
+					}
 				}
+				scores64 = output[i]
+			default:
+				err = fmt.Errorf("problem type %s not recognized", p.ProblemType)
 			}
-			batchClassificationOutputs.ClassificationOutputs[i] = inputClassificationOutputs
-		default:
-			err = fmt.Errorf("problem type %s not recognized", p.ProblemType)
+		}
+		if p.thresholded() {
+			classes, scores64 = p.applyThresholds(classes, scores64)
+		}
+		batchClassificationOutputs.ClassificationOutputs[i] = classes
+		if p.Float64 {
+			batchClassificationOutputs.Scores64[i] = scores64
 		}
 	}
 	return &batchClassificationOutputs, err
 }
 
+// scores32 computes the scores of the logits of each input in float32, merging the scores of the windows of
+// each input if it was split.
+func (p *TextClassificationPipeline) scores32(logits [][]float32, windows []int) ([][]float32, error) {
+	var aggregationFunction func([]float32) []float32
+	switch p.AggregationFunctionName {
+	case "SIGMOID":
+		aggregationFunction = util.Sigmoid
+	case "SOFTMAX":
+		aggregationFunction = util.SoftMax
+	case "NONE":
+		aggregationFunction = func(logits []float32) []float32 { return logits }
+	default:
+		return nil, fmt.Errorf("aggregation function %s is not supported", p.AggregationFunctionName)
+	}
+	scores := make([][]float32, len(logits))
+	for i, inputLogits := range logits {
+		scores[i] = aggregationFunction(inputLogits)
+	}
+	if windows != nil {
+		return mergeWindowScores(scores, windows, p.WindowAggregation)
+	}
+	return scores, nil
+}
+
+// scores64 is like scores32, in float64.
+func (p *TextClassificationPipeline) scores64(logits [][]float32, windows []int) ([][]float64, error) {
+	var aggregationFunction func([]float32) []float64
+	switch p.AggregationFunctionName {
+	case "SIGMOID":
+		aggregationFunction = util.Sigmoid64
+	case "SOFTMAX":
+		aggregationFunction = util.SoftMax64
+	case "NONE":
+		aggregationFunction = util.ToFloat64
+	default:
+		return nil, fmt.Errorf("aggregation function %s is not supported", p.AggregationFunctionName)
+	}
+	scores := make([][]float64, len(logits))
+	for i, inputLogits := range logits {
+		scores[i] = aggregationFunction(inputLogits)
+	}
+	if windows != nil {
+		return mergeWindowScores(scores, windows, p.WindowAggregation)
+	}
+	return scores, nil
+}
+
 // Run the pipeline on a string batch.
 func (p *TextClassificationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
 	return p.RunPipeline(inputs)
 }
 
 func (p *TextClassificationPipeline) RunPipeline(inputs []string) (*TextClassificationOutput, error) {
+	return p.run(func(batch *PipelineBatch) error {
+		return p.Preprocess(batch, inputs)
+	})
+}
+
+// RunPairs classifies pairs of texts, each text along with the text pair at the same index, e.g. with NLI models
+// such as cross-encoder/nli-deberta-v3-small. Semantic textual similarity models with a single output, such as
+// cross-encoder/stsb-roberta-base, return their similarity score as is with the WithRawScores option.
+func (p *TextClassificationPipeline) RunPairs(texts []string, textPairs []string) (*TextClassificationOutput, error) {
+	return p.run(func(batch *PipelineBatch) error {
+		return p.PreprocessPairs(batch, texts, textPairs)
+	})
+}
+
+func (p *TextClassificationPipeline) run(preprocess func(batch *PipelineBatch) error) (*TextClassificationOutput, error) {
 	var runErrors []error
 	batch := NewBatch()
 	defer func(*PipelineBatch) {
 		runErrors = append(runErrors, batch.Destroy())
 	}(batch)
 
-	runErrors = append(runErrors, p.Preprocess(batch, inputs))
+	runErrors = append(runErrors, preprocess(batch))
 	if e := errors.Join(runErrors...); e != nil {
 		return nil, e
 	}
@@ -339,3 +555,17 @@ func (p *TextClassificationPipeline) RunPipeline(inputs []string) (*TextClassifi
 	runErrors = append(runErrors, postErr)
 	return result, errors.Join(runErrors...)
 }
+
+// presetClassifier returns the copy of a classifier that a preset built on it runs, returning the scores of all the
+// labels with the given aggregation function, so that the classifier, which may be shared through the session, is
+// left as it is. The copy shares the onnx session and the tokenizer of the classifier.
+func presetClassifier(classifier *TextClassificationPipeline, aggregation string) (*TextClassificationPipeline, error) {
+	preset := *classifier
+	preset.ProblemType = "multiLabel"
+	preset.AggregationFunctionName = aggregation
+	preset.allLabels = true
+	if err := preset.Validate(); err != nil {
+		return nil, err
+	}
+	return &preset, nil
+}
@@ -0,0 +1,824 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// types
+
+// TextGenerationPipeline runs decoder-only language models, such as GPT-2, Llama or Qwen, exported to ONNX by
+// optimum with past key values (--task text-generation-with-past), either as a model with past_key_values
+// inputs or as a merged decoder with a use_cache_branch input. The keys and values of the tokens seen so far
+// are cached between decoding steps, so that each step only runs the model on the new token, and with
+// WithPromptCache between calls, so that prompts starting with the same tokens only run the model on the tokens
+// that follow them. Inputs are
+// generated one at a time, and the generated text is returned without the prompt. With beam search, each beam has
+// its own cache, copied when several beams extend the same one.
+type TextGenerationPipeline struct {
+	basePipeline
+	MaxNewTokens    int
+	Temperature     float32 // 0 for greedy decoding
+	TopK            int     // sample among the k most likely tokens only, 0 for no limit
+	TopP            float32 // sample among the most likely tokens whose cumulative probability reaches p, 0 for no limit
+	StopSequences   []string
+	LogitProcessors []LogitProcessor        // applied to the logits of each step before the next token is picked
+	NumBeams        int                     // beam search with NumBeams beams if greater than 1
+	LengthPenalty   float32                 // exponent of the length normalizing the scores of beam search hypotheses, 1 by default
+	EarlyStopping   bool                    // stop beam search as soon as NumBeams hypotheses are finished
+	Draft           *TextGenerationPipeline // draft model of speculative decoding, nil for none
+	DraftTokens     int                     // tokens proposed by the draft model at each step, 4 by default
+	PromptCacheSize int                     // number of sequences whose past key values are kept for the next prompts, 0 for none
+	EOSTokenIDs     map[int64]bool
+	regex           string
+	jsonSchema      string
+	hasCacheBranch  bool
+	presentIndex    map[int]int // index of the present output of each past key values input
+	random          *rand.Rand
+	randomMutex     sync.Mutex
+	draftProposed   uint64
+	draftAccepted   uint64
+	promptCache     *promptCache
+}
+
+type TextGenerationPipelineConfig struct {
+	EOSTokenID jsoniter.RawMessage `json:"eos_token_id"` // a token id or a list of token ids
+}
+
+type TextGenerationOutput struct {
+	GeneratedTexts []string
+}
+
+func (t *TextGenerationOutput) GetOutput() []any {
+	out := make([]any, len(t.GeneratedTexts))
+	for i, text := range t.GeneratedTexts {
+		out[i] = any(text)
+	}
+	return out
+}
+
+// kvCache holds the past keys and values of a sequence between decoding steps. Since onnxruntime tensors cannot
+// be empty, the cache of models without a use_cache_branch input starts with a dummy position, which is masked
+// out by the attention mask.
+type kvCache struct {
+	past   map[int]ort.Value // past key values, by input index
+	length int               // number of positions in the cache, including the dummy position
+	dummy  bool              // whether the first position is a dummy position
+	tokens int               // number of tokens in the cache
+}
+
+// clone copies the past key values of the cache, for beam search.
+func (c *kvCache) clone() (*kvCache, error) {
+	cloned := &kvCache{past: make(map[int]ort.Value, len(c.past)), length: c.length, dummy: c.dummy, tokens: c.tokens}
+	for inputIndex, value := range c.past {
+		tensor, err := gatherRows(value, []int{0})
+		if err != nil {
+			return nil, errors.Join(err, cloned.destroy())
+		}
+		cloned.past[inputIndex] = tensor
+	}
+	return cloned, nil
+}
+
+func (c *kvCache) destroy() error {
+	var err error
+	for _, value := range c.past {
+		err = errors.Join(err, value.Destroy())
+	}
+	return err
+}
+
+// presentOutputs returns the index of the present output of each past key values input of a decoder exported by
+// optimum, and whether the decoder is a merged decoder with a use_cache_branch input.
+func presentOutputs(inputs []ort.InputOutputInfo, outputs []ort.InputOutputInfo) (map[int]int, bool) {
+	presentIndex := map[int]int{}
+	hasCacheBranch := false
+	for i, input := range inputs {
+		if input.Name == "use_cache_branch" {
+			hasCacheBranch = true
+		}
+		if !strings.HasPrefix(input.Name, "past_key_values") {
+			continue
+		}
+		presentName := strings.Replace(input.Name, "past_key_values", "present", 1)
+		for j, output := range outputs {
+			if output.Name == presentName {
+				presentIndex[i] = j
+			}
+		}
+	}
+	return presentIndex, hasCacheBranch
+}
+
+// options
+
+// WithMaxTokens sets the maximum number of tokens generated for each input, 64 by default.
+func WithMaxTokens(maxNewTokens int) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.MaxNewTokens = maxNewTokens
+	}
+}
+
+// WithSampling samples the generated tokens from the distribution of the model scaled by the temperature, among
+// the topK most likely tokens and the most likely tokens whose cumulative probability reaches topP. A topK or
+// topP of 0 means no limit. Without this option, decoding is greedy.
+func WithSampling(temperature float32, topK int, topP float32) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.Temperature = temperature
+		pipeline.TopK = topK
+		pipeline.TopP = topP
+	}
+}
+
+// WithSamplingSeed seeds the random source of sampling, to make the generated texts reproducible.
+func WithSamplingSeed(seed int64) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.random = rand.New(rand.NewSource(seed))
+	}
+}
+
+// WithBeamSearch decodes with beam search (see GenerateWithBeamSearch) with numBeams beams, a length penalty,
+// usually 1, and early stopping or not. It cannot be combined with WithSampling.
+func WithBeamSearch(numBeams int, lengthPenalty float32, earlyStopping bool) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.NumBeams = numBeams
+		pipeline.LengthPenalty = lengthPenalty
+		pipeline.EarlyStopping = earlyStopping
+	}
+}
+
+// WithDraftModel generates with speculative decoding, where a small draft model with the same tokenizer, e.g. a
+// smaller model of the same family, proposes numDraftTokens tokens at each step that the model verifies in a single
+// run. The generated texts are the ones of the model alone, with greedy decoding as well as sampling, and are
+// generated faster on CPU when the draft model picks the same tokens as the model often, as shown by the
+// acceptance rate in GetStats. A numDraftTokens of 0 proposes 4 tokens. Beam search does not use the draft model.
+// The pipeline is invalid if the tokenizers of the two models differ.
+func WithDraftModel(draft *TextGenerationPipeline, numDraftTokens int) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.Draft = draft
+		pipeline.DraftTokens = numDraftTokens
+	}
+}
+
+// WithPromptCache keeps the past key values of the last size generated sequences, prompt and generated tokens, so
+// that the prompts of the next calls that start with the same tokens, e.g. with a long fixed system prompt or with
+// the previous turns of a chat, skip running the model on them. The longest cached prefix of each prompt is used,
+// and sequences are evicted least recently used first. The hits and the tokens reused are shown in GetStats.
+// Each sequence takes the memory of its past key values, which grows with the number of layers of the model and
+// the length of the sequence.
+func WithPromptCache(size int) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.PromptCacheSize = size
+	}
+}
+
+// WithStopSequences stops the generation of an input as soon as the generated text contains one of the stop
+// sequences. The stop sequence and what follows it are not returned.
+func WithStopSequences(stopSequences ...string) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.StopSequences = stopSequences
+	}
+}
+
+// WithLogitProcessors adds logit processors, applied in order to the logits of each decoding step before the next
+// token is picked.
+func WithLogitProcessors(processors ...LogitProcessor) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.LogitProcessors = append(pipeline.LogitProcessors, processors...)
+	}
+}
+
+// WithRegex constrains the generated texts to the matches of a regular expression, in the RE2 syntax of the regexp
+// package, by masking the tokens that cannot continue a match at each decoding step (see ConstraintProcessor).
+func WithRegex(pattern string) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.regex = pattern
+	}
+}
+
+// WithJSONSchema constrains the generated texts to JSON texts that are valid for a JSON schema, by masking the
+// tokens that cannot continue a valid text at each decoding step (see util.JSONSchemaPattern for the supported
+// keywords).
+func WithJSONSchema(schema string) PipelineOption[*TextGenerationPipeline] {
+	return func(pipeline *TextGenerationPipeline) {
+		pipeline.jsonSchema = schema
+	}
+}
+
+// NewTextGenerationPipeline initializes a new text generation pipeline. The end of sequence tokens are read from
+// the generation_config.json of the model if it has one, and from its config.json otherwise.
+func NewTextGenerationPipeline(config PipelineConfig[*TextGenerationPipeline], ortOptions *ort.SessionOptions) (*TextGenerationPipeline, error) {
+	pipeline := &TextGenerationPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.LengthPenalty = 1
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	if pipeline.MaxNewTokens == 0 {
+		pipeline.MaxNewTokens = 64
+	}
+	if pipeline.DraftTokens == 0 {
+		pipeline.DraftTokens = 4
+	}
+	if pipeline.PromptCacheSize > 0 {
+		pipeline.promptCache = &promptCache{maxEntries: pipeline.PromptCacheSize}
+	}
+	if pipeline.random == nil {
+		pipeline.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	// read the end of sequence tokens
+	pipelineInputConfig := TextGenerationPipelineConfig{}
+	configPath := util.PathJoinSafe(pipeline.ModelPath, "generation_config.json")
+	configBytes, err := util.ReadFileBytes(configPath)
+	if err == nil {
+		err = jsoniter.Unmarshal(configBytes, &pipelineInputConfig)
+	}
+	if err != nil || len(pipelineInputConfig.EOSTokenID) == 0 {
+		configPath = util.PathJoinSafe(pipeline.ModelPath, "config.json")
+		configBytes, err = util.ReadFileBytes(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err = jsoniter.Unmarshal(configBytes, &pipelineInputConfig); err != nil {
+			return nil, err
+		}
+	}
+	pipeline.EOSTokenIDs, err = parseTokenIDs(pipelineInputConfig.EOSTokenID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read eos_token_id from %s: %w", configPath, err)
+	}
+	constraint, err := generationConstraint(pipeline.ModelPath, pipeline.regex, pipeline.jsonSchema, pipeline.EOSTokenIDs)
+	if err != nil {
+		return nil, err
+	}
+	if constraint != nil {
+		pipeline.LogitProcessors = append(pipeline.LogitProcessors, constraint)
+	}
+
+	// onnx model init
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+
+	// init of inputs and outputs
+	inputs, outputs, err := loadInputOutputMeta(model)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = outputs
+	pipeline.presentIndex, pipeline.hasCacheBranch = presentOutputs(inputs, outputs)
+
+	// tokenizer init
+	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	if tkErr != nil {
+		return nil, tkErr
+	}
+	pipeline.Tokenizer = tk
+
+	// validate before the session is created, since the inputs of the model are not all tokenizer outputs
+	if err = pipeline.Validate(); err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+
+	// creation of the session
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := config.EngineCache.createSession(model, inputs, outputs, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	pipeline.OrtSession = session
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
+	pipeline.TokenizerTimings = &timings{}
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the logits output.
+func (p *TextGenerationPipeline) GetMetadata() PipelineMetadata {
+	for _, output := range p.OutputsMeta {
+		if output.Name == "logits" {
+			return PipelineMetadata{OutputsInfo: []OutputInfo{{Name: output.Name, Dimensions: output.Dimensions}}}
+		}
+	}
+	return PipelineMetadata{}
+}
+
+// Destroy frees the text generation pipeline resources.
+func (p *TextGenerationPipeline) Destroy() error {
+	return errors.Join(p.promptCache.destroy(), destroySession(p.Tokenizer, p.OrtSession))
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *TextGenerationPipeline) GetStats() []string {
+	stats := []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Tokenizer: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.TokenizerTimings.TotalNS),
+			p.TokenizerTimings.NumCalls,
+			time.Duration(float64(p.TokenizerTimings.TotalNS)/math.Max(1, float64(p.TokenizerTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+	if p.Draft != nil {
+		stats = append(stats, fmt.Sprintf("Speculative decoding: Draft tokens proposed=%d, Acceptance rate=%.2f",
+			atomic.LoadUint64(&p.draftProposed), p.draftAcceptanceRate()))
+	}
+	if p.promptCache != nil {
+		stats = append(stats, fmt.Sprintf("Prompt cache: Hits=%d, Misses=%d, Reused tokens=%d",
+			atomic.LoadUint64(&p.promptCache.hits), atomic.LoadUint64(&p.promptCache.misses),
+			atomic.LoadUint64(&p.promptCache.reusedTokens)))
+	}
+	return stats
+}
+
+// Validate checks that the pipeline is valid.
+func (p *TextGenerationPipeline) Validate() error {
+	var validationErrors []error
+
+	hasLogits := false
+	for _, output := range p.OutputsMeta {
+		if output.Name == "logits" {
+			hasLogits = len(output.Dimensions) == 3
+		}
+	}
+	if !hasLogits {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model must have a logits output with 3 dimensions"))
+	}
+	hasInputIDs := false
+	for i, input := range p.InputsMeta {
+		switch {
+		case input.Name == "input_ids":
+			hasInputIDs = true
+		case input.Name == "attention_mask", input.Name == "position_ids", input.Name == "use_cache_branch":
+		case strings.HasPrefix(input.Name, "past_key_values"):
+			if _, ok := p.presentIndex[i]; !ok {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: no present output for input %s", input.Name))
+			}
+			if input.DataType != ort.TensorElementDataTypeFloat {
+				validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: input %s must be float32", input.Name))
+			}
+		default:
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: input %s not recognized", input.Name))
+		}
+	}
+	if !hasInputIDs {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model must have an input_ids input"))
+	}
+	if len(p.presentIndex) == 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model has no past key values, export it with --task text-generation-with-past"))
+	}
+	if p.MaxNewTokens <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the maximum number of new tokens must be greater than zero"))
+	}
+	if p.Temperature < 0 || p.TopK < 0 || p.TopP < 0 || p.TopP > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: temperature and top k must not be negative, and top p must be between 0 and 1"))
+	}
+	if p.NumBeams < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the number of beams must not be negative"))
+	}
+	if p.PromptCacheSize < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the size of the prompt cache must not be negative"))
+	}
+	if p.DraftTokens < 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the number of draft tokens must not be negative"))
+	}
+	if p.Draft == p {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: a pipeline cannot be its own draft model"))
+	} else if p.Draft != nil {
+		validationErrors = append(validationErrors, p.validateDraft())
+	}
+	if p.NumBeams > 1 && p.Temperature > 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: beam search cannot be combined with sampling"))
+	}
+	if len(p.EOSTokenIDs) == 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: no eos_token_id in the model config"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// Preprocess tokenizes an input into the token ids of the prompt.
+func (p *TextGenerationPipeline) Preprocess(input string) ([]int64, error) {
+	return p.encodePrompt(input, true)
+}
+
+// encodePrompt tokenizes a prompt, with or without the special tokens of the tokenizer, e.g. without them for
+// prompts rendered with a chat template, which already contain them.
+func (p *TextGenerationPipeline) encodePrompt(input string, addSpecialTokens bool) ([]int64, error) {
+	start := time.Now()
+	tokenIDs, _ := p.Tokenizer.Encode(input, addSpecialTokens)
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	if len(tokenIDs) == 0 {
+		return nil, errors.New("the prompt has no tokens")
+	}
+	prompt := make([]int64, len(tokenIDs))
+	for i, id := range tokenIDs {
+		prompt[i] = int64(id)
+	}
+	return prompt, nil
+}
+
+// Forward generates tokens from the prompt until an end of sequence token, a stop sequence or MaxNewTokens
+// tokens, and returns the generated text.
+func (p *TextGenerationPipeline) Forward(prompt []int64) (string, error) {
+	settings, err := p.settings(nil)
+	if err != nil {
+		return "", err
+	}
+	return p.generate(prompt, settings)
+}
+
+// settings returns the decoding settings of a call: the settings of the pipeline, changed by the options of the
+// call.
+func (p *TextGenerationPipeline) settings(options []GenerationOption) (*generationSettings, error) {
+	settings := &generationSettings{
+		maxNewTokens:  p.MaxNewTokens,
+		temperature:   p.Temperature,
+		topK:          p.TopK,
+		topP:          p.TopP,
+		numBeams:      p.NumBeams,
+		lengthPenalty: p.LengthPenalty,
+		earlyStopping: p.EarlyStopping,
+		random:        p.random,
+		randomMutex:   &p.randomMutex,
+	}
+	return settings, settings.apply(options)
+}
+
+// generate generates the text that follows a prompt with the decoding settings of a call.
+func (p *TextGenerationPipeline) generate(prompt []int64, settings *generationSettings) (string, error) {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	var text string
+	var err error
+	switch {
+	case settings.numBeams > 1:
+		text, err = p.generateBeams(prompt, settings)
+	case p.Draft != nil:
+		text, err = p.generateSpeculative(prompt, settings)
+	default:
+		text, err = p.generateTokens(prompt, settings)
+	}
+	if err != nil {
+		return "", err
+	}
+	p.PipelineMemory.recordForward(usageBefore, nil)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return text, nil
+}
+
+// generateTokens generates the tokens that follow a prompt one at a time, greedily or by sampling.
+func (p *TextGenerationPipeline) generateTokens(prompt []int64, settings *generationSettings) (text string, err error) {
+	cache, err := p.startCache(prompt)
+	if err != nil {
+		return "", err
+	}
+	sequence := append([]int64{}, prompt...) // the prompt and the generated tokens
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, cache.destroy())
+			return
+		}
+		err = p.endCache(cache, sequence)
+	}()
+
+	processors := settings.processors(p.LogitProcessors)
+	var generated []uint32
+	stopped := false
+	tokenIDs := prompt[cache.tokens:]
+	for step := 0; step < settings.maxNewTokens && !stopped; step++ {
+		logits, stepErr := p.step(cache, tokenIDs)
+		if stepErr != nil {
+			return "", stepErr
+		}
+		if processErr := processLogits(processors, prompt, generated, logits); processErr != nil {
+			return "", processErr
+		}
+		next, tokenErr := settings.pickToken(logits)
+		if tokenErr != nil {
+			return "", tokenErr
+		}
+		if p.EOSTokenIDs[int64(next)] {
+			break
+		}
+		generated = append(generated, uint32(next))
+		sequence = append(sequence, int64(next))
+		if len(p.StopSequences) > 0 {
+			text, stopped = p.stopText(p.Tokenizer.Decode(generated, true))
+		}
+		tokenIDs = []int64{int64(next)}
+	}
+	if !stopped {
+		text = p.Tokenizer.Decode(generated, true)
+	}
+	return text, nil
+}
+
+// generateBeams generates the text that follows a prompt with beam search. Each beam is run on its own cache, and
+// the cache of a beam extended by several beams of the next step is copied. Beams are not stopped by the stop
+// sequences, which only truncate the best hypothesis.
+func (p *TextGenerationPipeline) generateBeams(prompt []int64, settings *generationSettings) (text string, err error) {
+	search := newBeamSearch(settings)
+	caches := make([]*kvCache, settings.numBeams)
+	if caches[0], err = p.startCache(prompt); err != nil {
+		return "", err
+	}
+	defer func() {
+		for _, cache := range caches {
+			if cache != nil {
+				err = errors.Join(err, cache.destroy())
+			}
+		}
+	}()
+
+	processors := settings.processors(p.LogitProcessors)
+	for step := 0; step < settings.maxNewTokens && !search.done; step++ {
+		logits := make([][]float32, len(search.beams))
+		for i, b := range search.beams {
+			if !b.active() {
+				continue
+			}
+			tokenIDs := prompt[caches[i].tokens:]
+			if step > 0 {
+				tokenIDs = []int64{int64(b.tokens[len(b.tokens)-1])}
+			}
+			stepLogits, stepErr := p.step(caches[i], tokenIDs)
+			if stepErr != nil {
+				return "", stepErr
+			}
+			if processErr := processLogits(processors, prompt, b.tokens, stepLogits); processErr != nil {
+				return "", processErr
+			}
+			logits[i] = stepLogits
+		}
+		if err = search.advance(logits, p.EOSTokenIDs); err != nil {
+			return "", err
+		}
+		if caches, err = p.reorderCaches(caches, search.beams); err != nil {
+			return "", err
+		}
+	}
+	text = p.Tokenizer.Decode(search.best(), true)
+	if len(p.StopSequences) > 0 {
+		text, _ = p.stopText(text)
+	}
+	return text, nil
+}
+
+// reorderCaches returns the caches of the new beams of beam search: the cache of the beam each one extends, copied
+// for all but the first beam extending it. The caches of the beams that are not extended are destroyed.
+func (p *TextGenerationPipeline) reorderCaches(caches []*kvCache, beams []beam) ([]*kvCache, error) {
+	reordered := make([]*kvCache, len(beams))
+	used := make([]bool, len(caches))
+	var err error
+	for i, b := range beams {
+		if !b.active() {
+			continue
+		}
+		if !used[b.parent] {
+			reordered[i] = caches[b.parent]
+			used[b.parent] = true
+			continue
+		}
+		if reordered[i], err = caches[b.parent].clone(); err != nil {
+			break
+		}
+	}
+	for i, cache := range caches {
+		if cache != nil && !used[i] {
+			err = errors.Join(err, cache.destroy())
+		}
+	}
+	if err != nil {
+		for _, cache := range reordered {
+			if cache != nil {
+				err = errors.Join(err, cache.destroy())
+			}
+		}
+		return make([]*kvCache, len(beams)), err
+	}
+	return reordered, nil
+}
+
+// stopText returns the text up to the first stop sequence it contains, if any.
+func (p *TextGenerationPipeline) stopText(text string) (string, bool) {
+	end := -1
+	for _, stopSequence := range p.StopSequences {
+		if index := strings.Index(text, stopSequence); stopSequence != "" && index >= 0 && (end < 0 || index < end) {
+			end = index
+		}
+	}
+	if end < 0 {
+		return text, false
+	}
+	return text[:end], true
+}
+
+// step runs the model on the new tokens of a sequence, replaces the past key values of the cache with the present
+// ones, and returns the logits of the last token.
+func (p *TextGenerationPipeline) step(cache *kvCache, tokenIDs []int64) ([]float32, error) {
+	logits, err := p.stepPositions(cache, tokenIDs, 1)
+	if err != nil {
+		return nil, err
+	}
+	return logits[0], nil
+}
+
+// stepPositions is like step, and returns the logits of the last positions tokens, e.g. to verify the tokens
+// proposed by a draft model.
+func (p *TextGenerationPipeline) stepPositions(cache *kvCache, tokenIDs []int64, positions int) ([][]float32, error) {
+	var tensors []ort.Value
+	defer func() {
+		for _, tensor := range tensors {
+			_ = tensor.Destroy()
+		}
+	}()
+
+	firstStep := len(cache.past) == 0
+	if firstStep {
+		if err := p.initCache(cache); err != nil {
+			return nil, err
+		}
+	}
+	// merged decoders ignore the past key values on the first step
+	usePast := !(firstStep && p.hasCacheBranch)
+	n := len(tokenIDs)
+	maskLength := n
+	if usePast {
+		maskLength += cache.length
+	}
+	attentionMask := make([]int64, maskLength)
+	for i := range attentionMask {
+		attentionMask[i] = 1
+	}
+	if usePast && cache.dummy {
+		attentionMask[0] = 0
+	}
+	positionIDs := make([]int64, n)
+	for i := range positionIDs {
+		positionIDs[i] = int64(cache.tokens + i)
+	}
+
+	inputTensors := make([]ort.Value, len(p.InputsMeta))
+	for i, meta := range p.InputsMeta {
+		var tensor ort.Value
+		var err error
+		switch meta.Name {
+		case "input_ids":
+			tensor, err = ort.NewTensor(ort.NewShape(1, int64(n)), tokenIDs)
+		case "attention_mask":
+			tensor, err = ort.NewTensor(ort.NewShape(1, int64(maskLength)), attentionMask)
+		case "position_ids":
+			tensor, err = ort.NewTensor(ort.NewShape(1, int64(n)), positionIDs)
+		case "use_cache_branch":
+			useCacheBranch := []byte{0}
+			if usePast {
+				useCacheBranch[0] = 1
+			}
+			tensor, err = ort.NewCustomDataTensor(ort.NewShape(1), useCacheBranch, ort.TensorElementDataTypeBool)
+		default:
+			inputTensors[i] = cache.past[i]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tensors = append(tensors, tensor)
+		inputTensors[i] = tensor
+	}
+
+	outputTensors := make([]ort.Value, len(p.OutputsMeta))
+	if err := p.OrtSession.Run(inputTensors, outputTensors); err != nil {
+		return nil, err
+	}
+
+	// the present key values become the past key values of the next step
+	isPresent := map[int]bool{}
+	for inputIndex, outputIndex := range p.presentIndex {
+		tensors = append(tensors, cache.past[inputIndex])
+		cache.past[inputIndex] = outputTensors[outputIndex]
+		isPresent[outputIndex] = true
+	}
+	cache.length = maskLength
+	cache.dummy = usePast && cache.dummy
+	cache.tokens += n
+
+	var logits [][]float32
+	for i, output := range outputTensors {
+		if isPresent[i] {
+			continue
+		}
+		tensors = append(tensors, output)
+		if p.OutputsMeta[i].Name != "logits" {
+			continue
+		}
+		logitsTensor, ok := output.(*ort.Tensor[float32])
+		if !ok {
+			return nil, errors.New("the logits are not a float32 tensor")
+		}
+		shape := logitsTensor.GetShape()
+		if int(shape[1]) < positions {
+			return nil, fmt.Errorf("the model returned the logits of %d positions, %d are needed", shape[1], positions)
+		}
+		vocabularySize := int(shape[2])
+		data := logitsTensor.GetData()
+		for position := positions; position > 0; position-- {
+			start := len(data) - position*vocabularySize
+			logits = append(logits, append([]float32{}, data[start:start+vocabularySize]...))
+		}
+	}
+	if len(logits) == 0 {
+		return nil, errors.New("the model has no logits output")
+	}
+	return logits, nil
+}
+
+// initCache creates the past key values of the first step, with a single dummy position.
+func (p *TextGenerationPipeline) initCache(cache *kvCache) error {
+	for inputIndex := range p.presentIndex {
+		dimensions := p.InputsMeta[inputIndex].Dimensions
+		shape := make([]int64, len(dimensions))
+		for i, dimension := range dimensions {
+			// the dynamic dimensions are the batch size and the past sequence length, both 1
+			shape[i] = max(dimension, 1)
+		}
+		tensor, err := ort.NewEmptyTensor[float32](ort.NewShape(shape...))
+		if err != nil {
+			return err
+		}
+		cache.past[inputIndex] = tensor
+	}
+	cache.length = 1
+	cache.dummy = !p.hasCacheBranch
+	return nil
+}
+
+// Postprocess trims the generated texts.
+func (p *TextGenerationPipeline) Postprocess(texts []string) (*TextGenerationOutput, error) {
+	output := &TextGenerationOutput{GeneratedTexts: make([]string, len(texts))}
+	for i, text := range texts {
+		output.GeneratedTexts[i] = strings.TrimSpace(text)
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *TextGenerationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete text generation output type rather than the interface.
+func (p *TextGenerationPipeline) RunPipeline(inputs []string) (*TextGenerationOutput, error) {
+	return p.RunWithOptions(inputs)
+}
+
+// RunWithOptions is like RunPipeline, with decoding options for this call only, e.g.
+// GenerateWithTemperature(0.7) and GenerateWithSeed(42).
+func (p *TextGenerationPipeline) RunWithOptions(inputs []string, options ...GenerationOption) (*TextGenerationOutput, error) {
+	settings, err := p.settings(options)
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, len(inputs))
+	for i, input := range inputs {
+		prompt, preprocessErr := p.Preprocess(input)
+		if preprocessErr != nil {
+			return nil, fmt.Errorf("input %d: %w", i, preprocessErr)
+		}
+		texts[i], err = p.generate(prompt, settings)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p.Postprocess(texts)
+}
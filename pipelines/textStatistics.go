@@ -0,0 +1,111 @@
+package pipelines
+
+import (
+	"errors"
+
+	"github.com/daulet/tokenizers"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// TextStatisticsPipeline computes the surface statistics and readability scores of its inputs and attaches them
+// to the outputs of a pipeline, so that the outputs can be filtered downstream on length or reading level. Token
+// counts are computed with Tokenizer, usually the tokenizer of the wrapped pipeline, without special tokens. With Skip,
+// inputs can also be filtered before they are run through the pipeline.
+type TextStatisticsPipeline struct {
+	Pipeline  Pipeline
+	Tokenizer *tokenizers.Tokenizer          // optional, token counts are 0 without a tokenizer
+	Skip      func(util.TextStatistics) bool // optional, inputs for which Skip returns true are not run through the pipeline
+}
+
+// AnnotatedOutput is the output of an input of a TextStatisticsPipeline.
+type AnnotatedOutput struct {
+	Statistics util.TextStatistics // statistics of the input
+	Skipped    bool                // whether the input was not run through the pipeline
+	Output     any                 // output of the pipeline for the input, nil if it was skipped
+}
+
+type TextStatisticsOutput struct {
+	Outputs []AnnotatedOutput
+}
+
+func (t *TextStatisticsOutput) GetOutput() []any {
+	out := make([]any, len(t.Outputs))
+	for i, output := range t.Outputs {
+		out[i] = any(output)
+	}
+	return out
+}
+
+// NewTextStatisticsPipeline creates a pipeline annotating the outputs of the pipeline with the statistics of their
+// inputs, counting tokens with the tokenizer, e.g. classifier.Tokenizer for a text classification pipeline.
+func NewTextStatisticsPipeline(pipeline Pipeline, tokenizer *tokenizers.Tokenizer) (*TextStatisticsPipeline, error) {
+	statistics := &TextStatisticsPipeline{
+		Pipeline:  pipeline,
+		Tokenizer: tokenizer,
+	}
+	if err := statistics.Validate(); err != nil {
+		return nil, err
+	}
+	return statistics, nil
+}
+
+// Run the pipeline on a batch of strings.
+func (p *TextStatisticsPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete text statistics output type rather than the interface.
+func (p *TextStatisticsPipeline) RunPipeline(inputs []string) (*TextStatisticsOutput, error) {
+	result := &TextStatisticsOutput{Outputs: make([]AnnotatedOutput, len(inputs))}
+	var modelInputs []string
+	var modelIndices []int
+	for i, input := range inputs {
+		statistics := util.ComputeTextStatistics(input)
+		if p.Tokenizer != nil {
+			ids, _ := p.Tokenizer.Encode(input, false)
+			statistics.Tokens = len(ids)
+		}
+		result.Outputs[i].Statistics = statistics
+		if p.Skip != nil && p.Skip(statistics) {
+			result.Outputs[i].Skipped = true
+			continue
+		}
+		modelInputs = append(modelInputs, input)
+		modelIndices = append(modelIndices, i)
+	}
+	if len(modelInputs) == 0 {
+		return result, nil
+	}
+	output, err := p.Pipeline.Run(modelInputs)
+	if err != nil {
+		return nil, err
+	}
+	for i, modelOutput := range output.GetOutput() {
+		result.Outputs[modelIndices[i]].Output = modelOutput
+	}
+	return result, nil
+}
+
+// GetStats returns the runtime statistics of the wrapped pipeline.
+func (p *TextStatisticsPipeline) GetStats() []string {
+	return p.Pipeline.GetStats()
+}
+
+// GetMetadata returns the metadata of the wrapped pipeline.
+func (p *TextStatisticsPipeline) GetMetadata() PipelineMetadata {
+	return p.Pipeline.GetMetadata()
+}
+
+// Validate checks that there is a pipeline to wrap.
+func (p *TextStatisticsPipeline) Validate() error {
+	if p.Pipeline == nil {
+		return errors.New("pipeline configuration invalid: a pipeline to annotate is required")
+	}
+	return nil
+}
+
+// Destroy does nothing, since the wrapped pipeline is destroyed with its session.
+func (p *TextStatisticsPipeline) Destroy() error {
+	return nil
+}
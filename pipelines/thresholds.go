@@ -0,0 +1,96 @@
+package pipelines
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// ThresholdsFile is the file of a model directory with the decision thresholds of a multi-label text classification
+// model, which text classification pipelines load when they are created.
+const ThresholdsFile = "thresholds.json"
+
+// LabelThresholds are the decision thresholds of the labels of a multi-label model, e.g. tuned on a validation set
+// for the F1 score of each label, as in {"threshold": 0.5, "thresholds": {"toxic": 0.3, "threat": 0.15}}.
+type LabelThresholds struct {
+	Threshold  float32            `json:"threshold"`  // threshold of the labels without one
+	Thresholds map[string]float32 `json:"thresholds"` // threshold of each label
+}
+
+// LoadThresholds reads the decision thresholds of the model at modelPath, which may be on S3. It returns nil if the
+// model directory has no ThresholdsFile.
+func LoadThresholds(modelPath string) (*LabelThresholds, error) {
+	path := util.PathJoinSafe(modelPath, ThresholdsFile)
+	exists, err := util.FileExists(path)
+	if err != nil || !exists {
+		return nil, err
+	}
+	thresholdsBytes, err := util.ReadFileBytes(path)
+	if err != nil {
+		return nil, err
+	}
+	thresholds := &LabelThresholds{}
+	if err = json.Unmarshal(thresholdsBytes, thresholds); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return thresholds, nil
+}
+
+// thresholded returns whether the pipeline only returns the labels whose score reaches their threshold, which the
+// classifiers of presets never do.
+func (p *TextClassificationPipeline) thresholded() bool {
+	return !p.allLabels && p.ProblemType == "multiLabel" && (len(p.Thresholds) > 0 || p.Threshold != 0)
+}
+
+// threshold returns the decision threshold of a label.
+func (p *TextClassificationPipeline) threshold(label string) float32 {
+	if threshold, ok := p.Thresholds[label]; ok {
+		return threshold
+	}
+	return p.Threshold
+}
+
+// applyThresholds returns the classification outputs of an input whose score reaches the threshold of their label,
+// and their scores.
+func (p *TextClassificationPipeline) applyThresholds(classes []ClassificationOutput, scores []float64) ([]ClassificationOutput, []float64) {
+	kept := make([]ClassificationOutput, 0, len(classes))
+	keptScores := make([]float64, 0, len(classes))
+	for j, class := range classes {
+		if class.Score >= p.threshold(class.Label) {
+			kept = append(kept, class)
+			keptScores = append(keptScores, scores[j])
+		}
+	}
+	return kept, keptScores
+}
+
+// validateThresholds checks that the thresholds are for labels of the model or of its taxonomy, and that they are
+// probabilities if the scores are.
+func (p *TextClassificationPipeline) validateThresholds() error {
+	isLabel := map[string]bool{}
+	for _, label := range p.IDLabelMap {
+		isLabel[label] = true
+	}
+	if p.Taxonomy != nil {
+		for label, parent := range p.Taxonomy.Parents {
+			isLabel[label] = true
+			isLabel[parent] = true
+		}
+	}
+	probabilities := p.AggregationFunctionName == "SOFTMAX" || p.AggregationFunctionName == "SIGMOID"
+	var validationErrors []error
+	for label, threshold := range p.Thresholds {
+		if !isLabel[label] {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: label %s of the thresholds is not a label of the model", label))
+		}
+		if probabilities && (threshold < 0 || threshold > 1) {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: threshold %f of label %s is not between 0 and 1", threshold, label))
+		}
+	}
+	if probabilities && (p.Threshold < 0 || p.Threshold > 1) {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: threshold %f is not between 0 and 1", p.Threshold))
+	}
+	return errors.Join(validationErrors...)
+}
@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"regexp"
 	"slices"
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/daulet/tokenizers"
 	ort "github.com/yalue/onnxruntime_go"
@@ -24,6 +26,9 @@ type TokenClassificationPipeline struct {
 	IDLabelMap          map[int]string
 	AggregationStrategy string
 	IgnoreLabels        []string
+	LabelMapping        map[string]string
+	EntityRules         []EntityRule
+	ruleMatchers        []*regexp.Regexp
 }
 
 type TokenClassificationPipelineConfig struct {
@@ -37,11 +42,21 @@ type Entity struct {
 	Index     int
 	Word      string
 	TokenID   uint32
-	Start     uint
-	End       uint
+	Start     uint // byte offset of the entity in the input
+	End       uint // byte offset of the end of the entity in the input
 	IsSubword bool
 }
 
+// EntityRule finds entities that the model may miss, such as domain-specific identifiers, using a
+// dictionary of terms and/or a regular expression.
+type EntityRule struct {
+	Label           string   // the entity label of the matches
+	Terms           []string // terms to match as whole words
+	CaseInsensitive bool     // whether the terms are matched case-insensitively
+	Pattern         string   // regular expression to match
+	Override        bool     // whether matches replace overlapping model entities, rather than only filling gaps
+}
+
 type TokenClassificationOutput struct {
 	Entities [][]Entity
 }
@@ -79,6 +94,27 @@ func WithIgnoreLabels(ignoreLabels []string) PipelineOption[*TokenClassification
 	}
 }
 
+// WithLabelMapping maps the labels predicted by the model to a user-defined schema, so that switching
+// models does not affect downstream consumers. Keys can be entity types (e.g. "PER": "PERSON"), which
+// also map the B-/I- labels of the type, or full labels (e.g. "B-PER": "PERSON"). The mapping is
+// applied during aggregation, after the model labels have been used to group tokens into entities.
+// Labels mapped to one of the ignore labels are filtered out of the output.
+func WithLabelMapping(mapping map[string]string) PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.LabelMapping = mapping
+	}
+}
+
+// WithEntityRules merges the entities found by the model with the matches of user-provided dictionaries
+// and regular expressions. When matches of different rules overlap, the longest match wins, and the rule
+// that comes first for matches of equal length. A match overlapping a model entity replaces it if its
+// rule has Override set, and is discarded otherwise. Rule matches have a score of 1.
+func WithEntityRules(rules []EntityRule) PipelineOption[*TokenClassificationPipeline] {
+	return func(pipeline *TokenClassificationPipeline) {
+		pipeline.EntityRules = rules
+	}
+}
+
 // NewTokenClassificationPipeline Initializes a feature extraction pipeline.
 func NewTokenClassificationPipeline(config PipelineConfig[*TokenClassificationPipeline], ortOptions *ort.SessionOptions) (*TokenClassificationPipeline, error) {
 	pipeline := &TokenClassificationPipeline{}
@@ -86,12 +122,14 @@ func NewTokenClassificationPipeline(config PipelineConfig[*TokenClassificationPi
 	pipeline.PipelineName = config.Name
 	pipeline.OrtOptions = ortOptions
 	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.Remote = config.Remote
 	for _, o := range config.Options {
 		o(pipeline)
 	}
 
 	// onnx model init
-	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename)
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +156,12 @@ func NewTokenClassificationPipeline(config PipelineConfig[*TokenClassificationPi
 	}
 	pipeline.IDLabelMap = pipelineInputConfig.IDLabelMap
 
+	// compile the entity rules
+	pipeline.ruleMatchers, err = compileEntityRules(pipeline.EntityRules)
+	if err != nil {
+		return nil, err
+	}
+
 	// default strategies if not set
 	if pipeline.AggregationStrategy == "" {
 		pipeline.AggregationStrategy = "SIMPLE"
@@ -127,6 +171,7 @@ func NewTokenClassificationPipeline(config PipelineConfig[*TokenClassificationPi
 	}
 
 	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
 	pipeline.TokenizerTimings = &timings{}
 
 	// tokenizer init
@@ -146,7 +191,9 @@ func NewTokenClassificationPipeline(config PipelineConfig[*TokenClassificationPi
 	pipeline.Tokenizer = tk
 
 	// creation of the session. Only one output (either token or sentence embedding).
-	session, err := createSession(model, inputs, outputs, ortOptions)
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := pipeline.createSession(config.EngineCache, model, inputs, outputs, ortOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -191,6 +238,7 @@ func (p *TokenClassificationPipeline) GetStats() []string {
 			time.Duration(p.PipelineTimings.TotalNS),
 			p.PipelineTimings.NumCalls,
 			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
 	}
 }
 
@@ -227,10 +275,12 @@ func (p *TokenClassificationPipeline) Preprocess(batch *PipelineBatch, inputs []
 // Forward performs the forward inference of the pipeline.
 func (p *TokenClassificationPipeline) Forward(batch *PipelineBatch) error {
 	start := time.Now()
-	err := runSessionOnBatch(batch, p.OrtSession, p.OutputsMeta)
+	usageBefore := memoryUsageBefore()
+	err := p.runOnBatch(batch, p.OutputsMeta)
 	if err != nil {
 		return err
 	}
+	p.PipelineMemory.recordForward(usageBefore, batch)
 	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
 	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
 	return nil
@@ -301,6 +351,9 @@ func (p *TokenClassificationPipeline) Postprocess(batch *PipelineBatch) (*TokenC
 				filteredEntities = append(filteredEntities, e)
 			}
 		}
+		if len(p.EntityRules) > 0 {
+			filteredEntities = p.applyEntityRules(input.Raw, filteredEntities)
+		}
 		classificationOutput.Entities[i] = filteredEntities
 	}
 	return &classificationOutput, nil
@@ -350,7 +403,7 @@ func (p *TokenClassificationPipeline) Aggregate(input tokenizedInput, preEntitie
 			}
 			label, ok := p.IDLabelMap[entityIdx]
 			if !ok {
-				return nil, fmt.Errorf("could not determine entity type for input %s, predicted entity index %d", input.Raw, entityIdx)
+				return nil, fmt.Errorf("could not determine entity type for input %s, predicted entity index %d", util.Redact(input.Raw), entityIdx)
 			}
 			entities[i] = Entity{
 				Entity:  label,
@@ -366,11 +419,27 @@ func (p *TokenClassificationPipeline) Aggregate(input tokenizedInput, preEntitie
 		return nil, errors.New("aggregation strategies other than SIMPLE and NONE are not implemented")
 	}
 	if p.AggregationStrategy == "NONE" {
+		for i := range entities {
+			entities[i].Entity = p.mapLabel(entities[i].Entity)
+		}
 		return entities, nil
 	}
 	return p.GroupEntities(entities)
 }
 
+// mapLabel maps a token label predicted by the model to the user-defined label schema.
+func (p *TokenClassificationPipeline) mapLabel(label string) string {
+	if mapped, ok := p.LabelMapping[label]; ok {
+		return mapped
+	}
+	if strings.HasPrefix(label, "B-") || strings.HasPrefix(label, "I-") {
+		if mapped, ok := p.LabelMapping[label[2:]]; ok {
+			return label[:2] + mapped
+		}
+	}
+	return label
+}
+
 func (p *TokenClassificationPipeline) getTag(entityName string) (string, string) {
 	var bi string
 	var tag string
@@ -396,6 +465,11 @@ func (p *TokenClassificationPipeline) groupSubEntities(entities []Entity) Entity
 	} else {
 		entityType = strings.Join(splits[1:], "-")
 	}
+	if mapped, ok := p.LabelMapping[entityType]; ok {
+		entityType = mapped
+	} else if mapped, ok := p.LabelMapping[entities[0].Entity]; ok {
+		entityType = mapped
+	}
 	scores := make([]float32, len(entities))
 	tokens := make([]uint32, len(entities))
 	for i, s := range entities {
@@ -445,6 +519,118 @@ func (p *TokenClassificationPipeline) GroupEntities(entities []Entity) ([]Entity
 	return entityGroups, nil
 }
 
+func compileEntityRules(rules []EntityRule) ([]*regexp.Regexp, error) {
+	matchers := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		var alternatives []string
+		if len(rule.Terms) > 0 {
+			// longer terms first, so that the longest term matches when terms share a prefix
+			terms := slices.Clone(rule.Terms)
+			slices.SortFunc(terms, func(a, b string) int { return len(b) - len(a) })
+			quoted := make([]string, len(terms))
+			for j, term := range terms {
+				quoted[j] = regexp.QuoteMeta(term)
+			}
+			termsPattern := `\b(?:` + strings.Join(quoted, "|") + `)\b`
+			if rule.CaseInsensitive {
+				termsPattern = "(?i)" + termsPattern
+			}
+			alternatives = append(alternatives, termsPattern)
+		}
+		if rule.Pattern != "" {
+			alternatives = append(alternatives, rule.Pattern)
+		}
+		if len(alternatives) == 0 {
+			return nil, fmt.Errorf("entity rule for label %s has neither terms nor a pattern", rule.Label)
+		}
+		matcher, err := regexp.Compile("(?:" + strings.Join(alternatives, ")|(?:") + ")")
+		if err != nil {
+			return nil, fmt.Errorf("entity rule for label %s is invalid: %w", rule.Label, err)
+		}
+		matchers[i] = matcher
+	}
+	return matchers, nil
+}
+
+type ruleMatch struct {
+	entity   Entity
+	rule     int
+	override bool
+}
+
+func overlaps(a, b Entity) bool {
+	return a.Start < b.End && b.Start < a.End
+}
+
+// applyEntityRules merges the rule matches in text with the entities predicted by the model.
+func (p *TokenClassificationPipeline) applyEntityRules(text string, entities []Entity) []Entity {
+	var candidates []ruleMatch
+	for i, matcher := range p.ruleMatchers {
+		for _, loc := range matcher.FindAllStringIndex(text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			candidates = append(candidates, ruleMatch{
+				entity: Entity{
+					Entity: p.EntityRules[i].Label,
+					Score:  1,
+					Word:   text[loc[0]:loc[1]],
+					Start:  uint(loc[0]),
+					End:    uint(loc[1]),
+				},
+				rule:     i,
+				override: p.EntityRules[i].Override,
+			})
+		}
+	}
+
+	// resolve conflicts between rules: longest match first, then rule order
+	slices.SortStableFunc(candidates, func(a, b ruleMatch) int {
+		lengthA, lengthB := a.entity.End-a.entity.Start, b.entity.End-b.entity.Start
+		if lengthA != lengthB {
+			return int(lengthB) - int(lengthA)
+		}
+		return a.rule - b.rule
+	})
+	var accepted []ruleMatch
+	for _, candidate := range candidates {
+		if !slices.ContainsFunc(accepted, func(m ruleMatch) bool { return overlaps(m.entity, candidate.entity) }) {
+			accepted = append(accepted, candidate)
+		}
+	}
+
+	// resolve conflicts with the model entities, whose offsets come from the tokenizer
+	var kept []Entity
+	for _, e := range entities {
+		e.Start, e.End = characterSpan(text, e.Start, e.End)
+		if !slices.ContainsFunc(accepted, func(m ruleMatch) bool { return m.override && overlaps(m.entity, e) }) {
+			kept = append(kept, e)
+		}
+	}
+	merged := slices.Clone(kept)
+	for _, m := range accepted {
+		if m.override || !slices.ContainsFunc(kept, func(e Entity) bool { return overlaps(m.entity, e) }) {
+			merged = append(merged, m.entity)
+		}
+	}
+	slices.SortStableFunc(merged, func(a, b Entity) int { return int(a.Start) - int(b.Start) })
+	return merged
+}
+
+// characterSpan returns the byte offsets of a span of text widened to the characters it overlaps, so that the
+// offsets of the tokens of byte-level tokenizers, which can split a multi-byte character, are compared with
+// the offsets of the rule matches on the same character boundaries.
+func characterSpan(text string, start uint, end uint) (uint, uint) {
+	first, last := min(int(start), len(text)), min(int(end), len(text))
+	for first > 0 && first < len(text) && !utf8.RuneStart(text[first]) {
+		first--
+	}
+	for last < len(text) && !utf8.RuneStart(text[last]) {
+		last++
+	}
+	return uint(first), uint(last)
+}
+
 // Run the pipeline on a string batch.
 func (p *TokenClassificationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
 	return p.RunPipeline(inputs)
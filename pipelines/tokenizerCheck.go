@@ -0,0 +1,236 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/daulet/tokenizers"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// TokenizerIssueKind is a kind of issue found by CheckTokenizer.
+type TokenizerIssueKind string
+
+const (
+	LossyDecoding     TokenizerIssueKind = "LOSSY_DECODING"     // characters missing from the decoded text, beyond case and whitespace
+	UnknownCharacters TokenizerIssueKind = "UNKNOWN_CHARACTERS" // characters encoded as the unknown token of the model
+	OffsetDrift       TokenizerIssueKind = "OFFSET_DRIFT"       // token offsets outside of the text, inside a character, or going backwards
+)
+
+// maxTokenizerIssueExamples is the number of issues of each kind kept as examples in a TokenizerReport.
+const maxTokenizerIssueExamples = 10
+
+// TokenizerIssue is an issue found in a text of the corpus checked by CheckTokenizer.
+type TokenizerIssue struct {
+	Kind   TokenizerIssueKind
+	Text   int // index of the text in the corpus
+	Start  int // byte offset of the span of the text with the issue
+	End    int // byte offset of the end of the span of the text with the issue
+	Detail string
+}
+
+// ProblemCharacter is a character of the corpus involved in issues of a kind.
+type ProblemCharacter struct {
+	Character rune
+	Kind      TokenizerIssueKind
+	Count     int
+}
+
+// String returns the character with its code point, e.g. é (U+00E9).
+func (c ProblemCharacter) String() string {
+	return fmt.Sprintf("%c (%U)", c.Character, c.Character)
+}
+
+// TokenizerReport is the result of encoding and decoding a corpus with the tokenizer of a model.
+type TokenizerReport struct {
+	Texts                int
+	Tokens               int
+	ExactRoundTrips      int                // texts given back exactly by decoding their tokens
+	NormalizedRoundTrips int                // texts given back up to case and whitespace, as expected from uncased or WordPiece tokenizers
+	LossyTexts           int                // texts with characters missing from their decoded text
+	UnknownTokens        int                // tokens that are the unknown token of the model
+	OffsetErrors         int                // tokens with offsets that do not map to the characters of the text
+	Characters           []ProblemCharacter // the characters involved in issues, most frequent first
+	Examples             []TokenizerIssue   // the first issues of each kind, in the order of the corpus
+}
+
+// HasIssues returns whether a text of the corpus is not given back by decoding, up to case and whitespace, or has
+// unknown tokens or wrong offsets.
+func (r *TokenizerReport) HasIssues() bool {
+	return r.LossyTexts > 0 || r.UnknownTokens > 0 || r.OffsetErrors > 0
+}
+
+// String returns a summary of the report, with the problem characters and the example issues.
+func (r *TokenizerReport) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Tokenizer report on %d texts, %d tokens\n", r.Texts, r.Tokens))
+	sb.WriteString(fmt.Sprintf("Round trips: exact=%d, normalized=%d, lossy=%d\n", r.ExactRoundTrips, r.NormalizedRoundTrips, r.LossyTexts))
+	sb.WriteString(fmt.Sprintf("Unknown tokens=%d, offset errors=%d\n", r.UnknownTokens, r.OffsetErrors))
+	for _, character := range r.Characters {
+		sb.WriteString(fmt.Sprintf("%s %s: %d\n", character.Kind, character, character.Count))
+	}
+	for _, issue := range r.Examples {
+		sb.WriteString(fmt.Sprintf("%s in text %d at %d-%d: %s\n", issue.Kind, issue.Text, issue.Start, issue.End, issue.Detail))
+	}
+	return sb.String()
+}
+
+// CheckTokenizer encodes and decodes a corpus, e.g. a sample of production inputs, with the tokenizer.json of the
+// model at modelPath, to find the characters that the model does not see as they are written before they cause
+// silent errors: characters lost by normalization or decoding, such as accents stripped by uncased models,
+// characters outside of the vocabulary, which the model only sees as the unknown token, and token offsets that do
+// not map to the characters of the text, which would shift the spans of entities and answers. Texts are not
+// truncated, and the example issues only quote texts through util.Redact.
+func CheckTokenizer(modelPath string, texts []string) (*TokenizerReport, error) {
+	if len(texts) == 0 {
+		return nil, errors.New("no texts to check the tokenizer with")
+	}
+	tk, err := loadTokenizerWithoutTruncation(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tk.Close()
+	}()
+	// models without an unknown token, e.g. with byte-level tokenizers, cannot have unknown characters
+	unknownToken, _ := readSpecialToken(modelPath, "unk_token")
+
+	checker := newTokenizerChecker(unknownToken)
+	for i, text := range texts {
+		encoding := tk.EncodeWithOptions(text, false, tokenizers.WithReturnOffsets(), tokenizers.WithReturnTokens())
+		checker.check(i, text, encoding, tk.Decode(encoding.IDs, true))
+	}
+	return checker.report(), nil
+}
+
+// tokenizerChecker accumulates the issues of the texts of a corpus.
+type tokenizerChecker struct {
+	unknownToken string
+	result       TokenizerReport
+	characters   map[ProblemCharacter]int // counts by character and kind, with a zero Count
+	examples     map[TokenizerIssueKind]int
+}
+
+func newTokenizerChecker(unknownToken string) *tokenizerChecker {
+	return &tokenizerChecker{unknownToken: unknownToken, characters: map[ProblemCharacter]int{}, examples: map[TokenizerIssueKind]int{}}
+}
+
+// check adds the issues of a text, given its encoding without special tokens and its decoded text.
+func (c *tokenizerChecker) check(index int, text string, encoding tokenizers.Encoding, decoded string) {
+	c.result.Texts++
+	c.result.Tokens += len(encoding.IDs)
+
+	switch {
+	case decoded == text:
+		c.result.ExactRoundTrips++
+	case foldText(decoded) == foldText(text):
+		c.result.NormalizedRoundTrips++
+	default:
+		lost := lostCharacters(text, decoded)
+		if len(lost) == 0 {
+			// the same characters in another order, or with characters added by decoding
+			c.result.NormalizedRoundTrips++
+			break
+		}
+		c.result.LossyTexts++
+		first := len(text)
+		for r, count := range lost {
+			c.characters[ProblemCharacter{Character: r, Kind: LossyDecoding}] += count
+			if position := strings.IndexFunc(text, func(t rune) bool { return unicode.ToLower(t) == r }); position >= 0 {
+				first = min(first, position)
+			}
+		}
+		end := first
+		if first < len(text) {
+			_, size := utf8.DecodeRuneInString(text[first:])
+			end += size
+		}
+		c.addExample(TokenizerIssue{Kind: LossyDecoding, Text: index, Start: first, End: end,
+			Detail: fmt.Sprintf("%s is decoded as %s", util.Redact(text), util.Redact(decoded))})
+	}
+
+	previousStart := 0
+	for i, offset := range encoding.Offsets {
+		start, end := int(offset[0]), int(offset[1])
+		if start > end || end > len(text) || !isCharacterBoundary(text, start) || !isCharacterBoundary(text, end) || start < previousStart {
+			c.result.OffsetErrors++
+			c.addExample(TokenizerIssue{Kind: OffsetDrift, Text: index, Start: start, End: end,
+				Detail: fmt.Sprintf("token %d has offsets %d-%d in a text of %d bytes", i, start, end, len(text))})
+			continue
+		}
+		previousStart = start
+		if c.unknownToken != "" && i < len(encoding.Tokens) && encoding.Tokens[i] == c.unknownToken {
+			c.result.UnknownTokens++
+			for _, r := range text[start:end] {
+				c.characters[ProblemCharacter{Character: r, Kind: UnknownCharacters}]++
+			}
+			c.addExample(TokenizerIssue{Kind: UnknownCharacters, Text: index, Start: start, End: end,
+				Detail: fmt.Sprintf("%s is encoded as %s", util.Redact(text[start:end]), c.unknownToken)})
+		}
+	}
+}
+
+func (c *tokenizerChecker) addExample(issue TokenizerIssue) {
+	if c.examples[issue.Kind] < maxTokenizerIssueExamples {
+		c.examples[issue.Kind]++
+		c.result.Examples = append(c.result.Examples, issue)
+	}
+}
+
+// report returns the report of the texts checked so far.
+func (c *tokenizerChecker) report() *TokenizerReport {
+	report := c.result
+	report.Characters = make([]ProblemCharacter, 0, len(c.characters))
+	for character, count := range c.characters {
+		character.Count = count
+		report.Characters = append(report.Characters, character)
+	}
+	sort.Slice(report.Characters, func(i, j int) bool {
+		a, b := report.Characters[i], report.Characters[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Character < b.Character
+	})
+	return &report
+}
+
+// foldText lowercases a text and removes its whitespace, which tokenizers commonly normalize.
+func foldText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, text)
+}
+
+// lostCharacters returns the characters of a text, lowercased and without whitespace, that are missing from its
+// decoded text, with the number of times they are missing.
+func lostCharacters(text string, decoded string) map[rune]int {
+	counts := map[rune]int{}
+	for _, r := range foldText(text) {
+		counts[r]++
+	}
+	for _, r := range foldText(decoded) {
+		counts[r]--
+	}
+	for r, count := range counts {
+		if count <= 0 {
+			delete(counts, r)
+		}
+	}
+	return counts
+}
+
+func isCharacterBoundary(text string, offset int) bool {
+	return offset >= 0 && (offset == len(text) || (offset < len(text) && utf8.RuneStart(text[offset])))
+}
@@ -0,0 +1,167 @@
+package pipelines
+
+import (
+	"errors"
+	"image"
+	"io"
+	"sort"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// VideoTagger tags videos with the labels of an image classifier, for media tagging. The frames of a video
+// selected by a util.FrameSelector, e.g. one frame per second or the first frame of each scene, are classified in
+// batches, and the labels of the frames are aggregated into the tags of the video.
+type VideoTagger struct {
+	Classify  func(images []image.Image) ([][]ClassificationOutput, error) // labels of each image, by decreasing score
+	BatchSize int                                                          // number of frames classified at once, 16 by default
+}
+
+// FrameClassification is the classification of a sampled frame of a video.
+type FrameClassification struct {
+	Index  int
+	Time   time.Duration
+	Labels []ClassificationOutput
+}
+
+// VideoTag is a label aggregated over the sampled frames of a video.
+type VideoTag struct {
+	Label     string
+	MeanScore float32       // mean score over the sampled frames, counting 0 for frames without the label
+	MaxScore  float32       // highest score of a frame
+	MaxTime   time.Duration // time of the frame with the highest score
+	TopFrames int           // number of frames where it is the label with the highest score
+}
+
+// VideoTaggingOutput is the result of tagging a video.
+type VideoTaggingOutput struct {
+	Frames []FrameClassification // the sampled frames, in order
+	Tags   []VideoTag            // the labels of the frames, by decreasing mean score
+}
+
+// NewVideoTagger tags videos with the labels of an image classification pipeline. Labels that are not in the top
+// labels of a frame, as set with WithTopLabels, count as 0 for that frame.
+func NewVideoTagger(classifier *ImageClassificationPipeline) (*VideoTagger, error) {
+	if classifier == nil {
+		return nil, errors.New("an image classification pipeline is required to tag videos")
+	}
+	return &VideoTagger{
+		Classify: func(images []image.Image) ([][]ClassificationOutput, error) {
+			output, err := classifier.RunImages(images)
+			if err != nil {
+				return nil, err
+			}
+			return output.ClassificationOutputs, nil
+		},
+		BatchSize: 16,
+	}, nil
+}
+
+// NewZeroShotVideoTagger tags videos with the labels of a zero shot image classification pipeline.
+func NewZeroShotVideoTagger(classifier *ZeroShotImageClassificationPipeline) (*VideoTagger, error) {
+	if classifier == nil {
+		return nil, errors.New("a zero shot image classification pipeline is required to tag videos")
+	}
+	return &VideoTagger{
+		Classify: func(images []image.Image) ([][]ClassificationOutput, error) {
+			output, err := classifier.RunImages(images)
+			if err != nil {
+				return nil, err
+			}
+			return output.ClassificationOutputs, nil
+		},
+		BatchSize: 16,
+	}, nil
+}
+
+// TagVideo reads the frames of a video, classifies the frames picked by the selector, and aggregates their labels.
+// Only a batch of frames is kept in memory at a time.
+func (t *VideoTagger) TagVideo(reader util.FrameReader, selector util.FrameSelector) (*VideoTaggingOutput, error) {
+	batchSize := t.BatchSize
+	if batchSize <= 0 {
+		batchSize = 16
+	}
+	output := &VideoTaggingOutput{}
+	var batch []*util.VideoFrame
+	classifyBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		images := make([]image.Image, len(batch))
+		for i, frame := range batch {
+			images[i] = frame.Image
+		}
+		labels, err := t.Classify(images)
+		if err != nil {
+			return err
+		}
+		if len(labels) != len(batch) {
+			return errors.New("the classifier returned a different number of outputs than frames")
+		}
+		for i, frame := range batch {
+			output.Frames = append(output.Frames, FrameClassification{Index: frame.Index, Time: frame.Time, Labels: labels[i]})
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !selector.SelectFrame(frame) {
+			continue
+		}
+		batch = append(batch, frame)
+		if len(batch) == batchSize {
+			if err = classifyBatch(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := classifyBatch(); err != nil {
+		return nil, err
+	}
+	output.Tags = AggregateFrameLabels(output.Frames)
+	return output, nil
+}
+
+// AggregateFrameLabels aggregates the labels of the classified frames of a video into tags, by decreasing mean
+// score.
+func AggregateFrameLabels(frames []FrameClassification) []VideoTag {
+	tags := map[string]*VideoTag{}
+	sums := map[string]float32{}
+	for _, frame := range frames {
+		for i, label := range frame.Labels {
+			tag, ok := tags[label.Label]
+			if !ok {
+				tag = &VideoTag{Label: label.Label, MaxScore: label.Score, MaxTime: frame.Time}
+				tags[label.Label] = tag
+			}
+			sums[label.Label] += label.Score
+			if label.Score > tag.MaxScore {
+				tag.MaxScore = label.Score
+				tag.MaxTime = frame.Time
+			}
+			if i == 0 {
+				tag.TopFrames++
+			}
+		}
+	}
+	aggregated := make([]VideoTag, 0, len(tags))
+	for label, tag := range tags {
+		tag.MeanScore = sums[label] / float32(len(frames))
+		aggregated = append(aggregated, *tag)
+	}
+	sort.Slice(aggregated, func(i, j int) bool {
+		if aggregated[i].MeanScore != aggregated[j].MeanScore {
+			return aggregated[i].MeanScore > aggregated[j].MeanScore
+		}
+		return aggregated[i].Label < aggregated[j].Label
+	})
+	return aggregated
+}
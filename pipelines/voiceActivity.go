@@ -0,0 +1,241 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// VoiceActivityDetector finds the segments of speech of mono audio, with samples between -1 and 1 at the sample
+// rate.
+type VoiceActivityDetector interface {
+	DetectSpeech(samples []float32, sampleRate int) ([]util.AudioSegment, error)
+}
+
+// EnergyVAD detects speech from the energy of the audio, relative to its noise floor. It needs no model and works
+// well on recordings with little background noise.
+type EnergyVAD struct {
+	ThresholdDB float64 // energy of speech above the noise floor
+	Options     util.VADOptions
+}
+
+// NewEnergyVAD creates an energy based voice activity detector, with speech 12 dB above the noise floor.
+func NewEnergyVAD() *EnergyVAD {
+	return &EnergyVAD{ThresholdDB: 12, Options: util.DefaultVADOptions()}
+}
+
+// DetectSpeech finds the segments of speech of the audio.
+func (v *EnergyVAD) DetectSpeech(samples []float32, sampleRate int) ([]util.AudioSegment, error) {
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate %d", sampleRate)
+	}
+	return util.DetectSpeechEnergy(samples, sampleRate, v.ThresholdDB, v.Options), nil
+}
+
+// SileroVAD detects speech with the Silero VAD ONNX model (silero_vad.onnx of snakers4/silero-vad), versions 4
+// and 5, at 8 or 16 kHz. The model scores windows of 32ms sequentially, and windows with a probability of speech of
+// at least Threshold start speech, which continues until the probability falls below Threshold - 0.15. The model is
+// stateful, so a detector processes one audio at a time.
+type SileroVAD struct {
+	Threshold  float32
+	Options    util.VADOptions
+	session    *ort.DynamicAdvancedSession
+	inputs     []ort.InputOutputInfo
+	outputs    []ort.InputOutputInfo
+	stateNames map[string]string // state inputs of the model by state output
+	mutex      sync.Mutex
+}
+
+// NewSileroVAD loads the Silero VAD model at modelPath, a directory with the model or the path of the model. The
+// ONNX runtime must be initialized, e.g. by creating a hugot session first.
+func NewSileroVAD(modelPath string, ortOptions *ort.SessionOptions) (*SileroVAD, error) {
+	var onnxBytes []byte
+	var err error
+	if strings.HasSuffix(modelPath, ".onnx") {
+		onnxBytes, err = util.ReadFileBytes(modelPath)
+	} else {
+		onnxBytes, err = loadOnnxModelBytes(modelPath, "", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	inputs, outputs, err := loadInputOutputMeta(onnxBytes)
+	if err != nil {
+		return nil, err
+	}
+	detector := &SileroVAD{
+		Threshold: 0.5,
+		Options:   util.DefaultVADOptions(),
+		inputs:    inputs,
+		outputs:   outputs,
+	}
+	names := map[string]bool{}
+	for _, input := range inputs {
+		names[input.Name] = true
+	}
+	switch {
+	case names["state"]:
+		detector.stateNames = map[string]string{"stateN": "state"}
+	case names["h"] && names["c"]:
+		detector.stateNames = map[string]string{"hn": "h", "cn": "c"}
+	}
+	if err = detector.validate(names); err != nil {
+		return nil, err
+	}
+	detector.session, err = createSession(onnxBytes, inputs, outputs, ortOptions)
+	if err != nil {
+		return nil, err
+	}
+	return detector, nil
+}
+
+// validate checks that the model has the inputs and outputs of Silero VAD.
+func (v *SileroVAD) validate(inputNames map[string]bool) error {
+	var validationErrors []error
+	if !inputNames["input"] || !inputNames["sr"] || v.stateNames == nil || len(inputNames) != 2+len(v.stateNames) {
+		validationErrors = append(validationErrors, errors.New("silero VAD configuration invalid: the model must have the input, sr and state inputs of version 5, or the h and c inputs of version 4"))
+	}
+	outputNames := map[string]bool{}
+	for _, output := range v.outputs {
+		outputNames[output.Name] = true
+	}
+	if !outputNames["output"] || len(outputNames) != 1+len(v.stateNames) {
+		validationErrors = append(validationErrors, errors.New("silero VAD configuration invalid: the model must have an output and its state outputs"))
+	}
+	for output := range v.stateNames {
+		if !outputNames[output] {
+			validationErrors = append(validationErrors, fmt.Errorf("silero VAD configuration invalid: state output %s is missing", output))
+		}
+	}
+	return errors.Join(validationErrors...)
+}
+
+// DetectSpeech finds the segments of speech of the audio, which must be sampled at 8 or 16 kHz.
+func (v *SileroVAD) DetectSpeech(samples []float32, sampleRate int) ([]util.AudioSegment, error) {
+	probabilities, err := v.SpeechProbabilities(samples, sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	speech := make([]bool, len(probabilities))
+	speaking := false
+	for i, probability := range probabilities {
+		speaking = probability >= v.Threshold || (speaking && probability >= v.Threshold-0.15)
+		speech[i] = speaking
+	}
+	windowSize, _ := sileroWindow(sampleRate)
+	duration := float64(len(samples)) / float64(sampleRate)
+	return util.SpeechSegments(speech, float64(windowSize)/float64(sampleRate), duration, v.Options), nil
+}
+
+// sileroWindow returns the number of samples of the windows scored by Silero VAD at the sample rate, and of the
+// context from the previous window that version 5 prepends to each window.
+func sileroWindow(sampleRate int) (int, int) {
+	if sampleRate == 8000 {
+		return 256, 32
+	}
+	return 512, 64
+}
+
+// SpeechProbabilities returns the probability of speech of each window of 32ms of the audio.
+func (v *SileroVAD) SpeechProbabilities(samples []float32, sampleRate int) (probabilities []float32, err error) {
+	if sampleRate != 8000 && sampleRate != 16000 {
+		return nil, fmt.Errorf("silero VAD supports audio at 8000 or 16000 Hz, not %d Hz: resample it with util.ResampleAudio", sampleRate)
+	}
+	windowSize, contextSize := sileroWindow(sampleRate)
+	if _, ok := v.stateNames["hn"]; ok {
+		// version 4 has no context
+		contextSize = 0
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	// the tensors are reused for all the windows, the state outputs being copied to the state inputs
+	var values []ort.Value
+	defer func() {
+		for _, value := range values {
+			if value != nil {
+				err = errors.Join(err, value.Destroy())
+			}
+		}
+	}()
+	var window *ort.Tensor[float32]
+	states := map[string]*ort.Tensor[float32]{}
+	inputValues := make([]ort.Value, len(v.inputs))
+	for i, input := range v.inputs {
+		var value ort.Value
+		switch input.Name {
+		case "input":
+			window, err = ort.NewEmptyTensor[float32](ort.NewShape(1, int64(contextSize+windowSize)))
+			value = window
+		case "sr":
+			value, err = ort.NewScalar(int64(sampleRate))
+		default:
+			// the batch dimension of the states is dynamic
+			shape := ort.NewShape(input.Dimensions...)
+			for j, dimension := range shape {
+				shape[j] = max(dimension, 1)
+			}
+			states[input.Name], err = ort.NewEmptyTensor[float32](shape)
+			value = states[input.Name]
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		inputValues[i] = value
+	}
+	outputValues := make([]ort.Value, len(v.outputs))
+	outputIndex := 0
+	for i, output := range v.outputs {
+		if output.Name == "output" {
+			outputIndex = i
+		}
+	}
+
+	windowData := window.GetData()
+	for start := 0; start < len(samples); start += windowSize {
+		// the context is the end of the previous window
+		copy(windowData, windowData[windowSize:])
+		clear(windowData[contextSize:])
+		copy(windowData[contextSize:], samples[start:min(start+windowSize, len(samples))])
+		for i := range outputValues {
+			outputValues[i] = nil
+		}
+		if err = v.session.Run(inputValues, outputValues); err != nil {
+			return nil, err
+		}
+		values = append(values, outputValues...)
+		for i, output := range v.outputs {
+			tensor, ok := outputValues[i].(*ort.Tensor[float32])
+			if !ok {
+				return nil, fmt.Errorf("output %s of silero VAD is not a float32 tensor", output.Name)
+			}
+			if i == outputIndex {
+				probabilities = append(probabilities, tensor.GetData()[0])
+			} else {
+				copy(states[v.stateNames[output.Name]].GetData(), tensor.GetData())
+			}
+		}
+		for _, value := range outputValues {
+			err = errors.Join(err, value.Destroy())
+		}
+		values = values[:len(values)-len(outputValues)]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return probabilities, nil
+}
+
+// Destroy frees the resources of the model.
+func (v *SileroVAD) Destroy() error {
+	if v.session == nil {
+		return nil
+	}
+	return v.session.Destroy()
+}
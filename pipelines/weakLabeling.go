@@ -0,0 +1,198 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Abstain is the label returned by a labeling function that does not vote on an input.
+const Abstain = ""
+
+// LabelingFunction votes for a noisy label for each of a batch of inputs, or abstains.
+type LabelingFunction struct {
+	Name  string
+	Apply func(inputs []string) ([]string, error) // one label per input, or Abstain
+}
+
+// WeakLabel is the label aggregated from the votes of the labeling functions for an input.
+type WeakLabel struct {
+	Label      string            // Abstain if all the labeling functions abstained
+	Confidence float32           // weight of the votes for the label over the weight of all the votes
+	Votes      map[string]string // label voted by each labeling function that did not abstain
+}
+
+// KeywordLabelingFunction votes for label on the inputs that contain any of the keywords as whole words,
+// case-insensitively.
+func KeywordLabelingFunction(name string, label string, keywords ...string) (LabelingFunction, error) {
+	if len(keywords) == 0 {
+		return LabelingFunction{}, fmt.Errorf("labeling function %s has no keywords", name)
+	}
+	quoted := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		quoted[i] = regexp.QuoteMeta(keyword)
+	}
+	return RegexLabelingFunction(name, label, `(?i)\b(?:`+strings.Join(quoted, "|")+`)\b`)
+}
+
+// RegexLabelingFunction votes for label on the inputs that match the regular expression.
+func RegexLabelingFunction(name string, label string, pattern string) (LabelingFunction, error) {
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		return LabelingFunction{}, fmt.Errorf("invalid pattern for labeling function %s: %w", name, err)
+	}
+	return LabelingFunction{
+		Name: name,
+		Apply: func(inputs []string) ([]string, error) {
+			labels := make([]string, len(inputs))
+			for i, input := range inputs {
+				if expression.MatchString(input) {
+					labels[i] = label
+				}
+			}
+			return labels, nil
+		},
+	}, nil
+}
+
+// ClassifierLabelingFunction votes for the top label predicted by a text classification pipeline when its score
+// is at least minScore, and abstains otherwise. labelMapping optionally maps the labels of the model to the
+// labels of the task, and the labels missing from a non-empty mapping abstain.
+func ClassifierLabelingFunction(name string, classifier *TextClassificationPipeline, minScore float32, labelMapping map[string]string) LabelingFunction {
+	return LabelingFunction{
+		Name: name,
+		Apply: func(inputs []string) ([]string, error) {
+			output, err := classifier.RunPipeline(inputs)
+			if err != nil {
+				return nil, err
+			}
+			labels := make([]string, len(inputs))
+			for i, classes := range output.ClassificationOutputs {
+				var top ClassificationOutput
+				for j, class := range classes {
+					if j == 0 || class.Score > top.Score {
+						top = class
+					}
+				}
+				if len(classes) == 0 || top.Score < minScore {
+					continue
+				}
+				labels[i] = top.Label
+				if len(labelMapping) > 0 {
+					labels[i] = labelMapping[top.Label]
+				}
+			}
+			return labels, nil
+		},
+	}
+}
+
+// WeakLabeler aggregates the votes of labeling functions into a label per input, with a weighted majority vote.
+// The weight of each labeling function is its estimated accuracy: starting from equal weights, each function's
+// accuracy is estimated as its agreement with the aggregated labels, and the labels are aggregated again with
+// the new weights, for a few iterations. This down-weights noisy labeling functions without any labeled data.
+type WeakLabeler struct {
+	Functions  []LabelingFunction
+	Iterations int                // number of weight estimation iterations, 0 for a plain majority vote
+	BatchSize  int                // inputs are passed to the labeling functions in batches of BatchSize
+	Weights    map[string]float32 // weight of each labeling function estimated by the last call to Label
+}
+
+// NewWeakLabeler creates a labeler aggregating the votes of the labeling functions.
+func NewWeakLabeler(functions ...LabelingFunction) (*WeakLabeler, error) {
+	if len(functions) == 0 {
+		return nil, errors.New("no labeling functions")
+	}
+	names := map[string]bool{}
+	for _, function := range functions {
+		if names[function.Name] {
+			return nil, fmt.Errorf("labeling function name %s is not unique", function.Name)
+		}
+		names[function.Name] = true
+	}
+	return &WeakLabeler{
+		Functions:  functions,
+		Iterations: 5,
+		BatchSize:  32,
+	}, nil
+}
+
+// Label runs the labeling functions on the inputs and aggregates their votes.
+func (l *WeakLabeler) Label(inputs []string) ([]WeakLabel, error) {
+	if l.BatchSize <= 0 {
+		return nil, errors.New("batch size must be greater than zero")
+	}
+	labels := make([]WeakLabel, len(inputs))
+	for i := range labels {
+		labels[i].Votes = map[string]string{}
+	}
+	for _, function := range l.Functions {
+		for batchStart := 0; batchStart < len(inputs); batchStart += l.BatchSize {
+			batch := inputs[batchStart:min(batchStart+l.BatchSize, len(inputs))]
+			votes, err := function.Apply(batch)
+			if err != nil {
+				return nil, fmt.Errorf("labeling function %s failed: %w", function.Name, err)
+			}
+			if len(votes) != len(batch) {
+				return nil, fmt.Errorf("labeling function %s returned %d labels for %d inputs", function.Name, len(votes), len(batch))
+			}
+			for i, vote := range votes {
+				if vote != Abstain {
+					labels[batchStart+i].Votes[function.Name] = vote
+				}
+			}
+		}
+	}
+
+	l.Weights = map[string]float32{}
+	for _, function := range l.Functions {
+		l.Weights[function.Name] = 1
+	}
+	aggregateVotes(labels, l.Weights)
+	for iteration := 0; iteration < l.Iterations; iteration++ {
+		for _, function := range l.Functions {
+			agreements, votes := 0, 0
+			for _, label := range labels {
+				if vote, ok := label.Votes[function.Name]; ok {
+					votes++
+					if vote == label.Label {
+						agreements++
+					}
+				}
+			}
+			// smoothed, so that functions that rarely vote keep a weight close to the prior of 0.5
+			l.Weights[function.Name] = (float32(agreements) + 1) / (float32(votes) + 2)
+		}
+		aggregateVotes(labels, l.Weights)
+	}
+	return labels, nil
+}
+
+// aggregateVotes sets the label of each input to the label with the highest total weight of votes. Ties are
+// broken by label order, so that the aggregation is deterministic.
+func aggregateVotes(labels []WeakLabel, weights map[string]float32) {
+	for i, label := range labels {
+		totals := map[string]float32{}
+		var total float32
+		for function, vote := range label.Votes {
+			totals[vote] += weights[function]
+			total += weights[function]
+		}
+		candidates := make([]string, 0, len(totals))
+		for candidate := range totals {
+			candidates = append(candidates, candidate)
+		}
+		sort.Strings(candidates)
+		labels[i].Label, labels[i].Confidence = Abstain, 0
+		for _, candidate := range candidates {
+			if labels[i].Label == Abstain || totals[candidate] > totals[labels[i].Label] {
+				labels[i].Label = candidate
+			}
+		}
+		if total > 0 {
+			labels[i].Confidence = totals[labels[i].Label] / total
+		}
+	}
+}
@@ -1,12 +1,9 @@
 package pipelines
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"math"
-	"os"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -162,6 +159,8 @@ func NewZeroShotClassificationPipeline(config PipelineConfig[*ZeroShotClassifica
 	pipeline.PipelineName = config.Name
 	pipeline.OrtOptions = ortOptions
 	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.Remote = config.Remote
 	pipeline.entailmentID = -1 // Default value
 	pipeline.HypothesisTemplate = "This example is {}."
 
@@ -196,46 +195,14 @@ func NewZeroShotClassificationPipeline(config PipelineConfig[*ZeroShotClassifica
 		}
 	}
 
-	configPath1 := util.PathJoinSafe(pipeline.ModelPath, "special_tokens_map.json")
-	file, err := os.Open(configPath1)
+	separatorToken, err := readSpecialToken(pipeline.ModelPath, "sep_token")
 	if err != nil {
-		return nil, fmt.Errorf("cannot read special_tokens_map.json at %s", pipeline.ModelPath)
-	}
-	defer func() {
-		err = file.Close()
-	}()
-
-	byteValue, _ := io.ReadAll(file)
-	var result map[string]interface{}
-	err = json.Unmarshal(byteValue, &result)
-	if err != nil {
-		return nil, fmt.Errorf("cannot unmarshal special_tokens_map.json at %s", pipeline.ModelPath)
-	}
-
-	sepToken, ok := result["sep_token"]
-	if !ok {
-		return nil, fmt.Errorf("no sep token detected in special_tokens_map.json at %s", pipeline.ModelPath)
-	}
-
-	switch v := sepToken.(type) {
-	case map[string]interface{}:
-		t, ok := v["content"]
-		if !ok {
-			return nil, fmt.Errorf("sep_token is map but no content field is available")
-		}
-		tString, ok := t.(string)
-		if !ok {
-			return nil, fmt.Errorf("sep_token cannot be converted to string: %v", t)
-		}
-		pipeline.separatorToken = tString
-	case string:
-		pipeline.separatorToken = v
-	default:
-		return nil, fmt.Errorf("sep_token has unexpected type: %v", v)
+		return nil, err
 	}
+	pipeline.separatorToken = separatorToken
 
 	// onnx model init
-	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename)
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
 	if err != nil {
 		return nil, err
 	}
@@ -259,13 +226,16 @@ func NewZeroShotClassificationPipeline(config PipelineConfig[*ZeroShotClassifica
 	}
 	pipeline.Tokenizer = tk
 
-	session, err := createSession(model, inputs, pipeline.OutputsMeta, ortOptions)
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := pipeline.createSession(config.EngineCache, model, inputs, pipeline.OutputsMeta, ortOptions)
 	if err != nil {
 		return nil, err
 	}
 	pipeline.OrtSession = session
 
 	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
 	pipeline.TokenizerTimings = &timings{}
 	return pipeline, err
 }
@@ -281,10 +251,12 @@ func (p *ZeroShotClassificationPipeline) Preprocess(batch *PipelineBatch, inputs
 
 func (p *ZeroShotClassificationPipeline) Forward(batch *PipelineBatch) error {
 	start := time.Now()
-	err := runSessionOnBatch(batch, p.OrtSession, p.OutputsMeta)
+	usageBefore := memoryUsageBefore()
+	err := p.runOnBatch(batch, p.OutputsMeta)
 	if err != nil {
 		return err
 	}
+	p.PipelineMemory.recordForward(usageBefore, batch)
 	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
 	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
 	return nil
@@ -414,11 +386,6 @@ func (p *ZeroShotClassificationPipeline) Postprocess(outputTensors [][][]float32
 
 func (p *ZeroShotClassificationPipeline) RunPipeline(inputs []string) (*ZeroShotOutput, error) {
 	var outputTensors [][][]float32
-	batch := NewBatch()
-	var runErrors []error
-	defer func(*PipelineBatch) {
-		runErrors = append(runErrors, batch.Destroy())
-	}(batch)
 
 	sequencePairs, _, err := createSequencePairs(inputs, p.Labels, p.HypothesisTemplate)
 	if err != nil {
@@ -436,22 +403,33 @@ func (p *ZeroShotClassificationPipeline) RunPipeline(inputs []string) (*ZeroShot
 			// The difference in outputs for one separator vs two is very small (differences in the thousandths place), but they
 			// definitely are different
 			concatenatedString := pair[0] + p.separatorToken + pair[1]
-			runErrors = append(runErrors, p.Preprocess(batch, []string{concatenatedString}))
-			if e := errors.Join(runErrors...); e != nil {
-				return nil, e
+			logits, pairErr := p.runPair(concatenatedString)
+			if pairErr != nil {
+				return nil, pairErr
 			}
-			runErrors = append(runErrors, p.Forward(batch))
-			if e := errors.Join(runErrors...); e != nil {
-				return nil, e
-			}
-			sequenceTensors = append(sequenceTensors, batch.OutputTensors[0].GetData())
+			sequenceTensors = append(sequenceTensors, logits)
 		}
 		outputTensors = append(outputTensors, sequenceTensors)
 	}
 
-	outputs, err := p.Postprocess(outputTensors, p.Labels, inputs)
-	runErrors = append(runErrors, err)
-	return outputs, errors.Join(runErrors...)
+	return p.Postprocess(outputTensors, p.Labels, inputs)
+}
+
+// runPair runs the model on a single premise/hypothesis pair and returns a copy of its logits. Each pair gets
+// its own batch so that the tensors of a pair are destroyed before the next one is created.
+func (p *ZeroShotClassificationPipeline) runPair(pair string) (logits []float32, err error) {
+	batch := NewBatch()
+	defer func(*PipelineBatch) {
+		err = errors.Join(err, batch.Destroy())
+	}(batch)
+
+	if err = p.Preprocess(batch, []string{pair}); err != nil {
+		return nil, err
+	}
+	if err = p.Forward(batch); err != nil {
+		return nil, err
+	}
+	return append([]float32{}, batch.OutputTensors[0].GetData()...), nil
 }
 
 // PIPELINE INTERFACE IMPLEMENTATION
@@ -471,6 +449,7 @@ func (p *ZeroShotClassificationPipeline) GetStats() []string {
 			time.Duration(p.PipelineTimings.TotalNS),
 			p.PipelineTimings.NumCalls,
 			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
 	}
 }
 
@@ -0,0 +1,414 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	util "github.com/knights-analytics/hugot/utils"
+
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// types
+
+// ZeroShotImageClassificationPipeline classifies images into arbitrary labels with CLIP-style dual encoders,
+// exported to ONNX as two graphs: a vision model with a pixel_values input and an image_embeds output
+// (vision_model.onnx by default), and a text model with an input_ids input and a text_embeds output
+// (text_model.onnx by default). The scores of the labels are the softmax of the cosine similarities between the
+// image and the labels, scaled by LogitScale. The embeddings of the labels are computed once, when the pipeline
+// is created.
+type ZeroShotImageClassificationPipeline struct {
+	basePipeline
+	imageProcessor
+	Labels             []string
+	HypothesisTemplate string
+	LogitScale         float32
+	TextOnnxFilename   string
+	TextSession        *ort.DynamicAdvancedSession
+	TextInputsMeta     []ort.InputOutputInfo
+	TextOutputsMeta    []ort.InputOutputInfo
+	labelEmbeddings    [][]float32
+}
+
+type ZeroShotImageClassificationOutput struct {
+	ClassificationOutputs [][]ClassificationOutput // scores of all the labels for each image, by decreasing score
+}
+
+func (t *ZeroShotImageClassificationOutput) GetOutput() []any {
+	out := make([]any, len(t.ClassificationOutputs))
+	for i, classificationOutput := range t.ClassificationOutputs {
+		out[i] = any(classificationOutput)
+	}
+	return out
+}
+
+// options
+
+// WithImageLabels sets the candidate labels of the images.
+func WithImageLabels(labels []string) PipelineOption[*ZeroShotImageClassificationPipeline] {
+	return func(pipeline *ZeroShotImageClassificationPipeline) {
+		pipeline.Labels = labels
+	}
+}
+
+// WithImageHypothesisTemplate sets the text embedded for each label, where {} is replaced with the label. It is
+// "This is a photo of {}." by default.
+func WithImageHypothesisTemplate(hypothesisTemplate string) PipelineOption[*ZeroShotImageClassificationPipeline] {
+	return func(pipeline *ZeroShotImageClassificationPipeline) {
+		pipeline.HypothesisTemplate = hypothesisTemplate
+	}
+}
+
+// WithLogitScale sets the factor applied to the cosine similarities before the softmax. It is 100 by default,
+// the learned value of the OpenAI CLIP models.
+func WithLogitScale(logitScale float32) PipelineOption[*ZeroShotImageClassificationPipeline] {
+	return func(pipeline *ZeroShotImageClassificationPipeline) {
+		pipeline.LogitScale = logitScale
+	}
+}
+
+// WithTextOnnxFilename sets the filename of the text model, text_model.onnx by default. The filename of the
+// vision model is the OnnxFilename of the pipeline config.
+func WithTextOnnxFilename(filename string) PipelineOption[*ZeroShotImageClassificationPipeline] {
+	return func(pipeline *ZeroShotImageClassificationPipeline) {
+		pipeline.TextOnnxFilename = filename
+	}
+}
+
+// NewZeroShotImageClassificationPipeline initializes a new zero shot image classification pipeline.
+func NewZeroShotImageClassificationPipeline(config PipelineConfig[*ZeroShotImageClassificationPipeline], ortOptions *ort.SessionOptions) (*ZeroShotImageClassificationPipeline, error) {
+	pipeline := &ZeroShotImageClassificationPipeline{}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+	pipeline.HypothesisTemplate = "This is a photo of {}."
+	pipeline.LogitScale = 100
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	if pipeline.OnnxFilename == "" {
+		pipeline.OnnxFilename = "vision_model.onnx"
+	}
+	if pipeline.TextOnnxFilename == "" {
+		pipeline.TextOnnxFilename = "text_model.onnx"
+	}
+	if err := pipeline.loadImageProcessor(pipeline.ModelPath); err != nil {
+		return nil, err
+	}
+
+	// onnx models init
+	vision, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+	visionInputs, visionOutputs, err := loadInputOutputMeta(vision)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = visionInputs
+	pipeline.OutputsMeta = selectOutput(visionOutputs, "image_embeds")
+	text, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.TextOnnxFilename, nil)
+	if err != nil {
+		return nil, err
+	}
+	textInputs, textOutputs, err := loadInputOutputMeta(text)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.TextInputsMeta = textInputs
+	pipeline.TextOutputsMeta = selectOutput(textOutputs, "text_embeds")
+
+	// tokenizer init
+	pipeline.TokenizerOptions, err = getTokenizerOptions(textInputs)
+	if err != nil {
+		return nil, err
+	}
+	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	if tkErr != nil {
+		return nil, tkErr
+	}
+	pipeline.Tokenizer = tk
+
+	// creation of the sessions, placed together by the total size of both graphs
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, vision, text)
+	pipeline.OrtOptions = ortOptions
+	session, err := config.EngineCache.createSession(vision, visionInputs, pipeline.OutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	pipeline.OrtSession = session
+	textSession, err := config.EngineCache.createSession(text, textInputs, pipeline.TextOutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, pipeline.Destroy())
+	}
+	pipeline.TextSession = textSession
+
+	// initialize timings
+	pipeline.TokenizerTimings = &timings{}
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(vision) + len(text))}
+
+	// validate, and embed the labels
+	err = pipeline.Validate()
+	if err == nil {
+		pipeline.labelEmbeddings, err = pipeline.embedLabels(pipeline.Labels)
+	}
+	if err != nil {
+		errDestroy := pipeline.Destroy()
+		return nil, errors.Join(err, errDestroy)
+	}
+	return pipeline, nil
+}
+
+// selectOutput returns the output with the given name, or all the outputs if there is none so that validation
+// reports it.
+func selectOutput(outputs []ort.InputOutputInfo, name string) []ort.InputOutputInfo {
+	for _, output := range outputs {
+		if output.Name == name {
+			return []ort.InputOutputInfo{output}
+		}
+	}
+	return outputs
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the image and text embeddings.
+func (p *ZeroShotImageClassificationPipeline) GetMetadata() PipelineMetadata {
+	metadata := PipelineMetadata{}
+	for _, output := range append(append([]ort.InputOutputInfo{}, p.OutputsMeta...), p.TextOutputsMeta...) {
+		metadata.OutputsInfo = append(metadata.OutputsInfo, OutputInfo{Name: output.Name, Dimensions: output.Dimensions})
+	}
+	return metadata
+}
+
+// Destroy frees the zero shot image classification pipeline resources.
+func (p *ZeroShotImageClassificationPipeline) Destroy() error {
+	err := destroySession(p.Tokenizer, p.OrtSession)
+	if p.TextSession != nil {
+		err = errors.Join(err, p.TextSession.Destroy())
+	}
+	return err
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *ZeroShotImageClassificationPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Image preprocessing: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.ImageTimings.TotalNS),
+			p.ImageTimings.NumCalls,
+			time.Duration(float64(p.ImageTimings.TotalNS)/math.Max(1, float64(p.ImageTimings.NumCalls)))),
+		fmt.Sprintf("Tokenizer: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.TokenizerTimings.TotalNS),
+			p.TokenizerTimings.NumCalls,
+			time.Duration(float64(p.TokenizerTimings.TotalNS)/math.Max(1, float64(p.TokenizerTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *ZeroShotImageClassificationPipeline) Validate() error {
+	var validationErrors []error
+
+	if len(p.Labels) == 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: no labels, set them with WithImageLabels"))
+	}
+	if !strings.Contains(p.HypothesisTemplate, "{}") {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the hypothesis template %q has no {} to replace with the labels", p.HypothesisTemplate))
+	}
+	if p.LogitScale <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the logit scale must be greater than zero"))
+	}
+	if len(p.OutputsMeta) != 1 || p.OutputsMeta[0].Name != "image_embeds" || len(p.OutputsMeta[0].Dimensions) != 2 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the vision model must have an image_embeds output with 2 dimensions"))
+	}
+	if len(p.TextOutputsMeta) != 1 || p.TextOutputsMeta[0].Name != "text_embeds" || len(p.TextOutputsMeta[0].Dimensions) != 2 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the text model must have a text_embeds output with 2 dimensions"))
+	} else if len(p.OutputsMeta) == 1 {
+		imageSize, textSize := p.OutputsMeta[0].Dimensions[len(p.OutputsMeta[0].Dimensions)-1], p.TextOutputsMeta[0].Dimensions[1]
+		if imageSize > 0 && textSize > 0 && imageSize != textSize {
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the image embeddings have %d dimensions but the text embeddings have %d", imageSize, textSize))
+		}
+	}
+	return errors.Join(append(validationErrors, p.validateImageProcessor(p.InputsMeta))...)
+}
+
+// embedLabels returns the normalized text embeddings of the labels, inserted in the hypothesis template.
+func (p *ZeroShotImageClassificationPipeline) embedLabels(labels []string) ([][]float32, error) {
+	hypotheses := make([]string, len(labels))
+	for i, label := range labels {
+		hypotheses[i] = strings.Replace(p.HypothesisTemplate, "{}", label, 1)
+	}
+	return p.EmbedTexts(hypotheses)
+}
+
+// EmbedTexts returns the normalized embeddings of texts by the text model, in the space of the image embeddings.
+func (p *ZeroShotImageClassificationPipeline) EmbedTexts(texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	batch := NewBatch()
+	defer func() {
+		_ = batch.Destroy()
+	}()
+	start := time.Now()
+	tokenizeInputs(batch, p.Tokenizer, texts, p.TokenizerOptions)
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+	if err := createInputTensors(batch, p.TextInputsMeta); err != nil {
+		return nil, err
+	}
+	inputs := make([]ort.Value, len(batch.InputTensors))
+	for i, tensor := range batch.InputTensors {
+		inputs[i] = tensor
+	}
+	return p.runEmbeddings(p.TextSession, inputs)
+}
+
+// EmbedImages returns the normalized embeddings of decoded images by the vision model.
+func (p *ZeroShotImageClassificationPipeline) EmbedImages(images []image.Image) ([][]float32, error) {
+	if len(images) == 0 {
+		return nil, nil
+	}
+	pixelValues, err := p.Preprocess(images)
+	if err != nil {
+		return nil, err
+	}
+	embeddings, err := p.Forward(pixelValues)
+	return embeddings, errors.Join(err, pixelValues.Destroy())
+}
+
+// runEmbeddings runs one of the encoders and returns its normalized embeddings.
+func (p *ZeroShotImageClassificationPipeline) runEmbeddings(session *ort.DynamicAdvancedSession, inputs []ort.Value) ([][]float32, error) {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	outputs := []ort.Value{nil}
+	if err := session.Run(inputs, outputs); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = outputs[0].Destroy()
+	}()
+	embeddingsTensor, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, errors.New("the embeddings are not a float32 tensor")
+	}
+	shape := embeddingsTensor.GetShape()
+	data := embeddingsTensor.GetData()
+	embeddings := make([][]float32, shape[0])
+	for i := range embeddings {
+		embeddings[i] = util.Normalize(append([]float32(nil), data[i*int(shape[1]):(i+1)*int(shape[1])]...), 2)
+	}
+	p.PipelineMemory.recordForward(usageBefore, nil)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return embeddings, nil
+}
+
+// Preprocess creates the pixel_values tensor of the images.
+func (p *ZeroShotImageClassificationPipeline) Preprocess(images []image.Image) (*ort.Tensor[float32], error) {
+	return p.pixelValues(images)
+}
+
+// Forward runs the vision model and returns the normalized embeddings of the images.
+func (p *ZeroShotImageClassificationPipeline) Forward(pixelValues *ort.Tensor[float32]) ([][]float32, error) {
+	return p.runEmbeddings(p.OrtSession, []ort.Value{pixelValues})
+}
+
+// Postprocess scores the labels of each image with the softmax of their scaled cosine similarities.
+func (p *ZeroShotImageClassificationPipeline) Postprocess(imageEmbeddings [][]float32, labels []string, labelEmbeddings [][]float32) (*ZeroShotImageClassificationOutput, error) {
+	output := &ZeroShotImageClassificationOutput{ClassificationOutputs: make([][]ClassificationOutput, len(imageEmbeddings))}
+	for i, imageEmbedding := range imageEmbeddings {
+		logits := make([]float32, len(labelEmbeddings))
+		for j, labelEmbedding := range labelEmbeddings {
+			if len(labelEmbedding) != len(imageEmbedding) {
+				return nil, fmt.Errorf("the image embeddings have %d dimensions but the text embeddings have %d", len(imageEmbedding), len(labelEmbedding))
+			}
+			var similarity float32
+			for k := range imageEmbedding {
+				similarity += imageEmbedding[k] * labelEmbedding[k]
+			}
+			logits[j] = p.LogitScale * similarity
+		}
+		scores := util.SoftMax(logits)
+		classificationOutputs := make([]ClassificationOutput, len(labels))
+		for j, label := range labels {
+			classificationOutputs[j] = ClassificationOutput{Label: label, Score: scores[j]}
+		}
+		sort.SliceStable(classificationOutputs, func(a, b int) bool {
+			return classificationOutputs[a].Score > classificationOutputs[b].Score
+		})
+		output.ClassificationOutputs[i] = classificationOutputs
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of paths to images, in the formats supported by util.DecodeImage.
+func (p *ZeroShotImageClassificationPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete zero shot image classification output type rather than the
+// interface.
+func (p *ZeroShotImageClassificationPipeline) RunPipeline(inputs []string) (*ZeroShotImageClassificationOutput, error) {
+	images, err := readImages(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunImages(images)
+}
+
+// RunImageBytes classifies a batch of image files, e.g. uploads, into the labels of the pipeline. The formats
+// supported by util.DecodeImage are JPEG, PNG, GIF and WebP, rotated as set by their EXIF orientation.
+func (p *ZeroShotImageClassificationPipeline) RunImageBytes(inputs [][]byte) (*ZeroShotImageClassificationOutput, error) {
+	images, err := decodeImages(inputs)
+	if err != nil {
+		return nil, err
+	}
+	return p.RunImages(images)
+}
+
+// RunImages classifies a batch of decoded images into the labels of the pipeline.
+func (p *ZeroShotImageClassificationPipeline) RunImages(images []image.Image) (*ZeroShotImageClassificationOutput, error) {
+	return p.classify(images, p.Labels, p.labelEmbeddings)
+}
+
+// RunImagesWithLabels classifies a batch of decoded images into other labels than the ones of the pipeline. The
+// labels are embedded at each call.
+func (p *ZeroShotImageClassificationPipeline) RunImagesWithLabels(images []image.Image, labels []string) (*ZeroShotImageClassificationOutput, error) {
+	if len(labels) == 0 {
+		return nil, errors.New("you must include at least one label")
+	}
+	labelEmbeddings, err := p.embedLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	return p.classify(images, labels, labelEmbeddings)
+}
+
+func (p *ZeroShotImageClassificationPipeline) classify(images []image.Image, labels []string, labelEmbeddings [][]float32) (*ZeroShotImageClassificationOutput, error) {
+	if len(images) == 0 {
+		return &ZeroShotImageClassificationOutput{}, nil
+	}
+	imageEmbeddings, err := p.EmbedImages(images)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(imageEmbeddings, labels, labelEmbeddings)
+}
@@ -0,0 +1,469 @@
+package pipelines
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/daulet/tokenizers"
+	jsoniter "github.com/json-iterator/go"
+	ort "github.com/yalue/onnxruntime_go"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+// types
+
+// ZeroShotNERPipeline extracts entities of arbitrary types with GLiNER models, such as urchade/gliner_multi-v2.1
+// exported to ONNX with a span-level head. The entity types are written in a prompt before the text, as
+// <<ENT>> type <<ENT>> type ... <<SEP>> text, and the model scores every span of up to MaxWidth words of the text
+// against every type. The spans scoring at least Threshold are selected greedily by decreasing score, without
+// overlaps unless NestedEntities is set. The model directory must have the gliner_config.json of the model.
+type ZeroShotNERPipeline struct {
+	basePipeline
+	Labels         []string // entity types, which RunWithLabels can override
+	Threshold      float32
+	NestedEntities bool // keep the entities nested in others, partially overlapping entities are always dropped
+	MaxWidth       int  // maximum number of words of an entity, read from gliner_config.json
+	MaxWords       int  // longer texts are truncated, read from gliner_config.json
+	entityTokenIDs []uint32
+	sepTokenIDs    []uint32
+	prefixIDs      []uint32 // special tokens added before a sequence, e.g. [CLS]
+	suffixIDs      []uint32 // special tokens added after a sequence, e.g. [SEP]
+}
+
+type ZeroShotNEROutput struct {
+	Entities [][]Entity // entities of each input in order of their position, with the entity type as Entity
+}
+
+func (t *ZeroShotNEROutput) GetOutput() []any {
+	out := make([]any, len(t.Entities))
+	for i, entities := range t.Entities {
+		out[i] = any(entities)
+	}
+	return out
+}
+
+// glinerConfig holds the fields of gliner_config.json used by the pipeline.
+type glinerConfig struct {
+	MaxWidth    int    `json:"max_width"`
+	MaxLen      int    `json:"max_len"`
+	EntityToken string `json:"ent_token"`
+	SepToken    string `json:"sep_token"`
+	SpanMode    string `json:"span_mode"`
+}
+
+// glinerWord is a word of a text with its byte offsets.
+type glinerWord struct {
+	text       string
+	start, end int
+}
+
+// glinerWordPattern splits texts into words as GLiNER does.
+var glinerWordPattern = regexp.MustCompile(`[\p{L}\p{N}_]+(?:[-_][\p{L}\p{N}_]+)*|\S`)
+
+// options
+
+// WithEntityLabels sets the entity types to extract.
+func WithEntityLabels(labels []string) PipelineOption[*ZeroShotNERPipeline] {
+	return func(pipeline *ZeroShotNERPipeline) {
+		pipeline.Labels = labels
+	}
+}
+
+// WithEntityThreshold sets the minimum score of an entity, 0.5 by default.
+func WithEntityThreshold(threshold float32) PipelineOption[*ZeroShotNERPipeline] {
+	return func(pipeline *ZeroShotNERPipeline) {
+		pipeline.Threshold = threshold
+	}
+}
+
+// WithNestedEntities keeps the entities nested in other entities, e.g. a city within an address.
+func WithNestedEntities() PipelineOption[*ZeroShotNERPipeline] {
+	return func(pipeline *ZeroShotNERPipeline) {
+		pipeline.NestedEntities = true
+	}
+}
+
+// NewZeroShotNERPipeline initializes a new zero shot NER pipeline.
+func NewZeroShotNERPipeline(config PipelineConfig[*ZeroShotNERPipeline], ortOptions *ort.SessionOptions) (*ZeroShotNERPipeline, error) {
+	pipeline := &ZeroShotNERPipeline{Threshold: 0.5}
+	pipeline.ModelPath = config.ModelPath
+	pipeline.PipelineName = config.Name
+	pipeline.OrtOptions = ortOptions
+	pipeline.OnnxFilename = config.OnnxFilename
+	pipeline.OnnxTransforms = config.OnnxTransforms
+
+	for _, o := range config.Options {
+		o(pipeline)
+	}
+
+	configBytes, err := util.ReadFileBytes(util.PathJoinSafe(pipeline.ModelPath, "gliner_config.json"))
+	if err != nil {
+		return nil, err
+	}
+	modelConfig := glinerConfig{MaxWidth: 12, MaxLen: 384, EntityToken: "<<ENT>>", SepToken: "<<SEP>>"}
+	if err = jsoniter.Unmarshal(configBytes, &modelConfig); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal gliner_config.json at %s: %w", pipeline.ModelPath, err)
+	}
+	if modelConfig.SpanMode == "token_level" {
+		return nil, errors.New("GLiNER models with a token level head are not supported, only span level ones")
+	}
+	pipeline.MaxWidth = modelConfig.MaxWidth
+	pipeline.MaxWords = modelConfig.MaxLen
+
+	// onnx model init
+	model, err := loadOnnxModelBytes(pipeline.ModelPath, pipeline.OnnxFilename, pipeline.OnnxTransforms)
+	if err != nil {
+		return nil, err
+	}
+	inputs, outputs, err := loadInputOutputMeta(model)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.InputsMeta = inputs
+	pipeline.OutputsMeta = selectOutput(outputs, "logits")
+
+	// tokenizer init, the prompt tokens are added tokens of the tokenizer
+	tk, tkErr := loadTokenizer(pipeline.ModelPath)
+	if tkErr != nil {
+		return nil, tkErr
+	}
+	pipeline.Tokenizer = tk
+	pipeline.entityTokenIDs = tk.EncodeWithOptions(modelConfig.EntityToken, false).IDs
+	pipeline.sepTokenIDs = tk.EncodeWithOptions(modelConfig.SepToken, false).IDs
+	template := tk.EncodeWithOptions("a", true, tokenizers.WithReturnSpecialTokensMask())
+	content := false
+	for i, special := range template.SpecialTokensMask {
+		switch {
+		case special == 0:
+			content = true
+		case content:
+			pipeline.suffixIDs = append(pipeline.suffixIDs, template.IDs[i])
+		default:
+			pipeline.prefixIDs = append(pipeline.prefixIDs, template.IDs[i])
+		}
+	}
+
+	// initialize timings
+	pipeline.PipelineTimings = &timings{}
+	pipeline.PipelineMemory = &MemoryStats{ModelBytes: uint64(len(model))}
+	pipeline.TokenizerTimings = &timings{}
+
+	// validate before creating the session, as the inputs of other models cannot be created
+	if err = pipeline.Validate(); err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	ortOptions = config.CPUPlacement.sessionOptions(ortOptions, model)
+	pipeline.OrtOptions = ortOptions
+	session, err := config.EngineCache.createSession(model, inputs, pipeline.OutputsMeta, ortOptions)
+	if err != nil {
+		return nil, errors.Join(err, tk.Close())
+	}
+	pipeline.OrtSession = session
+	return pipeline, nil
+}
+
+// INTERFACE IMPLEMENTATION
+
+// GetMetadata returns metadata information about the pipeline, in particular:
+// OutputInfo: names and dimensions of the span logits output.
+func (p *ZeroShotNERPipeline) GetMetadata() PipelineMetadata {
+	return PipelineMetadata{
+		OutputsInfo: []OutputInfo{
+			{
+				Name:       p.OutputsMeta[0].Name,
+				Dimensions: p.OutputsMeta[0].Dimensions,
+			},
+		},
+	}
+}
+
+// Destroy frees the zero shot NER pipeline resources.
+func (p *ZeroShotNERPipeline) Destroy() error {
+	return destroySession(p.Tokenizer, p.OrtSession)
+}
+
+// GetStats returns the runtime statistics for the pipeline.
+func (p *ZeroShotNERPipeline) GetStats() []string {
+	return []string{
+		fmt.Sprintf("Statistics for pipeline: %s", p.PipelineName),
+		fmt.Sprintf("Tokenizer: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.TokenizerTimings.TotalNS),
+			p.TokenizerTimings.NumCalls,
+			time.Duration(float64(p.TokenizerTimings.TotalNS)/math.Max(1, float64(p.TokenizerTimings.NumCalls)))),
+		fmt.Sprintf("ONNX: Total time=%s, Execution count=%d, Average query time=%s",
+			time.Duration(p.PipelineTimings.TotalNS),
+			p.PipelineTimings.NumCalls,
+			time.Duration(float64(p.PipelineTimings.TotalNS)/math.Max(1, float64(p.PipelineTimings.NumCalls)))),
+		p.GetMemoryStats().String(),
+	}
+}
+
+// Validate checks that the pipeline is valid.
+func (p *ZeroShotNERPipeline) Validate() error {
+	var validationErrors []error
+
+	if p.Threshold < 0 || p.Threshold > 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the entity threshold must be between 0 and 1"))
+	}
+	if p.MaxWidth <= 0 || p.MaxWords <= 0 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: max_width and max_len of gliner_config.json must be greater than zero"))
+	}
+	if len(p.entityTokenIDs) != 1 || len(p.sepTokenIDs) != 1 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the entity and separator tokens of the prompt must be single tokens of the tokenizer"))
+	}
+	for _, input := range p.InputsMeta {
+		switch input.Name {
+		case "input_ids", "attention_mask", "words_mask", "text_lengths", "span_idx", "span_mask":
+		default:
+			validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: input %s is not an input of GLiNER models", input.Name))
+		}
+	}
+	if len(p.OutputsMeta) != 1 || p.OutputsMeta[0].Name != "logits" || len(p.OutputsMeta[0].Dimensions) != 4 {
+		validationErrors = append(validationErrors, fmt.Errorf("pipeline configuration invalid: the model must have a logits output with 4 dimensions (batch, words, span widths, entity types)"))
+	}
+	return errors.Join(validationErrors...)
+}
+
+// splitWords splits a text into the words that the model tags, up to MaxWords.
+func (p *ZeroShotNERPipeline) splitWords(text string) []glinerWord {
+	var words []glinerWord
+	for _, match := range glinerWordPattern.FindAllStringIndex(text, p.MaxWords) {
+		words = append(words, glinerWord{text: text[match[0]:match[1]], start: match[0], end: match[1]})
+	}
+	return words
+}
+
+// Preprocess creates the input tensors of the model for the words of each input, after the prompt of the labels.
+// words_mask marks the first token of each word with the word's position, counted from 1.
+func (p *ZeroShotNERPipeline) Preprocess(inputs []string, labels []string) ([]ort.Value, error) {
+	start := time.Now()
+	words := make([][]glinerWord, len(inputs))
+	for i, input := range inputs {
+		words[i] = p.splitWords(input)
+	}
+	var prompt []uint32
+	for _, label := range labels {
+		prompt = append(prompt, p.entityTokenIDs...)
+		prompt = append(prompt, p.Tokenizer.EncodeWithOptions(label, false).IDs...)
+	}
+	prompt = append(prompt, p.sepTokenIDs...)
+
+	batchSize := len(words)
+	tokenIDs := make([][]uint32, batchSize)
+	wordMasks := make([][]int64, batchSize)
+	maxTokens, maxWords := 0, 1
+	for i, inputWords := range words {
+		tokenIDs[i] = append(append([]uint32{}, p.prefixIDs...), prompt...)
+		wordMasks[i] = make([]int64, len(tokenIDs[i]))
+		for j, word := range inputWords {
+			wordIDs := p.Tokenizer.EncodeWithOptions(word.text, false).IDs
+			for k, id := range wordIDs {
+				tokenIDs[i] = append(tokenIDs[i], id)
+				mask := int64(0)
+				if k == 0 {
+					mask = int64(j + 1)
+				}
+				wordMasks[i] = append(wordMasks[i], mask)
+			}
+		}
+		tokenIDs[i] = append(tokenIDs[i], p.suffixIDs...)
+		wordMasks[i] = append(wordMasks[i], make([]int64, len(p.suffixIDs))...)
+		maxTokens = max(maxTokens, len(tokenIDs[i]))
+		maxWords = max(maxWords, len(inputWords))
+	}
+	atomic.AddUint64(&p.TokenizerTimings.NumCalls, 1)
+	atomic.AddUint64(&p.TokenizerTimings.TotalNS, uint64(time.Since(start)))
+
+	numSpans := maxWords * p.MaxWidth
+	inputIDs := make([]int64, batchSize*maxTokens)
+	attentionMask := make([]int64, batchSize*maxTokens)
+	wordsMask := make([]int64, batchSize*maxTokens)
+	textLengths := make([]int64, batchSize)
+	spanIndices := make([]int64, batchSize*numSpans*2)
+	spanMask := make([]byte, batchSize*numSpans)
+	for i := range batchSize {
+		for j, id := range tokenIDs[i] {
+			inputIDs[i*maxTokens+j] = int64(id)
+			attentionMask[i*maxTokens+j] = 1
+			wordsMask[i*maxTokens+j] = wordMasks[i][j]
+		}
+		textLengths[i] = int64(len(words[i]))
+		for wordStart := range maxWords {
+			for width := range p.MaxWidth {
+				span := i*numSpans + wordStart*p.MaxWidth + width
+				spanIndices[2*span] = int64(wordStart)
+				spanIndices[2*span+1] = int64(wordStart + width)
+				if wordStart+width < len(words[i]) {
+					spanMask[span] = 1
+				}
+			}
+		}
+	}
+
+	var values []ort.Value
+	destroyValues := func(err error) ([]ort.Value, error) {
+		for _, value := range values {
+			err = errors.Join(err, value.Destroy())
+		}
+		return nil, err
+	}
+	for _, input := range p.InputsMeta {
+		var value ort.Value
+		var err error
+		switch input.Name {
+		case "input_ids":
+			value, err = ort.NewTensor(ort.NewShape(int64(batchSize), int64(maxTokens)), inputIDs)
+		case "attention_mask":
+			value, err = ort.NewTensor(ort.NewShape(int64(batchSize), int64(maxTokens)), attentionMask)
+		case "words_mask":
+			value, err = ort.NewTensor(ort.NewShape(int64(batchSize), int64(maxTokens)), wordsMask)
+		case "text_lengths":
+			value, err = ort.NewTensor(ort.NewShape(int64(batchSize), 1), textLengths)
+		case "span_idx":
+			value, err = ort.NewTensor(ort.NewShape(int64(batchSize), int64(numSpans), 2), spanIndices)
+		case "span_mask":
+			// onnxruntime_go has no generic boolean tensors, booleans are one byte each
+			value, err = ort.NewCustomDataTensor(ort.NewShape(int64(batchSize), int64(numSpans)), spanMask, ort.TensorElementDataTypeBool)
+		default:
+			err = fmt.Errorf("input %s not recognized", input.Name)
+		}
+		if err != nil {
+			return destroyValues(err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Forward runs the model and returns the span logits with their shape (batch, words, span widths, entity types).
+func (p *ZeroShotNERPipeline) Forward(inputs []ort.Value) ([]float32, []int64, error) {
+	start := time.Now()
+	usageBefore := memoryUsageBefore()
+	outputs := []ort.Value{nil}
+	if err := p.OrtSession.Run(inputs, outputs); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = outputs[0].Destroy()
+	}()
+	logitsTensor, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, nil, errors.New("the logits are not a float32 tensor")
+	}
+	shape := logitsTensor.GetShape()
+	logits := append([]float32(nil), logitsTensor.GetData()...)
+	p.PipelineMemory.recordForward(usageBefore, nil)
+	atomic.AddUint64(&p.PipelineTimings.NumCalls, 1)
+	atomic.AddUint64(&p.PipelineTimings.TotalNS, uint64(time.Since(start)))
+	return logits, shape, nil
+}
+
+// Postprocess decodes the spans scoring at least the threshold into entities, selected greedily by decreasing
+// score.
+func (p *ZeroShotNERPipeline) Postprocess(inputs []string, labels []string, logits []float32, shape []int64) (*ZeroShotNEROutput, error) {
+	if len(shape) != 4 || int(shape[0]) != len(inputs) || len(logits) != int(shape[0]*shape[1]*shape[2]*shape[3]) {
+		return nil, fmt.Errorf("the logits have shape %v, expected (%d, words, span widths, entity types)", shape, len(inputs))
+	}
+	numWords, numWidths, numLabels := int(shape[1]), int(shape[2]), int(shape[3])
+	if numLabels != len(labels) {
+		return nil, fmt.Errorf("the model scored %d entity types for %d labels", numLabels, len(labels))
+	}
+	output := &ZeroShotNEROutput{Entities: make([][]Entity, len(inputs))}
+	type span struct {
+		start, end int // positions of the first and last words
+		label      int
+		score      float32
+	}
+	for i, input := range inputs {
+		inputWords := p.splitWords(input)
+		var candidates []span
+		for start := range min(numWords, len(inputWords)) {
+			for width := range numWidths {
+				if start+width >= len(inputWords) {
+					break
+				}
+				offset := ((i*numWords+start)*numWidths + width) * numLabels
+				for label, logit := range logits[offset : offset+numLabels] {
+					score := util.Sigmoid([]float32{logit})[0]
+					if score >= p.Threshold {
+						candidates = append(candidates, span{start: start, end: start + width, label: label, score: score})
+					}
+				}
+			}
+		}
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return candidates[a].score > candidates[b].score
+		})
+		var selected []span
+		for _, candidate := range candidates {
+			keep := true
+			for _, other := range selected {
+				disjoint := candidate.end < other.start || candidate.start > other.end
+				nested := (candidate.start >= other.start && candidate.end <= other.end) || (other.start >= candidate.start && other.end <= candidate.end)
+				same := candidate.start == other.start && candidate.end == other.end
+				if !disjoint && (!p.NestedEntities || !nested || same) {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				selected = append(selected, candidate)
+			}
+		}
+		sort.SliceStable(selected, func(a, b int) bool {
+			return selected[a].start < selected[b].start || (selected[a].start == selected[b].start && selected[a].end > selected[b].end)
+		})
+		for _, entity := range selected {
+			startByte, endByte := inputWords[entity.start].start, inputWords[entity.end].end
+			output.Entities[i] = append(output.Entities[i], Entity{
+				Entity: labels[entity.label],
+				Score:  entity.score,
+				Index:  entity.start,
+				Word:   inputs[i][startByte:endByte],
+				Start:  uint(startByte),
+				End:    uint(endByte),
+			})
+		}
+	}
+	return output, nil
+}
+
+// Run the pipeline on a batch of strings, with the entity types of the pipeline.
+func (p *ZeroShotNERPipeline) Run(inputs []string) (PipelineBatchOutput, error) {
+	return p.RunPipeline(inputs)
+}
+
+// RunPipeline is like Run, but returns the concrete zero shot NER output type rather than the interface.
+func (p *ZeroShotNERPipeline) RunPipeline(inputs []string) (*ZeroShotNEROutput, error) {
+	return p.RunWithLabels(inputs, p.Labels)
+}
+
+// RunWithLabels extracts the entities of the given types from the inputs.
+func (p *ZeroShotNERPipeline) RunWithLabels(inputs []string, labels []string) (output *ZeroShotNEROutput, err error) {
+	if len(labels) == 0 {
+		return nil, errors.New("no entity types to extract, set them with WithEntityLabels")
+	}
+	if len(inputs) == 0 {
+		return &ZeroShotNEROutput{}, nil
+	}
+	tensors, err := p.Preprocess(inputs, labels)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, tensor := range tensors {
+			err = errors.Join(err, tensor.Destroy())
+		}
+	}()
+	logits, shape, err := p.Forward(tensors)
+	if err != nil {
+		return nil, err
+	}
+	return p.Postprocess(inputs, labels, logits, shape)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// CacheFlusher is implemented by pipelines that cache results, so that the admin API can flush their cache.
+type CacheFlusher interface {
+	FlushCache()
+}
+
+// RouteStats are the runtime statistics of the pipeline of a route.
+type RouteStats struct {
+	Pipeline string                 `json:"pipeline"` // name of the pipeline in the session
+	Stats    []string               `json:"stats"`
+	Memory   *pipelines.MemoryStats `json:"memory,omitempty"`
+}
+
+// AdminResponse is the body of the responses of the admin handler.
+type AdminResponse struct {
+	Models []RouteConfig         `json:"models,omitempty"`
+	Routes []string              `json:"routes,omitempty"` // routes warmed up or flushed
+	Stats  map[string]RouteStats `json:"stats,omitempty"`
+	Error  string                `json:"error,omitempty"`
+}
+
+// Warmup runs the warmup inputs of the route on the given path, or of all the routes if the path is empty, and
+// returns the paths of the routes warmed up.
+func (r *Router) Warmup(path string) ([]string, error) {
+	routes := r.acquireAll()
+	defer release(routes)
+	if path != "" {
+		if _, ok := routes[path]; !ok {
+			return nil, &routeNotFoundError{path: path}
+		}
+	}
+	var warmed []string
+	var warmupErrors []error
+	for routePath, servedRoute := range routes {
+		if (path != "" && routePath != path) || len(servedRoute.config.Warmup) == 0 {
+			continue
+		}
+		if err := servedRoute.warmup(); err != nil {
+			warmupErrors = append(warmupErrors, fmt.Errorf("cannot warm up route %s: %w", routePath, err))
+			continue
+		}
+		warmed = append(warmed, routePath)
+	}
+	sort.Strings(warmed)
+	return warmed, errors.Join(warmupErrors...)
+}
+
+// FlushCaches flushes the response caches of the routes and the cache of the pipelines that implement
+// CacheFlusher, and returns the paths of their routes.
+func (r *Router) FlushCaches() []string {
+	routes := r.acquireAll()
+	defer release(routes)
+	var flushed []string
+	for path, servedRoute := range routes {
+		flusher, ok := servedRoute.pipeline.(CacheFlusher)
+		if ok {
+			flusher.FlushCache()
+		}
+		if servedRoute.cache != nil {
+			servedRoute.cache.FlushCache()
+		}
+		if ok || servedRoute.cache != nil {
+			flushed = append(flushed, path)
+		}
+	}
+	sort.Strings(flushed)
+	return flushed
+}
+
+// Stats returns the runtime statistics of the pipeline of each route, by path.
+func (r *Router) Stats() map[string]RouteStats {
+	routes := r.acquireAll()
+	defer release(routes)
+	stats := make(map[string]RouteStats, len(routes))
+	for path, servedRoute := range routes {
+		routeStats := RouteStats{Pipeline: servedRoute.sessionName, Stats: servedRoute.pipeline.GetStats()}
+		if memoryPipeline, ok := servedRoute.pipeline.(interface{ GetMemoryStats() pipelines.MemoryStats }); ok {
+			memory := memoryPipeline.GetMemoryStats()
+			routeStats.Memory = &memory
+		}
+		stats[path] = routeStats
+	}
+	return stats
+}
+
+func release(routes map[string]*route) {
+	for _, servedRoute := range routes {
+		servedRoute.inFlight.Done()
+	}
+}
+
+// BearerToken authorizes the requests with an "Authorization: Bearer <token>" header. An empty token rejects
+// all the requests.
+func BearerToken(token string) func(r *http.Request) bool {
+	expected := []byte("Bearer " + token)
+	return func(r *http.Request) bool {
+		return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+	}
+}
+
+// NewAdminHandler returns the handler of the admin API of a router, for operators to manage the served models
+// at runtime as with a model server. Requests are rejected unless authorize accepts them, e.g. with
+// BearerToken(token). The API is:
+//
+//	GET    /models            the routes and the specs of their pipelines
+//	POST   /models            load a pipeline, with a RouteConfig body
+//	DELETE /models/{path}     unload the pipeline of a route
+//	POST   /reload            reload the configuration file
+//	POST   /warmup?path=      run the warmup inputs of a route, or of all routes without path
+//	POST   /cache/flush       flush the caches of the pipelines
+//	GET    /stats             runtime and memory statistics of the pipelines
+//
+// Mount it on its own prefix, e.g. mux.Handle("/admin/", http.StripPrefix("/admin", admin)).
+func NewAdminHandler(router *Router, authorize func(r *http.Request) bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /models", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, AdminResponse{Models: router.RouteConfigs()})
+	})
+	mux.HandleFunc("POST /models", func(w http.ResponseWriter, request *http.Request) {
+		var routeConfig RouteConfig
+		if err := json.NewDecoder(request.Body).Decode(&routeConfig); err != nil {
+			writeJSON(w, http.StatusBadRequest, AdminResponse{Error: fmt.Sprintf("invalid request: %s", err)})
+			return
+		}
+		if err := router.LoadRoute(routeConfig); err != nil {
+			writeJSON(w, http.StatusInternalServerError, AdminResponse{Models: router.RouteConfigs(), Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, AdminResponse{Models: router.RouteConfigs()})
+	})
+	mux.HandleFunc("DELETE /models/{path...}", func(w http.ResponseWriter, request *http.Request) {
+		err := router.UnloadRoute("/" + request.PathValue("path"))
+		var notFound *routeNotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			writeJSON(w, http.StatusNotFound, AdminResponse{Error: err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, AdminResponse{Models: router.RouteConfigs(), Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, AdminResponse{Models: router.RouteConfigs()})
+		}
+	})
+	mux.Handle("/reload", router.ReloadHandler())
+	mux.HandleFunc("POST /warmup", func(w http.ResponseWriter, request *http.Request) {
+		warmed, err := router.Warmup(request.URL.Query().Get("path"))
+		var notFound *routeNotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			writeJSON(w, http.StatusNotFound, AdminResponse{Error: err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, AdminResponse{Routes: warmed, Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, AdminResponse{Routes: warmed})
+		}
+	})
+	mux.HandleFunc("POST /cache/flush", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, AdminResponse{Routes: router.FlushCaches()})
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, AdminResponse{Stats: router.Stats()})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		if authorize == nil || !authorize(request) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, AdminResponse{Error: "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, request)
+	})
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot/pipelines"
+	"github.com/knights-analytics/hugot/workers"
+)
+
+// cachedPipeline is a test pipeline with a cache to flush.
+type cachedPipeline struct {
+	upperPipeline
+	flushes int
+}
+
+func (p *cachedPipeline) FlushCache() {
+	p.flushes++
+}
+
+func TestAdminHandler(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(configPath, []byte(`{"routes": [
+		{"pipeline": {"name": "sentiment", "type": "textClassification"}, "warmup": ["warm"]},
+		{"pipeline": {"name": "cached", "type": "featureExtraction"}}
+	]}`), 0o600))
+	var destroyed []string
+	cached := &cachedPipeline{}
+	router := &Router{
+		ConfigPath: configPath,
+		createPipeline: func(spec workers.PipelineSpec) (pipelines.Pipeline, error) {
+			if spec.Type == "featureExtraction" {
+				return cached, nil
+			}
+			return &upperPipeline{}, nil
+		},
+		destroyPipeline: func(name string) error {
+			destroyed = append(destroyed, name)
+			return nil
+		},
+		routes: map[string]*route{},
+	}
+	assert.NoError(t, router.Reload())
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", NewAdminHandler(router, BearerToken("secret"))))
+	mux.Handle("/", router)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	call := func(method string, path string, token string, body string) (int, string) {
+		request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		responseBody, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		return response.StatusCode, string(responseBody)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		status, body := call(http.MethodGet, "/admin/models", token, ``)
+		assert.Equal(t, http.StatusUnauthorized, status)
+		assert.JSONEq(t, `{"error":"unauthorized"}`, body)
+	}
+
+	status, body := call(http.MethodGet, "/admin/models", "secret", ``)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"path":"/cached"`)
+	assert.Contains(t, body, `"path":"/sentiment"`)
+
+	// load a model on a new route, and unload it
+	status, _ = call(http.MethodPost, "/admin/models", "secret", `{"path": "/v2/sentiment", "pipeline": {"name": "sentiment", "type": "textClassification"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	status, body = call(http.MethodPost, "/v2/sentiment", "", `{"inputs": ["a"]}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"outputs":["A"]}`, body)
+	status, _ = call(http.MethodDelete, "/admin/models/v2/sentiment", "secret", ``)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"sentiment@3"}, destroyed)
+	assert.Equal(t, []string{"/cached", "/sentiment"}, router.Routes())
+	status, body = call(http.MethodDelete, "/admin/models/v2/sentiment", "secret", ``)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"error":"no pipeline is served on /v2/sentiment"}`, body)
+
+	// warmup, cache flushing and stats
+	status, body = call(http.MethodPost, "/admin/warmup", "secret", ``)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"routes":["/sentiment"]}`, body)
+	status, _ = call(http.MethodPost, "/admin/warmup?path=/missing", "secret", ``)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, body = call(http.MethodPost, "/admin/cache/flush", "secret", ``)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"routes":["/cached"]}`, body)
+	assert.Equal(t, 1, cached.flushes)
+	status, body = call(http.MethodGet, "/admin/stats", "secret", ``)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"stats":{"/cached":{"pipeline":"cached@2","stats":null},"/sentiment":{"pipeline":"sentiment@1","stats":null}}}`, body)
+
+	// reloading drops the routes loaded through the API
+	status, _ = call(http.MethodPost, "/admin/models", "secret", `{"pipeline": {"name": "extra", "type": "textClassification"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/cached", "/extra", "/sentiment"}, router.Routes())
+	status, body = call(http.MethodPost, "/admin/reload", "secret", ``)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"routes":["/cached","/sentiment"]}`, body)
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator identifies the client of a request, and reports whether the request is authenticated.
+type Authenticator func(r *http.Request) (client string, ok bool)
+
+// APIKeys authenticates the requests with an API key, sent as "Authorization: Bearer <key>" or in an X-API-Key
+// header. keys maps each API key to the name of its client, which is used for quotas, usage and audit logs.
+func APIKeys(keys map[string]string) Authenticator {
+	return func(r *http.Request) (string, bool) {
+		key := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = bearer
+		}
+		if key == "" {
+			return "", false
+		}
+		// every key is compared so that the time taken does not depend on which key matches
+		client, found := "", false
+		for candidate, name := range keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+				client, found = name, true
+			}
+		}
+		return client, found
+	}
+}
+
+// ClientCertificate authenticates the requests with the TLS client certificate verified by the server (mTLS), and
+// identifies the client by the common name of the certificate. The server must verify client certificates, e.g.
+// with tls.Config.ClientAuth set to tls.RequireAndVerifyClientCert.
+func ClientCertificate() Authenticator {
+	return func(r *http.Request) (string, bool) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			return "", false
+		}
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+}
+
+// AnyOf authenticates the requests with the first authenticator that accepts them, e.g. to accept both API keys
+// and client certificates.
+func AnyOf(authenticators ...Authenticator) Authenticator {
+	return func(r *http.Request) (string, bool) {
+		for _, authenticate := range authenticators {
+			if client, ok := authenticate(r); ok {
+				return client, true
+			}
+		}
+		return "", false
+	}
+}
+
+// Quota limits the requests of a client. Zero values are not limited.
+type Quota struct {
+	RequestsPerSecond float64       // sustained request rate
+	Burst             int           // requests allowed at once above the rate, 1 by default
+	MaxInputs         int64         // inputs allowed per period
+	Period            time.Duration // period of MaxInputs, a day by default
+}
+
+// Usage counts the requests of a client.
+type Usage struct {
+	Requests uint64 `json:"requests"` // requests let through
+	Inputs   uint64 `json:"inputs"`   // inputs of the requests let through
+	Rejected uint64 `json:"rejected"` // requests rejected by the quota of the client
+}
+
+type clientUsage struct {
+	Usage
+	tokens       float64 // requests available in the rate bucket
+	refilledAt   time.Time
+	periodStart  time.Time
+	periodInputs int64
+}
+
+// AccessControl is a middleware that authenticates the requests to pipeline handlers and enforces a quota per client,
+// so that the pipelines can be exposed to several teams without a gateway in front of them. Requests that are not
+// authenticated get a 401, and requests over the quota of their client a 429 with a Retry-After header. The client
+// is set as the actor of the request, see WithActor, so that audited pipelines record it. The bodies of the
+// requests are read to count their inputs before the limits of WithLimits apply, up to MaxBodyBytes, and larger
+// ones get a 413.
+type AccessControl struct {
+	Authenticate Authenticator
+	DefaultQuota Quota            // quota of the clients without their own
+	Quotas       map[string]Quota // quota of each client
+	MaxBodyBytes int64            // size of the request bodies, 10 MiB by default and if zero
+
+	mutex sync.Mutex
+	usage map[string]*clientUsage
+}
+
+// NewAccessControl creates an access control with a default quota for all the clients.
+func NewAccessControl(authenticate Authenticator, defaultQuota Quota) *AccessControl {
+	return &AccessControl{Authenticate: authenticate, DefaultQuota: defaultQuota, Quotas: map[string]Quota{}, usage: map[string]*clientUsage{}}
+}
+
+// Usage returns the usage counters of each client.
+func (a *AccessControl) Usage() map[string]Usage {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	usage := make(map[string]Usage, len(a.usage))
+	for client, counters := range a.usage {
+		usage[client] = counters.Usage
+	}
+	return usage
+}
+
+// UsageHandler returns a handler that responds with the usage counters of each client as JSON. Like the admin
+// API, it should only be exposed to administrators.
+func (a *AccessControl) UsageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, a.Usage())
+	})
+}
+
+// Middleware authenticates the requests and enforces the quotas before the next handler.
+func (a *AccessControl) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, ok := "", false
+		if a.Authenticate != nil {
+			client, ok = a.Authenticate(r)
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeResponse(w, http.StatusUnauthorized, Response{Error: "unauthorized"})
+			return
+		}
+		inputs, err := countInputs(w, r, a.maxBodyBytes())
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeResponse(w, http.StatusRequestEntityTooLarge, Response{
+					Error: fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit),
+					Code:  ErrorBodyTooLarge,
+				})
+				return
+			}
+			writeResponse(w, http.StatusBadRequest, Response{Error: "invalid request: " + err.Error()})
+			return
+		}
+		if retryAfter, reason := a.admit(client, inputs, time.Now()); reason != "" {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeResponse(w, http.StatusTooManyRequests, Response{Error: reason})
+			return
+		}
+		WithActor(func(*http.Request) string { return client })(next).ServeHTTP(w, r)
+	})
+}
+
+// defaultMaxBodyBytes is the size of the request bodies read by an AccessControl without MaxBodyBytes.
+const defaultMaxBodyBytes = 10 << 20
+
+func (a *AccessControl) maxBodyBytes() int64 {
+	if a.MaxBodyBytes > 0 {
+		return a.MaxBodyBytes
+	}
+	return defaultMaxBodyBytes
+}
+
+// countInputs counts the inputs of the JSON Request body of a POST request of up to maxBodyBytes bytes, and leaves
+// the body to be read again. Bodies that are not a valid request count as no inputs, and are rejected by the
+// pipeline handler.
+func countInputs(w http.ResponseWriter, r *http.Request, maxBodyBytes int64) (int64, error) {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return 0, nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		return 0, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	request := Request{}
+	if json.Unmarshal(body, &request) != nil {
+		return 0, nil
+	}
+	return int64(len(request.Inputs)), nil
+}
+
+// admit counts a request of the client with its inputs if its quota allows it. Otherwise, it returns the time
+// after which the request can be retried and the reason for the rejection.
+func (a *AccessControl) admit(client string, inputs int64, now time.Time) (time.Duration, string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	quota, ok := a.Quotas[client]
+	if !ok {
+		quota = a.DefaultQuota
+	}
+	burst := float64(max(quota.Burst, 1))
+	usage, ok := a.usage[client]
+	if !ok {
+		usage = &clientUsage{tokens: burst, refilledAt: now, periodStart: now}
+		if a.usage == nil {
+			a.usage = map[string]*clientUsage{}
+		}
+		a.usage[client] = usage
+	}
+
+	if quota.RequestsPerSecond > 0 {
+		usage.tokens = min(burst, usage.tokens+now.Sub(usage.refilledAt).Seconds()*quota.RequestsPerSecond)
+		usage.refilledAt = now
+		if usage.tokens < 1 {
+			usage.Rejected++
+			return time.Duration((1 - usage.tokens) / quota.RequestsPerSecond * float64(time.Second)), "rate limit exceeded"
+		}
+	}
+	if quota.MaxInputs > 0 {
+		period := quota.Period
+		if period <= 0 {
+			period = 24 * time.Hour
+		}
+		if now.Sub(usage.periodStart) >= period {
+			usage.periodStart = now
+			usage.periodInputs = 0
+		}
+		if usage.periodInputs+inputs > quota.MaxInputs {
+			usage.Rejected++
+			return usage.periodStart.Add(period).Sub(now), "input quota exceeded"
+		}
+		usage.periodInputs += inputs
+	}
+	if quota.RequestsPerSecond > 0 {
+		usage.tokens--
+	}
+	usage.Requests++
+	usage.Inputs += uint64(inputs)
+	return 0, ""
+}
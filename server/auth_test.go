@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessControl(t *testing.T) {
+	access := NewAccessControl(APIKeys(map[string]string{"key-a": "team-a", "key-b": "team-b"}), Quota{MaxInputs: 3})
+	access.Quotas["team-b"] = Quota{RequestsPerSecond: 0.001, Burst: 2}
+	var actors []string
+	handler := access.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actors = append(actors, ActorFromContext(r.Context()))
+		NewPipelineHandler(&upperPipeline{}).ServeHTTP(w, r)
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	post := func(header string, value string, body string) *http.Response {
+		request, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		assert.NoError(t, err)
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		return response
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("", "", `{"inputs": ["a"]}`).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, post("X-API-Key", "wrong", `{"inputs": ["a"]}`).StatusCode)
+
+	// team-a can send 3 inputs a day
+	assert.Equal(t, http.StatusOK, post("Authorization", "Bearer key-a", `{"inputs": ["a", "b"]}`).StatusCode)
+	response := post("X-API-Key", "key-a", `{"inputs": ["c", "d"]}`)
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.NotEmpty(t, response.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, post("X-API-Key", "key-a", `{"inputs": ["c"]}`).StatusCode)
+
+	// team-b can send a burst of 2 requests
+	assert.Equal(t, http.StatusOK, post("X-API-Key", "key-b", `{"inputs": ["a"]}`).StatusCode)
+	assert.Equal(t, http.StatusOK, post("X-API-Key", "key-b", `{"inputs": ["a"]}`).StatusCode)
+	response = post("X-API-Key", "key-b", `{"inputs": ["a"]}`)
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.Equal(t, "1000", response.Header.Get("Retry-After"))
+
+	assert.Equal(t, []string{"team-a", "team-a", "team-b", "team-b"}, actors)
+	assert.Equal(t, map[string]Usage{
+		"team-a": {Requests: 2, Inputs: 3, Rejected: 1},
+		"team-b": {Requests: 2, Inputs: 2, Rejected: 1},
+	}, access.Usage())
+}
+
+func TestAccessControlBodyLimit(t *testing.T) {
+	access := NewAccessControl(APIKeys(map[string]string{"key-a": "team-a"}), Quota{})
+	access.MaxBodyBytes = 32
+	handler := access.Middleware(NewPipelineHandler(&upperPipeline{}))
+	post := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		request.Header.Set("X-API-Key", "key-a")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusOK, post(`{"inputs": ["a", "b"]}`).Code)
+	response := post(`{"inputs": ["` + strings.Repeat("a", 64) + `"]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+	assert.Contains(t, response.Body.String(), ErrorBodyTooLarge)
+	assert.Equal(t, map[string]Usage{"team-a": {Requests: 1, Inputs: 2}}, access.Usage())
+	assert.Equal(t, int64(defaultMaxBodyBytes), NewAccessControl(nil, Quota{}).maxBodyBytes())
+}
+
+func TestAccessControlPeriod(t *testing.T) {
+	access := NewAccessControl(nil, Quota{MaxInputs: 2, Period: time.Minute})
+	start := time.Now()
+	_, reason := access.admit("client", 2, start)
+	assert.Empty(t, reason)
+	retryAfter, reason := access.admit("client", 1, start.Add(20*time.Second))
+	assert.Equal(t, "input quota exceeded", reason)
+	assert.Equal(t, 40*time.Second, retryAfter)
+	_, reason = access.admit("client", 1, start.Add(time.Minute))
+	assert.Empty(t, reason)
+}
+
+func TestClientCertificate(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/", nil)
+	_, ok := ClientCertificate()(request)
+	assert.False(t, ok)
+	request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "team-c"}}}}}
+	client, ok := AnyOf(APIKeys(nil), ClientCertificate())(request)
+	assert.True(t, ok)
+	assert.Equal(t, "team-c", client)
+}
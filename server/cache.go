@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache caches the successful responses of pipeline handlers, keyed on the hash of the request path and
+// body, e.g. for idempotent embedding endpoints. Responses carry standard cache headers, so that CDNs and clients
+// can cache them too: Cache-Control with the TTL as max-age, an ETag, and an Age for cached responses, and requests
+// with a matching If-None-Match get a 304 Not Modified. Requests with "Cache-Control: no-cache" skip the cache.
+// The X-Cache header of the responses is HIT or MISS. It implements CacheFlusher.
+type ResponseCache struct {
+	TTL        time.Duration
+	MaxEntries int // least recently used responses are evicted beyond MaxEntries, 0 for no limit
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+}
+
+type cachedResponse struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	etag   string
+	stored time.Time
+}
+
+// NewResponseCache creates a cache of at most maxEntries responses that expire after ttl.
+func NewResponseCache(ttl time.Duration, maxEntries int) *ResponseCache {
+	return &ResponseCache{TTL: ttl, MaxEntries: maxEntries, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// Middleware caches the responses of the next handler.
+func (c *ResponseCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, Response{Error: fmt.Sprintf("invalid request: %s", err.Error())})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(r.URL.Path))
+		hash.Write([]byte{0})
+		hash.Write(body)
+		key := hex.EncodeToString(hash.Sum(nil))
+
+		noCache := strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+		if !noCache {
+			if cached := c.get(key); cached != nil {
+				c.write(w, r, cached, "HIT")
+				return
+			}
+		}
+		recorder := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		response := &cachedResponse{key: key, status: recorder.status, header: recorder.header, body: recorder.body.Bytes(), stored: time.Now()}
+		if response.status != http.StatusOK {
+			copyHeader(w.Header(), response.header)
+			w.WriteHeader(response.status)
+			_, _ = w.Write(response.body)
+			return
+		}
+		bodyHash := sha256.Sum256(response.body)
+		response.etag = `"` + hex.EncodeToString(bodyHash[:16]) + `"`
+		c.put(response)
+		c.write(w, r, response, "MISS")
+	})
+}
+
+// write writes a cached response with its cache headers, or 304 Not Modified if the client has it.
+func (c *ResponseCache) write(w http.ResponseWriter, r *http.Request, response *cachedResponse, status string) {
+	header := w.Header()
+	copyHeader(header, response.header)
+	age := time.Since(response.stored)
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", max(int((c.TTL-age).Seconds()), 0)))
+	header.Set("ETag", response.etag)
+	header.Set("X-Cache", status)
+	if status == "HIT" {
+		header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	}
+	if r.Header.Get("If-None-Match") == response.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(response.status)
+	// the status is already sent, an error here means the client went away
+	_, _ = w.Write(response.body)
+}
+
+func (c *ResponseCache) get(key string) *cachedResponse {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	response := element.Value.(*cachedResponse)
+	if time.Since(response.stored) >= c.TTL {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return response
+}
+
+func (c *ResponseCache) put(response *cachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[response.key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[response.key] = c.order.PushFront(response)
+	for c.MaxEntries > 0 && c.order.Len() > c.MaxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// Len returns the number of cached responses, expired ones included until they are requested again or evicted.
+func (c *ResponseCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// FlushCache removes all the cached responses.
+func (c *ResponseCache) FlushCache() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// responseRecorder buffers the response of a handler.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+func copyHeader(destination http.Header, source http.Header) {
+	for name, values := range source {
+		destination[name] = values
+	}
+}
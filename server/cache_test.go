@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot/pipelines"
+	"github.com/knights-analytics/hugot/workers"
+)
+
+func TestResponseCache(t *testing.T) {
+	pipeline := &countingPipeline{}
+	cache := NewResponseCache(time.Minute, 2)
+	server := httptest.NewServer(cache.Middleware(NewPipelineHandler(pipeline)))
+	defer server.Close()
+	post := func(body string, header map[string]string) (*http.Response, string) {
+		request, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+		assert.NoError(t, err)
+		for name, value := range header {
+			request.Header.Set(name, value)
+		}
+		response, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		responseBody, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		return response, string(responseBody)
+	}
+
+	response, body := post(`{"inputs": ["a"]}`, nil)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.JSONEq(t, `{"outputs":["A"]}`, body)
+	assert.Equal(t, "MISS", response.Header.Get("X-Cache"))
+	assert.Equal(t, "public, max-age=60", response.Header.Get("Cache-Control"))
+	etag := response.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	response, body = post(`{"inputs": ["a"]}`, nil)
+	assert.JSONEq(t, `{"outputs":["A"]}`, body)
+	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	assert.Equal(t, "0", response.Header.Get("Age"))
+	assert.Equal(t, etag, response.Header.Get("ETag"))
+	assert.Equal(t, 1, pipeline.batches)
+
+	// the client already has the response
+	response, body = post(`{"inputs": ["a"]}`, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, response.StatusCode)
+	assert.Empty(t, body)
+
+	// no-cache runs the pipeline again
+	response, _ = post(`{"inputs": ["a"]}`, map[string]string{"Cache-Control": "no-cache"})
+	assert.Equal(t, "MISS", response.Header.Get("X-Cache"))
+	assert.Equal(t, 2, pipeline.batches)
+
+	// errors are not cached
+	for range 2 {
+		response, _ = post(`{"inputs": ["fail"]}`, nil)
+		assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+		assert.Empty(t, response.Header.Get("X-Cache"))
+	}
+	assert.Equal(t, 1, cache.Len())
+
+	// the least recently used response is evicted
+	post(`{"inputs": ["b"]}`, nil)
+	post(`{"inputs": ["a"]}`, nil)
+	post(`{"inputs": ["c"]}`, nil)
+	assert.Equal(t, 2, cache.Len())
+	response, _ = post(`{"inputs": ["a"]}`, nil)
+	assert.Equal(t, "HIT", response.Header.Get("X-Cache"))
+	response, _ = post(`{"inputs": ["b"]}`, nil)
+	assert.Equal(t, "MISS", response.Header.Get("X-Cache"))
+
+	cache.FlushCache()
+	assert.Equal(t, 0, cache.Len())
+	response, _ = post(`{"inputs": ["a"]}`, nil)
+	assert.Equal(t, "MISS", response.Header.Get("X-Cache"))
+}
+
+func TestRouterResponseCache(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(configPath, []byte(`{"routes": [
+		{"pipeline": {"name": "embeddings", "type": "featureExtraction"}, "cacheTTL": 60},
+		{"pipeline": {"name": "sentiment", "type": "textClassification"}}
+	]}`), 0o600))
+	router := &Router{
+		ConfigPath: configPath,
+		createPipeline: func(spec workers.PipelineSpec) (pipelines.Pipeline, error) {
+			return &countingPipeline{}, nil
+		},
+		destroyPipeline: func(name string) error { return nil },
+		routes:          map[string]*route{},
+	}
+	assert.NoError(t, router.Reload())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	post := func(path string) string {
+		response, err := http.Post(server.URL+path, "application/json", strings.NewReader(`{"inputs": ["a"]}`))
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		return response.Header.Get("X-Cache")
+	}
+
+	assert.Equal(t, "MISS", post("/embeddings"))
+	assert.Equal(t, "HIT", post("/embeddings"))
+	assert.Empty(t, post("/sentiment"))
+	assert.Equal(t, []string{"/embeddings"}, router.FlushCaches())
+	assert.Equal(t, "MISS", post("/embeddings"))
+	assert.NoError(t, router.Close())
+}
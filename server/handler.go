@@ -0,0 +1,143 @@
+// Package server serves hugot pipelines over HTTP. The handlers and middleware only depend on net/http, so they
+// can be mounted in any Go web framework: directly in chi or the standard library mux, with echo.WrapHandler and
+// echo.WrapMiddleware in echo, or with the adaptor package in fiber.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// Request is the body of a request to a pipeline handler.
+type Request struct {
+	Inputs    []string `json:"inputs"`
+	InputType string   `json:"inputType,omitempty"` // query or document, to embed the inputs with the query or document prefix of an embedding pipeline
+}
+
+// Response is the body of the response of a pipeline handler, with one output per input.
+type Response struct {
+	Outputs []any  `json:"outputs,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`  // code of the error of a request over the limits, see WithLimits
+	Input   *int   `json:"input,omitempty"` // index of the input the error is about
+}
+
+type pipelineContextKey struct{}
+
+type actorContextKey struct{}
+
+// actorPipeline is implemented by pipelines that record who runs them, such as pipelines.AuditedPipeline.
+type actorPipeline interface {
+	RunAs(actor string, inputs []string) (pipelines.PipelineBatchOutput, error)
+}
+
+// prefixedEmbedder is implemented by embedding pipelines that prefix queries and documents differently, such as
+// pipelines.FeatureExtractionPipeline.
+type prefixedEmbedder interface {
+	EmbedQueries(queries []string) (*pipelines.FeatureExtractionOutput, error)
+	EmbedDocuments(documents []string) (*pipelines.FeatureExtractionOutput, error)
+}
+
+// NewPipelineHandler returns a handler that runs the pipeline on the inputs of POST requests with a JSON Request body,
+// and responds with a JSON Response. If pipeline is nil, the pipeline bound to the request by WithPipeline is used,
+// so that a single handler can serve a different pipeline on each route. Requests with an input type embed their
+// inputs as queries or documents, with the prefixes of the embedding pipeline.
+func NewPipelineHandler(pipeline pipelines.Pipeline) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeResponse(w, http.StatusMethodNotAllowed, Response{Error: fmt.Sprintf("method %s not allowed", r.Method)})
+			return
+		}
+		p := pipeline
+		if p == nil {
+			p = PipelineFromContext(r.Context())
+		}
+		if p == nil {
+			writeResponse(w, http.StatusInternalServerError, Response{Error: "no pipeline is bound to this route"})
+			return
+		}
+		request := Request{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeResponse(w, http.StatusBadRequest, Response{Error: fmt.Sprintf("invalid request: %s", err.Error())})
+			return
+		}
+		if len(request.Inputs) == 0 {
+			writeResponse(w, http.StatusBadRequest, Response{Error: "invalid request: no inputs"})
+			return
+		}
+		var output pipelines.PipelineBatchOutput
+		var err error
+		embedder, isEmbedder := p.(prefixedEmbedder)
+		switch {
+		case request.InputType != "" && request.InputType != "query" && request.InputType != "document":
+			writeResponse(w, http.StatusBadRequest, Response{Error: fmt.Sprintf("invalid request: input type %s is not query or document", request.InputType)})
+			return
+		case request.InputType != "" && !isEmbedder:
+			writeResponse(w, http.StatusBadRequest, Response{Error: "invalid request: the pipeline does not embed queries and documents"})
+			return
+		case request.InputType == "query":
+			output, err = embedder.EmbedQueries(request.Inputs)
+		case request.InputType == "document":
+			output, err = embedder.EmbedDocuments(request.Inputs)
+		default:
+			if audited, ok := p.(actorPipeline); ok {
+				output, err = audited.RunAs(ActorFromContext(r.Context()), request.Inputs)
+			} else {
+				output, err = p.Run(request.Inputs)
+			}
+		}
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, Response{Error: err.Error()})
+			return
+		}
+		writeResponse(w, http.StatusOK, Response{Outputs: output.GetOutput()})
+	})
+}
+
+// WithPipeline is a middleware that binds a pipeline to the requests of a route, for handlers created with
+// NewPipelineHandler(nil) or custom handlers using PipelineFromContext.
+func WithPipeline(pipeline pipelines.Pipeline) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pipelineContextKey{}, pipeline)))
+		})
+	}
+}
+
+// PipelineFromContext returns the pipeline bound to a request by WithPipeline, or nil.
+func PipelineFromContext(ctx context.Context) pipelines.Pipeline {
+	pipeline, _ := ctx.Value(pipelineContextKey{}).(pipelines.Pipeline)
+	return pipeline
+}
+
+// WithActor is a middleware that identifies who sends the requests of a route, e.g. from the authenticated user or
+// client certificate, so that audited pipelines record it in their audit log.
+func WithActor(actor func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorContextKey{}, actor(r))))
+		})
+	}
+}
+
+// ActorFromContext returns the actor of a request set by WithActor, or the empty string.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+func writeResponse(w http.ResponseWriter, status int, response Response) {
+	writeJSON(w, status, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// the status is already sent, an error here means the client went away
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// upperPipeline is a test pipeline that upper-cases its inputs.
+type upperPipeline struct{}
+
+type upperOutput struct {
+	outputs []string
+}
+
+func (o *upperOutput) GetOutput() []any {
+	out := make([]any, len(o.outputs))
+	for i, output := range o.outputs {
+		out[i] = output
+	}
+	return out
+}
+
+func (p *upperPipeline) Destroy() error                          { return nil }
+func (p *upperPipeline) GetStats() []string                      { return nil }
+func (p *upperPipeline) Validate() error                         { return nil }
+func (p *upperPipeline) GetMetadata() pipelines.PipelineMetadata { return pipelines.PipelineMetadata{} }
+func (p *upperPipeline) Run(inputs []string) (pipelines.PipelineBatchOutput, error) {
+	output := &upperOutput{}
+	for _, input := range inputs {
+		if input == "fail" {
+			return nil, errors.New("pipeline failure")
+		}
+		output.outputs = append(output.outputs, strings.ToUpper(input))
+	}
+	return output, nil
+}
+
+// prefixPipeline is a test embedding pipeline whose embedding of an input is its length, after its prefix.
+type prefixPipeline struct {
+	upperPipeline
+}
+
+func (p *prefixPipeline) embed(inputs []string, prefix string) (*pipelines.FeatureExtractionOutput, error) {
+	output := &pipelines.FeatureExtractionOutput{}
+	for _, input := range inputs {
+		output.Embeddings = append(output.Embeddings, []float32{float32(len(prefix + input))})
+	}
+	return output, nil
+}
+
+func (p *prefixPipeline) EmbedQueries(queries []string) (*pipelines.FeatureExtractionOutput, error) {
+	return p.embed(queries, "query: ")
+}
+
+func (p *prefixPipeline) EmbedDocuments(documents []string) (*pipelines.FeatureExtractionOutput, error) {
+	return p.embed(documents, "passage: ")
+}
+
+func TestPipelineHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/direct", NewPipelineHandler(&upperPipeline{}))
+	mux.Handle("/bound", WithPipeline(&upperPipeline{})(NewPipelineHandler(nil)))
+	mux.Handle("/unbound", NewPipelineHandler(nil))
+	mux.Handle("/embed", NewPipelineHandler(&prefixPipeline{}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, test := range []struct {
+		path     string
+		method   string
+		body     string
+		status   int
+		expected string
+	}{
+		{"/direct", http.MethodPost, `{"inputs": ["a", "b"]}`, http.StatusOK, `{"outputs":["A","B"]}`},
+		{"/bound", http.MethodPost, `{"inputs": ["c"]}`, http.StatusOK, `{"outputs":["C"]}`},
+		{"/unbound", http.MethodPost, `{"inputs": ["c"]}`, http.StatusInternalServerError, `{"error":"no pipeline is bound to this route"}`},
+		{"/direct", http.MethodGet, ``, http.StatusMethodNotAllowed, `{"error":"method GET not allowed"}`},
+		{"/direct", http.MethodPost, `{"inputs": []}`, http.StatusBadRequest, `{"error":"invalid request: no inputs"}`},
+		{"/direct", http.MethodPost, `{"inputs": ["fail"]}`, http.StatusInternalServerError, `{"error":"pipeline failure"}`},
+		{"/embed", http.MethodPost, `{"inputs": ["ab"]}`, http.StatusOK, `{"outputs":["AB"]}`},
+		{"/embed", http.MethodPost, `{"inputs": ["ab"], "inputType": "query"}`, http.StatusOK, `{"outputs":[[9]]}`},
+		{"/embed", http.MethodPost, `{"inputs": ["ab"], "inputType": "document"}`, http.StatusOK, `{"outputs":[[11]]}`},
+		{"/embed", http.MethodPost, `{"inputs": ["ab"], "inputType": "passage"}`, http.StatusBadRequest, `{"error":"invalid request: input type passage is not query or document"}`},
+		{"/direct", http.MethodPost, `{"inputs": ["ab"], "inputType": "query"}`, http.StatusBadRequest, `{"error":"invalid request: the pipeline does not embed queries and documents"}`},
+	} {
+		request, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		assert.NoError(t, err)
+		response, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		body := new(strings.Builder)
+		_, err = io.Copy(body, response.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		assert.Equal(t, test.status, response.StatusCode, test.path)
+		assert.JSONEq(t, test.expected, body.String(), test.path)
+	}
+}
+
+func TestAuditedPipelineHandler(t *testing.T) {
+	log := new(strings.Builder)
+	audited, err := pipelines.NewAuditedPipeline(&upperPipeline{}, "upper", "v1", pipelines.NewAuditLog(log, nil))
+	assert.NoError(t, err)
+	handler := WithActor(func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	})(NewPipelineHandler(audited))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	request, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(`{"inputs": ["secret"]}`))
+	assert.NoError(t, err)
+	request.Header.Set("X-User", "alice")
+	response, err := http.DefaultClient.Do(request)
+	assert.NoError(t, err)
+	assert.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Contains(t, log.String(), `"actor":"alice"`)
+	assert.Contains(t, log.String(), `"pipeline":"upper"`)
+	assert.NotContains(t, log.String(), "secret")
+}
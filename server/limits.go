@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Error codes of the requests rejected by WithLimits, and of the responses it replaces.
+const (
+	ErrorBodyTooLarge     = "body_too_large"
+	ErrorTooManyInputs    = "too_many_inputs"
+	ErrorInputTooLong     = "input_too_long"
+	ErrorResponseTooLarge = "response_too_large"
+)
+
+// Limits protects pipelines from abusive payloads. Zero values are not limited.
+type Limits struct {
+	MaxBodyBytes     int64 `json:"maxBodyBytes"`     // size of the request body
+	MaxInputs        int   `json:"maxInputs"`        // inputs of a request
+	MaxInputLength   int   `json:"maxInputLength"`   // characters of an input, after sanitization
+	Sanitize         bool  `json:"sanitize"`         // remove control characters other than tabs and line breaks from the inputs
+	MaxResponseBytes int64 `json:"maxResponseBytes"` // size of the response body
+}
+
+// WithLimits is a middleware that rejects the requests to a pipeline handler beyond the limits with a 413 and a JSON
+// Response, whose Code is one of the error codes above and Input the index of the offending input. With Sanitize,
+// the control characters of the inputs are removed before they reach the next handler. Invalid UTF-8 is already
+// replaced by the JSON decoder. The responses of the next handler larger than MaxResponseBytes are replaced with a
+// 500 and the ErrorResponseTooLarge code.
+func WithLimits(limits Limits) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Body == nil {
+				limits.serve(next, w, r)
+				return
+			}
+			if limits.MaxBodyBytes > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					writeResponse(w, http.StatusRequestEntityTooLarge, Response{
+						Error: fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit),
+						Code:  ErrorBodyTooLarge,
+					})
+					return
+				}
+				writeResponse(w, http.StatusBadRequest, Response{Error: fmt.Sprintf("invalid request: %s", err.Error())})
+				return
+			}
+			request := Request{}
+			if json.Unmarshal(body, &request) != nil {
+				// the pipeline handler rejects the invalid requests
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				limits.serve(next, w, r)
+				return
+			}
+			if response := limits.check(&request); response != nil {
+				writeResponse(w, http.StatusRequestEntityTooLarge, *response)
+				return
+			}
+			if limits.Sanitize {
+				if body, err = json.Marshal(request); err != nil {
+					writeResponse(w, http.StatusInternalServerError, Response{Error: err.Error()})
+					return
+				}
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			limits.serve(next, w, r)
+		})
+	}
+}
+
+// serve runs the next handler, and replaces its response with an error response if it exceeds MaxResponseBytes.
+func (l Limits) serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if l.MaxResponseBytes <= 0 {
+		next.ServeHTTP(w, r)
+		return
+	}
+	recorder := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	next.ServeHTTP(recorder, r)
+	if size := int64(recorder.body.Len()); size > l.MaxResponseBytes {
+		writeResponse(w, http.StatusInternalServerError, Response{
+			Error: fmt.Sprintf("response has %d bytes, more than the limit of %d", size, l.MaxResponseBytes),
+			Code:  ErrorResponseTooLarge,
+		})
+		return
+	}
+	copyHeader(w.Header(), recorder.header)
+	w.WriteHeader(recorder.status)
+	_, _ = w.Write(recorder.body.Bytes())
+}
+
+// check sanitizes the inputs of the request if set, and returns the error response of the first limit it exceeds.
+func (l Limits) check(request *Request) *Response {
+	if l.MaxInputs > 0 && len(request.Inputs) > l.MaxInputs {
+		return &Response{
+			Error: fmt.Sprintf("request has %d inputs, more than the limit of %d", len(request.Inputs), l.MaxInputs),
+			Code:  ErrorTooManyInputs,
+		}
+	}
+	for i, input := range request.Inputs {
+		if l.Sanitize {
+			input = sanitizeInput(input)
+			request.Inputs[i] = input
+		}
+		if l.MaxInputLength > 0 {
+			if length := utf8.RuneCountInString(input); length > l.MaxInputLength {
+				return &Response{
+					Error: fmt.Sprintf("input %d has %d characters, more than the limit of %d", i, length, l.MaxInputLength),
+					Code:  ErrorInputTooLong,
+					Input: &i,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sanitizeInput removes the control characters of an input, except for tabs and line breaks.
+func sanitizeInput(input string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, input)
+}
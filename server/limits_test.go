@@ -0,0 +1,61 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithLimits(t *testing.T) {
+	limits := Limits{MaxBodyBytes: 64, MaxInputs: 2, MaxInputLength: 5, Sanitize: true}
+	server := httptest.NewServer(WithLimits(limits)(NewPipelineHandler(&upperPipeline{})))
+	defer server.Close()
+
+	for _, test := range []struct {
+		body     string
+		status   int
+		expected string
+	}{
+		{`{"inputs": ["a", "bc"]}`, http.StatusOK, `{"outputs":["A","BC"]}`},
+		{`{"inputs": ["a\u0000b\tc\u001b"]}`, http.StatusOK, `{"outputs":["AB\tC"]}`},
+		{`{"inputs": ["a", "b", "c"]}`, http.StatusRequestEntityTooLarge, `{"error":"request has 3 inputs, more than the limit of 2","code":"too_many_inputs"}`},
+		{`{"inputs": ["a", "abcdef"]}`, http.StatusRequestEntityTooLarge, `{"error":"input 1 has 6 characters, more than the limit of 5","code":"input_too_long","input":1}`},
+		{`{"inputs": ["` + strings.Repeat("a", 64) + `"]}`, http.StatusRequestEntityTooLarge, `{"error":"request body is larger than 64 bytes","code":"body_too_large"}`},
+		{`{"inputs": `, http.StatusBadRequest, `{"error":"invalid request: unexpected EOF"}`},
+	} {
+		response, err := http.Post(server.URL, "application/json", strings.NewReader(test.body))
+		assert.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		assert.Equal(t, test.status, response.StatusCode, test.body)
+		assert.JSONEq(t, test.expected, string(body), test.body)
+	}
+}
+
+func TestWithLimitsResponseSize(t *testing.T) {
+	server := httptest.NewServer(WithLimits(Limits{MaxResponseBytes: 24})(NewPipelineHandler(&upperPipeline{})))
+	defer server.Close()
+
+	for _, test := range []struct {
+		body     string
+		status   int
+		expected string
+	}{
+		{`{"inputs": ["abc"]}`, http.StatusOK, `{"outputs":["ABC"]}`},
+		{`{"inputs": ["abcdefghij"]}`, http.StatusInternalServerError, `{"error":"response has 27 bytes, more than the limit of 24","code":"response_too_large"}`},
+	} {
+		response, err := http.Post(server.URL, "application/json", strings.NewReader(test.body))
+		assert.NoError(t, err)
+		body, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		assert.Equal(t, test.status, response.StatusCode, test.body)
+		assert.Equal(t, "application/json", response.Header.Get("Content-Type"), test.body)
+		assert.JSONEq(t, test.expected, string(body), test.body)
+	}
+}
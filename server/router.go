@@ -0,0 +1,459 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+	util "github.com/knights-analytics/hugot/utils"
+	"github.com/knights-analytics/hugot/workers"
+)
+
+// Config is the configuration of a Router, read from a JSON file.
+type Config struct {
+	Session workers.SessionSpec `json:"session"` // only applied when the router is created
+	Routes  []RouteConfig       `json:"routes"`
+}
+
+// RouteConfig serves a pipeline on a route.
+type RouteConfig struct {
+	Path         string               `json:"path"` // "/" followed by the pipeline name by default
+	Pipeline     workers.PipelineSpec `json:"pipeline"`
+	MaxBatchSize int                  `json:"maxBatchSize"` // larger requests are run in several batches. 0 for no limit
+	Warmup       []string             `json:"warmup"`       // inputs run when the pipeline is loaded, and by the admin warmup endpoint
+	CacheTTL     int                  `json:"cacheTTL"`     // seconds responses are cached for, see ResponseCache. 0 to disable caching
+	CacheSize    int                  `json:"cacheSize"`    // maximum number of cached responses, 1000 by default
+	Limits                            // size limits and sanitization of the requests, see WithLimits
+}
+
+// ReloadResponse is the body of the response of the reload handler.
+type ReloadResponse struct {
+	Routes []string `json:"routes,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Router serves the pipelines of a configuration file, one per route, and applies the changes made to the file
+// without restarting the process: on Reload, the pipelines of new routes are created, the ones of removed routes
+// are destroyed once their running requests complete, and the ones whose spec changed are recreated, while the
+// other routes keep serving requests. A reload is atomic: if any pipeline cannot be created, the previous
+// configuration keeps being served.
+type Router struct {
+	ConfigPath string
+	OnReload   func(err error) // called after each reload triggered by Watch, ReloadOnSignal or ReloadHandler, e.g. to log errors
+
+	session         *hugot.Session
+	sessionSpec     workers.SessionSpec
+	createPipeline  func(spec workers.PipelineSpec) (pipelines.Pipeline, error)
+	destroyPipeline func(name string) error
+
+	reloadMutex  sync.Mutex // serializes reloads
+	routesMutex  sync.RWMutex
+	routes       map[string]*route
+	generation   int
+	lastModified time.Time
+	lastSize     int64
+}
+
+type route struct {
+	config      RouteConfig
+	sessionName string // name of the pipeline in the session, unique across reloads
+	pipeline    pipelines.Pipeline
+	served      pipelines.Pipeline // the pipeline, batched as configured
+	cache       *ResponseCache     // nil if the responses of the route are not cached
+	handler     http.Handler
+	inFlight    sync.WaitGroup
+}
+
+// NewRouter creates the hugot session and the pipelines of the configuration file.
+func NewRouter(configPath string) (*Router, error) {
+	config, err := readConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	session, err := workers.NewSessionFromSpec(config.Session)
+	if err != nil {
+		return nil, err
+	}
+	router := &Router{
+		ConfigPath:  configPath,
+		session:     session,
+		sessionSpec: config.Session,
+		createPipeline: func(spec workers.PipelineSpec) (pipelines.Pipeline, error) {
+			return workers.NewPipelineFromSpec(session, spec)
+		},
+		destroyPipeline: session.DestroyPipeline,
+		routes:          map[string]*route{},
+	}
+	if err = router.Reload(); err != nil {
+		return nil, errors.Join(err, session.Destroy())
+	}
+	return router, nil
+}
+
+func readConfig(configPath string) (Config, error) {
+	config := Config{}
+	configBytes, err := util.ReadFileBytes(configPath)
+	if err != nil {
+		return config, err
+	}
+	if err = json.Unmarshal(configBytes, &config); err != nil {
+		return config, fmt.Errorf("invalid configuration %s: %w", configPath, err)
+	}
+	paths := map[string]bool{}
+	for i := range config.Routes {
+		routeConfig := &config.Routes[i]
+		if routeConfig.Pipeline.Name == "" {
+			return config, fmt.Errorf("invalid configuration %s: route %d has no pipeline name", configPath, i)
+		}
+		if routeConfig.Path == "" {
+			routeConfig.Path = "/" + routeConfig.Pipeline.Name
+		}
+		if paths[routeConfig.Path] {
+			return config, fmt.Errorf("invalid configuration %s: route %s is defined twice", configPath, routeConfig.Path)
+		}
+		paths[routeConfig.Path] = true
+	}
+	return config, nil
+}
+
+// Reload reads the configuration file again and applies the changes to the routes. Changes to the session
+// settings require a restart.
+func (r *Router) Reload() error {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+
+	// the file is stated before it is read, so that a change made while reloading triggers another reload, and a
+	// failed reload is only retried by Watch once the file is fixed
+	if info, err := os.Stat(r.ConfigPath); err == nil {
+		r.lastModified, r.lastSize = info.ModTime(), info.Size()
+	}
+	config, err := readConfig(r.ConfigPath)
+	if err != nil {
+		return err
+	}
+	if config.Session != r.sessionSpec {
+		return errors.New("the session settings cannot be reloaded, restart the server to apply them")
+	}
+	return r.apply(config.Routes)
+}
+
+// apply serves the given routes, creating the pipelines of new routes and of routes whose spec changed, and
+// destroying the pipelines which are not served any more. It must be called with the reload mutex held.
+func (r *Router) apply(routeConfigs []RouteConfig) error {
+	r.routesMutex.RLock()
+	current := r.routes
+	r.routesMutex.RUnlock()
+
+	routes := map[string]*route{}
+	kept := map[string]bool{} // session names of the pipelines still in use
+	var created []*route
+	for _, routeConfig := range routeConfigs {
+		old, ok := current[routeConfig.Path]
+		if ok && reflect.DeepEqual(old.config.Pipeline, routeConfig.Pipeline) {
+			kept[old.sessionName] = true
+			if reflect.DeepEqual(old.config, routeConfig) {
+				routes[routeConfig.Path] = old
+			} else {
+				routes[routeConfig.Path] = newRoute(routeConfig, old.sessionName, old.pipeline)
+			}
+			continue
+		}
+		r.generation++
+		spec := routeConfig.Pipeline
+		spec.Name = fmt.Sprintf("%s@%d", routeConfig.Pipeline.Name, r.generation)
+		pipeline, createErr := r.createPipeline(spec)
+		if createErr == nil {
+			created = append(created, newRoute(routeConfig, spec.Name, pipeline))
+			createErr = created[len(created)-1].warmup()
+		}
+		if createErr != nil {
+			destroyErrors := []error{fmt.Errorf("cannot create the pipeline of route %s: %w", routeConfig.Path, createErr)}
+			for _, createdRoute := range created {
+				destroyErrors = append(destroyErrors, r.destroyPipeline(createdRoute.sessionName))
+			}
+			return errors.Join(destroyErrors...)
+		}
+		routes[routeConfig.Path] = created[len(created)-1]
+		kept[spec.Name] = true
+	}
+
+	r.routesMutex.Lock()
+	r.routes = routes
+	r.routesMutex.Unlock()
+
+	// the replaced pipelines are destroyed once the requests they are running complete. The routes still served as
+	// they are keep receiving requests, so they are not waited for
+	served := make(map[*route]bool, len(routes))
+	for _, servedRoute := range routes {
+		served[servedRoute] = true
+	}
+	var destroyErrors []error
+	destroyed := map[string]bool{}
+	for _, old := range current {
+		if served[old] {
+			continue
+		}
+		old.inFlight.Wait()
+		if !kept[old.sessionName] && !destroyed[old.sessionName] {
+			destroyed[old.sessionName] = true
+			destroyErrors = append(destroyErrors, r.destroyPipeline(old.sessionName))
+		}
+	}
+	return errors.Join(destroyErrors...)
+}
+
+// LoadRoute serves a pipeline on a route, replacing the pipeline served on the same path if there is one. The
+// route is not added to the configuration file, so it is removed by the next reload unless the file has it.
+func (r *Router) LoadRoute(routeConfig RouteConfig) error {
+	if routeConfig.Pipeline.Name == "" {
+		return errors.New("the route has no pipeline name")
+	}
+	if routeConfig.Path == "" {
+		routeConfig.Path = "/" + routeConfig.Pipeline.Name
+	}
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+	routeConfigs := []RouteConfig{routeConfig}
+	for _, config := range r.RouteConfigs() {
+		if config.Path != routeConfig.Path {
+			routeConfigs = append(routeConfigs, config)
+		}
+	}
+	return r.apply(routeConfigs)
+}
+
+// UnloadRoute stops serving a route and destroys its pipeline once its running requests complete. The route is
+// served again by the next reload if the configuration file has it.
+func (r *Router) UnloadRoute(path string) error {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+	found := false
+	var routeConfigs []RouteConfig
+	for _, config := range r.RouteConfigs() {
+		if config.Path == path {
+			found = true
+		} else {
+			routeConfigs = append(routeConfigs, config)
+		}
+	}
+	if !found {
+		return &routeNotFoundError{path: path}
+	}
+	return r.apply(routeConfigs)
+}
+
+func newRoute(config RouteConfig, sessionName string, pipeline pipelines.Pipeline) *route {
+	served := pipeline
+	if config.MaxBatchSize > 0 {
+		served = &batchedPipeline{Pipeline: pipeline, batchSize: config.MaxBatchSize}
+	}
+	servedRoute := &route{config: config, sessionName: sessionName, pipeline: pipeline, served: served, handler: NewPipelineHandler(served)}
+	if config.CacheTTL > 0 {
+		cacheSize := config.CacheSize
+		if cacheSize == 0 {
+			cacheSize = 1000
+		}
+		servedRoute.cache = NewResponseCache(time.Duration(config.CacheTTL)*time.Second, cacheSize)
+		servedRoute.handler = servedRoute.cache.Middleware(servedRoute.handler)
+	}
+	if config.Limits != (Limits{}) {
+		servedRoute.handler = WithLimits(config.Limits)(servedRoute.handler)
+	}
+	return servedRoute
+}
+
+// warmup runs the pipeline of the route on its warmup inputs.
+func (rt *route) warmup() error {
+	if len(rt.config.Warmup) == 0 {
+		return nil
+	}
+	_, err := rt.served.Run(rt.config.Warmup)
+	return err
+}
+
+// Routes returns the paths currently served, in alphabetical order.
+func (r *Router) Routes() []string {
+	r.routesMutex.RLock()
+	defer r.routesMutex.RUnlock()
+	paths := make([]string, 0, len(r.routes))
+	for path := range r.routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// RouteConfigs returns the configuration of the routes currently served, by path.
+func (r *Router) RouteConfigs() []RouteConfig {
+	r.routesMutex.RLock()
+	defer r.routesMutex.RUnlock()
+	configs := make([]RouteConfig, 0, len(r.routes))
+	for _, servedRoute := range r.routes {
+		configs = append(configs, servedRoute.config)
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Path < configs[j].Path
+	})
+	return configs
+}
+
+// acquire returns the route served on a path, which cannot be destroyed until it is released with
+// inFlight.Done().
+func (r *Router) acquire(path string) (*route, bool) {
+	r.routesMutex.RLock()
+	defer r.routesMutex.RUnlock()
+	servedRoute, ok := r.routes[path]
+	if ok {
+		servedRoute.inFlight.Add(1)
+	}
+	return servedRoute, ok
+}
+
+// acquireAll is like acquire for all the routes, by path.
+func (r *Router) acquireAll() map[string]*route {
+	r.routesMutex.RLock()
+	defer r.routesMutex.RUnlock()
+	routes := make(map[string]*route, len(r.routes))
+	for path, servedRoute := range r.routes {
+		servedRoute.inFlight.Add(1)
+		routes[path] = servedRoute
+	}
+	return routes
+}
+
+type routeNotFoundError struct {
+	path string
+}
+
+func (e *routeNotFoundError) Error() string {
+	return fmt.Sprintf("no pipeline is served on %s", e.path)
+}
+
+// ServeHTTP runs the pipeline of the route of the request.
+func (r *Router) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	servedRoute, ok := r.acquire(request.URL.Path)
+	if !ok {
+		writeResponse(w, http.StatusNotFound, Response{Error: (&routeNotFoundError{path: request.URL.Path}).Error()})
+		return
+	}
+	defer servedRoute.inFlight.Done()
+	servedRoute.handler.ServeHTTP(w, request)
+}
+
+func (r *Router) reloaded(err error) {
+	if r.OnReload != nil {
+		r.OnReload(err)
+	}
+}
+
+// Watch reloads the configuration whenever the file changes, checking it every interval, until the context is
+// done.
+func (r *Router) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(r.ConfigPath)
+			if err != nil {
+				continue // the file may be being replaced
+			}
+			r.reloadMutex.Lock()
+			changed := !info.ModTime().Equal(r.lastModified) || info.Size() != r.lastSize
+			r.reloadMutex.Unlock()
+			if changed {
+				r.reloaded(r.Reload())
+			}
+		}
+	}
+}
+
+// ReloadOnSignal reloads the configuration when the process receives SIGHUP, until the context is done.
+func (r *Router) ReloadOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			r.reloaded(r.Reload())
+		}
+	}
+}
+
+// ReloadHandler returns a handler that reloads the configuration on POST requests, and responds with the routes
+// served after the reload. It should only be mounted behind authentication, as the admin API does.
+func (r *Router) ReloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, ReloadResponse{Error: fmt.Sprintf("method %s not allowed", request.Method)})
+			return
+		}
+		err := r.Reload()
+		r.reloaded(err)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ReloadResponse{Routes: r.Routes(), Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, ReloadResponse{Routes: r.Routes()})
+	})
+}
+
+// Close destroys the pipelines and the session of the router, once the running requests complete.
+func (r *Router) Close() error {
+	r.reloadMutex.Lock()
+	defer r.reloadMutex.Unlock()
+	r.routesMutex.Lock()
+	current := r.routes
+	r.routes = map[string]*route{}
+	r.routesMutex.Unlock()
+	for _, old := range current {
+		old.inFlight.Wait()
+	}
+	if r.session == nil {
+		return nil
+	}
+	return r.session.Destroy()
+}
+
+// batchedPipeline runs a pipeline on batches of at most batchSize inputs.
+type batchedPipeline struct {
+	pipelines.Pipeline
+	batchSize int
+}
+
+type batchedOutput struct {
+	outputs []any
+}
+
+func (o *batchedOutput) GetOutput() []any {
+	return o.outputs
+}
+
+func (p *batchedPipeline) Run(inputs []string) (pipelines.PipelineBatchOutput, error) {
+	output := &batchedOutput{outputs: make([]any, 0, len(inputs))}
+	for start := 0; start < len(inputs); start += p.batchSize {
+		batchOutput, err := p.Pipeline.Run(inputs[start:min(start+p.batchSize, len(inputs))])
+		if err != nil {
+			return nil, err
+		}
+		output.outputs = append(output.outputs, batchOutput.GetOutput()...)
+	}
+	return output, nil
+}
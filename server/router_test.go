@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot/pipelines"
+	"github.com/knights-analytics/hugot/workers"
+)
+
+// countingPipeline counts the batches it runs.
+type countingPipeline struct {
+	upperPipeline
+	batches int
+}
+
+func (p *countingPipeline) Run(inputs []string) (pipelines.PipelineBatchOutput, error) {
+	p.batches++
+	return p.upperPipeline.Run(inputs)
+}
+
+func TestRouterReload(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(config string) {
+		assert.NoError(t, os.WriteFile(configPath, []byte(config), 0o600))
+	}
+	writeConfig(`{"routes": [{"pipeline": {"name": "first", "type": "textClassification"}}]}`)
+
+	var created, destroyed []string
+	createdPipelines := map[string]*countingPipeline{}
+	router := &Router{
+		ConfigPath: configPath,
+		createPipeline: func(spec workers.PipelineSpec) (pipelines.Pipeline, error) {
+			if spec.ModelPath == "missing" {
+				return nil, errors.New("model not found")
+			}
+			created = append(created, spec.Name)
+			createdPipelines[spec.Name] = &countingPipeline{}
+			return createdPipelines[spec.Name], nil
+		},
+		destroyPipeline: func(name string) error {
+			destroyed = append(destroyed, name)
+			return nil
+		},
+		routes: map[string]*route{},
+	}
+	assert.NoError(t, router.Reload())
+	assert.Equal(t, []string{"/first"}, router.Routes())
+	assert.Equal(t, []string{"first@1"}, created)
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/reload", router.ReloadHandler())
+	mux.Handle("/", router)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	post := func(path string, body string) (int, string) {
+		response, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		responseBody, err := io.ReadAll(response.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		return response.StatusCode, string(responseBody)
+	}
+
+	status, body := post("/first", `{"inputs": ["a"]}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"outputs":["A"]}`, body)
+
+	// a new route is added, and the batch size of the first one changes without recreating its pipeline
+	writeConfig(`{"routes": [
+		{"pipeline": {"name": "first", "type": "textClassification"}, "maxBatchSize": 2},
+		{"path": "/v2/second", "pipeline": {"name": "second", "type": "textClassification"}}
+	]}`)
+	status, body = post("/admin/reload", ``)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"routes":["/first","/v2/second"]}`, body)
+	assert.Equal(t, []string{"first@1", "second@2"}, created)
+	assert.Empty(t, destroyed)
+	status, body = post("/first", `{"inputs": ["a", "b", "c", "d", "e"]}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"outputs":["A","B","C","D","E"]}`, body)
+	assert.Equal(t, 1+3, createdPipelines["first@1"].batches)
+
+	// a failed reload keeps serving the previous configuration
+	writeConfig(`{"routes": [
+		{"pipeline": {"name": "first", "type": "textClassification", "multiLabel": true}},
+		{"path": "/v2/second", "pipeline": {"name": "second", "type": "textClassification", "modelPath": "missing"}}
+	]}`)
+	status, body = post("/admin/reload", ``)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.JSONEq(t, `{"routes":["/first","/v2/second"],"error":"cannot create the pipeline of route /v2/second: model not found"}`, body)
+	assert.Equal(t, []string{"first@3"}, destroyed)
+	status, _ = post("/v2/second", `{"inputs": ["a"]}`)
+	assert.Equal(t, http.StatusOK, status)
+
+	// the second route is removed and the first one is recreated with its new spec
+	writeConfig(`{"routes": [{"pipeline": {"name": "first", "type": "textClassification", "multiLabel": true}}]}`)
+	assert.NoError(t, router.Reload())
+	assert.Equal(t, []string{"/first"}, router.Routes())
+	assert.ElementsMatch(t, []string{"first@3", "first@1", "second@2"}, destroyed)
+	status, body = post("/v2/second", `{"inputs": ["a"]}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.JSONEq(t, `{"error":"no pipeline is served on /v2/second"}`, body)
+
+	// invalid configurations and session changes are rejected
+	writeConfig(`{"routes": [{"pipeline": {"name": "first"}}, {"path": "/first", "pipeline": {"name": "other"}}]}`)
+	assert.ErrorContains(t, router.Reload(), "route /first is defined twice")
+	writeConfig(`{"session": {"cuda": true}, "routes": []}`)
+	assert.ErrorContains(t, router.Reload(), "restart the server")
+	assert.Equal(t, []string{"/first"}, router.Routes())
+	assert.NoError(t, router.Close())
+	assert.Empty(t, router.Routes())
+}
+
+// blockingPipeline runs requests once release is closed, and signals on started when a request starts.
+type blockingPipeline struct {
+	upperPipeline
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingPipeline) Run(inputs []string) (pipelines.PipelineBatchOutput, error) {
+	p.started <- struct{}{}
+	<-p.release
+	return p.upperPipeline.Run(inputs)
+}
+
+func TestRouterReloadWithRequestsInFlight(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(config string) {
+		assert.NoError(t, os.WriteFile(configPath, []byte(config), 0o600))
+	}
+	writeConfig(`{"routes": [
+		{"pipeline": {"name": "kept", "type": "textClassification"}},
+		{"pipeline": {"name": "removed", "type": "textClassification"}}
+	]}`)
+
+	createdPipelines := map[string]*blockingPipeline{}
+	destroyed := make(chan string, 10)
+	router := &Router{
+		ConfigPath: configPath,
+		createPipeline: func(spec workers.PipelineSpec) (pipelines.Pipeline, error) {
+			createdPipelines[spec.Name] = &blockingPipeline{started: make(chan struct{}, 10), release: make(chan struct{})}
+			return createdPipelines[spec.Name], nil
+		},
+		destroyPipeline: func(name string) error {
+			destroyed <- name
+			return nil
+		},
+		routes: map[string]*route{},
+	}
+	assert.NoError(t, router.Reload())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	post := func(path string, done chan<- int) {
+		response, err := http.Post(server.URL+path, "application/json", strings.NewReader(`{"inputs": ["a"]}`))
+		assert.NoError(t, err)
+		assert.NoError(t, response.Body.Close())
+		done <- response.StatusCode
+	}
+	keptDone, removedDone := make(chan int, 1), make(chan int, 1)
+	go post("/kept", keptDone)
+	go post("/removed", removedDone)
+	<-createdPipelines["kept@1"].started
+	<-createdPipelines["removed@2"].started
+
+	// the reload does not wait for the requests of the route it keeps, but for those of the route it removes
+	writeConfig(`{"routes": [{"pipeline": {"name": "kept", "type": "textClassification"}}]}`)
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- router.Reload()
+	}()
+	select {
+	case err := <-reloaded:
+		t.Fatalf("the reload completed before the requests of the removed route: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, []string{"/kept"}, router.Routes())
+
+	// the kept route keeps serving new requests during the reload
+	secondKeptDone := make(chan int, 1)
+	go post("/kept", secondKeptDone)
+	<-createdPipelines["kept@1"].started
+
+	close(createdPipelines["removed@2"].release)
+	assert.Equal(t, http.StatusOK, <-removedDone)
+	assert.NoError(t, <-reloaded)
+	assert.Equal(t, "removed@2", <-destroyed)
+
+	close(createdPipelines["kept@1"].release)
+	assert.Equal(t, http.StatusOK, <-keptDone)
+	assert.Equal(t, http.StatusOK, <-secondKeptDone)
+	assert.Empty(t, destroyed)
+	assert.NoError(t, router.Close())
+}
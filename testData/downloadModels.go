@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"os"
+	"path"
+	"slices"
 
 	"github.com/knights-analytics/hugot"
 	util "github.com/knights-analytics/hugot/utils"
@@ -35,12 +37,32 @@ func main() {
 				"protectai/deberta-v3-base-zeroshot-v1-onnx",
 				"KnightsAnalytics/distilbert-base-uncased-finetuned-sst-2-english",
 				"KnightsAnalytics/distilbert-NER",
-				"SamLowe/roberta-base-go_emotions-onnx"} {
+				"SamLowe/roberta-base-go_emotions-onnx",
+				"Xenova/bert-base-uncased",
+				"Xenova/t5-small"} {
 				_, err := session.DownloadModel(modelName, "./models", downloadOptions)
 				if err != nil {
 					panic(err)
 				}
 			}
+			// the fill-mask and text2text models come with several onnx variants, only the ones the tests load are kept
+			keep := map[string][]string{
+				"./models/Xenova_bert-base-uncased/onnx": {"model_quantized.onnx"},
+				"./models/Xenova_t5-small/onnx":          {"encoder_model.onnx", "decoder_model_merged.onnx"},
+			}
+			for onnxDir, keptFiles := range keep {
+				onnxFiles, err := os.ReadDir(onnxDir)
+				if err != nil {
+					panic(err)
+				}
+				for _, onnxFile := range onnxFiles {
+					if !slices.Contains(keptFiles, onnxFile.Name()) {
+						if err = os.Remove(path.Join(onnxDir, onnxFile.Name())); err != nil {
+							panic(err)
+						}
+					}
+				}
+			}
 		}
 	} else {
 		panic(err)
@@ -0,0 +1,387 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// DecodeWAV decodes a WAV file into mono samples between -1 and 1, averaging the channels, and returns them
+// with the sample rate of the file. 8, 16, 24 and 32 bit integer PCM and 32 and 64 bit float samples are
+// supported.
+func DecodeWAV(data []byte) ([]float32, int, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, errors.New("not a WAV file")
+	}
+	var format, channels, bitsPerSample uint16
+	var sampleRate uint32
+	var samples []byte
+	formatFound, dataFound := false, false
+	for offset := 12; offset+8 <= len(data); {
+		chunkID := string(data[offset : offset+4])
+		chunkSize := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		start := offset + 8
+		end := min(start+chunkSize, len(data))
+		switch chunkID {
+		case "fmt ":
+			if end-start < 16 {
+				return nil, 0, errors.New("invalid WAV format chunk")
+			}
+			format = binary.LittleEndian.Uint16(data[start : start+2])
+			channels = binary.LittleEndian.Uint16(data[start+2 : start+4])
+			sampleRate = binary.LittleEndian.Uint32(data[start+4 : start+8])
+			bitsPerSample = binary.LittleEndian.Uint16(data[start+14 : start+16])
+			if format == 0xFFFE && end-start >= 26 {
+				// WAVE_FORMAT_EXTENSIBLE, the format code is at the start of the sub format GUID
+				format = binary.LittleEndian.Uint16(data[start+24 : start+26])
+			}
+			formatFound = true
+		case "data":
+			samples = data[start:end]
+			dataFound = true
+		}
+		offset = start + chunkSize + chunkSize%2 // chunks are padded to an even size
+	}
+	if !formatFound || !dataFound {
+		return nil, 0, errors.New("WAV file without format or data chunk")
+	}
+	if channels == 0 || sampleRate == 0 {
+		return nil, 0, errors.New("WAV file without channels or sample rate")
+	}
+
+	unsupported := fmt.Errorf("unsupported WAV format %d with %d bits per sample", format, bitsPerSample)
+	if format != 1 && format != 3 {
+		return nil, 0, unsupported
+	}
+	mono, err := DecodePCM(samples, PCMFormat{Channels: int(channels), BitsPerSample: int(bitsPerSample), Float: format == 3})
+	if err != nil {
+		return nil, 0, unsupported
+	}
+	return mono, int(sampleRate), nil
+}
+
+// DecodeMP3 decodes an MP3 file, with or without an ID3v2 tag, into mono samples between -1 and 1, averaging the
+// channels, and returns them with the sample rate of the file. MPEG-1 and MPEG-2 layer III files are supported.
+func DecodeMP3(data []byte) ([]float32, int, error) {
+	decoder, err := mp3.NewDecoder(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid MP3 file: %w", err)
+	}
+	pcm, err := io.ReadAll(decoder)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid MP3 file: %w", err)
+	}
+	// the decoder always outputs 16 bit stereo, mono files are copied on both channels
+	mono, err := DecodePCM(pcm, PCMFormat{Channels: 2, BitsPerSample: 16})
+	if err != nil {
+		return nil, 0, err
+	}
+	return mono, decoder.SampleRate(), nil
+}
+
+// DecodeOGG decodes an Ogg Vorbis file into mono samples between -1 and 1, averaging the channels, and returns
+// them with the sample rate of the file. Other codecs in an Ogg container, such as Opus, are not supported.
+func DecodeOGG(data []byte) ([]float32, int, error) {
+	samples, format, err := oggvorbis.ReadAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid Ogg Vorbis file: %w", err)
+	}
+	if format.Channels <= 0 || format.SampleRate <= 0 {
+		return nil, 0, errors.New("Ogg Vorbis file without channels or sample rate")
+	}
+	mono := make([]float32, len(samples)/format.Channels)
+	for i := range mono {
+		var sum float32
+		for _, sample := range samples[i*format.Channels : (i+1)*format.Channels] {
+			sum += sample
+		}
+		mono[i] = sum / float32(format.Channels)
+	}
+	return mono, format.SampleRate, nil
+}
+
+// DecodeAudio decodes an audio file into mono samples between -1 and 1 and returns them with the sample rate of
+// the file, which the pipelines then resample to the rate of their model. The format is detected from the
+// content: WAV, FLAC, MP3 and Ogg Vorbis files are supported.
+func DecodeAudio(data []byte) ([]float32, int, error) {
+	content := data
+	// an ID3v2 tag may precede the audio of FLAC and MP3 files
+	if len(content) >= 10 && string(content[0:3]) == "ID3" {
+		size := int(content[6]&0x7F)<<21 | int(content[7]&0x7F)<<14 | int(content[8]&0x7F)<<7 | int(content[9]&0x7F)
+		size += 10
+		if content[5]&0x10 != 0 { // footer
+			size += 10
+		}
+		if size > len(content) {
+			return nil, 0, errors.New("truncated ID3 tag")
+		}
+		content = content[size:]
+		if len(content) < 4 || string(content[0:4]) != "fLaC" {
+			// the MP3 decoder skips the tag itself
+			return DecodeMP3(data)
+		}
+	}
+	switch {
+	case len(content) >= 12 && string(content[0:4]) == "RIFF" && string(content[8:12]) == "WAVE":
+		return DecodeWAV(content)
+	case len(content) >= 4 && string(content[0:4]) == "fLaC":
+		return DecodeFLAC(content)
+	case len(content) >= 4 && string(content[0:4]) == "OggS":
+		return DecodeOGG(content)
+	case len(content) >= 2 && content[0] == 0xFF && content[1]&0xE0 == 0xE0:
+		return DecodeMP3(content)
+	default:
+		return nil, 0, errors.New("unknown audio format, WAV, FLAC, MP3 and Ogg Vorbis are supported")
+	}
+}
+
+// PCMFormat describes raw PCM audio: interleaved little-endian samples of signed integers, or unsigned for 8 bits,
+// or IEEE floats.
+type PCMFormat struct {
+	Channels      int
+	BitsPerSample int  // 8, 16, 24 or 32 bits for integers, 32 or 64 bits for floats
+	Float         bool // samples are floats
+}
+
+// DecodePCM decodes raw PCM audio into mono samples between -1 and 1, averaging the channels.
+func DecodePCM(data []byte, format PCMFormat) ([]float32, error) {
+	if format.Channels <= 0 {
+		return nil, errors.New("PCM audio without channels")
+	}
+	var decode func([]byte) float64
+	switch {
+	case !format.Float && format.BitsPerSample == 8:
+		decode = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case !format.Float && format.BitsPerSample == 16:
+		decode = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / 32768 }
+	case !format.Float && format.BitsPerSample == 24:
+		decode = func(b []byte) float64 {
+			value := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			return float64(value) / 8388608
+		}
+	case !format.Float && format.BitsPerSample == 32:
+		decode = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648 }
+	case format.Float && format.BitsPerSample == 32:
+		decode = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	case format.Float && format.BitsPerSample == 64:
+		decode = func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+	default:
+		return nil, fmt.Errorf("unsupported PCM format with %d bits per sample", format.BitsPerSample)
+	}
+
+	sampleSize := format.BitsPerSample / 8
+	frameSize := sampleSize * format.Channels
+	mono := make([]float32, len(data)/frameSize)
+	for i := range mono {
+		var sum float64
+		for channel := 0; channel < format.Channels; channel++ {
+			start := i*frameSize + channel*sampleSize
+			sum += decode(data[start : start+sampleSize])
+		}
+		mono[i] = float32(sum / float64(format.Channels))
+	}
+	return mono, nil
+}
+
+// ResampleAudio resamples audio from one sample rate to another with linear interpolation. When downsampling,
+// each output sample is the average of the input samples it covers, to limit aliasing.
+func ResampleAudio(samples []float32, fromRate int, toRate int) []float32 {
+	if fromRate == toRate || len(samples) == 0 {
+		return samples
+	}
+	ratio := float64(fromRate) / float64(toRate)
+	resampled := make([]float32, int(float64(len(samples))/ratio))
+	for i := range resampled {
+		position := float64(i) * ratio
+		if ratio > 1 {
+			start, end := int(position), min(int(position+ratio), len(samples))
+			var sum float32
+			for _, sample := range samples[start:end] {
+				sum += sample
+			}
+			resampled[i] = sum / float32(max(end-start, 1))
+			continue
+		}
+		index := int(position)
+		fraction := float32(position - float64(index))
+		next := min(index+1, len(samples)-1)
+		resampled[i] = samples[index]*(1-fraction) + samples[next]*fraction
+	}
+	return resampled
+}
+
+// MelSpectrogram computes log-mel spectrogram features as Whisper models expect them: the power spectrum of a
+// short-time Fourier transform with a Hann window, projected on a mel filter bank with the Slaney mel scale and
+// normalization, in log10 scale, clamped to 8 below the maximum and rescaled. It is safe for concurrent use.
+type MelSpectrogram struct {
+	NumFFT    int
+	HopLength int
+	NumMels   int
+	window    []float64
+	twiddles  []complex128
+	filters   []melFilter
+}
+
+// melFilter is a triangular mel filter, with the weights of the frequency bins from start.
+type melFilter struct {
+	start   int
+	weights []float64
+}
+
+// NewMelSpectrogram creates the window and the mel filter bank for the given parameters, e.g. a sample rate of
+// 16000, 400 FFT points, a hop length of 160 and 80 mels for Whisper models.
+func NewMelSpectrogram(sampleRate int, numFFT int, hopLength int, numMels int) *MelSpectrogram {
+	m := &MelSpectrogram{NumFFT: numFFT, HopLength: hopLength, NumMels: numMels}
+	m.window = make([]float64, numFFT)
+	m.twiddles = make([]complex128, numFFT)
+	for i := range m.window {
+		m.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(numFFT)) // periodic Hann window
+		angle := -2 * math.Pi * float64(i) / float64(numFFT)
+		m.twiddles[i] = complex(math.Cos(angle), math.Sin(angle))
+	}
+
+	// triangular filters between mel points evenly spaced from 0 to the Nyquist frequency
+	numBins := numFFT/2 + 1
+	maxMel := hzToMel(float64(sampleRate) / 2)
+	melPoints := make([]float64, numMels+2)
+	for i := range melPoints {
+		melPoints[i] = melToHz(maxMel * float64(i) / float64(numMels+1))
+	}
+	m.filters = make([]melFilter, numMels)
+	for i := range m.filters {
+		lower, center, upper := melPoints[i], melPoints[i+1], melPoints[i+2]
+		norm := 2 / (upper - lower)
+		filter := melFilter{start: -1}
+		for bin := 0; bin < numBins; bin++ {
+			frequency := float64(bin) * float64(sampleRate) / float64(numFFT)
+			weight := max(0, min((frequency-lower)/(center-lower), (upper-frequency)/(upper-center)))
+			if weight > 0 {
+				if filter.start < 0 {
+					filter.start = bin
+				}
+				filter.weights = append(filter.weights, weight*norm)
+			} else if filter.start >= 0 {
+				break
+			}
+		}
+		if filter.start < 0 {
+			filter.start = 0
+		}
+		m.filters[i] = filter
+	}
+	return m
+}
+
+// hzToMel converts a frequency to the Slaney mel scale, linear below 1 kHz and logarithmic above.
+func hzToMel(frequency float64) float64 {
+	if frequency < 1000 {
+		return frequency * 3 / 200
+	}
+	return 15 + math.Log(frequency/1000)*27/math.Log(6.4)
+}
+
+func melToHz(mel float64) float64 {
+	if mel < 15 {
+		return mel * 200 / 3
+	}
+	return 1000 * math.Exp((mel-15)*math.Log(6.4)/27)
+}
+
+// LogMel returns the log-mel spectrogram of the samples, padded with silence or truncated to numFrames hops,
+// as a numMels x numFrames matrix in row-major order.
+func (m *MelSpectrogram) LogMel(samples []float32, numFrames int) []float32 {
+	numSamples := numFrames * m.HopLength
+	padding := m.NumFFT / 2
+	// the signal is centered on the frames with reflection padding
+	padded := make([]float64, numSamples+2*padding)
+	for i := 0; i < numSamples && i < len(samples); i++ {
+		padded[padding+i] = float64(samples[i])
+	}
+	for i := 0; i < padding; i++ {
+		padded[padding-1-i] = padded[padding+1+i]
+		padded[padding+numSamples+i] = padded[padding+numSamples-2-i]
+	}
+
+	numBins := m.NumFFT/2 + 1
+	features := make([]float64, m.NumMels*numFrames)
+	frame := make([]complex128, m.NumFFT)
+	power := make([]float64, numBins)
+	maxFeature := math.Inf(-1)
+	for f := 0; f < numFrames; f++ {
+		start := f * m.HopLength
+		for i := range frame {
+			frame[i] = complex(padded[start+i]*m.window[i], 0)
+		}
+		spectrum := fft(frame, m.twiddles, 1)
+		for bin := range power {
+			power[bin] = real(spectrum[bin])*real(spectrum[bin]) + imag(spectrum[bin])*imag(spectrum[bin])
+		}
+		for mel, filter := range m.filters {
+			var energy float64
+			for i, weight := range filter.weights {
+				energy += weight * power[filter.start+i]
+			}
+			feature := math.Log10(max(energy, 1e-10))
+			features[mel*numFrames+f] = feature
+			maxFeature = max(maxFeature, feature)
+		}
+	}
+	logMel := make([]float32, len(features))
+	for i, feature := range features {
+		logMel[i] = float32((max(feature, maxFeature-8) + 4) / 4)
+	}
+	return logMel
+}
+
+// fft computes the discrete Fourier transform of x with a mixed radix Cooley-Tukey algorithm, so that sizes which
+// are not powers of two, such as the 400 points of Whisper, stay fast. twiddles are the roots of unity of the
+// top level transform, of which x is a subsequence taken every stride elements.
+func fft(x []complex128, twiddles []complex128, stride int) []complex128 {
+	n := len(x)
+	if n == 1 {
+		return []complex128{x[0]}
+	}
+	radix := n
+	for factor := 2; factor*factor <= n; factor++ {
+		if n%factor == 0 {
+			radix = factor
+			break
+		}
+	}
+	size := len(twiddles)
+	output := make([]complex128, n)
+	if radix == n {
+		// prime size, direct transform
+		for k := 0; k < n; k++ {
+			var sum complex128
+			for j := 0; j < n; j++ {
+				sum += x[j] * twiddles[(j*k*stride)%size]
+			}
+			output[k] = sum
+		}
+		return output
+	}
+	subSize := n / radix
+	subTransforms := make([][]complex128, radix)
+	subsequence := make([]complex128, subSize)
+	for r := 0; r < radix; r++ {
+		for k := range subsequence {
+			subsequence[k] = x[k*radix+r]
+		}
+		subTransforms[r] = fft(subsequence, twiddles, stride*radix)
+	}
+	for k := 0; k < n; k++ {
+		var sum complex128
+		for r := 0; r < radix; r++ {
+			sum += subTransforms[r][k%subSize] * twiddles[(r*k*stride)%size]
+		}
+		output[k] = sum
+	}
+	return output
+}
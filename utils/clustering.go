@@ -0,0 +1,258 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// StreamingClusterer groups a stream of embeddings into clusters on the fly, e.g. for real-time topic grouping of
+// event streams. It is a leader-follower algorithm with running-mean centroids, similar to streaming k-means:
+// each embedding joins the cluster with the most similar centroid if the cosine similarity reaches Threshold, and
+// starts a new cluster otherwise, until MaxClusters is reached. Every RecenterEvery assignments, clusters whose
+// centroids have drifted together are merged, and the weight of past embeddings is multiplied by Decay, so that
+// the centroids follow the topics as they evolve. A StreamingClusterer is safe for concurrent use.
+type StreamingClusterer struct {
+	Threshold     float32 // minimum cosine similarity to join a cluster
+	MaxClusters   int     // maximum number of clusters, 0 for no limit. When reached, embeddings join the most similar cluster
+	MergeAbove    float32 // minimum cosine similarity of two centroids to merge their clusters when recentering
+	RecenterEvery int     // number of assignments between recenterings, 0 to only recenter when Recenter is called
+	Decay         float32 // factor applied to the weight of past embeddings when recentering, 1 for no decay
+
+	mutex       sync.Mutex
+	clusters    []*streamingCluster
+	nextID      int
+	assignments int
+	dimension   int
+}
+
+type streamingCluster struct {
+	id     int
+	sum    []float64 // weighted sum of the normalized embeddings of the cluster
+	weight float64   // sum of the weights of the embeddings of the cluster
+	size   int
+}
+
+// Cluster is a cluster of a StreamingClusterer.
+type Cluster struct {
+	ID       int
+	Centroid []float32 // normalized mean of the embeddings of the cluster
+	Size     int       // number of embeddings assigned to the cluster, including merged clusters
+}
+
+// NewStreamingClusterer creates a clusterer joining clusters above the similarity threshold, merging clusters whose
+// centroids are more similar than the threshold every 1000 assignments, without decay or limit on the number of clusters.
+func NewStreamingClusterer(threshold float32) *StreamingClusterer {
+	return &StreamingClusterer{
+		Threshold:     threshold,
+		MergeAbove:    threshold,
+		RecenterEvery: 1000,
+		Decay:         1,
+	}
+}
+
+// Assign assigns an embedding to a cluster and returns the id of the cluster. Cluster ids are never reused, and
+// the id of a cluster merged into another one is no longer returned by Clusters, see Recenter.
+func (c *StreamingClusterer) Assign(embedding []float32) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(embedding) == 0 {
+		return 0, errors.New("cannot cluster an empty embedding")
+	}
+	if c.dimension == 0 {
+		c.dimension = len(embedding)
+	}
+	if len(embedding) != c.dimension {
+		return 0, fmt.Errorf("embedding has dimension %d, but the clusterer has dimension %d", len(embedding), c.dimension)
+	}
+	normalized := Normalize(append([]float32{}, embedding...), 2)
+
+	var best *streamingCluster
+	bestSimilarity := float32(-2)
+	for _, cluster := range c.clusters {
+		if similarity := Dot(normalized, cluster.centroid()); similarity > bestSimilarity {
+			best, bestSimilarity = cluster, similarity
+		}
+	}
+	if best == nil || (bestSimilarity < c.Threshold && (c.MaxClusters <= 0 || len(c.clusters) < c.MaxClusters)) {
+		best = &streamingCluster{id: c.nextID, sum: make([]float64, c.dimension)}
+		c.nextID++
+		c.clusters = append(c.clusters, best)
+	}
+	for i, e := range normalized {
+		best.sum[i] += float64(e)
+	}
+	best.weight++
+	best.size++
+
+	c.assignments++
+	if c.RecenterEvery > 0 && c.assignments%c.RecenterEvery == 0 {
+		c.recenter()
+	}
+	return best.id, nil
+}
+
+// Recenter merges the clusters whose centroids are more similar than MergeAbove, and applies Decay to the weight
+// of the embeddings assigned so far. It returns, for each merged cluster id, the id of the cluster it was merged into.
+func (c *StreamingClusterer) Recenter() map[int]int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.recenter()
+}
+
+func (c *StreamingClusterer) recenter() map[int]int {
+	merged := map[int]int{}
+	for {
+		// merge the most similar pair of clusters first, until no pair is similar enough
+		bestI, bestJ := -1, -1
+		bestSimilarity := c.MergeAbove
+		for i := range c.clusters {
+			for j := i + 1; j < len(c.clusters); j++ {
+				if similarity := Dot(c.clusters[i].centroid(), c.clusters[j].centroid()); similarity >= bestSimilarity {
+					bestI, bestJ, bestSimilarity = i, j, similarity
+				}
+			}
+		}
+		if bestI < 0 {
+			break
+		}
+		into, from := c.clusters[bestI], c.clusters[bestJ]
+		for i := range into.sum {
+			into.sum[i] += from.sum[i]
+		}
+		into.weight += from.weight
+		into.size += from.size
+		merged[from.id] = into.id
+		for id, target := range merged {
+			if target == from.id {
+				merged[id] = into.id
+			}
+		}
+		c.clusters = append(c.clusters[:bestJ], c.clusters[bestJ+1:]...)
+	}
+	if c.Decay > 0 && c.Decay != 1 {
+		for _, cluster := range c.clusters {
+			for i := range cluster.sum {
+				cluster.sum[i] *= float64(c.Decay)
+			}
+			cluster.weight *= float64(c.Decay)
+		}
+	}
+	return merged
+}
+
+// Clusters returns the current clusters, by increasing id.
+func (c *StreamingClusterer) Clusters() []Cluster {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	clusters := make([]Cluster, len(c.clusters))
+	for i, cluster := range c.clusters {
+		clusters[i] = Cluster{ID: cluster.id, Centroid: cluster.centroid(), Size: cluster.size}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].ID < clusters[j].ID
+	})
+	return clusters
+}
+
+// centroid returns the normalized mean of the embeddings of the cluster.
+func (c *streamingCluster) centroid() []float32 {
+	centroid := make([]float32, len(c.sum))
+	for i, e := range c.sum {
+		centroid[i] = float32(e / c.weight)
+	}
+	return Normalize(centroid, 2)
+}
+
+// AgglomerativeClustering clusters embeddings with average linkage on their cosine similarity: starting from one
+// cluster per embedding, the two clusters with the highest mean similarity between their embeddings are merged,
+// until there are numClusters clusters, or if numClusters is 0 until no two clusters have a mean similarity of at
+// least threshold. It returns the cluster of each embedding, numbered by first appearance. The similarity matrix
+// takes O(n²) memory.
+func AgglomerativeClustering(embeddings [][]float32, numClusters int, threshold float32) ([]int, error) {
+	n := len(embeddings)
+	if numClusters < 0 {
+		return nil, fmt.Errorf("invalid number of clusters %d", numClusters)
+	}
+	normalized := make([][]float32, n)
+	for i, embedding := range embeddings {
+		if len(embedding) == 0 || len(embedding) != len(embeddings[0]) {
+			return nil, fmt.Errorf("embedding %d has dimension %d, but the first embedding has dimension %d", i, len(embedding), len(embeddings[0]))
+		}
+		normalized[i] = Normalize(append([]float32{}, embedding...), 2)
+	}
+	similarities := make([][]float32, n)
+	for i := range similarities {
+		similarities[i] = make([]float32, n)
+		for j := 0; j < i; j++ {
+			similarities[i][j] = Dot(normalized[i], normalized[j])
+			similarities[j][i] = similarities[i][j]
+		}
+	}
+	sizes := make([]int, n)
+	parents := make([]int, n)
+	active := make([]bool, n)
+	nearest := make([]int, n) // most similar active cluster of each active cluster
+	for i := range sizes {
+		sizes[i], parents[i], active[i] = 1, i, true
+	}
+	updateNearest := func(i int) {
+		nearest[i] = -1
+		for j := range n {
+			if j != i && active[j] && (nearest[i] < 0 || similarities[i][j] > similarities[i][nearest[i]]) {
+				nearest[i] = j
+			}
+		}
+	}
+	for i := range n {
+		updateNearest(i)
+	}
+	for remaining := n; remaining > 1 && remaining > numClusters; remaining-- {
+		best := -1
+		for i := range n {
+			if active[i] && nearest[i] >= 0 && (best < 0 || similarities[i][nearest[i]] > similarities[best][nearest[best]]) {
+				best = i
+			}
+		}
+		into, from := min(best, nearest[best]), max(best, nearest[best])
+		if numClusters == 0 && similarities[into][from] < threshold {
+			break
+		}
+		// the mean similarity with the merged cluster is the weighted mean of the similarities with both clusters
+		for k := range n {
+			if active[k] && k != into && k != from {
+				similarity := (float32(sizes[into])*similarities[into][k] + float32(sizes[from])*similarities[from][k]) / float32(sizes[into]+sizes[from])
+				similarities[into][k], similarities[k][into] = similarity, similarity
+			}
+		}
+		sizes[into] += sizes[from]
+		parents[from] = into
+		active[from] = false
+		for k := range n {
+			if !active[k] {
+				continue
+			}
+			if k == into || nearest[k] == into || nearest[k] == from {
+				updateNearest(k)
+			} else if similarities[k][into] > similarities[k][nearest[k]] {
+				nearest[k] = into
+			}
+		}
+	}
+	labels := make([]int, n)
+	clusterLabels := map[int]int{}
+	for i := range labels {
+		root := i
+		for parents[root] != root {
+			root = parents[root]
+		}
+		label, ok := clusterLabels[root]
+		if !ok {
+			label = len(clusterLabels)
+			clusterLabels[root] = label
+		}
+		labels[i] = label
+	}
+	return labels, nil
+}
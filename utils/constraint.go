@@ -0,0 +1,274 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// TokenConstraint constrains the text generated by a language model to the matches of a regular expression, in
+// the RE2 syntax of the regexp package. At each decoding step, it finds the tokens of the vocabulary that keep the
+// generated text a prefix of a match, so that the other tokens can be masked. The expression is compiled to an
+// automaton whose states are built lazily, and the vocabulary is walked as a trie of the bytes of the tokens, so
+// that tokens sharing a prefix are checked together. Tokens may end in the middle of a multi-byte character, which
+// is allowed if a character starting with its bytes can match. Word boundaries are not supported and ^ and $
+// always match, as the whole text must match. It is safe for concurrent use.
+type TokenConstraint struct {
+	Pattern     string
+	program     *syntax.Prog
+	trie        *tokenTrie
+	numTokens   int
+	startState  int
+	mutex       sync.Mutex
+	states      []constraintState
+	stateIDs    map[string]int
+	transitions []map[rune]int // state after each character read from a state, -1 if none
+	allowed     map[constraintPosition][]uint64
+}
+
+// constraintState is a state of the automaton: the instructions of the program that can match the next character.
+type constraintState struct {
+	instructions []uint32
+	match        bool
+}
+
+// constraintPosition is the state of the automaton after some text, and the bytes of an incomplete character at
+// the end of the text.
+type constraintPosition struct {
+	state   int
+	pending string
+}
+
+type tokenTrie struct {
+	children map[byte]*tokenTrie
+	tokenIDs []int
+}
+
+// NewTokenConstraint compiles the pattern for the vocabulary, given as the bytes of the decoded text of each token.
+// Tokens without bytes, such as special tokens, are never allowed.
+func NewTokenConstraint(pattern string, tokens [][]byte) (*TokenConstraint, error) {
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid constraint pattern: %w", err)
+	}
+	program, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("invalid constraint pattern: %w", err)
+	}
+	c := &TokenConstraint{
+		Pattern:   pattern,
+		program:   program,
+		trie:      &tokenTrie{},
+		numTokens: len(tokens),
+		stateIDs:  map[string]int{},
+		allowed:   map[constraintPosition][]uint64{},
+	}
+	for id, token := range tokens {
+		if len(token) == 0 {
+			continue
+		}
+		node := c.trie
+		for _, b := range token {
+			if node.children == nil {
+				node.children = map[byte]*tokenTrie{}
+			}
+			child, ok := node.children[b]
+			if !ok {
+				child = &tokenTrie{}
+				node.children[b] = child
+			}
+			node = child
+		}
+		node.tokenIDs = append(node.tokenIDs, id)
+	}
+	c.startState = c.stateOf(c.closure([]uint32{uint32(program.Start)}))
+	return c, nil
+}
+
+// closure adds the instructions reachable without reading a character, and keeps those that read one.
+func (c *TokenConstraint) closure(instructions []uint32) []uint32 {
+	seen := map[uint32]bool{}
+	var kept []uint32
+	stack := append([]uint32{}, instructions...)
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[pc] {
+			continue
+		}
+		seen[pc] = true
+		instruction := c.program.Inst[pc]
+		switch instruction.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			stack = append(stack, instruction.Out, instruction.Arg)
+		case syntax.InstCapture, syntax.InstNop, syntax.InstEmptyWidth:
+			stack = append(stack, instruction.Out)
+		case syntax.InstFail:
+		default:
+			kept = append(kept, pc)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+	return kept
+}
+
+// stateOf returns the id of the state with the given instructions, or -1 if none can match.
+func (c *TokenConstraint) stateOf(instructions []uint32) int {
+	if len(instructions) == 0 {
+		return -1
+	}
+	var key strings.Builder
+	for _, pc := range instructions {
+		key.WriteString(strconv.Itoa(int(pc)))
+		key.WriteByte(',')
+	}
+	if id, ok := c.stateIDs[key.String()]; ok {
+		return id
+	}
+	state := constraintState{instructions: instructions}
+	for _, pc := range instructions {
+		if c.program.Inst[pc].Op == syntax.InstMatch {
+			state.match = true
+		}
+	}
+	c.states = append(c.states, state)
+	c.transitions = append(c.transitions, map[rune]int{})
+	c.stateIDs[key.String()] = len(c.states) - 1
+	return len(c.states) - 1
+}
+
+// next returns the state after reading a character, or -1.
+func (c *TokenConstraint) next(state int, r rune) int {
+	if next, ok := c.transitions[state][r]; ok {
+		return next
+	}
+	var instructions []uint32
+	for _, pc := range c.states[state].instructions {
+		instruction := c.program.Inst[pc]
+		if instruction.Op != syntax.InstMatch && instruction.MatchRune(r) {
+			instructions = append(instructions, instruction.Out)
+		}
+	}
+	next := c.stateOf(c.closure(instructions))
+	c.transitions[state][r] = next
+	return next
+}
+
+// advance returns the position after reading bytes, or false if the text cannot match.
+func (c *TokenConstraint) advance(position constraintPosition, text []byte) (constraintPosition, bool) {
+	for _, b := range text {
+		pending := position.pending + string([]byte{b})
+		if !utf8.FullRuneInString(pending) {
+			if !c.canStartWith(position.state, pending) {
+				return position, false
+			}
+			position.pending = pending
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(pending)
+		if r == utf8.RuneError && size <= 1 {
+			return position, false
+		}
+		position.state = c.next(position.state, r)
+		position.pending = ""
+		if position.state < 0 {
+			return position, false
+		}
+	}
+	return position, true
+}
+
+// canStartWith reports whether a character starting with the bytes of an incomplete character can be read.
+func (c *TokenConstraint) canStartWith(state int, prefix string) bool {
+	// the range of the characters starting with the prefix, from its bits and the bits of the missing bytes
+	var length int
+	var value rune
+	switch b := prefix[0]; {
+	case b&0xE0 == 0xC0:
+		length, value = 2, rune(b&0x1F)
+	case b&0xF0 == 0xE0:
+		length, value = 3, rune(b&0x0F)
+	case b&0xF8 == 0xF0:
+		length, value = 4, rune(b&0x07)
+	default:
+		return false
+	}
+	for i := 1; i < len(prefix); i++ {
+		if prefix[i]&0xC0 != 0x80 {
+			return false
+		}
+		value = value<<6 | rune(prefix[i]&0x3F)
+	}
+	missing := 6 * (length - len(prefix))
+	lowRune := max(value<<missing, []rune{0, 0, 0x80, 0x800, 0x10000}[length])
+	highRune := min(value<<missing|(1<<missing-1), []rune{0, 0, 0x7FF, 0xFFFF, utf8.MaxRune}[length])
+	if lowRune > highRune {
+		return false
+	}
+	for _, pc := range c.states[state].instructions {
+		instruction := c.program.Inst[pc]
+		switch instruction.Op {
+		case syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			return true
+		case syntax.InstRune1:
+			if instruction.Rune[0] >= lowRune && instruction.Rune[0] <= highRune {
+				return true
+			}
+		case syntax.InstRune:
+			runes := instruction.Rune
+			if len(runes) == 1 {
+				runes = []rune{runes[0], runes[0]}
+			}
+			for i := 0; i+1 < len(runes); i += 2 {
+				if runes[i] <= highRune && runes[i+1] >= lowRune {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Allowed returns the tokens that can follow the generated text, as a bitset of token ids, and whether the
+// generated text is a complete match. It fails if the generated text cannot match.
+func (c *TokenConstraint) Allowed(generated []byte) ([]uint64, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	position, ok := c.advance(constraintPosition{state: c.startState}, generated)
+	if !ok {
+		return nil, false, errors.New("the generated text does not match the constraint")
+	}
+	complete := position.pending == "" && c.states[position.state].match
+	if allowed, found := c.allowed[position]; found {
+		return allowed, complete, nil
+	}
+	allowed := make([]uint64, (c.numTokens+63)/64)
+	var walk func(node *tokenTrie, position constraintPosition)
+	walk = func(node *tokenTrie, position constraintPosition) {
+		for _, id := range node.tokenIDs {
+			allowed[id/64] |= 1 << (id % 64)
+		}
+		for b, child := range node.children {
+			if next, valid := c.advance(position, []byte{b}); valid {
+				walk(child, next)
+			}
+		}
+	}
+	for b, child := range c.trie.children {
+		if next, valid := c.advance(position, []byte{b}); valid {
+			walk(child, next)
+		}
+	}
+	c.allowed[position] = allowed
+	return allowed, complete, nil
+}
+
+// TokenAllowed reports whether a token id is set in a bitset returned by Allowed.
+func TokenAllowed(allowed []uint64, id int) bool {
+	return id >= 0 && id/64 < len(allowed) && allowed[id/64]&(1<<(id%64)) != 0
+}
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// EvaluationMetric computes a metric of a model on the evaluation samples with the given indices. Indices can
+// repeat, since bootstrap samples are drawn with replacement.
+type EvaluationMetric func(indices []int) float64
+
+// ConfidenceInterval is a bootstrap confidence interval of the difference of a metric between two models.
+type ConfidenceInterval struct {
+	Delta      float64 // metric of model B minus metric of model A on all the samples
+	Lower      float64
+	Upper      float64
+	Confidence float64 // e.g. 0.95
+}
+
+// Significant returns whether the interval excludes zero, i.e. whether one model is better than the other at
+// the confidence level of the interval.
+func (c ConfidenceInterval) Significant() bool {
+	return c.Lower > 0 || c.Upper < 0
+}
+
+func (c ConfidenceInterval) String() string {
+	return fmt.Sprintf("%.4f [%.4f, %.4f] at %.0f%% confidence", c.Delta, c.Lower, c.Upper, c.Confidence*100)
+}
+
+// BootstrapDelta estimates a confidence interval of metricB - metricA on n evaluation samples with the percentile
+// bootstrap: both metrics are computed on the same iterations resamples of the samples, drawn with replacement.
+// The resamples are drawn from a generator seeded with seed, so that intervals are reproducible.
+func BootstrapDelta(n int, metricA EvaluationMetric, metricB EvaluationMetric, iterations int, confidence float64, seed int64) (ConfidenceInterval, error) {
+	if n <= 0 {
+		return ConfidenceInterval{}, errors.New("no samples to bootstrap")
+	}
+	if iterations <= 0 {
+		return ConfidenceInterval{}, errors.New("the number of bootstrap iterations must be greater than zero")
+	}
+	if confidence <= 0 || confidence >= 1 {
+		return ConfidenceInterval{}, fmt.Errorf("confidence must be between 0 and 1, got %f", confidence)
+	}
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	interval := ConfidenceInterval{Delta: metricB(indices) - metricA(indices), Confidence: confidence}
+
+	random := rand.New(rand.NewSource(seed))
+	deltas := make([]float64, iterations)
+	for iteration := range deltas {
+		for i := range indices {
+			indices[i] = random.Intn(n)
+		}
+		deltas[iteration] = metricB(indices) - metricA(indices)
+	}
+	sort.Float64s(deltas)
+	alpha := (1 - confidence) / 2
+	interval.Lower = percentile(deltas, alpha)
+	interval.Upper = percentile(deltas, 1-alpha)
+	return interval, nil
+}
+
+// percentile returns the p-th quantile of sorted values, interpolating linearly between values.
+func percentile(sorted []float64, p float64) float64 {
+	position := p * float64(len(sorted)-1)
+	lower := int(math.Floor(position))
+	upper := int(math.Ceil(position))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(position-float64(lower))
+}
+
+// AccuracyMetric is the fraction of the samples whose predicted label is the expected label.
+func AccuracyMetric(predicted []string, expected []string) EvaluationMetric {
+	return func(indices []int) float64 {
+		if len(indices) == 0 {
+			return 0
+		}
+		correct := 0
+		for _, i := range indices {
+			if predicted[i] == expected[i] {
+				correct++
+			}
+		}
+		return float64(correct) / float64(len(indices))
+	}
+}
+
+// MacroF1Metric is the mean over the expected labels of the F1 score of each label.
+func MacroF1Metric(predicted []string, expected []string) EvaluationMetric {
+	return func(indices []int) float64 {
+		truePositives := map[string]int{}
+		predictedCounts := map[string]int{}
+		expectedCounts := map[string]int{}
+		for _, i := range indices {
+			predictedCounts[predicted[i]]++
+			expectedCounts[expected[i]]++
+			if predicted[i] == expected[i] {
+				truePositives[expected[i]]++
+			}
+		}
+		if len(expectedCounts) == 0 {
+			return 0
+		}
+		sum := 0.0
+		for label, expectedCount := range expectedCounts {
+			if truePositives[label] > 0 {
+				sum += 2 * float64(truePositives[label]) / float64(predictedCounts[label]+expectedCount)
+			}
+		}
+		return sum / float64(len(expectedCounts))
+	}
+}
+
+// MeanMetric is the mean of per-sample scores, e.g. the nDCG of each query of a retrieval evaluation.
+func MeanMetric(scores []float64) EvaluationMetric {
+	return func(indices []int) float64 {
+		if len(indices) == 0 {
+			return 0
+		}
+		sum := 0.0
+		for _, i := range indices {
+			sum += scores[i]
+		}
+		return sum / float64(len(indices))
+	}
+}
+
+// NDCG returns the normalized discounted cumulative gain at k of a ranking, given the relevance of the ranked
+// results in ranking order. k must be at least 1.
+func NDCG(relevances []float64, k int) (float64, error) {
+	if k < 1 {
+		return 0, fmt.Errorf("k must be at least 1, got %d", k)
+	}
+	ideal := append([]float64{}, relevances...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(ideal)))
+	idealGain := discountedCumulativeGain(ideal, k)
+	if idealGain == 0 {
+		return 0, nil
+	}
+	return discountedCumulativeGain(relevances, k) / idealGain, nil
+}
+
+func discountedCumulativeGain(relevances []float64, k int) float64 {
+	gain := 0.0
+	for i, relevance := range relevances[:min(k, len(relevances))] {
+		gain += (math.Pow(2, relevance) - 1) / math.Log2(float64(i+2))
+	}
+	return gain
+}
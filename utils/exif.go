@@ -0,0 +1,116 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ImageOrientation returns the EXIF orientation of a JPEG, PNG or WebP image, from 1 to 8, or 1 if the image has
+// no EXIF orientation. Cameras and phones save photos as captured by the sensor, and the orientation tells how to
+// rotate and flip them for display:
+//   - 1: as stored
+//   - 2: flipped horizontally
+//   - 3: rotated by 180 degrees
+//   - 4: flipped vertically
+//   - 5: transposed, i.e. flipped along the top-left to bottom-right diagonal
+//   - 6: rotated by 90 degrees clockwise
+//   - 7: transversed, i.e. flipped along the top-right to bottom-left diagonal
+//   - 8: rotated by 90 degrees counterclockwise
+func ImageOrientation(data []byte) int {
+	exif := findExif(data)
+	if exif == nil {
+		return 1
+	}
+	orientation := exifOrientation(exif)
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// findExif returns the TIFF structure of the EXIF metadata of an image, or nil.
+func findExif(data []byte) []byte {
+	switch {
+	case len(data) > 2 && data[0] == 0xFF && data[1] == 0xD8:
+		// JPEG: the metadata is in an APP1 segment before the image data
+		for position := 2; position+4 <= len(data) && data[position] == 0xFF; {
+			marker := data[position+1]
+			if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+				position += 2
+				continue
+			}
+			if marker == 0xDA || marker == 0xD9 {
+				return nil
+			}
+			length := int(binary.BigEndian.Uint16(data[position+2:]))
+			end := position + 2 + length
+			if length < 2 || end > len(data) {
+				return nil
+			}
+			if segment := data[position+4 : end]; marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return segment[6:]
+			}
+			position = end
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		// PNG: the metadata is in an eXIf chunk
+		for position := 8; position+12 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[position:]))
+			chunkType := string(data[position+4 : position+8])
+			end := position + 12 + length
+			if length < 0 || end > len(data) || chunkType == "IDAT" {
+				return nil
+			}
+			if chunkType == "eXIf" {
+				return data[position+8 : position+8+length]
+			}
+			position = end
+		}
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		// WebP: the metadata is in an EXIF chunk, sometimes with the prefix of JPEG segments
+		for position := 12; position+8 <= len(data); {
+			length := int(binary.LittleEndian.Uint32(data[position+4:]))
+			end := position + 8 + length + length%2
+			if length < 0 || position+8+length > len(data) {
+				return nil
+			}
+			if string(data[position:position+4]) == "EXIF" {
+				return bytes.TrimPrefix(data[position+8:position+8+length], []byte("Exif\x00\x00"))
+			}
+			position = end
+		}
+	}
+	return nil
+}
+
+// exifOrientation reads the orientation tag of the first image file directory of a TIFF structure, or returns 0.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	directory := int(order.Uint32(tiff[4:]))
+	if directory < 8 || directory+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[directory:]))
+	for i := 0; i < entries; i++ {
+		entry := directory + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// the orientation is a SHORT, stored in the first bytes of the value
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package util
+
+import "math"
+
+// Fbank computes log mel filter bank features as Kaldi does, the input of speaker embedding models such as the
+// WeSpeaker ones: frames of 25ms every 10ms without padding, with the DC offset removed, a pre-emphasis of 0.97
+// and a Povey window, zero-padded to a power of two, projected on triangular filters evenly spaced on the HTK mel
+// scale from 20 Hz to the Nyquist frequency, in natural log scale. It is safe for concurrent use.
+type Fbank struct {
+	FrameLength int // samples per frame
+	FrameShift  int // samples between frames
+	NumMels     int
+	window      []float64
+	twiddles    []complex128
+	filters     []melFilter
+}
+
+// NewFbank creates the window and the mel filter bank for the sample rate and number of mels, e.g. 16000 and 80.
+func NewFbank(sampleRate int, numMels int) *Fbank {
+	f := &Fbank{FrameLength: sampleRate * 25 / 1000, FrameShift: sampleRate / 100, NumMels: numMels}
+	numFFT := 1
+	for numFFT < f.FrameLength {
+		numFFT *= 2
+	}
+	f.window = make([]float64, f.FrameLength)
+	for i := range f.window {
+		f.window[i] = math.Pow(0.5-0.5*math.Cos(2*math.Pi*float64(i)/float64(f.FrameLength-1)), 0.85)
+	}
+	f.twiddles = make([]complex128, numFFT)
+	for i := range f.twiddles {
+		angle := -2 * math.Pi * float64(i) / float64(numFFT)
+		f.twiddles[i] = complex(math.Cos(angle), math.Sin(angle))
+	}
+
+	// triangles in the mel domain between mel points evenly spaced from 20 Hz to the Nyquist frequency
+	htkMel := func(frequency float64) float64 {
+		return 1127 * math.Log(1+frequency/700)
+	}
+	lowMel, highMel := htkMel(20), htkMel(float64(sampleRate)/2)
+	melStep := (highMel - lowMel) / float64(numMels+1)
+	f.filters = make([]melFilter, numMels)
+	for i := range f.filters {
+		lower, center, upper := lowMel+float64(i)*melStep, lowMel+float64(i+1)*melStep, lowMel+float64(i+2)*melStep
+		filter := melFilter{start: -1}
+		for bin := 0; bin < numFFT/2; bin++ {
+			mel := htkMel(float64(bin) * float64(sampleRate) / float64(numFFT))
+			weight := max(0, min((mel-lower)/(center-lower), (upper-mel)/(upper-center)))
+			if weight > 0 {
+				if filter.start < 0 {
+					filter.start = bin
+				}
+				filter.weights = append(filter.weights, weight)
+			} else if filter.start >= 0 {
+				break
+			}
+		}
+		if filter.start < 0 {
+			filter.start = 0
+		}
+		f.filters[i] = filter
+	}
+	return f
+}
+
+// NumFrames returns the number of frames of numSamples samples.
+func (f *Fbank) NumFrames(numSamples int) int {
+	if numSamples < f.FrameLength {
+		return 0
+	}
+	return 1 + (numSamples-f.FrameLength)/f.FrameShift
+}
+
+// Features returns the features of the samples, as a NumFrames x NumMels matrix in row-major order. Kaldi features
+// are usually computed on samples scaled to 16 bit integers, i.e. multiplied by 32768.
+func (f *Fbank) Features(samples []float32) []float32 {
+	numFrames := f.NumFrames(len(samples))
+	features := make([]float32, numFrames*f.NumMels)
+	frame := make([]complex128, len(f.twiddles))
+	values := make([]float64, f.FrameLength)
+	power := make([]float64, len(f.twiddles)/2+1)
+	for n := 0; n < numFrames; n++ {
+		start := n * f.FrameShift
+		var mean float64
+		for i := range values {
+			values[i] = float64(samples[start+i])
+			mean += values[i]
+		}
+		mean /= float64(f.FrameLength)
+		for i := range values {
+			values[i] -= mean
+		}
+		for i := len(values) - 1; i > 0; i-- {
+			values[i] -= 0.97 * values[i-1]
+		}
+		values[0] -= 0.97 * values[0]
+		for i := range frame {
+			frame[i] = 0
+			if i < f.FrameLength {
+				frame[i] = complex(values[i]*f.window[i], 0)
+			}
+		}
+		spectrum := fft(frame, f.twiddles, 1)
+		for bin := range power {
+			power[bin] = real(spectrum[bin])*real(spectrum[bin]) + imag(spectrum[bin])*imag(spectrum[bin])
+		}
+		for mel, filter := range f.filters {
+			var energy float64
+			for i, weight := range filter.weights {
+				energy += weight * power[filter.start+i]
+			}
+			features[n*f.NumMels+mel] = float32(math.Log(max(energy, 1.1920929e-07)))
+		}
+	}
+	return features
+}
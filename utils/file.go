@@ -1,7 +1,10 @@
 package util
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"path/filepath"
@@ -29,6 +32,42 @@ func ReadFileBytes(filename string) ([]byte, error) {
 	return outBytes, err
 }
 
+// FileSHA256 returns the hex encoded SHA-256 hash of the content of the file at filename.
+func FileSHA256(filename string) (hash string, err error) {
+	file, err := FileSystem.OpenURL(context.Background(), filename)
+	if err != nil {
+		return "", err
+	}
+	defer func(file io.Closer) {
+		err = errors.Join(err, CloseFile(file))
+	}(file)
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// FileSize returns the size in bytes of the file at filename.
+func FileSize(filename string) (int64, error) {
+	object, err := FileSystem.Object(context.Background(), filename)
+	if err != nil {
+		return 0, err
+	}
+	return object.Size(), nil
+}
+
+// WriteFileBytes writes data to the file at filename, which may be on S3, replacing the file if it exists.
+func WriteFileBytes(filename string, data []byte) error {
+	return FileSystem.Upload(context.Background(), filename, 0o644, bytes.NewReader(data))
+}
+
+// FileExists returns whether there is a file at filename.
+func FileExists(filename string) (bool, error) {
+	return FileSystem.Exists(context.Background(), filename)
+}
+
 func CloseFile(file io.Closer) error {
 	return file.Close()
 }
@@ -0,0 +1,386 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter is a parsed filter expression such as `score >= 0.8 && label != "neutral"`.
+// Expressions compare fields with string, number or boolean literals using ==, !=, <, <=, > and >=,
+// and combine comparisons with &&, || and !, and with parentheses. A field on its own is true if it
+// is a true boolean. Field names are case-insensitive.
+type Filter struct {
+	expression string
+	root       filterNode
+}
+
+// filterNode is a node in the syntax tree of a filter expression.
+type filterNode interface {
+	eval(fields map[string]any) (any, error)
+}
+
+type filterLiteral struct {
+	value any
+}
+
+type filterField struct {
+	name string
+}
+
+type filterNot struct {
+	operand filterNode
+}
+
+type filterBinary struct {
+	operator string
+	left     filterNode
+	right    filterNode
+}
+
+// ParseFilter parses a filter expression.
+func ParseFilter(expression string) (*Filter, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expression, err)
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %s", expression, parser.tokens[parser.position].text)
+	}
+	return &Filter{expression: expression, root: root}, nil
+}
+
+// Match evaluates the filter on the given fields.
+func (f *Filter) Match(fields map[string]any) (bool, error) {
+	result, err := f.root.eval(fields)
+	if err != nil {
+		return false, fmt.Errorf("cannot evaluate filter %q: %w", f.expression, err)
+	}
+	match, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("filter %q does not evaluate to a boolean", f.expression)
+	}
+	return match, nil
+}
+
+func (f *Filter) String() string {
+	return f.expression
+}
+
+func (n filterLiteral) eval(_ map[string]any) (any, error) {
+	return n.value, nil
+}
+
+func (n filterField) eval(fields map[string]any) (any, error) {
+	for k, v := range fields {
+		if strings.EqualFold(k, n.name) {
+			switch value := v.(type) {
+			case float32:
+				return float64(value), nil
+			case int:
+				return float64(value), nil
+			case int64:
+				return float64(value), nil
+			case uint:
+				return float64(value), nil
+			case uint32:
+				return float64(value), nil
+			default:
+				return v, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("field %s not found", n.name)
+}
+
+func (n filterNot) eval(fields map[string]any) (any, error) {
+	value, err := n.operand.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! can only be applied to booleans, got %v", value)
+	}
+	return !b, nil
+}
+
+func (n filterBinary) eval(fields map[string]any) (any, error) {
+	left, err := n.left.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// short-circuit the logical operators
+	if n.operator == "&&" || n.operator == "||" {
+		leftBool, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s can only be applied to booleans, got %v", n.operator, left)
+		}
+		if (n.operator == "&&" && !leftBool) || (n.operator == "||" && leftBool) {
+			return leftBool, nil
+		}
+		right, rightErr := n.right.eval(fields)
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		rightBool, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s can only be applied to booleans, got %v", n.operator, right)
+		}
+		return rightBool, nil
+	}
+
+	right, err := n.right.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare number %v with %v", l, right)
+		}
+		return compareOrdered(n.operator, l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare string %q with %v", l, right)
+		}
+		return compareOrdered(n.operator, l, r)
+	case bool:
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare boolean %v with %v", l, right)
+		}
+		switch n.operator {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		default:
+			return nil, fmt.Errorf("operator %s cannot be applied to booleans", n.operator)
+		}
+	default:
+		return nil, fmt.Errorf("cannot compare value %v", left)
+	}
+}
+
+func compareOrdered[T float64 | string](operator string, l, r T) (bool, error) {
+	switch operator {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	default:
+		return false, fmt.Errorf("unknown operator %s", operator)
+	}
+}
+
+// parsing
+
+type filterTokenKind int
+
+const (
+	filterTokenIdentifier filterTokenKind = iota
+	filterTokenNumber
+	filterTokenString
+	filterTokenOperator
+)
+
+type filterToken struct {
+	kind  filterTokenKind
+	text  string
+	value any
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			var sb strings.Builder
+			for end < len(runes) && runes[end] != c {
+				if runes[end] == '\\' && end+1 < len(runes) {
+					end++
+				}
+				sb.WriteRune(runes[end])
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in filter %q", expression)
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenString, text: string(runes[i : end+1]), value: sb.String()})
+			i = end + 1
+		case unicode.IsDigit(c) || c == '.' || (c == '-' && i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.')):
+			end := i + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.' || runes[end] == 'e' || runes[end] == 'E' ||
+				((runes[end] == '-' || runes[end] == '+') && (runes[end-1] == 'e' || runes[end-1] == 'E'))) {
+				end++
+			}
+			text := string(runes[i:end])
+			number, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s in filter %q", text, expression)
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenNumber, text: text, value: number})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i + 1
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenIdentifier, text: string(runes[i:end])})
+			i = end
+		default:
+			operator := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", ">=", "<=", ">", "<", "!", "(", ")"} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q in filter %q", c, expression)
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenOperator, text: operator})
+			i += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens   []filterToken
+	position int
+}
+
+func (p *filterParser) peekOperator(operators ...string) (string, bool) {
+	if p.position >= len(p.tokens) || p.tokens[p.position].kind != filterTokenOperator {
+		return "", false
+	}
+	for _, operator := range operators {
+		if p.tokens[p.position].text == operator {
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOperator("||"); !ok {
+			return left, nil
+		}
+		p.position++
+		right, rightErr := p.parseAnd()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = filterBinary{operator: "||", left: left, right: right}
+	}
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOperator("&&"); !ok {
+			return left, nil
+		}
+		p.position++
+		right, rightErr := p.parseUnary()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = filterBinary{operator: "&&", left: left, right: right}
+	}
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if _, ok := p.peekOperator("!"); ok {
+		p.position++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	operator, ok := p.peekOperator("==", "!=", ">=", "<=", ">", "<")
+	if !ok {
+		return left, nil
+	}
+	p.position++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return filterBinary{operator: operator, left: left, right: right}, nil
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	if p.position >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	token := p.tokens[p.position]
+	p.position++
+	switch token.kind {
+	case filterTokenNumber, filterTokenString:
+		return filterLiteral{value: token.value}, nil
+	case filterTokenIdentifier:
+		switch token.text {
+		case "true":
+			return filterLiteral{value: true}, nil
+		case "false":
+			return filterLiteral{value: false}, nil
+		default:
+			return filterField{name: token.text}, nil
+		}
+	default:
+		if token.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.peekOperator(")"); !ok {
+				return nil, fmt.Errorf("missing closing parenthesis")
+			}
+			p.position++
+			return node, nil
+		}
+		return nil, fmt.Errorf("unexpected %s", token.text)
+	}
+}
@@ -0,0 +1,444 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// DecodeFLAC decodes a FLAC file into mono samples between -1 and 1, averaging the channels, and returns them
+// with the sample rate of the file. All the FLAC subframe types and channel decorrelations are supported, with
+// 4 to 32 bits per sample. The checksums of the frames are not verified.
+func DecodeFLAC(data []byte) ([]float32, int, error) {
+	if len(data) < 4 || string(data[0:4]) != "fLaC" {
+		return nil, 0, errors.New("not a FLAC file")
+	}
+	stream := flacStream{}
+	offset := 4
+	for last := false; !last; {
+		if offset+4 > len(data) {
+			return nil, 0, errors.New("truncated FLAC metadata")
+		}
+		last = data[offset]&0x80 != 0
+		blockType := data[offset] & 0x7F
+		length := int(data[offset+1])<<16 | int(data[offset+2])<<8 | int(data[offset+3])
+		offset += 4
+		if offset+length > len(data) {
+			return nil, 0, errors.New("truncated FLAC metadata")
+		}
+		if blockType == 0 {
+			if length < 34 {
+				return nil, 0, errors.New("invalid FLAC stream info")
+			}
+			info := data[offset : offset+34]
+			stream.sampleRate = int(info[10])<<12 | int(info[11])<<4 | int(info[12])>>4
+			stream.channels = int(info[12]>>1&0x07) + 1
+			stream.bitsPerSample = int(info[12]&0x01)<<4 | int(info[13]>>4) + 1
+			stream.totalSamples = int(binary.BigEndian.Uint64(info[10:18]) & 0xFFFFFFFFF)
+			stream.hasInfo = true
+		}
+		offset += length
+	}
+	if !stream.hasInfo {
+		return nil, 0, errors.New("FLAC file without stream info")
+	}
+
+	var mono []float32
+	reader := &bitReader{data: data, position: offset * 8}
+	// the frames end at the total number of samples if the stream info has it, e.g. before an ID3 tag
+	for reader.position/8+2 <= len(data) && (stream.totalSamples == 0 || len(mono) < stream.totalSamples) {
+		samples, sampleRate, err := stream.decodeFrame(reader)
+		if err != nil {
+			return nil, 0, err
+		}
+		if sampleRate != 0 {
+			stream.sampleRate = sampleRate
+		}
+		mono = append(mono, samples...)
+	}
+	if stream.sampleRate == 0 {
+		return nil, 0, errors.New("FLAC file without sample rate")
+	}
+	return mono, stream.sampleRate, nil
+}
+
+// flacStream holds the stream info of a FLAC file.
+type flacStream struct {
+	sampleRate    int
+	channels      int
+	bitsPerSample int
+	totalSamples  int
+	hasInfo       bool
+}
+
+// decodeFrame decodes a frame into mono samples, and returns its sample rate if the frame header sets it.
+func (s *flacStream) decodeFrame(r *bitReader) ([]float32, int, error) {
+	sync, err := r.read(14)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sync != 0x3FFE {
+		return nil, 0, fmt.Errorf("invalid FLAC frame sync code at byte %d", r.position/8)
+	}
+	header, err := r.read(18) // reserved, blocking strategy, block size, sample rate, channels, sample size, reserved
+	if err != nil {
+		return nil, 0, err
+	}
+	blockSizeCode := header >> 12 & 0x0F
+	sampleRateCode := header >> 8 & 0x0F
+	channelAssignment := int(header >> 4 & 0x0F)
+	sampleSizeCode := header >> 1 & 0x07
+	if err = r.skipUTF8(); err != nil {
+		return nil, 0, err
+	}
+
+	var blockSize int
+	switch {
+	case blockSizeCode == 1:
+		blockSize = 192
+	case blockSizeCode >= 2 && blockSizeCode <= 5:
+		blockSize = 576 << (blockSizeCode - 2)
+	case blockSizeCode == 6 || blockSizeCode == 7:
+		size, sizeErr := r.read(8 << (blockSizeCode - 6))
+		if sizeErr != nil {
+			return nil, 0, sizeErr
+		}
+		blockSize = int(size) + 1
+	case blockSizeCode >= 8:
+		blockSize = 256 << (blockSizeCode - 8)
+	default:
+		return nil, 0, errors.New("reserved FLAC block size")
+	}
+
+	sampleRate := 0
+	switch sampleRateCode {
+	case 0:
+	case 12, 13, 14:
+		bits := uint(8)
+		if sampleRateCode != 12 {
+			bits = 16
+		}
+		rate, rateErr := r.read(bits)
+		if rateErr != nil {
+			return nil, 0, rateErr
+		}
+		sampleRate = int(rate) * []int{1000, 1, 10}[sampleRateCode-12]
+	case 15:
+		return nil, 0, errors.New("invalid FLAC sample rate")
+	default:
+		sampleRate = []int{0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000}[sampleRateCode]
+	}
+
+	bitsPerSample := s.bitsPerSample
+	if sampleSizeCode != 0 {
+		bitsPerSample = []int{0, 8, 12, 0, 16, 20, 24, 32}[sampleSizeCode]
+		if bitsPerSample == 0 {
+			return nil, 0, errors.New("reserved FLAC sample size")
+		}
+	}
+	if _, err = r.read(8); err != nil { // CRC-8 of the header
+		return nil, 0, err
+	}
+
+	channels := channelAssignment + 1
+	if channelAssignment > 7 {
+		if channelAssignment > 10 {
+			return nil, 0, errors.New("reserved FLAC channel assignment")
+		}
+		channels = 2
+	}
+	subframes := make([][]int64, channels)
+	for channel := range subframes {
+		bits := bitsPerSample
+		// the side channel has an extra bit
+		if (channelAssignment == 8 || channelAssignment == 10) && channel == 1 || channelAssignment == 9 && channel == 0 {
+			bits++
+		}
+		if subframes[channel], err = decodeSubframe(r, blockSize, bits); err != nil {
+			return nil, 0, err
+		}
+	}
+	r.align()
+	if _, err = r.read(16); err != nil { // CRC-16 of the frame
+		return nil, 0, err
+	}
+
+	switch channelAssignment {
+	case 8: // left and side
+		for i, side := range subframes[1] {
+			subframes[1][i] = subframes[0][i] - side
+		}
+	case 9: // side and right
+		for i, side := range subframes[0] {
+			subframes[0][i] = side + subframes[1][i]
+		}
+	case 10: // mid and side
+		for i, side := range subframes[1] {
+			mid := subframes[0][i]<<1 | side&1
+			subframes[0][i], subframes[1][i] = (mid+side)>>1, (mid-side)>>1
+		}
+	}
+	scale := float64(int64(1) << (bitsPerSample - 1))
+	mono := make([]float32, blockSize)
+	for i := range mono {
+		var sum int64
+		for _, subframe := range subframes {
+			sum += subframe[i]
+		}
+		mono[i] = float32(float64(sum) / float64(channels) / scale)
+	}
+	return mono, sampleRate, nil
+}
+
+// fixedCoefficients are the coefficients of the fixed predictors of each order.
+var fixedCoefficients = [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}
+
+// decodeSubframe decodes the samples of a channel of a frame.
+func decodeSubframe(r *bitReader, blockSize int, bitsPerSample int) ([]int64, error) {
+	header, err := r.read(8)
+	if err != nil {
+		return nil, err
+	}
+	subframeType := header >> 1 & 0x3F
+	wasted := 0
+	if header&1 == 1 {
+		zeros, unaryErr := r.readUnary()
+		if unaryErr != nil {
+			return nil, unaryErr
+		}
+		wasted = int(zeros) + 1
+		bitsPerSample -= wasted
+	}
+	samples := make([]int64, blockSize)
+
+	switch {
+	case subframeType == 0: // constant
+		value, valueErr := r.readSigned(uint(bitsPerSample))
+		if valueErr != nil {
+			return nil, valueErr
+		}
+		for i := range samples {
+			samples[i] = value
+		}
+	case subframeType == 1: // verbatim
+		for i := range samples {
+			if samples[i], err = r.readSigned(uint(bitsPerSample)); err != nil {
+				return nil, err
+			}
+		}
+	case subframeType >= 8 && subframeType <= 12: // fixed predictor
+		order := int(subframeType - 8)
+		if err = readWarmUp(r, samples, bitsPerSample, order); err != nil {
+			return nil, err
+		}
+		if err = decodePrediction(r, samples, order, fixedCoefficients[order], 0); err != nil {
+			return nil, err
+		}
+	case subframeType >= 32: // linear predictor
+		order := int(subframeType-32) + 1
+		if err = readWarmUp(r, samples, bitsPerSample, order); err != nil {
+			return nil, err
+		}
+		precision, precisionErr := r.read(4)
+		if precisionErr != nil {
+			return nil, precisionErr
+		}
+		if precision == 15 {
+			return nil, errors.New("invalid FLAC coefficient precision")
+		}
+		shift, shiftErr := r.readSigned(5)
+		if shiftErr != nil {
+			return nil, shiftErr
+		}
+		if shift < 0 {
+			return nil, errors.New("negative FLAC predictor shift")
+		}
+		coefficients := make([]int64, order)
+		for i := range coefficients {
+			if coefficients[i], err = r.readSigned(uint(precision) + 1); err != nil {
+				return nil, err
+			}
+		}
+		if err = decodePrediction(r, samples, order, coefficients, uint(shift)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("reserved FLAC subframe type %d", subframeType)
+	}
+
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= wasted
+		}
+	}
+	return samples, nil
+}
+
+// readWarmUp reads the unpredicted samples at the start of a predicted subframe.
+func readWarmUp(r *bitReader, samples []int64, bitsPerSample int, order int) error {
+	if order > len(samples) {
+		return errors.New("FLAC predictor order larger than the block size")
+	}
+	var err error
+	for i := range order {
+		if samples[i], err = r.readSigned(uint(bitsPerSample)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodePrediction decodes the residual of a predicted subframe after its warm-up samples, and restores its samples.
+func decodePrediction(r *bitReader, samples []int64, order int, coefficients []int64, shift uint) error {
+	if err := decodeResidual(r, samples, order); err != nil {
+		return err
+	}
+	for i := order; i < len(samples); i++ {
+		var prediction int64
+		for j, coefficient := range coefficients {
+			prediction += coefficient * samples[i-j-1]
+		}
+		samples[i] += prediction >> shift
+	}
+	return nil
+}
+
+// decodeResidual decodes the Rice coded residual of a predicted subframe into the samples after the warm-up ones.
+func decodeResidual(r *bitReader, samples []int64, order int) error {
+	method, err := r.read(2)
+	if err != nil {
+		return err
+	}
+	if method > 1 {
+		return errors.New("reserved FLAC residual coding method")
+	}
+	parameterBits, escape := uint(4), uint64(15)
+	if method == 1 {
+		parameterBits, escape = 5, 31
+	}
+	partitionOrder, err := r.read(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	partitionSize := len(samples) >> partitionOrder
+	if partitionSize < order || partitionSize<<partitionOrder != len(samples) {
+		return errors.New("invalid FLAC residual partition order")
+	}
+	i := order
+	for partition := range partitions {
+		end := (partition + 1) * partitionSize
+		parameter, parameterErr := r.read(parameterBits)
+		if parameterErr != nil {
+			return parameterErr
+		}
+		if parameter == escape {
+			bits, bitsErr := r.read(5)
+			if bitsErr != nil {
+				return bitsErr
+			}
+			for ; i < end; i++ {
+				if samples[i], err = r.readSigned(uint(bits)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for ; i < end; i++ {
+			quotient, unaryErr := r.readUnary()
+			if unaryErr != nil {
+				return unaryErr
+			}
+			remainder, remainderErr := r.read(uint(parameter))
+			if remainderErr != nil {
+				return remainderErr
+			}
+			value := quotient<<parameter | remainder
+			samples[i] = int64(value>>1) ^ -int64(value&1)
+		}
+	}
+	return nil
+}
+
+// bitReader reads big-endian bit fields from a byte slice.
+type bitReader struct {
+	data     []byte
+	position int // in bits
+}
+
+var errTruncated = errors.New("truncated audio data")
+
+// read reads an unsigned value of up to 64 bits.
+func (r *bitReader) read(bits uint) (uint64, error) {
+	if r.position+int(bits) > len(r.data)*8 {
+		return 0, errTruncated
+	}
+	var value uint64
+	for bits > 0 {
+		available := 8 - uint(r.position%8)
+		take := min(available, bits)
+		current := uint64(r.data[r.position/8]>>(available-take)) & (1<<take - 1)
+		value = value<<take | current
+		r.position += int(take)
+		bits -= take
+	}
+	return value, nil
+}
+
+// readSigned reads a two's complement value of up to 64 bits.
+func (r *bitReader) readSigned(bits uint) (int64, error) {
+	if bits == 0 {
+		return 0, nil
+	}
+	value, err := r.read(bits)
+	if err != nil {
+		return 0, err
+	}
+	return int64(value<<(64-bits)) >> (64 - bits), nil
+}
+
+// readUnary counts the zero bits before the next one bit, and reads the one bit.
+func (r *bitReader) readUnary() (uint64, error) {
+	var zeros uint64
+	for {
+		if r.position >= len(r.data)*8 {
+			return 0, errTruncated
+		}
+		if r.position%8 == 0 && r.data[r.position/8] == 0 {
+			zeros += 8
+			r.position += 8
+			continue
+		}
+		bit := r.data[r.position/8] >> (7 - r.position%8) & 1
+		r.position++
+		if bit == 1 {
+			return zeros, nil
+		}
+		zeros++
+	}
+}
+
+// skipUTF8 skips a number coded as UTF-8, as the frame and sample numbers of FLAC frame headers.
+func (r *bitReader) skipUTF8() error {
+	first, err := r.read(8)
+	if err != nil {
+		return err
+	}
+	continuation := 0
+	for mask := uint64(0x80); first&mask != 0 && mask > 1; mask >>= 1 {
+		continuation++
+	}
+	if continuation == 1 {
+		return errors.New("invalid FLAC frame number")
+	}
+	if continuation > 0 {
+		continuation--
+	}
+	_, err = r.read(uint(continuation) * 8)
+	return err
+}
+
+// align skips to the next byte boundary.
+func (r *bitReader) align() {
+	r.position = (r.position + 7) / 8 * 8
+}
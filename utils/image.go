@@ -0,0 +1,371 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"  // register the gif decoder for DecodeImage
+	_ "image/jpeg" // register the jpeg decoder for DecodeImage
+	_ "image/png"  // register the png decoder for DecodeImage
+	"math"
+	"runtime"
+	"sync"
+
+	_ "golang.org/x/image/webp" // register the webp decoder for DecodeImage
+)
+
+// ImageFilter is the interpolation filter used to resize images.
+type ImageFilter int
+
+const (
+	Bilinear ImageFilter = iota
+	Bicubic
+	Nearest
+	Box
+	Hamming
+	Lanczos
+)
+
+// PILImageFilter returns the filter of a PIL resampling filter, the resample of preprocessor_config.json: 0 for
+// nearest, 1 for lanczos, 2 for bilinear, 3 for bicubic, 4 for box and 5 for hamming. Unknown filters are
+// bilinear.
+func PILImageFilter(resample int) ImageFilter {
+	switch resample {
+	case 0:
+		return Nearest
+	case 1:
+		return Lanczos
+	case 3:
+		return Bicubic
+	case 4:
+		return Box
+	case 5:
+		return Hamming
+	default:
+		return Bilinear
+	}
+}
+
+// support returns the radius of the filter, in source pixels when upscaling.
+func (f ImageFilter) support() float64 {
+	switch f {
+	case Box:
+		return 0.5
+	case Bicubic:
+		return 2
+	case Lanczos:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// weight is the filter function of PIL.
+func (f ImageFilter) weight(x float64) float64 {
+	switch f {
+	case Box:
+		if x > -0.5 && x <= 0.5 {
+			return 1
+		}
+		return 0
+	case Lanczos:
+		if x >= -3 && x < 3 {
+			return sinc(x) * sinc(x/3)
+		}
+		return 0
+	}
+	x = math.Abs(x)
+	switch f {
+	case Bicubic:
+		// cubic convolution with a = -0.5, as in PIL
+		const a = -0.5
+		switch {
+		case x < 1:
+			return ((a+2)*x-(a+3))*x*x + 1
+		case x < 2:
+			return ((a*x-5*a)*x+8*a)*x - 4*a
+		}
+		return 0
+	case Hamming:
+		if x == 0 {
+			return 1
+		}
+		if x >= 1 {
+			return 0
+		}
+		x *= math.Pi
+		// PIL uses single precision constants
+		return math.Sin(x) / x * (float64(float32(0.54)) + float64(float32(0.46))*math.Cos(x))
+	}
+	return max(0, 1-x)
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// resamplePrecision is the number of fractional bits of the fixed point filter weights with which PIL resamples
+// 8 bit images.
+const resamplePrecision = 22
+
+// ResizeImage resizes an image as PIL does, which is what the transformers image processors and so image models
+// are trained with: the image is resampled horizontally and then vertically with the fixed point arithmetic of
+// PIL, so that the pixels are identical, and when downscaling the filter covers all the source pixels of each
+// target pixel, which avoids aliasing. Rows are resampled in parallel. Transparency is dropped.
+func ResizeImage(img image.Image, width int, height int, filter ImageFilter) *image.NRGBA {
+	source := toNRGBA(img)
+	sourceWidth, sourceHeight := source.Rect.Dx(), source.Rect.Dy()
+	if filter == Nearest {
+		return resizeNearest(source, width, height)
+	}
+
+	// as in PIL, a pass is skipped if its size is unchanged
+	horizontal := source
+	if width != sourceWidth {
+		horizontal = image.NewNRGBA(image.Rect(0, 0, width, sourceHeight))
+		starts, weights := resampleWeights(sourceWidth, width, filter)
+		parallelRows(sourceHeight, func(y int) {
+			row := source.Pix[y*source.Stride:]
+			target := horizontal.Pix[y*horizontal.Stride:]
+			for x := 0; x < width; x++ {
+				var r, g, b int64 = 1 << (resamplePrecision - 1), 1 << (resamplePrecision - 1), 1 << (resamplePrecision - 1)
+				for i, weight := range weights[x] {
+					offset := (starts[x] + i) * 4
+					r += weight * int64(row[offset])
+					g += weight * int64(row[offset+1])
+					b += weight * int64(row[offset+2])
+				}
+				target[x*4], target[x*4+1], target[x*4+2], target[x*4+3] = clipFixed(r), clipFixed(g), clipFixed(b), 255
+			}
+		})
+	}
+
+	resized := horizontal
+	if height != sourceHeight {
+		resized = image.NewNRGBA(image.Rect(0, 0, width, height))
+		starts, weights := resampleWeights(sourceHeight, height, filter)
+		parallelRows(height, func(y int) {
+			target := resized.Pix[y*resized.Stride:]
+			for x := 0; x < width; x++ {
+				var r, g, b int64 = 1 << (resamplePrecision - 1), 1 << (resamplePrecision - 1), 1 << (resamplePrecision - 1)
+				for i, weight := range weights[y] {
+					offset := (starts[y]+i)*horizontal.Stride + x*4
+					r += weight * int64(horizontal.Pix[offset])
+					g += weight * int64(horizontal.Pix[offset+1])
+					b += weight * int64(horizontal.Pix[offset+2])
+				}
+				target[x*4], target[x*4+1], target[x*4+2], target[x*4+3] = clipFixed(r), clipFixed(g), clipFixed(b), 255
+			}
+		})
+	}
+	if resized == source {
+		return ImageToRGB(source)
+	}
+	return resized
+}
+
+// resizeNearest resizes an image with the nearest neighbour, the source pixel under the center of each target
+// pixel, as PIL does.
+func resizeNearest(source *image.NRGBA, width int, height int) *image.NRGBA {
+	resized := image.NewNRGBA(image.Rect(0, 0, width, height))
+	scaleX := float64(source.Rect.Dx()) / float64(width)
+	scaleY := float64(source.Rect.Dy()) / float64(height)
+	parallelRows(height, func(y int) {
+		sourceY := int((float64(y) + 0.5) * scaleY)
+		for x := 0; x < width; x++ {
+			sourceX := int((float64(x) + 0.5) * scaleX)
+			offset := y*resized.Stride + x*4
+			copy(resized.Pix[offset:offset+3], source.Pix[sourceY*source.Stride+sourceX*4:])
+			resized.Pix[offset+3] = 255
+		}
+	})
+	return resized
+}
+
+// resampleWeights returns, for each target pixel, the first source pixel it covers and the normalized filter
+// weights of the source pixels from that one, in fixed point with resamplePrecision fractional bits.
+func resampleWeights(sourceSize int, targetSize int, filter ImageFilter) ([]int, [][]int64) {
+	scale := float64(sourceSize) / float64(targetSize)
+	filterScale := max(scale, 1)
+	support := filter.support() * filterScale
+	starts := make([]int, targetSize)
+	weights := make([][]int64, targetSize)
+	pixelWeights := make([]float64, int(math.Ceil(support))*2+1)
+	for i := range starts {
+		center := (float64(i) + 0.5) * scale
+		start := max(int(center-support+0.5), 0)
+		end := min(int(center+support+0.5), sourceSize)
+		count := max(end-start, 0)
+		var total float64
+		for j := 0; j < count; j++ {
+			pixelWeights[j] = filter.weight((float64(start+j) - center + 0.5) * (1 / filterScale))
+			total += pixelWeights[j]
+		}
+		fixed := make([]int64, count)
+		for j := range fixed {
+			weight := pixelWeights[j]
+			if total != 0 {
+				weight /= total
+			}
+			if weight < 0 {
+				fixed[j] = int64(-0.5 + weight*(1<<resamplePrecision))
+			} else {
+				fixed[j] = int64(0.5 + weight*(1<<resamplePrecision))
+			}
+		}
+		starts[i], weights[i] = start, fixed
+	}
+	return starts, weights
+}
+
+// clipFixed converts a fixed point value to 8 bits.
+func clipFixed(value int64) uint8 {
+	return uint8(min(max(value>>resamplePrecision, 0), 255))
+}
+
+// parallelRows runs process on the rows of an image, split among the CPUs.
+func parallelRows(rows int, process func(y int)) {
+	workers := min(runtime.GOMAXPROCS(0), rows)
+	if workers <= 1 || rows < 64 {
+		for y := 0; y < rows; y++ {
+			process(y)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	chunk := (rows + workers - 1) / workers
+	for start := 0; start < rows; start += chunk {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			for y := start; y < min(start+chunk, rows); y++ {
+				process(y)
+			}
+		}(start)
+	}
+	wg.Wait()
+}
+
+// toNRGBA converts an image to non-premultiplied RGBA with its origin at zero, so that its pixels can be read
+// directly.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+	return nrgba
+}
+
+// ResizeShortestEdge returns the size of an image resized so that its shortest edge has the given length,
+// keeping its aspect ratio.
+func ResizeShortestEdge(img image.Image, shortestEdge int) (int, int) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= height {
+		return shortestEdge, int(float64(shortestEdge) * float64(height) / float64(width))
+	}
+	return int(float64(shortestEdge) * float64(width) / float64(height)), shortestEdge
+}
+
+// CenterCropImage crops the center of an image to the given size. Images smaller than the size are padded with
+// black.
+func CenterCropImage(img image.Image, width int, height int) *image.NRGBA {
+	bounds := img.Bounds()
+	top := (bounds.Dy() - height) / 2
+	left := (bounds.Dx() - width) / 2
+	cropped := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(cropped, cropped.Rect, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	draw.Draw(cropped, cropped.Rect, img, bounds.Min.Add(image.Pt(left, top)), draw.Src)
+	return cropped
+}
+
+// ImagePixels returns the RGB values of an image in channel first order, each multiplied by rescale and then
+// normalized with the mean and standard deviation of its channel.
+func ImagePixels(img image.Image, rescale float32, mean [3]float32, std [3]float32) []float32 {
+	source := toNRGBA(img)
+	width, height := source.Rect.Dx(), source.Rect.Dy()
+	planeSize := width * height
+	pixels := make([]float32, 3*planeSize)
+	parallelRows(height, func(y int) {
+		for x := 0; x < width; x++ {
+			offset := y*source.Stride + x*4
+			for channel := 0; channel < 3; channel++ {
+				value := float32(source.Pix[offset+channel]) * rescale
+				pixels[channel*planeSize+y*width+x] = (value - mean[channel]) / std[channel]
+			}
+		}
+	})
+	return pixels
+}
+
+// DecodeImage decodes a JPEG, PNG, GIF or WebP image, e.g. the bytes of an upload, as transformers loads images:
+// the image is rotated and flipped as set by its EXIF orientation, and converted to 8 bit RGB, from grayscale,
+// CMYK, YCbCr, paletted or 16 bit images. Transparency is dropped, as PIL's convert("RGB") does.
+func DecodeImage(data []byte) (*image.NRGBA, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, errors.New("unsupported image format, expected JPEG, PNG, GIF or WebP")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %w", err)
+	}
+	return OrientImage(ImageToRGB(img), ImageOrientation(data)), nil
+}
+
+// ImageToRGB converts an image to 8 bit RGB, as an opaque non-premultiplied RGBA image. Non-premultiplied images
+// keep the color of their transparent pixels.
+func ImageToRGB(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	rgb := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		for y := 0; y < rgb.Rect.Dy(); y++ {
+			copy(rgb.Pix[y*rgb.Stride:(y+1)*rgb.Stride], nrgba.Pix[nrgba.PixOffset(bounds.Min.X, bounds.Min.Y+y):])
+		}
+	} else {
+		draw.Draw(rgb, rgb.Rect, img, bounds.Min, draw.Src)
+	}
+	for i := 3; i < len(rgb.Pix); i += 4 {
+		rgb.Pix[i] = 255
+	}
+	return rgb
+}
+
+// OrientImage rotates and flips an image as set by an EXIF orientation from 1 to 8, see ImageOrientation, so that
+// it is displayed upright.
+func OrientImage(img image.Image, orientation int) *image.NRGBA {
+	source := toNRGBA(img)
+	if orientation < 2 || orientation > 8 {
+		return source
+	}
+	width, height := source.Rect.Dx(), source.Rect.Dy()
+	targetWidth, targetHeight := width, height
+	if orientation >= 5 {
+		targetWidth, targetHeight = height, width
+	}
+	// the source pixel of each target pixel
+	sourcePixel := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return width - 1 - x, y },
+		3: func(x, y int) (int, int) { return width - 1 - x, height - 1 - y },
+		4: func(x, y int) (int, int) { return x, height - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return y, height - 1 - x },
+		7: func(x, y int) (int, int) { return width - 1 - y, height - 1 - x },
+		8: func(x, y int) (int, int) { return width - 1 - y, x },
+	}[orientation]
+	oriented := image.NewNRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+	for y := 0; y < targetHeight; y++ {
+		for x := 0; x < targetWidth; x++ {
+			sourceX, sourceY := sourcePixel(x, y)
+			copy(oriented.Pix[y*oriented.Stride+x*4:y*oriented.Stride+x*4+4], source.Pix[sourceY*source.Stride+sourceX*4:])
+		}
+	}
+	return oriented
+}
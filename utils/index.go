@@ -0,0 +1,113 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// VectorIndex is an in-memory index of vectors searched by cosine similarity. The search is exact,
+// which is fast enough for knowledge bases and corpora of up to a few hundred thousand vectors.
+type VectorIndex struct {
+	ids       []string
+	vectors   [][]float32
+	dimension int
+}
+
+// SearchResult is a vector found by a search of a VectorIndex.
+type SearchResult struct {
+	ID    string
+	Score float32 // cosine similarity between the query and the vector
+}
+
+// NewVectorIndex creates an empty vector index.
+func NewVectorIndex() *VectorIndex {
+	return &VectorIndex{}
+}
+
+// Add adds a vector with the given id to the index. The vector is normalized when it is added,
+// and all vectors of an index must have the same dimension.
+func (x *VectorIndex) Add(id string, vector []float32) error {
+	if len(vector) == 0 {
+		return fmt.Errorf("cannot add empty vector %s to the index", id)
+	}
+	if x.dimension == 0 {
+		x.dimension = len(vector)
+	}
+	if len(vector) != x.dimension {
+		return fmt.Errorf("vector %s has dimension %d, but the index has dimension %d", id, len(vector), x.dimension)
+	}
+	normalized := make([]float32, len(vector))
+	copy(normalized, vector)
+	x.ids = append(x.ids, id)
+	x.vectors = append(x.vectors, Normalize(normalized, 2))
+	return nil
+}
+
+// Len returns the number of vectors in the index.
+func (x *VectorIndex) Len() int {
+	return len(x.ids)
+}
+
+// Search returns the k vectors most similar to the query, most similar first.
+func (x *VectorIndex) Search(query []float32, k int) ([]SearchResult, error) {
+	if len(x.ids) == 0 || k <= 0 {
+		return nil, nil
+	}
+	if len(query) != x.dimension {
+		return nil, fmt.Errorf("query has dimension %d, but the index has dimension %d", len(query), x.dimension)
+	}
+	queryNorm := float32(Norm(query, 2))
+	if queryNorm == 0 {
+		queryNorm = 1
+	}
+	results := make([]SearchResult, len(x.ids))
+	for i, vector := range x.vectors {
+		results[i] = SearchResult{ID: x.ids[i], Score: Dot(query, vector) / queryNorm}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	return results[:min(k, len(results))], nil
+}
+
+// Dot product of two vectors of the same length.
+func Dot(a []float32, b []float32) float32 {
+	var dot float32
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return dot
+}
+
+// CosineSimilarity of two vectors of the same length.
+func CosineSimilarity(a []float32, b []float32) (float32, error) {
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("cannot compute cosine similarity of vectors of dimension %d and %d", len(a), len(b))
+	}
+	denominator := Norm(a, 2) * Norm(b, 2)
+	if denominator == 0 {
+		return 0, nil
+	}
+	return float32(math.Max(-1, math.Min(1, float64(Dot(a, b))/denominator))), nil
+}
+
+// MaxSim is the late-interaction score of ColBERT between the token embeddings of a query and of a document: the sum
+// over the query tokens of their highest dot product with a document token. With normalized token embeddings, each
+// query token contributes its highest cosine similarity.
+func MaxSim(query [][]float32, document [][]float32) (float32, error) {
+	var score float32
+	for _, queryToken := range query {
+		best := float32(math.Inf(-1))
+		for _, documentToken := range document {
+			if len(queryToken) != len(documentToken) {
+				return 0, fmt.Errorf("cannot compare token embeddings of dimension %d and %d", len(queryToken), len(documentToken))
+			}
+			best = max(best, Dot(queryToken, documentToken))
+		}
+		if len(document) > 0 {
+			score += best
+		}
+	}
+	return score, nil
+}
@@ -0,0 +1,305 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	jsonWhitespace = `[ ]?`
+	jsonCharacter  = `(?:[^"\\\x00-\x1F]|\\["\\/bfnrt]|\\u[0-9a-fA-F]{4})`
+	jsonInteger    = `-?(?:0|[1-9][0-9]*)`
+	jsonNumber     = jsonInteger + `(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?`
+	jsonDate       = `[0-9]{4}-(?:0[1-9]|1[0-2])-(?:0[1-9]|[12][0-9]|3[01])`
+	jsonTime       = `(?:[01][0-9]|2[0-3]):[0-5][0-9]:[0-5][0-9](?:\.[0-9]+)?(?:Z|[+-](?:[01][0-9]|2[0-3]):[0-5][0-9])?`
+)
+
+var jsonFormats = map[string]string{
+	"date":      jsonDate,
+	"time":      jsonTime,
+	"date-time": jsonDate + `T` + jsonTime,
+	"uuid":      `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+// JSONSchemaPattern converts a JSON schema into a regular expression matching JSON texts that are valid for the
+// schema, to constrain generated text with a TokenConstraint. The texts have at most one space around the
+// punctuation, and the properties of objects in the order of the schema, which keeps the texts short and the
+// choices of the model few. The keywords type (a type or a list of types), enum, const, anyOf, oneOf, properties,
+// required, additionalProperties (as a schema, for objects without properties), items, minItems, maxItems,
+// minLength, maxLength, pattern and format (date, time, date-time and uuid) are supported. Other keywords, such as
+// minimum and maximum, are ignored, and references are not supported, since regular expressions cannot describe
+// recursive schemas.
+func JSONSchemaPattern(schema []byte) (string, error) {
+	return jsonSchemaPattern(schema, "#")
+}
+
+func jsonSchemaPattern(raw json.RawMessage, path string) (string, error) {
+	var schema map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return "", fmt.Errorf("the schema at %s is not an object: %w", path, err)
+	}
+	if _, ok := schema["$ref"]; ok {
+		return "", fmt.Errorf("the schema at %s has a $ref, which is not supported", path)
+	}
+
+	if value, ok := schema["const"]; ok {
+		return jsonLiteralPattern(value)
+	}
+	if values, ok := schema["enum"]; ok {
+		var enum []json.RawMessage
+		if err := json.Unmarshal(values, &enum); err != nil {
+			return "", fmt.Errorf("the enum at %s is not a list: %w", path, err)
+		}
+		patterns := make([]string, len(enum))
+		for i, value := range enum {
+			pattern, err := jsonLiteralPattern(value)
+			if err != nil {
+				return "", err
+			}
+			patterns[i] = pattern
+		}
+		return jsonAlternatives(patterns), nil
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		if values, ok := schema[keyword]; ok {
+			var subschemas []json.RawMessage
+			if err := json.Unmarshal(values, &subschemas); err != nil {
+				return "", fmt.Errorf("the %s at %s is not a list: %w", keyword, path, err)
+			}
+			patterns := make([]string, len(subschemas))
+			for i, subschema := range subschemas {
+				pattern, err := jsonSchemaPattern(subschema, fmt.Sprintf("%s/%s/%d", path, keyword, i))
+				if err != nil {
+					return "", err
+				}
+				patterns[i] = pattern
+			}
+			return jsonAlternatives(patterns), nil
+		}
+	}
+
+	var types []string
+	if value, ok := schema["type"]; ok {
+		var single string
+		if json.Unmarshal(value, &single) == nil {
+			types = []string{single}
+		} else if err := json.Unmarshal(value, &types); err != nil {
+			return "", fmt.Errorf("the type at %s is not a string or a list of strings", path)
+		}
+	} else if _, ok = schema["properties"]; ok {
+		types = []string{"object"}
+	} else {
+		return "", fmt.Errorf("the schema at %s has no type", path)
+	}
+	patterns := make([]string, len(types))
+	for i, schemaType := range types {
+		pattern, err := jsonTypePattern(schema, schemaType, path)
+		if err != nil {
+			return "", err
+		}
+		patterns[i] = pattern
+	}
+	return jsonAlternatives(patterns), nil
+}
+
+func jsonTypePattern(schema map[string]json.RawMessage, schemaType string, path string) (string, error) {
+	switch schemaType {
+	case "string":
+		if pattern, ok := schema["pattern"]; ok {
+			var expression string
+			if err := json.Unmarshal(pattern, &expression); err != nil {
+				return "", fmt.Errorf("the pattern at %s is not a string: %w", path, err)
+			}
+			expression = strings.TrimSuffix(strings.TrimPrefix(expression, "^"), "$")
+			if _, err := regexp.Compile(expression); err != nil {
+				return "", fmt.Errorf("the pattern at %s is invalid: %w", path, err)
+			}
+			return `"(?:` + expression + `)"`, nil
+		}
+		if format, ok := schema["format"]; ok {
+			var name string
+			if err := json.Unmarshal(format, &name); err == nil && jsonFormats[name] != "" {
+				return `"` + jsonFormats[name] + `"`, nil
+			}
+		}
+		minLength, maxLength, err := jsonSchemaBounds(schema, "minLength", "maxLength", path)
+		if err != nil {
+			return "", err
+		}
+		return `"` + jsonCharacter + jsonRepetition(minLength, maxLength) + `"`, nil
+	case "integer":
+		return jsonInteger, nil
+	case "number":
+		return jsonNumber, nil
+	case "boolean":
+		return `(?:true|false)`, nil
+	case "null":
+		return `null`, nil
+	case "array":
+		items, ok := schema["items"]
+		if !ok {
+			return "", fmt.Errorf("the array at %s has no items schema", path)
+		}
+		item, err := jsonSchemaPattern(items, path+"/items")
+		if err != nil {
+			return "", err
+		}
+		minItems, maxItems, err := jsonSchemaBounds(schema, "minItems", "maxItems", path)
+		if err != nil {
+			return "", err
+		}
+		separator := jsonWhitespace + `,` + jsonWhitespace
+		var elements string
+		switch {
+		case maxItems == 0:
+			elements = ""
+		case minItems == 0:
+			elements = `(?:` + item + `(?:` + separator + item + `)` + jsonRepetition(0, maxItems-1) + `)?`
+		default:
+			elements = item + `(?:` + separator + item + `)` + jsonRepetition(minItems-1, maxItems-1)
+		}
+		return `\[` + jsonWhitespace + elements + jsonWhitespace + `\]`, nil
+	case "object":
+		return jsonObjectPattern(schema, path)
+	default:
+		return "", fmt.Errorf("the type %q at %s is not supported", schemaType, path)
+	}
+}
+
+// jsonObjectPattern matches the properties of an object in the order of the schema. With optional properties, the
+// separator before a property depends on whether a property precedes it, so the pattern of the properties from
+// the i-th one is built for both cases.
+func jsonObjectPattern(schema map[string]json.RawMessage, path string) (string, error) {
+	separator := jsonWhitespace + `,` + jsonWhitespace
+	names, properties, err := jsonOrderedObject(schema["properties"])
+	if err != nil {
+		return "", fmt.Errorf("the properties at %s are not an object: %w", path, err)
+	}
+	if len(names) == 0 {
+		additional, ok := schema["additionalProperties"]
+		if !ok || bytes.Equal(bytes.TrimSpace(additional), []byte("true")) || bytes.Equal(bytes.TrimSpace(additional), []byte("false")) {
+			return `\{` + jsonWhitespace + `\}`, nil
+		}
+		value, valueErr := jsonSchemaPattern(additional, path+"/additionalProperties")
+		if valueErr != nil {
+			return "", valueErr
+		}
+		entry := `"` + jsonCharacter + `*"` + jsonWhitespace + `:` + jsonWhitespace + value
+		return `\{` + jsonWhitespace + `(?:` + entry + `(?:` + separator + entry + `)*)?` + jsonWhitespace + `\}`, nil
+	}
+	var requiredNames []string
+	if required, ok := schema["required"]; ok {
+		if err = json.Unmarshal(required, &requiredNames); err != nil {
+			return "", fmt.Errorf("the required properties at %s are not a list of strings: %w", path, err)
+		}
+	}
+	isRequired := map[string]bool{}
+	for _, name := range requiredNames {
+		isRequired[name] = true
+	}
+
+	entries := make([]string, len(names))
+	for i, name := range names {
+		key, _ := json.Marshal(name)
+		value, valueErr := jsonSchemaPattern(properties[i], path+"/properties/"+name)
+		if valueErr != nil {
+			return "", valueErr
+		}
+		entries[i] = regexp.QuoteMeta(string(key)) + jsonWhitespace + `:` + jsonWhitespace + value
+	}
+	// after[i] matches the properties from the i-th one when a property precedes them, first[i] when none does
+	after := make([]string, len(names)+1)
+	first := make([]string, len(names)+1)
+	for i := len(names) - 1; i >= 0; i-- {
+		if isRequired[names[i]] {
+			after[i] = separator + entries[i] + after[i+1]
+			first[i] = entries[i] + after[i+1]
+		} else {
+			after[i] = `(?:` + separator + entries[i] + `)?` + after[i+1]
+			first[i] = `(?:` + entries[i] + after[i+1] + `|` + first[i+1] + `)`
+			if first[i+1] == "" {
+				first[i] = `(?:` + entries[i] + after[i+1] + `)?`
+			}
+		}
+	}
+	return `\{` + jsonWhitespace + first[0] + jsonWhitespace + `\}`, nil
+}
+
+// jsonOrderedObject returns the keys and values of a JSON object in order.
+func jsonOrderedObject(raw json.RawMessage) ([]string, []json.RawMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, nil, errors.New("expected an object")
+	}
+	var names []string
+	var values []json.RawMessage
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		var value json.RawMessage
+		if err = decoder.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		names = append(names, token.(string))
+		values = append(values, value)
+	}
+	return names, values, nil
+}
+
+// jsonSchemaBounds reads the bounds of a length, with -1 for no maximum.
+func jsonSchemaBounds(schema map[string]json.RawMessage, minimumKeyword string, maximumKeyword string, path string) (int, int, error) {
+	minimum, maximum := 0, -1
+	if value, ok := schema[minimumKeyword]; ok {
+		if err := json.Unmarshal(value, &minimum); err != nil || minimum < 0 {
+			return 0, 0, fmt.Errorf("the %s at %s is not a non-negative integer", minimumKeyword, path)
+		}
+	}
+	if value, ok := schema[maximumKeyword]; ok {
+		if err := json.Unmarshal(value, &maximum); err != nil || maximum < minimum {
+			return 0, 0, fmt.Errorf("the %s at %s is not an integer of at least %d", maximumKeyword, path, minimum)
+		}
+	}
+	if minimum > 1000 || maximum > 1000 {
+		return 0, 0, fmt.Errorf("the bounds at %s are above 1000, the maximum repetition of regular expressions", path)
+	}
+	return minimum, maximum, nil
+}
+
+func jsonRepetition(minimum int, maximum int) string {
+	switch {
+	case minimum == 0 && maximum < 0:
+		return `*`
+	case maximum < 0:
+		return `{` + strconv.Itoa(minimum) + `,}`
+	case minimum == maximum:
+		return `{` + strconv.Itoa(minimum) + `}`
+	default:
+		return `{` + strconv.Itoa(minimum) + `,` + strconv.Itoa(maximum) + `}`
+	}
+}
+
+// jsonLiteralPattern matches a JSON value written compactly.
+func jsonLiteralPattern(value json.RawMessage) (string, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, value); err != nil {
+		return "", err
+	}
+	return regexp.QuoteMeta(compact.String()), nil
+}
+
+func jsonAlternatives(patterns []string) string {
+	if len(patterns) == 1 {
+		return patterns[0]
+	}
+	return `(?:` + strings.Join(patterns, `|`) + `)`
+}
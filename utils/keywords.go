@@ -0,0 +1,141 @@
+package util
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// KeywordMatcher finds all the occurrences of a set of keywords in a text in a single pass with the
+// Aho-Corasick algorithm, so that large keyword lists (e.g. profanity lists) can be matched in time
+// linear in the length of the text.
+type KeywordMatcher struct {
+	nodes           []keywordNode
+	keywords        []string
+	caseInsensitive bool
+	wholeWords      bool
+}
+
+// KeywordMatch is an occurrence of a keyword in a text, with byte offsets.
+type KeywordMatch struct {
+	Keyword string
+	Start   int
+	End     int
+}
+
+type keywordNode struct {
+	children map[rune]int
+	fail     int
+	outputs  []int // indices of the keywords ending at this node, including through failure links
+}
+
+// NewKeywordMatcher creates a matcher for the keywords. With caseInsensitive, keywords match regardless of
+// case, and with wholeWords, keywords only match when they are not part of a longer word.
+func NewKeywordMatcher(keywords []string, caseInsensitive bool, wholeWords bool) *KeywordMatcher {
+	m := &KeywordMatcher{
+		nodes:           []keywordNode{{children: map[rune]int{}}},
+		keywords:        keywords,
+		caseInsensitive: caseInsensitive,
+		wholeWords:      wholeWords,
+	}
+	for i, keyword := range keywords {
+		if keyword == "" {
+			continue
+		}
+		node := 0
+		for _, r := range keyword {
+			r = m.fold(r)
+			next, ok := m.nodes[node].children[r]
+			if !ok {
+				next = len(m.nodes)
+				m.nodes = append(m.nodes, keywordNode{children: map[rune]int{}})
+				m.nodes[node].children[r] = next
+			}
+			node = next
+		}
+		m.nodes[node].outputs = append(m.nodes[node].outputs, i)
+	}
+
+	// breadth-first construction of the failure links
+	queue := make([]int, 0, len(m.nodes))
+	for _, child := range m.nodes[0].children {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for r, child := range m.nodes[node].children {
+			fail := m.nodes[node].fail
+			for fail > 0 && !m.hasChild(fail, r) {
+				fail = m.nodes[fail].fail
+			}
+			if next, ok := m.nodes[fail].children[r]; ok && next != child {
+				m.nodes[child].fail = next
+			}
+			m.nodes[child].outputs = append(m.nodes[child].outputs, m.nodes[m.nodes[child].fail].outputs...)
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+func (m *KeywordMatcher) hasChild(node int, r rune) bool {
+	_, ok := m.nodes[node].children[r]
+	return ok
+}
+
+func (m *KeywordMatcher) fold(r rune) rune {
+	if m.caseInsensitive {
+		return unicode.ToLower(r)
+	}
+	return r
+}
+
+// FindAll returns all the occurrences of the keywords in the text, ordered by end offset. Overlapping
+// occurrences of different keywords are all returned.
+func (m *KeywordMatcher) FindAll(text string) []KeywordMatch {
+	var matches []KeywordMatch
+	// starts holds the byte offset of each rune read so far, to convert keyword lengths in runes to offsets
+	var starts []int
+	node := 0
+	for offset := 0; offset < len(text); {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		starts = append(starts, offset)
+		offset += size
+		r = m.fold(r)
+		for node > 0 && !m.hasChild(node, r) {
+			node = m.nodes[node].fail
+		}
+		node = m.nodes[node].children[r] // the root when there is no child
+		for _, keywordIndex := range m.nodes[node].outputs {
+			keyword := m.keywords[keywordIndex]
+			start := starts[len(starts)-utf8.RuneCountInString(keyword)]
+			if m.wholeWords && !isWordBoundary(text, start, offset) {
+				continue
+			}
+			matches = append(matches, KeywordMatch{Keyword: keyword, Start: start, End: offset})
+		}
+	}
+	return matches
+}
+
+// Match returns whether any keyword occurs in the text.
+func (m *KeywordMatcher) Match(text string) bool {
+	return len(m.FindAll(text)) > 0
+}
+
+// isWordBoundary returns whether text[start:end] is not preceded or followed by a letter or digit.
+func isWordBoundary(text string, start int, end int) bool {
+	if start > 0 {
+		r, _ := utf8.DecodeLastRuneInString(text[:start])
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+	if end < len(text) {
+		r, _ := utf8.DecodeRuneInString(text[end:])
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// ProcessMemoryUsage returns the resident memory of the process in bytes, which includes the memory allocated by
+// onnxruntime outside of the Go heap. On systems without /proc, it falls back to the memory obtained from the
+// OS by the Go runtime, which does not.
+func ProcessMemoryUsage() (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		memStats := runtime.MemStats{}
+		runtime.ReadMemStats(&memStats)
+		return memStats.Sys, nil
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "VmRSS:" {
+			continue
+		}
+		kilobytes, parseErr := strconv.ParseUint(fields[1], 10, 64)
+		if parseErr != nil {
+			return 0, parseErr
+		}
+		return kilobytes * 1024, nil
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+	return memStats.Sys, nil
+}
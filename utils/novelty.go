@@ -0,0 +1,203 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// NoveltyDetector scores how unlike the data it was fitted on a vector is. Vectors with a score above Threshold
+// are novel, e.g. inputs to reject or review in a data ingestion pipeline.
+type NoveltyDetector interface {
+	Score(vector []float32) (float32, error)
+	IsNovel(vector []float32) (bool, float32, error)
+}
+
+// KNNNoveltyDetector scores a vector by its mean cosine distance to its K nearest neighbours in a vector index of
+// the reference data. It makes no assumption on the distribution of the data, which can have several clusters.
+type KNNNoveltyDetector struct {
+	Index     *VectorIndex
+	K         int
+	Threshold float32
+}
+
+// NewKNNNoveltyDetector creates a detector from an index of the reference data, with a threshold of 0.5.
+func NewKNNNoveltyDetector(index *VectorIndex, k int) (*KNNNoveltyDetector, error) {
+	if index == nil || index.Len() == 0 {
+		return nil, errors.New("the reference index is empty")
+	}
+	if k <= 0 {
+		return nil, errors.New("k must be greater than zero")
+	}
+	return &KNNNoveltyDetector{Index: index, K: k, Threshold: 0.5}, nil
+}
+
+// Score returns the mean cosine distance of the vector to its K nearest neighbours, between 0 and 2.
+func (d *KNNNoveltyDetector) Score(vector []float32) (float32, error) {
+	return d.score(vector, 0)
+}
+
+func (d *KNNNoveltyDetector) score(vector []float32, skip int) (float32, error) {
+	results, err := d.Index.Search(vector, d.K+skip)
+	if err != nil {
+		return 0, err
+	}
+	if len(results) <= skip {
+		return 0, errors.New("the reference index has not enough vectors")
+	}
+	var distance float32
+	for _, result := range results[skip:] {
+		distance += 1 - result.Score
+	}
+	return distance / float32(len(results)-skip), nil
+}
+
+// IsNovel returns whether the score of the vector is above the threshold, and the score.
+func (d *KNNNoveltyDetector) IsNovel(vector []float32) (bool, float32, error) {
+	score, err := d.Score(vector)
+	return score > d.Threshold, score, err
+}
+
+// FitThreshold sets the threshold to the quantile of the scores of the vectors of the index, each scored against
+// the other vectors of the index, e.g. 0.99 to flag about 1% of inputs distributed like the reference data.
+func (d *KNNNoveltyDetector) FitThreshold(quantile float64) error {
+	scores := make([]float32, d.Index.Len())
+	for i, vector := range d.Index.vectors {
+		score, err := d.score(vector, 1)
+		if err != nil {
+			return err
+		}
+		scores[i] = score
+	}
+	threshold, err := scoreQuantile(scores, quantile)
+	d.Threshold = threshold
+	return err
+}
+
+// GaussianNoveltyDetector scores a vector by its Mahalanobis distance to a Gaussian fitted on the reference data.
+// The covariance is shrunk towards a multiple of the identity, so that it can be inverted even with fewer reference
+// vectors than dimensions.
+type GaussianNoveltyDetector struct {
+	Mean      []float64
+	Threshold float32
+	cholesky  [][]float64 // lower triangular factor of the shrunk covariance
+}
+
+// FitGaussianNoveltyDetector fits the mean and the covariance of the reference vectors. shrinkage, between 0 and 1,
+// is the weight of the identity in the shrunk covariance, e.g. 0.1. The threshold is set to the quantile of the
+// scores of the reference vectors.
+func FitGaussianNoveltyDetector(reference [][]float32, shrinkage float64, quantile float64) (*GaussianNoveltyDetector, error) {
+	if len(reference) < 2 {
+		return nil, errors.New("at least two reference vectors are required")
+	}
+	if shrinkage < 0 || shrinkage > 1 {
+		return nil, fmt.Errorf("shrinkage must be between 0 and 1, got %f", shrinkage)
+	}
+	dimension := len(reference[0])
+	mean := make([]float64, dimension)
+	for i, vector := range reference {
+		if len(vector) != dimension {
+			return nil, fmt.Errorf("reference vector %d has dimension %d, expected %d", i, len(vector), dimension)
+		}
+		for j, e := range vector {
+			mean[j] += float64(e) / float64(len(reference))
+		}
+	}
+	covariance := make([][]float64, dimension)
+	for j := range covariance {
+		covariance[j] = make([]float64, dimension)
+	}
+	centered := make([]float64, dimension)
+	for _, vector := range reference {
+		for j, e := range vector {
+			centered[j] = float64(e) - mean[j]
+		}
+		for j := range covariance {
+			for k := 0; k <= j; k++ {
+				covariance[j][k] += centered[j] * centered[k] / float64(len(reference)-1)
+			}
+		}
+	}
+	trace := 0.0
+	for j := range covariance {
+		trace += covariance[j][j]
+	}
+	scale := math.Max(trace/float64(dimension), 1e-12)
+	for j := range covariance {
+		for k := 0; k <= j; k++ {
+			covariance[j][k] *= 1 - shrinkage
+		}
+		covariance[j][j] += shrinkage * scale
+	}
+
+	// Cholesky decomposition of the lower triangle
+	cholesky := make([][]float64, dimension)
+	for j := range cholesky {
+		cholesky[j] = make([]float64, j+1)
+		for k := 0; k <= j; k++ {
+			sum := covariance[j][k]
+			for l := 0; l < k; l++ {
+				sum -= cholesky[j][l] * cholesky[k][l]
+			}
+			if j == k {
+				if sum <= 0 {
+					return nil, errors.New("the covariance is singular, increase the shrinkage")
+				}
+				cholesky[j][j] = math.Sqrt(sum)
+			} else {
+				cholesky[j][k] = sum / cholesky[k][k]
+			}
+		}
+	}
+
+	detector := &GaussianNoveltyDetector{Mean: mean, cholesky: cholesky}
+	scores := make([]float32, len(reference))
+	for i, vector := range reference {
+		score, err := detector.Score(vector)
+		if err != nil {
+			return nil, err
+		}
+		scores[i] = score
+	}
+	threshold, err := scoreQuantile(scores, quantile)
+	if err != nil {
+		return nil, err
+	}
+	detector.Threshold = threshold
+	return detector, nil
+}
+
+// Score returns the Mahalanobis distance of the vector to the fitted Gaussian.
+func (d *GaussianNoveltyDetector) Score(vector []float32) (float32, error) {
+	if len(vector) != len(d.Mean) {
+		return 0, fmt.Errorf("vector has dimension %d, but the detector has dimension %d", len(vector), len(d.Mean))
+	}
+	// solve L y = x - mean, the squared distance is |y|^2
+	y := make([]float64, len(vector))
+	squaredDistance := 0.0
+	for j := range y {
+		sum := float64(vector[j]) - d.Mean[j]
+		for k := 0; k < j; k++ {
+			sum -= d.cholesky[j][k] * y[k]
+		}
+		y[j] = sum / d.cholesky[j][j]
+		squaredDistance += y[j] * y[j]
+	}
+	return float32(math.Sqrt(squaredDistance)), nil
+}
+
+// IsNovel returns whether the score of the vector is above the threshold, and the score.
+func (d *GaussianNoveltyDetector) IsNovel(vector []float32) (bool, float32, error) {
+	score, err := d.Score(vector)
+	return score > d.Threshold, score, err
+}
+
+func scoreQuantile(scores []float32, quantile float64) (float32, error) {
+	if quantile < 0 || quantile > 1 {
+		return 0, fmt.Errorf("quantile must be between 0 and 1, got %f", quantile)
+	}
+	sorted := append([]float32{}, scores...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(math.Round(quantile*float64(len(sorted)-1)))], nil
+}
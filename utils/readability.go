@@ -0,0 +1,99 @@
+package util
+
+import (
+	"strings"
+	"unicode"
+)
+
+// TextStatistics are surface statistics and readability scores of a text, e.g. to filter a corpus on length or
+// reading level. The readability scores are defined for English text.
+type TextStatistics struct {
+	Characters         int     // number of characters, excluding whitespace
+	Words              int     // number of words, i.e. runs of letters, digits and apostrophes
+	Sentences          int     // number of sentences, at least one for a text with words
+	Syllables          int     // estimated number of syllables of the words
+	ComplexWords       int     // number of words with three syllables or more
+	Tokens             int     // number of tokens of the model's tokenizer, 0 if not computed
+	FleschReadingEase  float64 // higher is easier, 60-70 is plain English
+	FleschKincaidGrade float64 // U.S. school grade level
+}
+
+// ComputeTextStatistics computes the statistics of a text, except the token count, which depends on a tokenizer.
+func ComputeTextStatistics(text string) TextStatistics {
+	stats := TextStatistics{}
+	for _, r := range text {
+		if !unicode.IsSpace(r) {
+			stats.Characters++
+		}
+	}
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '’'
+	})
+	for _, word := range words {
+		word = strings.Trim(word, "'’")
+		if word == "" {
+			continue
+		}
+		stats.Words++
+		syllables := CountSyllables(word)
+		stats.Syllables += syllables
+		if syllables >= 3 {
+			stats.ComplexWords++
+		}
+	}
+	if stats.Words == 0 {
+		return stats
+	}
+
+	// count runs of sentence terminators, and a last sentence without terminator
+	// a period between digits is a decimal point
+	runes := []rune(text)
+	inTerminator, pendingWords := false, false
+	for i, r := range runes {
+		isTerminator := strings.ContainsRune(".!?。！？", r) &&
+			!(r == '.' && i > 0 && i+1 < len(runes) && unicode.IsDigit(runes[i-1]) && unicode.IsDigit(runes[i+1]))
+		if isTerminator && !inTerminator && pendingWords {
+			stats.Sentences++
+			pendingWords = false
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			pendingWords = true
+		}
+		inTerminator = isTerminator
+	}
+	if pendingWords {
+		stats.Sentences++
+	}
+	stats.Sentences = max(stats.Sentences, 1)
+
+	wordsPerSentence := float64(stats.Words) / float64(stats.Sentences)
+	syllablesPerWord := float64(stats.Syllables) / float64(stats.Words)
+	stats.FleschReadingEase = 206.835 - 1.015*wordsPerSentence - 84.6*syllablesPerWord
+	stats.FleschKincaidGrade = 0.39*wordsPerSentence + 11.8*syllablesPerWord - 15.59
+	return stats
+}
+
+// CountSyllables estimates the number of syllables of an English word by counting its groups of vowels,
+// ignoring a silent final e. Words without vowels, such as numbers, count as one syllable.
+func CountSyllables(word string) int {
+	word = strings.ToLower(word)
+	isVowel := func(r rune) bool {
+		return strings.ContainsRune("aeiouyàâäéèêëîïôöûüù", r)
+	}
+	runes := []rune(word)
+	syllables := 0
+	previousVowel := false
+	for _, r := range runes {
+		vowel := isVowel(r)
+		if vowel && !previousVowel {
+			syllables++
+		}
+		previousVowel = vowel
+	}
+	// silent final e, as in "make" but not in "table" or "be"
+	n := len(runes)
+	if syllables > 1 && n > 2 && runes[n-1] == 'e' && runes[n-2] != 'l' && !isVowel(runes[n-2]) {
+		syllables--
+	}
+	return max(syllables, 1)
+}
@@ -0,0 +1,31 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+)
+
+var redaction atomic.Bool
+
+// SetRedaction enables or disables redaction of input texts in the errors returned by hugot, see Redact.
+func SetRedaction(enabled bool) {
+	redaction.Store(enabled)
+}
+
+// RedactionEnabled returns whether input texts are redacted.
+func RedactionEnabled() bool {
+	return redaction.Load()
+}
+
+// Redact returns the text unchanged, or, if redaction is enabled, a placeholder with its length in bytes and the
+// first 16 hexadecimal digits of its SHA-256 hash. Any input text, or part of it, quoted in an error or a log
+// message must go through Redact.
+func Redact(text string) string {
+	if !redaction.Load() {
+		return text
+	}
+	sum := sha256.Sum256([]byte(text))
+	return fmt.Sprintf("[redacted len=%d sha256=%s]", len(text), hex.EncodeToString(sum[:8]))
+}
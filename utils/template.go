@@ -0,0 +1,2473 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ChatTemplate is a parsed chat template, the Jinja template of the chat_template of a tokenizer_config.json that
+// renders a conversation into the prompt of a model. It implements the subset of Jinja used by chat templates,
+// with the trim_blocks and lstrip_blocks settings of transformers:
+//   - output {{ }}, statements {% %} with whitespace control, and comments {# #};
+//   - if, elif and else, for loops over lists, strings and mappings with loop.index, loop.first and the like, set
+//     including namespace attributes, and the generation tags, which are ignored;
+//   - literals, variables, attributes, subscripts and slices, arithmetic, ~ concatenation, comparisons, in, and, or,
+//     not, conditional expressions, tests with is, and filters with |;
+//   - the string methods and filters of chat templates such as strip, split, startswith, trim, tojson and length,
+//     and the raise_exception, range, namespace and strftime_now functions.
+//
+// Macros and template inheritance are not supported.
+type ChatTemplate struct {
+	root []templateNode
+}
+
+// templateUndefined is the value of undefined variables and attributes. It renders as an empty string and is
+// false.
+type templateUndefined struct{}
+
+// templateNamespace is a namespace, whose attributes can be set within loops.
+type templateNamespace map[string]any
+
+// templateFunction is a function or method callable from a template.
+type templateFunction func(args []any, kwargs map[string]any) (any, error)
+
+// templateNode is a node of the syntax tree of a template.
+type templateNode interface {
+	render(r *templateRenderer, out *strings.Builder) error
+}
+
+type templateText struct {
+	text string
+}
+
+type templateOutput struct {
+	expression templateExpression
+}
+
+type templateIf struct {
+	conditions []templateExpression
+	branches   [][]templateNode // one per condition, and an optional else branch
+}
+
+type templateFor struct {
+	targets  []string
+	iterable templateExpression
+	filter   templateExpression // optional condition of the items
+	body     []templateNode
+	empty    []templateNode // else branch, rendered if there are no items
+}
+
+type templateSet struct {
+	target    string
+	attribute string // attribute of the target namespace, if any
+	value     templateExpression
+}
+
+// ParseChatTemplate parses a chat template.
+func ParseChatTemplate(source string) (*ChatTemplate, error) {
+	tokens, err := lexTemplate(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &templateParser{tokens: tokens}
+	root, end, err := parser.parseBlock()
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat template: %w", err)
+	}
+	if end != "" {
+		return nil, fmt.Errorf("invalid chat template: unexpected %s", end)
+	}
+	return &ChatTemplate{root: root}, nil
+}
+
+// Render renders the template with the variables, e.g. messages, add_generation_prompt, bos_token and eos_token.
+// Values can be Go strings, numbers, booleans, nil, slices and maps with string keys, and structs are not
+// supported.
+func (t *ChatTemplate) Render(variables map[string]any) (string, error) {
+	globals := map[string]any{
+		"raise_exception": templateFunction(func(args []any, _ map[string]any) (any, error) {
+			if len(args) == 0 {
+				return nil, errors.New("chat template error")
+			}
+			return nil, fmt.Errorf("chat template error: %s", templateString(args[0]))
+		}),
+		"range":        templateFunction(templateRange),
+		"namespace":    templateFunction(templateNewNamespace),
+		"dict":         templateFunction(templateNewNamespace),
+		"strftime_now": templateFunction(templateStrftimeNow),
+	}
+	for name, value := range variables {
+		globals[name] = normalizeTemplateValue(value)
+	}
+	r := &templateRenderer{scopes: []map[string]any{globals}}
+	var out strings.Builder
+	if err := r.renderNodes(t.root, &out); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// normalizeTemplateValue converts Go values to the types used by templates: int, float64, string, bool, nil,
+// []any and map[string]any.
+func normalizeTemplateValue(value any) any {
+	switch v := value.(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case uint64:
+		return int(v)
+	case float32:
+		return float64(v)
+	case []string:
+		values := make([]any, len(v))
+		for i, e := range v {
+			values[i] = e
+		}
+		return values
+	case []any:
+		values := make([]any, len(v))
+		for i, e := range v {
+			values[i] = normalizeTemplateValue(e)
+		}
+		return values
+	case []map[string]any:
+		values := make([]any, len(v))
+		for i, e := range v {
+			values[i] = normalizeTemplateValue(e)
+		}
+		return values
+	case map[string]string:
+		values := make(map[string]any, len(v))
+		for k, e := range v {
+			values[k] = e
+		}
+		return values
+	case map[string]any:
+		values := make(map[string]any, len(v))
+		for k, e := range v {
+			values[k] = normalizeTemplateValue(e)
+		}
+		return values
+	default:
+		return value
+	}
+}
+
+// lexing
+
+type templateTokenKind int
+
+const (
+	templateTokenText templateTokenKind = iota
+	templateTokenOutput
+	templateTokenStatement
+)
+
+type templateToken struct {
+	kind    templateTokenKind
+	content string // text, or source of the expression or statement
+}
+
+// lexTemplate splits a template into text, outputs and statements, applying whitespace control, trim_blocks and
+// lstrip_blocks, and dropping comments.
+func lexTemplate(source string) ([]templateToken, error) {
+	var tokens []templateToken
+	trimNext := false    // a tag ending with - strips the whitespace that follows it
+	trimNewline := false // a statement strips the newline that follows it
+	for len(source) > 0 {
+		start := strings.Index(source, "{")
+		for start >= 0 && start+1 < len(source) && !strings.ContainsRune("{%#", rune(source[start+1])) {
+			next := strings.Index(source[start+1:], "{")
+			if next < 0 {
+				start = -1
+				break
+			}
+			start += next + 1
+		}
+		if start < 0 || start+1 >= len(source) {
+			start = len(source)
+		}
+		text := source[:start]
+		atLineStart := len(tokens) == 0 // whether the text starts a line of the template
+		trimHead := func() {
+			if trimNext {
+				text = strings.TrimLeftFunc(text, unicode.IsSpace)
+			} else if trimNewline {
+				text = strings.TrimPrefix(strings.TrimPrefix(text, "\r"), "\n")
+			}
+			trimNext, trimNewline = false, false
+		}
+		if start == len(source) {
+			trimHead()
+			tokens = append(tokens, templateToken{kind: templateTokenText, content: text})
+			break
+		}
+
+		opening := source[start+1]
+		closing := map[byte]string{'{': "}}", '%': "%}", '#': "#}"}[opening]
+		inner := source[start+2:]
+		stripBefore := strings.HasPrefix(inner, "-")
+		if stripBefore || strings.HasPrefix(inner, "+") {
+			inner = inner[1:]
+		}
+		end := templateTagEnd(inner, closing, opening != '#')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid chat template: unclosed tag at %q", truncateTemplate(source[start:]))
+		}
+		content := inner[:end]
+		source = inner[end+len(closing):]
+
+		if stripBefore {
+			text = strings.TrimRightFunc(text, unicode.IsSpace)
+		} else if opening != '{' {
+			// lstrip_blocks strips the spaces and tabs before a block tag at the start of a line
+			lineStart := strings.LastIndex(text, "\n") + 1
+			if strings.TrimLeft(text[lineStart:], " \t") == "" && (lineStart > 0 || atLineStart) {
+				text = text[:lineStart]
+			}
+		}
+		trimHead()
+		if strings.HasSuffix(content, "-") {
+			content = content[:len(content)-1]
+			trimNext = true
+		}
+		if text != "" {
+			tokens = append(tokens, templateToken{kind: templateTokenText, content: text})
+		}
+		switch opening {
+		case '{':
+			tokens = append(tokens, templateToken{kind: templateTokenOutput, content: strings.TrimSpace(content)})
+		case '%':
+			tokens = append(tokens, templateToken{kind: templateTokenStatement, content: strings.TrimSpace(content)})
+			trimNewline = true
+		default:
+			trimNewline = true
+		}
+	}
+	return tokens, nil
+}
+
+// templateTagEnd returns the position of the closing delimiter of a tag, skipping string literals if quoted.
+func templateTagEnd(inner string, closing string, quoted bool) int {
+	var quote byte
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case quoted && (c == '"' || c == '\''):
+			quote = c
+		case strings.HasPrefix(inner[i:], closing):
+			return i
+		}
+	}
+	return -1
+}
+
+func truncateTemplate(source string) string {
+	if len(source) > 40 {
+		return source[:40] + "..."
+	}
+	return source
+}
+
+// parsing of statements
+
+type templateParser struct {
+	tokens   []templateToken
+	position int
+}
+
+// parseBlock parses nodes until the end of the template or a statement ending the block, such as endif or else,
+// and returns the ending statement.
+func (p *templateParser) parseBlock() ([]templateNode, string, error) {
+	var nodes []templateNode
+	for p.position < len(p.tokens) {
+		token := p.tokens[p.position]
+		p.position++
+		switch token.kind {
+		case templateTokenText:
+			nodes = append(nodes, templateText{text: token.content})
+		case templateTokenOutput:
+			expression, err := parseTemplateExpression(token.content)
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, templateOutput{expression: expression})
+		case templateTokenStatement:
+			keyword, rest, _ := strings.Cut(token.content, " ")
+			rest = strings.TrimSpace(rest)
+			switch keyword {
+			case "if":
+				node, err := p.parseIf(rest)
+				if err != nil {
+					return nil, "", err
+				}
+				nodes = append(nodes, node)
+			case "for":
+				node, err := p.parseFor(rest)
+				if err != nil {
+					return nil, "", err
+				}
+				nodes = append(nodes, node)
+			case "set":
+				node, err := parseTemplateSet(rest)
+				if err != nil {
+					return nil, "", err
+				}
+				nodes = append(nodes, node)
+			case "generation", "endgeneration":
+				// marks the assistant messages for training, without effect on the rendering
+			case "elif", "else", "endif", "endfor":
+				return nodes, token.content, nil
+			default:
+				return nil, "", fmt.Errorf("unsupported statement %q", token.content)
+			}
+		}
+	}
+	return nodes, "", nil
+}
+
+func (p *templateParser) parseIf(condition string) (templateNode, error) {
+	node := templateIf{}
+	for {
+		expression, err := parseTemplateExpression(condition)
+		if err != nil {
+			return nil, err
+		}
+		body, end, err := p.parseBlock()
+		if err != nil {
+			return nil, err
+		}
+		node.conditions = append(node.conditions, expression)
+		node.branches = append(node.branches, body)
+		switch {
+		case strings.HasPrefix(end, "elif "):
+			condition = strings.TrimSpace(strings.TrimPrefix(end, "elif "))
+		case end == "else":
+			body, end, err = p.parseBlock()
+			if err != nil {
+				return nil, err
+			}
+			if end != "endif" {
+				return nil, fmt.Errorf("expected endif, got %q", end)
+			}
+			node.branches = append(node.branches, body)
+			return node, nil
+		case end == "endif":
+			return node, nil
+		default:
+			return nil, fmt.Errorf("expected endif, got %q", end)
+		}
+	}
+}
+
+func (p *templateParser) parseFor(header string) (templateNode, error) {
+	targets, rest, ok := strings.Cut(header, " in ")
+	if !ok {
+		return nil, fmt.Errorf("invalid for statement %q", header)
+	}
+	node := templateFor{}
+	for _, target := range strings.Split(targets, ",") {
+		node.targets = append(node.targets, strings.Trim(strings.TrimSpace(target), "()"))
+	}
+	tokens, err := tokenizeTemplateExpression(rest)
+	if err != nil {
+		return nil, err
+	}
+	parser := &templateExpressionParser{tokens: tokens}
+	// the iterable stops before a loop filter, so that its if is not a conditional expression
+	if node.iterable, err = parser.parseOr(); err != nil {
+		return nil, err
+	}
+	if parser.acceptName("if") {
+		if node.filter, err = parser.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %s in for statement %q", parser.tokens[parser.position].text, header)
+	}
+	body, end, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	node.body = body
+	if end == "else" {
+		if node.empty, end, err = p.parseBlock(); err != nil {
+			return nil, err
+		}
+	}
+	if end != "endfor" {
+		return nil, fmt.Errorf("expected endfor, got %q", end)
+	}
+	return node, nil
+}
+
+func parseTemplateSet(statement string) (templateNode, error) {
+	target, value, ok := strings.Cut(statement, "=")
+	if !ok {
+		return nil, fmt.Errorf("unsupported set statement %q", statement)
+	}
+	node := templateSet{target: strings.TrimSpace(target)}
+	if name, attribute, isAttribute := strings.Cut(node.target, "."); isAttribute {
+		node.target, node.attribute = name, attribute
+	}
+	expression, err := parseTemplateExpression(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	node.value = expression
+	return node, nil
+}
+
+// rendering
+
+type templateRenderer struct {
+	scopes []map[string]any
+}
+
+func (r *templateRenderer) lookup(name string) any {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if value, ok := r.scopes[i][name]; ok {
+			return value
+		}
+	}
+	return templateUndefined{}
+}
+
+func (r *templateRenderer) renderNodes(nodes []templateNode, out *strings.Builder) error {
+	for _, node := range nodes {
+		if err := node.render(r, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n templateText) render(_ *templateRenderer, out *strings.Builder) error {
+	out.WriteString(n.text)
+	return nil
+}
+
+func (n templateOutput) render(r *templateRenderer, out *strings.Builder) error {
+	value, err := n.expression.eval(r)
+	if err != nil {
+		return err
+	}
+	out.WriteString(templateString(value))
+	return nil
+}
+
+func (n templateIf) render(r *templateRenderer, out *strings.Builder) error {
+	for i, condition := range n.conditions {
+		value, err := condition.eval(r)
+		if err != nil {
+			return err
+		}
+		if templateTruth(value) {
+			return r.renderNodes(n.branches[i], out)
+		}
+	}
+	if len(n.branches) > len(n.conditions) {
+		return r.renderNodes(n.branches[len(n.conditions)], out)
+	}
+	return nil
+}
+
+func (n templateFor) render(r *templateRenderer, out *strings.Builder) error {
+	iterable, err := n.iterable.eval(r)
+	if err != nil {
+		return err
+	}
+	items, err := templateItems(iterable)
+	if err != nil {
+		return err
+	}
+	r.scopes = append(r.scopes, map[string]any{})
+	defer func() {
+		r.scopes = r.scopes[:len(r.scopes)-1]
+	}()
+	scope := r.scopes[len(r.scopes)-1]
+	bind := func(item any) error {
+		if len(n.targets) == 1 {
+			scope[n.targets[0]] = item
+			return nil
+		}
+		values, ok := item.([]any)
+		if !ok || len(values) != len(n.targets) {
+			return fmt.Errorf("cannot unpack %s into %d variables", templateRepr(item), len(n.targets))
+		}
+		for i, target := range n.targets {
+			scope[target] = values[i]
+		}
+		return nil
+	}
+	if n.filter != nil {
+		var kept []any
+		for _, item := range items {
+			if err = bind(item); err != nil {
+				return err
+			}
+			keep, filterErr := n.filter.eval(r)
+			if filterErr != nil {
+				return filterErr
+			}
+			if templateTruth(keep) {
+				kept = append(kept, item)
+			}
+		}
+		items = kept
+	}
+	if len(items) == 0 {
+		return r.renderNodes(n.empty, out)
+	}
+	for i, item := range items {
+		if err = bind(item); err != nil {
+			return err
+		}
+		loop := map[string]any{
+			"index":     i + 1,
+			"index0":    i,
+			"revindex":  len(items) - i,
+			"revindex0": len(items) - i - 1,
+			"first":     i == 0,
+			"last":      i == len(items)-1,
+			"length":    len(items),
+			"previtem":  templateUndefined{},
+			"nextitem":  templateUndefined{},
+		}
+		if i > 0 {
+			loop["previtem"] = items[i-1]
+		}
+		if i < len(items)-1 {
+			loop["nextitem"] = items[i+1]
+		}
+		scope["loop"] = loop
+		if err = r.renderNodes(n.body, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n templateSet) render(r *templateRenderer, _ *strings.Builder) error {
+	value, err := n.value.eval(r)
+	if err != nil {
+		return err
+	}
+	if n.attribute == "" {
+		r.scopes[len(r.scopes)-1][n.target] = value
+		return nil
+	}
+	namespace, ok := r.lookup(n.target).(templateNamespace)
+	if !ok {
+		return fmt.Errorf("cannot set attribute %s of %s, which is not a namespace", n.attribute, n.target)
+	}
+	namespace[n.attribute] = value
+	return nil
+}
+
+// expressions
+
+// templateExpression is a node of the syntax tree of an expression.
+type templateExpression interface {
+	eval(r *templateRenderer) (any, error)
+}
+
+type templateLiteral struct {
+	value any
+}
+
+type templateName struct {
+	name string
+}
+
+type templateList struct {
+	items []templateExpression
+}
+
+type templateDict struct {
+	keys   []templateExpression
+	values []templateExpression
+}
+
+type templateUnary struct {
+	operator string
+	operand  templateExpression
+}
+
+type templateBinary struct {
+	operator string
+	left     templateExpression
+	right    templateExpression
+}
+
+type templateConditional struct {
+	condition templateExpression
+	then      templateExpression
+	otherwise templateExpression // optional
+}
+
+type templateAttribute struct {
+	object templateExpression
+	name   string
+}
+
+type templateSubscript struct {
+	object templateExpression
+	index  templateExpression
+}
+
+type templateSlice struct {
+	object            templateExpression
+	start, stop, step templateExpression // optional
+}
+
+type templateCall struct {
+	function templateExpression
+	args     []templateExpression
+	kwargs   map[string]templateExpression
+}
+
+type templateFilter struct {
+	operand templateExpression
+	name    string
+	args    []templateExpression
+	kwargs  map[string]templateExpression
+}
+
+type templateTest struct {
+	operand templateExpression
+	name    string
+	args    []templateExpression
+	negated bool
+}
+
+func parseTemplateExpression(source string) (templateExpression, error) {
+	tokens, err := tokenizeTemplateExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &templateExpressionParser{tokens: tokens}
+	expression, err := parser.parseConditional()
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", source, err)
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, fmt.Errorf("invalid expression %q: unexpected %s", source, parser.tokens[parser.position].text)
+	}
+	return expression, nil
+}
+
+func (e templateLiteral) eval(_ *templateRenderer) (any, error) {
+	return e.value, nil
+}
+
+func (e templateName) eval(r *templateRenderer) (any, error) {
+	return r.lookup(e.name), nil
+}
+
+func (e templateList) eval(r *templateRenderer) (any, error) {
+	values := make([]any, len(e.items))
+	for i, item := range e.items {
+		value, err := item.eval(r)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (e templateDict) eval(r *templateRenderer) (any, error) {
+	values := make(map[string]any, len(e.keys))
+	for i, key := range e.keys {
+		k, err := key.eval(r)
+		if err != nil {
+			return nil, err
+		}
+		keyString, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("dictionary keys must be strings, got %s", templateRepr(k))
+		}
+		if values[keyString], err = e.values[i].eval(r); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (e templateUnary) eval(r *templateRenderer) (any, error) {
+	value, err := e.operand.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	switch e.operator {
+	case "not":
+		return !templateTruth(value), nil
+	case "-":
+		switch v := value.(type) {
+		case int:
+			return -v, nil
+		case float64:
+			return -v, nil
+		}
+		return nil, fmt.Errorf("cannot negate %s", templateRepr(value))
+	default:
+		return value, nil
+	}
+}
+
+func (e templateBinary) eval(r *templateRenderer) (any, error) {
+	left, err := e.left.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	switch e.operator {
+	case "and":
+		if !templateTruth(left) {
+			return left, nil
+		}
+		return e.right.eval(r)
+	case "or":
+		if templateTruth(left) {
+			return left, nil
+		}
+		return e.right.eval(r)
+	}
+	right, err := e.right.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	switch e.operator {
+	case "~":
+		return templateString(left) + templateString(right), nil
+	case "==":
+		return templateEqual(left, right), nil
+	case "!=":
+		return !templateEqual(left, right), nil
+	case "in":
+		return templateContains(right, left)
+	case "not in":
+		contains, containsErr := templateContains(right, left)
+		return !contains, containsErr
+	case "<", "<=", ">", ">=":
+		return templateCompare(e.operator, left, right)
+	default:
+		return templateArithmetic(e.operator, left, right)
+	}
+}
+
+func (e templateConditional) eval(r *templateRenderer) (any, error) {
+	condition, err := e.condition.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	if templateTruth(condition) {
+		return e.then.eval(r)
+	}
+	if e.otherwise == nil {
+		return templateUndefined{}, nil
+	}
+	return e.otherwise.eval(r)
+}
+
+func (e templateAttribute) eval(r *templateRenderer) (any, error) {
+	object, err := e.object.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	switch o := object.(type) {
+	case map[string]any:
+		if value, ok := o[e.name]; ok {
+			return value, nil
+		}
+	case templateNamespace:
+		if value, ok := o[e.name]; ok {
+			return value, nil
+		}
+		return templateUndefined{}, nil
+	}
+	if method := templateMethod(object, e.name); method != nil {
+		return method, nil
+	}
+	return templateUndefined{}, nil
+}
+
+func (e templateSubscript) eval(r *templateRenderer) (any, error) {
+	object, err := e.object.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	index, err := e.index.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	switch o := object.(type) {
+	case map[string]any:
+		if key, ok := index.(string); ok {
+			if value, found := o[key]; found {
+				return value, nil
+			}
+		}
+		return templateUndefined{}, nil
+	case templateNamespace:
+		if key, ok := index.(string); ok {
+			if value, found := o[key]; found {
+				return value, nil
+			}
+		}
+		return templateUndefined{}, nil
+	case []any, string:
+		i, ok := index.(int)
+		if !ok {
+			return nil, fmt.Errorf("indices must be integers, got %s", templateRepr(index))
+		}
+		items, _ := templateItems(o)
+		if i < 0 {
+			i += len(items)
+		}
+		if i < 0 || i >= len(items) {
+			return templateUndefined{}, nil
+		}
+		return items[i], nil
+	case templateUndefined:
+		return templateUndefined{}, nil
+	}
+	return nil, fmt.Errorf("%s is not subscriptable", templateRepr(object))
+}
+
+func (e templateSlice) eval(r *templateRenderer) (any, error) {
+	object, err := e.object.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	bounds := make([]*int, 3)
+	for i, bound := range []templateExpression{e.start, e.stop, e.step} {
+		if bound == nil {
+			continue
+		}
+		value, boundErr := bound.eval(r)
+		if boundErr != nil {
+			return nil, boundErr
+		}
+		if value == nil {
+			continue
+		}
+		integer, ok := value.(int)
+		if !ok {
+			return nil, fmt.Errorf("slice indices must be integers, got %s", templateRepr(value))
+		}
+		bounds[i] = &integer
+	}
+	var items []any
+	switch o := object.(type) {
+	case []any:
+		items = o
+	case string:
+		items, _ = templateItems(o)
+	default:
+		return nil, fmt.Errorf("%s cannot be sliced", templateRepr(object))
+	}
+	sliced, err := sliceTemplateItems(items, bounds[0], bounds[1], bounds[2])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := object.(string); ok {
+		var sb strings.Builder
+		for _, item := range sliced {
+			sb.WriteString(item.(string))
+		}
+		return sb.String(), nil
+	}
+	return sliced, nil
+}
+
+// sliceTemplateItems slices items as Python does, with negative and out of range bounds.
+func sliceTemplateItems(items []any, start, stop, step *int) ([]any, error) {
+	n := len(items)
+	s := 1
+	if step != nil {
+		s = *step
+	}
+	if s == 0 {
+		return nil, errors.New("slice step cannot be zero")
+	}
+	clamp := func(bound *int, fallback int, low int, high int) int {
+		if bound == nil {
+			return fallback
+		}
+		i := *bound
+		if i < 0 {
+			i += n
+		}
+		return max(low, min(high, i))
+	}
+	var sliced []any
+	if s > 0 {
+		for i := clamp(start, 0, 0, n); i < clamp(stop, n, 0, n); i += s {
+			sliced = append(sliced, items[i])
+		}
+	} else {
+		for i := clamp(start, n-1, -1, n-1); i > clamp(stop, -1, -1, n-1); i += s {
+			sliced = append(sliced, items[i])
+		}
+	}
+	if sliced == nil {
+		sliced = []any{}
+	}
+	return sliced, nil
+}
+
+func (e templateCall) eval(r *templateRenderer) (any, error) {
+	function, err := e.function.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := function.(templateFunction)
+	if !ok {
+		return nil, fmt.Errorf("%s is not callable", templateRepr(function))
+	}
+	args, kwargs, err := evalTemplateArguments(r, e.args, e.kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return f(args, kwargs)
+}
+
+func evalTemplateArguments(r *templateRenderer, args []templateExpression, kwargs map[string]templateExpression) ([]any, map[string]any, error) {
+	values := make([]any, len(args))
+	for i, arg := range args {
+		value, err := arg.eval(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i] = value
+	}
+	keywordValues := make(map[string]any, len(kwargs))
+	for name, arg := range kwargs {
+		value, err := arg.eval(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		keywordValues[name] = value
+	}
+	return values, keywordValues, nil
+}
+
+func (e templateFilter) eval(r *templateRenderer) (any, error) {
+	operand, err := e.operand.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	args, kwargs, err := evalTemplateArguments(r, e.args, e.kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return applyTemplateFilter(e.name, operand, args, kwargs)
+}
+
+func (e templateTest) eval(r *templateRenderer) (any, error) {
+	operand, err := e.operand.eval(r)
+	if err != nil {
+		return nil, err
+	}
+	args, _, err := evalTemplateArguments(r, e.args, nil)
+	if err != nil {
+		return nil, err
+	}
+	result, err := applyTemplateTest(e.name, operand, args)
+	if err != nil {
+		return nil, err
+	}
+	return result != e.negated, nil
+}
+
+// values
+
+func templateTruth(value any) bool {
+	switch v := value.(type) {
+	case nil, templateUndefined:
+		return false
+	case bool:
+		return v
+	case int:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	case map[string]any:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+// templateString converts a value to a string as Python's str does.
+func templateString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case templateUndefined:
+		return ""
+	default:
+		return templateRepr(value)
+	}
+}
+
+// templateRepr converts a value to a string as Python's repr does.
+func templateRepr(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "None"
+	case templateUndefined:
+		return ""
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e16 {
+			return strconv.FormatFloat(v, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return "'" + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), "'", `\'`) + "'"
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = templateRepr(e)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]any:
+		keys := sortedTemplateKeys(v)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = templateRepr(k) + ": " + templateRepr(v[k])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case templateNamespace:
+		return "<Namespace>"
+	case templateFunction:
+		return "<function>"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func sortedTemplateKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// templateItems returns the items iterated by a for loop: the elements of a list, the characters of a string, or
+// the sorted keys of a mapping.
+func templateItems(value any) ([]any, error) {
+	switch v := value.(type) {
+	case []any:
+		return v, nil
+	case string:
+		items := make([]any, 0, len(v))
+		for _, c := range v {
+			items = append(items, string(c))
+		}
+		return items, nil
+	case map[string]any:
+		items := make([]any, 0, len(v))
+		for _, k := range sortedTemplateKeys(v) {
+			items = append(items, k)
+		}
+		return items, nil
+	case nil, templateUndefined:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s is not iterable", templateRepr(value))
+}
+
+func templateNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func templateEqual(left any, right any) bool {
+	if l, ok := templateNumber(left); ok {
+		r, isNumber := templateNumber(right)
+		return isNumber && l == r
+	}
+	switch l := left.(type) {
+	case nil:
+		return right == nil
+	case templateUndefined:
+		_, ok := right.(templateUndefined)
+		return ok
+	case string:
+		r, ok := right.(string)
+		return ok && l == r
+	case []any:
+		r, ok := right.([]any)
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !templateEqual(l[i], r[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		r, ok := right.(map[string]any)
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for k, v := range l {
+			if other, found := r[k]; !found || !templateEqual(v, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func templateContains(container any, item any) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return false, fmt.Errorf("'in <string>' requires a string, got %s", templateRepr(item))
+		}
+		return strings.Contains(c, s), nil
+	case []any:
+		for _, e := range c {
+			if templateEqual(e, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]any:
+		s, ok := item.(string)
+		_, found := c[s]
+		return ok && found, nil
+	case templateNamespace:
+		s, ok := item.(string)
+		_, found := c[s]
+		return ok && found, nil
+	case nil, templateUndefined:
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is not a container", templateRepr(container))
+}
+
+func templateCompare(operator string, left any, right any) (bool, error) {
+	if l, ok := templateNumber(left); ok {
+		if r, isNumber := templateNumber(right); isNumber {
+			return compareOrdered(operator, l, r)
+		}
+	}
+	if l, ok := left.(string); ok {
+		if r, isString := right.(string); isString {
+			return compareOrdered(operator, l, r)
+		}
+	}
+	return false, fmt.Errorf("cannot compare %s and %s", templateRepr(left), templateRepr(right))
+}
+
+func templateArithmetic(operator string, left any, right any) (any, error) {
+	if operator == "+" {
+		switch l := left.(type) {
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []any:
+			if r, ok := right.([]any); ok {
+				return append(append([]any{}, l...), r...), nil
+			}
+		}
+	}
+	if operator == "*" {
+		if s, ok := left.(string); ok {
+			if n, isInt := right.(int); isInt {
+				return strings.Repeat(s, max(n, 0)), nil
+			}
+		}
+	}
+	l, leftOk := templateNumber(left)
+	r, rightOk := templateNumber(right)
+	if !leftOk || !rightOk {
+		return nil, fmt.Errorf("unsupported operands for %s: %s and %s", operator, templateRepr(left), templateRepr(right))
+	}
+	li, leftInt := left.(int)
+	ri, rightInt := right.(int)
+	integers := leftInt && rightInt
+	if (operator == "/" || operator == "//" || operator == "%") && r == 0 {
+		return nil, errors.New("division by zero")
+	}
+	switch operator {
+	case "+":
+		if integers {
+			return li + ri, nil
+		}
+		return l + r, nil
+	case "-":
+		if integers {
+			return li - ri, nil
+		}
+		return l - r, nil
+	case "*":
+		if integers {
+			return li * ri, nil
+		}
+		return l * r, nil
+	case "/":
+		return l / r, nil
+	case "//":
+		if integers {
+			return int(math.Floor(l / r)), nil
+		}
+		return math.Floor(l / r), nil
+	case "%":
+		if integers {
+			return ((li % ri) + ri) % ri, nil
+		}
+		return l - r*math.Floor(l/r), nil
+	case "**":
+		if integers && ri >= 0 {
+			return int(math.Pow(l, r)), nil
+		}
+		return math.Pow(l, r), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", operator)
+}
+
+// functions, methods, filters and tests
+
+func templateRange(args []any, _ map[string]any) (any, error) {
+	bounds := make([]int, len(args))
+	for i, arg := range args {
+		bound, ok := arg.(int)
+		if !ok {
+			return nil, fmt.Errorf("range expects integers, got %s", templateRepr(arg))
+		}
+		bounds[i] = bound
+	}
+	start, stop, step := 0, 0, 1
+	switch len(bounds) {
+	case 1:
+		stop = bounds[0]
+	case 2:
+		start, stop = bounds[0], bounds[1]
+	case 3:
+		start, stop, step = bounds[0], bounds[1], bounds[2]
+	default:
+		return nil, errors.New("range expects 1 to 3 arguments")
+	}
+	if step == 0 {
+		return nil, errors.New("range step cannot be zero")
+	}
+	values := []any{}
+	for i := start; (step > 0 && i < stop) || (step < 0 && i > stop); i += step {
+		values = append(values, i)
+	}
+	return values, nil
+}
+
+func templateNewNamespace(args []any, kwargs map[string]any) (any, error) {
+	namespace := templateNamespace{}
+	for _, arg := range args {
+		if m, ok := arg.(map[string]any); ok {
+			for k, v := range m {
+				namespace[k] = v
+			}
+		}
+	}
+	for k, v := range kwargs {
+		namespace[k] = v
+	}
+	return namespace, nil
+}
+
+// templateStrftimeNow formats the current date with the directives of Python's strftime used by chat templates.
+func templateStrftimeNow(args []any, _ map[string]any) (any, error) {
+	if len(args) != 1 {
+		return nil, errors.New("strftime_now expects a format")
+	}
+	format, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("strftime_now expects a string, got %s", templateRepr(args[0]))
+	}
+	directives := map[byte]string{
+		'd': "02", 'm': "01", 'y': "06", 'Y': "2006", 'H': "15", 'I': "03", 'M': "04", 'S': "05", 'p': "PM",
+		'b': "Jan", 'B': "January", 'a': "Mon", 'A': "Monday", 'Z': "MST", 'z': "-0700",
+	}
+	now := time.Now()
+	var sb strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			sb.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch layout, found := directives[format[i]]; {
+		case found:
+			sb.WriteString(now.Format(layout))
+		case format[i] == 'j':
+			sb.WriteString(fmt.Sprintf("%03d", now.YearDay()))
+		case format[i] == '%':
+			sb.WriteByte('%')
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(format[i])
+		}
+	}
+	return sb.String(), nil
+}
+
+// templateMethod returns the method of a string or mapping with the given name, or nil.
+func templateMethod(object any, name string) templateFunction {
+	switch o := object.(type) {
+	case string:
+		return templateStringMethod(o, name)
+	case map[string]any:
+		switch name {
+		case "items":
+			return func(_ []any, _ map[string]any) (any, error) {
+				items := make([]any, 0, len(o))
+				for _, k := range sortedTemplateKeys(o) {
+					items = append(items, []any{k, o[k]})
+				}
+				return items, nil
+			}
+		case "keys":
+			return func(_ []any, _ map[string]any) (any, error) {
+				return templateItems(o)
+			}
+		case "values":
+			return func(_ []any, _ map[string]any) (any, error) {
+				values := make([]any, 0, len(o))
+				for _, k := range sortedTemplateKeys(o) {
+					values = append(values, o[k])
+				}
+				return values, nil
+			}
+		case "get":
+			return func(args []any, _ map[string]any) (any, error) {
+				if len(args) == 0 {
+					return nil, errors.New("get expects a key")
+				}
+				if key, ok := args[0].(string); ok {
+					if value, found := o[key]; found {
+						return value, nil
+					}
+				}
+				if len(args) > 1 {
+					return args[1], nil
+				}
+				return nil, nil
+			}
+		}
+	}
+	return nil
+}
+
+func templateStringMethod(s string, name string) templateFunction {
+	stringArg := func(args []any, i int) (string, bool) {
+		if i >= len(args) {
+			return "", false
+		}
+		arg, ok := args[i].(string)
+		return arg, ok
+	}
+	trim := func(trimmer func(string, string) string, trimSpace func(string) string) templateFunction {
+		return func(args []any, _ map[string]any) (any, error) {
+			if chars, ok := stringArg(args, 0); ok {
+				return trimmer(s, chars), nil
+			}
+			return trimSpace(s), nil
+		}
+	}
+	affix := func(test func(string, string) bool) templateFunction {
+		return func(args []any, _ map[string]any) (any, error) {
+			if len(args) == 1 {
+				if options, ok := args[0].([]any); ok {
+					for _, option := range options {
+						if affix, isString := option.(string); isString && test(s, affix) {
+							return true, nil
+						}
+					}
+					return false, nil
+				}
+			}
+			affix, ok := stringArg(args, 0)
+			if !ok {
+				return nil, fmt.Errorf("%s expects a string", name)
+			}
+			return test(s, affix), nil
+		}
+	}
+	switch name {
+	case "strip":
+		return trim(strings.Trim, strings.TrimSpace)
+	case "lstrip":
+		return trim(strings.TrimLeft, func(s string) string { return strings.TrimLeftFunc(s, unicode.IsSpace) })
+	case "rstrip":
+		return trim(strings.TrimRight, func(s string) string { return strings.TrimRightFunc(s, unicode.IsSpace) })
+	case "startswith":
+		return affix(strings.HasPrefix)
+	case "endswith":
+		return affix(strings.HasSuffix)
+	case "upper":
+		return func(_ []any, _ map[string]any) (any, error) { return strings.ToUpper(s), nil }
+	case "lower":
+		return func(_ []any, _ map[string]any) (any, error) { return strings.ToLower(s), nil }
+	case "title":
+		return func(_ []any, _ map[string]any) (any, error) { return templateTitle(s), nil }
+	case "capitalize":
+		return func(_ []any, _ map[string]any) (any, error) { return templateCapitalize(s), nil }
+	case "replace":
+		return func(args []any, _ map[string]any) (any, error) {
+			old, okOld := stringArg(args, 0)
+			replacement, okNew := stringArg(args, 1)
+			if !okOld || !okNew {
+				return nil, errors.New("replace expects two strings")
+			}
+			count := -1
+			if len(args) > 2 {
+				if n, ok := args[2].(int); ok {
+					count = n
+				}
+			}
+			return strings.Replace(s, old, replacement, count), nil
+		}
+	case "split", "rsplit":
+		return func(args []any, _ map[string]any) (any, error) {
+			separator, ok := stringArg(args, 0)
+			limit := -1
+			if len(args) > 1 {
+				if n, isInt := args[1].(int); isInt && n >= 0 {
+					limit = n + 1
+				}
+			}
+			var parts []string
+			switch {
+			case !ok:
+				parts = strings.Fields(s)
+			case name == "rsplit" && limit > 0:
+				parts = strings.Split(s, separator)
+				if len(parts) > limit {
+					parts = append([]string{strings.Join(parts[:len(parts)-limit+1], separator)}, parts[len(parts)-limit+1:]...)
+				}
+			default:
+				parts = strings.SplitN(s, separator, limit)
+			}
+			values := make([]any, len(parts))
+			for i, part := range parts {
+				values[i] = part
+			}
+			return values, nil
+		}
+	case "find":
+		return func(args []any, _ map[string]any) (any, error) {
+			sub, ok := stringArg(args, 0)
+			if !ok {
+				return nil, errors.New("find expects a string")
+			}
+			return strings.Index(s, sub), nil
+		}
+	case "count":
+		return func(args []any, _ map[string]any) (any, error) {
+			sub, ok := stringArg(args, 0)
+			if !ok {
+				return nil, errors.New("count expects a string")
+			}
+			return strings.Count(s, sub), nil
+		}
+	}
+	return nil
+}
+
+func templateTitle(s string) string {
+	runes := []rune(s)
+	previousLetter := false
+	for i, c := range runes {
+		if previousLetter {
+			runes[i] = unicode.ToLower(c)
+		} else {
+			runes[i] = unicode.ToUpper(c)
+		}
+		previousLetter = unicode.IsLetter(c)
+	}
+	return string(runes)
+}
+
+func templateCapitalize(s string) string {
+	runes := []rune(strings.ToLower(s))
+	if len(runes) > 0 {
+		runes[0] = unicode.ToUpper(runes[0])
+	}
+	return string(runes)
+}
+
+func applyTemplateFilter(name string, value any, args []any, kwargs map[string]any) (any, error) {
+	switch name {
+	case "trim":
+		return strings.TrimSpace(templateString(value)), nil
+	case "upper":
+		return strings.ToUpper(templateString(value)), nil
+	case "lower":
+		return strings.ToLower(templateString(value)), nil
+	case "title":
+		return templateTitle(templateString(value)), nil
+	case "capitalize":
+		return templateCapitalize(templateString(value)), nil
+	case "string":
+		return templateString(value), nil
+	case "safe", "e", "escape":
+		// templates are rendered without autoescaping
+		return value, nil
+	case "length", "count":
+		switch v := value.(type) {
+		case string:
+			return len([]rune(v)), nil
+		case []any:
+			return len(v), nil
+		case map[string]any:
+			return len(v), nil
+		case templateUndefined, nil:
+			return 0, nil
+		}
+		return nil, fmt.Errorf("%s has no length", templateRepr(value))
+	case "default", "d":
+		_, undefined := value.(templateUndefined)
+		fallback := any("")
+		if len(args) > 0 {
+			fallback = args[0]
+		}
+		if undefined || (len(args) > 1 && templateTruth(args[1]) && !templateTruth(value)) {
+			return fallback, nil
+		}
+		return value, nil
+	case "first", "last", "reverse", "list", "sort", "unique":
+		items, err := templateItems(value)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "first":
+			if len(items) == 0 {
+				return templateUndefined{}, nil
+			}
+			return items[0], nil
+		case "last":
+			if len(items) == 0 {
+				return templateUndefined{}, nil
+			}
+			return items[len(items)-1], nil
+		case "reverse":
+			reversed := make([]any, len(items))
+			for i, item := range items {
+				reversed[len(items)-1-i] = item
+			}
+			if s, ok := value.(string); ok {
+				runes := []rune(s)
+				for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+					runes[i], runes[j] = runes[j], runes[i]
+				}
+				return string(runes), nil
+			}
+			return reversed, nil
+		case "sort":
+			sorted := append([]any{}, items...)
+			var sortErr error
+			sort.SliceStable(sorted, func(i, j int) bool {
+				less, err := templateCompare("<", sorted[i], sorted[j])
+				sortErr = errors.Join(sortErr, err)
+				return less
+			})
+			return sorted, sortErr
+		case "unique":
+			var unique []any
+			for _, item := range items {
+				if found, _ := templateContains(unique, item); !found {
+					unique = append(unique, item)
+				}
+			}
+			return unique, nil
+		default:
+			return append([]any{}, items...), nil
+		}
+	case "join":
+		items, err := templateItems(value)
+		if err != nil {
+			return nil, err
+		}
+		separator := ""
+		if len(args) > 0 {
+			separator = templateString(args[0])
+		}
+		parts := make([]string, len(items))
+		for i, item := range items {
+			parts[i] = templateString(item)
+		}
+		return strings.Join(parts, separator), nil
+	case "replace":
+		if len(args) < 2 {
+			return nil, errors.New("replace expects two strings")
+		}
+		return strings.ReplaceAll(templateString(value), templateString(args[0]), templateString(args[1])), nil
+	case "int":
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case float64:
+			return int(v), nil
+		case string:
+			i, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return 0, nil
+			}
+			return i, nil
+		}
+		return 0, nil
+	case "float":
+		if f, ok := templateNumber(value); ok {
+			return f, nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(templateString(value)), 64)
+		if err != nil {
+			return 0.0, nil
+		}
+		return f, nil
+	case "abs":
+		switch v := value.(type) {
+		case int:
+			return max(v, -v), nil
+		case float64:
+			return math.Abs(v), nil
+		}
+		return nil, fmt.Errorf("abs expects a number, got %s", templateRepr(value))
+	case "items":
+		if m, ok := value.(map[string]any); ok {
+			return templateMethod(m, "items")(nil, nil)
+		}
+		return nil, fmt.Errorf("items expects a mapping, got %s", templateRepr(value))
+	case "indent":
+		width := 4
+		if len(args) > 0 {
+			if w, ok := args[0].(int); ok {
+				width = w
+			}
+		}
+		lines := strings.Split(templateString(value), "\n")
+		for i := 1; i < len(lines); i++ {
+			if lines[i] != "" {
+				lines[i] = strings.Repeat(" ", width) + lines[i]
+			}
+		}
+		return strings.Join(lines, "\n"), nil
+	case "tojson":
+		indent := 0
+		if value, ok := kwargs["indent"].(int); ok {
+			indent = value
+		} else if len(args) > 0 {
+			if value, isInt := args[0].(int); isInt {
+				indent = value
+			}
+		}
+		var sb strings.Builder
+		if err := writeTemplateJSON(&sb, value, indent, 0); err != nil {
+			return nil, err
+		}
+		return sb.String(), nil
+	case "map", "selectattr", "rejectattr", "select", "reject":
+		return applyTemplateSequenceFilter(name, value, args, kwargs)
+	}
+	return nil, fmt.Errorf("unsupported filter %s", name)
+}
+
+// applyTemplateSequenceFilter applies the filters that select or map the items of a sequence.
+func applyTemplateSequenceFilter(name string, value any, args []any, kwargs map[string]any) (any, error) {
+	items, err := templateItems(value)
+	if err != nil {
+		return nil, err
+	}
+	attribute := func(item any, attribute string) any {
+		if m, ok := item.(map[string]any); ok {
+			if v, found := m[attribute]; found {
+				return v
+			}
+		}
+		return templateUndefined{}
+	}
+	result := []any{}
+	switch name {
+	case "map":
+		if a, ok := kwargs["attribute"].(string); ok {
+			for _, item := range items {
+				result = append(result, attribute(item, a))
+			}
+			return result, nil
+		}
+		if len(args) == 0 {
+			return nil, errors.New("map expects a filter or an attribute")
+		}
+		for _, item := range items {
+			mapped, mapErr := applyTemplateFilter(templateString(args[0]), item, args[1:], nil)
+			if mapErr != nil {
+				return nil, mapErr
+			}
+			result = append(result, mapped)
+		}
+		return result, nil
+	case "selectattr", "rejectattr":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s expects an attribute", name)
+		}
+		for _, item := range items {
+			v := attribute(item, templateString(args[0]))
+			keep := templateTruth(v)
+			if len(args) > 1 {
+				if keep, err = applyTemplateTest(templateString(args[1]), v, args[2:]); err != nil {
+					return nil, err
+				}
+			}
+			if keep == (name == "selectattr") {
+				result = append(result, item)
+			}
+		}
+		return result, nil
+	default:
+		for _, item := range items {
+			keep := templateTruth(item)
+			if len(args) > 0 {
+				if keep, err = applyTemplateTest(templateString(args[0]), item, args[1:]); err != nil {
+					return nil, err
+				}
+			}
+			if keep == (name == "select") {
+				result = append(result, item)
+			}
+		}
+		return result, nil
+	}
+}
+
+func applyTemplateTest(name string, value any, args []any) (bool, error) {
+	switch name {
+	case "defined":
+		_, undefined := value.(templateUndefined)
+		return !undefined, nil
+	case "undefined":
+		_, undefined := value.(templateUndefined)
+		return undefined, nil
+	case "none":
+		return value == nil, nil
+	case "string":
+		_, ok := value.(string)
+		return ok, nil
+	case "number":
+		_, isInt := value.(int)
+		_, isFloat := value.(float64)
+		return isInt || isFloat, nil
+	case "integer":
+		_, ok := value.(int)
+		return ok, nil
+	case "float":
+		_, ok := value.(float64)
+		return ok, nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok, nil
+	case "true":
+		return value == true, nil
+	case "false":
+		return value == false, nil
+	case "mapping":
+		_, isMap := value.(map[string]any)
+		_, isNamespace := value.(templateNamespace)
+		return isMap || isNamespace, nil
+	case "sequence", "iterable":
+		switch value.(type) {
+		case []any, string, map[string]any:
+			return true, nil
+		}
+		return false, nil
+	case "callable":
+		_, ok := value.(templateFunction)
+		return ok, nil
+	case "odd", "even":
+		i, ok := value.(int)
+		if !ok {
+			return false, fmt.Errorf("%s expects an integer, got %s", name, templateRepr(value))
+		}
+		return (i%2 != 0) == (name == "odd"), nil
+	case "divisibleby":
+		i, ok := value.(int)
+		if len(args) == 0 || !ok {
+			return false, errors.New("divisibleby expects integers")
+		}
+		d, ok := args[0].(int)
+		if !ok || d == 0 {
+			return false, errors.New("divisibleby expects a non zero integer")
+		}
+		return i%d == 0, nil
+	case "equalto", "eq", "==", "sameas":
+		if len(args) == 0 {
+			return false, fmt.Errorf("%s expects a value", name)
+		}
+		return templateEqual(value, args[0]), nil
+	case "ne", "!=":
+		if len(args) == 0 {
+			return false, fmt.Errorf("%s expects a value", name)
+		}
+		return !templateEqual(value, args[0]), nil
+	case "in":
+		if len(args) == 0 {
+			return false, errors.New("in expects a container")
+		}
+		return templateContains(args[0], value)
+	}
+	return false, fmt.Errorf("unsupported test %s", name)
+}
+
+// writeTemplateJSON writes a value as JSON as Python's json.dumps does with ensure_ascii=False: with ", " and ": "
+// separators, or with the given indent. Mapping keys are sorted, as Go maps have no order.
+func writeTemplateJSON(sb *strings.Builder, value any, indent int, depth int) error {
+	newline := func(depth int) {
+		if indent > 0 {
+			sb.WriteString("\n" + strings.Repeat(" ", indent*depth))
+		}
+	}
+	separator := ", "
+	if indent > 0 {
+		separator = ","
+	}
+	switch v := value.(type) {
+	case nil, templateUndefined:
+		sb.WriteString("null")
+	case bool:
+		sb.WriteString(strconv.FormatBool(v))
+	case int, float64:
+		sb.WriteString(templateRepr(v))
+	case string:
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(v); err != nil {
+			return err
+		}
+		sb.WriteString(strings.TrimSuffix(buffer.String(), "\n"))
+	case []any:
+		if len(v) == 0 {
+			sb.WriteString("[]")
+			return nil
+		}
+		sb.WriteString("[")
+		for i, e := range v {
+			if i > 0 {
+				sb.WriteString(separator)
+			}
+			newline(depth + 1)
+			if err := writeTemplateJSON(sb, e, indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		sb.WriteString("]")
+	case map[string]any, templateNamespace:
+		m, ok := v.(map[string]any)
+		if !ok {
+			m = v.(templateNamespace)
+		}
+		if len(m) == 0 {
+			sb.WriteString("{}")
+			return nil
+		}
+		sb.WriteString("{")
+		for i, k := range sortedTemplateKeys(m) {
+			if i > 0 {
+				sb.WriteString(separator)
+			}
+			newline(depth + 1)
+			if err := writeTemplateJSON(sb, k, indent, depth+1); err != nil {
+				return err
+			}
+			sb.WriteString(": ")
+			if err := writeTemplateJSON(sb, m[k], indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		sb.WriteString("}")
+	default:
+		return fmt.Errorf("cannot convert %s to JSON", templateRepr(value))
+	}
+	return nil
+}
+
+// lexing and parsing of expressions
+
+type templateExpressionToken struct {
+	kind  filterTokenKind
+	text  string
+	value any
+}
+
+func tokenizeTemplateExpression(source string) ([]templateExpressionToken, error) {
+	var tokens []templateExpressionToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			var sb strings.Builder
+			for end < len(runes) && runes[end] != c {
+				if runes[end] == '\\' && end+1 < len(runes) {
+					end++
+					switch runes[end] {
+					case 'n':
+						sb.WriteRune('\n')
+					case 't':
+						sb.WriteRune('\t')
+					case 'r':
+						sb.WriteRune('\r')
+					default:
+						sb.WriteRune(runes[end])
+					}
+				} else {
+					sb.WriteRune(runes[end])
+				}
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in expression %q", source)
+			}
+			tokens = append(tokens, templateExpressionToken{kind: filterTokenString, text: string(runes[i : end+1]), value: sb.String()})
+			i = end + 1
+		case unicode.IsDigit(c):
+			end := i + 1
+			isFloat := false
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || (runes[end] == '.' && !isFloat && end+1 < len(runes) && unicode.IsDigit(runes[end+1]))) {
+				isFloat = isFloat || runes[end] == '.'
+				end++
+			}
+			text := string(runes[i:end])
+			var value any
+			var err error
+			if isFloat {
+				value, err = strconv.ParseFloat(text, 64)
+			} else {
+				value, err = strconv.Atoi(text)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s in expression %q", text, source)
+			}
+			tokens = append(tokens, templateExpressionToken{kind: filterTokenNumber, text: text, value: value})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i + 1
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, templateExpressionToken{kind: filterTokenIdentifier, text: string(runes[i:end])})
+			i = end
+		default:
+			operator := ""
+			for _, candidate := range []string{"==", "!=", ">=", "<=", "//", "**", ">", "<", "+", "-", "*", "/", "%", "~", "|", ".", ",", ":", "(", ")", "[", "]", "{", "}", "="} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q in expression %q", c, source)
+			}
+			tokens = append(tokens, templateExpressionToken{kind: filterTokenOperator, text: operator})
+			i += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+type templateExpressionParser struct {
+	tokens   []templateExpressionToken
+	position int
+}
+
+func (p *templateExpressionParser) peek() (templateExpressionToken, bool) {
+	if p.position >= len(p.tokens) {
+		return templateExpressionToken{}, false
+	}
+	return p.tokens[p.position], true
+}
+
+func (p *templateExpressionParser) acceptOperator(operators ...string) (string, bool) {
+	token, ok := p.peek()
+	if !ok || token.kind != filterTokenOperator {
+		return "", false
+	}
+	for _, operator := range operators {
+		if token.text == operator {
+			p.position++
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+func (p *templateExpressionParser) acceptName(name string) bool {
+	token, ok := p.peek()
+	if ok && token.kind == filterTokenIdentifier && token.text == name {
+		p.position++
+		return true
+	}
+	return false
+}
+
+func (p *templateExpressionParser) expectOperator(operator string) error {
+	if _, ok := p.acceptOperator(operator); !ok {
+		if token, found := p.peek(); found {
+			return fmt.Errorf("expected %s, got %s", operator, token.text)
+		}
+		return fmt.Errorf("expected %s at the end of the expression", operator)
+	}
+	return nil
+}
+
+func (p *templateExpressionParser) parseConditional() (templateExpression, error) {
+	expression, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.acceptName("if") {
+		return expression, nil
+	}
+	condition, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	conditional := templateConditional{condition: condition, then: expression}
+	if p.acceptName("else") {
+		if conditional.otherwise, err = p.parseConditional(); err != nil {
+			return nil, err
+		}
+	}
+	return conditional, nil
+}
+
+func (p *templateExpressionParser) parseOr() (templateExpression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptName("or") {
+		right, rightErr := p.parseAnd()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = templateBinary{operator: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *templateExpressionParser) parseAnd() (templateExpression, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptName("and") {
+		right, rightErr := p.parseNot()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = templateBinary{operator: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *templateExpressionParser) parseNot() (templateExpression, error) {
+	if p.acceptName("not") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return templateUnary{operator: "not", operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *templateExpressionParser) parseComparison() (templateExpression, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.acceptOperator("==", "!=", ">=", "<=", ">", "<")
+		if !ok {
+			switch {
+			case p.acceptName("in"):
+				operator = "in"
+			case p.position+1 < len(p.tokens) && p.tokens[p.position].text == "not" && p.tokens[p.position+1].text == "in":
+				p.position += 2
+				operator = "not in"
+			case p.acceptName("is"):
+				test := templateTest{operand: left, negated: p.acceptName("not")}
+				token, found := p.peek()
+				if !found || token.kind != filterTokenIdentifier {
+					return nil, errors.New("expected the name of a test after is")
+				}
+				p.position++
+				test.name = token.text
+				if _, open := p.acceptOperator("("); open {
+					if test.args, _, err = p.parseArguments(); err != nil {
+						return nil, err
+					}
+				} else if next, hasNext := p.peek(); hasNext && (next.kind == filterTokenString || next.kind == filterTokenNumber) {
+					argument, argumentErr := p.parsePrimary()
+					if argumentErr != nil {
+						return nil, argumentErr
+					}
+					test.args = []templateExpression{argument}
+				}
+				left = test
+				continue
+			default:
+				return left, nil
+			}
+		}
+		right, rightErr := p.parseSum()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = templateBinary{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *templateExpressionParser) parseSum() (templateExpression, error) {
+	left, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.acceptOperator("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, rightErr := p.parseConcat()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = templateBinary{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *templateExpressionParser) parseConcat() (templateExpression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("~"); !ok {
+			return left, nil
+		}
+		right, rightErr := p.parseProduct()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = templateBinary{operator: "~", left: left, right: right}
+	}
+}
+
+func (p *templateExpressionParser) parseProduct() (templateExpression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.acceptOperator("*", "/", "//", "%", "**")
+		if !ok {
+			return left, nil
+		}
+		right, rightErr := p.parseUnary()
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		left = templateBinary{operator: operator, left: left, right: right}
+	}
+}
+
+func (p *templateExpressionParser) parseUnary() (templateExpression, error) {
+	if operator, ok := p.acceptOperator("-", "+"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return templateUnary{operator: operator, operand: operand}, nil
+	}
+	operand, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.acceptOperator("|"); !ok {
+			return operand, nil
+		}
+		token, found := p.peek()
+		if !found || token.kind != filterTokenIdentifier {
+			return nil, errors.New("expected the name of a filter after |")
+		}
+		p.position++
+		filter := templateFilter{operand: operand, name: token.text}
+		if _, open := p.acceptOperator("("); open {
+			if filter.args, filter.kwargs, err = p.parseArguments(); err != nil {
+				return nil, err
+			}
+		}
+		operand = filter
+	}
+}
+
+func (p *templateExpressionParser) parsePostfix() (templateExpression, error) {
+	expression, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.acceptOperator(".", "[", "(")
+		if !ok {
+			return expression, nil
+		}
+		switch operator {
+		case ".":
+			token, found := p.peek()
+			if !found || token.kind != filterTokenIdentifier {
+				return nil, errors.New("expected an attribute name after .")
+			}
+			p.position++
+			expression = templateAttribute{object: expression, name: token.text}
+		case "(":
+			call := templateCall{function: expression}
+			if call.args, call.kwargs, err = p.parseArguments(); err != nil {
+				return nil, err
+			}
+			expression = call
+		default:
+			if expression, err = p.parseSubscript(expression); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseSubscript parses an index or a slice, after its opening bracket.
+func (p *templateExpressionParser) parseSubscript(object templateExpression) (templateExpression, error) {
+	var bounds []templateExpression
+	isSlice := false
+	for {
+		token, ok := p.peek()
+		if !ok {
+			return nil, errors.New("missing closing bracket")
+		}
+		if token.kind == filterTokenOperator && (token.text == ":" || token.text == "]") {
+			bounds = append(bounds, nil)
+		} else {
+			bound, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			bounds = append(bounds, bound)
+		}
+		if _, colon := p.acceptOperator(":"); colon {
+			isSlice = true
+			continue
+		}
+		if err := p.expectOperator("]"); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if !isSlice {
+		return templateSubscript{object: object, index: bounds[0]}, nil
+	}
+	if len(bounds) > 3 {
+		return nil, errors.New("invalid slice")
+	}
+	for len(bounds) < 3 {
+		bounds = append(bounds, nil)
+	}
+	return templateSlice{object: object, start: bounds[0], stop: bounds[1], step: bounds[2]}, nil
+}
+
+// parseArguments parses the arguments of a call, after its opening parenthesis.
+func (p *templateExpressionParser) parseArguments() ([]templateExpression, map[string]templateExpression, error) {
+	var args []templateExpression
+	kwargs := map[string]templateExpression{}
+	for {
+		if _, closed := p.acceptOperator(")"); closed {
+			return args, kwargs, nil
+		}
+		if p.position+1 < len(p.tokens) && p.tokens[p.position].kind == filterTokenIdentifier && p.tokens[p.position+1].text == "=" {
+			name := p.tokens[p.position].text
+			p.position += 2
+			value, err := p.parseConditional()
+			if err != nil {
+				return nil, nil, err
+			}
+			kwargs[name] = value
+		} else {
+			value, err := p.parseConditional()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, value)
+		}
+		if _, comma := p.acceptOperator(","); !comma {
+			if err := p.expectOperator(")"); err != nil {
+				return nil, nil, err
+			}
+			return args, kwargs, nil
+		}
+	}
+}
+
+func (p *templateExpressionParser) parsePrimary() (templateExpression, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, errors.New("unexpected end of expression")
+	}
+	p.position++
+	switch token.kind {
+	case filterTokenNumber, filterTokenString:
+		value := token.value
+		// adjacent strings are concatenated
+		for next, found := p.peek(); token.kind == filterTokenString && found && next.kind == filterTokenString; next, found = p.peek() {
+			value = value.(string) + next.value.(string)
+			p.position++
+		}
+		return templateLiteral{value: value}, nil
+	case filterTokenIdentifier:
+		switch token.text {
+		case "true", "True":
+			return templateLiteral{value: true}, nil
+		case "false", "False":
+			return templateLiteral{value: false}, nil
+		case "none", "None":
+			return templateLiteral{value: nil}, nil
+		default:
+			return templateName{name: token.text}, nil
+		}
+	}
+	switch token.text {
+	case "(":
+		expression, err := p.parseConditional()
+		if err != nil {
+			return nil, err
+		}
+		if _, comma := p.acceptOperator(","); comma {
+			// a tuple, evaluated as a list
+			list := templateList{items: []templateExpression{expression}}
+			for {
+				if _, closed := p.acceptOperator(")"); closed {
+					return list, nil
+				}
+				item, itemErr := p.parseConditional()
+				if itemErr != nil {
+					return nil, itemErr
+				}
+				list.items = append(list.items, item)
+				if _, more := p.acceptOperator(","); !more {
+					return list, p.expectOperator(")")
+				}
+			}
+		}
+		return expression, p.expectOperator(")")
+	case "[":
+		list := templateList{}
+		for {
+			if _, closed := p.acceptOperator("]"); closed {
+				return list, nil
+			}
+			item, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, item)
+			if _, comma := p.acceptOperator(","); !comma {
+				return list, p.expectOperator("]")
+			}
+		}
+	case "{":
+		dict := templateDict{}
+		for {
+			if _, closed := p.acceptOperator("}"); closed {
+				return dict, nil
+			}
+			key, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expectOperator(":"); err != nil {
+				return nil, err
+			}
+			value, err := p.parseConditional()
+			if err != nil {
+				return nil, err
+			}
+			dict.keys = append(dict.keys, key)
+			dict.values = append(dict.values, value)
+			if _, comma := p.acceptOperator(","); !comma {
+				return dict, p.expectOperator("}")
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s", token.text)
+}
@@ -0,0 +1,230 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+// The chat templates of the tokenizer_config.json of the models.
+const (
+	llama3Template = `{% set loop_messages = messages %}{% for message in loop_messages %}{% set content = '<|start_header_id|>' + message['role'] + '<|end_header_id|>\n\n'+ message['content'] | trim + '<|eot_id|>' %}{% if loop.index0 == 0 %}{% set content = bos_token + content %}{% endif %}{{ content }}{% endfor %}{% if add_generation_prompt %}{{ '<|start_header_id|>assistant<|end_header_id|>\n\n' }}{% endif %}`
+
+	mistralTemplate = `{{ bos_token }}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if message['role'] == 'user' %}{{ '[INST] ' + message['content'] + ' [/INST]' }}{% elif message['role'] == 'assistant' %}{{ message['content'] + eos_token}}{% else %}{{ raise_exception('Only user and assistant roles are supported!') }}{% endif %}{% endfor %}`
+
+	qwen2Template = `{% for message in messages %}{% if loop.first and messages[0]['role'] != 'system' %}{{ '<|im_start|>system\nYou are a helpful assistant.<|im_end|>\n' }}{% endif %}{{'<|im_start|>' + message['role'] + '\n' + message['content'] + '<|im_end|>' + '\n'}}{% endfor %}{% if add_generation_prompt %}{{ '<|im_start|>assistant\n' }}{% endif %}`
+
+	qwen25Template = `{%- if tools %}
+    {{- '<|im_start|>system\n' }}
+    {%- if messages[0]['role'] == 'system' %}
+        {{- messages[0]['content'] }}
+    {%- else %}
+        {{- 'You are Qwen, created by Alibaba Cloud. You are a helpful assistant.' }}
+    {%- endif %}
+    {{- "\n\n# Tools\n\nYou may call one or more functions to assist with the user query.\n\nYou are provided with function signatures within <tools></tools> XML tags:\n<tools>" }}
+    {%- for tool in tools %}
+        {{- "\n" }}
+        {{- tool | tojson }}
+    {%- endfor %}
+    {{- "\n</tools>\n\nFor each function call, return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n<tool_call>\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n</tool_call><|im_end|>\n" }}
+{%- else %}
+    {%- if messages[0]['role'] == 'system' %}
+        {{- '<|im_start|>system\n' + messages[0]['content'] + '<|im_end|>\n' }}
+    {%- else %}
+        {{- '<|im_start|>system\nYou are Qwen, created by Alibaba Cloud. You are a helpful assistant.<|im_end|>\n' }}
+    {%- endif %}
+{%- endif %}
+{%- for message in messages %}
+    {%- if (message.role == "user") or (message.role == "system" and not loop.first) or (message.role == "assistant" and not message.tool_calls) %}
+        {{- '<|im_start|>' + message.role + '\n' + message.content + '<|im_end|>' + '\n' }}
+    {%- elif message.role == "assistant" %}
+        {{- '<|im_start|>' + message.role }}
+        {%- if message.content %}
+            {{- '\n' + message.content }}
+        {%- endif %}
+        {%- for tool_call in message.tool_calls %}
+            {%- if tool_call.function is defined %}
+                {%- set tool_call = tool_call.function %}
+            {%- endif %}
+            {{- '\n<tool_call>\n{"name": "' }}
+            {{- tool_call.name }}
+            {{- '", "arguments": ' }}
+            {{- tool_call.arguments | tojson }}
+            {{- '}\n</tool_call>' }}
+        {%- endfor %}
+        {{- '<|im_end|>\n' }}
+    {%- elif message.role == "tool" %}
+        {%- if (loop.index0 == 0) or (messages[loop.index0 - 1].role != "tool") %}
+            {{- '<|im_start|>user' }}
+        {%- endif %}
+        {{- '\n<tool_response>\n' }}
+        {{- message.content }}
+        {{- '\n</tool_response>' }}
+        {%- if loop.last or (messages[loop.index0 + 1].role != "tool") %}
+            {{- '<|im_end|>\n' }}
+        {%- endif %}
+    {%- endif %}
+{%- endfor %}
+{%- if add_generation_prompt %}
+    {{- '<|im_start|>assistant\n' }}
+{%- endif %}
+`
+
+	gemmaTemplate = `{{ bos_token }}{% if messages[0]['role'] == 'system' %}{{ raise_exception('System role not supported') }}{% endif %}{% for message in messages %}{% if (message['role'] == 'user') != (loop.index0 % 2 == 0) %}{{ raise_exception('Conversation roles must alternate user/assistant/user/assistant/...') }}{% endif %}{% if (message['role'] == 'assistant') %}{% set role = 'model' %}{% else %}{% set role = message['role'] %}{% endif %}{{ '<start_of_turn>' + role + '\n' + message['content'] | trim + '<end_of_turn>\n' }}{% endfor %}{% if add_generation_prompt %}{{'<start_of_turn>model\n'}}{% endif %}`
+
+	phi3Template = `{% for message in messages %}{% if message['role'] == 'system' %}{{'<|system|>\n' + message['content'] + '<|end|>\n'}}{% elif message['role'] == 'user' %}{{'<|user|>\n' + message['content'] + '<|end|>\n'}}{% elif message['role'] == 'assistant' %}{{'<|assistant|>\n' + message['content'] + '<|end|>\n'}}{% endif %}{% endfor %}{% if add_generation_prompt %}{{ '<|assistant|>\n' }}{% else %}{{ eos_token }}{% endif %}`
+)
+
+func TestChatTemplates(t *testing.T) {
+	system := map[string]any{"role": "system", "content": "You are a pirate."}
+	chat := []any{
+		map[string]any{"role": "user", "content": " Hello! "},
+		map[string]any{"role": "assistant", "content": "Ahoy!"},
+		map[string]any{"role": "user", "content": "Where is the treasure?"},
+	}
+	withSystem := append([]any{system}, chat...)
+	// the keys are in alphabetical order, as the ones of tojson, to be in the order of the Python dictionaries
+	tools := []any{map[string]any{"function": map[string]any{
+		"description": "Get the weather of a city",
+		"name":        "get_weather",
+		"parameters": map[string]any{
+			"properties": map[string]any{"city": map[string]any{"type": "string"}},
+			"required":   []any{"city"},
+			"type":       "object",
+		},
+	}, "type": "function"}}
+	toolCalls := []any{
+		map[string]any{"role": "user", "content": "What is the weather in Paris?"},
+		map[string]any{"role": "assistant", "content": "", "tool_calls": []any{
+			map[string]any{"type": "function", "function": map[string]any{"name": "get_weather", "arguments": map[string]any{"city": "Paris"}}},
+		}},
+		map[string]any{"role": "tool", "content": `{"temperature": 21}`},
+	}
+
+	tests := []struct {
+		name      string
+		template  string
+		variables map[string]any
+		expected  string
+	}{
+		{
+			name:      "llama 3",
+			template:  llama3Template,
+			variables: map[string]any{"messages": withSystem, "bos_token": "<|begin_of_text|>", "add_generation_prompt": true},
+			expected: "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nYou are a pirate.<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nHello!<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\nAhoy!<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nWhere is the treasure?<|eot_id|>" +
+				"<|start_header_id|>assistant<|end_header_id|>\n\n",
+		},
+		{
+			name:      "mistral",
+			template:  mistralTemplate,
+			variables: map[string]any{"messages": chat, "bos_token": "<s>", "eos_token": "</s>", "add_generation_prompt": true},
+			expected:  "<s>[INST]  Hello!  [/INST]Ahoy!</s>[INST] Where is the treasure? [/INST]",
+		},
+		{
+			name:      "qwen 2",
+			template:  qwen2Template,
+			variables: map[string]any{"messages": withSystem, "add_generation_prompt": true},
+			expected: "<|im_start|>system\nYou are a pirate.<|im_end|>\n" +
+				"<|im_start|>user\n Hello! <|im_end|>\n" +
+				"<|im_start|>assistant\nAhoy!<|im_end|>\n" +
+				"<|im_start|>user\nWhere is the treasure?<|im_end|>\n" +
+				"<|im_start|>assistant\n",
+		},
+		{
+			name:      "qwen 2 without system prompt",
+			template:  qwen2Template,
+			variables: map[string]any{"messages": chat[:1], "add_generation_prompt": false},
+			expected:  "<|im_start|>system\nYou are a helpful assistant.<|im_end|>\n<|im_start|>user\n Hello! <|im_end|>\n",
+		},
+		{
+			name:      "qwen 2.5",
+			template:  qwen25Template,
+			variables: map[string]any{"messages": withSystem, "add_generation_prompt": true},
+			expected: "<|im_start|>system\nYou are a pirate.<|im_end|>\n" +
+				"<|im_start|>user\n Hello! <|im_end|>\n" +
+				"<|im_start|>assistant\nAhoy!<|im_end|>\n" +
+				"<|im_start|>user\nWhere is the treasure?<|im_end|>\n" +
+				"<|im_start|>assistant\n",
+		},
+		{
+			name:      "qwen 2.5 with tools",
+			template:  qwen25Template,
+			variables: map[string]any{"messages": toolCalls, "tools": tools, "add_generation_prompt": true},
+			expected: "<|im_start|>system\nYou are Qwen, created by Alibaba Cloud. You are a helpful assistant.\n\n" +
+				"# Tools\n\nYou may call one or more functions to assist with the user query.\n\n" +
+				"You are provided with function signatures within <tools></tools> XML tags:\n<tools>\n" +
+				`{"function": {"description": "Get the weather of a city", "name": "get_weather", "parameters": {"properties": {"city": {"type": "string"}}, "required": ["city"], "type": "object"}}, "type": "function"}` +
+				"\n</tools>\n\nFor each function call, return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n" +
+				"<tool_call>\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n</tool_call><|im_end|>\n" +
+				"<|im_start|>user\nWhat is the weather in Paris?<|im_end|>\n" +
+				"<|im_start|>assistant\n<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call><|im_end|>\n" +
+				"<|im_start|>user\n<tool_response>\n{\"temperature\": 21}\n</tool_response><|im_end|>\n" +
+				"<|im_start|>assistant\n",
+		},
+		{
+			name:      "gemma",
+			template:  gemmaTemplate,
+			variables: map[string]any{"messages": chat, "bos_token": "<bos>", "add_generation_prompt": true},
+			expected: "<bos><start_of_turn>user\nHello!<end_of_turn>\n" +
+				"<start_of_turn>model\nAhoy!<end_of_turn>\n" +
+				"<start_of_turn>user\nWhere is the treasure?<end_of_turn>\n" +
+				"<start_of_turn>model\n",
+		},
+		{
+			name:      "phi 3",
+			template:  phi3Template,
+			variables: map[string]any{"messages": withSystem, "eos_token": "<|endoftext|>", "add_generation_prompt": true},
+			expected: "<|system|>\nYou are a pirate.<|end|>\n<|user|>\n Hello! <|end|>\n" +
+				"<|assistant|>\nAhoy!<|end|>\n<|user|>\nWhere is the treasure?<|end|>\n<|assistant|>\n",
+		},
+		{
+			name:      "phi 3 without generation prompt",
+			template:  phi3Template,
+			variables: map[string]any{"messages": chat[:2], "eos_token": "<|endoftext|>", "add_generation_prompt": false},
+			expected:  "<|user|>\n Hello! <|end|>\n<|assistant|>\nAhoy!<|end|>\n<|endoftext|>",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template, err := ParseChatTemplate(test.template)
+			check(t, err)
+			rendered, err := template.Render(test.variables)
+			check(t, err)
+			assert.Equal(t, test.expected, rendered)
+		})
+	}
+}
+
+func TestChatTemplateExceptions(t *testing.T) {
+	system := map[string]any{"role": "system", "content": "You are a pirate."}
+	user := map[string]any{"role": "user", "content": "Hello"}
+
+	tests := []struct {
+		name     string
+		template string
+		messages []any
+		expected string
+	}{
+		{name: "mistral system prompt", template: mistralTemplate, messages: []any{system, user}, expected: "Conversation roles must alternate"},
+		{name: "mistral roles", template: mistralTemplate, messages: []any{user, user}, expected: "Conversation roles must alternate"},
+		{name: "gemma system prompt", template: gemmaTemplate, messages: []any{system, user}, expected: "System role not supported"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template, err := ParseChatTemplate(test.template)
+			check(t, err)
+			_, err = template.Render(map[string]any{"messages": test.messages, "bos_token": "<s>", "eos_token": "</s>"})
+			assert.ErrorContains(t, err, test.expected)
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	numberWords = map[string]int{
+		"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+		"seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+	}
+	weekdays = map[string]time.Weekday{
+		"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+		"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+	}
+	months = map[string]time.Month{
+		"january": time.January, "february": time.February, "march": time.March, "april": time.April,
+		"may": time.May, "june": time.June, "july": time.July, "august": time.August,
+		"september": time.September, "october": time.October, "november": time.November, "december": time.December,
+		"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April, "jun": time.June,
+		"jul": time.July, "aug": time.August, "sep": time.September, "sept": time.September, "oct": time.October,
+		"nov": time.November, "dec": time.December,
+	}
+
+	relativeOffsetRegexp = regexp.MustCompile(`^(?:in\s+)?(\d+|[a-z]+)\s+(day|week|month|year)s?(\s+ago|\s+from\s+now|\s+later)?$`)
+	relativeUnitRegexp   = regexp.MustCompile(`^(next|last|this|previous|coming)\s+(day|week|month|year)$`)
+	relativeDayRegexp    = regexp.MustCompile(`^(?:(next|last|this|previous|coming)\s+)?([a-z]+)$`)
+	monthDayRegexp       = regexp.MustCompile(`^([a-z]+)\.?\s+(\d{1,2})(?:st|nd|rd|th)?(?:,?\s+(\d{4}))?$`)
+	dayMonthRegexp       = regexp.MustCompile(`^(\d{1,2})(?:st|nd|rd|th)?\s+(?:of\s+)?([a-z]+)\.?(?:,?\s+(\d{4}))?$`)
+	monthYearRegexp      = regexp.MustCompile(`^([a-z]+)\.?\s+(\d{4})$`)
+	isoDateRegexp        = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})$`)
+	yearRegexp           = regexp.MustCompile(`^(\d{4})$`)
+)
+
+// NormalizeTemporalExpression converts a temporal expression such as "next Tuesday", "in 3 days", "last month" or
+// "May 1st" to an ISO 8601 value, resolving relative expressions against the reference time. Days are normalized
+// to dates (2006-01-02), weeks to ISO weeks (2006-W01), months to 2006-01 and years to 2006. It returns false if
+// the expression is not recognized.
+func NormalizeTemporalExpression(expression string, reference time.Time) (string, bool) {
+	e := strings.Join(strings.Fields(strings.ToLower(strings.Trim(expression, " .,;:!?"))), " ")
+	e = strings.TrimPrefix(strings.TrimPrefix(e, "on "), "the ")
+	today := time.Date(reference.Year(), reference.Month(), reference.Day(), 0, 0, 0, 0, reference.Location())
+
+	switch e {
+	case "today", "tonight", "this morning", "this afternoon", "this evening", "now":
+		return formatDay(today), true
+	case "tomorrow", "tomorrow morning", "tomorrow night":
+		return formatDay(today.AddDate(0, 0, 1)), true
+	case "yesterday", "last night":
+		return formatDay(today.AddDate(0, 0, -1)), true
+	case "day after tomorrow":
+		return formatDay(today.AddDate(0, 0, 2)), true
+	case "day before yesterday":
+		return formatDay(today.AddDate(0, 0, -2)), true
+	}
+
+	if m := isoDateRegexp.FindStringSubmatch(e); m != nil {
+		if t, err := time.Parse("2006-01-02", e); err == nil {
+			return formatDay(t), true
+		}
+		return "", false
+	}
+	if m := yearRegexp.FindStringSubmatch(e); m != nil {
+		return m[1], true
+	}
+	if m := relativeOffsetRegexp.FindStringSubmatch(e); m != nil {
+		if n, ok := parseCount(m[1]); ok {
+			if strings.TrimSpace(m[3]) == "ago" {
+				n = -n
+			} else if m[3] == "" && !strings.HasPrefix(e, "in ") {
+				// e.g. "three days" without a direction is a duration, not a point in time
+				return "", false
+			}
+			return shift(today, m[2], n), true
+		}
+	}
+	if m := relativeUnitRegexp.FindStringSubmatch(e); m != nil {
+		n := 0
+		switch m[1] {
+		case "next", "coming":
+			n = 1
+		case "last", "previous":
+			n = -1
+		}
+		return shift(today, m[2], n), true
+	}
+	if m := relativeDayRegexp.FindStringSubmatch(e); m != nil {
+		weekday, ok := weekdays[m[2]]
+		if !ok {
+			if month, isMonth := months[m[2]]; isMonth && m[1] == "" {
+				return fmt.Sprintf("%04d-%02d", today.Year(), month), true
+			}
+			return "", false
+		}
+		return formatDay(resolveWeekday(today, weekday, m[1])), true
+	}
+	if m := monthYearRegexp.FindStringSubmatch(e); m != nil {
+		if month, ok := months[m[1]]; ok {
+			year, _ := strconv.Atoi(m[2])
+			return fmt.Sprintf("%04d-%02d", year, month), true
+		}
+	}
+	monthName, dayText, yearText := "", "", ""
+	if m := monthDayRegexp.FindStringSubmatch(e); m != nil {
+		monthName, dayText, yearText = m[1], m[2], m[3]
+	} else if m := dayMonthRegexp.FindStringSubmatch(e); m != nil {
+		monthName, dayText, yearText = m[2], m[1], m[3]
+	}
+	if month, ok := months[monthName]; ok {
+		day, _ := strconv.Atoi(dayText)
+		year := today.Year()
+		if yearText != "" {
+			year, _ = strconv.Atoi(yearText)
+		}
+		t := time.Date(year, month, day, 0, 0, 0, 0, today.Location())
+		if t.Month() != month {
+			return "", false // e.g. February 30
+		}
+		return formatDay(t), true
+	}
+	return "", false
+}
+
+func formatDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func parseCount(text string) (int, bool) {
+	if n, ok := numberWords[text]; ok {
+		return n, true
+	}
+	n, err := strconv.Atoi(text)
+	return n, err == nil
+}
+
+// shift moves the reference day by n units and formats the result at the precision of the unit.
+func shift(today time.Time, unit string, n int) string {
+	switch unit {
+	case "day":
+		return formatDay(today.AddDate(0, 0, n))
+	case "week":
+		year, week := today.AddDate(0, 0, 7*n).ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case "month":
+		t := time.Date(today.Year(), today.Month()+time.Month(n), 1, 0, 0, 0, 0, today.Location())
+		return t.Format("2006-01")
+	default:
+		return strconv.Itoa(today.Year() + n)
+	}
+}
+
+// resolveWeekday finds the date of a weekday relative to today. A bare weekday or "this"/"coming" weekday
+// is its next occurrence from today included, "next" is its next occurrence after today, and "last" is its
+// most recent occurrence before today.
+func resolveWeekday(today time.Time, weekday time.Weekday, modifier string) time.Time {
+	daysAhead := (int(weekday) - int(today.Weekday()) + 7) % 7
+	switch modifier {
+	case "last", "previous":
+		daysBack := (int(today.Weekday()) - int(weekday) + 7) % 7
+		if daysBack == 0 {
+			daysBack = 7
+		}
+		return today.AddDate(0, 0, -daysBack)
+	case "next":
+		if daysAhead == 0 {
+			daysAhead = 7
+		}
+		return today.AddDate(0, 0, daysAhead)
+	default:
+		return today.AddDate(0, 0, daysAhead)
+	}
+}
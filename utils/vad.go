@@ -0,0 +1,111 @@
+package util
+
+import (
+	"math"
+	"sort"
+)
+
+// AudioSegment is a segment of audio, in seconds from the start of the audio.
+type AudioSegment struct {
+	Start float64
+	End   float64
+}
+
+// VADOptions sets how the speech frames found by voice activity detection are grouped into segments.
+type VADOptions struct {
+	MinSpeech  float64 // seconds, shorter segments are dropped
+	MinSilence float64 // seconds, shorter silences between segments are bridged
+	SpeechPad  float64 // seconds added before and after each segment
+}
+
+// DefaultVADOptions returns the options of Silero VAD: segments of at least 250ms, silences of at least 100ms, and
+// 30ms of padding.
+func DefaultVADOptions() VADOptions {
+	return VADOptions{MinSpeech: 0.25, MinSilence: 0.1, SpeechPad: 0.03}
+}
+
+// SpeechSegments groups consecutive speech frames of frameDuration seconds into segments, in audio of duration
+// seconds.
+func SpeechSegments(speech []bool, frameDuration float64, duration float64, options VADOptions) []AudioSegment {
+	var segments []AudioSegment
+	start := -1
+	for i := 0; i <= len(speech); i++ {
+		isSpeech := i < len(speech) && speech[i]
+		switch {
+		case isSpeech && start < 0:
+			start = i
+		case !isSpeech && start >= 0:
+			segment := AudioSegment{Start: float64(start) * frameDuration, End: min(float64(i)*frameDuration, duration)}
+			if n := len(segments); n > 0 && segment.Start-segments[n-1].End < options.MinSilence {
+				segments[n-1].End = segment.End
+			} else {
+				segments = append(segments, segment)
+			}
+			start = -1
+		}
+	}
+	var kept []AudioSegment
+	for _, segment := range segments {
+		if segment.End-segment.Start < options.MinSpeech {
+			continue
+		}
+		segment.Start = max(0, segment.Start-options.SpeechPad)
+		segment.End = min(duration, segment.End+options.SpeechPad)
+		if n := len(kept); n > 0 && segment.Start <= kept[n-1].End {
+			kept[n-1].End = segment.End
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	return kept
+}
+
+// MergeSegments merges consecutive segments, along with the audio between them, as long as the merged segments are
+// at most maxDuration seconds long, e.g. to fill the 30 seconds windows of Whisper. Longer segments are kept as
+// they are.
+func MergeSegments(segments []AudioSegment, maxDuration float64) []AudioSegment {
+	var merged []AudioSegment
+	for _, segment := range segments {
+		if n := len(merged); n > 0 && segment.End-merged[n-1].Start <= maxDuration {
+			merged[n-1].End = segment.End
+			continue
+		}
+		merged = append(merged, segment)
+	}
+	return merged
+}
+
+// FrameEnergies returns the energy of each frame of frameSize samples in dB relative to full scale, -100 for
+// silence.
+func FrameEnergies(samples []float32, frameSize int) []float64 {
+	energies := make([]float64, 0, len(samples)/frameSize+1)
+	for start := 0; start < len(samples); start += frameSize {
+		frame := samples[start:min(start+frameSize, len(samples))]
+		var sum float64
+		for _, sample := range frame {
+			sum += float64(sample) * float64(sample)
+		}
+		energies = append(energies, 10*math.Log10(sum/float64(len(frame))+1e-10))
+	}
+	return energies
+}
+
+// DetectSpeechEnergy finds the segments of speech of mono audio from the energy of its frames of 30ms. A frame is
+// speech when its energy is at least thresholdDB above the noise floor, estimated as the 10th percentile of the
+// energies of the frames, and above -55 dB so that the noise of silent recordings is not speech.
+func DetectSpeechEnergy(samples []float32, sampleRate int, thresholdDB float64, options VADOptions) []AudioSegment {
+	frameSize := max(1, sampleRate*30/1000)
+	energies := FrameEnergies(samples, frameSize)
+	if len(energies) == 0 {
+		return nil
+	}
+	sorted := append([]float64(nil), energies...)
+	sort.Float64s(sorted)
+	threshold := max(sorted[len(sorted)/10]+thresholdDB, -55)
+	speech := make([]bool, len(energies))
+	for i, energy := range energies {
+		speech[i] = energy >= threshold
+	}
+	duration := float64(len(samples)) / float64(sampleRate)
+	return SpeechSegments(speech, float64(frameSize)/float64(sampleRate), duration, options)
+}
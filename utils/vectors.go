@@ -33,6 +33,21 @@ func SoftMax(vector []float32) []float32 {
 	return scores
 }
 
+// SoftMax64 is like SoftMax, but computes and returns the scores in float64, so that the scores of logits near
+// saturation, which round to the same float32, stay distinct.
+func SoftMax64(vector []float32) []float64 {
+	maxLogit := float64(slices.Max(vector))
+	scores := make([]float64, len(vector))
+	for i, logit := range vector {
+		scores[i] = math.Exp(float64(logit) - maxLogit)
+	}
+	sumExp := SumSlice(scores)
+	for i := range scores {
+		scores[i] /= sumExp
+	}
+	return scores
+}
+
 func SumSlice(s []float64) float64 {
 	sum := 0.0
 	for _, v := range s {
@@ -42,7 +57,7 @@ func SumSlice(s []float64) float64 {
 }
 
 // ArgMax find both index of max value in s and max value.
-func ArgMax(s []float32) (int, float32, error) {
+func ArgMax[T float32 | float64](s []T) (int, T, error) {
 	if len(s) == 0 {
 		return 0, 0, fmt.Errorf("attempted to calculate argmax of empty slice")
 	}
@@ -67,6 +82,15 @@ func Sigmoid(s []float32) []float32 {
 	return sigmoid
 }
 
+// Sigmoid64 is like Sigmoid, but returns the scores in float64.
+func Sigmoid64(s []float32) []float64 {
+	sigmoid := make([]float64, len(s))
+	for i, v := range s {
+		sigmoid[i] = 1.0 / (1.0 + math.Exp(-float64(v)))
+	}
+	return sigmoid
+}
+
 // Norm of a vector.
 func Norm(v []float32, p int) float64 {
 	sum := 0.0
@@ -89,3 +113,125 @@ func Normalize(embedding []float32, p int) []float32 {
 	}
 	return embedding
 }
+
+// Normalize64 is like Normalize with p = 2, for a float64 vector.
+func Normalize64(embedding []float64) []float64 {
+	sum := 0.0
+	for _, v := range embedding {
+		sum += v * v
+	}
+	normalizeDenominator := max(math.Sqrt(sum), 1e-12)
+	for i, v := range embedding {
+		embedding[i] = v / normalizeDenominator
+	}
+	return embedding
+}
+
+// ToFloat64 returns a float64 copy of a float32 vector.
+func ToFloat64(v []float32) []float64 {
+	converted := make([]float64, len(v))
+	for i, value := range v {
+		converted[i] = float64(value)
+	}
+	return converted
+}
+
+// ToFloat32 returns a float32 copy of a float64 vector.
+func ToFloat32(v []float64) []float32 {
+	converted := make([]float32, len(v))
+	for i, value := range v {
+		converted[i] = float32(value)
+	}
+	return converted
+}
+
+// Add returns the sum of two vectors of the same length.
+func Add(a []float32, b []float32) ([]float32, error) {
+	if len(a) != len(b) {
+		return nil, fmt.Errorf("cannot add vectors of dimension %d and %d", len(a), len(b))
+	}
+	sum := make([]float32, len(a))
+	for i := range a {
+		sum[i] = a[i] + b[i]
+	}
+	return sum, nil
+}
+
+// Subtract returns a - b for two vectors of the same length, e.g. the direction from the centroid of a general
+// corpus to the centroid of a domain corpus.
+func Subtract(a []float32, b []float32) ([]float32, error) {
+	if len(a) != len(b) {
+		return nil, fmt.Errorf("cannot subtract vectors of dimension %d and %d", len(a), len(b))
+	}
+	difference := make([]float32, len(a))
+	for i := range a {
+		difference[i] = a[i] - b[i]
+	}
+	return difference, nil
+}
+
+// Scale returns the vector multiplied by a scalar.
+func Scale(v []float32, factor float32) []float32 {
+	scaled := make([]float32, len(v))
+	for i, e := range v {
+		scaled[i] = e * factor
+	}
+	return scaled
+}
+
+// Centroid returns the mean of vectors of the same length.
+func Centroid(vectors [][]float32) ([]float32, error) {
+	return WeightedAverage(vectors, nil)
+}
+
+// WeightedAverage returns the average of vectors of the same length weighted by weights, e.g. the embedding of a
+// document from the embeddings of its chunks weighted by their length. With nil weights, all vectors have the same
+// weight. The weights must not be negative and must not sum to zero.
+func WeightedAverage(vectors [][]float32, weights []float32) ([]float32, error) {
+	if len(vectors) == 0 {
+		return nil, fmt.Errorf("cannot average an empty set of vectors")
+	}
+	if weights != nil && len(weights) != len(vectors) {
+		return nil, fmt.Errorf("got %d weights for %d vectors", len(weights), len(vectors))
+	}
+	average := make([]float64, len(vectors[0]))
+	totalWeight := 0.0
+	for i, vector := range vectors {
+		if len(vector) != len(average) {
+			return nil, fmt.Errorf("cannot average vectors of dimension %d and %d", len(average), len(vector))
+		}
+		weight := 1.0
+		if weights != nil {
+			weight = float64(weights[i])
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("weight %d is negative", i)
+		}
+		totalWeight += weight
+		for j, e := range vector {
+			average[j] += weight * float64(e)
+		}
+	}
+	if totalWeight == 0 {
+		return nil, fmt.Errorf("the weights sum to zero")
+	}
+	result := make([]float32, len(average))
+	for j, sum := range average {
+		result[j] = float32(sum / totalWeight)
+	}
+	return result, nil
+}
+
+// RemoveProjection returns the vector with its projection on direction removed, i.e. the component of the vector
+// orthogonal to direction, e.g. to remove a domain or language direction shared by all the embeddings of a corpus
+// before clustering or deduplicating them. The result is not normalized.
+func RemoveProjection(v []float32, direction []float32) ([]float32, error) {
+	if len(v) != len(direction) {
+		return nil, fmt.Errorf("cannot project a vector of dimension %d on a direction of dimension %d", len(v), len(direction))
+	}
+	squaredNorm := Dot(direction, direction)
+	if squaredNorm == 0 {
+		return nil, fmt.Errorf("cannot project on a zero direction")
+	}
+	return Subtract(v, Scale(direction, Dot(v, direction)/squaredNorm))
+}
@@ -0,0 +1,275 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"time"
+)
+
+// VideoFrame is a decoded frame of a video.
+type VideoFrame struct {
+	Index int           // position of the frame in the video, from 0
+	Time  time.Duration // time of the frame from the start of the video, 0 if the frame rate is unknown
+	Image image.Image
+}
+
+// FrameReader reads the frames of a video in order. ReadFrame returns io.EOF after the last frame.
+type FrameReader interface {
+	ReadFrame() (*VideoFrame, error)
+}
+
+// frameTime returns the time of a frame at a frame rate, or 0 if the frame rate is not positive.
+func frameTime(index int, frameRate float64) time.Duration {
+	if frameRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(index) / frameRate * float64(time.Second))
+}
+
+type mjpegReader struct {
+	reader    *bufio.Reader
+	frameRate float64
+	index     int
+}
+
+// NewMJPEGReader reads the frames of a Motion JPEG stream, i.e. of JPEG images one after the other, at frameRate
+// frames per second. Videos in other formats, such as H.264 in MP4, are not decoded by hugot, as their decoders
+// would add dependencies: convert them to Motion JPEG with an external tool, e.g. by piping the output of
+// `ffmpeg -i video.mp4 -f mjpeg -q:v 3 -`, which can also sample the frames with `-vf fps=1`. The streams of
+// IP cameras are often Motion JPEG, and any bytes between the images, such as multipart headers, are skipped.
+func NewMJPEGReader(reader io.Reader, frameRate float64) FrameReader {
+	return &mjpegReader{reader: bufio.NewReader(reader), frameRate: frameRate}
+}
+
+// ReadFrame reads and decodes the next JPEG image of the stream.
+func (m *mjpegReader) ReadFrame() (*VideoFrame, error) {
+	data, err := readJPEG(m.reader)
+	if err != nil {
+		return nil, err
+	}
+	img, err := DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode frame %d: %w", m.index, err)
+	}
+	frame := &VideoFrame{Index: m.index, Time: frameTime(m.index, m.frameRate), Image: img}
+	m.index++
+	return frame, nil
+}
+
+// readJPEG reads the bytes of the next JPEG image of a stream, from its start of image marker to its end of image
+// marker. The segments are read by their length and the entropy-coded data up to the next marker, so that the end
+// of image markers of embedded thumbnails do not end the image.
+func readJPEG(reader *bufio.Reader) ([]byte, error) {
+	// skip to the start of image marker
+	previous := byte(0)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if previous == 0xFF && b == 0xD8 {
+			break
+		}
+		previous = b
+	}
+	var data bytes.Buffer
+	data.Write([]byte{0xFF, 0xD8})
+	unexpected := func(err error) error {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	marker := byte(0) // a marker already read at the end of entropy-coded data
+	for {
+		if marker == 0 {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return nil, unexpected(err)
+			}
+			if b != 0xFF {
+				return nil, fmt.Errorf("invalid JPEG marker 0x%02X", b)
+			}
+			for b == 0xFF {
+				if b, err = reader.ReadByte(); err != nil {
+					return nil, unexpected(err)
+				}
+			}
+			marker = b
+		}
+		data.Write([]byte{0xFF, marker})
+		switch {
+		case marker == 0xD9:
+			return data.Bytes(), nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			marker = 0
+			continue
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		data.Write(length[:])
+		size := int(length[0])<<8 | int(length[1])
+		if size < 2 {
+			return nil, fmt.Errorf("invalid length %d of JPEG segment 0x%02X", size, marker)
+		}
+		if _, err := io.CopyN(&data, reader, int64(size-2)); err != nil {
+			return nil, unexpected(err)
+		}
+		isScan := marker == 0xDA
+		marker = 0
+		if !isScan {
+			continue
+		}
+		// the entropy-coded data of a scan ends at the first marker other than a restart marker, where 0xFF bytes
+		// of the data are followed by 0x00
+		for marker == 0 {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return nil, unexpected(err)
+			}
+			if b != 0xFF {
+				data.WriteByte(b)
+				continue
+			}
+			next, err := reader.ReadByte()
+			for err == nil && next == 0xFF {
+				next, err = reader.ReadByte()
+			}
+			if err != nil {
+				return nil, unexpected(err)
+			}
+			if next == 0x00 || (next >= 0xD0 && next <= 0xD7) {
+				data.Write([]byte{0xFF, next})
+				continue
+			}
+			marker = next
+		}
+	}
+}
+
+type imageSequenceReader struct {
+	paths     []string
+	frameRate float64
+	index     int
+}
+
+// NewImageSequenceReader reads the frames of a video from image files, in the formats supported by DecodeImage,
+// such as the frames extracted by `ffmpeg -i video.mp4 frames/%06d.png`, at frameRate frames per second.
+func NewImageSequenceReader(paths []string, frameRate float64) FrameReader {
+	return &imageSequenceReader{paths: paths, frameRate: frameRate}
+}
+
+// ReadFrame reads and decodes the next image file.
+func (s *imageSequenceReader) ReadFrame() (*VideoFrame, error) {
+	if s.index >= len(s.paths) {
+		return nil, io.EOF
+	}
+	data, err := ReadFileBytes(s.paths[s.index])
+	if err != nil {
+		return nil, err
+	}
+	img, err := DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode frame %s: %w", s.paths[s.index], err)
+	}
+	frame := &VideoFrame{Index: s.index, Time: frameTime(s.index, s.frameRate), Image: img}
+	s.index++
+	return frame, nil
+}
+
+// FrameSelector selects the frames of a video that are sampled, e.g. to be classified. It is called on each frame
+// of a video in order, and may keep state between frames, so a selector must be used for a single video.
+type FrameSelector interface {
+	SelectFrame(frame *VideoFrame) bool
+}
+
+type everyNthFrame int
+
+// EveryNthFrame selects the first frame of a video and then one frame every n frames.
+func EveryNthFrame(n int) FrameSelector {
+	return everyNthFrame(max(n, 1))
+}
+
+func (n everyNthFrame) SelectFrame(frame *VideoFrame) bool {
+	return frame.Index%int(n) == 0
+}
+
+type everyInterval struct {
+	interval time.Duration
+	next     time.Duration
+	started  bool
+}
+
+// EveryInterval selects the first frame of a video and then the first frame after each interval of time, e.g. one
+// frame per second whatever the frame rate. The frames must have times, i.e. be read with a frame rate.
+func EveryInterval(interval time.Duration) FrameSelector {
+	return &everyInterval{interval: interval}
+}
+
+func (e *everyInterval) SelectFrame(frame *VideoFrame) bool {
+	if e.started && frame.Time < e.next {
+		return false
+	}
+	e.started = true
+	e.next = frame.Time + e.interval
+	return true
+}
+
+type sceneChanges struct {
+	threshold float64
+	previous  []float64
+}
+
+// SceneChanges selects the first frame of a video and the frames that start a new scene, whose color histogram
+// differs from the one of the previous frame by more than the threshold. The difference is the total variation
+// distance between the histograms, from 0 for frames with the same colors to 1 for frames without colors in
+// common, and cuts between scenes usually differ by more than 0.3. Histograms ignore the motion within a scene.
+func SceneChanges(threshold float64) FrameSelector {
+	return &sceneChanges{threshold: threshold}
+}
+
+func (s *sceneChanges) SelectFrame(frame *VideoFrame) bool {
+	histogram := colorHistogram(frame.Image)
+	previous := s.previous
+	s.previous = histogram
+	if previous == nil {
+		return true
+	}
+	distance := 0.0
+	for i := range histogram {
+		distance += math.Abs(histogram[i] - previous[i])
+	}
+	return distance/2 > s.threshold
+}
+
+// colorHistogram returns the normalized histogram of the colors of an image, with 4 bins per channel, from a grid
+// of up to 64x64 pixels.
+func colorHistogram(img image.Image) []float64 {
+	histogram := make([]float64, 64)
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return histogram
+	}
+	stepX := max(1, bounds.Dx()/64)
+	stepY := max(1, bounds.Dy()/64)
+	total := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			histogram[(r>>14)*16+(g>>14)*4+b>>14]++
+			total++
+		}
+	}
+	for i := range histogram {
+		histogram[i] /= total
+	}
+	return histogram
+}
@@ -0,0 +1,162 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type vocabularyJSON struct {
+	Model struct {
+		Type  string          `json:"type"`
+		Vocab json.RawMessage `json:"vocab"`
+	} `json:"model"`
+	AddedTokens []struct {
+		ID      uint32 `json:"id"`
+		Content string `json:"content"`
+		Special bool   `json:"special"`
+	} `json:"added_tokens"`
+	Decoder *decoderJSON `json:"decoder"`
+}
+
+type decoderJSON struct {
+	Type     string         `json:"type"`
+	Prefix   string         `json:"prefix"`
+	Decoders []*decoderJSON `json:"decoders"`
+}
+
+// LoadVocabulary reads the vocabulary of a tokenizer from the content of its tokenizer.json file, and returns
+// the token of each token id, including the added tokens such as [MASK] or <mask>. Tokens are returned as they
+// are stored in the vocabulary, e.g. with the ## prefix of WordPiece continuation tokens or the Ġ space marker of
+// byte-level BPE tokens, and ids without a token are empty. The WordPiece, BPE, WordLevel and Unigram models are supported.
+func LoadVocabulary(tokenizerBytes []byte) ([]string, error) {
+	config := vocabularyJSON{}
+	if err := json.Unmarshal(tokenizerBytes, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Model.Vocab) == 0 {
+		return nil, errors.New("the tokenizer has no vocabulary")
+	}
+	tokens := map[uint32]string{}
+	switch config.Model.Type {
+	case "Unigram":
+		// a list of [token, score] pairs, the id of a token is its index
+		var entries [][]any
+		if err := json.Unmarshal(config.Model.Vocab, &entries); err != nil {
+			return nil, fmt.Errorf("cannot read the Unigram vocabulary: %w", err)
+		}
+		for id, entry := range entries {
+			if len(entry) == 0 {
+				return nil, fmt.Errorf("vocabulary entry %d has no token", id)
+			}
+			token, ok := entry[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("vocabulary entry %d has no token", id)
+			}
+			tokens[uint32(id)] = token
+		}
+	default:
+		var vocab map[string]uint32
+		if err := json.Unmarshal(config.Model.Vocab, &vocab); err != nil {
+			return nil, fmt.Errorf("cannot read the %s vocabulary: %w", config.Model.Type, err)
+		}
+		for token, id := range vocab {
+			tokens[id] = token
+		}
+	}
+	for _, added := range config.AddedTokens {
+		tokens[added.ID] = added.Content
+	}
+
+	size := uint32(0)
+	for id := range tokens {
+		size = max(size, id+1)
+	}
+	vocabulary := make([]string, size)
+	for id, token := range tokens {
+		vocabulary[id] = token
+	}
+	return vocabulary, nil
+}
+
+// TokenBytes reads the vocabulary of a tokenizer from the content of its tokenizer.json file, and returns the bytes
+// that each token id adds to a decoded text, according to the decoder of the tokenizer: the bytes of byte-level BPE
+// tokens, the ▁ space marker of SentencePiece tokens as a space and their <0x0A> byte tokens as the byte, and a
+// space before WordPiece tokens that do not start with the continuation prefix. The bytes of a token may not be
+// valid UTF-8, e.g. for byte-level BPE tokens that are a part of a character. Special tokens, which are skipped
+// when decoding, have no bytes. The spaces that decoders strip at the start of a text are kept.
+func TokenBytes(tokenizerBytes []byte) ([][]byte, error) {
+	vocabulary, err := LoadVocabulary(tokenizerBytes)
+	if err != nil {
+		return nil, err
+	}
+	config := vocabularyJSON{}
+	if err = json.Unmarshal(tokenizerBytes, &config); err != nil {
+		return nil, err
+	}
+	decoders := map[string]*decoderJSON{}
+	var collect func(decoder *decoderJSON)
+	collect = func(decoder *decoderJSON) {
+		if decoder == nil {
+			return
+		}
+		decoders[decoder.Type] = decoder
+		for _, child := range decoder.Decoders {
+			collect(child)
+		}
+	}
+	collect(config.Decoder)
+
+	// byte-level BPE maps each byte to a printable character, the printable ASCII and Latin-1 characters to
+	// themselves and the others to the characters from U+0100 in order
+	byteLevel := map[rune]byte{}
+	shifted := rune(256)
+	for b := 0; b < 256; b++ {
+		if (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || b >= 0xAE {
+			byteLevel[rune(b)] = byte(b)
+		} else {
+			byteLevel[shifted] = byte(b)
+			shifted++
+		}
+	}
+
+	tokens := make([][]byte, len(vocabulary))
+	for id, token := range vocabulary {
+		switch {
+		case token == "":
+		case decoders["ByteLevel"] != nil:
+			for _, r := range token {
+				b, ok := byteLevel[r]
+				if !ok {
+					return nil, fmt.Errorf("token %d is not a byte-level token: %q", id, token)
+				}
+				tokens[id] = append(tokens[id], b)
+			}
+		case decoders["WordPiece"] != nil:
+			prefix := decoders["WordPiece"].Prefix
+			if prefix != "" && strings.HasPrefix(token, prefix) {
+				tokens[id] = []byte(strings.TrimPrefix(token, prefix))
+			} else {
+				tokens[id] = []byte(" " + token)
+			}
+		default:
+			if decoders["ByteFallback"] != nil && len(token) == 6 && strings.HasPrefix(token, "<0x") && strings.HasSuffix(token, ">") {
+				if b, parseErr := strconv.ParseUint(token[3:5], 16, 8); parseErr == nil {
+					tokens[id] = []byte{byte(b)}
+					continue
+				}
+			}
+			tokens[id] = []byte(strings.ReplaceAll(token, "▁", " "))
+		}
+	}
+	for _, added := range config.AddedTokens {
+		if added.Special {
+			tokens[added.ID] = nil
+		} else {
+			tokens[added.ID] = []byte(added.Content)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,355 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// WordPieceTokenizer is a pure Go implementation of the WordPiece tokenizers of BERT-like models (BERT, DistilBERT,
+// MiniLM, ...), loaded from their tokenizer.json. Unlike the pipelines' tokenizer, it does not need cgo, so it
+// can be compiled to WebAssembly to share hugot's token counting and chunking with browsers and edge functions.
+// It only supports the BertNormalizer and BertPreTokenizer, and strips accents from Latin characters only.
+type WordPieceTokenizer struct {
+	vocab                map[string]uint32
+	unknownToken         string
+	continuingPrefix     string
+	maxInputCharsPerWord int
+	cleanText            bool
+	handleChineseChars   bool
+	lowercase            bool
+	stripAccents         bool
+	prefixTokens         []WordPieceToken // special tokens added before a sequence, e.g. [CLS]
+	suffixTokens         []WordPieceToken // special tokens added after a sequence, e.g. [SEP]
+}
+
+// WordPieceToken is a token of a text, with the byte offsets of the text it comes from.
+// Special tokens have empty offsets.
+type WordPieceToken struct {
+	ID    uint32
+	Token string
+	Start int
+	End   int
+}
+
+type tokenizerJSON struct {
+	Normalizer *struct {
+		Type               string `json:"type"`
+		CleanText          bool   `json:"clean_text"`
+		HandleChineseChars bool   `json:"handle_chinese_chars"`
+		StripAccents       *bool  `json:"strip_accents"`
+		Lowercase          bool   `json:"lowercase"`
+	} `json:"normalizer"`
+	PreTokenizer *struct {
+		Type string `json:"type"`
+	} `json:"pre_tokenizer"`
+	Model struct {
+		Type                    string            `json:"type"`
+		UnknownToken            string            `json:"unk_token"`
+		ContinuingSubwordPrefix string            `json:"continuing_subword_prefix"`
+		MaxInputCharsPerWord    int               `json:"max_input_chars_per_word"`
+		Vocab                   map[string]uint32 `json:"vocab"`
+	} `json:"model"`
+	PostProcessor *struct {
+		Type   string `json:"type"`
+		CLS    []any  `json:"cls"`
+		SEP    []any  `json:"sep"`
+		Single []struct {
+			SpecialToken *struct {
+				ID string `json:"id"`
+			} `json:"SpecialToken"`
+			Sequence *struct {
+				ID string `json:"id"`
+			} `json:"Sequence"`
+		} `json:"single"`
+		SpecialTokens map[string]struct {
+			IDs    []uint32 `json:"ids"`
+			Tokens []string `json:"tokens"`
+		} `json:"special_tokens"`
+	} `json:"post_processor"`
+}
+
+// NewWordPieceTokenizer loads a WordPiece tokenizer from the content of a tokenizer.json file.
+func NewWordPieceTokenizer(tokenizerBytes []byte) (*WordPieceTokenizer, error) {
+	config := tokenizerJSON{}
+	if err := json.Unmarshal(tokenizerBytes, &config); err != nil {
+		return nil, err
+	}
+	if config.Model.Type != "WordPiece" {
+		return nil, fmt.Errorf("tokenizer model %s is not supported, only WordPiece is", config.Model.Type)
+	}
+	t := &WordPieceTokenizer{
+		vocab:                config.Model.Vocab,
+		unknownToken:         config.Model.UnknownToken,
+		continuingPrefix:     config.Model.ContinuingSubwordPrefix,
+		maxInputCharsPerWord: config.Model.MaxInputCharsPerWord,
+	}
+	if t.maxInputCharsPerWord <= 0 {
+		t.maxInputCharsPerWord = 100
+	}
+	if _, ok := t.vocab[t.unknownToken]; !ok {
+		return nil, fmt.Errorf("unknown token %s is not in the vocabulary", t.unknownToken)
+	}
+
+	if config.Normalizer != nil {
+		if config.Normalizer.Type != "BertNormalizer" {
+			return nil, fmt.Errorf("normalizer %s is not supported, only BertNormalizer is", config.Normalizer.Type)
+		}
+		t.cleanText = config.Normalizer.CleanText
+		t.handleChineseChars = config.Normalizer.HandleChineseChars
+		t.lowercase = config.Normalizer.Lowercase
+		t.stripAccents = config.Normalizer.Lowercase
+		if config.Normalizer.StripAccents != nil {
+			t.stripAccents = *config.Normalizer.StripAccents
+		}
+	}
+	if config.PreTokenizer != nil && config.PreTokenizer.Type != "BertPreTokenizer" {
+		return nil, fmt.Errorf("pre-tokenizer %s is not supported, only BertPreTokenizer is", config.PreTokenizer.Type)
+	}
+
+	if processor := config.PostProcessor; processor != nil {
+		switch processor.Type {
+		case "BertProcessing", "RobertaProcessing":
+			cls, err := specialTokenPair(processor.CLS)
+			if err != nil {
+				return nil, err
+			}
+			sep, err := specialTokenPair(processor.SEP)
+			if err != nil {
+				return nil, err
+			}
+			t.prefixTokens = []WordPieceToken{cls}
+			t.suffixTokens = []WordPieceToken{sep}
+		case "TemplateProcessing":
+			sequenceSeen := false
+			for _, piece := range processor.Single {
+				if piece.Sequence != nil {
+					sequenceSeen = true
+					continue
+				}
+				if piece.SpecialToken == nil {
+					continue
+				}
+				special, ok := processor.SpecialTokens[piece.SpecialToken.ID]
+				if !ok || len(special.IDs) != len(special.Tokens) {
+					return nil, fmt.Errorf("special token %s of the post-processor is not defined", piece.SpecialToken.ID)
+				}
+				for i, id := range special.IDs {
+					token := WordPieceToken{ID: id, Token: special.Tokens[i]}
+					if sequenceSeen {
+						t.suffixTokens = append(t.suffixTokens, token)
+					} else {
+						t.prefixTokens = append(t.prefixTokens, token)
+					}
+				}
+			}
+		default:
+			return nil, fmt.Errorf("post-processor %s is not supported", processor.Type)
+		}
+	}
+	return t, nil
+}
+
+// specialTokenPair parses a [token, id] pair of a BertProcessing post-processor.
+func specialTokenPair(pair []any) (WordPieceToken, error) {
+	if len(pair) != 2 {
+		return WordPieceToken{}, errors.New("invalid special token in post-processor")
+	}
+	token, ok := pair[0].(string)
+	id, okID := pair[1].(float64)
+	if !ok || !okID {
+		return WordPieceToken{}, errors.New("invalid special token in post-processor")
+	}
+	return WordPieceToken{ID: uint32(id), Token: token}, nil
+}
+
+// Tokenize splits text into tokens, without special tokens.
+func (t *WordPieceTokenizer) Tokenize(text string) []WordPieceToken {
+	var tokens []WordPieceToken
+	for _, word := range t.preTokenize(t.normalize(text)) {
+		tokens = append(tokens, t.wordPiece(word)...)
+	}
+	return tokens
+}
+
+// Encode splits text into tokens and adds the special tokens of the model, like the tokenizer of the pipelines.
+func (t *WordPieceTokenizer) Encode(text string) []WordPieceToken {
+	tokens := append([]WordPieceToken{}, t.prefixTokens...)
+	tokens = append(tokens, t.Tokenize(text)...)
+	return append(tokens, t.suffixTokens...)
+}
+
+// Count returns the number of tokens of text, including special tokens.
+func (t *WordPieceTokenizer) Count(text string) int {
+	return len(t.Tokenize(text)) + len(t.prefixTokens) + len(t.suffixTokens)
+}
+
+// Chunk splits text into consecutive chunks of at most maxTokens tokens each, including special tokens,
+// with overlap tokens repeated between consecutive chunks.
+func (t *WordPieceTokenizer) Chunk(text string, maxTokens int, overlap int) ([]string, error) {
+	capacity := maxTokens - len(t.prefixTokens) - len(t.suffixTokens)
+	if capacity <= 0 {
+		return nil, fmt.Errorf("chunks of %d tokens cannot hold the special tokens of the model", maxTokens)
+	}
+	if overlap < 0 || overlap >= capacity {
+		return nil, fmt.Errorf("overlap must be between 0 and %d", capacity-1)
+	}
+	tokens := t.Tokenize(text)
+	var chunks []string
+	for start := 0; start < len(tokens); start += capacity - overlap {
+		end := min(start+capacity, len(tokens))
+		chunks = append(chunks, text[tokens[start].Start:tokens[end-1].End])
+		if end == len(tokens) {
+			break
+		}
+	}
+	return chunks, nil
+}
+
+// normalizedRune is a rune of the normalized text along with the byte offsets of the original text it comes from.
+type normalizedRune struct {
+	r     rune
+	start int
+	end   int
+}
+
+func (t *WordPieceTokenizer) normalize(text string) []normalizedRune {
+	normalized := make([]normalizedRune, 0, len(text))
+	for start, r := range text {
+		end := start + utf8.RuneLen(r)
+		if r == utf8.RuneError {
+			end = start + 1
+		}
+		if t.cleanText {
+			if r == 0 || r == utf8.RuneError || isControl(r) {
+				continue
+			}
+			if isWhitespace(r) {
+				r = ' '
+			}
+		}
+		if t.lowercase {
+			r = unicode.ToLower(r)
+		}
+		if t.stripAccents {
+			if unicode.Is(unicode.Mn, r) {
+				continue
+			}
+			if folded, ok := accentFolding[r]; ok {
+				r = folded
+			}
+		}
+		if t.handleChineseChars && isChinese(r) {
+			normalized = append(normalized, normalizedRune{' ', start, end}, normalizedRune{r, start, end}, normalizedRune{' ', start, end})
+			continue
+		}
+		normalized = append(normalized, normalizedRune{r, start, end})
+	}
+	return normalized
+}
+
+// preTokenize splits the normalized text on whitespace and punctuation, keeping punctuation as separate words.
+func (t *WordPieceTokenizer) preTokenize(text []normalizedRune) [][]normalizedRune {
+	var words [][]normalizedRune
+	wordStart := -1
+	for i, nr := range text {
+		switch {
+		case isWhitespace(nr.r):
+			if wordStart >= 0 {
+				words = append(words, text[wordStart:i])
+				wordStart = -1
+			}
+		case isPunctuation(nr.r):
+			if wordStart >= 0 {
+				words = append(words, text[wordStart:i])
+				wordStart = -1
+			}
+			words = append(words, text[i:i+1])
+		default:
+			if wordStart < 0 {
+				wordStart = i
+			}
+		}
+	}
+	if wordStart >= 0 {
+		words = append(words, text[wordStart:])
+	}
+	return words
+}
+
+// wordPiece splits a word into the longest tokens of the vocabulary, from left to right.
+func (t *WordPieceTokenizer) wordPiece(word []normalizedRune) []WordPieceToken {
+	unknown := []WordPieceToken{{ID: t.vocab[t.unknownToken], Token: t.unknownToken, Start: word[0].start, End: word[len(word)-1].end}}
+	if len(word) > t.maxInputCharsPerWord {
+		return unknown
+	}
+	runes := make([]rune, len(word))
+	for i, nr := range word {
+		runes[i] = nr.r
+	}
+	var tokens []WordPieceToken
+	for start := 0; start < len(runes); {
+		found := false
+		for end := len(runes); end > start; end-- {
+			piece := string(runes[start:end])
+			if start > 0 {
+				piece = t.continuingPrefix + piece
+			}
+			if id, ok := t.vocab[piece]; ok {
+				tokens = append(tokens, WordPieceToken{ID: id, Token: piece, Start: word[start].start, End: word[end-1].end})
+				start = end
+				found = true
+				break
+			}
+		}
+		if !found {
+			return unknown
+		}
+	}
+	return tokens
+}
+
+func isWhitespace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || unicode.Is(unicode.Zs, r)
+}
+
+func isControl(r rune) bool {
+	if r == '\t' || r == '\n' || r == '\r' {
+		return false
+	}
+	return unicode.In(r, unicode.Cc, unicode.Cf)
+}
+
+func isPunctuation(r rune) bool {
+	if (r >= 33 && r <= 47) || (r >= 58 && r <= 64) || (r >= 91 && r <= 96) || (r >= 123 && r <= 126) {
+		return true
+	}
+	return unicode.IsPunct(r)
+}
+
+func isChinese(r rune) bool {
+	return (r >= 0x4E00 && r <= 0x9FFF) || (r >= 0x3400 && r <= 0x4DBF) || (r >= 0x20000 && r <= 0x2A6DF) ||
+		(r >= 0x2A700 && r <= 0x2B73F) || (r >= 0x2B740 && r <= 0x2B81F) || (r >= 0x2B820 && r <= 0x2CEAF) ||
+		(r >= 0xF900 && r <= 0xFAFF) || (r >= 0x2F800 && r <= 0x2FA1F)
+}
+
+// accentFolding maps the accented Latin characters to their unaccented base character, as NFD normalization
+// followed by the removal of combining marks would.
+var accentFolding = func() map[rune]rune {
+	folding := map[rune]rune{}
+	for base, accented := range map[rune]string{
+		'a': "àáâãäåāăą", 'A': "ÀÁÂÃÄÅĀĂĄ", 'c': "çćĉċč", 'C': "ÇĆĈĊČ", 'd': "ď", 'D': "Ď",
+		'e': "èéêëēĕėęě", 'E': "ÈÉÊËĒĔĖĘĚ", 'g': "ĝğġģ", 'G': "ĜĞĠĢ", 'h': "ĥ", 'H': "Ĥ",
+		'i': "ìíîïĩīĭį", 'I': "ÌÍÎÏĨĪĬĮİ", 'j': "ĵ", 'J': "Ĵ", 'k': "ķ", 'K': "Ķ", 'l': "ĺļľ", 'L': "ĹĻĽ",
+		'n': "ñńņň", 'N': "ÑŃŅŇ", 'o': "òóôõöōŏő", 'O': "ÒÓÔÕÖŌŎŐ", 'r': "ŕŗř", 'R': "ŔŖŘ",
+		's': "śŝşš", 'S': "ŚŜŞŠ", 't': "ţť", 'T': "ŢŤ", 'u': "ùúûüũūŭůűų", 'U': "ÙÚÛÜŨŪŬŮŰŲ",
+		'w': "ŵ", 'W': "Ŵ", 'y': "ýÿŷ", 'Y': "ÝŶŸ", 'z': "źżž", 'Z': "ŹŻŽ",
+	} {
+		for _, r := range accented {
+			folding[r] = base
+		}
+	}
+	return folding
+}()
@@ -0,0 +1,74 @@
+//go:build js && wasm
+
+// Package main builds hugot's tokenize, count and chunk helpers to WebAssembly, so that browsers and edge
+// functions can share hugot's preprocessing logic. Model inference needs onnxruntime and is not available.
+//
+// Build it with:
+//
+//	GOOS=js GOARCH=wasm go build -o hugot.wasm ./wasm
+//
+// and load it with the wasm_exec.js support file of your Go installation. This defines a global hugot object
+// with a loadTokenizer(tokenizerJSON) function, which returns a tokenizer with tokenize(text), count(text) and
+// chunk(text, maxTokens, overlap) methods. Errors are returned as objects with an error field.
+package main
+
+import (
+	"syscall/js"
+
+	util "github.com/knights-analytics/hugot/utils"
+)
+
+func main() {
+	js.Global().Set("hugot", js.ValueOf(map[string]any{
+		"loadTokenizer": js.FuncOf(loadTokenizer),
+	}))
+	// keep the Go runtime alive so that the functions remain callable
+	select {}
+}
+
+func loadTokenizer(_ js.Value, args []js.Value) any {
+	if len(args) != 1 {
+		return errorResult("loadTokenizer expects the content of a tokenizer.json file")
+	}
+	tokenizer, err := util.NewWordPieceTokenizer([]byte(args[0].String()))
+	if err != nil {
+		return errorResult(err.Error())
+	}
+	return js.ValueOf(map[string]any{
+		"tokenize": js.FuncOf(func(_ js.Value, args []js.Value) any {
+			if len(args) != 1 {
+				return errorResult("tokenize expects a text")
+			}
+			tokens := tokenizer.Encode(args[0].String())
+			result := make([]any, len(tokens))
+			for i, token := range tokens {
+				result[i] = map[string]any{"id": token.ID, "token": token.Token, "start": token.Start, "end": token.End}
+			}
+			return js.ValueOf(result)
+		}),
+		"count": js.FuncOf(func(_ js.Value, args []js.Value) any {
+			if len(args) != 1 {
+				return errorResult("count expects a text")
+			}
+			return js.ValueOf(tokenizer.Count(args[0].String()))
+		}),
+		"chunk": js.FuncOf(func(_ js.Value, args []js.Value) any {
+			if len(args) != 3 {
+				return errorResult("chunk expects a text, a maximum number of tokens and an overlap")
+			}
+			chunks, chunkErr := tokenizer.Chunk(args[0].String(), args[1].Int(), args[2].Int())
+			if chunkErr != nil {
+				return errorResult(chunkErr.Error())
+			}
+			result := make([]any, len(chunks))
+			for i, chunk := range chunks {
+				result[i] = chunk
+			}
+			return js.ValueOf(result)
+		}),
+	})
+}
+
+func errorResult(message string) any {
+	return js.ValueOf(map[string]any{"error": message})
+}
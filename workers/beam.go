@@ -0,0 +1,90 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// PipelineDoFn is a DoFn for the Apache Beam Go SDK that runs a hugot pipeline on a PCollection of strings
+// and emits key-value pairs of each input and its pipeline output encoded as JSON. Register it and apply it
+// with beam.ParDo:
+//
+//	beam.RegisterType(reflect.TypeOf((*workers.PipelineDoFn)(nil)).Elem())
+//	scored := beam.ParDo(s, workers.NewPipelineDoFn(sessionSpec, pipelineSpec), texts)
+//
+// The pipeline is created lazily when a worker sets up its first DoFn instance and shared by all the instances
+// of the worker, and the elements are run through it in batches of BatchSize. The same approach works in
+// other dataflow engines that have setup, per-element, end-of-bundle and teardown hooks, such as Spark with
+// mapPartitions through a Go worker.
+type PipelineDoFn struct {
+	Session   SessionSpec
+	Pipeline  PipelineSpec
+	BatchSize int
+
+	inputs []string
+}
+
+// NewPipelineDoFn creates a DoFn running the given pipeline in batches of 32 inputs.
+func NewPipelineDoFn(session SessionSpec, pipeline PipelineSpec) *PipelineDoFn {
+	return &PipelineDoFn{
+		Session:   session,
+		Pipeline:  pipeline,
+		BatchSize: 32,
+	}
+}
+
+// Setup acquires the shared pipeline of the worker, creating it if needed.
+func (f *PipelineDoFn) Setup() error {
+	if f.BatchSize <= 0 {
+		return errors.New("batch size must be greater than zero")
+	}
+	_, err := AcquirePipeline(f.Session, f.Pipeline)
+	return err
+}
+
+// ProcessElement buffers the input and runs the pipeline once a batch is full.
+func (f *PipelineDoFn) ProcessElement(ctx context.Context, input string, emit func(string, string)) error {
+	f.inputs = append(f.inputs, input)
+	if len(f.inputs) < f.BatchSize {
+		return nil
+	}
+	return f.flush(ctx, emit)
+}
+
+// FinishBundle runs the pipeline on the inputs buffered since the last full batch.
+func (f *PipelineDoFn) FinishBundle(ctx context.Context, emit func(string, string)) error {
+	return f.flush(ctx, emit)
+}
+
+// Teardown releases the shared pipeline. The session of the worker is destroyed with its last pipeline.
+func (f *PipelineDoFn) Teardown() error {
+	f.inputs = nil
+	return ReleasePipeline(f.Pipeline.Name)
+}
+
+func (f *PipelineDoFn) flush(ctx context.Context, emit func(string, string)) error {
+	if len(f.inputs) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pipeline, err := lookupPipeline(f.Pipeline.Name)
+	if err != nil {
+		return err
+	}
+	output, err := pipeline.Run(f.inputs)
+	if err != nil {
+		return err
+	}
+	for i, result := range output.GetOutput() {
+		resultJSON, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			return marshalErr
+		}
+		emit(f.inputs[i], string(resultJSON))
+	}
+	f.inputs = f.inputs[:0]
+	return nil
+}
@@ -0,0 +1,57 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+func TestPipelineDoFn(t *testing.T) {
+	sessionSpec := SessionSpec{OnnxLibraryPath: "/usr/lib64/onnxruntime.so"}
+	pipelineSpec := PipelineSpec{
+		Type:      "textClassification",
+		Name:      "sentiment",
+		ModelPath: "../models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+	}
+
+	// two instances of the DoFn on the same worker share the pipeline
+	first := NewPipelineDoFn(sessionSpec, pipelineSpec)
+	first.BatchSize = 2
+	second := NewPipelineDoFn(sessionSpec, pipelineSpec)
+	assert.NoError(t, first.Setup())
+	assert.NoError(t, second.Setup())
+
+	outputs := map[string]string{}
+	emit := func(input string, output string) {
+		outputs[input] = output
+	}
+	ctx := context.Background()
+	assert.NoError(t, first.ProcessElement(ctx, "This movie is disgustingly good !", emit))
+	assert.Len(t, outputs, 0)
+	assert.NoError(t, first.ProcessElement(ctx, "The director tried too much", emit))
+	assert.Len(t, outputs, 2)
+	assert.NoError(t, first.ProcessElement(ctx, "What a waste of time", emit))
+	assert.Len(t, outputs, 2)
+	assert.NoError(t, first.FinishBundle(ctx, emit))
+	assert.Len(t, outputs, 3)
+
+	var classes []pipelines.ClassificationOutput
+	assert.NoError(t, json.Unmarshal([]byte(outputs["This movie is disgustingly good !"]), &classes))
+	assert.Equal(t, "POSITIVE", classes[0].Label)
+	assert.NoError(t, json.Unmarshal([]byte(outputs["What a waste of time"]), &classes))
+	assert.Equal(t, "NEGATIVE", classes[0].Label)
+
+	// a different pipeline under the same name is rejected
+	conflicting := pipelineSpec
+	conflicting.MultiLabel = true
+	_, err := AcquirePipeline(sessionSpec, conflicting)
+	assert.Error(t, err)
+
+	assert.NoError(t, first.Teardown())
+	assert.NoError(t, second.Teardown())
+	assert.Error(t, ReleasePipeline(pipelineSpec.Name))
+}
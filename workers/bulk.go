@@ -0,0 +1,429 @@
+package workers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// BulkEmbedding is the embedding of a document of a bulk embedding job.
+type BulkEmbedding struct {
+	Index     int64 // position of the document in the input
+	Embedding []float32
+}
+
+// BulkStats reports the progress of a bulk embedding job.
+type BulkStats struct {
+	Documents          int64 // documents embedded and written
+	Batches            int64
+	InputBytes         int64 // bytes of text of the documents written
+	SpilledBatches     int64 // batches spilled to disk because the writer fell behind
+	PeakMemoryBytes    int64 // highest memory reserved by the inputs in flight and the buffered embeddings
+	Elapsed            time.Duration
+	DocumentsPerSecond float64
+}
+
+// BulkEmbedder runs embedding jobs over millions of documents in bounded memory. Documents are read in batches,
+// embedded by Concurrency goroutines and written in input order. Each batch reserves memory for its texts and
+// its embeddings until it is written, and reading waits while MaxMemoryBytes are reserved, so a slow writer
+// applies backpressure to the whole job. With a SpillDir, embedded batches that would take more than half of
+// the memory while they wait for the writer are spilled to a temporary file instead, so that embedding carries
+// on. Progress, if set, is called with the statistics of the job after each batch is written.
+type BulkEmbedder struct {
+	Pipeline       pipelines.Pipeline // a featureExtraction pipeline
+	BatchSize      int                // documents embedded in a single pipeline run, 32 by default
+	Concurrency    int                // batches embedded concurrently, 1 by default
+	MaxMemoryBytes int64              // memory reserved by the batches in flight, 256MiB by default
+	SpillDir       string             // directory of the spill file, spilling is disabled if empty
+	Progress       func(BulkStats)
+}
+
+// NewBulkEmbedder creates a bulk embedder on a feature extraction pipeline.
+func NewBulkEmbedder(pipeline pipelines.Pipeline) *BulkEmbedder {
+	return &BulkEmbedder{
+		Pipeline:       pipeline,
+		BatchSize:      32,
+		Concurrency:    1,
+		MaxMemoryBytes: 256 << 20,
+	}
+}
+
+// ReadLines returns a document source for BulkEmbedder.Run that reads one document per line.
+func ReadLines(r io.Reader) func() (string, error) {
+	reader := bufio.NewReader(r)
+	return func() (string, error) {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+}
+
+// bulkBatch is a batch of documents of a bulk embedding job, from reading until writing.
+type bulkBatch struct {
+	sequence   int64
+	index      int64    // index of the first document of the batch
+	texts      []string // dropped once embedded
+	documents  int
+	inputBytes int64
+	reserved   int64 // memory reserved for the batch, released once it is written or spilled
+	embeddings [][]float32
+	spilled    bool
+	offset     int64 // of the embeddings in the spill file
+	size       int64
+}
+
+// bulkBuffer holds the memory reservations of a job and the queue of the batches ready to be written.
+type bulkBuffer struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	limit     int64
+	reserved  int64
+	queued    int64 // memory reserved by the batches in the queue
+	peak      int64
+	ready     []*bulkBatch
+	done      bool // no more batches will be queued
+	cancelled bool
+}
+
+func newBulkBuffer(limit int64) *bulkBuffer {
+	buffer := &bulkBuffer{limit: limit}
+	buffer.cond = sync.NewCond(&buffer.mutex)
+	return buffer
+}
+
+// reserve waits until the memory is available, or until the job is cancelled. A batch larger than the limit is
+// allowed on its own so that the job cannot stall.
+func (b *bulkBuffer) reserve(bytes int64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for !b.cancelled && b.reserved > 0 && b.reserved+bytes > b.limit {
+		b.cond.Wait()
+	}
+	if b.cancelled {
+		return false
+	}
+	b.reserved += bytes
+	b.peak = max(b.peak, b.reserved)
+	return true
+}
+
+func (b *bulkBuffer) release(bytes int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reserved -= bytes
+	b.cond.Broadcast()
+}
+
+// shouldSpill tells whether a batch would take the memory held by the queued batches above half of the limit.
+func (b *bulkBuffer) shouldSpill(batch *bulkBatch) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.queued+batch.reserved > b.limit/2
+}
+
+func (b *bulkBuffer) push(batch *bulkBatch) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.ready = append(b.ready, batch)
+	if !batch.spilled {
+		b.queued += batch.reserved
+	}
+	b.cond.Broadcast()
+}
+
+// pop returns the next batch to write, or nil once all batches are written or the job is cancelled.
+func (b *bulkBuffer) pop() *bulkBatch {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for !b.cancelled && !b.done && len(b.ready) == 0 {
+		b.cond.Wait()
+	}
+	if b.cancelled || len(b.ready) == 0 {
+		return nil
+	}
+	batch := b.ready[0]
+	b.ready = b.ready[1:]
+	if !batch.spilled {
+		b.queued -= batch.reserved
+	}
+	return batch
+}
+
+func (b *bulkBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.done = true
+	b.cond.Broadcast()
+}
+
+func (b *bulkBuffer) cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cancelled = true
+	b.cond.Broadcast()
+}
+
+// Run embeds the documents returned by next until it returns io.EOF, and passes their embeddings to write in
+// input order, one batch at a time. The job stops at the first error of next, of the pipeline or of write, or
+// when the context is cancelled.
+func (e *BulkEmbedder) Run(ctx context.Context, next func() (string, error), write func([]BulkEmbedding) error) (stats BulkStats, err error) {
+	if e.Pipeline == nil {
+		return stats, errors.New("the bulk embedder has no pipeline")
+	}
+	if e.BatchSize <= 0 || e.Concurrency <= 0 || e.MaxMemoryBytes <= 0 {
+		return stats, errors.New("batch size, concurrency and memory limit must be greater than zero")
+	}
+	var spillFile *os.File
+	if e.SpillDir != "" {
+		if spillFile, err = os.CreateTemp(e.SpillDir, "hugot-bulk-*.spill"); err != nil {
+			return stats, err
+		}
+		defer func() {
+			err = errors.Join(err, spillFile.Close(), os.Remove(spillFile.Name()))
+		}()
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	buffer := newBulkBuffer(e.MaxMemoryBytes)
+	stopBuffer := context.AfterFunc(ctx, buffer.cancel)
+	defer stopBuffer()
+	embeddingBytes := e.embeddingBytes()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	batches := make(chan *bulkBatch)
+	results := make(chan *bulkBatch)
+
+	// read the documents in batches, reserving memory for each batch
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(batches)
+		var index, sequence int64
+		for {
+			batch := &bulkBatch{sequence: sequence, index: index}
+			var readErr error
+			for len(batch.texts) < e.BatchSize {
+				var text string
+				if text, readErr = next(); readErr != nil {
+					break
+				}
+				batch.texts = append(batch.texts, text)
+				batch.inputBytes += int64(len(text))
+			}
+			if readErr != nil && readErr != io.EOF {
+				cancel(fmt.Errorf("cannot read document %d: %w", index+int64(len(batch.texts)), readErr))
+				return
+			}
+			batch.documents = len(batch.texts)
+			if batch.documents > 0 {
+				batch.reserved = batch.inputBytes + int64(batch.documents)*embeddingBytes
+				if !buffer.reserve(batch.reserved) {
+					return
+				}
+				select {
+				case batches <- batch:
+				case <-ctx.Done():
+					buffer.release(batch.reserved)
+					return
+				}
+				index += int64(batch.documents)
+				sequence++
+			}
+			if readErr == io.EOF {
+				return
+			}
+		}
+	}()
+
+	// embed the batches
+	var embedders sync.WaitGroup
+	for range e.Concurrency {
+		embedders.Add(1)
+		go func() {
+			defer embedders.Done()
+			for batch := range batches {
+				if ctx.Err() == nil {
+					if embedErr := e.embed(batch); embedErr != nil {
+						cancel(embedErr)
+					}
+				}
+				results <- batch
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		embedders.Wait()
+		close(results)
+	}()
+
+	// queue the embedded batches in input order, spilling them if the writer falls behind
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer buffer.close()
+		pending := map[int64]*bulkBatch{}
+		var nextSequence, spillOffset int64
+		for batch := range results {
+			if ctx.Err() != nil {
+				buffer.release(batch.reserved)
+				continue
+			}
+			pending[batch.sequence] = batch
+			for ready, ok := pending[nextSequence]; ok; ready, ok = pending[nextSequence] {
+				delete(pending, nextSequence)
+				nextSequence++
+				if spillFile != nil && buffer.shouldSpill(ready) {
+					size, spillErr := spillEmbeddings(spillFile, spillOffset, ready.embeddings)
+					if spillErr != nil {
+						cancel(fmt.Errorf("cannot spill embeddings: %w", spillErr))
+						buffer.release(ready.reserved)
+						break
+					}
+					ready.spilled, ready.offset, ready.size, ready.embeddings = true, spillOffset, size, nil
+					spillOffset += size
+					buffer.release(ready.reserved)
+				}
+				buffer.push(ready)
+			}
+		}
+		for _, batch := range pending {
+			buffer.release(batch.reserved)
+		}
+	}()
+
+	// write the batches
+	for batch := buffer.pop(); batch != nil; batch = buffer.pop() {
+		if writeErr := e.write(spillFile, batch, write); writeErr != nil {
+			cancel(writeErr)
+			break
+		}
+		if batch.spilled {
+			stats.SpilledBatches++
+		} else {
+			buffer.release(batch.reserved)
+		}
+		stats.Documents += int64(batch.documents)
+		stats.Batches++
+		stats.InputBytes += batch.inputBytes
+		stats.Elapsed = time.Since(start)
+		stats.DocumentsPerSecond = float64(stats.Documents) / math.Max(stats.Elapsed.Seconds(), 1e-9)
+		buffer.mutex.Lock()
+		stats.PeakMemoryBytes = buffer.peak
+		buffer.mutex.Unlock()
+		if e.Progress != nil {
+			e.Progress(stats)
+		}
+	}
+	buffer.cancel()
+	wg.Wait()
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return stats, cause
+	}
+	return stats, ctx.Err()
+}
+
+// embeddingBytes estimates the memory of an embedding from the output dimensions of the pipeline.
+func (e *BulkEmbedder) embeddingBytes() int64 {
+	dimension := int64(1024)
+	if outputs := e.Pipeline.GetMetadata().OutputsInfo; len(outputs) > 0 && len(outputs[0].Dimensions) > 0 {
+		if last := outputs[0].Dimensions[len(outputs[0].Dimensions)-1]; last > 0 {
+			dimension = last
+		}
+	}
+	return 4 * dimension
+}
+
+func (e *BulkEmbedder) embed(batch *bulkBatch) error {
+	var output pipelines.PipelineBatchOutput
+	var err error
+	if embedder, ok := e.Pipeline.(*pipelines.FeatureExtractionPipeline); ok {
+		// with the document prefix of the pipeline, if any
+		output, err = embedder.EmbedDocuments(batch.texts)
+	} else {
+		output, err = e.Pipeline.Run(batch.texts)
+	}
+	if err != nil {
+		return err
+	}
+	embeddings, ok := output.(*pipelines.FeatureExtractionOutput)
+	if !ok {
+		return fmt.Errorf("bulk embedding requires a feature extraction pipeline, the pipeline returned %T", output)
+	}
+	if len(embeddings.Embeddings) != len(batch.texts) {
+		return fmt.Errorf("the pipeline returned %d embeddings for %d documents", len(embeddings.Embeddings), len(batch.texts))
+	}
+	batch.embeddings = embeddings.Embeddings
+	batch.texts = nil
+	return nil
+}
+
+func (e *BulkEmbedder) write(spillFile *os.File, batch *bulkBatch, write func([]BulkEmbedding) error) error {
+	embeddings := batch.embeddings
+	if batch.spilled {
+		var err error
+		if embeddings, err = readSpilledEmbeddings(spillFile, batch.offset, batch.size); err != nil {
+			return fmt.Errorf("cannot read spilled embeddings: %w", err)
+		}
+	}
+	output := make([]BulkEmbedding, len(embeddings))
+	for i, embedding := range embeddings {
+		output[i] = BulkEmbedding{Index: batch.index + int64(i), Embedding: embedding}
+	}
+	return write(output)
+}
+
+// spillEmbeddings writes the embeddings at offset in the spill file, each as its length followed by its values,
+// and returns the number of bytes written.
+func spillEmbeddings(file *os.File, offset int64, embeddings [][]float32) (int64, error) {
+	size := 0
+	for _, embedding := range embeddings {
+		size += 4 + 4*len(embedding)
+	}
+	data := make([]byte, 0, size)
+	for _, embedding := range embeddings {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(embedding)))
+		for _, value := range embedding {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(value))
+		}
+	}
+	_, err := file.WriteAt(data, offset)
+	return int64(size), err
+}
+
+func readSpilledEmbeddings(file *os.File, offset int64, size int64) ([][]float32, error) {
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	var embeddings [][]float32
+	for len(data) >= 4 {
+		dimension := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		if len(data) < 4*dimension {
+			return nil, errors.New("truncated spill file")
+		}
+		embedding := make([]float32, dimension)
+		for i := range embedding {
+			embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+		}
+		embeddings = append(embeddings, embedding)
+		data = data[4*dimension:]
+	}
+	return embeddings, nil
+}
@@ -0,0 +1,104 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// lengthPipeline is a test feature extraction pipeline that embeds texts as their length.
+type lengthPipeline struct{}
+
+func (p *lengthPipeline) Destroy() error     { return nil }
+func (p *lengthPipeline) GetStats() []string { return nil }
+func (p *lengthPipeline) Validate() error    { return nil }
+func (p *lengthPipeline) GetMetadata() pipelines.PipelineMetadata {
+	return pipelines.PipelineMetadata{OutputsInfo: []pipelines.OutputInfo{{Dimensions: []int64{-1, 2}}}}
+}
+func (p *lengthPipeline) Run(inputs []string) (pipelines.PipelineBatchOutput, error) {
+	output := &pipelines.FeatureExtractionOutput{}
+	for _, input := range inputs {
+		if input == "fail" {
+			return nil, errors.New("pipeline failure")
+		}
+		output.Embeddings = append(output.Embeddings, []float32{float32(len(input)), 1})
+	}
+	return output, nil
+}
+
+func TestBulkEmbedder(t *testing.T) {
+	var lines []string
+	for i := range 1000 {
+		lines = append(lines, strings.Repeat("a", i%50))
+	}
+	input := strings.Join(lines, "\n") + "\n"
+
+	// a slow writer makes the embedder spill, and the embeddings are still written in input order
+	spillDir := t.TempDir()
+	embedder := NewBulkEmbedder(&lengthPipeline{})
+	embedder.BatchSize = 10
+	embedder.Concurrency = 4
+	embedder.MaxMemoryBytes = 2000
+	embedder.SpillDir = spillDir
+	progressCalls := 0
+	embedder.Progress = func(BulkStats) { progressCalls++ }
+	var written []BulkEmbedding
+	stats, err := embedder.Run(context.Background(), ReadLines(strings.NewReader(input)), func(batch []BulkEmbedding) error {
+		time.Sleep(time.Millisecond)
+		written = append(written, batch...)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, written, 1000)
+	for i, embedding := range written {
+		assert.Equal(t, int64(i), embedding.Index)
+		assert.Equal(t, []float32{float32(i % 50), 1}, embedding.Embedding)
+	}
+	assert.Equal(t, int64(1000), stats.Documents)
+	assert.Equal(t, int64(100), stats.Batches)
+	assert.Equal(t, 100, progressCalls)
+	assert.Greater(t, stats.SpilledBatches, int64(0))
+	assert.Greater(t, stats.DocumentsPerSecond, 0.0)
+	spillFiles, err := os.ReadDir(spillDir)
+	assert.NoError(t, err)
+	assert.Empty(t, spillFiles)
+
+	// without spilling, the writer applies backpressure and the memory stays bounded
+	embedder.SpillDir = ""
+	embedder.Progress = nil
+	stats, err = embedder.Run(context.Background(), ReadLines(strings.NewReader(input)), func([]BulkEmbedding) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), stats.SpilledBatches)
+	assert.LessOrEqual(t, stats.PeakMemoryBytes, int64(2000))
+
+	// errors of the pipeline, of the writer and of the source stop the job
+	_, err = embedder.Run(context.Background(), ReadLines(strings.NewReader(input+"fail\n")), func([]BulkEmbedding) error { return nil })
+	assert.ErrorContains(t, err, "pipeline failure")
+	_, err = embedder.Run(context.Background(), ReadLines(strings.NewReader(input)), func([]BulkEmbedding) error { return errors.New("disk full") })
+	assert.ErrorContains(t, err, "disk full")
+	read := 0
+	_, err = embedder.Run(context.Background(), func() (string, error) {
+		read++
+		if read > 25 {
+			return "", fmt.Errorf("connection lost")
+		}
+		return "text", nil
+	}, func([]BulkEmbedding) error { return nil })
+	assert.ErrorContains(t, err, "cannot read document 25: connection lost")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = embedder.Run(ctx, ReadLines(strings.NewReader(input)), func([]BulkEmbedding) error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+}
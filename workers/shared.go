@@ -0,0 +1,106 @@
+package workers
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// sharedPipelines holds the process-wide session and the pipelines created in it. Since there can only be one
+// hugot session per process, all the shared pipelines live in the same session, which is destroyed when the
+// last pipeline is released.
+var sharedPipelines = struct {
+	sync.Mutex
+	session     *hugot.Session
+	sessionSpec SessionSpec
+	pipelines   map[string]*sharedPipeline
+}{pipelines: map[string]*sharedPipeline{}}
+
+type sharedPipeline struct {
+	spec       PipelineSpec
+	pipeline   pipelines.Pipeline
+	references int
+}
+
+// AcquirePipeline returns the process-wide pipeline with the spec's name, creating it, and the session if needed,
+// on first use. Every call must be matched by a call to ReleasePipeline.
+func AcquirePipeline(sessionSpec SessionSpec, spec PipelineSpec) (pipelines.Pipeline, error) {
+	if spec.Name == "" {
+		return nil, errors.New("a name for the pipeline is required")
+	}
+	sharedPipelines.Lock()
+	defer sharedPipelines.Unlock()
+
+	if shared, ok := sharedPipelines.pipelines[spec.Name]; ok {
+		if !reflect.DeepEqual(shared.spec, spec) {
+			return nil, fmt.Errorf("pipeline %s is already in use with a different spec", spec.Name)
+		}
+		shared.references++
+		return shared.pipeline, nil
+	}
+
+	if sharedPipelines.session == nil {
+		session, err := NewSessionFromSpec(sessionSpec)
+		if err != nil {
+			return nil, err
+		}
+		sharedPipelines.session = session
+		sharedPipelines.sessionSpec = sessionSpec
+	} else if sharedPipelines.sessionSpec != sessionSpec {
+		return nil, errors.New("the shared session is already in use with a different spec")
+	}
+	pipeline, err := NewPipelineFromSpec(sharedPipelines.session, spec)
+	if err != nil {
+		if len(sharedPipelines.pipelines) == 0 {
+			err = errors.Join(err, destroySharedSession())
+		}
+		return nil, err
+	}
+	sharedPipelines.pipelines[spec.Name] = &sharedPipeline{spec: spec, pipeline: pipeline, references: 1}
+	return pipeline, nil
+}
+
+// ReleasePipeline releases a pipeline acquired with AcquirePipeline. When no pipeline is in use any more,
+// the session is destroyed along with all its pipelines.
+func ReleasePipeline(name string) error {
+	sharedPipelines.Lock()
+	defer sharedPipelines.Unlock()
+
+	shared, ok := sharedPipelines.pipelines[name]
+	if !ok {
+		return fmt.Errorf("pipeline %s is not in use", name)
+	}
+	shared.references--
+	for _, p := range sharedPipelines.pipelines {
+		if p.references > 0 {
+			return nil
+		}
+	}
+	return destroySharedSession()
+}
+
+// lookupPipeline returns a pipeline currently acquired with AcquirePipeline.
+func lookupPipeline(name string) (pipelines.Pipeline, error) {
+	sharedPipelines.Lock()
+	defer sharedPipelines.Unlock()
+
+	shared, ok := sharedPipelines.pipelines[name]
+	if !ok || shared.references == 0 {
+		return nil, fmt.Errorf("pipeline %s is not in use", name)
+	}
+	return shared.pipeline, nil
+}
+
+func destroySharedSession() error {
+	session := sharedPipelines.session
+	sharedPipelines.session = nil
+	sharedPipelines.pipelines = map[string]*sharedPipeline{}
+	if session == nil {
+		return nil
+	}
+	return session.Destroy()
+}
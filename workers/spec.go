@@ -0,0 +1,371 @@
+// Package workers runs hugot pipelines inside long-lived worker processes, such as Apache Beam workers or
+// Temporal workers. Pipelines are described by serializable specs, created lazily on first use, and shared
+// by all the work items processed by the same process, since loading a model for every item is too slow.
+package workers
+
+import (
+	"fmt"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// SessionSpec is the serializable configuration of a hugot session.
+type SessionSpec struct {
+	OnnxLibraryPath string `json:"onnxLibraryPath"`
+	Cuda            bool   `json:"cuda"`
+}
+
+// PipelineSpec is the serializable configuration of a pipeline.
+type PipelineSpec struct {
+	Type               string             `json:"type"` // featureExtraction, textClassification, tokenClassification, zeroShotClassification, fillMask, rerank, textGeneration, text2TextGeneration, speechRecognition, imageClassification, zeroShotImageClassification, colBERT, zeroShotNER, speakerDiarization, formality, moderation, languageDetection, rewardScoring or chat
+	Name               string             `json:"name"`
+	ModelPath          string             `json:"modelPath"`
+	OnnxFilename       string             `json:"onnxFilename"`
+	Normalization      bool               `json:"normalization"`      // featureExtraction
+	OutputName         string             `json:"outputName"`         // featureExtraction and colBERT
+	Pooling            string             `json:"pooling"`            // featureExtraction: MEAN, CLS or MAX
+	QueryPrefix        string             `json:"queryPrefix"`        // featureExtraction, e.g. "query: " for E5 models, for the query inputs
+	DocumentPrefix     string             `json:"documentPrefix"`     // featureExtraction, e.g. "passage: " for E5 models, for the document inputs
+	Dimensions         int                `json:"dimensions"`         // featureExtraction, truncates the embeddings of Matryoshka models to their first dimensions
+	MultiLabel         bool               `json:"multiLabel"`         // textClassification and zeroShotClassification
+	Aggregation        string             `json:"aggregation"`        // tokenClassification: SIMPLE or NONE
+	IgnoreLabels       []string           `json:"ignoreLabels"`       // tokenClassification
+	Labels             []string           `json:"labels"`             // zeroShotClassification, zeroShotImageClassification and zeroShotNER
+	HypothesisTemplate string             `json:"hypothesisTemplate"` // zeroShotClassification and zeroShotImageClassification
+	TopK               int                `json:"topK"`               // fillMask, textGeneration and imageClassification
+	TopP               float32            `json:"topP"`               // textGeneration
+	MaxNewTokens       int                `json:"maxNewTokens"`       // textGeneration, text2TextGeneration and speechRecognition
+	Prefix             string             `json:"prefix"`             // text2TextGeneration, e.g. "summarize: " for T5 models
+	DecoderFilename    string             `json:"decoderFilename"`    // text2TextGeneration
+	StopSequences      []string           `json:"stopSequences"`      // textGeneration
+	Language           string             `json:"language"`           // speechRecognition, detected if empty
+	Translate          bool               `json:"translate"`          // speechRecognition, translate to English
+	Timestamps         bool               `json:"timestamps"`         // speechRecognition
+	VAD                bool               `json:"vad"`                // speechRecognition, transcribe only the speech found by energy based voice activity detection
+	NumSpeakers        int                `json:"numSpeakers"`        // speakerDiarization, estimated if 0
+	LabelMapping       map[string]string  `json:"labelMapping"`       // formality and languageDetection
+	Thresholds         map[string]float32 `json:"thresholds"`         // textClassification with multiLabel, formality and moderation
+	Threshold          float32            `json:"threshold"`          // languageDetection, below which the language is unknown, zeroShotNER, speakerDiarization, and textClassification and moderation for the labels without a threshold
+	Temperature        float32            `json:"temperature"`        // formality and textGeneration
+	ChatTemplate       string             `json:"chatTemplate"`       // chat, the template of the model if empty
+	Regex              string             `json:"regex"`              // textGeneration, chat and text2TextGeneration, which the generated text must match
+	JSONSchema         string             `json:"jsonSchema"`         // textGeneration, chat and text2TextGeneration, which the generated JSON must be valid for
+	NumBeams           int                `json:"numBeams"`           // textGeneration, chat and text2TextGeneration, beam search if greater than 1
+	LengthPenalty      float32            `json:"lengthPenalty"`      // textGeneration, chat and text2TextGeneration, of beam search, 1 if 0
+	EarlyStopping      bool               `json:"earlyStopping"`      // textGeneration, chat and text2TextGeneration, of beam search
+	PromptCacheSize    int                `json:"promptCacheSize"`    // textGeneration and chat, number of sequences whose past key values are kept for the next prompts
+}
+
+// NewSessionFromSpec creates a hugot session from its spec.
+func NewSessionFromSpec(spec SessionSpec) (*hugot.Session, error) {
+	var opts []hugot.WithOption
+	if spec.OnnxLibraryPath != "" {
+		opts = append(opts, hugot.WithOnnxLibraryPath(spec.OnnxLibraryPath))
+	}
+	if spec.Cuda {
+		opts = append(opts, hugot.WithCuda(map[string]string{}))
+	}
+	return hugot.NewSession(opts...)
+}
+
+// NewPipelineFromSpec creates a pipeline in the session from its spec.
+func NewPipelineFromSpec(session *hugot.Session, spec PipelineSpec) (pipelines.Pipeline, error) {
+	switch spec.Type {
+	case "featureExtraction":
+		var options []hugot.FeatureExtractionOption
+		if spec.Normalization {
+			options = append(options, pipelines.WithNormalization())
+		}
+		if spec.OutputName != "" {
+			options = append(options, pipelines.WithOutputName(spec.OutputName))
+		}
+		if spec.Pooling != "" {
+			options = append(options, pipelines.WithPooling(spec.Pooling))
+		}
+		if spec.QueryPrefix != "" || spec.DocumentPrefix != "" {
+			options = append(options, pipelines.WithEmbeddingPrefixes(spec.QueryPrefix, spec.DocumentPrefix))
+		}
+		if spec.Dimensions > 0 {
+			options = append(options, pipelines.WithTruncatedDimensions(spec.Dimensions))
+		}
+		return hugot.NewPipeline(session, hugot.FeatureExtractionConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "textClassification":
+		var options []hugot.TextClassificationOption
+		if spec.MultiLabel {
+			options = append(options, pipelines.WithMultiLabel())
+		}
+		if len(spec.Thresholds) > 0 || spec.Threshold != 0 {
+			options = append(options, pipelines.WithThresholds(spec.Thresholds, spec.Threshold))
+		}
+		return hugot.NewPipeline(session, hugot.TextClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "tokenClassification":
+		var options []hugot.TokenClassificationOption
+		switch spec.Aggregation {
+		case "", "SIMPLE":
+			options = append(options, pipelines.WithSimpleAggregation())
+		case "NONE":
+			options = append(options, pipelines.WithoutAggregation())
+		default:
+			return nil, fmt.Errorf("aggregation %s is not supported", spec.Aggregation)
+		}
+		if len(spec.IgnoreLabels) > 0 {
+			options = append(options, pipelines.WithIgnoreLabels(spec.IgnoreLabels))
+		}
+		return hugot.NewPipeline(session, hugot.TokenClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "zeroShotClassification":
+		options := []pipelines.PipelineOption[*pipelines.ZeroShotClassificationPipeline]{
+			pipelines.WithLabels(spec.Labels),
+			pipelines.WithMultilabel(spec.MultiLabel),
+		}
+		if spec.HypothesisTemplate != "" {
+			options = append(options, pipelines.WithHypothesisTemplate(spec.HypothesisTemplate))
+		}
+		return hugot.NewPipeline(session, hugot.ZeroShotClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "fillMask":
+		var options []hugot.FillMaskOption
+		if spec.TopK != 0 {
+			options = append(options, pipelines.WithTopK(spec.TopK))
+		}
+		return hugot.NewPipeline(session, hugot.FillMaskConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "rerank":
+		return hugot.NewPipeline(session, hugot.RerankConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+		})
+	case "textGeneration":
+		return hugot.NewPipeline(session, textGenerationConfig(spec))
+	case "chat":
+		generator, err := hugot.NewPipeline(session, textGenerationConfig(spec))
+		if err != nil {
+			return nil, err
+		}
+		return pipelines.NewChatPipeline(generator, spec.ChatTemplate)
+	case "text2TextGeneration":
+		var options []hugot.Text2TextGenerationOption
+		if spec.MaxNewTokens != 0 {
+			options = append(options, pipelines.WithMaxNewTokens(spec.MaxNewTokens))
+		}
+		if spec.Prefix != "" {
+			options = append(options, pipelines.WithPrefix(spec.Prefix))
+		}
+		if spec.DecoderFilename != "" {
+			options = append(options, pipelines.WithDecoderFilename(spec.DecoderFilename))
+		}
+		if spec.Regex != "" {
+			options = append(options, pipelines.WithDecoderRegex(spec.Regex))
+		}
+		if spec.JSONSchema != "" {
+			options = append(options, pipelines.WithDecoderJSONSchema(spec.JSONSchema))
+		}
+		if spec.NumBeams != 0 {
+			options = append(options, pipelines.WithDecoderBeamSearch(spec.NumBeams, lengthPenalty(spec), spec.EarlyStopping))
+		}
+		return hugot.NewPipeline(session, hugot.Text2TextGenerationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "speechRecognition":
+		var options []hugot.SpeechRecognitionOption
+		if spec.MaxNewTokens != 0 {
+			options = append(options, pipelines.WithTranscriptionTokens(spec.MaxNewTokens))
+		}
+		if spec.Language != "" {
+			options = append(options, pipelines.WithLanguage(spec.Language))
+		}
+		if spec.Translate {
+			options = append(options, pipelines.WithTranslation())
+		}
+		if spec.Timestamps {
+			options = append(options, pipelines.WithTimestamps())
+		}
+		if spec.VAD {
+			options = append(options, pipelines.WithVoiceActivityDetection(pipelines.NewEnergyVAD()))
+		}
+		return hugot.NewPipeline(session, hugot.SpeechRecognitionConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "imageClassification":
+		var options []hugot.ImageClassificationOption
+		if spec.TopK != 0 {
+			options = append(options, pipelines.WithTopLabels(spec.TopK))
+		}
+		return hugot.NewPipeline(session, hugot.ImageClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "zeroShotImageClassification":
+		options := []hugot.ZeroShotImageClassificationOption{pipelines.WithImageLabels(spec.Labels)}
+		if spec.HypothesisTemplate != "" {
+			options = append(options, pipelines.WithImageHypothesisTemplate(spec.HypothesisTemplate))
+		}
+		return hugot.NewPipeline(session, hugot.ZeroShotImageClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "colBERT":
+		var options []hugot.ColBERTOption
+		if spec.OutputName != "" {
+			options = append(options, pipelines.WithTokenOutputName(spec.OutputName))
+		}
+		return hugot.NewPipeline(session, hugot.ColBERTConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "zeroShotNER":
+		options := []hugot.ZeroShotNEROption{pipelines.WithEntityLabels(spec.Labels)}
+		if spec.Threshold > 0 {
+			options = append(options, pipelines.WithEntityThreshold(spec.Threshold))
+		}
+		return hugot.NewPipeline(session, hugot.ZeroShotNERConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "speakerDiarization":
+		options := []hugot.SpeakerDiarizationOption{pipelines.WithNumSpeakers(spec.NumSpeakers)}
+		if spec.Threshold > 0 {
+			options = append(options, pipelines.WithSpeakerThreshold(spec.Threshold))
+		}
+		return hugot.NewPipeline(session, hugot.SpeakerDiarizationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+			Options:      options,
+		})
+	case "formality":
+		classifier, err := hugot.NewPipeline(session, hugot.TextClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+		})
+		if err != nil {
+			return nil, err
+		}
+		formality, err := pipelines.NewFormalityPipeline(classifier, spec.LabelMapping, spec.Thresholds)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Temperature != 0 {
+			formality.Temperature = spec.Temperature
+		}
+		return formality, nil
+	case "moderation":
+		classifier, err := hugot.NewPipeline(session, hugot.TextClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+		})
+		if err != nil {
+			return nil, err
+		}
+		moderation, err := pipelines.NewModerationPipeline(classifier, spec.Thresholds)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Threshold != 0 {
+			moderation.DefaultThreshold = spec.Threshold
+		}
+		return moderation, nil
+	case "languageDetection":
+		classifier, err := hugot.NewPipeline(session, hugot.TextClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return pipelines.NewLanguageDetectionPipeline(classifier, spec.LabelMapping, spec.Threshold)
+	case "rewardScoring":
+		classifier, err := hugot.NewPipeline(session, hugot.TextClassificationConfig{
+			ModelPath:    spec.ModelPath,
+			Name:         spec.Name,
+			OnnxFilename: spec.OnnxFilename,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return pipelines.NewRewardScoringPipeline(classifier)
+	default:
+		return nil, fmt.Errorf("pipeline type %s not implemented", spec.Type)
+	}
+}
+
+// textGenerationConfig is the config of the text generation pipeline of a spec, of the textGeneration or chat type.
+func textGenerationConfig(spec PipelineSpec) hugot.TextGenerationConfig {
+	var options []hugot.TextGenerationOption
+	if spec.MaxNewTokens != 0 {
+		options = append(options, pipelines.WithMaxTokens(spec.MaxNewTokens))
+	}
+	if spec.Temperature != 0 {
+		options = append(options, pipelines.WithSampling(spec.Temperature, spec.TopK, spec.TopP))
+	}
+	if len(spec.StopSequences) > 0 {
+		options = append(options, pipelines.WithStopSequences(spec.StopSequences...))
+	}
+	if spec.Regex != "" {
+		options = append(options, pipelines.WithRegex(spec.Regex))
+	}
+	if spec.JSONSchema != "" {
+		options = append(options, pipelines.WithJSONSchema(spec.JSONSchema))
+	}
+	if spec.NumBeams != 0 {
+		options = append(options, pipelines.WithBeamSearch(spec.NumBeams, lengthPenalty(spec), spec.EarlyStopping))
+	}
+	if spec.PromptCacheSize != 0 {
+		options = append(options, pipelines.WithPromptCache(spec.PromptCacheSize))
+	}
+	return hugot.TextGenerationConfig{
+		ModelPath:    spec.ModelPath,
+		Name:         spec.Name,
+		OnnxFilename: spec.OnnxFilename,
+		Options:      options,
+	}
+}
+
+// lengthPenalty is the beam search length penalty of a spec, 1 if it is not set.
+func lengthPenalty(spec PipelineSpec) float32 {
+	if spec.LengthPenalty == 0 {
+		return 1
+	}
+	return spec.LengthPenalty
+}
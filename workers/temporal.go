@@ -0,0 +1,130 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+// Activities are activity implementations for Temporal workers, or any queue worker that runs functions taking a
+// context and a list of texts. Register them on a Temporal worker with:
+//
+//	activities := workers.NewActivities(sessionSpec)
+//	activities.Classification = workers.PipelineSpec{Type: "textClassification", Name: "sentiment", ModelPath: "./models/sentiment"}
+//	activities.Heartbeat = activity.RecordHeartbeat
+//	w.RegisterActivity(activities)
+//
+// which registers the Embed, Classify and ExtractEntities activities. The pipelines are acquired from the shared
+// pipelines of the process on first use and reused by all the following activity invocations on the worker.
+// The inputs of an invocation are run in batches of BatchSize, and Heartbeat, if set, is called after each batch
+// with the number of inputs processed so far, so that long invocations are not timed out. The invocation is
+// stopped between batches when its context is cancelled.
+type Activities struct {
+	Session        SessionSpec
+	Embedding      PipelineSpec // featureExtraction pipeline used by Embed
+	Classification PipelineSpec // textClassification pipeline used by Classify
+	Extraction     PipelineSpec // tokenClassification pipeline used by ExtractEntities
+	BatchSize      int
+	Heartbeat      func(ctx context.Context, details ...any)
+
+	mutex     sync.Mutex
+	pipelines map[string]pipelines.Pipeline
+}
+
+// NewActivities creates activities running their inputs in batches of 32. Set the specs of the pipelines used by
+// the activities before registering them.
+func NewActivities(session SessionSpec) *Activities {
+	return &Activities{
+		Session:   session,
+		BatchSize: 32,
+	}
+}
+
+// Embed returns the embeddings of the inputs.
+func (a *Activities) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	return runActivity(ctx, a, a.Embedding, inputs, func(output pipelines.PipelineBatchOutput) ([][]float32, bool) {
+		embeddings, ok := output.(*pipelines.FeatureExtractionOutput)
+		if !ok {
+			return nil, false
+		}
+		return embeddings.Embeddings, true
+	})
+}
+
+// Classify returns the classes of the inputs.
+func (a *Activities) Classify(ctx context.Context, inputs []string) ([][]pipelines.ClassificationOutput, error) {
+	return runActivity(ctx, a, a.Classification, inputs, func(output pipelines.PipelineBatchOutput) ([][]pipelines.ClassificationOutput, bool) {
+		classes, ok := output.(*pipelines.TextClassificationOutput)
+		if !ok {
+			return nil, false
+		}
+		return classes.ClassificationOutputs, true
+	})
+}
+
+// ExtractEntities returns the entities found in the inputs.
+func (a *Activities) ExtractEntities(ctx context.Context, inputs []string) ([][]pipelines.Entity, error) {
+	return runActivity(ctx, a, a.Extraction, inputs, func(output pipelines.PipelineBatchOutput) ([][]pipelines.Entity, bool) {
+		entities, ok := output.(*pipelines.TokenClassificationOutput)
+		if !ok {
+			return nil, false
+		}
+		return entities.Entities, true
+	})
+}
+
+// pipeline returns the pipeline of the spec, acquiring it on the first invocation of the activities.
+func (a *Activities) pipeline(spec PipelineSpec) (pipelines.Pipeline, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if pipeline, ok := a.pipelines[spec.Name]; ok {
+		return pipeline, nil
+	}
+	pipeline, err := AcquirePipeline(a.Session, spec)
+	if err != nil {
+		return nil, err
+	}
+	if a.pipelines == nil {
+		a.pipelines = map[string]pipelines.Pipeline{}
+	}
+	a.pipelines[spec.Name] = pipeline
+	return pipeline, nil
+}
+
+// runActivity runs the inputs through the pipeline of the spec in batches, heartbeating after each batch,
+// and collects the outputs of each batch with convert.
+func runActivity[T any](ctx context.Context, a *Activities, spec PipelineSpec, inputs []string, convert func(pipelines.PipelineBatchOutput) ([]T, bool)) ([]T, error) {
+	if spec.Type == "" {
+		return nil, errors.New("no pipeline is configured for this activity")
+	}
+	if a.BatchSize <= 0 {
+		return nil, errors.New("batch size must be greater than zero")
+	}
+	pipeline, err := a.pipeline(spec)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]T, 0, len(inputs))
+	for batchStart := 0; batchStart < len(inputs); batchStart += a.BatchSize {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		output, runErr := pipeline.Run(inputs[batchStart:min(batchStart+a.BatchSize, len(inputs))])
+		if runErr != nil {
+			return nil, runErr
+		}
+		batchResults, ok := convert(output)
+		if !ok {
+			return nil, fmt.Errorf("pipeline %s of type %s cannot be used for this activity", spec.Name, spec.Type)
+		}
+		results = append(results, batchResults...)
+		if a.Heartbeat != nil {
+			a.Heartbeat(ctx, len(results))
+		}
+	}
+	return results, nil
+}
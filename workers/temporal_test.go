@@ -0,0 +1,46 @@
+package workers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivities(t *testing.T) {
+	activities := NewActivities(SessionSpec{OnnxLibraryPath: "/usr/lib64/onnxruntime.so"})
+	activities.Classification = PipelineSpec{
+		Type:      "textClassification",
+		Name:      "sentiment",
+		ModelPath: "../models/KnightsAnalytics_distilbert-base-uncased-finetuned-sst-2-english",
+	}
+	activities.BatchSize = 2
+	var heartbeats []any
+	activities.Heartbeat = func(_ context.Context, details ...any) {
+		heartbeats = append(heartbeats, details...)
+	}
+
+	ctx := context.Background()
+	classes, err := activities.Classify(ctx, []string{"This movie is disgustingly good !", "The director tried too much", "What a waste of time"})
+	assert.NoError(t, err)
+	assert.Len(t, classes, 3)
+	assert.Equal(t, "POSITIVE", classes[0][0].Label)
+	assert.Equal(t, "NEGATIVE", classes[2][0].Label)
+	assert.Equal(t, []any{2, 3}, heartbeats)
+
+	// the pipeline is reused by the following invocations
+	classes, err = activities.Classify(ctx, []string{"What a waste of time"})
+	assert.NoError(t, err)
+	assert.Equal(t, "NEGATIVE", classes[0][0].Label)
+
+	// activities without a configured pipeline fail
+	_, err = activities.Embed(ctx, []string{"What a waste of time"})
+	assert.Error(t, err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = activities.Classify(cancelled, []string{"What a waste of time"})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	assert.NoError(t, ReleasePipeline("sentiment"))
+}